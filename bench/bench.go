@@ -0,0 +1,401 @@
+/*
+Package bench runs walker against a synthetic site to measure its throughput
+
+Run starts a local HTTP server that generates a site graph of Options.Domains
+domains with Options.Pages pages each, seeds the root page of every domain,
+and runs a FetchManager (and optionally a Dispatcher) until every page has
+been fetched or Options.Timeout passes. Every request is routed to the local
+server regardless of the host it names, so no DNS or network access is needed.
+
+The resulting Report gives fetch throughput, request latencies and the
+allocations made while the crawl ran, so it can be compared between builds to
+track performance regressions. It is usually run with `walker bench`.
+*/
+package bench
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// Options describes the site generated for a benchmark and how long to run
+type Options struct {
+	// Number of domains in the site
+	Domains int
+
+	// Number of pages on each domain
+	Pages int
+
+	// Number of links on each page. Each page links to the next page on its
+	// domain (so every page is reachable from the root), the rest of the links
+	// go to random pages of random domains.
+	FanOut int
+
+	// How long the server waits before answering each request
+	Latency time.Duration
+
+	// Approximate size of each page body in bytes
+	PageSize int
+
+	// Crawl delay used in place of fetcher.default_crawl_delay while the
+	// benchmark runs
+	CrawlDelay time.Duration
+
+	// How long to wait for the whole site to be fetched
+	Timeout time.Duration
+
+	// Seed for generating links, so runs with the same options crawl the
+	// same site
+	Seed int64
+}
+
+// DefaultOptions returns the Options used by `walker bench` when no flags are
+// given
+func DefaultOptions() Options {
+	return Options{
+		Domains:  10,
+		Pages:    100,
+		FanOut:   10,
+		Latency:  10 * time.Millisecond,
+		PageSize: 10 * 1024,
+		Timeout:  5 * time.Minute,
+		Seed:     1,
+	}
+}
+
+func (o Options) check() error {
+	if o.Domains < 1 || o.Pages < 1 {
+		return fmt.Errorf("Need at least one domain and one page per domain, got %d domains of %d pages",
+			o.Domains, o.Pages)
+	}
+	if o.FanOut < 1 {
+		return fmt.Errorf("FanOut must be at least 1, got %d", o.FanOut)
+	}
+	if o.Latency < 0 || o.CrawlDelay < 0 || o.PageSize < 0 {
+		return fmt.Errorf("Latency, CrawlDelay and PageSize can't be negative")
+	}
+	if o.Timeout <= 0 {
+		return fmt.Errorf("Timeout must be positive, got %v", o.Timeout)
+	}
+	return nil
+}
+
+// Report holds the results of a benchmark run
+type Report struct {
+	// Number of pages in the generated site
+	Pages int
+
+	// Number of fetch results stored, including repeated fetches of a page
+	Fetches int
+
+	// Number of distinct pages fetched
+	Distinct int
+
+	// Number of fetches that failed with a FetchError
+	Errors int
+
+	// True if every page was fetched before the timeout
+	Complete bool
+
+	// Time from starting the crawl until every page was fetched (or the
+	// timeout)
+	Elapsed time.Duration
+
+	// Request latencies (time to response headers, including the server's
+	// Options.Latency), robots.txt requests included
+	Requests                           int
+	LatencyP50, LatencyP90, LatencyP99 time.Duration
+	LatencyMax                         time.Duration
+
+	// Allocations made by the process during the run, which includes the
+	// benchmark's own server
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+// Throughput returns the number of fetches per second
+func (r *Report) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Fetches) / r.Elapsed.Seconds()
+}
+
+// Print writes the report with printf, one line per measurement
+func (r *Report) Print(printf func(format string, args ...interface{})) {
+	complete := "complete"
+	if !r.Complete {
+		complete = "timed out"
+	}
+	printf("Pages:       %d (%d fetched, %s)\n", r.Pages, r.Distinct, complete)
+	printf("Fetches:     %d (%d errors)\n", r.Fetches, r.Errors)
+	printf("Elapsed:     %v\n", r.Elapsed)
+	printf("Throughput:  %.1f fetches/sec\n", r.Throughput())
+	printf("Requests:    %d\n", r.Requests)
+	printf("Latency:     p50 %v  p90 %v  p99 %v  max %v\n", r.LatencyP50, r.LatencyP90, r.LatencyP99,
+		r.LatencyMax)
+	var perFetch, bytesPerFetch uint64
+	if r.Fetches > 0 {
+		perFetch = r.Allocs / uint64(r.Fetches)
+		bytesPerFetch = r.AllocBytes / uint64(r.Fetches)
+	}
+	printf("Allocations: %d (%d bytes), %d (%d bytes) per fetch\n", r.Allocs, r.AllocBytes, perFetch,
+		bytesPerFetch)
+}
+
+// Run crawls a site generated from opts and reports how it went. ds is the
+// datastore to crawl with; if nil a new MemoryDatastore is used. dispatcher is
+// started alongside the fetchers if it isn't nil (datastores like cassandra's
+// need one to generate segments). handler receives the fetch results, and
+// may be nil to discard them.
+func Run(opts Options, ds walker.Datastore, dispatcher walker.Dispatcher, handler walker.Handler) (*Report, error) {
+	if err := opts.check(); err != nil {
+		return nil, err
+	}
+
+	origDelay := walker.Config.Fetcher.DefaultCrawlDelay
+	defer func() { walker.Config.Fetcher.DefaultCrawlDelay = origDelay }()
+	walker.Config.Fetcher.DefaultCrawlDelay = opts.CrawlDelay.String()
+
+	s := &site{opts: opts}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to listen for the benchmark site: %v", err)
+	}
+	defer listener.Close()
+	go http.Serve(listener, s)
+
+	if ds == nil {
+		ds = NewMemoryDatastore()
+	}
+	if handler == nil {
+		handler = discardHandler{}
+	}
+	rec := &recordingDatastore{
+		Datastore: ds,
+		total:     opts.Domains * opts.Pages,
+		fetched:   map[string]bool{},
+		done:      make(chan struct{}),
+	}
+	transport := &siteTransport{
+		addr:      listener.Addr().String(),
+		transport: &http.Transport{},
+	}
+
+	for d := 0; d < opts.Domains; d++ {
+		ds.StoreParsedURL(walker.MustParse(s.pageURL(d, 0)), nil)
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	manager, err := walker.NewFetchManager(
+		walker.WithDatastore(rec),
+		walker.WithHandler(handler),
+		walker.WithTransport(transport),
+	)
+	if err != nil {
+		return nil, err
+	}
+	go manager.Start()
+	if dispatcher != nil {
+		go func() {
+			if err := dispatcher.StartDispatcher(); err != nil {
+				log4go.Error("Benchmark dispatcher failed: %v", err)
+			}
+		}()
+	}
+
+	complete := true
+	select {
+	case <-rec.done:
+	case <-time.After(opts.Timeout):
+		complete = false
+	}
+	elapsed := time.Since(start)
+
+	if dispatcher != nil {
+		dispatcher.StopDispatcher()
+	}
+	manager.Stop()
+	runtime.ReadMemStats(&after)
+
+	r := &Report{
+		Pages:      rec.total,
+		Complete:   complete,
+		Elapsed:    elapsed,
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}
+	rec.mu.Lock()
+	r.Fetches, r.Distinct, r.Errors = rec.fetches, len(rec.fetched), rec.errors
+	rec.mu.Unlock()
+	transport.latencies(r)
+	return r, nil
+}
+
+// site serves the generated pages. Page p of domain d is at
+// http://bench<d>.com/page<p>.html, and its links are generated from
+// Options.Seed so they are the same every time it is requested.
+type site struct {
+	opts Options
+}
+
+func (s *site) pageURL(domain, page int) string {
+	return fmt.Sprintf("http://bench%d.com/page%d.html", domain, page)
+}
+
+// ServeHTTP implements http.Handler
+func (s *site) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.opts.Latency)
+
+	if r.URL.Path == "/robots.txt" {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, "User-agent: *\nDisallow:\n")
+		return
+	}
+
+	domain, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Host, "bench"), ".com"))
+	if err != nil || domain < 0 || domain >= s.opts.Domains {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/page"), ".html"))
+	if err != nil || page < 0 || page >= s.opts.Pages {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	fmt.Fprint(w, s.page(domain, page))
+}
+
+// page returns the body of a page
+func (s *site) page(domain, page int) string {
+	rnd := rand.New(rand.NewSource(s.opts.Seed + int64(domain*s.opts.Pages+page)))
+	var body []string
+	body = append(body, fmt.Sprintf("<html><head><title>bench%d.com page %d</title></head><body>", domain, page))
+	if page+1 < s.opts.Pages {
+		body = append(body, fmt.Sprintf(`<a href="%s">next</a>`, s.pageURL(domain, page+1)))
+	}
+	for i := 1; i < s.opts.FanOut; i++ {
+		link := s.pageURL(rnd.Intn(s.opts.Domains), rnd.Intn(s.opts.Pages))
+		body = append(body, fmt.Sprintf(`<a href="%s">link %d</a>`, link, i))
+	}
+
+	size := 0
+	for _, b := range body {
+		size += len(b)
+	}
+	if pad := s.opts.PageSize - size - len("<p></p></body></html>"); pad > 0 {
+		body = append(body, "<p>"+strings.Repeat("x", pad)+"</p>")
+	}
+	body = append(body, "</body></html>")
+	return strings.Join(body, "\n")
+}
+
+// siteTransport sends every request to the benchmark site, keeping the
+// requested host in the Host header, and records how long each took
+type siteTransport struct {
+	addr      string
+	transport http.RoundTripper
+
+	mu    sync.Mutex
+	times []time.Duration
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *siteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := *req
+	u := *req.URL
+	u.Host = t.addr
+	r.URL = &u
+	if r.Host == "" {
+		r.Host = req.URL.Host
+	}
+
+	start := time.Now()
+	res, err := t.transport.RoundTrip(&r)
+	took := time.Since(start)
+
+	t.mu.Lock()
+	t.times = append(t.times, took)
+	t.mu.Unlock()
+	return res, err
+}
+
+// latencies fills in the request count and latency percentiles of r
+func (t *siteTransport) latencies(r *Report) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r.Requests = len(t.times)
+	if len(t.times) == 0 {
+		return
+	}
+	sorted := append([]time.Duration(nil), t.times...)
+	sort.Sort(byDuration(sorted))
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	r.LatencyP50 = percentile(50)
+	r.LatencyP90 = percentile(90)
+	r.LatencyP99 = percentile(99)
+	r.LatencyMax = sorted[len(sorted)-1]
+}
+
+type byDuration []time.Duration
+
+func (d byDuration) Len() int           { return len(d) }
+func (d byDuration) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDuration) Less(i, j int) bool { return d[i] < d[j] }
+
+// recordingDatastore wraps the benchmark's datastore to count fetches, and
+// closes done once every page of the site has been fetched
+type recordingDatastore struct {
+	walker.Datastore
+
+	mu      sync.Mutex
+	total   int
+	fetches int
+	errors  int
+	fetched map[string]bool
+	done    chan struct{}
+}
+
+// StoreURLFetchResults implements walker.Datastore
+func (ds *recordingDatastore) StoreURLFetchResults(fr *walker.FetchResults) {
+	ds.Datastore.StoreURLFetchResults(fr)
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.fetches++
+	if fr.FetchError != nil {
+		ds.errors++
+	}
+	if ds.fetched[fr.URL.String()] || len(ds.fetched) >= ds.total {
+		return
+	}
+	ds.fetched[fr.URL.String()] = true
+	if len(ds.fetched) == ds.total {
+		close(ds.done)
+	}
+}
+
+// discardHandler is used when Run isn't given a handler
+type discardHandler struct{}
+
+// HandleResponse implements walker.Handler
+func (discardHandler) HandleResponse(fr *walker.FetchResults) {}
@@ -0,0 +1,66 @@
+package bench
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+func init() {
+	walker.LoadTestConfig("test-walker.yaml")
+}
+
+func TestRunFetchesWholeSite(t *testing.T) {
+	opts := Options{
+		Domains:  3,
+		Pages:    5,
+		FanOut:   3,
+		PageSize: 512,
+		Timeout:  30 * time.Second,
+		Seed:     1,
+	}
+	r, err := Run(opts, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !r.Complete {
+		t.Fatalf("Expected the whole site to be fetched, got %d of %d pages", r.Distinct, r.Pages)
+	}
+	if r.Pages != 15 || r.Distinct != 15 {
+		t.Errorf("Expected 15 pages fetched, got %d of %d", r.Distinct, r.Pages)
+	}
+	if r.Errors != 0 {
+		t.Errorf("Expected no fetch errors, got %d", r.Errors)
+	}
+	if r.Requests < r.Fetches || r.LatencyMax < r.LatencyP50 {
+		t.Errorf("Bad latency report: %d requests for %d fetches, p50 %v max %v",
+			r.Requests, r.Fetches, r.LatencyP50, r.LatencyMax)
+	}
+}
+
+func TestSitePage(t *testing.T) {
+	s := &site{opts: Options{Domains: 2, Pages: 4, FanOut: 5, PageSize: 2048, Seed: 7}}
+	body := s.page(1, 2)
+	if body != s.page(1, 2) {
+		t.Errorf("Expected the same page to be generated each time")
+	}
+	if len(body) < 2048 {
+		t.Errorf("Expected page to be padded to 2048 bytes, got %d", len(body))
+	}
+	if !strings.Contains(body, `<a href="http://bench1.com/page3.html">next</a>`) {
+		t.Errorf("Expected page to link to the next page on its domain:\n%v", body)
+	}
+}
+
+func TestOptionsCheck(t *testing.T) {
+	if err := DefaultOptions().check(); err != nil {
+		t.Errorf("Expected default options to be valid, got %v", err)
+	}
+	bad := DefaultOptions()
+	bad.FanOut = 0
+	if err := bad.check(); err == nil {
+		t.Errorf("Expected FanOut of 0 to be rejected")
+	}
+}
@@ -0,0 +1,11 @@
+package bench
+
+import "github.com/iParadigms/walker"
+
+// MemoryDatastore is walker.MemoryDatastore, which started out here
+type MemoryDatastore = walker.MemoryDatastore
+
+// NewMemoryDatastore creates an empty MemoryDatastore
+func NewMemoryDatastore() *MemoryDatastore {
+	return walker.NewMemoryDatastore()
+}
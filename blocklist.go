@@ -0,0 +1,392 @@
+package walker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// Blocklist is a source of domains that must never be crawled, ex. a threat
+// or adult content feed. Blocklists are configured with blocklist.lists
+// entries of the form "<type>:<location>"; see RegisterBlocklistType.
+type Blocklist interface {
+	// Name identifies the list in logs and counts; it is the config entry the
+	// list was created from
+	Name() string
+
+	// Load (re)reads the list. It is called before the list is first used and
+	// then every blocklist.refresh_interval. If it fails, the list should keep
+	// what it had loaded before.
+	Load() error
+
+	// Contains returns true if host is on the list
+	Contains(host string) bool
+}
+
+// BlocklistFactory creates a Blocklist named name from the location part of a
+// blocklist.lists entry.
+type BlocklistFactory func(name, location string) (Blocklist, error)
+
+var blocklistTypes = map[string]BlocklistFactory{
+	"file":  newFileBlocklist,
+	"url":   newURLBlocklist,
+	"dnsbl": newDNSBlocklist,
+}
+
+// RegisterBlocklistType makes blocklist.lists entries starting with "<typ>:"
+// create their Blocklist with factory. The built in types are:
+//
+//	file:<path>    a file of domains, one per line (hosts file format works)
+//	url:<url>      the same, downloaded over HTTP
+//	dnsbl:<zone>   a DNS blocklist; a host is listed if <host>.<zone> resolves
+func RegisterBlocklistType(typ string, factory BlocklistFactory) {
+	blocklistTypes[typ] = factory
+}
+
+// Blocklists checks hosts against a group of Blocklists, counting how many
+// lookups each one blocked.
+type Blocklists struct {
+	lists []Blocklist
+
+	mu     sync.Mutex
+	counts map[string]int64
+
+	quit chan struct{}
+}
+
+// NewBlocklists creates the Blocklists for the given blocklist.lists entries.
+// The lists are not loaded until Load is called.
+func NewBlocklists(entries []string) (*Blocklists, error) {
+	b := &Blocklists{counts: map[string]int64{}}
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Blocklist %q should be of the form <type>:<location>", entry)
+		}
+		factory, ok := blocklistTypes[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("Blocklist %q has unknown type %q", entry, parts[0])
+		}
+		list, err := factory(entry, parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create blocklist %q: %v", entry, err)
+		}
+		b.lists = append(b.lists, list)
+		b.counts[entry] = 0
+	}
+	return b, nil
+}
+
+// Load loads (or reloads) every list, logging any that fail
+func (b *Blocklists) Load() {
+	for _, list := range b.lists {
+		if err := list.Load(); err != nil {
+			log4go.Error("Failed to load blocklist %v: %v", list.Name(), err)
+		}
+	}
+	log4go.Info("Loaded blocklists, blocked so far: %v", b.Counts())
+}
+
+// Refresh reloads the lists every interval until Stop is called
+func (b *Blocklists) Refresh(interval time.Duration) {
+	b.quit = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.Load()
+			case <-b.quit:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing the lists
+func (b *Blocklists) Stop() {
+	if b.quit != nil {
+		close(b.quit)
+		b.quit = nil
+	}
+}
+
+// Blocked returns the name of the first list host is on, or "" if it isn't
+// on any. Each time a host is blocked it is counted against the list.
+func (b *Blocklists) Blocked(host string) string {
+	name := b.lookup(host)
+	if name != "" {
+		b.mu.Lock()
+		b.counts[name]++
+		b.mu.Unlock()
+	}
+	return name
+}
+
+// lookup is Blocked without counting the lookup
+func (b *Blocklists) lookup(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, list := range b.lists {
+		if list.Contains(host) {
+			return list.Name()
+		}
+	}
+	return ""
+}
+
+// Counts returns how many lookups each list has blocked, by list name
+func (b *Blocklists) Counts() map[string]int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counts := make(map[string]int64, len(b.counts))
+	for name, n := range b.counts {
+		counts[name] = n
+	}
+	return counts
+}
+
+// The Blocklists for Config.Blocklist, created on first use by
+// DomainBlocklisted, and the config entries they were created from
+var configBlocklists *Blocklists
+var configBlocklistsEntries string
+var configBlocklistsMu sync.Mutex
+
+// configuredBlocklists returns the Blocklists for Config.Blocklist, loading
+// them (and starting their refresh) if the config has changed since they were
+// last loaded. It returns nil if no lists are configured.
+func configuredBlocklists() *Blocklists {
+	configBlocklistsMu.Lock()
+	defer configBlocklistsMu.Unlock()
+
+	entries := strings.Join(Config.Blocklist.Lists, "\n")
+	if configBlocklists != nil && entries == configBlocklistsEntries {
+		return configBlocklists
+	}
+
+	if configBlocklists != nil {
+		configBlocklists.Stop()
+		configBlocklists = nil
+	}
+	configBlocklistsEntries = entries
+	if len(Config.Blocklist.Lists) == 0 {
+		return nil
+	}
+
+	b, err := NewBlocklists(Config.Blocklist.Lists)
+	if err != nil {
+		log4go.Error("Not using blocklists: %v", err)
+		return nil
+	}
+	b.Load()
+	interval, err := time.ParseDuration(Config.Blocklist.RefreshInterval)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	if interval > 0 {
+		b.Refresh(interval)
+	}
+	configBlocklists = b
+	return b
+}
+
+// DomainBlocklisted returns the name of the configured blocklist (see
+// blocklist.lists) that domain is on, or "" if it isn't on any.
+func DomainBlocklisted(domain string) string {
+	b := configuredBlocklists()
+	if b == nil {
+		return ""
+	}
+	return b.Blocked(domain)
+}
+
+// BlocklistHandler serves how many lookups each configured blocklist has
+// blocked in this process, as JSON. cmd registers it at /debug/blocklists on
+// the debug (pprof) listener.
+func BlocklistHandler(w http.ResponseWriter, r *http.Request) {
+	counts := map[string]int64{}
+	if b := configuredBlocklists(); b != nil {
+		counts = b.Counts()
+	}
+	buf, err := json.MarshalIndent(counts, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+//
+// Built in blocklist types
+//
+
+// domainSetBlocklist is a Blocklist of domains read in full by load. A host is
+// on the list if it, or any domain it is a subdomain of, is in the set.
+type domainSetBlocklist struct {
+	name string
+	load func() (io.ReadCloser, error)
+
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+func newFileBlocklist(name, path string) (Blocklist, error) {
+	return &domainSetBlocklist{
+		name: name,
+		load: func() (io.ReadCloser, error) {
+			return os.Open(path)
+		},
+	}, nil
+}
+
+// blocklistHTTPTimeout bounds downloading a url: blocklist
+var blocklistHTTPTimeout = 60 * time.Second
+
+func newURLBlocklist(name, url string) (Blocklist, error) {
+	client := &http.Client{Timeout: blocklistHTTPTimeout}
+	return &domainSetBlocklist{
+		name: name,
+		load: func() (io.ReadCloser, error) {
+			res, err := client.Get(url)
+			if err != nil {
+				return nil, err
+			}
+			if res.StatusCode != http.StatusOK {
+				res.Body.Close()
+				return nil, fmt.Errorf("GET %v returned %v", url, res.Status)
+			}
+			return res.Body, nil
+		},
+	}, nil
+}
+
+func (l *domainSetBlocklist) Name() string {
+	return l.name
+}
+
+func (l *domainSetBlocklist) Load() error {
+	r, err := l.load()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	domains, err := readBlocklistDomains(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.domains = domains
+	l.mu.Unlock()
+	log4go.Info("Loaded %v domains from blocklist %v", len(domains), l.name)
+	return nil
+}
+
+func (l *domainSetBlocklist) Contains(host string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for {
+		if l.domains[host] {
+			return true
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// readBlocklistDomains reads one domain per line, ignoring blank lines and #
+// comments. Lines with more than one field are read like a hosts file, taking
+// the names after the address.
+func readBlocklistDomains(r io.Reader) (map[string]bool, error) {
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 {
+			fields = fields[1:]
+		}
+		for _, f := range fields {
+			f = strings.TrimSuffix(strings.ToLower(f), ".")
+			if f != "" && f != "localhost" {
+				domains[f] = true
+			}
+		}
+	}
+	return domains, scanner.Err()
+}
+
+// dnsBlocklist is a Blocklist queried live over DNS. Answers are cached until
+// the next Load.
+type dnsBlocklist struct {
+	name string
+	zone string
+
+	// lookup resolves a host name, net.LookupHost unless testing
+	lookup func(host string) ([]string, error)
+
+	mu    sync.Mutex
+	cache map[string]bool
+}
+
+// dnsBlocklistCacheSize is the most answers a dnsBlocklist keeps between
+// Loads; the cache is cleared when it fills up
+const dnsBlocklistCacheSize = 100000
+
+func newDNSBlocklist(name, zone string) (Blocklist, error) {
+	return &dnsBlocklist{
+		name:   name,
+		zone:   strings.Trim(zone, "."),
+		lookup: net.LookupHost,
+		cache:  map[string]bool{},
+	}, nil
+}
+
+func (l *dnsBlocklist) Name() string {
+	return l.name
+}
+
+func (l *dnsBlocklist) Load() error {
+	l.mu.Lock()
+	l.cache = map[string]bool{}
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *dnsBlocklist) Contains(host string) bool {
+	l.mu.Lock()
+	listed, ok := l.cache[host]
+	l.mu.Unlock()
+	if ok {
+		return listed
+	}
+
+	// Any answer means the host is listed; NXDOMAIN (or any other failure)
+	// is taken to mean it isn't, so an unreachable list blocks nothing
+	addrs, err := l.lookup(host + "." + l.zone)
+	listed = err == nil && len(addrs) > 0
+
+	l.mu.Lock()
+	if len(l.cache) >= dnsBlocklistCacheSize {
+		l.cache = map[string]bool{}
+	}
+	l.cache[host] = listed
+	l.mu.Unlock()
+	return listed
+}
@@ -0,0 +1,107 @@
+package walker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testBlocklist = `# A hosts file style list
+0.0.0.0 bad.com
+127.0.0.1 localhost
+
+worse.com     # plain domain
+0.0.0.0 Evil.org. alsoevil.org
+`
+
+func TestBlocklists(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testBlocklist)
+	f.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "served.com")
+	}))
+	defer srv.Close()
+
+	fileList := "file:" + f.Name()
+	urlList := "url:" + srv.URL
+	dnsList := "dnsbl:dbl.test."
+	b, err := NewBlocklists([]string{fileList, urlList, dnsList})
+	if err != nil {
+		t.Fatalf("NewBlocklists failed: %v", err)
+	}
+	b.lists[2].(*dnsBlocklist).lookup = func(host string) ([]string, error) {
+		if host == "spam.com.dbl.test" {
+			return []string{"127.0.1.2"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	b.Load()
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"bad.com", fileList},
+		{"www.bad.com", fileList},
+		{"notbad.com", ""},
+		{"worse.com", fileList},
+		{"evil.org", fileList},
+		{"alsoevil.org", fileList},
+		{"localhost", ""},
+		{"served.com", urlList},
+		{"spam.com", dnsList},
+		{"SPAM.com.", dnsList},
+		{"fine.com", ""},
+	}
+	for _, tst := range tests {
+		if got := b.Blocked(tst.host); got != tst.expected {
+			t.Errorf("Blocked(%q) = %q, expected %q", tst.host, got, tst.expected)
+		}
+	}
+
+	expCounts := map[string]int64{fileList: 5, urlList: 1, dnsList: 2}
+	if counts := b.Counts(); !reflect.DeepEqual(counts, expCounts) {
+		t.Errorf("Counts() = %v, expected %v", counts, expCounts)
+	}
+}
+
+func TestBlocklistsBadEntries(t *testing.T) {
+	for _, entry := range []string{"nocolon", "file:", "bogus:/tmp/list"} {
+		if _, err := NewBlocklists([]string{entry}); err == nil {
+			t.Errorf("Expected an error creating blocklist %q", entry)
+		}
+	}
+}
+
+func TestBlocklistKeepsListOnFailedLoad(t *testing.T) {
+	ok := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ok {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "bad.com")
+	}))
+	defer srv.Close()
+
+	b, err := NewBlocklists([]string{"url:" + srv.URL})
+	if err != nil {
+		t.Fatalf("NewBlocklists failed: %v", err)
+	}
+	b.Load()
+	ok = false
+	b.Load()
+	if b.Blocked("bad.com") == "" {
+		t.Errorf("Expected bad.com to still be blocked after a failed reload")
+	}
+}
@@ -0,0 +1,209 @@
+package cassandra
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// Host alias detection finds domains that are mirrors of one another, so only
+// one of them is crawled. Every dispatcher.alias_probe_interval the
+// dispatcher probes each domain: it resolves the domain and GETs each of
+// dispatcher.alias_probe_paths, and records the addresses and content
+// fingerprints as the domain's probe_key in domain_info. Domains sharing a
+// probe_key are aliases; all but the canonical one get mirr_for set to it,
+// and are not dispatched unless dispatcher.crawl_aliases is set.
+
+// aliasProber probes domains for host alias detection
+type aliasProber struct {
+	paths      []string
+	client     *http.Client
+	lookupHost func(host string) ([]string, error)
+}
+
+func newAliasProber() *aliasProber {
+	timeout, err := time.ParseDuration(walker.Config.Fetcher.HTTPTimeout)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+	return &aliasProber{
+		paths:      walker.Config.Dispatcher.AliasProbePaths,
+		client:     &http.Client{Timeout: timeout},
+		lookupHost: net.LookupHost,
+	}
+}
+
+// probe returns the probe key of domain: its sorted addresses followed by the
+// status and FNV fingerprint of each probe path. It fails if the domain
+// doesn't resolve or none of the paths could be fetched successfully, since
+// such domains can't be told apart.
+func (p *aliasProber) probe(domain string) (string, error) {
+	addrs, err := p.lookupHost(domain)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", fmt.Errorf("%v has no addresses", domain)
+	}
+	sort.Strings(addrs)
+
+	parts := []string{strings.Join(addrs, ",")}
+	ok := false
+	for _, path := range p.paths {
+		status, fp, err := p.fingerprint("http://" + domain + path)
+		if err != nil {
+			return "", err
+		}
+		ok = ok || (status >= 200 && status < 300)
+		parts = append(parts, fmt.Sprintf("%d:%016x", status, fp))
+	}
+	if !ok {
+		return "", fmt.Errorf("none of the probe paths of %v could be fetched", domain)
+	}
+	return strings.Join(parts, "|"), nil
+}
+
+// fingerprint GETs link, returning the status and the FNV-64 hash of the body
+func (p *aliasProber) fingerprint(link string) (int, uint64, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("User-Agent", walker.Config.Fetcher.UserAgent)
+	res, err := p.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+	h := fnv.New64()
+	_, err = io.Copy(h, io.LimitReader(res.Body, walker.Config.Fetcher.MaxHTTPContentSizeBytes))
+	if err != nil {
+		return 0, 0, err
+	}
+	return res.StatusCode, h.Sum64(), nil
+}
+
+// aliasCandidate is a domain considered by detectAliases
+type aliasCandidate struct {
+	domain    string
+	priority  int
+	excluded  bool
+	key       string
+	probeTime time.Time
+	mirrorOf  string
+}
+
+// canonicalAlias returns the member of a group of aliases that is crawled:
+// the one with the highest priority, then the shortest name, then the first
+// alphabetically
+func canonicalAlias(group []*aliasCandidate) *aliasCandidate {
+	best := group[0]
+	for _, c := range group[1:] {
+		switch {
+		case c.priority != best.priority:
+			if c.priority > best.priority {
+				best = c
+			}
+		case len(c.domain) != len(best.domain):
+			if len(c.domain) < len(best.domain) {
+				best = c
+			}
+		case c.domain < best.domain:
+			best = c
+		}
+	}
+	return best
+}
+
+// detectAliases probes the domains whose probe is older than
+// aliasProbeInterval, then regroups all domains by probe key and updates
+// their mirr_for
+func (d *Dispatcher) detectAliases() {
+	var candidates []*aliasCandidate
+	itr := d.db.Query(`SELECT dom, priority, excluded, probe_key, probe_time, mirr_for FROM domain_info`).Iter()
+	c := &aliasCandidate{}
+	for itr.Scan(&c.domain, &c.priority, &c.excluded, &c.key, &c.probeTime, &c.mirrorOf) {
+		candidates = append(candidates, c)
+		c = &aliasCandidate{}
+	}
+	if err := itr.Close(); err != nil {
+		log4go.Error("Failed to read domains for alias detection: %v", err)
+		return
+	}
+
+	for _, c := range candidates {
+		if c.excluded || time.Since(c.probeTime) < d.aliasProbeInterval {
+			continue
+		}
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+
+		key, err := d.prober.probe(c.domain)
+		if err != nil {
+			log4go.Debug("Failed to probe %v for aliases: %v", c.domain, err)
+		}
+		c.key = key
+		err = d.db.Query(`UPDATE domain_info SET probe_key = ?, probe_time = ? WHERE dom = ?`,
+			key, time.Now(), c.domain).Exec()
+		if err != nil {
+			log4go.Error("Failed to store alias probe of %v: %v", c.domain, err)
+		}
+	}
+
+	groups := map[string][]*aliasCandidate{}
+	for _, c := range candidates {
+		if c.key != "" && !c.excluded {
+			groups[c.key] = append(groups[c.key], c)
+		}
+	}
+	for _, c := range candidates {
+		mirrorOf := ""
+		if group := groups[c.key]; len(group) > 1 && !c.excluded {
+			if canon := canonicalAlias(group); canon != c {
+				mirrorOf = canon.domain
+			}
+		}
+		if mirrorOf == c.mirrorOf {
+			continue
+		}
+		if mirrorOf != "" {
+			log4go.Info("Domain %v is an alias of %v", c.domain, mirrorOf)
+		} else {
+			log4go.Info("Domain %v is no longer an alias of %v", c.domain, c.mirrorOf)
+		}
+		err := d.db.Query(`UPDATE domain_info SET mirr_for = ? WHERE dom = ?`, mirrorOf, c.domain).Exec()
+		if err != nil {
+			log4go.Error("Failed to update mirr_for of %v: %v", c.domain, err)
+		}
+	}
+}
+
+// pollAliases runs detectAliases every minute (or every aliasProbeInterval if
+// that's shorter) until the dispatcher quits
+func (d *Dispatcher) pollAliases() {
+	period := d.aliasProbeInterval
+	if period > time.Minute {
+		period = time.Minute
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+			d.detectAliases()
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package cassandra
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// The audit_log table is partitioned by day so a partition can't grow without
+// bound; ListAudit walks back through days until it has enough entries.
+
+// auditMaxDays is how many days back ListAudit will look for entries
+const auditMaxDays = 90
+
+// auditDay returns the start of the (UTC) day t falls in, the partition key of
+// audit_log
+func auditDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// RecordAudit is documented on the ModelDatastore interface.
+func (ds *Datastore) RecordAudit(entry *AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	err := ds.db.Query(`INSERT INTO audit_log (day, id, time, actor, action, target, detail)
+						VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		auditDay(entry.Time), gocql.UUIDFromTime(entry.Time), entry.Time,
+		entry.Actor, entry.Action, entry.Target, entry.Detail).Exec()
+	if err != nil {
+		return fmt.Errorf("Failed to record audit entry %v %v: %v", entry.Action, entry.Target, err)
+	}
+	return nil
+}
+
+// ListAudit is documented on the ModelDatastore interface.
+func (ds *Datastore) ListAudit(limit int) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	day := auditDay(time.Now())
+	for i := 0; i < auditMaxDays && len(entries) < limit; i++ {
+		itr := ds.db.Query(`SELECT time, actor, action, target, detail FROM audit_log
+							WHERE day = ? LIMIT ?`, day, limit-len(entries)).Iter()
+		var e AuditEntry
+		for itr.Scan(&e.Time, &e.Actor, &e.Action, &e.Target, &e.Detail) {
+			entry := e
+			entries = append(entries, &entry)
+		}
+		if err := itr.Close(); err != nil {
+			return entries, fmt.Errorf("Failed to list audit log for %v: %v", day, err)
+		}
+		day = day.Add(-24 * time.Hour)
+	}
+	return entries, nil
+}
@@ -0,0 +1,54 @@
+package cassandra
+
+import (
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// Newly added domains get a bootstrap boost, so new seeds show results
+// quickly: for dispatcher.new_domain_boost_period after a domain is added
+// (domain_info boost_until), it is claimed with
+// dispatcher.new_domain_priority_boost added to its priority and its
+// segments hold dispatcher.new_domain_segment_multiplier times the usual
+// number of links. After that it is scheduled like any other domain. The
+// boost of a domain can also be set or cleared through /rest/boost.
+
+// boostActive returns true if a domain boosted until until is still boosted
+func boostActive(until time.Time) bool {
+	return !until.IsZero() && time.Now().Before(until)
+}
+
+// boostedPriority returns priority plus the bootstrap priority boost, if the
+// domain is boosted until until
+func boostedPriority(priority int, until time.Time) int {
+	if !boostActive(until) {
+		return priority
+	}
+	return priority + walker.Config.Dispatcher.NewDomainPriorityBoost
+}
+
+// boostedSegmentLimit returns the number of links a segment may hold for a
+// domain boosted until until
+func boostedSegmentLimit(until time.Time) int {
+	limit := walker.Config.Dispatcher.MaxLinksPerSegment
+	if boostActive(until) {
+		limit *= walker.Config.Dispatcher.NewDomainSegmentMultiplier
+	}
+	return limit
+}
+
+// boostValue returns the value to store in domain_info boost_until for a
+// boost lasting until until: null if until is zero, so no boost
+func boostValue(until time.Time) interface{} {
+	if until.IsZero() {
+		return nil
+	}
+	return until
+}
+
+// Boosted returns true if the domain is in its bootstrap boost (see
+// dispatcher.new_domain_boost_period)
+func (d *DomainInfo) Boosted() bool {
+	return boostActive(d.BoostUntil)
+}
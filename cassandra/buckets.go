@@ -0,0 +1,49 @@
+package cassandra
+
+import (
+	"hash/fnv"
+
+	"github.com/iParadigms/walker"
+)
+
+// The links table is partitioned by (dom, bucket) rather than by domain alone,
+// so a huge domain's links (and their fetch history) are spread over
+// cassandra.link_buckets partitions instead of piling up in one. A link's
+// bucket is a hash of its subdomain and path, so all the rows of a link share
+// a partition; queries about one link name its bucket, and queries over a
+// whole domain (or subdomain) ask for all of its buckets with bucket IN ?.
+// With the default of one bucket every link is in bucket 0, and a domain is a
+// single partition as before.
+//
+// Rows of a link are adjacent in a query over all buckets, but links are only
+// in (subdom, path, proto) order within each bucket; code that needs them in
+// order across a domain reads the buckets separately and merges them (see
+// ListLinks).
+
+// LinkBucket returns the bucket of the links table holding the link with the
+// given subdomain and path
+func LinkBucket(subdom, path string) int {
+	n := walker.Config.Cassandra.LinkBuckets
+	if n <= 1 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(subdom))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(n))
+}
+
+// linkBuckets returns every bucket of the links table, to query a whole
+// domain with bucket IN ?
+func linkBuckets() []int {
+	n := walker.Config.Cassandra.LinkBuckets
+	if n < 1 {
+		n = 1
+	}
+	buckets := make([]int, n)
+	for i := range buckets {
+		buckets[i] = i
+	}
+	return buckets
+}
@@ -0,0 +1,66 @@
+package cassandra
+
+import (
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// Burst mode is for one-off full snapshots of a domain, ex. before a site
+// migration. An operator starts it through /rest/burst for a set time
+// (domain_info burst_until). Until then the domain's segments hold
+// dispatcher.burst_segment_multiplier times the usual number of links, only
+// uncrawled ones, a next segment is always generated ahead of the one being
+// crawled, and fetchers crawl it at fetcher.burst_crawl_delay (see
+// Datastore.BurstMode). The dispatcher ends the burst early once a complete
+// scan of the domain finds no uncrawled links left.
+
+// burstActive returns true if a domain in burst mode until until still is
+func burstActive(until time.Time) bool {
+	return !until.IsZero() && time.Now().Before(until)
+}
+
+// burstSegmentLimit returns the number of links a segment may hold for a
+// domain allowed limit links outside of burst mode, in burst mode until until
+func burstSegmentLimit(limit int, until time.Time) int {
+	if burstActive(until) {
+		limit *= walker.Config.Dispatcher.BurstSegmentMultiplier
+	}
+	return limit
+}
+
+// burstPipelineDepth returns how many segments may be generated ahead of the
+// one being crawled for a domain allowed depth outside of burst mode: at least
+// one while it is in burst mode, unless an operator set its max_segs
+func burstPipelineDepth(depth, maxSegments int, until time.Time) int {
+	if burstActive(until) && maxSegments == 0 && depth < 1 {
+		return 1
+	}
+	return depth
+}
+
+// burstValue returns the value to store in domain_info burst_until for a
+// burst lasting until until: null if until is zero, so no burst
+func burstValue(until time.Time) interface{} {
+	if until.IsZero() {
+		return nil
+	}
+	return until
+}
+
+// endBurst takes domain out of burst mode, now that it has no uncrawled links
+// left
+func (d *Dispatcher) endBurst(domain string) {
+	err := d.db.Query(`UPDATE domain_info SET burst_until = null WHERE dom = ?`, domain).Exec()
+	if err != nil {
+		log4go.Error("Failed to end the burst of %v: %v", domain, err)
+		return
+	}
+	log4go.Info("Burst of %v is complete, it has no uncrawled links left", domain)
+}
+
+// Bursting returns true if the domain is in burst mode
+func (d *DomainInfo) Bursting() bool {
+	return burstActive(d.BurstUntil)
+}
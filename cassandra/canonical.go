@@ -0,0 +1,202 @@
+package cassandra
+
+import (
+	"fmt"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// Links are canonicalized when parsed (see walker.URL.Canonicalize), but
+// links stored before that may be in the links table more than once, under
+// keys differing only in the case of their domain, subdomain or protocol, a
+// default port on their domain (ex. example.com:80), or an empty path.
+// Canonicalize merges such links into their canonical form. It is meant to be
+// run once on data stored by older versions of walker.
+
+// CanonicalMerge is a link Canonicalize found stored under a non-canonical key
+type CanonicalMerge struct {
+	// The link as stored, and its canonical form
+	Link      string
+	Canonical string
+
+	// True if the canonical link was already stored, so this one was only a
+	// duplicate. Otherwise the canonical link is stored in its place, as a
+	// parsed link not yet crawled (the fetch history isn't carried over).
+	Duplicate bool
+
+	// True if the link was merged. If merging it was attempted but failed,
+	// Error says why.
+	Repaired bool
+	Error    string
+}
+
+// CanonicalizeReport is the outcome of Canonicalize
+type CanonicalizeReport struct {
+	// Numbers of domains and links checked
+	Domains int
+	Links   int
+
+	Merges []*CanonicalMerge
+
+	// Domains in domain_info whose names aren't canonical, with all their
+	// links merged into other domains. Those that weren't claimed were
+	// deleted from domain_info when repairing.
+	StaleDomains []string
+}
+
+// Repaired returns the number of links merged
+func (r *CanonicalizeReport) Repaired() int {
+	n := 0
+	for _, m := range r.Merges {
+		if m.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// linkKey is the key of a link in the links table, less its bucket and time
+type linkKey struct {
+	subdom, path, proto string
+}
+
+// Canonicalize is documented on the ModelDatastore interface.
+func (ds *Datastore) Canonicalize(repair bool) (*CanonicalizeReport, error) {
+	var domains []string
+	var dom string
+	itr := ds.db.Query(`SELECT dom FROM domain_info`).Iter()
+	for itr.Scan(&dom) {
+		domains = append(domains, dom)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read domain_info: %v", err)
+	}
+
+	r := &CanonicalizeReport{}
+	for _, dom := range domains {
+		r.Domains++
+		if err := ds.canonicalizeDomain(r, dom, repair); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// canonicalizeDomain merges the non-canonical links of dom, adding them to r
+func (ds *Datastore) canonicalizeDomain(r *CanonicalizeReport, dom string, repair bool) error {
+	var links []linkKey
+	seen := map[linkKey]bool{}
+	var l linkKey
+	itr := ds.db.Query(`SELECT subdom, path, proto FROM links WHERE dom = ? AND bucket IN ?`,
+		dom, linkBuckets()).Iter()
+	for itr.Scan(&l.subdom, &l.path, &l.proto) {
+		if !seen[l] {
+			seen[l] = true
+			links = append(links, l)
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return fmt.Errorf("Failed to read links of %v: %v", dom, err)
+	}
+
+	moved := 0
+	for _, l := range links {
+		r.Links++
+		u, err := walker.CreateURL(dom, l.subdom, l.path, l.proto, walker.NotYetCrawled)
+		if err != nil {
+			log4go.Warn("Not canonicalizing unparseable link %v://%v %v of %v: %v", l.proto, l.subdom, l.path, dom, err)
+			continue
+		}
+		cdom, csubdom, err := u.TLDPlusOneAndSubdomain()
+		if err != nil {
+			log4go.Warn("Not canonicalizing %v: %v", u, err)
+			continue
+		}
+		c := linkKey{csubdom, u.RequestURI(), u.Scheme}
+		if cdom == dom && c == l {
+			continue
+		}
+
+		host := dom
+		if l.subdom != "" {
+			host = l.subdom + "." + dom
+		}
+		m := &CanonicalMerge{
+			Link:      fmt.Sprintf("%v://%v%v", l.proto, host, l.path),
+			Canonical: u.String(),
+		}
+		r.Merges = append(r.Merges, m)
+		var found string
+		err = ds.db.Query(`SELECT dom FROM links
+							WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ? LIMIT 1`,
+			cdom, LinkBucket(c.subdom, c.path), c.subdom, c.path, c.proto).Scan(&found)
+		if err == nil {
+			m.Duplicate = true
+		} else if err != gocql.ErrNotFound {
+			return fmt.Errorf("Failed to look up %v: %v", u, err)
+		}
+		if !repair {
+			if cdom != dom {
+				moved++
+			}
+			continue
+		}
+
+		if !m.Duplicate {
+			if !ds.hasDomain(cdom) {
+				ds.addDomain(cdom)
+			}
+			query, values := insertLinkQuery([]dbfield{
+				dbfield{"dom", cdom},
+				dbfield{"bucket", LinkBucket(c.subdom, c.path)},
+				dbfield{"subdom", c.subdom},
+				dbfield{"path", c.path},
+				dbfield{"proto", c.proto},
+				dbfield{"time", walker.NotYetCrawled},
+			})
+			if err := ds.db.Query(query, values...).Exec(); err != nil {
+				log4go.Error("Failed to store canonical link %v: %v", u, err)
+				m.Error = err.Error()
+				continue
+			}
+		}
+		err = ds.db.Query(`DELETE FROM links WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ?`,
+			dom, LinkBucket(l.subdom, l.path), l.subdom, l.path, l.proto).Exec()
+		if err != nil {
+			log4go.Error("Failed to delete non-canonical link %v: %v", m.Link, err)
+			m.Error = err.Error()
+			continue
+		}
+		err = ds.db.Query(`DELETE FROM segments WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+			dom, l.subdom, l.path, l.proto).Exec()
+		if err != nil {
+			log4go.Error("Failed to delete non-canonical link %v from its segment: %v", m.Link, err)
+		}
+		m.Repaired = true
+		if cdom != dom {
+			moved++
+		}
+	}
+
+	if len(links) == 0 || moved < len(links) {
+		return nil
+	}
+	r.StaleDomains = append(r.StaleDomains, dom)
+	if repair {
+		var claimTok gocql.UUID
+		if err := ds.db.Query(`SELECT claim_tok FROM domain_info WHERE dom = ?`, dom).Scan(&claimTok); err != nil {
+			return fmt.Errorf("Failed to read domain_info of %v: %v", dom, err)
+		}
+		if claimTok != (gocql.UUID{}) {
+			log4go.Warn("Not deleting non-canonical domain %v, it is claimed", dom)
+			return nil
+		}
+		if err := ds.db.Query(`DELETE FROM domain_info WHERE dom = ?`, dom).Exec(); err != nil {
+			return fmt.Errorf("Failed to delete non-canonical domain %v: %v", dom, err)
+		}
+		ds.domainCache.Remove(dom)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package cassandra
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// A checkpoint is a stream of JSON objects: one checkpointHeader followed by
+// any number of checkpointRecords, each holding either a domain_info row or a
+// segments row. Streaming keeps memory flat no matter how big the crawl is.
+// Link rows (and so page bodies) are deliberately not included; a checkpoint
+// captures scheduling state only.
+
+const checkpointFormat = "walker-checkpoint"
+const checkpointVersion = 1
+
+type checkpointHeader struct {
+	Format   string    `json:"format"`
+	Version  int       `json:"version"`
+	Created  time.Time `json:"created"`
+	Keyspace string    `json:"keyspace"`
+}
+
+type checkpointRecord struct {
+	Domain  *checkpointDomain  `json:"domain,omitempty"`
+	Segment *checkpointSegment `json:"segment,omitempty"`
+}
+
+// checkpointDomain is a domain_info row. Claim tokens are not exported: they
+// belong to fetchers that won't exist when the checkpoint is imported.
+type checkpointDomain struct {
+	Dom               string    `json:"dom"`
+	Priority          int       `json:"priority"`
+	ClaimTime         time.Time `json:"claim_time"`
+	Dispatched        bool      `json:"dispatched"`
+	Excluded          bool      `json:"excluded"`
+	ExcludeReason     string    `json:"exclude_reason"`
+	TotLinks          int       `json:"tot_links"`
+	UncrawledLinks    int       `json:"uncrawled_links"`
+	QueuedLinks       int       `json:"queued_links"`
+	ErrorLinks        int       `json:"error_links"`
+	ParseErrorLinks   int       `json:"parse_error_links"`
+	RecentLinks       int       `json:"recent_links"`
+	RobotsExLinks     int       `json:"robots_excluded_links"`
+	NoIndexLinks      int       `json:"noindex_links"`
+	NoFollowLinks     int       `json:"nofollow_links"`
+	LastDispatch      time.Time `json:"last_dispatch"`
+	LastEmptyDispatch time.Time `json:"last_empty_dispatch"`
+	ByteQuota         int64     `json:"byte_quota"`
+	QuotaBytes        int64     `json:"quota_bytes"`
+	QuotaDay          time.Time `json:"quota_day"`
+	CrawlDelay        int       `json:"crawl_delay"`
+}
+
+// checkpointSegment is a segments row
+type checkpointSegment struct {
+	Dom      string    `json:"dom"`
+	Subdom   string    `json:"subdom"`
+	Path     string    `json:"path"`
+	Proto    string    `json:"proto"`
+	Time     time.Time `json:"time"`
+	ChainPos int       `json:"chain_pos"`
+	Depth    int       `json:"depth,omitempty"`
+	FNV      int64     `json:"fnv,omitempty"`
+}
+
+// ExportCheckpoint is documented on the ModelDatastore interface.
+func (ds *Datastore) ExportCheckpoint(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	err := enc.Encode(checkpointHeader{
+		Format:   checkpointFormat,
+		Version:  checkpointVersion,
+		Created:  time.Now(),
+		Keyspace: walker.Config.Cassandra.Keyspace,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to write checkpoint header: %v", err)
+	}
+
+	var d checkpointDomain
+	numDomains := 0
+	itr := ds.db.Query(`SELECT dom, priority, claim_time, dispatched, excluded, exclude_reason,
+							tot_links, uncrawled_links, queued_links, error_links, parse_error_links, recent_links,
+							robots_excluded_links, noindex_links, nofollow_links,
+							last_dispatch, last_empty_dispatch, byte_quota, quota_bytes, quota_day, crawl_delay
+						FROM domain_info`).Iter()
+	for itr.Scan(&d.Dom, &d.Priority, &d.ClaimTime, &d.Dispatched, &d.Excluded, &d.ExcludeReason,
+		&d.TotLinks, &d.UncrawledLinks, &d.QueuedLinks, &d.ErrorLinks, &d.ParseErrorLinks, &d.RecentLinks,
+		&d.RobotsExLinks, &d.NoIndexLinks, &d.NoFollowLinks,
+		&d.LastDispatch, &d.LastEmptyDispatch, &d.ByteQuota, &d.QuotaBytes, &d.QuotaDay, &d.CrawlDelay) {
+		if err := enc.Encode(checkpointRecord{Domain: &d}); err != nil {
+			itr.Close()
+			return fmt.Errorf("Failed to write checkpoint domain %v: %v", d.Dom, err)
+		}
+		numDomains++
+	}
+	if err := itr.Close(); err != nil {
+		return fmt.Errorf("Failed to read domain_info for checkpoint: %v", err)
+	}
+
+	var s checkpointSegment
+	numSegments := 0
+	itr = ds.db.Query(`SELECT dom, subdom, path, proto, time, chain_pos, depth, fnv FROM segments`).Iter()
+	for itr.Scan(&s.Dom, &s.Subdom, &s.Path, &s.Proto, &s.Time, &s.ChainPos, &s.Depth, &s.FNV) {
+		if err := enc.Encode(checkpointRecord{Segment: &s}); err != nil {
+			itr.Close()
+			return fmt.Errorf("Failed to write checkpoint segment for %v: %v", s.Dom, err)
+		}
+		numSegments++
+	}
+	if err := itr.Close(); err != nil {
+		return fmt.Errorf("Failed to read segments for checkpoint: %v", err)
+	}
+
+	log4go.Info("Exported checkpoint with %v domains and %v segment links", numDomains, numSegments)
+	return nil
+}
+
+// ImportCheckpoint is documented on the ModelDatastore interface.
+func (ds *Datastore) ImportCheckpoint(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	var hdr checkpointHeader
+	if err := dec.Decode(&hdr); err != nil {
+		return fmt.Errorf("Failed to read checkpoint header: %v", err)
+	}
+	if hdr.Format != checkpointFormat {
+		return fmt.Errorf("Not a walker checkpoint (format %q)", hdr.Format)
+	}
+	if hdr.Version != checkpointVersion {
+		return fmt.Errorf("Unsupported checkpoint version %v (expected %v)", hdr.Version, checkpointVersion)
+	}
+	log4go.Info("Importing checkpoint created %v from keyspace %v", hdr.Created, hdr.Keyspace)
+
+	numDomains := 0
+	numSegments := 0
+	var claimed []string
+	skip := map[string]bool{}
+	for {
+		var rec checkpointRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Failed to read checkpoint record: %v", err)
+		}
+
+		if d := rec.Domain; d != nil {
+			isClaimed, err := ds.isClaimed(d.Dom)
+			if err != nil {
+				return fmt.Errorf("Failed to check claim of %v: %v", d.Dom, err)
+			}
+			if isClaimed {
+				log4go.Warn("Not importing %v, it is claimed by a fetcher", d.Dom)
+				claimed = append(claimed, d.Dom)
+				skip[d.Dom] = true
+				continue
+			}
+			err = ds.db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, claim_time, dispatched,
+									excluded, exclude_reason, tot_links, uncrawled_links, queued_links,
+									error_links, parse_error_links, recent_links, robots_excluded_links, noindex_links,
+									nofollow_links, last_dispatch, last_empty_dispatch, byte_quota,
+									quota_bytes, quota_day, crawl_delay)
+								VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				d.Dom, gocql.UUID{}, d.Priority, d.ClaimTime, d.Dispatched,
+				d.Excluded, d.ExcludeReason, d.TotLinks, d.UncrawledLinks, d.QueuedLinks,
+				d.ErrorLinks, d.ParseErrorLinks, d.RecentLinks, d.RobotsExLinks, d.NoIndexLinks,
+				d.NoFollowLinks, d.LastDispatch, d.LastEmptyDispatch, d.ByteQuota,
+				d.QuotaBytes, d.QuotaDay, d.CrawlDelay).Exec()
+			if err != nil {
+				return fmt.Errorf("Failed to import domain %v: %v", d.Dom, err)
+			}
+			ds.domainCache.Add(d.Dom, true)
+			numDomains++
+		}
+
+		if s := rec.Segment; s != nil && !skip[s.Dom] {
+			err = ds.db.Query(`INSERT INTO segments (dom, subdom, path, proto, time, chain_pos, depth, fnv)
+								VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				s.Dom, s.Subdom, s.Path, s.Proto, s.Time, s.ChainPos, s.Depth, s.FNV).Exec()
+			if err != nil {
+				return fmt.Errorf("Failed to import segment link for %v: %v", s.Dom, err)
+			}
+			numSegments++
+		}
+	}
+
+	log4go.Info("Imported checkpoint with %v domains and %v segment links", numDomains, numSegments)
+	if len(claimed) > 0 {
+		return walker.NewError(walker.ErrAlreadyClaimed,
+			fmt.Errorf("Skipped %v claimed domains: %v", len(claimed), strings.Join(claimed, ", ")))
+	}
+	return nil
+}
+
+// isClaimed returns true if dom is claimed by a fetcher
+func (ds *Datastore) isClaimed(dom string) (bool, error) {
+	var tok gocql.UUID
+	err := ds.db.Query(`SELECT claim_tok FROM domain_info WHERE dom = ?`, dom).Scan(&tok)
+	if err == gocql.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return tok != gocql.UUID{}, nil
+}
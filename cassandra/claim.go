@@ -0,0 +1,150 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// ClaimCandidate is a dispatched, unclaimed domain that ClaimNewHost may
+// claim.
+type ClaimCandidate struct {
+	Domain string
+
+	// The domain's priority (domain_info.priority)
+	Priority int
+
+	// When the domain's current segment was dispatched
+	LastDispatch time.Time
+
+	// The node (see walker.NodeID) that last claimed the domain, or
+	// "" if it hasn't been claimed since nodes were recorded
+	LastNode string
+
+	// The end of the domain's bootstrap boost (domain_info.boost_until)
+	BoostUntil time.Time
+}
+
+// ClaimStrategy decides which domains ClaimNewHost claims, and in what order.
+// The Datastore reads a batch of candidates from domain_info and tries to
+// claim those Order returns, in the order returned; candidates left out are
+// skipped until the next pass. The built in strategies are chosen with
+// cassandra.claim_strategy; others can be set with SetClaimStrategy.
+type ClaimStrategy interface {
+	Order(ds *Datastore, candidates []*ClaimCandidate) []*ClaimCandidate
+}
+
+// newClaimStrategy returns the ClaimStrategy named by
+// Config.Cassandra.ClaimStrategy
+func newClaimStrategy(node string) (ClaimStrategy, error) {
+	switch walker.Config.Cassandra.ClaimStrategy {
+	case "priority":
+		return PriorityClaimStrategy{}, nil
+	case "round_robin":
+		return RoundRobinClaimStrategy{}, nil
+	case "affinity":
+		wait, err := time.ParseDuration(walker.Config.Cassandra.ClaimAffinityWait)
+		if err != nil {
+			panic(err) // This won't happen b/c this duration is checked in Config
+		}
+		return AffinityClaimStrategy{Node: node, Wait: wait}, nil
+	default:
+		return nil, fmt.Errorf("Unknown claim strategy %q", walker.Config.Cassandra.ClaimStrategy)
+	}
+}
+
+// claimNodeID returns the ID of this node (see walker.NodeID)
+func claimNodeID() string {
+	return walker.NodeID()
+}
+
+// PriorityClaimStrategy claims the highest priority candidates first. Each
+// candidate is also only claimed in proportion to its priority (see
+// domainPriorityTry), so low priority domains are claimed less often. Domains
+// in their bootstrap boost are tried with the boost added to their priority.
+type PriorityClaimStrategy struct{}
+
+// Order implements ClaimStrategy
+func (PriorityClaimStrategy) Order(ds *Datastore, candidates []*ClaimCandidate) []*ClaimCandidate {
+	prios := map[string]int{}
+	for _, c := range candidates {
+		prios[c.Domain] = boostedPriority(ds.agedPriority(c.Priority, c.LastDispatch), c.BoostUntil)
+	}
+	sorted := append([]*ClaimCandidate(nil), candidates...)
+	sort.Stable(byClaimPriority{sorted, prios})
+
+	var order []*ClaimCandidate
+	for _, c := range sorted {
+		if ds.domainPriorityTry(c.Domain, prios[c.Domain]) {
+			order = append(order, c)
+		}
+	}
+	return order
+}
+
+type byClaimPriority struct {
+	candidates []*ClaimCandidate
+	prios      map[string]int
+}
+
+func (s byClaimPriority) Len() int { return len(s.candidates) }
+func (s byClaimPriority) Swap(i, j int) {
+	s.candidates[i], s.candidates[j] = s.candidates[j], s.candidates[i]
+}
+func (s byClaimPriority) Less(i, j int) bool {
+	return s.prios[s.candidates[i].Domain] > s.prios[s.candidates[j].Domain]
+}
+
+// RoundRobinClaimStrategy claims the candidates that have waited longest
+// since being dispatched first, ignoring priority.
+type RoundRobinClaimStrategy struct{}
+
+// Order implements ClaimStrategy
+func (RoundRobinClaimStrategy) Order(ds *Datastore, candidates []*ClaimCandidate) []*ClaimCandidate {
+	sorted := append([]*ClaimCandidate(nil), candidates...)
+	sort.Stable(byLastDispatch(sorted))
+	return sorted
+}
+
+type byLastDispatch []*ClaimCandidate
+
+func (s byLastDispatch) Len() int           { return len(s) }
+func (s byLastDispatch) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLastDispatch) Less(i, j int) bool { return s[i].LastDispatch.Before(s[j].LastDispatch) }
+
+// AffinityClaimStrategy has nodes re-claim the domains they crawled before,
+// so they can reuse warm DNS, connection and robots.txt caches. A node claims
+// its own domains first, then domains no node has claimed, then domains last
+// claimed by another node that have waited at least Wait since being
+// dispatched (so domains of a node that has gone away are still crawled).
+// Within each group candidates are ordered as by PriorityClaimStrategy.
+type AffinityClaimStrategy struct {
+	// This node's name, compared against ClaimCandidate.LastNode
+	Node string
+
+	// How long a domain last claimed by another node waits for it
+	Wait time.Duration
+}
+
+// Order implements ClaimStrategy
+func (s AffinityClaimStrategy) Order(ds *Datastore, candidates []*ClaimCandidate) []*ClaimCandidate {
+	var own, unclaimed, stale []*ClaimCandidate
+	for _, c := range candidates {
+		switch {
+		case c.LastNode == s.Node:
+			own = append(own, c)
+		case c.LastNode == "":
+			unclaimed = append(unclaimed, c)
+		case time.Since(c.LastDispatch) >= s.Wait:
+			stale = append(stale, c)
+		}
+	}
+
+	var order []*ClaimCandidate
+	for _, group := range [][]*ClaimCandidate{own, unclaimed, stale} {
+		order = append(order, PriorityClaimStrategy{}.Order(ds, group)...)
+	}
+	return order
+}
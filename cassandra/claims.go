@@ -0,0 +1,147 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+)
+
+// Each fetcher keeps a count of the links it has stored results for in every
+// domain it holds, and writes them to fetcher_claims (at most every
+// claimProgressInterval, and with each heartbeat) so the console can show how
+// far through its segments each fetcher is. The rows share the TTL of
+// active_fetchers, so a fetcher that goes away takes its progress with it.
+
+// claimProgressInterval is the least time between writes of a domain's
+// progress from StoreURLFetchResults
+const claimProgressInterval = 30 * time.Second
+
+type claimProgress struct {
+	fetched int
+	written time.Time
+}
+
+// addProgress counts a fetch result stored for dom, writing the count to
+// fetcher_claims if it hasn't been written recently
+func (ds *Datastore) addProgress(dom string) {
+	ds.progressMu.Lock()
+	p, ok := ds.progress[dom]
+	if !ok {
+		p = &claimProgress{}
+		ds.progress[dom] = p
+	}
+	p.fetched++
+	fetched := p.fetched
+	write := time.Since(p.written) >= claimProgressInterval
+	if write {
+		p.written = time.Now()
+	}
+	ds.progressMu.Unlock()
+
+	if write {
+		if err := ds.writeProgress(dom, fetched); err != nil {
+			log4go.Error("Failed to write claim progress of %v: %v", dom, err)
+		}
+	}
+}
+
+// clearProgress forgets the progress of dom, which has been unclaimed
+func (ds *Datastore) clearProgress(dom string) {
+	ds.progressMu.Lock()
+	delete(ds.progress, dom)
+	ds.progressMu.Unlock()
+
+	err := ds.db.Query(`DELETE FROM fetcher_claims WHERE tok = ? AND dom = ?`, ds.crawlerUUID, dom).Exec()
+	if err != nil {
+		log4go.Error("Failed to clear claim progress of %v: %v", dom, err)
+	}
+}
+
+// refreshProgress writes the progress of every domain this datastore holds,
+// renewing the rows' TTL
+func (ds *Datastore) refreshProgress() error {
+	ds.progressMu.Lock()
+	counts := map[string]int{}
+	now := time.Now()
+	for dom, p := range ds.progress {
+		counts[dom] = p.fetched
+		p.written = now
+	}
+	ds.progressMu.Unlock()
+
+	for dom, fetched := range counts {
+		if err := ds.writeProgress(dom, fetched); err != nil {
+			return fmt.Errorf("Failed to write claim progress of %v: %v", dom, err)
+		}
+	}
+	return nil
+}
+
+func (ds *Datastore) writeProgress(dom string, fetched int) error {
+	return ds.db.Query(`INSERT INTO fetcher_claims (tok, dom, fetched) VALUES (?, ?, ?) USING TTL ?`,
+		ds.crawlerUUID, dom, fetched, ds.activeFetchersTTL).Exec()
+}
+
+// ListClaims is documented on the ModelDatastore interface.
+func (ds *Datastore) ListClaims() ([]*FetcherClaims, error) {
+	var fetchers []*FetcherClaims
+	itr := ds.db.Query(`SELECT tok, node FROM active_fetchers`).Iter()
+	var tok gocql.UUID
+	var node string
+	for itr.Scan(&tok, &node) {
+		fetchers = append(fetchers, &FetcherClaims{Token: tok, Node: node})
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to list active fetchers: %v", err)
+	}
+
+	for _, f := range fetchers {
+		fetched := map[string]int{}
+		itr = ds.db.Query(`SELECT dom, fetched FROM fetcher_claims WHERE tok = ?`, f.Token).Iter()
+		var dom string
+		var n int
+		for itr.Scan(&dom, &n) {
+			fetched[dom] = n
+		}
+		if err := itr.Close(); err != nil {
+			return nil, fmt.Errorf("Failed to list claim progress of %v: %v", f.Token, err)
+		}
+
+		itr = ds.db.Query(`SELECT dom, claim_time, queued_links FROM domain_info WHERE claim_tok = ?`,
+			f.Token).Iter()
+		for {
+			c := &Claim{}
+			if !itr.Scan(&c.Domain, &c.ClaimTime, &c.Queued) {
+				break
+			}
+			c.Fetched = fetched[c.Domain]
+			f.Claims = append(f.Claims, c)
+		}
+		if err := itr.Close(); err != nil {
+			return nil, fmt.Errorf("Failed to list claims of %v: %v", f.Token, err)
+		}
+		sort.Sort(claimsByDomain(f.Claims))
+	}
+	sort.Sort(fetchersByNode(fetchers))
+	return fetchers, nil
+}
+
+type claimsByDomain []*Claim
+
+func (s claimsByDomain) Len() int           { return len(s) }
+func (s claimsByDomain) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s claimsByDomain) Less(i, j int) bool { return s[i].Domain < s[j].Domain }
+
+type fetchersByNode []*FetcherClaims
+
+func (s fetchersByNode) Len() int      { return len(s) }
+func (s fetchersByNode) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s fetchersByNode) Less(i, j int) bool {
+	if s[i].Node != s[j].Node {
+		return s[i].Node < s[j].Node
+	}
+	return s[i].Token.String() < s[j].Token.String()
+}
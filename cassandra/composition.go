@@ -0,0 +1,190 @@
+package cassandra
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/iParadigms/walker"
+)
+
+// The dispatcher counts what each domain's crawled pages are made of as it
+// scans the domain's links, and keeps the counts in domain_info: its 2xx
+// pages by Content-Type (type_counts), and its crawled links by status class
+// (status_counts). The console charts them, so domains that are mostly
+// binaries or mostly redirects stand out. Only the
+// dispatcher.content_stats_limit most common types are counted by name, the
+// rest as ContentOther. Links not requested (excluded by robots.txt, say)
+// aren't counted.
+
+// The status classes of status_counts, and the type the least common
+// Content-Types are counted as
+const (
+	Status2xx    = "2xx"
+	Status3xx    = "3xx"
+	Status4xx    = "4xx"
+	Status5xx    = "5xx"
+	StatusError  = "error"
+	ContentOther = "other"
+)
+
+// statusClasses are the status classes in the order the console shows them
+var statusClasses = []string{Status2xx, Status3xx, Status4xx, Status5xx, StatusError}
+
+// contentStats holds the composition counts the dispatcher keeps in
+// domain_info
+type contentStats struct {
+	types, statuses map[string]int
+}
+
+func newContentStats() contentStats {
+	return contentStats{types: map[string]int{}, statuses: map[string]int{}}
+}
+
+// statusClass returns the status class of a link fetched with the given
+// status and fetch error, or "" if it wasn't requested
+func statusClass(status int, fetchErr string) string {
+	switch {
+	case status >= 200 && status < 300:
+		return Status2xx
+	case status >= 300 && status < 400:
+		return Status3xx
+	case status >= 400 && status < 500:
+		return Status4xx
+	case status >= 500:
+		return Status5xx
+	case fetchErr != "":
+		return StatusError
+	}
+	return ""
+}
+
+// contentType returns mime without its parameters, lower-cased
+func contentType(mime string) string {
+	if i := strings.Index(mime, ";"); i >= 0 {
+		mime = mime[:i]
+	}
+	mime = strings.ToLower(strings.TrimSpace(mime))
+	if mime == "" {
+		return "unknown"
+	}
+	return mime
+}
+
+// add counts the latest fetch of the link of c
+func (s contentStats) add(c *cell) {
+	if c.crawlTime.Equal(walker.NotYetCrawled) {
+		return
+	}
+	class := statusClass(c.status, c.fetchErr)
+	if class == "" {
+		return
+	}
+	s.statuses[class]++
+	if class == Status2xx {
+		s.types[contentType(c.mime)]++
+	}
+}
+
+// top folds all but the limit most common types into ContentOther
+func (s contentStats) top(limit int) contentStats {
+	shares := compositionOf(s.types)
+	if len(shares) <= limit {
+		return s
+	}
+	types := map[string]int{}
+	for i, sh := range shares {
+		if i < limit && sh.Name != ContentOther {
+			types[sh.Name] = sh.Pages
+		} else {
+			types[ContentOther] += sh.Pages
+		}
+	}
+	return contentStats{types: types, statuses: s.statuses}
+}
+
+// changed returns the domain_info columns of s that differ from prev
+func (s contentStats) changed(prev contentStats) []dbfield {
+	var fields []dbfield
+	if !sameCounts(s.types, prev.types) {
+		fields = append(fields, dbfield{"type_counts", s.types})
+	}
+	if !sameCounts(s.statuses, prev.statuses) {
+		fields = append(fields, dbfield{"status_counts", s.statuses})
+	}
+	return fields
+}
+
+// sameCounts returns true if a and b hold the same counts, a nil map (as an
+// empty map column reads) being the same as an empty one
+func sameCounts(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ContentShare is one part of a domain's composition
+type ContentShare struct {
+	// The Content-Type or status class
+	Name string
+
+	Pages int
+
+	// Pages as a fraction of the composition's total
+	Fraction float64
+}
+
+// compositionOf returns the shares of counts, largest first
+func compositionOf(counts map[string]int) []ContentShare {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	var shares []ContentShare
+	for name, n := range counts {
+		if n > 0 {
+			shares = append(shares, ContentShare{Name: name, Pages: n, Fraction: float64(n) / float64(total)})
+		}
+	}
+	sort.Sort(bySharePages(shares))
+	return shares
+}
+
+// bySharePages sorts ContentShares largest first, then by name
+type bySharePages []ContentShare
+
+func (s bySharePages) Len() int      { return len(s) }
+func (s bySharePages) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySharePages) Less(i, j int) bool {
+	if s[i].Pages != s[j].Pages {
+		return s[i].Pages > s[j].Pages
+	}
+	return s[i].Name < s[j].Name
+}
+
+// TypeComposition returns the shares of the domain's 2xx pages by
+// Content-Type, largest first, as of its last dispatch
+func (d *DomainInfo) TypeComposition() []ContentShare {
+	return compositionOf(d.TypeCounts)
+}
+
+// StatusComposition returns the shares of the domain's crawled links by
+// status class, in class order, as of its last dispatch
+func (d *DomainInfo) StatusComposition() []ContentShare {
+	var shares []ContentShare
+	byName := map[string]ContentShare{}
+	for _, sh := range compositionOf(d.StatusCounts) {
+		byName[sh.Name] = sh
+	}
+	for _, class := range statusClasses {
+		if sh, ok := byName[class]; ok {
+			shares = append(shares, sh)
+		}
+	}
+	return shares
+}
@@ -0,0 +1,181 @@
+package cassandra
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// DiffCrawls compares a domain as crawled at two points in time, using the
+// fetch history kept in the links table. A link's state at a time is its
+// latest fetch at or before that time; links that hadn't been fetched by then
+// weren't part of the crawl yet. This answers questions like "what broke after
+// the site relaunch?": pass a time before the relaunch and one after its pages
+// were recrawled.
+
+// CrawlDiff is the outcome of DiffCrawls
+type CrawlDiff struct {
+	Domain   string
+	From, To time.Time
+
+	// Number of links fetched by From and by To
+	LinksFrom, LinksTo int
+
+	// Number of fetches made after From, by To
+	Fetched int
+
+	// Links first fetched after From, by To
+	New []*CrawlDiffLink
+
+	// Links that answered fine (a status below 400, or a redirect) at From
+	// but are gone (a 404 or 410) at To
+	Disappeared []*CrawlDiffLink
+
+	// Other links whose status, or whether they could be fetched at all,
+	// changed between From and To
+	Changed []*CrawlDiffLink
+}
+
+// CrawlDiffLink is a link's state at the two times compared. The From fields
+// are zero for new links.
+type CrawlDiffLink struct {
+	URL *walker.URL
+
+	// When the link was fetched, the status it answered (0 if the fetch
+	// failed or it redirected), why the fetch failed and where it redirected
+	// to, as of From and To
+	FromTime, ToTime         time.Time
+	FromStatus, ToStatus     int
+	FromError, ToError       string
+	FromRedirect, ToRedirect string
+}
+
+// FromState describes the link's state at From, ex. "200", "redirects to
+// http://a.com/" or "error: ...", or "" if it hadn't been fetched yet
+func (l *CrawlDiffLink) FromState() string {
+	if l.FromTime.IsZero() {
+		return ""
+	}
+	return describeCrawlState(l.FromStatus, l.FromError, l.FromRedirect)
+}
+
+// ToState describes the link's state at To, like FromState
+func (l *CrawlDiffLink) ToState() string {
+	return describeCrawlState(l.ToStatus, l.ToError, l.ToRedirect)
+}
+
+func describeCrawlState(status int, err, redirect string) string {
+	switch {
+	case err != "":
+		return "error: " + err
+	case redirect != "":
+		return "redirects to " + redirect
+	}
+	return fmt.Sprint(status)
+}
+
+// crawlState is a fetch of a link, as read from the links table
+type crawlState struct {
+	time     time.Time
+	status   int
+	err      string
+	redirect string
+}
+
+func (s *crawlState) gone() bool {
+	return s.status == http.StatusNotFound || s.status == http.StatusGone
+}
+
+func (s *crawlState) ok() bool {
+	return s.err == "" && (s.redirect != "" || s.status > 0 && s.status < 400)
+}
+
+func (s *crawlState) same(other *crawlState) bool {
+	return s.status == other.status && s.redirect == other.redirect && (s.err == "") == (other.err == "")
+}
+
+// DiffCrawls is documented on the ModelDatastore interface.
+func (ds *Datastore) DiffCrawls(domain string, from, to time.Time) (*CrawlDiff, error) {
+	if !from.Before(to) {
+		return nil, fmt.Errorf("Crawl diff times out of order: %v is not before %v", from, to)
+	}
+	dinfo, err := ds.FindDomain(domain)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find domain %v: %v", domain, err)
+	} else if dinfo == nil {
+		return nil, walker.NewError(walker.ErrNotFound, fmt.Errorf("Domain %v not found", domain))
+	}
+	diff := &CrawlDiff{Domain: domain, From: from, To: to}
+
+	// A link's rows come out together, ordered by fetch time, so its state at
+	// a time is the last of its rows at or before it
+	var subdom, path, proto string
+	var cur crawlState
+	var link struct {
+		subdom, path, proto string
+		atFrom, atTo        *crawlState
+	}
+	flush := func() error {
+		if link.atTo == nil {
+			return nil
+		}
+		u, err := walker.CreateURL(domain, link.subdom, link.path, link.proto, link.atTo.time)
+		if err != nil {
+			return err
+		}
+		diff.add(u, link.atFrom, link.atTo)
+		return nil
+	}
+
+	itr := ds.db.Query(`SELECT subdom, path, proto, time, stat, err, redto_url FROM links
+							WHERE dom = ? AND bucket IN ?`, domain, linkBuckets()).Iter()
+	for itr.Scan(&subdom, &path, &proto, &cur.time, &cur.status, &cur.err, &cur.redirect) {
+		if subdom != link.subdom || path != link.path || proto != link.proto {
+			if err := flush(); err != nil {
+				itr.Close()
+				return nil, fmt.Errorf("Failed to diff link of %v: %v", domain, err)
+			}
+			link.subdom, link.path, link.proto = subdom, path, proto
+			link.atFrom, link.atTo = nil, nil
+		}
+		if cur.time.Equal(walker.NotYetCrawled) || cur.time.After(to) {
+			continue
+		}
+		state := cur
+		link.atTo = &state
+		if !cur.time.After(from) {
+			link.atFrom = &state
+		} else {
+			diff.Fetched++
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read links of %v: %v", domain, err)
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("Failed to diff link of %v: %v", domain, err)
+	}
+	return diff, nil
+}
+
+// add records link u, whose state was atFrom at From (nil if it hadn't been
+// fetched yet) and atTo at To
+func (d *CrawlDiff) add(u *walker.URL, atFrom, atTo *crawlState) {
+	d.LinksTo++
+	l := &CrawlDiffLink{URL: u, ToTime: atTo.time, ToStatus: atTo.status, ToError: atTo.err,
+		ToRedirect: atTo.redirect}
+	if atFrom == nil {
+		d.New = append(d.New, l)
+		return
+	}
+	d.LinksFrom++
+	l.FromTime, l.FromStatus, l.FromError, l.FromRedirect = atFrom.time, atFrom.status, atFrom.err, atFrom.redirect
+	switch {
+	case atFrom.ok() && atTo.gone():
+		d.Disappeared = append(d.Disappeared, l)
+	case !atFrom.same(atTo):
+		d.Changed = append(d.Changed, l)
+	}
+}
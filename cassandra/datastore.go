@@ -3,8 +3,11 @@ package cassandra
 import (
 	"bytes"
 	"fmt"
+	"hash/fnv"
+	"math"
 	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -12,6 +15,7 @@ import (
 	"code.google.com/p/log4go"
 	"github.com/gocql/gocql"
 	"github.com/iParadigms/walker"
+	"github.com/temoto/robotstxt.go"
 
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -34,6 +38,22 @@ type Datastore struct {
 	// Cache key is TopLevelDomain+1, value is a bool (true if the domain exists)
 	domainCache *lru.Cache
 
+	// A cache of links whose provenance we've recently recorded (see
+	// storeProvenance), keyed by URL, or nil if it isn't recorded
+	provenanceCache *lru.Cache
+
+	// A cache of the active param rules of domains (see activeParamRules),
+	// keyed by domain, or nil if trap escape is off
+	paramRules *lru.Cache
+
+	// A cache of the crawl scopes of domains (see domainScope), keyed by
+	// domain
+	scopes *lru.Cache
+
+	// A cache of the results of verifying new domains (see verifyDomain), keyed
+	// by domain, or nil if cassandra.verify_new_domains is empty
+	verified *lru.Cache
+
 	// This is a unique UUID for the entire crawler.
 	crawlerUUID gocql.UUID
 
@@ -58,8 +78,69 @@ type Datastore struct {
 	// it equals Config.Cassandra.DefaultDomainPriority. In either case maxPrio is the
 	// best max_priority value available.
 	maxPrio int
+
+	// Download quota accounting for the domains this datastore has claimed,
+	// keyed by domain (and mutex to protect it)
+	quotas  map[string]*hostQuota
+	quotaMu sync.Mutex
+
+	// How long a dispatched domain must wait to earn the full age credit (see
+	// agedPriority); zero disables aging
+	priorityAgingPeriod time.Duration
+
+	// How long a newly added domain is boosted for
+	// (dispatcher.new_domain_boost_period); zero disables the boost
+	newDomainBoostPeriod time.Duration
+
+	// Number of seconds a host_context row lives (fetcher.host_context_ttl);
+	// zero disables storing them
+	hostContextTTL int
+
+	// Number of seconds a samples row lives (cassandra.sample_ttl)
+	sampleTTL int
+
+	// Parsed fetcher.response_time_slo
+	responseTimeSLO time.Duration
+
+	// Closed to stop the goroutine feeding LinksForHost links for a domain,
+	// keyed by domain (and mutex to protect it)
+	segmentReads  map[string]chan struct{}
+	segmentReadMu sync.Mutex
+
+	// Picks which domains ClaimNewHost claims (see cassandra.claim_strategy),
+	// and this node's name, recorded on the domains it claims
+	claimStrategy ClaimStrategy
+	claimNode     string
+
+	// Links fetched so far for each domain this datastore holds, keyed by
+	// domain (and mutex to protect it); reported in fetcher_claims
+	progress   map[string]*claimProgress
+	progressMu sync.Mutex
+
+	// Makes the writes of StoreURLFetchResults and StoreParsedURL in the
+	// background if cassandra.async_writes is set (nil otherwise)
+	writes *writePipeline
+
+	// Where claims and unclaims are counted (see SetMetrics), or nil
+	metrics walker.Metrics
 }
 
+// The counters the Datastore (see SetMetrics) and Dispatcher (see
+// Dispatcher.Metrics) add to their Metrics
+const (
+	MetricClaims   = "walker_cassandra_claims"
+	MetricUnclaims = "walker_cassandra_unclaims"
+
+	// Segments generated (including those generated ahead, see pipeline.go),
+	// and the links in them
+	MetricSegmentsDispatched = "walker_segments_dispatched"
+	MetricLinksDispatched    = "walker_links_dispatched"
+
+	// A histogram (see walker.Observer) of how long generating a domain's
+	// segment took, in seconds
+	MetricSegmentSeconds = "walker_segment_seconds"
+)
+
 var MaxPriorityPeriod time.Duration
 
 func init() {
@@ -78,12 +159,38 @@ func NewDatastore() (*Datastore, error) {
 	var err error
 	ds.db, err = ds.cf.CreateSession()
 	if err != nil {
-		return nil, fmt.Errorf("Failed to create cassandra datastore: %v", err)
+		return nil, walker.NewError(walker.ErrDatastoreUnavailable,
+			fmt.Errorf("Failed to create cassandra datastore: %v", err))
 	}
 	ds.domainCache, err = lru.New(walker.Config.Cassandra.AddedDomainsCacheSize)
 	if err != nil {
 		return nil, err
 	}
+	if walker.Config.Cassandra.StoreLinkProvenance {
+		ds.provenanceCache, err = lru.New(walker.Config.Cassandra.LinkProvenanceCache)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if walker.Config.Dispatcher.TrapEscape != walker.TrapEscapeOff {
+		ds.paramRules, err = lru.New(walker.Config.Cassandra.AddedDomainsCacheSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ds.scopes, err = lru.New(walker.Config.Cassandra.AddedDomainsCacheSize)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(walker.Config.Cassandra.VerifyNewDomains) > 0 {
+		ds.verified, err = lru.New(walker.Config.Cassandra.AddedDomainsCacheSize)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	u, err := gocql.RandomUUID()
 	if err != nil {
@@ -97,15 +204,66 @@ func NewDatastore() (*Datastore, error) {
 	}
 	ds.activeFetchersTTL = int(durr / time.Second)
 
+	ds.priorityAgingPeriod, err = time.ParseDuration(walker.Config.Cassandra.PriorityAgingPeriod)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+
+	ds.newDomainBoostPeriod, err = time.ParseDuration(walker.Config.Dispatcher.NewDomainBoostPeriod)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+
+	durr, err = time.ParseDuration(walker.Config.Fetcher.HostContextTTL)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	ds.hostContextTTL = int(durr / time.Second)
+
+	durr, err = time.ParseDuration(walker.Config.Cassandra.SampleTTL)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	ds.sampleTTL = int(durr / time.Second)
+
+	ds.responseTimeSLO, err = time.ParseDuration(walker.Config.Fetcher.ResponseTimeSLO)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+
 	ds.restartCursor = true
 	ds.maxPrioNeedFetch = time.Now().AddDate(-1, 0, 0)
 	ds.maxPrio = walker.Config.Cassandra.DefaultDomainPriority
+	ds.quotas = map[string]*hostQuota{}
+	ds.segmentReads = map[string]chan struct{}{}
+	ds.progress = map[string]*claimProgress{}
+
+	ds.claimNode = claimNodeID()
+	if ds.claimNode == "" {
+		ds.claimNode = ds.crawlerUUID.String()
+	}
+	ds.claimStrategy, err = newClaimStrategy(ds.claimNode)
+	if err != nil {
+		return nil, err
+	}
+
+	if walker.Config.Cassandra.AsyncWrites {
+		ds.writes = newWritePipeline(walker.Config.Cassandra.AsyncWriteQueue, walker.Config.Cassandra.AsyncWriters)
+	}
 
 	return ds, nil
 }
 
-// Close will close the Datastore
+// SetClaimStrategy replaces the ClaimStrategy set by cassandra.claim_strategy
+func (ds *Datastore) SetClaimStrategy(s ClaimStrategy) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.claimStrategy = s
+}
+
+// Close will close the Datastore, once any queued writes are made
 func (ds *Datastore) Close() {
+	ds.closeWrites()
 	ds.db.Close()
 }
 
@@ -139,6 +297,9 @@ func (ds *Datastore) ClaimNewHost() string {
 
 	domain := ds.domains[0]
 	ds.domains = ds.domains[1:]
+	if ds.metrics != nil {
+		ds.metrics.Add(MetricClaims, 1)
+	}
 	return domain
 }
 
@@ -170,6 +331,29 @@ func (ds *Datastore) domainPriorityTry(dom string, domPriority int) bool {
 	return false
 }
 
+// agedPriority returns the priority a domain is tried with (see
+// domainPriorityTry) after waiting to be claimed since it was dispatched at
+// lastDispatch: its own priority plus an age credit. The credit follows
+// (waited / priority_aging_period) ^ priority_aging_exponent of the max
+// priority, capped at the max priority, so a domain that has waited a whole
+// aging period is claimed on the next pass whatever its priority.
+func (ds *Datastore) agedPriority(priority int, lastDispatch time.Time) int {
+	if ds.priorityAgingPeriod <= 0 || lastDispatch.IsZero() {
+		return priority
+	}
+	waited := time.Since(lastDispatch)
+	if waited <= 0 {
+		return priority
+	}
+	maxPrio := ds.MaxPriority()
+	age := math.Min(float64(waited)/float64(ds.priorityAgingPeriod), 1)
+	credit := int(math.Ceil(float64(maxPrio) * math.Pow(age, walker.Config.Cassandra.PriorityAgingExponent)))
+	if credit > maxPrio {
+		credit = maxPrio
+	}
+	return priority + credit
+}
+
 // This method sets the domain_counters table correctly after a domain has been claimed.
 func (ds *Datastore) domainPriorityClaim(dom string) bool {
 	err := ds.db.Query("UPDATE domain_counters SET next_crawl = next_crawl-? WHERE dom = ?", ds.MaxPriority(), dom).Exec()
@@ -186,7 +370,7 @@ func (ds *Datastore) domainPriorityClaim(dom string) bool {
 func (ds *Datastore) tryClaimHosts(limit int) (domains []string, retry bool) {
 	var domainIter *gocql.Iter
 	if ds.restartCursor {
-		loopQuery := fmt.Sprintf(`SELECT dom, priority 
+		loopQuery := fmt.Sprintf(`SELECT dom, priority, last_dispatch, claim_node, boost_until
 									FROM domain_info
 									WHERE 
 										claim_tok = 00000000-0000-0000-0000-000000000000 AND
@@ -196,7 +380,7 @@ func (ds *Datastore) tryClaimHosts(limit int) (domains []string, retry bool) {
 		domainIter = ds.db.Query(loopQuery).Iter()
 		ds.restartCursor = false
 	} else {
-		loopQuery := fmt.Sprintf(`SELECT dom, priority 
+		loopQuery := fmt.Sprintf(`SELECT dom, priority, last_dispatch, claim_node, boost_until
 									FROM domain_info
 									WHERE 
 										claim_tok = 00000000-0000-0000-0000-000000000000 AND
@@ -210,7 +394,8 @@ func (ds *Datastore) tryClaimHosts(limit int) (domains []string, retry bool) {
 	casQuery := `UPDATE domain_info 
 						SET 
 							claim_tok = ?, 
-							claim_time = ?
+							claim_time = ?,
+							claim_node = ?
 						WHERE 
 							dom = ?
 						IF 
@@ -222,21 +407,38 @@ func (ds *Datastore) tryClaimHosts(limit int) (domains []string, retry bool) {
 	// another datastore before any can be claimed by this datastore.
 	// Under current expected use, it seems like we wouldn't need to retry
 	// more than 5-ish times (hence the retryLimit setting).
-	var domain string
-	var domPriority int
+	var candidates []*ClaimCandidate
+	c := &ClaimCandidate{}
+	for domainIter.Scan(&c.Domain, &c.Priority, &c.LastDispatch, &c.LastNode, &c.BoostUntil) {
+		candidates = append(candidates, c)
+		c = &ClaimCandidate{}
+	}
+
+	err := domainIter.Close()
+
+	if err != nil {
+		log4go.Error("Domain iteration query failed: %v", err)
+		return
+	}
+
+	if len(candidates) == 0 {
+		// Restart claimCursor.
+		ds.claimCursor = ""
+		ds.restartCursor = true
+		retry = true
+		return
+	}
+	ds.claimCursor = candidates[len(candidates)-1].Domain
+
 	start := time.Now()
 	trumpedClaim := 0
-	scanComplete := false
-	for domainIter.Scan(&domain, &domPriority) {
-		scanComplete = true
-		if !ds.domainPriorityTry(domain, domPriority) {
-			continue
-		}
+	for _, c := range ds.claimStrategy.Order(ds, candidates) {
+		domain := c.Domain
 
 		// The query below is a compare-and-set type query. It will only update the claim_tok, claim_time
 		// if the claim_tok remains 00000000-0000-0000-0000-000000000000 at the time of update.
 		casMap := map[string]interface{}{}
-		applied, err := ds.db.Query(casQuery, ds.crawlerUUID, time.Now(), domain).MapScanCAS(casMap)
+		applied, err := ds.db.Query(casQuery, ds.crawlerUUID, time.Now(), ds.claimNode, domain).MapScanCAS(casMap)
 		if err != nil {
 			log4go.Error("Failed to claim segment %v: %v", domain, err)
 		} else if !applied {
@@ -251,20 +453,7 @@ func (ds *Datastore) tryClaimHosts(limit int) (domains []string, retry bool) {
 		}
 	}
 
-	err := domainIter.Close()
-
-	if err != nil {
-		log4go.Error("Domain iteration query failed: %v", err)
-		return
-	}
-
-	ds.claimCursor = domain
-
-	if !scanComplete {
-		// Restart claimCursor.
-		ds.restartCursor = true
-		retry = true
-	} else if trumpedClaim >= limit {
+	if trumpedClaim >= limit {
 		log4go.Fine("tryClaimHosts requesting retry with trumpedClaim = %d, and limit = %d", trumpedClaim, limit)
 		retry = true
 	}
@@ -274,57 +463,172 @@ func (ds *Datastore) tryClaimHosts(limit int) (domains []string, retry bool) {
 
 // UnclaimHost is documented on the walker.Datastore interface.
 func (ds *Datastore) UnclaimHost(host string) {
+	ds.stopSegmentRead(host)
+	ds.waitWrites(host)
+
 	err := ds.db.Query(`DELETE FROM segments WHERE dom = ?`, host).Exec()
 	if err != nil {
 		log4go.Error("Failed deleting segment links for %v: %v", host, err)
 	}
 
+	// If the dispatcher generated the next segment ahead, it is queued and the
+	// host left dispatched, ready to be claimed again
+	queued := ds.promotePendingSegment(host)
+
 	err = ds.db.Query(`UPDATE domain_info 
 					   SET 
-					   		dispatched = false,
+					   		dispatched = ?,
 							claim_tok = 00000000-0000-0000-0000-000000000000,
-							queued_links = 0
-						WHERE dom = ?`, host).Exec()
+							queued_links = ?
+						WHERE dom = ?`, queued > 0, queued, host).Exec()
 	if err != nil {
 		log4go.Error("Failed deleting %v from domains_to_crawl: %v", host, err)
 	}
+
+	ds.quotaMu.Lock()
+	delete(ds.quotas, host)
+	ds.quotaMu.Unlock()
+
+	ds.clearProgress(host)
+	if ds.metrics != nil {
+		ds.metrics.Add(MetricUnclaims, 1)
+	}
 }
 
 // LinksForHost is documented on the walker.Datastore interface.
 func (ds *Datastore) LinksForHost(domain string) <-chan *walker.URL {
-	links, err := ds.getSegmentLinks(domain)
+	return ds.LinksForHostFrom(domain, SegmentCursor{})
+}
+
+// SegmentCursor is a position in a domain's segment, which is read in
+// (subdomain, path, protocol) order. The zero SegmentCursor is the start of
+// the segment.
+type SegmentCursor struct {
+	Subdom, Path, Proto string
+}
+
+// SegmentCursorFor returns the cursor positioned at u, so reading from it
+// resumes with the link after u.
+func SegmentCursorFor(u *walker.URL) (SegmentCursor, error) {
+	_, subdom, err := u.TLDPlusOneAndSubdomain()
 	if err != nil {
-		log4go.Error("Failed to grab segment for %v: %v", domain, err)
-		c := make(chan *walker.URL)
-		close(c)
-		return c
+		return SegmentCursor{}, err
 	}
-	log4go.Info("Returning %v links to crawl domain %v", len(links), domain)
+	return SegmentCursor{Subdom: subdom, Path: u.RequestURI(), Proto: u.Scheme}, nil
+}
 
-	linkchan := make(chan *walker.URL, len(links))
-	for _, l := range links {
-		linkchan <- l
-	}
-	close(linkchan)
+// LinksForHostFrom is like LinksForHost, but only returns the links in the
+// domain's segment after cursor, ex. to resume a crawl that stopped part way
+// through. The segment is read cassandra.segment_read_chunk_size links at a
+// time, and the next chunk isn't read until the channel has room for it.
+// Reading stops when the host is unclaimed.
+func (ds *Datastore) LinksForHostFrom(domain string, cursor SegmentCursor) <-chan *walker.URL {
+	chunkSize := walker.Config.Cassandra.SegmentReadChunkSize
+	linkchan := make(chan *walker.URL, chunkSize)
+	quit := make(chan struct{})
+
+	ds.segmentReadMu.Lock()
+	if prev, ok := ds.segmentReads[domain]; ok {
+		close(prev)
+	}
+	ds.segmentReads[domain] = quit
+	ds.segmentReadMu.Unlock()
+
+	go func() {
+		defer close(linkchan)
+		defer func() {
+			ds.segmentReadMu.Lock()
+			if ds.segmentReads[domain] == quit {
+				delete(ds.segmentReads, domain)
+			}
+			ds.segmentReadMu.Unlock()
+		}()
+
+		total := 0
+		for {
+			links, next, rows, err := ds.getSegmentChunk(domain, cursor, chunkSize)
+			if err != nil {
+				log4go.Error("Failed to grab segment for %v: %v", domain, err)
+				return
+			}
+			for _, l := range links {
+				if !sendLink(linkchan, l, quit) {
+					log4go.Info("Stopped reading segment for %v after %v links", domain, total)
+					return
+				}
+				total++
+			}
+			if rows < chunkSize {
+				break
+			}
+			cursor = next
+		}
+		log4go.Info("Returned %v links to crawl domain %v", total, domain)
+	}()
 	return linkchan
 }
 
-// getSegmentLinks returns all the URLs in a domain's segment.
-// TODO: change our LinksForHost implementation to kick off a goroutine to feed
-// 			the channel, instead of keeping all links in memory as we do now.
-func (ds *Datastore) getSegmentLinks(domain string) (links []*walker.URL, err error) {
-	q := ds.db.Query(`SELECT dom, subdom, path, proto, time
-						FROM segments WHERE dom = ?`, domain)
+// sendLink sends u on linkchan, returning false instead if quit is closed
+// first
+func sendLink(linkchan chan<- *walker.URL, u *walker.URL, quit <-chan struct{}) bool {
+	// Check quit on its own first, since select picks at random when both
+	// cases are ready
+	select {
+	case <-quit:
+		return false
+	default:
+	}
+	select {
+	case linkchan <- u:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// stopSegmentRead stops the goroutine feeding LinksForHost links for domain,
+// if there is one
+func (ds *Datastore) stopSegmentRead(domain string) {
+	ds.segmentReadMu.Lock()
+	defer ds.segmentReadMu.Unlock()
+	if quit, ok := ds.segmentReads[domain]; ok {
+		close(quit)
+		delete(ds.segmentReads, domain)
+	}
+}
+
+// getSegmentChunk returns up to limit URLs from a domain's segment after
+// cursor, the cursor of the last row read, and the number of rows read (which
+// can be more than len(links) if some rows didn't make valid URLs).
+func (ds *Datastore) getSegmentChunk(domain string, cursor SegmentCursor, limit int) (
+	links []*walker.URL, next SegmentCursor, rows int, err error) {
+
+	var q *gocql.Query
+	if cursor == (SegmentCursor{}) {
+		q = ds.db.Query(`SELECT dom, subdom, path, proto, time, chain_pos, depth, fnv
+							FROM segments WHERE dom = ? LIMIT ?`, domain, limit)
+	} else {
+		q = ds.db.Query(`SELECT dom, subdom, path, proto, time, chain_pos, depth, fnv
+							FROM segments WHERE dom = ? AND (subdom, path, proto) > (?, ?, ?) LIMIT ?`,
+			domain, cursor.Subdom, cursor.Path, cursor.Proto, limit)
+	}
 	iter := q.Iter()
 	defer func() { err = iter.Close() }()
 
-	var dbdomain, subdomain, path, protocol string
+	next = cursor
+	var dbdomain string
 	var crawlTime time.Time
-	for iter.Scan(&dbdomain, &subdomain, &path, &protocol, &crawlTime) {
-		u, e := walker.CreateURL(dbdomain, subdomain, path, protocol, crawlTime)
+	var chainPos, depth int
+	var fp int64
+	for iter.Scan(&dbdomain, &next.Subdom, &next.Path, &next.Proto, &crawlTime, &chainPos, &depth, &fp) {
+		rows++
+		u, e := walker.CreateURL(dbdomain, next.Subdom, next.Path, next.Proto, crawlTime)
 		if e != nil {
 			log4go.Error("Error adding link (%v) to crawl: %v", u, e)
 		} else {
+			u.ChainPos = chainPos
+			u.Depth = depth
+			u.LastFingerprint = fp
 			log4go.Debug("Adding link: %v", u)
 			links = append(links, u)
 		}
@@ -339,8 +643,30 @@ type dbfield struct {
 	value interface{}
 }
 
+// insertLinkQuery returns the statement inserting inserts into the links
+// table, and the values to bind to it
+func insertLinkQuery(inserts []dbfield) (string, []interface{}) {
+	names := []string{}
+	values := []interface{}{}
+	placeholders := []string{}
+	for _, f := range inserts {
+		names = append(names, f.name)
+		values = append(values, f.value)
+		placeholders = append(placeholders, "?")
+	}
+	return fmt.Sprintf(`INSERT INTO links (%s) VALUES (%s)`,
+		strings.Join(names, ", "), strings.Join(placeholders, ", ")), values
+}
+
 // StoreURLFetchResults is documented on the walker.Datastore interface.
 func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
+	dom, _ := fr.URL.ToplevelDomainPlusOne()
+	ds.write(dom, func() error { return ds.storeURLFetchResults(fr) })
+}
+
+// storeURLFetchResults makes the writes of StoreURLFetchResults, returning an
+// error if the fetch results couldn't be stored
+func (ds *Datastore) storeURLFetchResults(fr *walker.FetchResults) error {
 	url := fr.URL
 	if len(fr.RedirectedFrom) > 0 {
 		// Remember that the actual response of this FetchResults is from
@@ -353,11 +679,12 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 		// Consider storing in the link table so we don't keep trying to crawl
 		// this link
 		log4go.Error("StoreURLFetchResults not storing %v: %v", fr.URL, err)
-		return
+		return nil
 	}
 
 	inserts := []dbfield{
 		dbfield{"dom", dom},
+		dbfield{"bucket", LinkBucket(subdom, url.RequestURI())},
 		dbfield{"subdom", subdom},
 		dbfield{"path", url.RequestURI()},
 		dbfield{"proto", url.Scheme},
@@ -369,47 +696,169 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 		inserts = append(inserts, dbfield{"err", fr.FetchError.Error()})
 	}
 
+	if fr.ParseError != nil {
+		inserts = append(inserts, dbfield{"parse_err", fr.ParseError.Error()})
+	}
+
 	if fr.ExcludedByRobots {
 		inserts = append(inserts, dbfield{"robot_ex", true})
 	}
 
+	if fr.SitemapFresh {
+		inserts = append(inserts, dbfield{"sitemap_fresh", true})
+	}
+
+	if fr.ExtensionDenied {
+		inserts = append(inserts, dbfield{"ext_denied", true})
+	}
+
 	if fr.Response != nil {
 		inserts = append(inserts, dbfield{"stat", fr.Response.StatusCode})
 	}
 
+	if len(fr.RedirectedFrom) == 0 && fr.RedirectedTo != nil {
+		// A redirect that wasn't followed (fetcher.follow_redirects); the
+		// hops of followed ones are recorded below
+		inserts = append(inserts, dbfield{"redto_url", fr.RedirectedTo.String()})
+		if len(fr.RedirectStatuses) > 0 {
+			inserts = append(inserts, dbfield{"redto_stat", fr.RedirectStatuses[0]})
+		}
+	}
+
+	if fr.CacheMaxAge > 0 {
+		inserts = append(inserts, dbfield{"cache_max_age", fr.CacheMaxAge})
+	}
+
+	if !fr.CacheExpires.IsZero() {
+		inserts = append(inserts, dbfield{"expires", fr.CacheExpires})
+	}
+
+	if fr.RefreshHint > 0 {
+		inserts = append(inserts, dbfield{"refresh_hint", int(fr.RefreshHint / time.Second)})
+	}
+
+	if len(fr.OutlinkDomains) > 0 {
+		inserts = append(inserts, dbfield{"outlink_doms", fr.OutlinkDomains})
+	}
+
+	if fr.Node != "" {
+		inserts = append(inserts, dbfield{"node", fr.Node})
+	}
+
+	if !fr.CrawlAt.IsZero() {
+		inserts = append(inserts, dbfield{"crawl_at", fr.CrawlAt})
+	}
+
+	if fr.HandlerError != nil {
+		inserts = append(inserts, dbfield{"handler_err", fr.HandlerError.Error()})
+		if fr.HandlerRetry {
+			inserts = append(inserts, dbfield{"getnow", true})
+		}
+	}
+
 	if fr.MimeType != "" {
 		inserts = append(inserts, dbfield{"mime", fr.MimeType})
 	}
 
+	if fr.ContentSize > 0 {
+		inserts = append(inserts, dbfield{"size", fr.ContentSize})
+	}
+
+	if fr.Partial {
+		inserts = append(inserts, dbfield{"partial", true})
+	}
+
 	if fr.Body != "" {
 		inserts = append(inserts, dbfield{"body", fr.Body})
 	}
 
-	if walker.Config.Cassandra.StoreResponseHeaders && fr.Response != nil && fr.Response.Header != nil {
-		h := map[string]string{}
-		for k, v := range fr.Response.Header {
-			h[k] = strings.Join(v, "\000")
+	if fr.AMPURL != nil {
+		inserts = append(inserts, dbfield{"amp_url", fr.AMPURL.String()})
+	}
+
+	if fr.MobileURL != nil {
+		inserts = append(inserts, dbfield{"mobile_url", fr.MobileURL.String()})
+	}
+
+	if fr.CanonicalURL != nil {
+		inserts = append(inserts, dbfield{"canon_url", fr.CanonicalURL.String()})
+	}
+
+	if fr.URL.Depth > 0 {
+		inserts = append(inserts, dbfield{"depth", fr.URL.Depth})
+	}
+
+	if fr.URL.ChainPos > 0 {
+		inserts = append(inserts, dbfield{"chain_pos", fr.URL.ChainPos})
+	}
+
+	if fr.MetaNoIndex {
+		inserts = append(inserts, dbfield{"noindex", true})
+	}
+
+	if fr.MetaNoFollow {
+		inserts = append(inserts, dbfield{"nofollow", true})
+	}
+
+	if fr.MetaNoAI {
+		inserts = append(inserts, dbfield{"noai", true})
+	}
+
+	if fr.MetaNoImageAI {
+		inserts = append(inserts, dbfield{"noimageai", true})
+	}
+
+	if fr.MetaNoSnippet {
+		inserts = append(inserts, dbfield{"nosnippet", true})
+	}
+
+	if fr.MetaMaxSnippet > 0 {
+		inserts = append(inserts, dbfield{"max_snippet", fr.MetaMaxSnippet})
+	}
+
+	if img := fr.Image; img != nil {
+		inserts = append(inserts, dbfield{"img_format", img.Format})
+		inserts = append(inserts, dbfield{"img_width", img.Width})
+		inserts = append(inserts, dbfield{"img_height", img.Height})
+		if img.CameraMake != "" {
+			inserts = append(inserts, dbfield{"exif_make", img.CameraMake})
+		}
+		if img.CameraModel != "" {
+			inserts = append(inserts, dbfield{"exif_model", img.CameraModel})
+		}
+		if img.HasGPS {
+			inserts = append(inserts, dbfield{"gps_lat", img.Latitude})
+			inserts = append(inserts, dbfield{"gps_lon", img.Longitude})
 		}
-		inserts = append(inserts, dbfield{"headers", h})
 	}
 
-	// Put the values together and run the query
-	names := []string{}
-	values := []interface{}{}
-	placeholders := []string{}
-	for _, f := range inserts {
-		names = append(names, f.name)
-		values = append(values, f.value)
-		placeholders = append(placeholders, "?")
+	if (walker.Config.Cassandra.StoreResponseHeaders || fr.Sampled) && fr.Response != nil &&
+		fr.Response.Header != nil {
+		inserts = append(inserts, dbfield{"headers", encodeHeaders(fr.Response.Header)})
 	}
-	err = ds.db.Query(
-		fmt.Sprintf(`INSERT INTO links (%s) VALUES (%s)`,
-			strings.Join(names, ", "), strings.Join(placeholders, ", ")),
-		values...,
-	).Exec()
+
+	// Put the values together and run the query
+	query, values := insertLinkQuery(inserts)
+	err = ds.db.Query(query, values...).Exec()
 	if err != nil {
 		log4go.Error("Failed storing fetch results: %v", err)
-		return
+		return err
+	}
+
+	if fr.Sampled {
+		ds.storeSample(fr, url, dom, subdom)
+	}
+	ds.storeWatchChanges(fr, url, dom, subdom)
+	if fr.Screenshot != nil {
+		ds.storeScreenshot(fr.Screenshot, url, dom, subdom)
+	}
+	ds.storeSurrogateKeys(fr, url, dom, subdom)
+	ds.storeLatency(fr, url, dom, subdom)
+
+	ds.addProgress(dom)
+
+	if fr.ContentSize > 0 {
+		ds.addDownloadedBytes(dom, fr.ContentSize)
 	}
 
 	if len(fr.RedirectedFrom) > 0 {
@@ -424,15 +873,29 @@ func (ds *Datastore) StoreURLFetchResults(fr *walker.FetchResults) {
 				log4go.Error("StoreURLFetchResults not storing info for url that redirected (%v): %v", back, err)
 				continue
 			}
-			err := ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time, redto_url) VALUES (?, ?, ?, ?, ?, ?)`,
-				dom, subdom, back.RequestURI(), back.Scheme, fr.FetchTime,
-				front.String()).Exec()
+			var status interface{}
+			if i < len(fr.RedirectStatuses) {
+				status = fr.RedirectStatuses[i]
+			}
+			err := ds.db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, redto_url, redto_stat)
+								VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				dom, LinkBucket(subdom, back.RequestURI()), subdom, back.RequestURI(), back.Scheme, fr.FetchTime,
+				front.String(), status).Exec()
 			if err != nil {
 				log4go.Error("Failed to insert redirected link %s -> %s: %v", back.String(), front.String(), err)
 			}
 			back = front
 		}
 	}
+
+	for _, exp := range fr.ExpandedLinks {
+		err := ds.db.Query(`INSERT INTO link_expansions (src, ref, dst, time) VALUES (?, ?, ?, ?)`,
+			exp.From.String(), fr.URL.String(), exp.To.String(), fr.FetchTime).Exec()
+		if err != nil {
+			log4go.Error("Failed to insert link expansion %v -> %v: %v", exp.From, exp.To, err)
+		}
+	}
+	return nil
 }
 
 // StoreParsedURL is documented on the walker.Datastore interface.
@@ -446,31 +909,446 @@ func (ds *Datastore) StoreParsedURL(u *walker.URL, fr *walker.FetchResults) {
 		log4go.Debug("StoreParsedURL not storing %v: %v", fr.URL, err)
 		return
 	}
+	claimed := dom
+	if fr != nil && fr.URL != nil {
+		claimed, _ = fr.URL.ToplevelDomainPlusOne()
+		if scope := ds.domainScope(claimed); scope != nil && !scope.Allows(u, fr.URL) {
+			log4go.Fine("Not storing %v found on %v: out of scope %v", u, fr.URL, scope)
+			return
+		}
+	}
+	ds.write(claimed, func() error { return ds.storeParsedURL(u, dom, subdom, fr) })
+}
 
-	exists := ds.hasDomain(dom)
+// storeParsedURL makes the writes of StoreParsedURL, returning an error if
+// the link couldn't be stored
+func (ds *Datastore) storeParsedURL(u *walker.URL, dom, subdom string, fr *walker.FetchResults) error {
+	var err error
+	exists := ds.admitDomain(dom, nil)
 
-	if !exists && walker.Config.Cassandra.AddNewDomains {
-		log4go.Debug("Adding new domain to system: %v", dom)
-		ds.addDomain(dom)
-		exists = true
+	if exists {
+		u = ds.collapseTrapped(u, dom, subdom)
 	}
 
 	if exists {
-		log4go.Fine("Inserting parsed URL: %v", u)
-		err = ds.db.Query(`INSERT INTO links (dom, subdom, path, proto, time)
-							VALUES (?, ?, ?, ?, ?)`,
-			dom, subdom, u.RequestURI(), u.Scheme, walker.NotYetCrawled).Exec()
+		inserts := []dbfield{
+			dbfield{"dom", dom},
+			dbfield{"bucket", LinkBucket(subdom, u.RequestURI())},
+			dbfield{"subdom", subdom},
+			dbfield{"path", u.RequestURI()},
+			dbfield{"proto", u.Scheme},
+			dbfield{"time", walker.NotYetCrawled},
+		}
+		// Written even for seeds (0), so seeding a link found before makes
+		// it a seed, but never raised: a link keeps the shallowest depth it
+		// was found at
+		if u.Depth == 0 || ds.shallowerThanStored(u, dom, subdom) {
+			inserts = append(inserts, dbfield{"depth", u.Depth})
+		}
+		if u.ChainPos > 0 {
+			log4go.Fine("Inserting parsed URL: %v (pagination chain position %v)", u, u.ChainPos)
+			inserts = append(inserts, dbfield{"chain_pos", u.ChainPos})
+		} else {
+			log4go.Fine("Inserting parsed URL: %v", u)
+		}
+		if !u.SitemapLastMod.IsZero() {
+			inserts = append(inserts, dbfield{"sitemap_lastmod", u.SitemapLastMod})
+		}
+		if u.SitemapPriority > 0 {
+			inserts = append(inserts, dbfield{"sitemap_prio", u.SitemapPriority})
+		}
+		query, values := insertLinkQuery(inserts)
+		err = ds.db.Query(query, values...).Exec()
 		if err != nil {
 			log4go.Error("failed inserting parsed url (%v): %v", u, err)
 		}
 	}
+
+	if exists && err == nil {
+		ds.storeProvenance(u, dom, subdom, fr)
+	}
+	return err
+}
+
+// shallowerThanStored returns true if u is shallower than the depth stored on
+// its not yet crawled row, or it has no such row. Links found on every page
+// (navigation, footers) are rediscovered deeper all the time, and would
+// otherwise drift past dispatcher.max_crawl_depth.
+func (ds *Datastore) shallowerThanStored(u *walker.URL, dom, subdom string) bool {
+	var depth int
+	err := ds.db.Query(`SELECT depth FROM links
+						WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+		dom, LinkBucket(subdom, u.RequestURI()), subdom, u.RequestURI(), u.Scheme,
+		walker.NotYetCrawled).Scan(&depth)
+	if err == gocql.ErrNotFound {
+		return true
+	} else if err != nil {
+		log4go.Error("Failed to read the stored depth of %v: %v", u, err)
+		return true
+	}
+	return u.Depth < depth
+}
+
+// storeProvenance records that u was found on the page fetched in fr, unless
+// it was found somewhere before. Links recorded recently are remembered in
+// provenanceCache, so the check only reaches cassandra for links this
+// datastore hasn't seen.
+func (ds *Datastore) storeProvenance(u *walker.URL, dom, subdom string, fr *walker.FetchResults) {
+	if ds.provenanceCache == nil || fr == nil || fr.URL == nil {
+		return
+	}
+	link := u.String()
+	if ds.provenanceCache.Contains(link) {
+		return
+	}
+	err := ds.db.Query(`INSERT INTO link_provenance (dom, subdom, path, proto, ref, found)
+						VALUES (?, ?, ?, ?, ?, ?) IF NOT EXISTS`,
+		dom, subdom, u.RequestURI(), u.Scheme, fr.URL.String(), fr.FetchTime).Exec()
+	if err != nil {
+		log4go.Error("Failed to store provenance of %v: %v", u, err)
+		return
+	}
+	ds.provenanceCache.Add(link, true)
+}
+
+// FindLinkProvenance is documented on the ModelDatastore interface.
+func (ds *Datastore) FindLinkProvenance(u *walker.URL) (*LinkProvenance, error) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return nil, err
+	}
+	var ref string
+	var found time.Time
+	err = ds.db.Query(`SELECT ref, found FROM link_provenance
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+		dom, subdom, u.RequestURI(), u.Scheme).Scan(&ref, &found)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to find provenance of %v: %v", u, err)
+	}
+	p := &LinkProvenance{Found: found}
+	p.Referrer, err = walker.ParseURL(ref)
+	if err != nil {
+		return nil, fmt.Errorf("Bad provenance of %v: %v", u, err)
+	}
+	return p, nil
+}
+
+// HostQuotaExceeded is documented on the walker.Datastore interface.
+func (ds *Datastore) HostQuotaExceeded(host string) bool {
+	ds.quotaMu.Lock()
+	defer ds.quotaMu.Unlock()
+	return ds.loadQuota(host).exceeded(time.Now())
+}
+
+// loadQuota returns the cached hostQuota for dom, reading it from domain_info
+// if this is the first time we've seen dom since claiming it. quotaMu must be
+// held by the caller.
+func (ds *Datastore) loadQuota(dom string) *hostQuota {
+	q, ok := ds.quotas[dom]
+	if ok {
+		return q
+	}
+
+	var byteQuota, quotaBytes int64
+	var day time.Time
+	err := ds.db.Query(`SELECT byte_quota, quota_bytes, quota_day FROM domain_info WHERE dom = ?`,
+		dom).Scan(&byteQuota, &quotaBytes, &day)
+	if err != nil {
+		log4go.Error("Failed to read download quota for %v: %v", dom, err)
+	}
+	q = &hostQuota{limit: effectiveByteQuota(byteQuota), used: quotaBytes, day: day}
+	ds.quotas[dom] = q
+	return q
+}
+
+// addDownloadedBytes adds n bytes to today's download total for dom and
+// persists the new total to domain_info.
+func (ds *Datastore) addDownloadedBytes(dom string, n int64) {
+	ds.quotaMu.Lock()
+	q := ds.loadQuota(dom)
+	q.add(n, time.Now())
+	used, day := q.used, q.day
+	ds.quotaMu.Unlock()
+
+	err := ds.db.Query(`UPDATE domain_info SET quota_bytes = ?, quota_day = ? WHERE dom = ?`,
+		used, day, dom).Exec()
+	if err != nil {
+		log4go.Error("Failed to update download quota for %v: %v", dom, err)
+	}
+}
+
+// robotsChangeMaxLinks caps how many crawled links of a host StoreRobotsTxt
+// checks against changed robots.txt rules
+const robotsChangeMaxLinks = 10000
+
+// StoreRobotsTxt is documented on the walker.Datastore interface. When the
+// contents differ from what was stored for host last time, it counts the
+// previously crawled links that the old rules allowed but the new rules block.
+// The time of the change and that count are recorded in domain_info
+// (robots_changed and robots_blocked), and a warning is logged if the count is
+// non-zero, since it likely means crawl coverage for this domain will drop.
+func (ds *Datastore) StoreRobotsTxt(host string, body []byte) {
+	u, err := walker.ParseURL("http://" + host + "/")
+	if err != nil {
+		log4go.Error("StoreRobotsTxt failed to parse host %v: %v", host, err)
+		return
+	}
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		log4go.Error("StoreRobotsTxt failed to get domain for %v: %v", host, err)
+		return
+	}
+
+	hash := fnv.New64()
+	hash.Write(body)
+	fp := int64(hash.Sum64())
+
+	var oldFp int64
+	var oldBody string
+	err = ds.db.Query(`SELECT fnv, body FROM robots_txt WHERE dom = ? AND subdom = ?`,
+		dom, subdom).Scan(&oldFp, &oldBody)
+	found := true
+	if err == gocql.ErrNotFound {
+		found = false
+	} else if err != nil {
+		log4go.Error("Failed to read stored robots.txt for %v: %v", host, err)
+		return
+	}
+
+	now := time.Now()
+	if found && oldFp == fp {
+		return
+	}
+	err = ds.db.Query(`INSERT INTO robots_txt (dom, subdom, fnv, body, changed) VALUES (?, ?, ?, ?, ?)`,
+		dom, subdom, fp, string(body), now).Exec()
+	if err != nil {
+		log4go.Error("Failed to store robots.txt for %v: %v", host, err)
+		return
+	}
+	if !found {
+		// First time we've seen it, nothing to compare against
+		return
+	}
+
+	blocked, err := ds.countNewlyBlocked(dom, subdom, []byte(oldBody), body)
+	if err != nil {
+		log4go.Error("Failed to compare robots.txt rules for %v: %v", host, err)
+		return
+	}
+	if blocked > 0 {
+		log4go.Warn("robots.txt for %v changed and now blocks %v previously crawled links", host, blocked)
+	} else {
+		log4go.Info("robots.txt for %v changed", host)
+	}
+	err = ds.db.Query(`UPDATE domain_info SET robots_changed = ?, robots_blocked = ? WHERE dom = ?`,
+		now, blocked, dom).Exec()
+	if err != nil {
+		log4go.Error("Failed to flag robots.txt change for %v: %v", dom, err)
+	}
+}
+
+// StoreControlFileOverLimit is documented on the walker.Datastore interface.
+// It is recorded in domain_info (over_limit and over_limit_link).
+func (ds *Datastore) StoreControlFileOverLimit(host, link string, limit int64) {
+	u, err := walker.ParseURL("http://" + host + "/")
+	if err != nil {
+		log4go.Error("StoreControlFileOverLimit failed to parse host %v: %v", host, err)
+		return
+	}
+	dom, err := u.ToplevelDomainPlusOne()
+	if err != nil {
+		log4go.Error("StoreControlFileOverLimit failed to get domain for %v: %v", host, err)
+		return
+	}
+	err = ds.db.Query(`UPDATE domain_info SET over_limit = ?, over_limit_link = ? WHERE dom = ?`,
+		time.Now(), link, dom).Exec()
+	if err != nil {
+		log4go.Error("Failed to flag %v over its size limit for %v: %v", link, dom, err)
+	}
+}
+
+// countNewlyBlocked returns the number of crawled links in dom/subdom which
+// robots.txt contents oldBody allow for our user agent but newBody disallows.
+func (ds *Datastore) countNewlyBlocked(dom, subdom string, oldBody, newBody []byte) (int, error) {
+	oldRobots, err := robotstxt.FromBytes(oldBody)
+	if err != nil {
+		return 0, err
+	}
+	newRobots, err := robotstxt.FromBytes(newBody)
+	if err != nil {
+		return 0, err
+	}
+	oldGroup := oldRobots.FindGroup(walker.Config.Fetcher.UserAgent)
+	newGroup := newRobots.FindGroup(walker.Config.Fetcher.UserAgent)
+
+	blocked := 0
+	checked := 0
+	lastPath := ""
+	var path string
+	var crawlTime time.Time
+	itr := ds.db.Query(`SELECT path, time FROM links WHERE dom = ? AND bucket IN ? AND subdom = ?`,
+		dom, linkBuckets(), subdom).Iter()
+	for itr.Scan(&path, &crawlTime) {
+		// Rows for the same path are adjacent; count each crawled path once
+		if path == lastPath || crawlTime.Equal(walker.NotYetCrawled) {
+			continue
+		}
+		lastPath = path
+		if oldGroup.Test(path) && !newGroup.Test(path) {
+			blocked++
+		}
+		checked++
+		if checked >= robotsChangeMaxLinks {
+			break
+		}
+	}
+	return blocked, itr.Close()
+}
+
+// CrawlDelayOverride is documented on the walker.Datastore interface.
+func (ds *Datastore) CrawlDelayOverride(host string) time.Duration {
+	var delay int
+	err := ds.db.Query(`SELECT crawl_delay FROM domain_info WHERE dom = ?`, host).Scan(&delay)
+	if err != nil && err != gocql.ErrNotFound {
+		log4go.Error("Failed to read crawl delay override for %v: %v", host, err)
+		return 0
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+// BurstMode is documented on the walker.Datastore interface.
+func (ds *Datastore) BurstMode(host string) bool {
+	var until time.Time
+	err := ds.db.Query(`SELECT burst_until FROM domain_info WHERE dom = ?`, host).Scan(&until)
+	if err != nil && err != gocql.ErrNotFound {
+		log4go.Error("Failed to read burst mode of %v: %v", host, err)
+		return false
+	}
+	return burstActive(until)
+}
+
+// scopeCacheTTL is how long the Datastore keeps the crawl scope of a domain
+// before reading it again, so a scope changed by an operator applies within
+// it on every node
+const scopeCacheTTL = time.Minute
+
+// cachedScope is the crawl scope of a domain, nil if it has none
+type cachedScope struct {
+	scope *walker.CrawlScope
+	read  time.Time
+}
+
+// domainScope returns the crawl scope of domain, or nil if it has none (or it
+// can't be read), reading it again if it was cached longer than scopeCacheTTL
+// ago
+func (ds *Datastore) domainScope(domain string) *walker.CrawlScope {
+	if c, ok := ds.scopes.Get(domain); ok && time.Since(c.(*cachedScope).read) < scopeCacheTTL {
+		return c.(*cachedScope).scope
+	}
+	var scope *walker.CrawlScope
+	var mode, pattern string
+	var subdomains []string
+	err := ds.db.Query(`SELECT scope, scope_subdoms, scope_pattern FROM domain_info WHERE dom = ?`,
+		domain).Scan(&mode, &subdomains, &pattern)
+	if err != nil && err != gocql.ErrNotFound {
+		log4go.Error("Failed to read crawl scope of %v: %v", domain, err)
+		return nil
+	}
+	if mode != "" && mode != walker.ScopeAll {
+		scope = &walker.CrawlScope{Mode: mode, Subdomains: subdomains, Pattern: pattern}
+		if err := scope.Compile(); err != nil {
+			log4go.Error("Ignoring crawl scope of %v: %v", domain, err)
+			scope = nil
+		}
+	}
+	ds.scopes.Add(domain, &cachedScope{scope: scope, read: time.Now()})
+	return scope
+}
+
+// StoreHostContext is documented on the walker.Datastore interface. The
+// context expires after fetcher.host_context_ttl.
+func (ds *Datastore) StoreHostContext(host string, hc *walker.HostContext) {
+	if ds.hostContextTTL <= 0 {
+		return
+	}
+	err := ds.db.Query(`INSERT INTO host_context (dom, robots, no_robots, robots_time, addrs, crawl_delay)
+						VALUES (?, ?, ?, ?, ?, ?) USING TTL ?`,
+		host, hc.Robots, hc.NoRobots, hc.RobotsTime, hc.Addrs, int(hc.CrawlDelay/time.Millisecond),
+		ds.hostContextTTL).Exec()
+	if err != nil {
+		log4go.Error("Failed to store host context for %v: %v", host, err)
+	}
+}
+
+// LoadHostContext is documented on the walker.Datastore interface.
+func (ds *Datastore) LoadHostContext(host string) *walker.HostContext {
+	hc := &walker.HostContext{}
+	var delay int
+	err := ds.db.Query(`SELECT robots, no_robots, robots_time, addrs, crawl_delay
+						FROM host_context WHERE dom = ?`, host).Scan(
+		&hc.Robots, &hc.NoRobots, &hc.RobotsTime, &hc.Addrs, &delay)
+	if err == gocql.ErrNotFound {
+		return nil
+	} else if err != nil {
+		log4go.Error("Failed to load host context for %v: %v", host, err)
+		return nil
+	}
+	hc.CrawlDelay = time.Duration(delay) * time.Millisecond
+	return hc
+}
+
+// StorePageState is documented on the walker.Datastore interface.
+func (ds *Datastore) StorePageState(u *walker.URL, ps *walker.PageState) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		log4go.Error("StorePageState not storing %v: %v", u, err)
+		return
+	}
+	err = ds.db.Query(`INSERT INTO page_state (dom, subdom, path, proto, time, fnv, outlinks, watches)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		dom, subdom, u.RequestURI(), u.Scheme, ps.FetchTime, ps.Fingerprint, ps.Outlinks, ps.Watches).Exec()
+	if err != nil {
+		log4go.Error("Failed to store page state of %v: %v", u, err)
+	}
+}
+
+// LoadPageState is documented on the walker.Datastore interface.
+func (ds *Datastore) LoadPageState(u *walker.URL) *walker.PageState {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return nil
+	}
+	ps := &walker.PageState{}
+	err = ds.db.Query(`SELECT time, fnv, outlinks, watches FROM page_state
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+		dom, subdom, u.RequestURI(), u.Scheme).Scan(&ps.FetchTime, &ps.Fingerprint, &ps.Outlinks, &ps.Watches)
+	if err == gocql.ErrNotFound {
+		return nil
+	} else if err != nil {
+		log4go.Error("Failed to load page state of %v: %v", u, err)
+		return nil
+	}
+	return ps
+}
+
+// QuarantineHost is documented on the walker.Datastore interface.
+func (ds *Datastore) QuarantineHost(host string, until time.Time) {
+	err := ds.db.Query(`UPDATE domain_info SET quarantine_until = ? WHERE dom = ?`, until, host).Exec()
+	if err != nil {
+		log4go.Error("Failed to quarantine %v: %v", host, err)
+	}
 }
 
 // KeepAlive is documented on the walker.Datastore interface.
 func (ds *Datastore) KeepAlive() error {
-	err := ds.db.Query(`INSERT INTO active_fetchers (tok) VALUES (?) USING TTL ?`,
-		ds.crawlerUUID, ds.activeFetchersTTL).Exec()
-	return err
+	err := ds.db.Query(`INSERT INTO active_fetchers (tok, node) VALUES (?, ?) USING TTL ?`,
+		ds.crawlerUUID, ds.claimNode, ds.activeFetchersTTL).Exec()
+	if err != nil {
+		return walker.NewError(walker.ErrDatastoreUnavailable, err)
+	}
+	return ds.refreshProgress()
 }
 
 // hasDomain expects a TopLevelDomain+1 (no subdomain) and returns true if the
@@ -505,10 +1383,15 @@ func (ds *Datastore) addDomain(dom string) {
 func (ds *Datastore) addDomainWithExcludeReason(dom string, reason string) error {
 
 	// Try insert with excluded set to avoid dispatcher picking this domain up before the
-	// excluded reason can be set.
-	query := `INSERT INTO domain_info (dom, claim_tok, dispatched, priority, excluded) 
-					 VALUES (?, ?, false, ?, true) IF NOT EXISTS`
-	err := ds.db.Query(query, dom, gocql.UUID{}, walker.Config.Cassandra.DefaultDomainPriority).Exec()
+	// excluded reason can be set. A new domain starts its bootstrap boost.
+	var boostUntil time.Time
+	if ds.newDomainBoostPeriod > 0 {
+		boostUntil = time.Now().Add(ds.newDomainBoostPeriod)
+	}
+	query := `INSERT INTO domain_info (dom, claim_tok, dispatched, priority, excluded, boost_until) 
+					 VALUES (?, ?, false, ?, true, ?) IF NOT EXISTS`
+	err := ds.db.Query(query, dom, gocql.UUID{}, walker.Config.Cassandra.DefaultDomainPriority,
+		boostValue(boostUntil)).Exec()
 	if err != nil {
 		return err
 	}
@@ -551,18 +1434,35 @@ func (ds *Datastore) MaxPriority() int {
 // DomainInfo calls
 //
 
-func (ds *Datastore) FindDomain(domain string) (*DomainInfo, error) {
-	itr := ds.db.Query(`SELECT claim_tok, claim_time, excluded, exclude_reason, priority, tot_links, uncrawled_links, 
-						queued_links FROM domain_info WHERE dom = ?`, domain).Iter()
+// domainInfoColumns are the domain_info columns read by scanDomainInfo, in
+// order
+const domainInfoColumns = `dom, claim_tok, claim_time, dispatched, excluded, exclude_reason, priority,
+				tot_links, uncrawled_links, queued_links, error_links, parse_error_links, recent_links, byte_quota,
+				quota_bytes, quota_day, robots_changed, robots_blocked, crawl_delay, mirr_for, boost_until,
+				quarantine_until, robots_excluded_links, noindex_links, nofollow_links, over_limit, over_limit_link,
+				claim_node, scope, scope_subdoms, scope_pattern, max_segs, burst_until,
+				type_counts, status_counts`
+
+// scanDomainInfo reads the next row of an iterator over domainInfoColumns. It
+// returns nil when there are no more rows.
+func scanDomainInfo(itr *gocql.Iter) *DomainInfo {
+	var domain, excludeReason, mirrorOf, overLimitLink, claimNode, scope, scopePattern string
+	var scopeSubdomains []string
 	var claimTok gocql.UUID
-	var claimTime time.Time
-	var excluded bool
-	var excludeReason string
-	var priority, linksCount, uncrawledLinksCount, queuedLinksCount int
-	if !itr.Scan(&claimTok, &claimTime, &excluded, &excludeReason, &priority, &linksCount, &uncrawledLinksCount,
-		&queuedLinksCount) {
-		err := itr.Close()
-		return nil, err
+	var claimTime, qday, robotsChanged, boostUntil, burstUntil, quarantineUntil, overLimit time.Time
+	var dispatched, excluded bool
+	var priority, linksCount, uncrawledLinksCount, queuedLinksCount, errorLinksCount, recentLinksCount int
+	var parseErrorLinksCount, robotsBlocked, crawlDelay, maxSegments int
+	var robotsExcludedCount, noIndexCount, noFollowCount int
+	var byteQuota, quotaBytes int64
+	var typeCounts, statusCounts map[string]int
+	if !itr.Scan(&domain, &claimTok, &claimTime, &dispatched, &excluded, &excludeReason, &priority,
+		&linksCount, &uncrawledLinksCount, &queuedLinksCount, &errorLinksCount, &parseErrorLinksCount, &recentLinksCount,
+		&byteQuota, &quotaBytes, &qday, &robotsChanged, &robotsBlocked, &crawlDelay, &mirrorOf, &boostUntil,
+		&quarantineUntil, &robotsExcludedCount, &noIndexCount, &noFollowCount, &overLimit, &overLimitLink,
+		&claimNode, &scope, &scopeSubdomains, &scopePattern, &maxSegments, &burstUntil,
+		&typeCounts, &statusCounts) {
+		return nil
 	}
 
 	reason := ""
@@ -572,46 +1472,85 @@ func (ds *Datastore) FindDomain(domain string) (*DomainInfo, error) {
 		// This should just be a backstop in case someone doesn't set exclude_reason.
 		reason = "Exclusion marked"
 	}
-	dinfo := &DomainInfo{
-		Domain:               domain,
-		ClaimToken:           claimTok,
-		ClaimTime:            claimTime,
-		Excluded:             excluded,
-		ExcludeReason:        reason,
-		Priority:             priority,
-		NumberLinksTotal:     linksCount,
-		NumberLinksUncrawled: uncrawledLinksCount,
-		NumberLinksQueued:    queuedLinksCount,
-	}
-	err := itr.Close()
-	if err != nil {
-		return dinfo, err
+	return &DomainInfo{
+		Domain:                    domain,
+		ClaimToken:                claimTok,
+		ClaimNode:                 claimNode,
+		ClaimTime:                 claimTime,
+		Dispatched:                dispatched,
+		Excluded:                  excluded,
+		ExcludeReason:             reason,
+		Priority:                  priority,
+		NumberLinksTotal:          linksCount,
+		NumberLinksUncrawled:      uncrawledLinksCount,
+		NumberLinksQueued:         queuedLinksCount,
+		NumberLinksFailed:         errorLinksCount,
+		NumberLinksParseFailed:    parseErrorLinksCount,
+		NumberLinksRecent:         recentLinksCount,
+		NumberLinksRobotsExcluded: robotsExcludedCount,
+		NumberLinksNoIndex:        noIndexCount,
+		NumberLinksNoFollow:       noFollowCount,
+		ByteQuota:                 byteQuota,
+		BytesDownloaded:           quotaBytes,
+		QuotaDay:                  qday,
+		RobotsChanged:             robotsChanged,
+		RobotsNewlyBlocked:        robotsBlocked,
+		CrawlDelay:                time.Duration(crawlDelay) * time.Millisecond,
+		Scope:                     walker.CrawlScope{Mode: scope, Subdomains: scopeSubdomains, Pattern: scopePattern},
+		MaxSegments:               maxSegments,
+		MirrorOf:                  mirrorOf,
+		BoostUntil:                boostUntil,
+		BurstUntil:                burstUntil,
+		QuarantineUntil:           quarantineUntil,
+		OverLimit:                 overLimit,
+		OverLimitLink:             overLimitLink,
+		TypeCounts:                typeCounts,
+		StatusCounts:              statusCounts,
 	}
+}
 
+func (ds *Datastore) FindDomain(domain string) (*DomainInfo, error) {
+	itr := ds.db.Query(`SELECT `+domainInfoColumns+` FROM domain_info WHERE dom = ?`, domain).Iter()
+	dinfo := scanDomainInfo(itr)
+	err := itr.Close()
 	return dinfo, err
 }
 
 func (ds *Datastore) ListDomains(query DQ) ([]*DomainInfo, error) {
 	conditions := []string{}
 	args := []interface{}{}
-	if query.Working {
+	if query.Working || query.Dispatched == FilterTrue {
 		conditions = append(conditions, "dispatched = true")
 	}
 
+	sorted := query.Sort != SortByToken
+	var cursor *DomainInfo
 	if query.Seed != "" {
-		conditions = append(conditions, "TOKEN(dom) > TOKEN(?)")
-		args = append(args, query.Seed)
+		if sorted {
+			// The seed's current row tells us where in the sort order it is
+			var err error
+			cursor, err = ds.FindDomain(query.Seed)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to find seed domain %v: %v", query.Seed, err)
+			}
+			if cursor == nil {
+				return nil, walker.NewError(walker.ErrNotFound, fmt.Errorf("Seed domain %v not found", query.Seed))
+			}
+		} else {
+			conditions = append(conditions, "TOKEN(dom) > TOKEN(?)")
+			args = append(args, query.Seed)
+		}
 	}
 
-	cql := `SELECT dom, claim_tok, claim_time, excluded, exclude_reason, priority,
-				   tot_links, uncrawled_links, queued_links 
-			FROM domain_info`
+	cql := `SELECT ` + domainInfoColumns + ` FROM domain_info`
 
 	if len(conditions) > 0 {
 		cql += " WHERE " + strings.Join(conditions, " AND ")
 	}
 
-	if query.Limit > 0 {
+	// Other filters are applied as we read, so we can only have cassandra
+	// limit the rows if there are none
+	if query.Limit > 0 && !sorted && !query.filtered() {
 		cql += " LIMIT ?"
 		args = append(args, query.Limit)
 	}
@@ -620,41 +1559,96 @@ func (ds *Datastore) ListDomains(query DQ) ([]*DomainInfo, error) {
 	itr := ds.db.Query(cql, args...).Iter()
 
 	var dinfos []*DomainInfo
-	var domain, excludeReason string
-	var claimTok gocql.UUID
-	var claimTime time.Time
-	var excluded bool
-	var priority, linksCount, uncrawledLinksCount, queuedLinksCount int
-	for itr.Scan(&domain, &claimTok, &claimTime, &excluded, &excludeReason, &priority, &linksCount,
-		&uncrawledLinksCount, &queuedLinksCount) {
-		reason := ""
-		if excludeReason != "" {
-			reason = excludeReason
-		} else if excluded {
-			// This should just be a backstop in case someone doesn't set exclude_reason.
-			reason = "Exclusion marked"
+	for dinfo := scanDomainInfo(itr); dinfo != nil; dinfo = scanDomainInfo(itr) {
+		if !query.matches(dinfo) {
+			continue
 		}
 
-		dinfos = append(dinfos, &DomainInfo{
-			Domain:               domain,
-			ClaimToken:           claimTok,
-			ClaimTime:            claimTime,
-			Excluded:             excluded,
-			ExcludeReason:        reason,
-			Priority:             priority,
-			NumberLinksTotal:     linksCount,
-			NumberLinksUncrawled: uncrawledLinksCount,
-			NumberLinksQueued:    queuedLinksCount,
-		})
+		if !sorted {
+			dinfos = append(dinfos, dinfo)
+			if query.Limit > 0 && len(dinfos) >= query.Limit {
+				break
+			}
+			continue
+		}
+
+		// Sorting means reading every domain, but only the first Limit after
+		// the cursor need to be kept
+		if cursor != nil && !query.less(cursor, dinfo) {
+			continue
+		}
+		dinfos = append(dinfos, dinfo)
+		if query.Limit > 0 && len(dinfos) >= 2*query.Limit {
+			sort.Sort(domainSorter{dinfos, query})
+			dinfos = dinfos[:query.Limit]
+		}
 	}
 	err := itr.Close()
-	if err != nil {
-		return dinfos, err
-	}
 
+	if sorted {
+		sort.Sort(domainSorter{dinfos, query})
+		if query.Limit > 0 && len(dinfos) > query.Limit {
+			dinfos = dinfos[:query.Limit]
+		}
+	}
 	return dinfos, err
 }
 
+// filtered returns true if q has filters that have to be applied to rows as
+// they are read (see matches)
+func (q *DQ) filtered() bool {
+	return q.Excluded != FilterAny || q.Dispatched == FilterFalse || q.Claimed != FilterAny ||
+		q.MinPriority != 0 || q.MinErrorRate > 0
+}
+
+// matches returns true if d passes the filters of q
+func (q *DQ) matches(d *DomainInfo) bool {
+	return q.Excluded.match(d.Excluded) &&
+		q.Dispatched.match(d.Dispatched) &&
+		q.Claimed.match(d.ClaimToken != gocql.UUID{}) &&
+		(q.MinPriority == 0 || d.Priority >= q.MinPriority) &&
+		(q.MinErrorRate <= 0 || d.ErrorRate() >= q.MinErrorRate)
+}
+
+// sortKey returns the value of d that q sorts on
+func (q *DQ) sortKey(d *DomainInfo) float64 {
+	switch q.Sort {
+	case SortByPriority:
+		return float64(d.Priority)
+	case SortByLinks:
+		return float64(d.NumberLinksTotal)
+	case SortByUncrawled:
+		return float64(d.NumberLinksUncrawled)
+	case SortByClaimTime:
+		return float64(d.ClaimTime.UnixNano())
+	case SortByErrorRate:
+		return d.ErrorRate()
+	case SortByCoverageLoss:
+		return d.CoverageLoss()
+	}
+	return 0
+}
+
+// less orders domains by q's sort key (descending if SortDesc), breaking ties
+// by domain name so the order is stable across pages
+func (q *DQ) less(a, b *DomainInfo) bool {
+	ka, kb := q.sortKey(a), q.sortKey(b)
+	if ka != kb {
+		return (ka < kb) != q.SortDesc
+	}
+	return a.Domain < b.Domain
+}
+
+// domainSorter sorts DomainInfos for a DQ
+type domainSorter struct {
+	dinfos []*DomainInfo
+	query  DQ
+}
+
+func (s domainSorter) Len() int           { return len(s.dinfos) }
+func (s domainSorter) Swap(i, j int)      { s.dinfos[i], s.dinfos[j] = s.dinfos[j], s.dinfos[i] }
+func (s domainSorter) Less(i, j int) bool { return s.query.less(s.dinfos[i], s.dinfos[j]) }
+
 func (ds *Datastore) UpdateDomain(domain string, info *DomainInfo, cfg DomainInfoUpdateConfig) error {
 
 	vars := []string{}
@@ -674,6 +1668,69 @@ func (ds *Datastore) UpdateDomain(domain string, info *DomainInfo, cfg DomainInf
 		args = append(args, info.Priority)
 	}
 
+	if cfg.ByteQuota {
+		vars = append(vars, "byte_quota")
+		args = append(args, info.ByteQuota)
+
+		// Make sure a claimed domain picks up the new quota
+		ds.quotaMu.Lock()
+		delete(ds.quotas, domain)
+		ds.quotaMu.Unlock()
+	}
+
+	if cfg.CrawlDelay {
+		if info.CrawlDelay < 0 {
+			return fmt.Errorf("Crawl delay must not be negative, got %v", info.CrawlDelay)
+		}
+		vars = append(vars, "crawl_delay")
+		args = append(args, int(info.CrawlDelay/time.Millisecond))
+	}
+
+	if cfg.Scope {
+		scope := info.Scope
+		if err := scope.Compile(); err != nil {
+			return err
+		}
+		if scope.Mode == walker.ScopeAll {
+			scope = walker.CrawlScope{}
+		}
+		vars = append(vars, "scope", "scope_subdoms", "scope_pattern")
+		args = append(args, scope.Mode, scope.Subdomains, scope.Pattern)
+
+		if ds.scopes != nil {
+			ds.scopes.Remove(domain)
+		}
+	}
+
+	if cfg.MaxSegments {
+		if info.MaxSegments < 0 {
+			return fmt.Errorf("Max outstanding segments must not be negative, got %v", info.MaxSegments)
+		}
+		vars = append(vars, "max_segs")
+		args = append(args, info.MaxSegments)
+	}
+
+	if cfg.BoostUntil {
+		if boostActive(info.BoostUntil) {
+			// Boosting only makes sense for a domain that will be crawled
+			if err := ds.checkCrawlable(domain, info, cfg, "boost"); err != nil {
+				return err
+			}
+		}
+		vars = append(vars, "boost_until")
+		args = append(args, boostValue(info.BoostUntil))
+	}
+
+	if cfg.BurstUntil {
+		if burstActive(info.BurstUntil) {
+			if err := ds.checkCrawlable(domain, info, cfg, "burst"); err != nil {
+				return err
+			}
+		}
+		vars = append(vars, "burst_until")
+		args = append(args, burstValue(info.BurstUntil))
+	}
+
 	if len(vars) < 1 {
 		return fmt.Errorf("Expected at least one variable set in cfg (of type DomainInfoUpdateConfig)")
 	}
@@ -697,6 +1754,72 @@ func (ds *Datastore) UpdateDomain(domain string, info *DomainInfo, cfg DomainInf
 	return err
 }
 
+// checkCrawlable returns walker.ErrNotFound if domain doesn't exist, or
+// walker.ErrExcluded if it is excluded and the update doesn't unexclude it,
+// naming what the update was to do to it
+func (ds *Datastore) checkCrawlable(domain string, info *DomainInfo, cfg DomainInfoUpdateConfig, what string) error {
+	var excluded bool
+	err := ds.db.Query(`SELECT excluded FROM domain_info WHERE dom = ?`, domain).Scan(&excluded)
+	if err == gocql.ErrNotFound {
+		return walker.NewError(walker.ErrNotFound, fmt.Errorf("Domain %v not found", domain))
+	} else if err != nil {
+		return err
+	} else if excluded && !(cfg.Exclude && !info.Excluded) {
+		return walker.NewError(walker.ErrExcluded, fmt.Errorf("Cannot %v excluded domain %v", what, domain))
+	}
+	return nil
+}
+
+//
+// Download quota helpers
+//
+
+// hostQuota tracks how many bytes have been downloaded from a domain on a
+// given day.
+type hostQuota struct {
+	// bytes allowed per day; <= 0 means no quota
+	limit int64
+
+	// bytes downloaded on day
+	used int64
+
+	// the (UTC) day used was counted for
+	day time.Time
+}
+
+// quotaDay returns the start of the UTC day containing t.
+func quotaDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// effectiveByteQuota converts the byte_quota column of domain_info into the
+// number of bytes allowed per day, or 0 if there is no quota.
+func effectiveByteQuota(byteQuota int64) int64 {
+	if byteQuota == 0 {
+		return walker.Config.Cassandra.DefaultDailyByteQuota
+	} else if byteQuota < 0 {
+		return 0
+	}
+	return byteQuota
+}
+
+// exceeded returns true if the quota has been used up for the day containing
+// now.
+func (q *hostQuota) exceeded(now time.Time) bool {
+	return q.limit > 0 && q.day.Equal(quotaDay(now)) && q.used >= q.limit
+}
+
+// add counts n more bytes downloaded at time now, starting a fresh count if
+// now falls on a new day.
+func (q *hostQuota) add(n int64, now time.Time) {
+	today := quotaDay(now)
+	if !q.day.Equal(today) {
+		q.day = today
+		q.used = 0
+	}
+	q.used += n
+}
+
 //
 // LinkInfo calls
 //
@@ -719,13 +1842,14 @@ func (ds *Datastore) FindLink(u *walker.URL, collectContent bool) (*LinkInfo, er
 	}
 
 	itr := ds.db.Query(
-		`SELECT dom, subdom, path, proto, time, stat, err, robot_ex `+
+		`SELECT dom, subdom, path, proto, time, stat, err, robot_ex, mime, size, parse_err `+
 			extraSelect+
 			"FROM links "+
 			"WHERE dom = ? AND"+
+			"     bucket = ? AND"+
 			"	  subdom = ? AND"+
 			"     path = ? AND"+
-			"     proto = ?", tld1, subtld1, u.RequestURI(), u.Scheme).Iter()
+			"     proto = ?", tld1, LinkBucket(subtld1, u.RequestURI()), subtld1, u.RequestURI(), u.Scheme).Iter()
 	rtimes := map[string]rememberTimes{}
 	linfos, err := ds.collectLinkInfos(nil, rtimes, itr, 1, nil, collectContent)
 	if err != nil {
@@ -769,6 +1893,8 @@ func (ds *Datastore) FindLink(u *walker.URL, collectContent bool) (*LinkInfo, er
 // SELECT * FROM links WHERE domain = startDomain AND subdomain = startSubDomain AND path > startPath
 // SELECT * FROM links WHERE domain = startDomain AND subdomain > startSubDomain
 //
+// (all within one bucket of the domain; ListLinks runs these against each bucket and merges the results)
+//
 // Now the only piece left, is that crawl_time is part of the primary key. Generally we're only going to take the latest
 // crawl time. But see Historical query
 //
@@ -784,28 +1910,49 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 		return nil, fmt.Errorf("Bad value for limit parameter %d", query.Limit)
 	}
 
-	var acceptLink func(string) bool
-	if query.FilterRegex != "" {
-		re, err := regexp.Compile(query.FilterRegex)
-		if err != nil {
-			return nil, fmt.Errorf("FilterRegex compile error: %v", err)
+	var acceptLink func(*LinkInfo) bool
+	if query.FilterRegex != "" || query.MimeType != "" || query.MinSize > 0 || query.MaxSize > 0 || query.ParseFailed {
+		var re *regexp.Regexp
+		if query.FilterRegex != "" {
+			var err error
+			re, err = regexp.Compile(query.FilterRegex)
+			if err != nil {
+				return nil, fmt.Errorf("FilterRegex compile error: %v", err)
+			}
 		}
-		acceptLink = func(s string) bool {
-			return re.MatchString(s)
+		mimeType := strings.ToLower(query.MimeType)
+		acceptLink = func(linfo *LinkInfo) bool {
+			if re != nil && !re.MatchString(linfo.URL.String()) {
+				return false
+			}
+			if mimeType != "" && !strings.HasPrefix(linfo.Mime, mimeType) {
+				return false
+			}
+			if query.MinSize > 0 && linfo.Size < query.MinSize {
+				return false
+			}
+			if query.MaxSize > 0 && linfo.Size > query.MaxSize {
+				return false
+			}
+			if query.ParseFailed && linfo.ParseError == "" {
+				return false
+			}
+			return true
 		}
 	}
 
 	var linfos []*LinkInfo
-	rtimes := map[string]rememberTimes{}
 	var table []queryEntry
 
+	// Each query is run against each bucket of the domain in turn; the
+	// bucket is the second argument
 	if query.Seed == nil {
 		table = []queryEntry{
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, mime, size, parse_err
                       FROM links 
-                      WHERE dom = ?`,
-				args: []interface{}{domain},
+                      WHERE dom = ? AND bucket = ?`,
+				args: []interface{}{domain, 0},
 			},
 		}
 	} else {
@@ -819,35 +1966,63 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 
 		table = []queryEntry{
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, mime, size, parse_err
                       FROM links 
-                      WHERE dom = ? AND 
+                      WHERE dom = ? AND bucket = ? AND
                             subdom = ? AND 
                             path = ? AND 
                             proto > ?`,
-				args: []interface{}{dom, sub, pat, pro},
+				args: []interface{}{dom, 0, sub, pat, pro},
 			},
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, mime, size, parse_err
                       FROM links 
-                      WHERE dom = ? AND subdom = ? AND 
+                      WHERE dom = ? AND bucket = ? AND subdom = ? AND 
                             path > ?`,
-				args: []interface{}{dom, sub, pat},
+				args: []interface{}{dom, 0, sub, pat},
 			},
 			queryEntry{
-				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex 
+				query: `SELECT dom, subdom, path, proto, time, stat, err, robot_ex, mime, size, parse_err
                       FROM links 
-                      WHERE dom = ? AND 
+                      WHERE dom = ? AND bucket = ? AND
                             subdom > ?`,
-				args: []interface{}{dom, sub},
+				args: []interface{}{dom, 0, sub},
 			},
 		}
 	}
 
+	// Links are in order within each bucket, so the first query.Limit links
+	// of the domain are among the first query.Limit of each bucket
+	buckets := linkBuckets()
+	for _, bucket := range buckets {
+		blinfos, err := ds.listBucketLinks(table, bucket, query.Limit, acceptLink)
+		if err != nil {
+			return linfos, err
+		}
+		linfos = append(linfos, blinfos...)
+	}
+	if len(buckets) > 1 {
+		linfos = sortLinkInfos(linfos)
+		if len(linfos) > query.Limit {
+			linfos = linfos[:query.Limit]
+		}
+	}
+
+	return linfos, nil
+}
+
+// listBucketLinks runs the layered ListLinks queries in table against one
+// bucket, until limit links are found
+func (ds *Datastore) listBucketLinks(table []queryEntry, bucket int, limit int,
+	acceptLink func(*LinkInfo) bool) ([]*LinkInfo, error) {
+	var linfos []*LinkInfo
 	var err error
+	rtimes := map[string]rememberTimes{}
 	for _, qt := range table {
-		itr := ds.db.Query(qt.query, qt.args...).Iter()
-		linfos, err = ds.collectLinkInfos(linfos, rtimes, itr, query.Limit, acceptLink, false)
+		args := append([]interface{}{}, qt.args...)
+		args[1] = bucket
+		itr := ds.db.Query(qt.query, args...).Iter()
+		linfos, err = ds.collectLinkInfos(linfos, rtimes, itr, limit, acceptLink, false)
 		if err != nil {
 			return linfos, err
 		}
@@ -855,34 +2030,59 @@ func (ds *Datastore) ListLinks(domain string, query LQ) ([]*LinkInfo, error) {
 		err = itr.Close()
 		if err != nil {
 			return linfos, err
-		} else if len(linfos) >= query.Limit {
+		} else if len(linfos) >= limit {
 			return linfos, nil
 		}
 	}
-
 	return linfos, nil
 }
 
+// sortLinkInfos sorts linfos the way the links table orders a domain's links:
+// by subdomain, path, then protocol
+func sortLinkInfos(linfos []*LinkInfo) []*LinkInfo {
+	keys := make(map[*LinkInfo]string, len(linfos))
+	for _, linfo := range linfos {
+		subdom, _ := linfo.URL.Subdomain()
+		keys[linfo] = subdom + "\x00" + linfo.URL.RequestURI() + "\x00" + linfo.URL.Scheme
+	}
+	sort.SliceStable(linfos, func(i, j int) bool { return keys[linfos[i]] < keys[linfos[j]] })
+	return linfos
+}
+
 func (ds *Datastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error) {
 	query := `SELECT dom, subdom, path, proto, time, stat,
-						err, robot_ex, redto_url, getnow, mime, fnv
+						err, robot_ex, redto_url, getnow, mime, fnv, size,
+						amp_url, mobile_url, canon_url, noai, noimageai, nosnippet, max_snippet,
+						img_format, img_width, img_height, exif_make, exif_model, gps_lat, gps_lon, parse_err,
+						crawl_at, handler_err, partial, outlink_doms, node
               FROM links
-              WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`
+              WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ?`
 	tld1, subtld1, err := u.TLDPlusOneAndSubdomain()
 	if err != nil {
 		return nil, err
 	}
 
-	itr := ds.db.Query(query, tld1, subtld1, u.RequestURI(), u.Scheme).Iter()
+	itr := ds.db.Query(query, tld1, LinkBucket(subtld1, u.RequestURI()), subtld1, u.RequestURI(), u.Scheme).Iter()
 
 	var linfos []*LinkInfo
-	var dom, sub, path, prot, getError, mime, redtoURL string
-	var crawlTime time.Time
+	var dom, sub, path, prot, getError, parseError, handlerError, mime, redtoURL string
+	var ampURL, mobileURL, canonURL string
+	var crawlTime, crawlAt time.Time
 	var status int
-	var fnvFP int64
-	var robotsExcluded, getnow bool
+	var fnvFP, size int64
+	var robotsExcluded, getnow, partial bool
+	var noAI, noImageAI, noSnippet bool
+	var maxSnippet int
+	var imgFormat, exifMake, exifModel string
+	var imgWidth, imgHeight int
+	var gpsLat, gpsLon float64
+	var outlinkDoms map[string]int
+	var node string
 	for itr.Scan(&dom, &sub, &path, &prot, &crawlTime, &status,
-		&getError, &robotsExcluded, &redtoURL, &getnow, &mime, &fnvFP) {
+		&getError, &robotsExcluded, &redtoURL, &getnow, &mime, &fnvFP, &size,
+		&ampURL, &mobileURL, &canonURL, &noAI, &noImageAI, &noSnippet, &maxSnippet,
+		&imgFormat, &imgWidth, &imgHeight, &exifMake, &exifModel, &gpsLat, &gpsLon, &parseError,
+		&crawlAt, &handlerError, &partial, &outlinkDoms, &node) {
 		// If we need pagination here at some point...
 		//if count < seedIndex {
 		//	count++
@@ -894,12 +2094,43 @@ func (ds *Datastore) ListLinkHistorical(u *walker.URL) ([]*LinkInfo, error) {
 			URL:            u,
 			Status:         status,
 			Error:          getError,
+			ParseError:     parseError,
 			CrawlTime:      crawlTime,
 			RobotsExcluded: robotsExcluded,
 			RedirectedTo:   redtoURL,
 			GetNow:         getnow,
 			Mime:           mime,
 			FnvFingerprint: fnvFP,
+			Size:           size,
+			AMPURL:         ampURL,
+			MobileURL:      mobileURL,
+			CanonicalURL:   canonURL,
+			NoAI:           noAI,
+			NoImageAI:      noImageAI,
+			NoSnippet:      noSnippet,
+			MaxSnippet:     maxSnippet,
+			CrawlAt:        crawlAt,
+			HandlerError:   handlerError,
+			Partial:        partial,
+			OutlinkDomains: outlinkDoms,
+			Node:           node,
+		}
+		outlinkDoms = nil
+		if imgFormat != "" {
+			linfo.Image = &walker.ImageInfo{
+				Format:      imgFormat,
+				Width:       imgWidth,
+				Height:      imgHeight,
+				CameraMake:  exifMake,
+				CameraModel: exifModel,
+			}
+			// Null reads as 0; a real position of exactly 0,0 is lost, which
+			// is fine since nobody photographs from there
+			if gpsLat != 0 || gpsLon != 0 {
+				linfo.Image.HasGPS = true
+				linfo.Image.Latitude = gpsLat
+				linfo.Image.Longitude = gpsLon
+			}
 		}
 		linfos = append(linfos, linfo)
 
@@ -984,9 +2215,10 @@ func (ds *Datastore) InsertLinks(links []string, excludeDomainReason string) []e
 			continue
 		}
 
-		err = db.Query(`INSERT INTO links (dom, subdom, path, proto, time)
-                                     VALUES (?, ?, ?, ?, ?)`, d, subdom,
-			u.RequestURI(), u.Scheme, walker.NotYetCrawled).Exec()
+		// Depth 0, as these are seeds even if found as links before
+		err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, depth)
+                                     VALUES (?, ?, ?, ?, ?, ?, ?)`, d, LinkBucket(subdom, u.RequestURI()), subdom,
+			u.RequestURI(), u.Scheme, walker.NotYetCrawled, 0).Exec()
 		if err != nil {
 			errList = append(errList, fmt.Errorf("%v # `insert query`: %v", link, err))
 			continue
@@ -996,24 +2228,70 @@ func (ds *Datastore) InsertLinks(links []string, excludeDomainReason string) []e
 	return errList
 }
 
-//collectLinkInfos populates a []LinkInfo list given a cassandra iterator. Arguments are described as:
+// ScheduleLink sets the time link may be crawled no earlier than on its latest
+// row in the links table. A zero at removes the constraint.
+func (ds *Datastore) ScheduleLink(link string, at time.Time) error {
+	u, err := walker.ParseAndNormalizeURL(link)
+	if err != nil {
+		return fmt.Errorf("%v # ParseAndNormalizeURL: %v", link, err)
+	}
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return fmt.Errorf("%v # TLDPlusOneAndSubdomain: %v", link, err)
+	}
+
+	// Rows come out oldest first, so the last one read is the latest
+	var crawlTime, latest time.Time
+	found := false
+	bucket := LinkBucket(subdom, u.RequestURI())
+	itr := ds.db.Query(`SELECT time FROM links WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ?`,
+		dom, bucket, subdom, u.RequestURI(), u.Scheme).Iter()
+	for itr.Scan(&crawlTime) {
+		latest = crawlTime
+		found = true
+	}
+	if err := itr.Close(); err != nil {
+		return fmt.Errorf("%v # select query: %v", link, err)
+	}
+	if !found {
+		return walker.NewError(walker.ErrNotFound, fmt.Errorf("%v # link not found", link))
+	}
+
+	var crawlAt interface{}
+	if !at.IsZero() {
+		crawlAt = at
+	}
+	err = ds.db.Query(`UPDATE links SET crawl_at = ?
+						WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+		crawlAt, dom, bucket, subdom, u.RequestURI(), u.Scheme, latest).Exec()
+	if err != nil {
+		return fmt.Errorf("%v # update query: %v", link, err)
+	}
+	return nil
+}
+
+// collectLinkInfos populates a []LinkInfo list given a cassandra iterator. Arguments are described as:
 // (a) linfos is the list of LinkInfo's to build on
-// (b) rtimes is scratch space used to filter most recent link
+// (b) rtimes is scratch space used to filter most recent link (ind is -1 for
+// links whose most recent row linkAccept rejected)
 // (c) itr is a gocql.Iter instance to be read
 // (d) limit is the max length of linfos
-// (e) linkAccept is a func(string)bool. If linkAccept(linkText) returns false, the link IS NOT retained in linfos [
-//  This is used to implement filterRegex on ListLinks]
+// (e) linkAccept is a func(*LinkInfo)bool. If linkAccept(linfo) returns false, the link IS NOT retained in linfos [
+//
+//	This is used to implement the FilterRegex, MimeType, MinSize, MaxSize and ParseFailed filters on ListLinks]
 func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]rememberTimes, itr *gocql.Iter, limit int,
-	linkAccept func(string) bool, collectContent bool) ([]*LinkInfo, error) {
-	var domain, subdomain, path, protocol, anerror string
+	linkAccept func(*LinkInfo) bool, collectContent bool) ([]*LinkInfo, error) {
+	var domain, subdomain, path, protocol, anerror, parseError, mime string
 	var crawlTime time.Time
 	var robotsExcluded bool
 	var status int
+	var size int64
 	var body string
 	var headers map[string]string
 	var httpHeaders http.Header
 
-	args := []interface{}{&domain, &subdomain, &path, &protocol, &crawlTime, &status, &anerror, &robotsExcluded}
+	args := []interface{}{&domain, &subdomain, &path, &protocol, &crawlTime, &status, &anerror, &robotsExcluded,
+		&mime, &size, &parseError}
 	if collectContent {
 		args = append(args, &body, &headers)
 	}
@@ -1025,10 +2303,6 @@ func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]reme
 		}
 		urlString := u.String()
 
-		if linkAccept != nil && !linkAccept(urlString) {
-			continue
-		}
-
 		qq, yes := rtimes[urlString]
 
 		if yes && qq.ctm.After(crawlTime) {
@@ -1036,14 +2310,7 @@ func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]reme
 		}
 
 		if collectContent {
-			httpHeaders = nil
-			if headers != nil {
-				httpHeaders = http.Header{}
-				for k, v := range headers {
-					vs := strings.Split(v, "\000")
-					httpHeaders[k] = vs
-				}
-			}
+			httpHeaders = decodeHeaders(headers)
 			headers = nil
 		}
 
@@ -1051,17 +2318,35 @@ func (ds *Datastore) collectLinkInfos(linfos []*LinkInfo, rtimes map[string]reme
 			URL:            u,
 			Status:         status,
 			Error:          anerror,
+			ParseError:     parseError,
 			RobotsExcluded: robotsExcluded,
 			CrawlTime:      crawlTime,
+			Mime:           mime,
+			Size:           size,
 			Body:           body,
 			Headers:        httpHeaders,
 		}
 
+		// Only the latest row of a link is filtered, so the link is listed
+		// as it is now rather than as an older row that happens to match.
+		// The time is remembered either way, so no older row is taken
+		// instead.
 		nindex := -1
-		if yes {
-			nindex = qq.ind
-			linfos[qq.ind] = linfo
-		} else {
+		accepted := linkAccept == nil || linkAccept(linfo)
+		if yes && qq.ind >= 0 {
+			if accepted {
+				nindex = qq.ind
+				linfos[qq.ind] = linfo
+			} else {
+				linfos = append(linfos[:qq.ind], linfos[qq.ind+1:]...)
+				for k, rt := range rtimes {
+					if rt.ind > qq.ind {
+						rt.ind--
+						rtimes[k] = rt
+					}
+				}
+			}
+		} else if accepted {
 			// If you've reached the limit, then we're all done
 			if len(linfos) >= limit {
 				break
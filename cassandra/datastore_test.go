@@ -3,11 +3,16 @@
 package cassandra
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"net/smtp"
 	"net/url"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -104,8 +109,8 @@ func TestDatastoreBasic(t *testing.T) {
 								VALUES (?, ?, ?, ?)`
 	insertSegment := `INSERT INTO segments (dom, subdom, path, proto)
 						VALUES (?, ?, ?, ?)`
-	insertLink := `INSERT INTO links (dom, subdom, path, proto, time)
-						VALUES (?, ?, ?, ?, ?)`
+	insertLink := `INSERT INTO links (dom, bucket, subdom, path, proto, time)
+						VALUES (?, 0, ?, ?, ?, ?)`
 
 	queries := []*gocql.Query{
 		db.Query(insertDomainInfo, "test.com", gocql.UUID{}, largePriority, true),
@@ -152,7 +157,7 @@ func TestDatastoreBasic(t *testing.T) {
 		*page2URL.URL: 200,
 	}
 	iter := db.Query(`SELECT dom, subdom, path, proto, time, stat
-						FROM links WHERE dom = 'test.com'`).Iter()
+						FROM links WHERE dom = 'test.com' AND bucket = 0`).Iter()
 	var linkdomain, subdomain, path, protocol string
 	var status int
 	var crawl_time time.Time
@@ -172,7 +177,7 @@ func TestDatastoreBasic(t *testing.T) {
 	ds.StoreParsedURL(walker.MustParse("http://test2.com/page2-1.html"), page2Fetch)
 
 	var count int
-	db.Query(`SELECT COUNT(*) FROM links WHERE dom = 'test2.com'`).Scan(&count)
+	db.Query(`SELECT COUNT(*) FROM links WHERE dom = 'test2.com' AND bucket = 0`).Scan(&count)
 	if count != 2 {
 		t.Errorf("Expected 2 parsed links to be inserted for test2.com, found %v", count)
 	}
@@ -212,7 +217,7 @@ func TestNewDomainAdditions(t *testing.T) {
 		t.Error("Expected test.com not to be added to domain_info")
 	}
 
-	db.Query(`SELECT COUNT(*) FROM links WHERE dom = 'test.com'`).Scan(&count)
+	db.Query(`SELECT COUNT(*) FROM links WHERE dom = 'test.com' AND bucket = 0`).Scan(&count)
 	if count != 0 {
 		t.Errorf("Expected parsed link not to be inserted for test.com, found %v", count)
 	}
@@ -240,6 +245,149 @@ func TestNewDomainAdditions(t *testing.T) {
 	}
 }
 
+// staticBlocklist is a walker.Blocklist of the comma separated domains in its
+// location, for the "test:" blocklist type
+type staticBlocklist struct {
+	name    string
+	domains map[string]bool
+}
+
+func (l *staticBlocklist) Name() string              { return l.name }
+func (l *staticBlocklist) Load() error               { return nil }
+func (l *staticBlocklist) Contains(host string) bool { return l.domains[host] }
+
+func init() {
+	walker.RegisterBlocklistType("test", func(name, location string) (walker.Blocklist, error) {
+		l := &staticBlocklist{name: name, domains: map[string]bool{}}
+		for _, d := range strings.Split(location, ",") {
+			l.domains[d] = true
+		}
+		return l, nil
+	})
+}
+
+func TestNewDomainBlocklisted(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	origAddNewDomains := walker.Config.Cassandra.AddNewDomains
+	origLists := walker.Config.Blocklist.Lists
+	defer func() {
+		walker.Config.Cassandra.AddNewDomains = origAddNewDomains
+		walker.Config.Blocklist.Lists = origLists
+	}()
+	walker.Config.Cassandra.AddNewDomains = true
+	walker.Config.Blocklist.Lists = []string{"test:blocked.com"}
+
+	ds.StoreParsedURL(walker.MustParse("http://www.blocked.com/page.html"), page1Fetch)
+	ds.StoreParsedURL(walker.MustParse("http://allowed.com/page.html"), page1Fetch)
+
+	var count int
+	db.Query(`SELECT COUNT(*) FROM domain_info WHERE dom = 'blocked.com'`).Scan(&count)
+	if count != 0 {
+		t.Error("Expected blocked.com not to be added to domain_info")
+	}
+	db.Query(`SELECT COUNT(*) FROM domain_info WHERE dom = 'allowed.com'`).Scan(&count)
+	if count != 1 {
+		t.Error("Expected allowed.com to be added to domain_info")
+	}
+}
+
+func TestNewDomainVerified(t *testing.T) {
+	origAddNewDomains := walker.Config.Cassandra.AddNewDomains
+	origVerify := walker.Config.Cassandra.VerifyNewDomains
+	origChecks := verifyDomainChecks
+	defer func() {
+		walker.Config.Cassandra.AddNewDomains = origAddNewDomains
+		walker.Config.Cassandra.VerifyNewDomains = origVerify
+		verifyDomainChecks = origChecks
+	}()
+	walker.Config.Cassandra.AddNewDomains = true
+	walker.Config.Cassandra.VerifyNewDomains = []string{walker.VerifyResolve, walker.VerifyNotParked}
+	verified := map[string]int{}
+	verifyDomainChecks = func(dom string, checks []string, transport http.RoundTripper) *walker.PreflightReport {
+		verified[dom]++
+		r := &walker.PreflightReport{Domain: dom}
+		r.Checks = append(r.Checks, walker.PreflightCheck{Name: walker.VerifyResolve, Passed: true})
+		r.Checks = append(r.Checks, walker.PreflightCheck{Name: walker.VerifyNotParked, Passed: dom != "parked.com"})
+		return r
+	}
+
+	db := GetTestDB()
+	ds := getDS(t)
+
+	ds.StoreParsedURL(walker.MustParse("http://parked.com/page.html"), page1Fetch)
+	ds.StoreParsedURL(walker.MustParse("http://parked.com/other.html"), page1Fetch)
+	ds.StoreParsedURL(walker.MustParse("http://real.com/page.html"), page1Fetch)
+
+	var count int
+	db.Query(`SELECT COUNT(*) FROM domain_info WHERE dom = 'parked.com'`).Scan(&count)
+	if count != 0 {
+		t.Error("Expected parked.com not to be added to domain_info")
+	}
+	db.Query(`SELECT COUNT(*) FROM domain_info WHERE dom = 'real.com'`).Scan(&count)
+	if count != 1 {
+		t.Error("Expected real.com to be added to domain_info")
+	}
+	if verified["parked.com"] != 1 {
+		t.Errorf("Expected parked.com to be verified once (then cached), got %d", verified["parked.com"])
+	}
+}
+
+func TestLinksForHostChunks(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	origChunkSize := walker.Config.Cassandra.SegmentReadChunkSize
+	defer func() {
+		walker.Config.Cassandra.SegmentReadChunkSize = origChunkSize
+	}()
+	walker.Config.Cassandra.SegmentReadChunkSize = 2
+
+	var expected []string
+	for _, path := range []string{"/a.html", "/b.html", "/c.html", "/d.html", "/e.html"} {
+		err := db.Query(`INSERT INTO segments (dom, subdom, path, proto) VALUES (?, ?, ?, ?)`,
+			"test.com", "", path, "http").Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert segment: %v", err)
+		}
+		expected = append(expected, "http://test.com"+path)
+	}
+
+	var got []string
+	for u := range ds.LinksForHost("test.com") {
+		got = append(got, u.String())
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected links from LinksForHost: %v\nBut got: %v", expected, got)
+	}
+
+	cursor, err := SegmentCursorFor(walker.MustParse("http://test.com/c.html"))
+	if err != nil {
+		t.Fatalf("SegmentCursorFor failed: %v", err)
+	}
+	got = nil
+	for u := range ds.LinksForHostFrom("test.com", cursor) {
+		got = append(got, u.String())
+	}
+	if !reflect.DeepEqual(got, expected[3:]) {
+		t.Errorf("Expected links from LinksForHostFrom: %v\nBut got: %v", expected[3:], got)
+	}
+
+	// Unclaiming the host stops the read, closing the channel once the
+	// buffered links are drained
+	links := ds.LinksForHost("test.com")
+	<-links
+	ds.UnclaimHost("test.com")
+	n := 0
+	for _ = range links {
+		n++
+	}
+	if n >= len(expected)-1 {
+		t.Errorf("Expected reading to stop after unclaiming, but got %v more links", n)
+	}
+}
+
 type StoreURLExpectation struct {
 	Input    *walker.FetchResults
 	Expected *LinksExpectation
@@ -433,7 +581,7 @@ func TestStoreURLFetchResults(t *testing.T) {
 
 		err := db.Query(
 			`SELECT err, robot_ex, stat, mime, fnv, body, headers FROM links
-			WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`, // AND time = ?`,
+			WHERE dom = ? AND bucket = 0 AND subdom = ? AND path = ? AND proto = ?`, // AND time = ?`,
 			exp.Domain,
 			exp.Subdomain,
 			exp.Path,
@@ -603,7 +751,7 @@ func TestAddingRedirects(t *testing.T) {
 		url := walker.MustParse(exp.link)
 
 		dom, subdom, _ := url.TLDPlusOneAndSubdomain()
-		itr := db.Query("SELECT redto_url FROM links WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?",
+		itr := db.Query("SELECT redto_url FROM links WHERE dom = ? AND bucket = 0 AND subdom = ? AND path = ? AND proto = ?",
 			dom,
 			subdom,
 			url.RequestURI(),
@@ -771,6 +919,114 @@ func TestDomainPriority(t *testing.T) {
 	}
 }
 
+func TestDomainPriorityAging(t *testing.T) {
+	origExp := walker.Config.Cassandra.PriorityAgingExponent
+	defer func() {
+		walker.Config.Cassandra.PriorityAgingExponent = origExp
+	}()
+
+	db := GetTestDB()
+	ds := getDS(t)
+	ds.priorityAgingPeriod = 24 * time.Hour
+	now := time.Now()
+
+	tests := []struct {
+		tag          string
+		priority     int
+		lastDispatch time.Time
+		exponent     float64
+		expected     int
+	}{
+		{"NeverDispatched", 2, time.Time{}, 1, 2},
+		{"JustDispatched", 2, now.Add(time.Second), 1, 2},
+		{"QuarterPeriod", 2, now.Add(-6 * time.Hour), 1, 5},
+		{"QuarterPeriodSquared", 2, now.Add(-6 * time.Hour), 2, 3},
+		{"HalfPeriodSquared", 0, now.Add(-12 * time.Hour), 2, 3},
+		{"PastPeriod", 0, now.Add(-30 * time.Hour), 1, 10},
+	}
+	for _, tst := range tests {
+		walker.Config.Cassandra.PriorityAgingExponent = tst.exponent
+		got := ds.agedPriority(tst.priority, tst.lastDispatch)
+		if got != tst.expected {
+			t.Errorf("For tag %v got aged priority %d, expected %d", tst.tag, got, tst.expected)
+		}
+	}
+	walker.Config.Cassandra.PriorityAgingExponent = 1
+
+	// A priority 0 domain is never claimed, unless it's been waiting long
+	// enough
+	insertDomainInfo := `INSERT INTO domain_info (dom, priority, claim_tok, dispatched, last_dispatch)
+							VALUES (?, 0, 00000000-0000-0000-0000-000000000000, true, ?)`
+	if err := db.Query(insertDomainInfo, "starved.com", now.Add(-25*time.Hour)).Exec(); err != nil {
+		t.Fatalf("Failed to insert domain starved.com: %v", err)
+	}
+	if err := db.Query(insertDomainInfo, "fresh.com", time.Time{}).Exec(); err != nil {
+		t.Fatalf("Failed to insert domain fresh.com: %v", err)
+	}
+
+	var got []string
+	for host := ds.ClaimNewHost(); host != ""; host = ds.ClaimNewHost() {
+		got = append(got, host)
+	}
+	if !reflect.DeepEqual(got, []string{"starved.com"}) {
+		t.Errorf("Expected only starved.com to be claimed, got %v", got)
+	}
+}
+
+func TestClaimStrategies(t *testing.T) {
+	now := time.Now()
+	domains := []struct {
+		dom          string
+		lastDispatch time.Time
+		node         string
+	}{
+		{"a.com", now.Add(-1 * time.Minute), ""},
+		{"b.com", now.Add(-3 * time.Minute), "other"},
+		{"c.com", now.Add(-2 * time.Minute), "me"},
+		{"d.com", now.Add(-1 * time.Hour), "other"},
+	}
+
+	tests := []struct {
+		tag      string
+		strategy ClaimStrategy
+		expected []string
+	}{
+		{"RoundRobin", RoundRobinClaimStrategy{}, []string{"d.com", "b.com", "c.com", "a.com"}},
+		{"Affinity", AffinityClaimStrategy{Node: "me", Wait: 10 * time.Minute},
+			[]string{"c.com", "a.com", "d.com"}},
+	}
+	for _, tst := range tests {
+		db := GetTestDB()
+		ds := getDS(t)
+		ds.SetClaimStrategy(tst.strategy)
+
+		for _, d := range domains {
+			err := db.Query(`INSERT INTO domain_info (dom, priority, claim_tok, dispatched, last_dispatch, claim_node)
+								VALUES (?, 1, 00000000-0000-0000-0000-000000000000, true, ?, ?)`,
+				d.dom, d.lastDispatch, d.node).Exec()
+			if err != nil {
+				t.Fatalf("Failed to insert domain %v: %v", d.dom, err)
+			}
+		}
+
+		var got []string
+		for host := ds.ClaimNewHost(); host != ""; host = ds.ClaimNewHost() {
+			got = append(got, host)
+		}
+		if !reflect.DeepEqual(got, tst.expected) {
+			t.Errorf("For tag %v expected claims %v, got %v", tst.tag, tst.expected, got)
+		}
+
+		var node string
+		if err := db.Query(`SELECT claim_node FROM domain_info WHERE dom = 'a.com'`).Scan(&node); err != nil {
+			t.Fatalf("Failed to select claim_node: %v", err)
+		}
+		if node != ds.claimNode {
+			t.Errorf("For tag %v expected a.com to be claimed by %q, got %q", tst.tag, ds.claimNode, node)
+		}
+	}
+}
+
 func TestDomainPriorityRatio(t *testing.T) {
 	// This test checks the ratio of fetched domains. The deal is we have two domains, d1 and d2, with priorities, p1
 	// and p2. The number of fetches of d1 (d2) is f1 (f2): that is the number of times d1 is claimed (by ClaimNewHost)
@@ -993,3 +1249,1404 @@ func TestUpdateDomain(t *testing.T) {
 	check("Priority & Exclude")
 
 }
+
+func TestHostQuota(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, byte_quota)
+					 VALUES (?, ?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, true, 100).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test domain: %v", err)
+	}
+
+	if ds.HostQuotaExceeded("test.com") {
+		t.Fatalf("Expected test.com to be under quota before any fetches")
+	}
+
+	for _, path := range []string{"/page1.html", "/page2.html"} {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:         walker.MustParse("http://test.com" + path),
+			FetchTime:   time.Now(),
+			ContentSize: 60,
+		})
+	}
+
+	if !ds.HostQuotaExceeded("test.com") {
+		t.Errorf("Expected test.com to be over quota after downloading 120 bytes")
+	}
+
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("Failed to find test.com: %v", err)
+	}
+	if dinfo.BytesDownloaded != 120 {
+		t.Errorf("Expected BytesDownloaded to be 120, got %d", dinfo.BytesDownloaded)
+	}
+	if !dinfo.QuotaDay.Equal(quotaDay(time.Now())) {
+		t.Errorf("Expected QuotaDay to be today, got %v", dinfo.QuotaDay)
+	}
+
+	// A new datastore (i.e. a different fetcher) should see the same totals
+	ds2 := getDS(t)
+	if !ds2.HostQuotaExceeded("test.com") {
+		t.Errorf("Expected persisted quota to show test.com as over quota")
+	}
+
+	// Yesterday's downloads don't count against today
+	err = db.Query(`UPDATE domain_info SET quota_day = ? WHERE dom = ?`,
+		quotaDay(time.Now()).AddDate(0, 0, -1), "test.com").Exec()
+	if err != nil {
+		t.Fatalf("Failed to update quota_day: %v", err)
+	}
+	ds3 := getDS(t)
+	if ds3.HostQuotaExceeded("test.com") {
+		t.Errorf("Expected test.com to be under quota on a new day")
+	}
+}
+
+func TestListLinksMimeSizeFilter(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	now := time.Now()
+	links := []struct {
+		path string
+		mime string
+		size int64
+	}{
+		{"/small.pdf", "application/pdf", 1000},
+		{"/big.pdf", "application/pdf", 20000000},
+		{"/big.html", "text/html", 20000000},
+		{"/img.png", "image/png", 500},
+	}
+	for _, l := range links {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, mime, size)
+						 VALUES (?, 0, ?, ?, ?, ?, ?, ?)`, "test.com", "", l.path, "http", now, l.mime, l.size).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link %v: %v", l.path, err)
+		}
+	}
+
+	tests := []struct {
+		tag      string
+		query    LQ
+		expected []string
+	}{
+		{"BigPDFs", LQ{Limit: 10, MimeType: "application/pdf", MinSize: 10 * 1024 * 1024},
+			[]string{"http://test.com/big.pdf"}},
+		{"AllPDFs", LQ{Limit: 10, MimeType: "application/pdf"},
+			[]string{"http://test.com/big.pdf", "http://test.com/small.pdf"}},
+		{"Images", LQ{Limit: 10, MimeType: "image/"},
+			[]string{"http://test.com/img.png"}},
+		{"Small", LQ{Limit: 10, MaxSize: 1000},
+			[]string{"http://test.com/img.png", "http://test.com/small.pdf"}},
+	}
+
+	for _, tst := range tests {
+		linfos, err := ds.ListLinks("test.com", tst.query)
+		if err != nil {
+			t.Fatalf("ListLinks failed for tag %v: %v", tst.tag, err)
+		}
+		var got []string
+		for _, linfo := range linfos {
+			got = append(got, linfo.URL.String())
+		}
+		if !reflect.DeepEqual(got, tst.expected) {
+			t.Errorf("For tag %v got links %v, expected %v", tst.tag, got, tst.expected)
+		}
+	}
+}
+
+func TestListLinksParseFailed(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	parseErr := fmt.Errorf("HTML tokenizer failed: max buffer exceeded")
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:        walker.MustParse("http://test.com/broken.html"),
+		FetchTime:  time.Now(),
+		ParseError: parseErr,
+	})
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:       walker.MustParse("http://test.com/fine.html"),
+		FetchTime: time.Now(),
+	})
+
+	linfos, err := ds.ListLinks("test.com", LQ{Limit: 10, ParseFailed: true})
+	if err != nil {
+		t.Fatalf("ListLinks failed: %v", err)
+	}
+	if len(linfos) != 1 {
+		t.Fatalf("Expected 1 link that failed to parse, got %d", len(linfos))
+	}
+	if linfos[0].URL.String() != "http://test.com/broken.html" {
+		t.Errorf("Expected http://test.com/broken.html to have failed parsing, got %v", linfos[0].URL)
+	}
+	if linfos[0].ParseError != parseErr.Error() {
+		t.Errorf("ParseError mismatch: got %q, expected %q", linfos[0].ParseError, parseErr.Error())
+	}
+}
+
+func TestListLinksFiltersLatestRow(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	parseErr := fmt.Errorf("HTML tokenizer failed: max buffer exceeded")
+	newer := time.Now().Truncate(time.Millisecond)
+	older := newer.Add(-time.Hour)
+	// fixed.html failed to parse, but not anymore; broke.html the other way
+	// around
+	for _, fr := range []*walker.FetchResults{
+		{URL: walker.MustParse("http://test.com/fixed.html"), FetchTime: older, ParseError: parseErr},
+		{URL: walker.MustParse("http://test.com/fixed.html"), FetchTime: newer},
+		{URL: walker.MustParse("http://test.com/broke.html"), FetchTime: older},
+		{URL: walker.MustParse("http://test.com/broke.html"), FetchTime: newer, ParseError: parseErr},
+	} {
+		ds.StoreURLFetchResults(fr)
+	}
+
+	linfos, err := ds.ListLinks("test.com", LQ{Limit: 10, ParseFailed: true})
+	if err != nil {
+		t.Fatalf("ListLinks failed: %v", err)
+	}
+	if len(linfos) != 1 {
+		t.Fatalf("Expected only the link whose latest fetch failed to parse, got %d links", len(linfos))
+	}
+	if linfos[0].URL.String() != "http://test.com/broke.html" {
+		t.Errorf("Expected http://test.com/broke.html, got %v", linfos[0].URL)
+	}
+	if !linfos[0].CrawlTime.Equal(newer) {
+		t.Errorf("Expected the latest fetch (%v) to be listed, got %v", newer, linfos[0].CrawlTime)
+	}
+}
+
+func TestStoreAlternateURLs(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	page := walker.MustParse("http://test.com/article.html")
+	fr := &walker.FetchResults{
+		URL:          page,
+		FetchTime:    time.Now(),
+		AMPURL:       walker.MustParse("http://test.com/amp/article.html"),
+		CanonicalURL: walker.MustParse("http://test.com/article.html"),
+	}
+	ds.StoreURLFetchResults(fr)
+
+	linfos, err := ds.ListLinkHistorical(page)
+	if err != nil {
+		t.Fatalf("ListLinkHistorical failed: %v", err)
+	}
+	if len(linfos) != 1 {
+		t.Fatalf("Expected 1 link history entry, got %d", len(linfos))
+	}
+	linfo := linfos[0]
+	if linfo.AMPURL != "http://test.com/amp/article.html" {
+		t.Errorf("AMPURL mismatch, got %q", linfo.AMPURL)
+	}
+	if linfo.MobileURL != "" {
+		t.Errorf("Expected empty MobileURL, got %q", linfo.MobileURL)
+	}
+	if linfo.CanonicalURL != "http://test.com/article.html" {
+		t.Errorf("CanonicalURL mismatch, got %q", linfo.CanonicalURL)
+	}
+}
+
+func TestStoreImageMetadata(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	photo := walker.MustParse("http://test.com/photo.jpg")
+	img := &walker.ImageInfo{
+		Format:      "jpeg",
+		Width:       640,
+		Height:      480,
+		CameraMake:  "Canon",
+		CameraModel: "EOS 5D",
+		HasGPS:      true,
+		Latitude:    40.5,
+		Longitude:   -79.25,
+	}
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:       photo,
+		FetchTime: time.Now(),
+		MimeType:  "image/jpeg",
+		Image:     img,
+	})
+
+	linfos, err := ds.ListLinkHistorical(photo)
+	if err != nil {
+		t.Fatalf("ListLinkHistorical failed: %v", err)
+	}
+	if len(linfos) != 1 {
+		t.Fatalf("Expected 1 link history entry, got %d", len(linfos))
+	}
+	if linfos[0].Image == nil {
+		t.Fatalf("Expected image metadata to be stored")
+	}
+	if *linfos[0].Image != *img {
+		t.Errorf("Image metadata mismatch, got %+v, expected %+v", *linfos[0].Image, *img)
+	}
+}
+
+func TestStoreRobotsTxtChange(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority) VALUES (?, ?, ?, ?)`,
+		"test.com", gocql.UUID{}, false, 0).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	crawled := []string{"/docs/a.html", "/docs/b.html", "/blog/c.html"}
+	for _, path := range crawled {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			"test.com", "www", path, "http", time.Now()).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+	// Not crawled yet, so shouldn't count as newly blocked
+	err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+		"test.com", "www", "/docs/d.html", "http", walker.NotYetCrawled).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert link: %v", err)
+	}
+
+	ds.StoreRobotsTxt("www.test.com", []byte("User-agent: *\nDisallow: /blog/\n"))
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if !dinfo.RobotsChanged.IsZero() {
+		t.Errorf("Expected first robots.txt not to be flagged as a change, got %v", dinfo.RobotsChanged)
+	}
+
+	// Storing the same contents again is not a change either
+	ds.StoreRobotsTxt("www.test.com", []byte("User-agent: *\nDisallow: /blog/\n"))
+	dinfo, err = ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if !dinfo.RobotsChanged.IsZero() {
+		t.Errorf("Expected unchanged robots.txt not to be flagged, got %v", dinfo.RobotsChanged)
+	}
+
+	ds.StoreRobotsTxt("www.test.com", []byte("User-agent: *\nDisallow: /blog/\nDisallow: /docs/\n"))
+	dinfo, err = ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo.RobotsChanged.IsZero() {
+		t.Errorf("Expected robots.txt change to be recorded")
+	}
+	if dinfo.RobotsNewlyBlocked != 2 {
+		t.Errorf("Expected 2 newly blocked links, got %v", dinfo.RobotsNewlyBlocked)
+	}
+}
+
+func TestHostContextRoundTrip(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	if hc := ds.LoadHostContext("test.com"); hc != nil {
+		t.Errorf("Expected no host context for test.com, got %+v", hc)
+	}
+
+	stored := &walker.HostContext{
+		Robots:     map[string][]byte{"test.com": []byte("User-agent: *\nDisallow: /private\n")},
+		NoRobots:   []string{"www.test.com"},
+		RobotsTime: time.Now().Truncate(time.Millisecond),
+		Addrs:      map[string]string{"test.com:80": "1.2.3.4:80"},
+		CrawlDelay: 1500 * time.Millisecond,
+	}
+	ds.StoreHostContext("test.com", stored)
+
+	hc := ds.LoadHostContext("test.com")
+	if hc == nil {
+		t.Fatalf("Expected a host context for test.com")
+	}
+	hc.RobotsTime = hc.RobotsTime.Local()
+	if !reflect.DeepEqual(hc, stored) {
+		t.Errorf("Host context mismatch\nExpected: %+v\nGot:      %+v", stored, hc)
+	}
+}
+
+func TestPageStateRoundTrip(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	u := walker.MustParse("http://sub.test.com/page.html?a=b")
+	if ps := ds.LoadPageState(u); ps != nil {
+		t.Errorf("Expected no page state for %v, got %+v", u, ps)
+	}
+
+	stored := &walker.PageState{
+		FetchTime:   time.Now().Truncate(time.Millisecond),
+		Fingerprint: 12345,
+		Outlinks:    []string{"http://test.com/a.html", "http://test.com/b.html"},
+		Watches:     map[string]string{"price": "9.99"},
+	}
+	ds.StorePageState(u, stored)
+
+	ps := ds.LoadPageState(u)
+	if ps == nil {
+		t.Fatalf("Expected a page state for %v", u)
+	}
+	ps.FetchTime = ps.FetchTime.Local()
+	if !reflect.DeepEqual(ps, stored) {
+		t.Errorf("Page state mismatch\nExpected: %+v\nGot:      %+v", stored, ps)
+	}
+}
+
+func TestScreenshots(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	u := walker.MustParse("http://sub.test.com/product.html")
+	if shots, err := ds.ListScreenshots(u); err != nil || len(shots) != 0 {
+		t.Errorf("Expected no screenshots of %v, got %v (%v)", u, shots, err)
+	}
+
+	now := time.Now().Truncate(time.Millisecond)
+	for i, at := range []time.Time{now.Add(-time.Hour), now} {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:       u,
+			FetchTime: at,
+			Response:  &http.Response{StatusCode: 200},
+			Screenshot: &walker.Screenshot{
+				Time:      at,
+				MimeType:  "image/png",
+				Image:     []byte{byte(i), 1, 2},
+				Thumbnail: []byte{byte(i), 3},
+			},
+		})
+	}
+
+	shots, err := ds.ListScreenshots(u)
+	if err != nil {
+		t.Fatalf("ListScreenshots failed: %v", err)
+	}
+	if len(shots) != 2 || !shots[0].Time.Equal(now) || shots[0].MimeType != "image/png" || shots[0].Image != nil {
+		t.Fatalf("Expected the 2 screenshots newest first without images, got %+v", shots)
+	}
+
+	shot, err := ds.FindScreenshot(u, shots[1].Time)
+	if err != nil {
+		t.Fatalf("FindScreenshot failed: %v", err)
+	}
+	if shot == nil || !reflect.DeepEqual(shot.Image, []byte{0, 1, 2}) || !reflect.DeepEqual(shot.Thumbnail, []byte{0, 3}) {
+		t.Errorf("FindScreenshot got %+v, expected the older screenshot", shot)
+	}
+	if shot, err := ds.FindScreenshot(u, now.Add(time.Minute)); err != nil || shot != nil {
+		t.Errorf("Expected no screenshot at an unknown time, got %+v (%v)", shot, err)
+	}
+}
+
+func TestLinkProvenance(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+
+	u := walker.MustParse("http://test.com/found.html")
+	if prov, err := ds.FindLinkProvenance(u); err != nil || prov != nil {
+		t.Fatalf("Expected no provenance before the link was found, got %+v (%v)", prov, err)
+	}
+
+	first := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	ds.StoreParsedURL(u, &walker.FetchResults{URL: walker.MustParse("http://test.com/first.html"), FetchTime: first})
+
+	// Later finds don't replace the first, even once this datastore has
+	// forgotten it recorded it
+	ds2 := getDS(t)
+	ds2.StoreParsedURL(u, &walker.FetchResults{URL: walker.MustParse("http://test.com/second.html"), FetchTime: time.Now()})
+
+	prov, err := ds2.FindLinkProvenance(u)
+	if err != nil {
+		t.Fatalf("FindLinkProvenance failed: %v", err)
+	}
+	if prov == nil || prov.Referrer.String() != "http://test.com/first.html" || !prov.Found.Equal(first) {
+		t.Errorf("Expected provenance of first.html at %v, got %+v", first, prov)
+	}
+}
+
+func TestStoreSitemapHints(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+
+	lastMod := time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)
+	u := walker.MustParse("http://test.com/listed.html")
+	u.SitemapLastMod, u.SitemapPriority = lastMod, 0.8
+	sitemap := &walker.FetchResults{URL: walker.MustParse("http://test.com/sitemap.xml"), FetchTime: time.Now()}
+	ds.StoreParsedURL(u, sitemap)
+	ds.StoreParsedURL(walker.MustParse("http://test.com/plain.html"), sitemap)
+
+	hints := map[string]string{}
+	itr := db.Query(`SELECT path, sitemap_lastmod, sitemap_prio FROM links WHERE dom = ?`, "test.com").Iter()
+	var path string
+	var mod time.Time
+	var prio float64
+	for itr.Scan(&path, &mod, &prio) {
+		hints[path] = fmt.Sprintf("%v %v", mod.UTC().Format("2006-01-02"), prio)
+		mod, prio = time.Time{}, 0
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read links: %v", err)
+	}
+	expected := map[string]string{"/listed.html": "2014-03-01 0.8", "/plain.html": "0001-01-01 0"}
+	if !reflect.DeepEqual(hints, expected) {
+		t.Errorf("Expected sitemap hints %v, got %v", expected, hints)
+	}
+}
+
+func TestSurrogateKeys(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+
+	fetched := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	store := func(link string, at time.Time, keys ...string) {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:           walker.MustParse(link),
+			FetchTime:     at,
+			Response:      &http.Response{StatusCode: http.StatusOK},
+			SurrogateKeys: keys,
+		})
+	}
+	store("http://test.com/a.html", fetched, "template:article", "section:news", "section:news", " ")
+	store("http://test.com/b.html", fetched, "template:article")
+	store("http://test.com/c.html", fetched, "template:article")
+
+	// c.html is fetched again without the key, so is no longer tagged
+	store("http://test.com/c.html", time.Now(), "template:gallery")
+
+	links, err := ds.ListSurrogateKeyLinks("template:article", 0)
+	if err != nil {
+		t.Fatalf("ListSurrogateKeyLinks failed: %v", err)
+	}
+	got := map[string]bool{}
+	for _, l := range links {
+		got[l.URL.String()] = true
+		if !l.Tagged.Equal(fetched) {
+			t.Errorf("Expected %v tagged at %v, got %v", l.URL, fetched, l.Tagged)
+		}
+	}
+	expected := map[string]bool{"http://test.com/a.html": true, "http://test.com/b.html": true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("ListSurrogateKeyLinks got %v, expected %v", got, expected)
+	}
+
+	if links, err := ds.ListSurrogateKeyLinks("section:news", 0); err != nil || len(links) != 1 {
+		t.Errorf("Expected a.html tagged section:news once, got %v (%v)", links, err)
+	}
+	if links, err := ds.ListSurrogateKeyLinks("template:article", 1); err != nil || len(links) != 1 {
+		t.Errorf("Expected limit to be honored, got %v (%v)", links, err)
+	}
+
+	var count int
+	if err := db.Query(`SELECT COUNT(*) FROM surrogate_keys WHERE key = ?`, "template:article").Scan(&count); err != nil {
+		t.Fatalf("Failed to count surrogate keys: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected the stale surrogate key to be deleted, found %d rows", count)
+	}
+}
+
+func TestDiffCrawls(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+
+	relaunch := time.Now().Add(-24 * time.Hour).Truncate(time.Millisecond)
+	before := relaunch.Add(-time.Hour)
+	after := relaunch.Add(time.Hour)
+	fetches := []struct {
+		path     string
+		time     time.Time
+		status   int
+		err      string
+		redirect string
+	}{
+		{"/same.html", before, 200, "", ""},
+		{"/same.html", after, 200, "", ""},
+		{"/gone.html", before, 200, "", ""},
+		{"/gone.html", after, 404, "", ""},
+		{"/broken.html", before, 200, "", ""},
+		{"/broken.html", after, 0, "connection refused", ""},
+		{"/moved.html", before, 200, "", ""},
+		{"/moved.html", after, 0, "", "http://test.com/new/moved.html"},
+		{"/new/moved.html", after, 200, "", ""},
+		{"/stale.html", before, 200, "", ""},
+		{"/uncrawled.html", walker.NotYetCrawled, 0, "", ""},
+		{"/later.html", time.Now(), 200, "", ""},
+	}
+	for _, f := range fetches {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, err, redto_url)
+							VALUES ('test.com', 0, '', ?, 'http', ?, ?, ?, ?)`,
+			f.path, f.time, f.status, f.err, f.redirect).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert test link: %v", err)
+		}
+	}
+
+	diff, err := ds.DiffCrawls("test.com", relaunch, relaunch.Add(12*time.Hour))
+	if err != nil {
+		t.Fatalf("DiffCrawls failed: %v", err)
+	}
+	if diff.LinksFrom != 5 || diff.LinksTo != 6 {
+		t.Errorf("Expected 5 links crawled by from and 6 by to, got %v and %v", diff.LinksFrom, diff.LinksTo)
+	}
+	paths := func(links []*CrawlDiffLink) []string {
+		var p []string
+		for _, l := range links {
+			p = append(p, l.URL.RequestURI())
+		}
+		sort.Strings(p)
+		return p
+	}
+	if p := paths(diff.New); !reflect.DeepEqual(p, []string{"/new/moved.html"}) {
+		t.Errorf("Expected new links [/new/moved.html], got %v", p)
+	}
+	if p := paths(diff.Disappeared); !reflect.DeepEqual(p, []string{"/gone.html"}) {
+		t.Errorf("Expected disappeared links [/gone.html], got %v", p)
+	}
+	if p := paths(diff.Changed); !reflect.DeepEqual(p, []string{"/broken.html", "/moved.html"}) {
+		t.Errorf("Expected changed links [/broken.html /moved.html], got %v", p)
+	}
+	for _, l := range diff.Changed {
+		if l.URL.RequestURI() == "/moved.html" && l.ToState() != "redirects to http://test.com/new/moved.html" {
+			t.Errorf("Unexpected state of /moved.html after the relaunch: %q", l.ToState())
+		}
+	}
+
+	if _, err := ds.DiffCrawls("test.com", relaunch, before); err == nil {
+		t.Errorf("Expected times out of order to fail")
+	}
+	if _, err := ds.DiffCrawls("unknown.com", before, after); !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected an unknown domain to fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestListRedirects(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+
+	start := time.Now().Add(-72 * time.Hour).Truncate(time.Millisecond)
+	fetches := []struct {
+		link, target string
+		status       int
+	}{
+		{"http://test.com/settled.html", "http://test.com/new.html", 301},
+		{"http://test.com/settled.html", "http://test.com/new.html", 301},
+		{"http://test.com/settled.html", "http://test.com/new.html", 308},
+		{"http://test.com/moved-again.html", "http://test.com/a.html", 301},
+		{"http://test.com/moved-again.html", "http://test.com/b.html", 301},
+		{"http://test.com/temporary.html", "http://test.com/new.html", 302},
+		{"http://test.com/back.html", "http://test.com/new.html", 301},
+		{"http://test.com/back.html", "", 0},
+	}
+	for i, f := range fetches {
+		fr := &walker.FetchResults{
+			URL:       walker.MustParse(f.link),
+			FetchTime: start.Add(time.Duration(i) * time.Hour),
+		}
+		if f.target != "" {
+			fr.RedirectedFrom = []*walker.URL{walker.MustParse(f.target)}
+			fr.RedirectStatuses = []int{f.status}
+		}
+		ds.StoreURLFetchResults(fr)
+	}
+
+	redirects, err := ds.ListRedirects("test.com")
+	if err != nil {
+		t.Fatalf("ListRedirects failed: %v", err)
+	}
+	expected := []struct {
+		link, target  string
+		status        int
+		confirmations int
+		settled       bool
+	}{
+		{"http://test.com/moved-again.html", "http://test.com/b.html", 301, 1, false},
+		{"http://test.com/settled.html", "http://test.com/new.html", 308, 3, true},
+		{"http://test.com/temporary.html", "http://test.com/new.html", 302, 0, false},
+	}
+	if len(redirects) != len(expected) {
+		t.Fatalf("Expected %d redirects, got %d: %+v", len(expected), len(redirects), redirects)
+	}
+	for i, e := range expected {
+		r := redirects[i]
+		if r.URL.String() != e.link || r.Target != e.target || r.Status != e.status ||
+			r.Confirmations != e.confirmations || r.Settled != e.settled {
+			t.Errorf("Expected redirect %+v, got %v -> %v (status %v, %v confirmations, settled %v)",
+				e, r.URL, r.Target, r.Status, r.Confirmations, r.Settled)
+		}
+	}
+
+	_, err = ds.ListRedirects("nowhere.com")
+	if !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing domain, got %v", err)
+	}
+}
+
+func TestOutlinkProfile(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+	ds.InsertLink("http://test.com/uncrawled.html", "")
+
+	start := time.Now().Add(-72 * time.Hour).Truncate(time.Millisecond)
+	fetches := []struct {
+		link     string
+		outlinks map[string]int
+	}{
+		// Only a page's latest fetch counts
+		{"http://test.com/a.html", map[string]int{"gone.com": 4}},
+		{"http://test.com/a.html", map[string]int{"other.com": 2, "partner.org": 1}},
+		{"http://test.com/b.html", map[string]int{"other.com": 1}},
+		{"http://test.com/c.html", nil},
+	}
+	for i, f := range fetches {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:            walker.MustParse(f.link),
+			FetchTime:      start.Add(time.Duration(i) * time.Hour),
+			OutlinkDomains: f.outlinks,
+		})
+	}
+
+	profile, err := ds.OutlinkProfile("test.com")
+	if err != nil {
+		t.Fatalf("OutlinkProfile failed: %v", err)
+	}
+	if profile.Pages != 3 || profile.LinkingPages != 2 {
+		t.Errorf("Expected 2 of 3 pages linking out, got %d of %d", profile.LinkingPages, profile.Pages)
+	}
+	expected := []OutlinkDomain{
+		{Domain: "other.com", Pages: 2, Links: 3},
+		{Domain: "partner.org", Pages: 1, Links: 1},
+	}
+	if len(profile.Domains) != len(expected) {
+		t.Fatalf("Expected %d domains, got %d: %+v", len(expected), len(profile.Domains), profile.Domains)
+	}
+	for i, e := range expected {
+		if *profile.Domains[i] != e {
+			t.Errorf("Expected domain %+v, got %+v", e, *profile.Domains[i])
+		}
+	}
+
+	linfos, err := ds.ListLinkHistorical(walker.MustParse("http://test.com/a.html"))
+	if err != nil || len(linfos) != 2 || linfos[1].OutlinkDomains["other.com"] != 2 {
+		t.Errorf("Expected the outlink domains of each fetch in the link history, got %+v (%v)", linfos, err)
+	}
+
+	_, err = ds.OutlinkProfile("nowhere.com")
+	if !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing domain, got %v", err)
+	}
+}
+
+func TestCrawlDelayOverride(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority) VALUES (?, ?, ?, ?)`,
+		"test.com", gocql.UUID{}, false, 0).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+
+	if d := ds.CrawlDelayOverride("test.com"); d != 0 {
+		t.Errorf("Expected no crawl delay override by default, got %v", d)
+	}
+	if d := ds.CrawlDelayOverride("unknown.com"); d != 0 {
+		t.Errorf("Expected no crawl delay override for unknown domain, got %v", d)
+	}
+
+	info := &DomainInfo{CrawlDelay: 2500 * time.Millisecond}
+	err = ds.UpdateDomain("test.com", info, DomainInfoUpdateConfig{CrawlDelay: true})
+	if err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	if d := ds.CrawlDelayOverride("test.com"); d != 2500*time.Millisecond {
+		t.Errorf("CrawlDelayOverride mismatch, got %v, expected %v", d, 2500*time.Millisecond)
+	}
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo.CrawlDelay != 2500*time.Millisecond {
+		t.Errorf("DomainInfo.CrawlDelay mismatch, got %v", dinfo.CrawlDelay)
+	}
+
+	info.CrawlDelay = -time.Second
+	err = ds.UpdateDomain("test.com", info, DomainInfoUpdateConfig{CrawlDelay: true})
+	if err == nil {
+		t.Errorf("Expected UpdateDomain to reject a negative crawl delay")
+	}
+}
+
+func TestCrawlScope(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	origAddNewDomains := walker.Config.Cassandra.AddNewDomains
+	defer func() { walker.Config.Cassandra.AddNewDomains = origAddNewDomains }()
+	walker.Config.Cassandra.AddNewDomains = true
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, dispatched, priority) VALUES (?, ?, ?, ?)`,
+		"test.com", gocql.UUID{}, false, 0).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+
+	bad := &DomainInfo{Scope: walker.CrawlScope{Mode: walker.ScopeCustom, Pattern: "("}}
+	if err := ds.UpdateDomain("test.com", bad, DomainInfoUpdateConfig{Scope: true}); err == nil {
+		t.Errorf("Expected UpdateDomain to reject a bad scope pattern")
+	}
+	info := &DomainInfo{Scope: walker.CrawlScope{Mode: walker.ScopeSubdomains, Subdomains: []string{"Docs."}}}
+	if err := ds.UpdateDomain("test.com", info, DomainInfoUpdateConfig{Scope: true}); err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if s := dinfo.Scope.String(); s != "subdomains (docs)" {
+		t.Errorf("Expected DomainInfo.Scope subdomains (docs), got %v", s)
+	}
+
+	page := &walker.FetchResults{URL: walker.MustParse("http://test.com/index.html"), FetchTime: time.Now()}
+	for _, link := range []string{"http://test.com/a.html", "http://docs.test.com/b.html",
+		"http://blog.test.com/c.html", "http://other.com/d.html"} {
+		ds.StoreParsedURL(walker.MustParse(link), page)
+	}
+	stored := map[string]bool{}
+	itr := db.Query(`SELECT dom, subdom, path FROM links`).Iter()
+	var dom, subdom, path string
+	for itr.Scan(&dom, &subdom, &path) {
+		stored[(&url.URL{Scheme: "http", Host: strings.TrimPrefix(subdom+"."+dom, "."), Path: path}).String()] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read links: %v", err)
+	}
+	expected := map[string]bool{"http://test.com/a.html": true, "http://docs.test.com/b.html": true}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected only the in scope links %v stored, got %v", expected, stored)
+	}
+
+	// Removing the scope keeps every link again, once the cached scope is
+	// dropped
+	info.Scope = walker.CrawlScope{}
+	if err := ds.UpdateDomain("test.com", info, DomainInfoUpdateConfig{Scope: true}); err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	if s := ds.domainScope("test.com"); s != nil {
+		t.Errorf("Expected no scope after removing it, got %v", s)
+	}
+}
+
+func TestBootstrapBoost(t *testing.T) {
+	origPeriod := walker.Config.Dispatcher.NewDomainBoostPeriod
+	origBoost := walker.Config.Dispatcher.NewDomainPriorityBoost
+	origMult := walker.Config.Dispatcher.NewDomainSegmentMultiplier
+	defer func() {
+		walker.Config.Dispatcher.NewDomainBoostPeriod = origPeriod
+		walker.Config.Dispatcher.NewDomainPriorityBoost = origBoost
+		walker.Config.Dispatcher.NewDomainSegmentMultiplier = origMult
+	}()
+	walker.Config.Dispatcher.NewDomainBoostPeriod = "1h"
+	walker.Config.Dispatcher.NewDomainPriorityBoost = 5
+	walker.Config.Dispatcher.NewDomainSegmentMultiplier = 3
+
+	GetTestDB()
+	ds := getDS(t)
+
+	if err := ds.InsertLink("http://new.com/", ""); err != nil {
+		t.Fatalf("InsertLink failed: %v", err)
+	}
+	dinfo, err := ds.FindDomain("new.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if !dinfo.Boosted() {
+		t.Fatalf("Expected new.com to be boosted, boost ends %v", dinfo.BoostUntil)
+	}
+	if d := dinfo.BoostUntil.Sub(time.Now()); d <= 59*time.Minute || d > time.Hour {
+		t.Errorf("Expected new.com's boost to end in about an hour, got %v", d)
+	}
+	if p := boostedPriority(2, dinfo.BoostUntil); p != 7 {
+		t.Errorf("Expected boosted priority 7, got %v", p)
+	}
+	if l := boostedSegmentLimit(dinfo.BoostUntil); l != 3*walker.Config.Dispatcher.MaxLinksPerSegment {
+		t.Errorf("Expected boosted segment limit %v, got %v", 3*walker.Config.Dispatcher.MaxLinksPerSegment, l)
+	}
+
+	// Ending the boost puts the domain back on its own priority
+	err = ds.UpdateDomain("new.com", &DomainInfo{}, DomainInfoUpdateConfig{BoostUntil: true})
+	if err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	dinfo, err = ds.FindDomain("new.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo.Boosted() {
+		t.Errorf("Expected new.com's boost to be cleared, boost ends %v", dinfo.BoostUntil)
+	}
+	if p := boostedPriority(2, dinfo.BoostUntil); p != 2 {
+		t.Errorf("Expected unboosted priority 2, got %v", p)
+	}
+	if l := boostedSegmentLimit(dinfo.BoostUntil); l != walker.Config.Dispatcher.MaxLinksPerSegment {
+		t.Errorf("Expected unboosted segment limit %v, got %v", walker.Config.Dispatcher.MaxLinksPerSegment, l)
+	}
+
+	// Only domains that exist and will be crawled can be boosted
+	boost := &DomainInfo{BoostUntil: time.Now().Add(time.Hour)}
+	err = ds.UpdateDomain("nosuch.com", boost, DomainInfoUpdateConfig{BoostUntil: true})
+	if !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected boosting a missing domain to fail with ErrNotFound, got %v", err)
+	}
+	err = ds.UpdateDomain("new.com", &DomainInfo{Excluded: true}, DomainInfoUpdateConfig{Exclude: true})
+	if err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	err = ds.UpdateDomain("new.com", boost, DomainInfoUpdateConfig{BoostUntil: true})
+	if !walker.IsError(err, walker.ErrExcluded) {
+		t.Errorf("Expected boosting an excluded domain to fail with ErrExcluded, got %v", err)
+	}
+}
+
+func TestScheduleLink(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	if err := ds.ScheduleLink("http://test.com/page.html", time.Now()); !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected ScheduleLink to fail with ErrNotFound for a link that was never inserted, got %v", err)
+	}
+
+	if err := ds.InsertLink("http://test.com/page.html", ""); err != nil {
+		t.Fatalf("InsertLink failed: %v", err)
+	}
+	u := walker.MustParse("http://test.com/page.html")
+	fetchTime := time.Now().Add(-time.Minute).Truncate(time.Millisecond)
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:       u,
+		FetchTime: fetchTime,
+		Response:  &http.Response{StatusCode: 503},
+	})
+
+	// Scheduling applies to the latest fetch
+	at := time.Now().Add(2 * time.Hour).Truncate(time.Millisecond)
+	if err := ds.ScheduleLink("http://test.com/page.html", at); err != nil {
+		t.Fatalf("ScheduleLink failed: %v", err)
+	}
+	linfos, err := ds.ListLinkHistorical(u)
+	if err != nil {
+		t.Fatalf("ListLinkHistorical failed: %v", err)
+	}
+	if len(linfos) != 2 {
+		t.Fatalf("Expected 2 rows for the link, got %v", len(linfos))
+	}
+	if !linfos[0].CrawlAt.IsZero() {
+		t.Errorf("Expected the uncrawled row to be unscheduled, got %v", linfos[0].CrawlAt)
+	}
+	if !linfos[1].CrawlAt.Equal(at) {
+		t.Errorf("CrawlAt mismatch, got %v, expected %v", linfos[1].CrawlAt, at)
+	}
+
+	if err := ds.ScheduleLink("http://test.com/page.html", time.Time{}); err != nil {
+		t.Fatalf("ScheduleLink failed: %v", err)
+	}
+	linfos, err = ds.ListLinkHistorical(u)
+	if err != nil {
+		t.Fatalf("ListLinkHistorical failed: %v", err)
+	}
+	if !linfos[len(linfos)-1].CrawlAt.IsZero() {
+		t.Errorf("Expected the schedule to be cleared, got %v", linfos[len(linfos)-1].CrawlAt)
+	}
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	lastDispatch := time.Now().Add(-time.Hour).Truncate(time.Millisecond)
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, excluded, exclude_reason,
+						last_dispatch, byte_quota)
+					 VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		"test.com", gocql.TimeUUID(), 7, true, true, "manual", lastDispatch, 1000).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	err = db.Query(`INSERT INTO segments (dom, subdom, path, proto, time, chain_pos) VALUES (?, ?, ?, ?, ?, ?)`,
+		"test.com", "www", "/page1.html", "http", walker.NotYetCrawled, 2).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert segment: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ds.ExportCheckpoint(&buf); err != nil {
+		t.Fatalf("ExportCheckpoint failed: %v", err)
+	}
+
+	db = GetTestDB()
+	if err := ds.ImportCheckpoint(&buf); err != nil {
+		t.Fatalf("ImportCheckpoint failed: %v", err)
+	}
+
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo == nil {
+		t.Fatalf("Expected test.com to be restored")
+	}
+	if dinfo.Priority != 7 || !dinfo.Excluded || dinfo.ExcludeReason != "manual" || dinfo.ByteQuota != 1000 {
+		t.Errorf("Restored domain mismatch: %+v", dinfo)
+	}
+	if dinfo.ClaimToken != (gocql.UUID{}) {
+		t.Errorf("Expected restored domain to be unclaimed, got claim token %v", dinfo.ClaimToken)
+	}
+
+	var path string
+	var chainPos int
+	err = db.Query(`SELECT path, chain_pos FROM segments WHERE dom = ?`, "test.com").Scan(&path, &chainPos)
+	if err != nil {
+		t.Fatalf("Failed to read restored segment: %v", err)
+	}
+	if path != "/page1.html" || chainPos != 2 {
+		t.Errorf("Restored segment mismatch: path %q, chain_pos %d", path, chainPos)
+	}
+
+	if err := ds.ImportCheckpoint(strings.NewReader(`{"format": "something-else"}`)); err == nil {
+		t.Errorf("Expected ImportCheckpoint to reject a non-checkpoint file")
+	}
+
+	// A domain claimed since the checkpoint was taken is left alone
+	tok := gocql.TimeUUID()
+	err = db.Query(`UPDATE domain_info SET claim_tok = ?, priority = ? WHERE dom = ?`, tok, 3, "test.com").Exec()
+	if err != nil {
+		t.Fatalf("Failed to claim domain: %v", err)
+	}
+	var checkpoint bytes.Buffer
+	checkpoint.WriteString(`{"format": "walker-checkpoint", "version": 1}` + "\n")
+	checkpoint.WriteString(`{"domain": {"dom": "test.com", "priority": 9}}` + "\n")
+	checkpoint.WriteString(`{"domain": {"dom": "other.com", "priority": 4}}` + "\n")
+	checkpoint.WriteString(`{"segment": {"dom": "test.com", "subdom": "", "path": "/new.html", "proto": "http"}}` + "\n")
+	err = ds.ImportCheckpoint(&checkpoint)
+	if !walker.IsError(err, walker.ErrAlreadyClaimed) || !strings.Contains(err.Error(), "test.com") {
+		t.Errorf("Expected ErrAlreadyClaimed naming test.com, got %v", err)
+	}
+	dinfo, err = ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo.ClaimToken != tok || dinfo.Priority != 3 {
+		t.Errorf("Expected claimed test.com to be left alone, got %+v", dinfo)
+	}
+	var n int
+	if err := db.Query(`SELECT COUNT(*) FROM segments WHERE dom = ?`, "test.com").Scan(&n); err != nil || n != 1 {
+		t.Errorf("Expected claimed test.com's segment to be left alone, got %d links (%v)", n, err)
+	}
+	dinfo, err = ds.FindDomain("other.com")
+	if err != nil || dinfo == nil || dinfo.Priority != 4 {
+		t.Errorf("Expected other.com to be imported, got %+v (%v)", dinfo, err)
+	}
+}
+
+func TestStoreSample(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	page := walker.MustParse("http://test.com/sampled.html")
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:       page,
+		FetchTime: time.Now(),
+		Response: &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"text/html"}, "Set-Cookie": []string{"a=1", "b=2"}},
+		},
+		MimeType: "text/html",
+		Body:     "<html>sampled</html>",
+		Sampled:  true,
+	})
+	ds.StoreURLFetchResults(&walker.FetchResults{
+		URL:       walker.MustParse("http://test.com/unsampled.html"),
+		FetchTime: time.Now(),
+	})
+
+	samples, err := ds.ListSamples(10)
+	if err != nil {
+		t.Fatalf("ListSamples failed: %v", err)
+	}
+	if len(samples) != 1 {
+		t.Fatalf("Expected 1 sample, got %d", len(samples))
+	}
+	if samples[0].URL.String() != page.String() {
+		t.Errorf("Sample URL mismatch, got %v, expected %v", samples[0].URL, page)
+	}
+
+	s, err := ds.FindSample(samples[0].ID)
+	if err != nil {
+		t.Fatalf("FindSample failed: %v", err)
+	}
+	if s == nil {
+		t.Fatalf("Expected to find sample %v", samples[0].ID)
+	}
+	if s.Status != http.StatusOK || s.MimeType != "text/html" || s.Body != "<html>sampled</html>" {
+		t.Errorf("Sample mismatch, got status %d mime %q body %q", s.Status, s.MimeType, s.Body)
+	}
+	if !reflect.DeepEqual(s.Headers["Set-Cookie"], []string{"a=1", "b=2"}) {
+		t.Errorf("Sample Set-Cookie header mismatch, got %v", s.Headers["Set-Cookie"])
+	}
+}
+
+func TestListClaims(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, queued_links)
+						VALUES (?, 00000000-0000-0000-0000-000000000000, 1, true, 4)`, "test.com").Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain_info: %v", err)
+	}
+	if host := ds.ClaimNewHost(); host != "test.com" {
+		t.Fatalf("Expected to claim test.com, got %q", host)
+	}
+
+	for _, path := range []string{"/page1.html", "/page2.html"} {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:       walker.MustParse("http://test.com" + path),
+			FetchTime: time.Now(),
+			Node:      ds.claimNode,
+		})
+	}
+	if err := ds.KeepAlive(); err != nil {
+		t.Fatalf("Failed KeepAlive: %v", err)
+	}
+
+	fetchers, err := ds.ListClaims()
+	if err != nil {
+		t.Fatalf("ListClaims failed: %v", err)
+	}
+	if len(fetchers) != 1 {
+		t.Fatalf("Expected 1 fetcher, got %d", len(fetchers))
+	}
+	f := fetchers[0]
+	if f.Token != ds.crawlerUUID || f.Node != ds.claimNode {
+		t.Errorf("Fetcher mismatch, got %v on %q, expected %v on %q", f.Token, f.Node, ds.crawlerUUID, ds.claimNode)
+	}
+	if len(f.Claims) != 1 {
+		t.Fatalf("Expected 1 claim, got %d", len(f.Claims))
+	}
+	c := f.Claims[0]
+	if c.Domain != "test.com" || c.Queued != 4 || c.Fetched != 2 {
+		t.Errorf("Claim mismatch, got %q with %d/%d fetched", c.Domain, c.Fetched, c.Queued)
+	}
+	if c.Progress() != 0.5 {
+		t.Errorf("Expected progress 0.5, got %v", c.Progress())
+	}
+
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil || dinfo.ClaimNode != ds.claimNode {
+		t.Errorf("Expected test.com claimed by %q, got %+v (%v)", ds.claimNode, dinfo, err)
+	}
+	linfos, err := ds.ListLinkHistorical(walker.MustParse("http://test.com/page1.html"))
+	if err != nil || len(linfos) != 1 || linfos[0].Node != ds.claimNode {
+		t.Errorf("Expected page1.html fetched by %q, got %+v (%v)", ds.claimNode, linfos, err)
+	}
+
+	ds.UnclaimHost("test.com")
+	fetchers, err = ds.ListClaims()
+	if err != nil {
+		t.Fatalf("ListClaims failed: %v", err)
+	}
+	if len(fetchers) != 1 || len(fetchers[0].Claims) != 0 {
+		t.Errorf("Expected no claims after UnclaimHost, got %v", fetchers)
+	}
+}
+
+func TestReportLatency(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	now := time.Now()
+	fetches := []struct {
+		link   string
+		time   time.Duration
+		status int
+	}{
+		{"http://fast.com/a.html", 50 * time.Millisecond, 200},
+		{"http://fast.com/b.html", 80 * time.Millisecond, 200},
+		{"http://slow.com/a.html", 300 * time.Millisecond, 200},
+		{"http://slow.com/big.html", 6 * time.Second, 200},
+		{"http://slow.com/big.html", 3 * time.Second, 200},
+		{"http://slow.com/dead.html", 45 * time.Second, 0},
+	}
+	for _, f := range fetches {
+		fr := &walker.FetchResults{
+			URL:          walker.MustParse(f.link),
+			FetchTime:    now,
+			ResponseTime: f.time,
+		}
+		if f.status != 0 {
+			fr.Response = &http.Response{StatusCode: f.status}
+		} else {
+			fr.FetchError = fmt.Errorf("timed out")
+		}
+		ds.StoreURLFetchResults(fr)
+	}
+
+	r, err := ds.ReportLatency(1, 10)
+	if err != nil {
+		t.Fatalf("ReportLatency failed: %v", err)
+	}
+	if r.Total.Fetches != 6 || r.Total.SlowFetches != 3 {
+		t.Errorf("Expected 6 fetches, 3 slow, got %d, %d", r.Total.Fetches, r.Total.SlowFetches)
+	}
+	if p := r.Total.Percentile(50); p != 500*time.Millisecond {
+		t.Errorf("Expected a 50th percentile of 500ms, got %v", p)
+	}
+	if len(r.Domains) != 2 || r.Domains[0].Domain != "slow.com" || r.Domains[0].Fetches != 4 ||
+		r.Domains[1].Domain != "fast.com" || r.Domains[1].Attainment() != 1 {
+		t.Errorf("Expected slow.com then fast.com, got %+v", r.Domains)
+	}
+	// big.html was recorded twice the same day, so just its latest fetch is
+	// kept
+	var pages []string
+	for _, p := range r.Pages {
+		pages = append(pages, fmt.Sprintf("%v %v %v", p.URL, p.ResponseTime, p.Status))
+	}
+	expected := []string{"http://slow.com/dead.html 45s 0", "http://slow.com/big.html 3s 200"}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Expected slow pages %v, got %v", expected, pages)
+	}
+
+	if _, err := ds.ReportLatency(0, 10); err == nil {
+		t.Error("Expected an error reporting on 0 days")
+	}
+}
+
+func TestFrontierSnapshot(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	domains := []struct {
+		dom          string
+		priority     int
+		excluded     bool
+		uncrawled    int
+		ages         []int
+		due, overdue int
+	}{
+		{"a.com", 1, false, 3, []int{1, 2, 0, 0, 0}, 5, 0},
+		{"b.com", 1, false, 1, []int{0, 0, 0, 0, 1}, 2, 1},
+		{"c.com", 3, false, 0, nil, 0, 0},
+		{"excluded.com", 3, true, 10, []int{10, 0, 0, 0, 0}, 10, 10},
+	}
+	for _, d := range domains {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, excluded, uncrawled_links,
+								uncrawled_ages, refresh_due, refresh_overdue)
+							VALUES (?, 00000000-0000-0000-0000-000000000000, ?, ?, ?, ?, ?, ?)`,
+			d.dom, d.priority, d.excluded, d.uncrawled, d.ages, d.due, d.overdue).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert test domain info: %v", err)
+		}
+	}
+
+	f, err := ds.FrontierSnapshot()
+	if err != nil {
+		t.Fatalf("FrontierSnapshot failed: %v", err)
+	}
+	total := FrontierCounts{Domains: 3, Uncrawled: 4, Ages: []int{1, 2, 0, 0, 1}, RefreshDue: 7, RefreshOverdue: 1}
+	if !reflect.DeepEqual(f.Total, total) {
+		t.Errorf("Expected frontier total %+v, got %+v", total, f.Total)
+	}
+	if !f.Total.FallingBehind() {
+		t.Error("Expected the crawl to be falling behind")
+	}
+	if len(f.Priorities) != 2 || f.Priorities[0].Priority != 3 || f.Priorities[0].Domains != 1 ||
+		f.Priorities[1].Priority != 1 || f.Priorities[1].Domains != 2 || f.Priorities[1].RefreshDue != 7 {
+		t.Errorf("Expected priorities 3 (1 domain) and 1 (2 domains), got %+v", f.Priorities)
+	}
+}
+
+func TestDomainReports(t *testing.T) {
+	db := GetTestDB()
+	ds := getDS(t)
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, ?)`, "test.com", gocql.UUID{}, 1, false).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test.com: %v", err)
+	}
+	week := 7 * 24 * time.Hour
+	before := time.Now().Add(-2 * week)
+	fetches := []struct {
+		link   string
+		at     time.Time
+		status int
+	}{
+		{"http://test.com/a.html", before, 200},
+		{"http://test.com/a.html", time.Now().Add(-time.Hour), 404},
+		{"http://test.com/b.html", before, 200},
+		{"http://test.com/b.html", time.Now().Add(-time.Hour), 200},
+		{"http://test.com/new.html", time.Now().Add(-time.Hour), 200},
+	}
+	for _, f := range fetches {
+		ds.StoreURLFetchResults(&walker.FetchResults{
+			URL:       walker.MustParse(f.link),
+			FetchTime: f.at,
+			Response:  &http.Response{StatusCode: f.status, Header: http.Header{}},
+		})
+	}
+
+	s, err := ds.SummarizeDomain("test.com", time.Now().Add(-week), time.Now(), 10)
+	if err != nil {
+		t.Fatalf("SummarizeDomain failed: %v", err)
+	}
+	if s.Fetched != 3 || s.Links != 3 || s.NumNew != 1 || s.NumBroken != 1 || s.NumChanged != 0 {
+		t.Errorf("Unexpected summary %+v", s)
+	}
+	if len(s.Broken) != 1 || s.Broken[0].URL.String() != "http://test.com/a.html" {
+		t.Errorf("Expected a.html to be broken, got %+v", s.Broken)
+	}
+
+	if err := ds.SetDomainReport("test.com", "not an address", week); err == nil {
+		t.Error("Expected a bad recipient to be refused")
+	}
+	if err := ds.SetDomainReport("test.com", "ops@test.com", time.Minute); err == nil {
+		t.Error("Expected a period under an hour to be refused")
+	}
+	if err := ds.SetDomainReport("nowhere.com", "ops@test.com", week); !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a missing domain, got %v", err)
+	}
+
+	var posted map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		json.NewDecoder(req.Body).Decode(&posted)
+	}))
+	defer srv.Close()
+	var mailed []string
+	defer func(send func(string, smtp.Auth, string, []string, []byte) error) { sendReportMail = send }(sendReportMail)
+	sendReportMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		mailed = append(mailed, string(msg))
+		return nil
+	}
+	origReports := walker.Config.Reports
+	defer func() { walker.Config.Reports = origReports }()
+	walker.Config.Reports.SMTPServer = "localhost:25"
+
+	for _, rcpt := range []string{"ops@test.com", srv.URL + "/hook"} {
+		if err := ds.SetDomainReport("test.com", rcpt, week); err != nil {
+			t.Fatalf("SetDomainReport(%v) failed: %v", rcpt, err)
+		}
+	}
+	reports, err := ds.ListDomainReports("test.com")
+	if err != nil || len(reports) != 2 || reports[0].Period != week || !reports[0].LastSent.IsZero() {
+		t.Fatalf("Expected 2 unsent weekly reports, got %+v (%v)", reports, err)
+	}
+
+	if sent := ds.sendDueReports(time.Now()); sent != 2 {
+		t.Errorf("Expected 2 reports sent, sent %d", sent)
+	}
+	if len(mailed) != 1 || !strings.Contains(mailed[0], "Subject: Walker crawl summary for test.com") ||
+		!strings.Contains(mailed[0], "http://test.com/a.html (200 before, now 404)") {
+		t.Errorf("Unexpected report email %v", mailed)
+	}
+	if posted["domain"] != "test.com" || posted["num_broken"] != 1.0 || posted["num_new"] != 1.0 {
+		t.Errorf("Unexpected posted report %v", posted)
+	}
+	if sent := ds.sendDueReports(time.Now()); sent != 0 {
+		t.Errorf("Expected no reports due right after sending them, sent %d", sent)
+	}
+
+	// A failed send is recorded
+	walker.Config.Reports.SMTPServer = ""
+	if err := ds.SendDomainReport("test.com", "ops@test.com"); err == nil {
+		t.Error("Expected sending email without an SMTP server to fail")
+	}
+	reports, _ = ds.ListDomainReports("")
+	for _, r := range reports {
+		if r.LastSent.IsZero() || (r.IsEmail() != (r.LastError != "")) {
+			t.Errorf("Unexpected report state %+v", r)
+		}
+	}
+
+	if err := ds.DeleteDomainReport("test.com", "ops@test.com"); err != nil {
+		t.Fatalf("DeleteDomainReport failed: %v", err)
+	}
+	if err := ds.SendDomainReport("test.com", "ops@test.com"); !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound sending a deleted report, got %v", err)
+	}
+}
+
+func TestBurstMode(t *testing.T) {
+	GetTestDB()
+	ds := getDS(t)
+
+	if err := ds.InsertLink("http://burst.com/", ""); err != nil {
+		t.Fatalf("InsertLink failed: %v", err)
+	}
+	if ds.BurstMode("burst.com") || ds.BurstMode("unknown.com") {
+		t.Errorf("Expected no domain to start in burst mode")
+	}
+
+	burst := &DomainInfo{BurstUntil: time.Now().Add(time.Hour)}
+	if err := ds.UpdateDomain("burst.com", burst, DomainInfoUpdateConfig{BurstUntil: true}); err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	dinfo, err := ds.FindDomain("burst.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if !dinfo.Bursting() || !ds.BurstMode("burst.com") {
+		t.Errorf("Expected burst.com to be in burst mode, burst ends %v", dinfo.BurstUntil)
+	}
+
+	// Ending it
+	if err := ds.UpdateDomain("burst.com", &DomainInfo{}, DomainInfoUpdateConfig{BurstUntil: true}); err != nil {
+		t.Fatalf("UpdateDomain failed: %v", err)
+	}
+	if ds.BurstMode("burst.com") {
+		t.Errorf("Expected burst.com's burst to be ended")
+	}
+
+	err = ds.UpdateDomain("nosuch.com", burst, DomainInfoUpdateConfig{BurstUntil: true})
+	if !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected bursting a missing domain to fail with ErrNotFound, got %v", err)
+	}
+}
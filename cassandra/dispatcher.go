@@ -4,6 +4,7 @@ import (
 	"container/heap"
 	"fmt"
 	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,6 +24,10 @@ import (
 // dispatcher can operate on the domains not currently being crawled (and vice
 // versa).
 type Dispatcher struct {
+	// Where the dispatcher counts the segments it generates, and observes how
+	// long generating them took (see the Metric* names), or nil
+	Metrics walker.Metrics
+
 	cf *gocql.ClusterConfig
 	db *gocql.Session
 
@@ -41,6 +46,10 @@ type Dispatcher struct {
 	// time; set by dispatcher.min_link_refresh_time config parameter
 	minRecrawlDelta time.Duration
 
+	// the longest a link's declared cache lifetime can keep it from being
+	// refreshed (0 for no limit); set by dispatcher.max_refresh_interval
+	maxRefreshInterval time.Duration
+
 	// Age at at which an active_fetcher cache entry is considered stale
 	activeFetcherCachetime time.Duration
 
@@ -61,6 +70,58 @@ type Dispatcher struct {
 
 	// How long do we wait before retrying a domain that didn't have any links.
 	emptyDispatchRetryInterval time.Duration
+
+	// How long generating one segment may take (0 for no limit), and how long
+	// a domain is skipped after it timed out or failed; set by
+	// dispatcher.domain_timeout and dispatcher.domain_retry_interval
+	domainTimeout       time.Duration
+	domainRetryInterval time.Duration
+
+	// Domains being skipped after failing to generate, keyed by domain (and
+	// mutex to protect it)
+	retries   map[string]*domainRetry
+	retriesMu sync.Mutex
+
+	// How long a domain iteration may run before the WebhookDispatcherStalled
+	// event fires (0 to never fire it); set by webhooks.dispatcher_stall_time
+	stallTime time.Duration
+
+	// When the running domain iteration started (zero between iterations),
+	// and whether it has been reported as stalled (and mutex to protect them)
+	iterationStart   time.Time
+	iterationStalled bool
+	iterationMu      sync.Mutex
+
+	// Round status (see rounds.go), also protected by iterationMu: the
+	// dispatcher's token in the dispatchers table and when it started, the
+	// number of rounds finished and when the last one did, whether that has
+	// been reported as overdue, and the domains generated and failed in the
+	// running round. roundOverdueTime is set by webhooks.round_overdue_time.
+	token            gocql.UUID
+	up               time.Time
+	rounds           int
+	roundFinished    time.Time
+	roundOverdue     bool
+	roundDomains     int
+	roundFailed      map[string]string
+	roundOverdueTime time.Duration
+
+	// How often each domain is probed for host alias detection (0 to not
+	// detect aliases), and the prober used; set by
+	// dispatcher.alias_probe_interval
+	aliasProbeInterval time.Duration
+	prober             *aliasProber
+
+	// How often to send the domain reports that are due (0 to not send
+	// them); set by reports.check_interval
+	reportInterval time.Duration
+}
+
+// domainRetry records when a domain whose segment generation failed may be
+// tried again
+type domainRetry struct {
+	after    time.Time
+	failures int
 }
 
 // StartDispatcher starts the dispatcher
@@ -70,18 +131,24 @@ func (d *Dispatcher) StartDispatcher() error {
 	var err error
 	d.db, err = d.cf.CreateSession()
 	if err != nil {
-		return fmt.Errorf("Failed to create cassandra session: %v", err)
+		return walker.NewError(walker.ErrDatastoreUnavailable,
+			fmt.Errorf("Failed to create cassandra session: %v", err))
 	}
 
 	d.quit = make(chan struct{})
 	d.domains = make(chan string)
 	d.removedToks = make(map[gocql.UUID]bool)
 	d.activeToks = make(map[gocql.UUID]time.Time)
+	d.retries = make(map[string]*domainRetry)
 
 	d.minRecrawlDelta, err = time.ParseDuration(walker.Config.Dispatcher.MinLinkRefreshTime)
 	if err != nil {
 		panic(err) //Not going to happen, parsed in config
 	}
+	d.maxRefreshInterval, err = time.ParseDuration(walker.Config.Dispatcher.MaxRefreshInterval)
+	if err != nil {
+		panic(err) //Not going to happen, parsed in config
+	}
 	ttl, err := time.ParseDuration(walker.Config.Fetcher.ActiveFetchersTTL)
 	if err != nil {
 		panic(err) //Not going to happen, parsed in config
@@ -98,6 +165,43 @@ func (d *Dispatcher) StartDispatcher() error {
 		panic(err)
 	}
 
+	d.domainTimeout, err = time.ParseDuration(walker.Config.Dispatcher.DomainTimeout)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+	d.domainRetryInterval, err = time.ParseDuration(walker.Config.Dispatcher.DomainRetryInterval)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+
+	d.stallTime, err = time.ParseDuration(walker.Config.Webhooks.DispatcherStallTime)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+	d.roundOverdueTime, err = time.ParseDuration(walker.Config.Webhooks.RoundOverdueTime)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+
+	d.aliasProbeInterval, err = time.ParseDuration(walker.Config.Dispatcher.AliasProbeInterval)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+	if d.prober == nil {
+		d.prober = newAliasProber()
+	}
+
+	d.reportInterval, err = time.ParseDuration(walker.Config.Reports.CheckInterval)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+
+	d.startRounds()
+	d.recoverInterrupted()
+	if d.aliasProbeInterval > 0 {
+		d.detectAliases()
+	}
+
 	for i := 0; i < walker.Config.Dispatcher.NumConcurrentDomains; i++ {
 		d.finishWG.Add(1)
 		go func() {
@@ -112,6 +216,38 @@ func (d *Dispatcher) StartDispatcher() error {
 		d.finishWG.Done()
 	}()
 
+	if d.stallTime > 0 {
+		d.finishWG.Add(1)
+		go func() {
+			d.watchStall()
+			d.finishWG.Done()
+		}()
+	}
+
+	if d.roundOverdueTime > 0 {
+		d.finishWG.Add(1)
+		go func() {
+			d.watchRounds()
+			d.finishWG.Done()
+		}()
+	}
+
+	if d.aliasProbeInterval > 0 {
+		d.finishWG.Add(1)
+		go func() {
+			d.pollAliases()
+			d.finishWG.Done()
+		}()
+	}
+
+	if d.reportInterval > 0 {
+		d.finishWG.Add(1)
+		go func() {
+			d.pollReports()
+			d.finishWG.Done()
+		}()
+	}
+
 	d.domainIterator()
 	return nil
 }
@@ -135,6 +271,7 @@ func (d *Dispatcher) StopDispatcher() error {
 	log4go.Info("Stopping CassandraDispatcher")
 	close(d.quit)
 	d.finishWG.Wait()
+	d.stopRounds()
 	d.db.Close()
 	return nil
 }
@@ -217,6 +354,8 @@ func (d *Dispatcher) cleanStrandedClaims(tok gocql.UUID) {
 			log4go.Error("%s failed to DELETE from segments: %v", tag, err)
 			ecount++
 		}
+		// The domain is dispatched afresh, so drop what was generated ahead
+		dropPendingSegments(db, domain)
 
 		err = db.Query(`UPDATE domain_info
 						SET 
@@ -294,19 +433,33 @@ func (d *Dispatcher) domainIterator() {
 	for {
 		iteration++
 		log4go.Debug("Starting new domain iteration")
-		domainiter := d.db.Query(`SELECT dom, dispatched, claim_tok, excluded FROM domain_info`).Iter()
+		d.startRound(time.Now())
+		domainiter := d.db.Query(`SELECT dom, dispatched, claim_tok, excluded, mirr_for, priority, max_segs,
+										burst_until
+									FROM domain_info`).Iter()
 
-		var domain string
+		var domain, mirrorOf string
 		var dispatched bool
 		var claimTok gocql.UUID
 		var excluded bool
-		for domainiter.Scan(&domain, &dispatched, &claimTok, &excluded) {
+		var priority, maxSegments int
+		var burstUntil time.Time
+		for domainiter.Scan(&domain, &dispatched, &claimTok, &excluded, &mirrorOf, &priority, &maxSegments,
+			&burstUntil) {
 			if d.quitSignaled() {
 				close(d.domains)
 				return
 			}
 
 			if !dispatched && !excluded {
+				if d.skipping(domain) {
+					continue
+				}
+				if mirrorOf != "" && d.aliasProbeInterval > 0 && !walker.Config.Dispatcher.CrawlAliases {
+					log4go.Fine("Not dispatching %v, it is an alias of %v", domain, mirrorOf)
+					continue
+				}
+				d.generatingWG.Add(1)
 				d.domains <- domain
 			} else if !d.fetcherIsAlive(claimTok) {
 				if d.oneShotIterations == 0 {
@@ -314,13 +467,20 @@ func (d *Dispatcher) domainIterator() {
 				} else {
 					d.cleanStrandedClaims(claimTok)
 				}
+			} else if dispatched && !excluded && !d.skipping(domain) &&
+				burstPipelineDepth(pipelineDepth(priority, maxSegments), maxSegments, burstUntil) > 0 {
+				// Generate its next segment ahead (see pipeline.go)
+				d.generatingWG.Add(1)
+				d.domains <- domain
 			}
 		}
 
-		if err := domainiter.Close(); err != nil {
+		err := domainiter.Close()
+		if err != nil {
 			log4go.Error("Error iterating domains from domain_info: %v", err)
 		}
 		d.generatingWG.Wait()
+		d.finishRound(err)
 
 		// Check for quit signal right away, otherwise if there are no domains
 		// to claim and the dispatchInterval is 0, then the dispatcher will
@@ -342,6 +502,38 @@ func (d *Dispatcher) domainIterator() {
 	}
 }
 
+// watchStall fires the WebhookDispatcherStalled event once for each domain
+// iteration that runs longer than stallTime
+func (d *Dispatcher) watchStall() {
+	ticker := time.NewTicker(d.stallTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+
+		d.iterationMu.Lock()
+		running := time.Duration(0)
+		if !d.iterationStart.IsZero() && !d.iterationStalled {
+			running = time.Since(d.iterationStart)
+		}
+		stalled := running >= d.stallTime
+		if stalled {
+			d.iterationStalled = true
+		}
+		d.iterationMu.Unlock()
+
+		if stalled {
+			log4go.Warn("Dispatcher domain iteration has been running for %v", running)
+			walker.FireWebhook(walker.NewWebhookEvent(walker.WebhookDispatcherStalled, "",
+				fmt.Sprintf("Dispatcher domain iteration has been running for %v", running),
+				map[string]interface{}{"running": running.String()}))
+		}
+	}
+}
+
 // quitSignaled returns true if a value was passed down the quit channel. This
 // should only be called once.
 func (d *Dispatcher) quitSignaled() bool {
@@ -356,15 +548,52 @@ func (d *Dispatcher) quitSignaled() bool {
 
 func (d *Dispatcher) generateRoutine() {
 	for domain := range d.domains {
-		d.generatingWG.Add(1)
-		if err := d.generateSegment(domain); err != nil {
+		start := time.Now()
+		err := d.generateSegment(domain)
+		walker.Observe(d.Metrics, MetricSegmentSeconds, time.Since(start).Seconds())
+		d.roundGenerated(domain, err)
+		if err != nil {
 			log4go.Error("error generating segment for %v: %v", domain, err)
+			d.skipDomain(domain)
+		} else {
+			d.retriesMu.Lock()
+			delete(d.retries, domain)
+			d.retriesMu.Unlock()
 		}
 		d.generatingWG.Done()
 	}
 	log4go.Debug("Finishing generateRoutine")
 }
 
+// skipDomain has domainIterator skip domain for a while after generating its
+// segment failed, so a domain that keeps failing or timing out doesn't hold up
+// every round. The wait doubles with each failure in a row, up to 16 times
+// domainRetryInterval.
+func (d *Dispatcher) skipDomain(domain string) {
+	if d.domainRetryInterval <= 0 {
+		return
+	}
+	d.retriesMu.Lock()
+	defer d.retriesMu.Unlock()
+	r := d.retries[domain]
+	if r == nil {
+		r = &domainRetry{}
+		d.retries[domain] = r
+	}
+	r.failures++
+	wait := d.domainRetryInterval * time.Duration(1<<uint(imin(r.failures-1, 4)))
+	r.after = time.Now().Add(wait)
+	log4go.Warn("Skipping dispatch of %v for %v after %v failure(s) in a row", domain, wait, r.failures)
+}
+
+// skipping returns true if domain failed recently and isn't due for a retry
+func (d *Dispatcher) skipping(domain string) bool {
+	d.retriesMu.Lock()
+	defer d.retriesMu.Unlock()
+	r := d.retries[domain]
+	return r != nil && time.Now().Before(r.after)
+}
+
 //
 // Some mathy type functions used in generateSegment
 //
@@ -395,6 +624,89 @@ type cell struct {
 	subdom, path, proto string
 	crawlTime           time.Time
 	getnow              bool
+	chainPos            int
+	depth               int
+	fnv                 int64
+	fetchErr            string
+	parseErr            string
+	status              int
+	robotEx             bool
+	noindex, nofollow   bool
+	cacheMaxAge         int
+	expires             time.Time
+	refreshHint         int
+	crawlAt             time.Time
+	redtoURL            string
+	redtoStatus         int
+	mime                string
+	found               time.Time
+
+	// The number of fetches in a row, up to and including this one, that the
+	// link permanently redirected to redtoURL
+	permRedirects int
+}
+
+// countRedirects sets c.permRedirects, given the link's previous row prev
+// (nil if c is its first)
+func (c *cell) countRedirects(prev *cell) {
+	c.permRedirects = 0
+	if walker.IsPermanentRedirect(c.redtoStatus) {
+		c.permRedirects = 1
+		if prev != nil && c.redtoURL == prev.redtoURL {
+			c.permRedirects = prev.permRedirects + 1
+		}
+	}
+}
+
+// inheritDepth makes c's depth the shallowest of its own and that of the
+// link's previous row prev, so a link counts at the shallowest depth it was
+// crawled at even when found again deeper
+func (c *cell) inheritDepth(prev *cell) {
+	if prev.depth < c.depth {
+		c.depth = prev.depth
+	}
+}
+
+// tooDeep returns true if the link is deeper than dispatcher.max_crawl_depth
+func (c *cell) tooDeep() bool {
+	n := walker.Config.Dispatcher.MaxCrawlDepth
+	return n > 0 && c.depth > n
+}
+
+// redirectSettled returns true if the link has permanently redirected to the
+// same target on enough fetches in a row that it isn't refreshed anymore (see
+// dispatcher.redirect_confirmations)
+func (c *cell) redirectSettled() bool {
+	n := walker.Config.Dispatcher.RedirectConfirmations
+	return n > 0 && c.permRedirects >= n
+}
+
+// refreshDelay returns how long after the cell was crawled it may be
+// refreshed: its declared cache lifetime or else the refresh interval its
+// publisher hinted at, limited to maxRefresh (if > 0), but no less than
+// minDelay
+func (c *cell) refreshDelay(minDelay, maxRefresh time.Duration) time.Duration {
+	var delay time.Duration
+	if c.cacheMaxAge > 0 {
+		delay = time.Duration(c.cacheMaxAge) * time.Second
+	} else if !c.expires.IsZero() {
+		delay = c.expires.Sub(c.crawlTime)
+	} else if c.refreshHint > 0 {
+		delay = time.Duration(c.refreshHint) * time.Second
+	}
+	if maxRefresh > 0 && delay > maxRefresh {
+		delay = maxRefresh
+	}
+	if delay < minDelay {
+		delay = minDelay
+	}
+	return delay
+}
+
+// key returns a string that sorts like the cell's position in a scan of the
+// domain's links (by subdomain, then path, then protocol)
+func (c *cell) key() string {
+	return c.subdom + "\x00" + c.path + "\x00" + c.proto
 }
 
 // 2 cells are equivalent if their full link renders to the same string.
@@ -405,12 +717,12 @@ func (c *cell) equivalent(other *cell) bool {
 }
 
 //
-// PriorityURL is a heap of URLs, where the next element Pop'ed off the list
-// points to the oldest (as measured by LastCrawled) element in the list. This
-// class is designed to be used with the container/heap package. This type is
-// currently only used in generateSegments
+// PriorityURL is a heap of compacted URLs, where the next element Pop'ed off
+// the list points to the oldest (as measured by LastCrawled) element in the
+// list. This class is designed to be used with the container/heap package.
+// This type is currently only used in generateSegments
 //
-type PriorityURL []*walker.URL
+type PriorityURL []walker.CompactURL
 
 // Returns the length of this PriorityURL
 func (pq PriorityURL) Len() int {
@@ -429,7 +741,7 @@ func (pq PriorityURL) Swap(i, j int) {
 
 // Push an item onto this PriorityURL
 func (pq *PriorityURL) Push(x interface{}) {
-	*pq = append(*pq, x.(*walker.URL))
+	*pq = append(*pq, x.(walker.CompactURL))
 }
 
 // Pop an item onto this PriorityURL
@@ -441,6 +753,69 @@ func (pq *PriorityURL) Pop() interface{} {
 	return x
 }
 
+// domainStats holds the link counts the dispatcher keeps in domain_info
+type domainStats struct {
+	total, uncrawled, failed, parseFailed, recent, queued int
+	robotsExcluded, noindex, nofollow                     int
+}
+
+// changed returns the domain_info columns of s that differ from prev, so
+// dispatching a domain whose counts haven't moved doesn't rewrite them
+func (s domainStats) changed(prev domainStats) []dbfield {
+	var fields []dbfield
+	for _, c := range []struct {
+		name      string
+		cur, prev int
+	}{
+		{"tot_links", s.total, prev.total},
+		{"uncrawled_links", s.uncrawled, prev.uncrawled},
+		{"error_links", s.failed, prev.failed},
+		{"parse_error_links", s.parseFailed, prev.parseFailed},
+		{"recent_links", s.recent, prev.recent},
+		{"queued_links", s.queued, prev.queued},
+		{"robots_excluded_links", s.robotsExcluded, prev.robotsExcluded},
+		{"noindex_links", s.noindex, prev.noindex},
+		{"nofollow_links", s.nofollow, prev.nofollow},
+	} {
+		if c.cur != c.prev {
+			fields = append(fields, dbfield{c.name, c.cur})
+		}
+	}
+	return fields
+}
+
+// byChainPos sorts compacted URLs by their position in a pagination chain,
+// earliest pages first. It is used in generateSegment to queue page 2 of a
+// listing before page 400.
+type byChainPos []walker.CompactURL
+
+func (l byChainPos) Len() int           { return len(l) }
+func (l byChainPos) Less(i, j int) bool { return l[i].ChainPos < l[j].ChainPos }
+func (l byChainPos) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// byKey sorts links by their cell keys, held in the parallel keys slice
+type byKey struct {
+	links []walker.CompactURL
+	keys  []string
+}
+
+func (l byKey) Len() int           { return len(l.links) }
+func (l byKey) Less(i, j int) bool { return l.keys[i] < l.keys[j] }
+func (l byKey) Swap(i, j int) {
+	l.links[i], l.links[j] = l.links[j], l.links[i]
+	l.keys[i], l.keys[j] = l.keys[j], l.keys[i]
+}
+
+// firstByKey returns the limit links of links (and their keys) with the
+// lowest keys, in key order
+func firstByKey(links []walker.CompactURL, keys []string, limit int) ([]walker.CompactURL, []string) {
+	sort.Stable(byKey{links, keys})
+	if len(links) > limit {
+		links, keys = links[:limit], keys[:limit]
+	}
+	return links, keys
+}
+
 // createInsertAllColumns produces an insert statement that will usable to clone a CQL row. Arguments are:
 //   (a) the table that the cloned rows are coming from
 //   (b) An iterator that points to the set of rows the user plans to copy
@@ -518,8 +893,8 @@ func (d *Dispatcher) correctURLNormalization(u *walker.URL) *walker.URL {
 	}
 
 	// Create read iterator
-	read := `SELECT * FROM links WHERE dom = ? AND subdom = ? AND proto = ? AND path = ?`
-	itr := d.db.Query(read, dom, subdom, proto, path).Iter()
+	read := `SELECT * FROM links WHERE dom = ? AND bucket = ? AND subdom = ? AND proto = ? AND path = ?`
+	itr := d.db.Query(read, dom, LinkBucket(subdom, path), subdom, proto, path).Iter()
 
 	// Use the read iterator to fashion a generic insert statement to move all fields from one primary key
 	// to another.
@@ -530,6 +905,7 @@ func (d *Dispatcher) correctURLNormalization(u *walker.URL) *walker.URL {
 	mp := map[string]interface{}{}
 	for itr.MapScan(mp) {
 		mp["dom"] = newdom
+		mp["bucket"] = LinkBucket(newsubdom, newpath)
 		mp["subdom"] = newsubdom
 		mp["path"] = newpath
 		mp["proto"] = newproto
@@ -555,8 +931,8 @@ func (d *Dispatcher) correctURLNormalization(u *walker.URL) *walker.URL {
 	}
 
 	// Now clobber the old rows
-	del := `DELETE FROM links WHERE dom = ? AND subdom = ? AND proto = ? AND path = ?`
-	err = d.db.Query(del, dom, subdom, proto, path).Exec()
+	del := `DELETE FROM links WHERE dom = ? AND bucket = ? AND subdom = ? AND proto = ? AND path = ?`
+	err = d.db.Query(del, dom, LinkBucket(subdom, path), subdom, proto, path).Exec()
 	if err != nil {
 		log4go.Error("correctURLNormalization error; Failed to delete for URL %v: %v", u.URL, err)
 		return u
@@ -565,46 +941,313 @@ func (d *Dispatcher) correctURLNormalization(u *walker.URL) *walker.URL {
 	return c
 }
 
+// storeSubdomainStats replaces the subdomain_stats rows of domain with stats
+func (d *Dispatcher) storeSubdomainStats(domain string, stats []*SubdomainStats) {
+	err := d.db.Query(`DELETE FROM subdomain_stats WHERE dom = ?`, domain).Exec()
+	if err != nil {
+		log4go.Error("Failed to clear subdomain_stats for %v: %v", domain, err)
+		return
+	}
+	for _, s := range stats {
+		err := d.db.Query(`INSERT INTO subdomain_stats (dom, subdom, tot_links, uncrawled_links, error_links)
+							VALUES (?, ?, ?, ?, ?)`,
+			domain, s.Subdomain, s.NumberLinksTotal, s.NumberLinksUncrawled, s.NumberLinksFailed).Exec()
+		if err != nil {
+			log4go.Error("Failed to insert subdomain_stats for %v: %v", s.Host(), err)
+		}
+	}
+}
+
 // generateSegment reads links in for this domain, generates a segment for it,
 // and inserts the domain into domains_to_crawl (assuming a segment is ready to
-// go)
+// go). It gives up without writing anything if reading the domain's links
+// takes longer than dispatcher.domain_timeout.
 func (d *Dispatcher) generateSegment(domain string) error {
+	var deadline time.Time
+	if d.domainTimeout > 0 {
+		deadline = time.Now().Add(d.domainTimeout)
+	}
+
+	if list := walker.DomainBlocklisted(domain); list != "" {
+		log4go.Info("Domain %v is on blocklist %v, not dispatching it", domain, list)
+		return nil
+	}
+
 	//
 	// If domain is empty, return early
 	//
-	var lastDispatch, lastEmptyDispatch time.Time
-	err := d.db.Query("SELECT last_dispatch, last_empty_dispatch FROM domain_info WHERE dom = ?",
-		domain).Scan(&lastDispatch, &lastEmptyDispatch)
+	var lastDispatch, lastEmptyDispatch, qday, dispatchStarted, boostUntil, burstUntil, quarantineUntil time.Time
+	var byteQuota, quotaBytes int64
+	var cursor string
+	var prev domainStats
+	var prevFrontier frontierStats
+	var prevContent contentStats
+	var alreadyDispatched bool
+	var priority, maxSegments int
+	err := d.db.Query(`SELECT last_dispatch, last_empty_dispatch, byte_quota, quota_bytes, quota_day, uncrawled_cursor,
+							tot_links, uncrawled_links, error_links, parse_error_links, recent_links, queued_links,
+							robots_excluded_links, noindex_links, nofollow_links, dispatch_started, boost_until, quarantine_until,
+							uncrawled_ages, refresh_due, refresh_overdue, dispatched, priority, max_segs, burst_until,
+							type_counts, status_counts
+						FROM domain_info WHERE dom = ?`,
+		domain).Scan(&lastDispatch, &lastEmptyDispatch, &byteQuota, &quotaBytes, &qday, &cursor,
+		&prev.total, &prev.uncrawled, &prev.failed, &prev.parseFailed, &prev.recent, &prev.queued,
+		&prev.robotsExcluded, &prev.noindex, &prev.nofollow,
+		&dispatchStarted, &boostUntil, &quarantineUntil,
+		&prevFrontier.ages, &prevFrontier.refreshDue, &prevFrontier.refreshOver,
+		&alreadyDispatched, &priority, &maxSegments, &burstUntil,
+		&prevContent.types, &prevContent.statuses)
 	if err != nil {
-		log4go.Error("Failed to read last_dispatch and last_empty_dispatch for %q: %v", domain, err)
+		log4go.Error("Failed to read domain_info for %q: %v", domain, err)
 		return err
 	}
+
+	//
+	// If writing a segment for this domain was interrupted, clear what was
+	// written before starting over. Like recoverInterrupted, leave journals
+	// younger than dispatcher.domain_timeout alone: another dispatcher may
+	// still be writing them.
+	//
+	if !dispatchStarted.IsZero() {
+		if d.domainTimeout > 0 && time.Since(dispatchStarted) < d.domainTimeout {
+			log4go.Debug("Segment for %v started at %v may still be in progress, not dispatching it",
+				domain, dispatchStarted)
+			return nil
+		}
+		log4go.Warn("Segment for %v started at %v was never finished, clearing it", domain, dispatchStarted)
+		if err := d.clearInterrupted(domain); err != nil {
+			return err
+		}
+	}
+	if time.Now().Before(quarantineUntil) {
+		log4go.Debug("Domain %v is quarantined until %v, not dispatching it", domain, quarantineUntil)
+		return nil
+	}
 	if lastEmptyDispatch.After(lastDispatch) && time.Since(lastEmptyDispatch) < d.emptyDispatchRetryInterval {
 		log4go.Debug("generateSegment pruned dispatch of domain %v", domain)
 		return nil
 	}
 
-	log4go.Info("Generating a crawl segment for %v", domain)
+	//
+	// If the domain has used up today's download quota, wait until tomorrow
+	//
+	quota := hostQuota{limit: effectiveByteQuota(byteQuota), used: quotaBytes, day: qday}
+	if quota.exceeded(time.Now()) {
+		log4go.Info("Domain %v is over its daily download quota, deferring dispatch", domain)
+		return nil
+	}
+
+	//
+	// A domain already dispatched gets a pending segment generated ahead of
+	// the one being crawled (see pipeline.go), leaving out the links already
+	// queued, if it may have more segments outstanding
+	//
+	var pendingSeq int
+	var queued map[string]bool
+	if alreadyDispatched {
+		seqs, err := pendingSegmentSeqs(d.db, domain)
+		if err != nil {
+			return err
+		}
+		if len(seqs) >= burstPipelineDepth(pipelineDepth(priority, maxSegments), maxSegments, burstUntil) {
+			return nil
+		}
+		pendingSeq = 1
+		if len(seqs) > 0 {
+			pendingSeq = seqs[len(seqs)-1] + 1
+		}
+		queued, err = d.queuedLinks(domain)
+		if err != nil {
+			return err
+		}
+		log4go.Info("Generating pending segment %v for %v", pendingSeq, domain)
+	} else {
+		// A pending segment completed after the domain was unclaimed (the
+		// unclaim found nothing to promote) would be promoted on top of this
+		// one, dispatching its links twice
+		seqs, err := pendingSegmentSeqs(d.db, domain)
+		if err != nil {
+			return err
+		}
+		if len(seqs) > 0 {
+			log4go.Info("Dropping %v pending segments left over for undispatched domain %v", len(seqs), domain)
+			dropPendingSegments(d.db, domain)
+		}
+		log4go.Info("Generating a crawl segment for %v", domain)
+	}
 
 	//
-	// Three lists to hold the 3 link types
+	// Three lists to hold the 3 link types. Links are held compacted with
+	// hosts until they are picked for the segment, since a big domain can
+	// have millions of crawled links waiting in crawledLinks.
 	//
-	var getNowLinks []*walker.URL    // links marked getnow
-	var uncrawledLinks []*walker.URL // links that haven't been crawled
-	var crawledLinks PriorityURL     // already crawled links, oldest links out first
+	hosts := walker.NewHostTable()
+	var getNowLinks []walker.CompactURL    // links marked getnow
+	var uncrawledLinks []walker.CompactURL // links that haven't been crawled
+	var crawledLinks PriorityURL           // already crawled links, oldest links out first
 	heap.Init(&crawledLinks)
 
+	// Uncrawled pages past the first of a pagination chain are held back
+	// here, and queued (earliest pages first) after other uncrawled links
+	var chainLinks byChainPos
+
+	// Uncrawled links are taken starting after cursor, the last uncrawled link
+	// dispatched for this domain, and wrapping around to the start of the scan
+	// (wrappedLinks), so links late in the scan get their turn even while new
+	// links keep being found earlier in it. uncrawledKeys and wrappedKeys hold
+	// the cell keys of the links. Links only come out in key order within each
+	// bucket of the links table, so the lists are trimmed to the links with
+	// the lowest keys (see firstByKey) rather than to the first links read.
+	var wrappedLinks []walker.CompactURL
+	var uncrawledKeys, wrappedKeys []string
+
 	// cell push will push the argument cell onto one of the three link-lists.
-	// logs failure if CreateURL fails. It also keeps track of total and uncrawled
-	// links by incrementing linksCount and uncrawledLinksCount
+	// logs failure if CreateURL fails. It also keeps track of total, uncrawled,
+	// failed, unparseable and recently crawled links, and coverage losses, by
+	// incrementing linksCount, uncrawledLinksCount, failedLinksCount,
+	// parseFailedLinksCount, recentLinksCount and losses
 	var now = time.Now()
-	var limit = walker.Config.Dispatcher.MaxLinksPerSegment
+	var limit = burstSegmentLimit(boostedSegmentLimit(boostUntil), burstUntil)
+	var bursting = burstActive(burstUntil)
+
+	// Domains too big to cover in full are sampled (see sampling.go); links
+	// due to be crawled go to sampler instead of the lists above, unless the
+	// domain is in burst mode
+	var sampler *linkSampler
+	if threshold := walker.Config.Dispatcher.SamplingThreshold; threshold > 0 && prev.total > threshold && !bursting {
+		log4go.Info("Sampling segment for %v (%v links at last dispatch)", domain, prev.total)
+		sampler = newLinkSampler(limit)
+	}
 	linksCount := 0
 	uncrawledLinksCount := 0
+	failedLinksCount := 0
+	parseFailedLinksCount := 0
+	recentLinksCount := 0
+	var losses domainStats
+	recentSince := now.Add(-FetchRateWindow)
+
+	// The frontier counts (see frontier.go), and the uncrawled links not yet
+	// stamped with the time they were found
+	frontier := newFrontierStats()
+	var unstamped []cell
+
+	// The composition counts (see composition.go), if on
+	var content *contentStats
+	if walker.Config.Dispatcher.ContentStatsLimit > 0 {
+		c := newContentStats()
+		content = &c
+	}
+
+	// Trap escape (see traps.go): the domain's param rules by paramRuleKey,
+	// the links active rules collapsed uncrawled links to (counted by cell
+	// key), and the detector looking for new traps
+	var rules map[string]*ParamRule
+	var collapsed map[string]int
+	var traps *trapDetector
+	if walker.Config.Dispatcher.TrapEscape != walker.TrapEscapeOff {
+		all, err := readParamRules(d.db, domain)
+		if err != nil {
+			log4go.Error("Not escaping traps of %v: %v", domain, err)
+		} else {
+			rules = map[string]*ParamRule{}
+			for _, r := range all {
+				rules[paramRuleKey(r.Subdomain, r.Path)] = r
+			}
+			collapsed = map[string]int{}
+			traps = newTrapDetector()
+		}
+	}
+
+	// The same counts per subdomain, if dispatcher.subdomain_stats_limit is set
+	var subdomainStats map[string]*SubdomainStats
+	if walker.Config.Dispatcher.SubdomainStatsLimit > 0 {
+		subdomainStats = map[string]*SubdomainStats{}
+	}
+
 	cellPush := func(c *cell) {
+		var sub *SubdomainStats
+		if subdomainStats != nil {
+			sub = subdomainStats[c.subdom]
+			if sub == nil {
+				sub = &SubdomainStats{Domain: domain, Subdomain: c.subdom}
+				subdomainStats[c.subdom] = sub
+			}
+			sub.NumberLinksTotal++
+		}
+
 		linksCount++
+		if content != nil {
+			content.add(c)
+		}
 		if c.crawlTime.Equal(walker.NotYetCrawled) {
 			uncrawledLinksCount++
+			if sub != nil {
+				sub.NumberLinksUncrawled++
+			}
+			if c.found.IsZero() {
+				unstamped = append(unstamped, *c)
+				frontier.ages[0]++
+			} else {
+				frontier.ages[frontierAgeBucket(c.found, now)]++
+			}
+		} else if c.fetchErr != "" || c.status >= 400 {
+			failedLinksCount++
+			if sub != nil {
+				sub.NumberLinksFailed++
+			}
+		} else if c.parseErr != "" {
+			parseFailedLinksCount++
+		}
+		if c.crawlTime.After(recentSince) {
+			recentLinksCount++
+		}
+		if c.robotEx && c.crawlTime.Equal(walker.NotYetCrawled) {
+			losses.robotsExcluded++
+		}
+		if c.noindex {
+			losses.noindex++
+		}
+		if c.nofollow {
+			losses.nofollow++
+		}
+
+		if c.crawlAt.After(now) {
+			// Scheduled to be crawled later (links.crawl_at)
+			return
+		}
+		if !c.getnow && c.tooDeep() {
+			// Past dispatcher.max_crawl_depth
+			return
+		}
+		if !c.getnow && c.redirectSettled() {
+			// Its content is crawled at the target it redirects to
+			return
+		}
+		if !c.crawlTime.Equal(walker.NotYetCrawled) {
+			delay := c.refreshDelay(d.minRecrawlDelta, d.maxRefreshInterval)
+			if c.crawlTime.Add(delay).Before(now) {
+				frontier.refreshDue++
+			}
+			if c.crawlTime.Add(2 * delay).Before(now) {
+				frontier.refreshOver++
+			}
+		}
+		if traps != nil && !c.getnow && c.crawlTime.Equal(walker.NotYetCrawled) {
+			rule := rules[paramRuleKey(c.subdom, trapPathOf(c.path))]
+			if rule == nil {
+				traps.add(c.subdom, c.path)
+			} else if rule.Status == ParamRuleActive {
+				if path, ok := rule.Collapse(c.path); ok {
+					// Its collapsed link is crawled instead
+					collapsed[(&cell{subdom: c.subdom, path: path, proto: c.proto}).key()]++
+					return
+				}
+			}
+		}
+
+		if queued[c.key()] {
+			// Already in the current or a pending segment
+			return
 		}
 
 		u, err := walker.CreateURL(domain, c.subdom, c.path, c.proto, c.crawlTime)
@@ -616,17 +1259,43 @@ func (d *Dispatcher) generateSegment(domain string) error {
 		if walker.Config.Dispatcher.CorrectLinkNormalization {
 			u = d.correctURLNormalization(u)
 		}
+		u.ChainPos = c.chainPos
+		u.Depth = c.depth
+		u.LastFingerprint = c.fnv
+		cu := hosts.Compact(u)
 
 		if c.getnow {
-			getNowLinks = append(getNowLinks, u)
+			getNowLinks = append(getNowLinks, cu)
+		} else if sampler != nil {
+			if c.crawlTime.Equal(walker.NotYetCrawled) ||
+				c.crawlTime.Add(c.refreshDelay(d.minRecrawlDelta, d.maxRefreshInterval)).Before(now) {
+				sampler.add(c.path, cu)
+			}
+		} else if c.crawlTime.Equal(walker.NotYetCrawled) && c.chainPos > 1 {
+			chainLinks = append(chainLinks, cu)
+			if len(chainLinks) >= 2*limit {
+				sort.Sort(chainLinks)
+				chainLinks = chainLinks[:limit]
+			}
 		} else if c.crawlTime.Equal(walker.NotYetCrawled) {
-			if len(uncrawledLinks) < limit {
-				uncrawledLinks = append(uncrawledLinks, u)
+			if key := c.key(); key > cursor {
+				uncrawledLinks = append(uncrawledLinks, cu)
+				uncrawledKeys = append(uncrawledKeys, key)
+				if len(uncrawledLinks) >= 2*limit {
+					uncrawledLinks, uncrawledKeys = firstByKey(uncrawledLinks, uncrawledKeys, limit)
+				}
+			} else {
+				wrappedLinks = append(wrappedLinks, cu)
+				wrappedKeys = append(wrappedKeys, key)
+				if len(wrappedLinks) >= 2*limit {
+					wrappedLinks, wrappedKeys = firstByKey(wrappedLinks, wrappedKeys, limit)
+				}
 			}
 		} else {
-			// Was this link crawled less than MinLinkRefreshTime?
-			if c.crawlTime.Add(d.minRecrawlDelta).Before(now) {
-				heap.Push(&crawledLinks, u)
+			// Was this link crawled less than MinLinkRefreshTime ago, or is
+			// its declared cache lifetime not up yet?
+			if c.crawlTime.Add(c.refreshDelay(d.minRecrawlDelta, d.maxRefreshInterval)).Before(now) {
+				heap.Push(&crawledLinks, cu)
 			}
 		}
 
@@ -643,8 +1312,10 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	// The only risk is: if a node is down and does not receive some link
 	// writes, then comes back up and is read for this query it may be missing
 	// some of the newly crawled links. This is unlikely and seems acceptable.
-	q := d.db.Query(`SELECT subdom, path, proto, time, getnow
-						FROM links WHERE dom = ?`, domain)
+	q := d.db.Query(`SELECT subdom, path, proto, time, getnow, chain_pos, err, parse_err, stat,
+							cache_max_age, expires, refresh_hint, crawl_at, robot_ex, noindex, nofollow, redto_url,
+							redto_stat, found, depth, fnv, mime
+						FROM links WHERE dom = ? AND bucket IN ?`, domain, linkBuckets())
 	q.Consistency(gocql.One)
 
 	var start = true
@@ -652,7 +1323,17 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	var current cell
 	var previous cell
 	iter := q.Iter()
-	for iter.Scan(&current.subdom, &current.path, &current.proto, &current.crawlTime, &current.getnow) {
+	for iter.Scan(&current.subdom, &current.path, &current.proto, &current.crawlTime, &current.getnow,
+		&current.chainPos, &current.fetchErr, &current.parseErr, &current.status,
+		&current.cacheMaxAge, &current.expires, &current.refreshHint, &current.crawlAt, &current.robotEx,
+		&current.noindex, &current.nofollow, &current.redtoURL, &current.redtoStatus, &current.found,
+		&current.depth, &current.fnv, &current.mime) {
+		if !start && current.equivalent(&previous) {
+			current.countRedirects(&previous)
+			current.inheritDepth(&previous)
+		} else {
+			current.countRedirects(nil)
+		}
 		if start {
 			previous = current
 			start = false
@@ -668,6 +1349,12 @@ func (d *Dispatcher) generateSegment(domain string) error {
 
 		previous = current
 
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			iter.Close()
+			return fmt.Errorf("timed out after %v reading links of %v (%v read)", d.domainTimeout, domain,
+				linksCount)
+		}
+
 		if len(getNowLinks) >= limit {
 			finish = false
 			break
@@ -680,41 +1367,107 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	if err := iter.Close(); err != nil {
 		return fmt.Errorf("error selecting links for %v: %v", domain, err)
 	}
+	uncrawledLinks, uncrawledKeys = firstByKey(uncrawledLinks, uncrawledKeys, limit)
+	wrappedLinks, wrappedKeys = firstByKey(wrappedLinks, wrappedKeys, limit)
 
 	//
 	// Merge the 3 link types
 	//
 	var links []*walker.URL
-	links = append(links, getNowLinks...)
+	take := func(cu walker.CompactURL) {
+		u, err := hosts.Expand(cu)
+		if err != nil {
+			log4go.Error("generateSegment failed to expand link: %v", err)
+			return
+		}
+		links = append(links, u)
+	}
+	for _, cu := range getNowLinks {
+		take(cu)
+	}
+
+	uncrawledLinks = append(uncrawledLinks, wrappedLinks...)
+	uncrawledKeys = append(uncrawledKeys, wrappedKeys...)
+	sort.Sort(chainLinks)
+	uncrawledLinks = append(uncrawledLinks, chainLinks...)
+	uncrawledTaken := 0
 
 	numRemain := limit - len(links)
-	if numRemain > 0 {
+	if numRemain > 0 && sampler != nil {
+		for _, cu := range sampler.sample(numRemain) {
+			take(cu)
+		}
+	} else if numRemain > 0 && bursting {
+		// A burst is for getting the whole domain crawled, so no refreshes
+		for len(uncrawledLinks) > 0 && len(links) < limit {
+			take(uncrawledLinks[0])
+			uncrawledLinks = uncrawledLinks[1:]
+			uncrawledTaken++
+		}
+	} else if numRemain > 0 {
 		refreshDecimal := walker.Config.Dispatcher.RefreshPercentage / 100.0
 		idealCrawled := round(refreshDecimal * float64(numRemain))
 		idealUncrawled := numRemain - idealCrawled
 
 		for i := 0; i < idealUncrawled && len(uncrawledLinks) > 0 && len(links) < limit; i++ {
-			links = append(links, uncrawledLinks[0])
+			take(uncrawledLinks[0])
 			uncrawledLinks = uncrawledLinks[1:]
+			uncrawledTaken++
 		}
 
 		for i := 0; i < idealCrawled && crawledLinks.Len() > 0 && len(links) < limit; i++ {
-			links = append(links, heap.Pop(&crawledLinks).(*walker.URL))
+			take(heap.Pop(&crawledLinks).(walker.CompactURL))
 		}
 
 		for len(uncrawledLinks) > 0 && len(links) < limit {
-			links = append(links, uncrawledLinks[0])
+			take(uncrawledLinks[0])
 			uncrawledLinks = uncrawledLinks[1:]
+			uncrawledTaken++
 		}
 
 		for crawledLinks.Len() > 0 && len(links) < limit {
-			links = append(links, heap.Pop(&crawledLinks).(*walker.URL))
+			take(heap.Pop(&crawledLinks).(walker.CompactURL))
 		}
 	}
 
+	// Pick up after the last (non pagination chain) uncrawled link dispatched
+	// next time
+	prevCursor := cursor
+	if uncrawledTaken > len(uncrawledKeys) {
+		uncrawledTaken = len(uncrawledKeys)
+	}
+	if uncrawledTaken > 0 {
+		cursor = uncrawledKeys[uncrawledTaken-1]
+	}
+
 	//
-	// Insert into segments
+	// Journal the segment in domain_info, then insert it into segments,
+	// dispatcher.segment_batch_size links at a time. A pending segment is
+	// inserted into pending_segments instead, and only counts once its size
+	// is written after it, so it needs no journal.
 	//
+	if pendingSeq > 0 {
+		err := d.db.Query(`DELETE FROM pending_segments WHERE dom = ? AND seq = ?`, domain, pendingSeq).Exec()
+		if err != nil {
+			return fmt.Errorf("error clearing pending segment %v of %v: %v", pendingSeq, domain, err)
+		}
+	} else if len(links) > 0 {
+		err := d.db.Query(`UPDATE domain_info SET dispatch_started = ?, dispatch_size = ? WHERE dom = ?`,
+			time.Now(), len(links), domain).Exec()
+		if err != nil {
+			return fmt.Errorf("error journaling segment of %v: %v", domain, err)
+		}
+	}
+	batch := d.db.NewBatch(gocql.UnloggedBatch)
+	flush := func() {
+		if batch.Size() == 0 {
+			return
+		}
+		if err := d.db.ExecuteBatch(batch); err != nil {
+			log4go.Error("Failed to insert %v segment links for %v, error: %v", batch.Size(), domain, err)
+		}
+		batch = d.db.NewBatch(gocql.UnloggedBatch)
+	}
 	for _, u := range links {
 		log4go.Debug("Inserting link in segment: %v", u.String())
 		dom, subdom, err := u.TLDPlusOneAndSubdomain()
@@ -722,12 +1475,32 @@ func (d *Dispatcher) generateSegment(domain string) error {
 			log4go.Error("generateSegment not inserting %v: %v", u, err)
 			return err
 		}
-		err = d.db.Query(`INSERT INTO segments
-			(dom, subdom, path, proto, time)
-			VALUES (?, ?, ?, ?, ?)`,
-			dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled).Exec()
+		if pendingSeq > 0 {
+			batch.Query(`INSERT INTO pending_segments
+				(dom, seq, subdom, path, proto, time, chain_pos, depth, fnv)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				dom, pendingSeq, subdom, u.RequestURI(), u.Scheme, u.LastCrawled, u.ChainPos, u.Depth,
+				u.LastFingerprint)
+		} else {
+			batch.Query(`INSERT INTO segments
+				(dom, subdom, path, proto, time, chain_pos, depth, fnv)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				dom, subdom, u.RequestURI(), u.Scheme, u.LastCrawled, u.ChainPos, u.Depth, u.LastFingerprint)
+		}
+		if batch.Size() >= walker.Config.Dispatcher.SegmentBatchSize {
+			flush()
+		}
+	}
+	flush()
+	if len(links) > 0 && d.Metrics != nil {
+		d.Metrics.Add(MetricSegmentsDispatched, 1)
+		d.Metrics.Add(MetricLinksDispatched, int64(len(links)))
+	}
+	if pendingSeq > 0 && len(links) > 0 {
+		err := d.db.Query(`INSERT INTO pending_segment_sizes (dom, seq, size, generated) VALUES (?, ?, ?, ?)`,
+			domain, pendingSeq, len(links), time.Now()).Exec()
 		if err != nil {
-			log4go.Error("Failed to insert link (%v), error: %v", u, err)
+			return fmt.Errorf("error completing pending segment %v of %v: %v", pendingSeq, domain, err)
 		}
 	}
 
@@ -747,23 +1520,84 @@ func (d *Dispatcher) generateSegment(domain string) error {
 	}
 
 	//
-	// Update domain_info
+	// Update domain_info, only writing the stats that changed since the last
+	// dispatch
 	//
-	updateQuery := fmt.Sprintf(`UPDATE domain_info
-								   SET 
-								   		dispatched = ?,
-								   		tot_links = ?,
-								   		uncrawled_links = ?,
-								   		queued_links = ?,
-								   		%s = ?
-								   WHERE dom = ?`, dispatchFieldName)
-
-	err = d.db.Query(updateQuery, dispatched, linksCount, uncrawledLinksCount, len(links), dispatchStamp,
-		domain).Exec()
-	if err != nil {
-		return fmt.Errorf("error inserting %v to domain_info: %v", domain, err)
+	stats := domainStats{
+		total:          linksCount,
+		uncrawled:      uncrawledLinksCount,
+		failed:         failedLinksCount,
+		parseFailed:    parseFailedLinksCount,
+		recent:         recentLinksCount,
+		queued:         len(links),
+		robotsExcluded: losses.robotsExcluded,
+		noindex:        losses.noindex,
+		nofollow:       losses.nofollow,
+	}
+	var updates []dbfield
+	if pendingSeq > 0 {
+		// The domain stays dispatched with its current segment queued
+		stats.queued = prev.queued
+	} else {
+		updates = append(updates, dbfield{"dispatched", dispatched})
+	}
+	updates = append(updates, stats.changed(prev)...)
+	if finish {
+		// The frontier counts are only whole if the scan was
+		updates = append(updates, frontier.changed(prevFrontier)...)
+		if content != nil {
+			top := content.top(walker.Config.Dispatcher.ContentStatsLimit)
+			updates = append(updates, top.changed(prevContent)...)
+		}
+	}
+	if cursor != prevCursor {
+		updates = append(updates, dbfield{"uncrawled_cursor", cursor})
+	}
+	if pendingSeq == 0 {
+		updates = append(updates, dbfield{dispatchFieldName, dispatchStamp})
+	}
+
+	sets := []string{}
+	values := []interface{}{}
+	for _, f := range updates {
+		sets = append(sets, f.name+" = ?")
+		values = append(values, f.value)
+	}
+	if dispatched && pendingSeq == 0 {
+		// Clear the journal in the same write that marks the domain dispatched
+		sets = append(sets, "dispatch_started = null", "dispatch_size = null")
+	}
+	if len(sets) > 0 {
+		values = append(values, domain)
+		err = d.db.Query(fmt.Sprintf(`UPDATE domain_info SET %s WHERE dom = ?`, strings.Join(sets, ", ")),
+			values...).Exec()
+		if err != nil {
+			return fmt.Errorf("error inserting %v to domain_info: %v", domain, err)
+		}
+	}
+
+	if bursting && finish && uncrawledLinksCount == 0 {
+		d.endBurst(domain)
+	}
+	if len(unstamped) > 0 {
+		d.stampFound(domain, unstamped, now)
+	}
+	if len(collapsed) > 0 {
+		d.storeCollapsed(domain, collapsed)
+	}
+	if traps != nil && finish {
+		if rule := traps.detect(domain, uncrawledLinksCount); rule != nil {
+			d.storeParamRule(rule)
+		}
+	}
+	if subdomainStats != nil {
+		d.storeSubdomainStats(domain, topSubdomains(subdomainStats, walker.Config.Dispatcher.SubdomainStatsLimit))
+	}
+	if pendingSeq > 0 {
+		log4go.Info("Generated pending segment %v for %v (%v links)", pendingSeq, domain, len(links))
+	} else {
+		log4go.Info("Generated segment for %v (%v links)", domain, len(links))
 	}
-	log4go.Info("Generated segment for %v (%v links)", domain, len(links))
 
 	return nil
 }
@@ -3,9 +3,12 @@
 package cassandra
 
 import (
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -36,6 +39,10 @@ type ExistingLink struct {
 	URL    walker.URL
 	Status int // -1 indicates this is a parsed link, not yet fetched
 	GetNow bool
+
+	// If set, the link failed to parse on this fetch (only used by
+	// TestDomainInfoStats)
+	ParseErr string
 }
 
 var MaxPriority = 10
@@ -428,8 +435,8 @@ func TestDispatcherBasic(t *testing.T) {
 		for _, el := range dt.ExistingLinks {
 			dom, subdom, _ := el.URL.TLDPlusOneAndSubdomain()
 			if el.Status == -1 {
-				q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, getnow)
-								VALUES (?, ?, ?, ?, ?, ?)`,
+				q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, getnow)
+								VALUES (?, 0, ?, ?, ?, ?, ?)`,
 					dom,
 					subdom,
 					el.URL.RequestURI(),
@@ -437,8 +444,8 @@ func TestDispatcherBasic(t *testing.T) {
 					el.URL.LastCrawled,
 					el.GetNow)
 			} else {
-				q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, stat, getnow)
-								VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, getnow)
+								VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
 					dom,
 					subdom,
 					el.URL.RequestURI(),
@@ -566,8 +573,8 @@ func TestMinLinkRefreshTime(t *testing.T) {
 		for _, el := range dt.ExistingLinks {
 			dom, subdom, _ := el.URL.TLDPlusOneAndSubdomain()
 			if el.Status == -1 {
-				q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, getnow)
-								VALUES (?, ?, ?, ?, ?, ?)`,
+				q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, getnow)
+								VALUES (?, 0, ?, ?, ?, ?, ?)`,
 					dom,
 					subdom,
 					el.URL.RequestURI(),
@@ -575,8 +582,8 @@ func TestMinLinkRefreshTime(t *testing.T) {
 					el.URL.LastCrawled,
 					el.GetNow)
 			} else {
-				q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, stat, getnow)
-								VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, getnow)
+								VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
 					dom,
 					subdom,
 					el.URL.RequestURI(),
@@ -614,6 +621,266 @@ func TestMinLinkRefreshTime(t *testing.T) {
 
 }
 
+func TestCacheLifetimeRefresh(t *testing.T) {
+	origMinLinkRefreshTime := walker.Config.Dispatcher.MinLinkRefreshTime
+	origMaxRefreshInterval := walker.Config.Dispatcher.MaxRefreshInterval
+	defer func() {
+		walker.Config.Dispatcher.MinLinkRefreshTime = origMinLinkRefreshTime
+		walker.Config.Dispatcher.MaxRefreshInterval = origMaxRefreshInterval
+	}()
+	walker.Config.Dispatcher.MinLinkRefreshTime = "1h"
+	walker.Config.Dispatcher.MaxRefreshInterval = "72h"
+
+	db := GetTestDB() // runs between tests to reset the db
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, MaxPriority).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+
+	now := time.Now()
+	day := 24 * time.Hour
+	links := []struct {
+		path     string
+		crawled  time.Time
+		maxAge   int
+		expires  time.Time
+		expected bool
+	}{
+		// No declared lifetime, only min_link_refresh_time applies
+		{"/none.html", now.Add(-2 * time.Hour), 0, time.Time{}, true},
+		{"/none-recent.html", now.Add(-30 * time.Minute), 0, time.Time{}, false},
+
+		// max-age of 2 days
+		{"/fresh.html", now.Add(-day), 2 * 86400, time.Time{}, false},
+		{"/stale.html", now.Add(-3 * day), 2 * 86400, time.Time{}, true},
+
+		// Expires 2 days after the crawl
+		{"/expires-fresh.html", now.Add(-day), 0, now.Add(day), false},
+		{"/expires-stale.html", now.Add(-3 * day), 0, now.Add(-day), true},
+
+		// A year long max-age is capped by max_refresh_interval
+		{"/capped.html", now.Add(-4 * day), 365 * 86400, time.Time{}, true},
+	}
+	expected := map[string]bool{}
+	for _, l := range links {
+		q := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, cache_max_age, expires)
+						VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
+			"test.com", "", l.path, "http", l.crawled, l.maxAge, l.expires)
+		if l.maxAge == 0 && l.expires.IsZero() {
+			q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time)
+							VALUES (?, 0, ?, ?, ?, ?)`,
+				"test.com", "", l.path, "http", l.crawled)
+		}
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test link: %v\nQuery: %v", err, q)
+		}
+		if l.expected {
+			expected[l.path] = true
+		}
+	}
+
+	runDispatcher(t)
+
+	got := map[string]bool{}
+	iter := db.Query(`SELECT path FROM segments WHERE dom = 'test.com'`).Iter()
+	var path string
+	for iter.Scan(&path) {
+		got[path] = true
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected segments %v\nBut got: %v", expected, got)
+	}
+}
+
+func TestRefreshHints(t *testing.T) {
+	origMinLinkRefreshTime := walker.Config.Dispatcher.MinLinkRefreshTime
+	origMaxRefreshInterval := walker.Config.Dispatcher.MaxRefreshInterval
+	defer func() {
+		walker.Config.Dispatcher.MinLinkRefreshTime = origMinLinkRefreshTime
+		walker.Config.Dispatcher.MaxRefreshInterval = origMaxRefreshInterval
+	}()
+	walker.Config.Dispatcher.MinLinkRefreshTime = "1h"
+	walker.Config.Dispatcher.MaxRefreshInterval = "72h"
+
+	db := GetTestDB() // runs between tests to reset the db
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, MaxPriority).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+
+	now := time.Now()
+	day := 24 * time.Hour
+	links := []struct {
+		path     string
+		crawled  time.Time
+		hint     int
+		maxAge   int
+		expected bool
+	}{
+		// Weekly hint
+		{"/weekly-fresh.html", now.Add(-2 * day), 7 * 86400, 0, false},
+		{"/capped.html", now.Add(-4 * day), 7 * 86400, 0, true},
+
+		// Hourly hint, but no shorter than min_link_refresh_time
+		{"/hourly.html", now.Add(-2 * time.Hour), 3600, 0, true},
+		{"/hourly-recent.html", now.Add(-30 * time.Minute), 60, 0, false},
+
+		// A declared cache lifetime wins over the hint
+		{"/max-age.html", now.Add(-2 * time.Hour), 7 * 86400, 3600, true},
+	}
+	expected := map[string]bool{}
+	for _, l := range links {
+		q := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, refresh_hint)
+						VALUES (?, 0, ?, ?, ?, ?, ?)`,
+			"test.com", "", l.path, "http", l.crawled, l.hint)
+		if l.maxAge > 0 {
+			q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, refresh_hint, cache_max_age)
+							VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
+				"test.com", "", l.path, "http", l.crawled, l.hint, l.maxAge)
+		}
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test link: %v\nQuery: %v", err, q)
+		}
+		if l.expected {
+			expected[l.path] = true
+		}
+	}
+
+	runDispatcher(t)
+
+	got := map[string]bool{}
+	iter := db.Query(`SELECT path FROM segments WHERE dom = 'test.com'`).Iter()
+	var path string
+	for iter.Scan(&path) {
+		got[path] = true
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected segments %v\nBut got: %v", expected, got)
+	}
+}
+
+func TestDispatchCrawlAt(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, MaxPriority).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+
+	now := time.Now()
+	links := []struct {
+		path     string
+		crawled  time.Time
+		getnow   bool
+		crawlAt  time.Time
+		expected bool
+	}{
+		{"/now.html", walker.NotYetCrawled, false, time.Time{}, true},
+		{"/later.html", walker.NotYetCrawled, false, now.Add(time.Hour), false},
+		{"/past.html", walker.NotYetCrawled, false, now.Add(-time.Hour), true},
+		{"/getnow-later.html", walker.NotYetCrawled, true, now.Add(time.Hour), false},
+		{"/retry-later.html", now.Add(-48 * time.Hour), false, now.Add(time.Hour), false},
+		{"/retry-past.html", now.Add(-48 * time.Hour), false, now.Add(-time.Hour), true},
+	}
+	expected := map[string]bool{}
+	for _, l := range links {
+		q := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, getnow, crawl_at)
+						VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
+			"test.com", "", l.path, "http", l.crawled, l.getnow, l.crawlAt)
+		if l.crawlAt.IsZero() {
+			q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, getnow)
+							VALUES (?, 0, ?, ?, ?, ?, ?)`,
+				"test.com", "", l.path, "http", l.crawled, l.getnow)
+		}
+		if err := q.Exec(); err != nil {
+			t.Fatalf("Failed to insert test link: %v\nQuery: %v", err, q)
+		}
+		if l.expected {
+			expected[l.path] = true
+		}
+	}
+
+	runDispatcher(t)
+
+	got := map[string]bool{}
+	iter := db.Query(`SELECT path FROM segments WHERE dom = 'test.com'`).Iter()
+	var path string
+	for iter.Scan(&path) {
+		got[path] = true
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected segments %v\nBut got: %v", expected, got)
+	}
+}
+
+func TestDispatchSettledRedirects(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, MaxPriority).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+
+	// Each link was fetched an hour apart, ending two days ago, redirecting
+	// with the given statuses to the given targets
+	links := []struct {
+		path     string
+		statuses []int
+		targets  []string
+		getnow   bool
+		expected bool
+	}{
+		{"/settled.html", []int{301, 301, 301}, []string{"/new.html", "/new.html", "/new.html"}, false, false},
+		{"/twice.html", []int{302, 301, 301}, []string{"/new.html", "/new.html", "/new.html"}, false, true},
+		{"/moved-again.html", []int{301, 301, 301}, []string{"/a.html", "/a.html", "/b.html"}, false, true},
+		{"/temporary.html", []int{302, 302, 302}, []string{"/new.html", "/new.html", "/new.html"}, false, true},
+		{"/getnow.html", []int{301, 301, 301}, []string{"/new.html", "/new.html", "/new.html"}, true, true},
+	}
+	expected := map[string]bool{}
+	last := time.Now().Add(-48 * time.Hour)
+	for _, l := range links {
+		for i, status := range l.statuses {
+			crawled := last.Add(time.Duration(i-len(l.statuses)+1) * time.Hour)
+			getnow := l.getnow && i == len(l.statuses)-1
+			err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, redto_url, redto_stat, getnow)
+							VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?)`,
+				"test.com", "", l.path, "http", crawled, "http://test.com"+l.targets[i], status, getnow).Exec()
+			if err != nil {
+				t.Fatalf("Failed to insert test link: %v", err)
+			}
+		}
+		if l.expected {
+			expected[l.path] = true
+		}
+	}
+
+	runDispatcher(t)
+
+	got := map[string]bool{}
+	iter := db.Query(`SELECT path FROM segments WHERE dom = 'test.com'`).Iter()
+	var path string
+	for iter.Scan(&path) {
+		got[path] = true
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected segments %v\nBut got: %v", expected, got)
+	}
+}
+
 func TestAutoUnclaim(t *testing.T) {
 	// This test shows that the dispatcher will reclaim the dead.com links,
 	// but leave the ok.com links alone.
@@ -690,8 +957,8 @@ func TestAutoUnclaim(t *testing.T) {
 		for _, el := range dt.ExistingLinks {
 			dom, subdom, _ := el.URL.TLDPlusOneAndSubdomain()
 			if el.Status == -1 {
-				q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, getnow)
-								VALUES (?, ?, ?, ?, ?, ?)`,
+				q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, getnow)
+								VALUES (?, 0, ?, ?, ?, ?, ?)`,
 					dom,
 					subdom,
 					el.URL.RequestURI(),
@@ -699,8 +966,8 @@ func TestAutoUnclaim(t *testing.T) {
 					el.URL.LastCrawled,
 					el.GetNow)
 			} else {
-				q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, stat, getnow)
-								VALUES (?, ?, ?, ?, ?, ?, ?)`,
+				q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, getnow)
+								VALUES (?, 0, ?, ?, ?, ?, ?, ?)`,
 					dom,
 					subdom,
 					el.URL.RequestURI(),
@@ -923,13 +1190,13 @@ func TestURLCorrection(t *testing.T) {
 		}
 		path := u.RequestURI()
 		proto := u.Scheme
-		err = db.Query(`INSERT INTO links (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+		err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
 			dom, subdom, path, proto, walker.NotYetCrawled).Exec()
 		if err != nil {
 			t.Fatalf("Failed to insert into links for %v: %v", tst.input, err)
 		}
 		if tst.double {
-			err = db.Query(`INSERT INTO links (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+			err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
 				dom, subdom, path, proto, time.Now()).Exec()
 			if err != nil {
 				t.Fatalf("Failed to insert into links (2nd time) for %v: %v", tst.input, err)
@@ -1013,7 +1280,7 @@ func TestDomainInfoStats(t *testing.T) {
 
 			ExistingLinks: []ExistingLink{
 				{URL: walker.URL{URL: walker.MustParse("http://test.com/page1.html").URL,
-					LastCrawled: now.AddDate(0, 0, -1)}},
+					LastCrawled: now.AddDate(0, 0, -1)}, Status: 404},
 				{URL: walker.URL{URL: walker.MustParse("http://test.com/page1.html").URL,
 					LastCrawled: now.AddDate(0, 0, -2)}},
 				{URL: walker.URL{URL: walker.MustParse("http://test.com/page1.html").URL,
@@ -1025,7 +1292,7 @@ func TestDomainInfoStats(t *testing.T) {
 				{URL: walker.URL{URL: walker.MustParse("http://test.com/page3.html").URL,
 					LastCrawled: walker.NotYetCrawled}},
 				{URL: walker.URL{URL: walker.MustParse("http://test.com/page4.html").URL,
-					LastCrawled: time.Now()}},
+					LastCrawled: time.Now()}, Status: 200, ParseErr: "HTML tokenizer failed: max buffer exceeded"},
 			},
 		},
 	}
@@ -1049,14 +1316,16 @@ func TestDomainInfoStats(t *testing.T) {
 
 		for _, el := range dt.ExistingLinks {
 			dom, subdom, _ := el.URL.TLDPlusOneAndSubdomain()
-			q = db.Query(`INSERT INTO links (dom, subdom, path, proto, time, getnow)
-								VALUES (?, ?, ?, ?, ?, ?)`,
+			q = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, getnow, stat, parse_err)
+								VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?)`,
 				dom,
 				subdom,
 				el.URL.RequestURI(),
 				el.URL.Scheme,
 				el.URL.LastCrawled,
-				el.GetNow)
+				el.GetNow,
+				el.Status,
+				el.ParseErr)
 			if err := q.Exec(); err != nil {
 				t.Fatalf("Failed to insert test links: %v\nQuery: %v", err, q)
 			}
@@ -1064,10 +1333,12 @@ func TestDomainInfoStats(t *testing.T) {
 
 		runDispatcher(t)
 
-		var linksCount, uncrawledLinksCount, queuedLinksCount int
-		err := db.Query(`SELECT tot_links, uncrawled_links, queued_links 
+		var linksCount, uncrawledLinksCount, queuedLinksCount, errorLinksCount, recentLinksCount int
+		var parseErrorLinksCount int
+		err := db.Query(`SELECT tot_links, uncrawled_links, queued_links, error_links, recent_links, parse_error_links
 						 FROM domain_info 
-						 WHERE dom = 'test.com'`).Scan(&linksCount, &uncrawledLinksCount, &queuedLinksCount)
+						 WHERE dom = 'test.com'`).Scan(&linksCount, &uncrawledLinksCount, &queuedLinksCount,
+			&errorLinksCount, &recentLinksCount, &parseErrorLinksCount)
 		if err != nil {
 			t.Fatalf("Select direct error: %v", err)
 		}
@@ -1080,8 +1351,145 @@ func TestDomainInfoStats(t *testing.T) {
 		if queuedLinksCount != 3 {
 			t.Errorf("queued_links mismatch: got %d, expected %d", queuedLinksCount, 3)
 		}
+		if errorLinksCount != 1 {
+			t.Errorf("error_links mismatch: got %d, expected %d", errorLinksCount, 1)
+		}
+		if recentLinksCount != 1 {
+			t.Errorf("recent_links mismatch: got %d, expected %d", recentLinksCount, 1)
+		}
+		if parseErrorLinksCount != 1 {
+			t.Errorf("parse_error_links mismatch: got %d, expected %d", parseErrorLinksCount, 1)
+		}
+	}
+
+}
+
+func TestDispatcherCoverageLosses(t *testing.T) {
+	db := GetTestDB()
+	if err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, excluded)
+							VALUES ('test.com', 00000000-0000-0000-0000-000000000000, 1, false, false)`).Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+
+	crawled := time.Now().AddDate(0, 0, -1)
+	links := []struct {
+		path                       string
+		time                       time.Time
+		robotEx, noindex, nofollow bool
+	}{
+		{"/excluded.html", walker.NotYetCrawled, true, false, false},
+		{"/noindex.html", crawled, false, true, false},
+		{"/both.html", crawled, false, true, true},
+		{"/nofollow.html", crawled, false, false, true},
+		{"/fine.html", crawled, false, false, false},
+		{"/uncrawled.html", walker.NotYetCrawled, false, false, false},
+	}
+	for _, l := range links {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, robot_ex, noindex, nofollow)
+							VALUES ('test.com', 0, '', ?, 'http', ?, 200, ?, ?, ?)`,
+			l.path, l.time, l.robotEx, l.noindex, l.nofollow).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert test link: %v", err)
+		}
+	}
+	// A link that was excluded once but has since been crawled isn't lost
+	for _, tm := range []time.Time{walker.NotYetCrawled, crawled} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, robot_ex)
+							VALUES ('test.com', 0, '', '/allowed.html', 'http', ?, 200, ?)`,
+			tm, tm.Equal(walker.NotYetCrawled)).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert test link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	ds := getDS(t)
+	defer ds.Close()
+	dinfo, err := ds.FindDomain("test.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo.NumberLinksRobotsExcluded != 1 {
+		t.Errorf("robots_excluded_links mismatch: got %d, expected %d", dinfo.NumberLinksRobotsExcluded, 1)
+	}
+	if dinfo.NumberLinksNoIndex != 2 {
+		t.Errorf("noindex_links mismatch: got %d, expected %d", dinfo.NumberLinksNoIndex, 2)
+	}
+	if dinfo.NumberLinksNoFollow != 2 {
+		t.Errorf("nofollow_links mismatch: got %d, expected %d", dinfo.NumberLinksNoFollow, 2)
+	}
+	if loss, expected := dinfo.CoverageLoss(), 3.0/7.0; loss != expected {
+		t.Errorf("CoverageLoss mismatch: got %v, expected %v", loss, expected)
+	}
+}
+
+func TestDispatchFrontier(t *testing.T) {
+	origMinLinkRefreshTime := walker.Config.Dispatcher.MinLinkRefreshTime
+	defer func() {
+		walker.Config.Dispatcher.MinLinkRefreshTime = origMinLinkRefreshTime
+	}()
+	walker.Config.Dispatcher.MinLinkRefreshTime = "24h"
+
+	db := GetTestDB()
+	if err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, excluded)
+							VALUES ('test.com', 00000000-0000-0000-0000-000000000000, 1, false, false)`).Exec(); err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+
+	now := time.Now()
+	links := []struct {
+		path  string
+		time  time.Time
+		found time.Time
+	}{
+		{"/new.html", walker.NotYetCrawled, time.Time{}},
+		{"/week.html", walker.NotYetCrawled, now.AddDate(0, 0, -3)},
+		{"/old.html", walker.NotYetCrawled, now.AddDate(0, 0, -60)},
+		{"/fresh.html", now.Add(-time.Hour), time.Time{}},
+		{"/due.html", now.Add(-30 * time.Hour), time.Time{}},
+		{"/overdue.html", now.AddDate(0, 0, -3), time.Time{}},
+	}
+	for _, l := range links {
+		var found interface{}
+		if !l.found.IsZero() {
+			found = l.found
+		}
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, found)
+							VALUES ('test.com', ?, '', ?, 'http', ?, 200, ?)`,
+			LinkBucket("", l.path), l.path, l.time, found).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert test link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	var ages []int
+	var due, overdue int
+	err := db.Query(`SELECT uncrawled_ages, refresh_due, refresh_overdue FROM domain_info WHERE dom = 'test.com'`).
+		Scan(&ages, &due, &overdue)
+	if err != nil {
+		t.Fatalf("Failed to read frontier counts: %v", err)
+	}
+	if expected := []int{1, 0, 1, 0, 1}; !reflect.DeepEqual(ages, expected) {
+		t.Errorf("uncrawled_ages mismatch: got %v, expected %v", ages, expected)
+	}
+	if due != 2 || overdue != 1 {
+		t.Errorf("Expected 2 links due for refresh and 1 overdue, got %d and %d", due, overdue)
 	}
 
+	// The link found without a time was stamped
+	var found time.Time
+	err = db.Query(`SELECT found FROM links WHERE dom = 'test.com' AND bucket = ? AND subdom = ''
+						AND path = '/new.html' AND proto = 'http' AND time = ?`,
+		LinkBucket("", "/new.html"), walker.NotYetCrawled).Scan(&found)
+	if err != nil {
+		t.Fatalf("Failed to read found time: %v", err)
+	}
+	if found.Before(now.Add(-time.Minute)) {
+		t.Errorf("Expected /new.html to be stamped as found at dispatch, got %v", found)
+	}
 }
 
 func TestDispatchPruning(t *testing.T) {
@@ -1118,7 +1526,7 @@ func TestDispatchPruning(t *testing.T) {
 	}
 
 	insertDomain := `INSERT INTO domain_info (dom, last_dispatch, last_empty_dispatch, dispatched) VALUES (?, ?, ?, false)`
-	insertLink := `INSERT INTO links (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`
+	insertLink := `INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`
 	for _, tst := range tests {
 		err := db.Query(insertDomain, tst.dom, tst.lastDispatch, tst.lastEmptyDispatch).Exec()
 		if err != nil {
@@ -1159,3 +1567,1389 @@ func TestDispatchPruning(t *testing.T) {
 	}
 
 }
+
+func TestDispatchDeferredOverQuota(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	today := quotaDay(time.Now())
+
+	tests := []struct {
+		dom        string
+		byteQuota  int64
+		quotaBytes int64
+		quotaDay   time.Time
+	}{
+		// should dispatch: under quota
+		{"a.com", 100, 50, today},
+
+		// should NOT dispatch: over quota today
+		{"b.com", 100, 150, today},
+
+		// should dispatch: over quota, but that was yesterday
+		{"c.com", 100, 150, today.AddDate(0, 0, -1)},
+
+		// should dispatch: negative quota means no quota
+		{"d.com", -1, 150, today},
+	}
+
+	insertDomain := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched, byte_quota, quota_bytes, quota_day)
+						VALUES (?, ?, ?, false, ?, ?, ?)`
+	insertLink := `INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`
+	for _, tst := range tests {
+		err := db.Query(insertDomain, tst.dom, gocql.UUID{}, 1, tst.byteQuota, tst.quotaBytes, tst.quotaDay).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+		err = db.Query(insertLink, tst.dom, "", "/page1.html", "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	itr := db.Query("SELECT dom FROM segments").Iter()
+	var domain string
+	got := map[string]bool{}
+	for itr.Scan(&domain) {
+		got[domain] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+
+	expected := map[string]bool{
+		"a.com": true,
+		"c.com": true,
+		"d.com": true,
+	}
+
+	for dom := range got {
+		if !expected[dom] {
+			t.Errorf("Didn't expect domain %q in segments table", dom)
+		}
+		delete(expected, dom)
+	}
+
+	for dom := range expected {
+		t.Errorf("Failed to find expected domain %q", dom)
+	}
+}
+
+func TestDispatchSkipsQuarantined(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	ds := getDS(t)
+	defer ds.Close()
+
+	insertDomain := `INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, 1, false)`
+	insertLink := `INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`
+	for _, dom := range []string{"dead.com", "expired.com", "alive.com"} {
+		if err := db.Query(insertDomain, dom, gocql.UUID{}).Exec(); err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+		err := db.Query(insertLink, dom, "", "/page1.html", "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+	ds.QuarantineHost("dead.com", time.Now().Add(time.Hour))
+	ds.QuarantineHost("expired.com", time.Now().Add(-time.Hour))
+
+	runDispatcher(t)
+
+	itr := db.Query("SELECT dom FROM segments").Iter()
+	var domain string
+	got := map[string]bool{}
+	for itr.Scan(&domain) {
+		got[domain] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	expected := map[string]bool{"expired.com": true, "alive.com": true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Dispatched %v, expected %v", got, expected)
+	}
+
+	dinfo, err := ds.FindDomain("dead.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if !dinfo.Quarantined() {
+		t.Errorf("Expected dead.com to show as quarantined, got %+v", dinfo)
+	}
+}
+
+func TestSubdomainStats(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLimit := walker.Config.Dispatcher.SubdomainStatsLimit
+	defer func() {
+		walker.Config.Dispatcher.SubdomainStatsLimit = origLimit
+	}()
+	walker.Config.Dispatcher.SubdomainStatsLimit = 1
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+
+	// www has the most links, broken the highest error rate, and the rest
+	// shouldn't be recorded
+	crawled := time.Now().AddDate(0, 0, -1)
+	links := []struct {
+		subdom string
+		path   string
+		crawl  time.Time
+		status int
+	}{
+		{"www", "/1.html", crawled, 200},
+		{"www", "/2.html", crawled, 404},
+		{"www", "/3.html", walker.NotYetCrawled, 0},
+		{"www", "/4.html", walker.NotYetCrawled, 0},
+		{"broken", "/1.html", crawled, 500},
+		{"broken", "/2.html", crawled, 500},
+		{"", "/1.html", crawled, 200},
+		{"", "/2.html", crawled, 200},
+		{"blog", "/1.html", walker.NotYetCrawled, 0},
+	}
+	for _, l := range links {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, stat) VALUES (?, 0, ?, ?, ?, ?, ?)`,
+			"test.com", l.subdom, l.path, "http", l.crawl, l.status).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	ds := getDS(t)
+	stats, err := ds.ListSubdomainStats("test.com")
+	if err != nil {
+		t.Fatalf("ListSubdomainStats failed: %v", err)
+	}
+	expected := []*SubdomainStats{
+		{Domain: "test.com", Subdomain: "www", NumberLinksTotal: 4, NumberLinksUncrawled: 2, NumberLinksFailed: 1},
+		{Domain: "test.com", Subdomain: "broken", NumberLinksTotal: 2, NumberLinksUncrawled: 0, NumberLinksFailed: 2},
+	}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Subdomain stats mismatch, got:")
+		for _, s := range stats {
+			t.Errorf("\t%+v", *s)
+		}
+	}
+	if len(stats) == 2 && stats[1].ErrorRate() != 1 {
+		t.Errorf("Expected error rate 1 for broken.test.com, got %v", stats[1].ErrorRate())
+	}
+}
+
+func TestDispatchBlocklisted(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLists := walker.Config.Blocklist.Lists
+	defer func() {
+		walker.Config.Blocklist.Lists = origLists
+	}()
+	walker.Config.Blocklist.Lists = []string{"test:blocked.com"}
+
+	for _, dom := range []string{"blocked.com", "allowed.com"} {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+							VALUES (?, ?, ?, false)`, dom, gocql.UUID{}, 1).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+		err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			dom, "", "/page.html", "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	itr := db.Query("SELECT dom FROM segments").Iter()
+	var dom string
+	var got []string
+	for itr.Scan(&dom) {
+		got = append(got, dom)
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, []string{"allowed.com"}) {
+		t.Errorf("Expected only allowed.com to be dispatched, got %v", got)
+	}
+}
+
+func TestDispatchRotatesUncrawled(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLimit := walker.Config.Dispatcher.MaxLinksPerSegment
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLimit
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	for _, path := range []string{"/a.html", "/b.html", "/c.html"} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			"test.com", "", path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	// Each dispatch should pick up where the last left off, wrapping around,
+	// even though none of the links were crawled in between
+	expected := [][]string{
+		{"/a.html", "/b.html"},
+		{"/a.html", "/c.html"},
+		{"/b.html", "/c.html"},
+	}
+	for i, exp := range expected {
+		runDispatcher(t)
+
+		itr := db.Query("SELECT path FROM segments WHERE dom = ?", "test.com").Iter()
+		var path string
+		var got []string
+		for itr.Scan(&path) {
+			got = append(got, path)
+		}
+		if err := itr.Close(); err != nil {
+			t.Fatalf("Failed to read segments: %v", err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("Dispatch %d: got segment %v, expected %v", i+1, got, exp)
+		}
+
+		err := db.Query(`DELETE FROM segments WHERE dom = ?`, "test.com").Exec()
+		if err != nil {
+			t.Fatalf("Failed to clear segments: %v", err)
+		}
+		err = db.Query(`UPDATE domain_info SET dispatched = false WHERE dom = ?`, "test.com").Exec()
+		if err != nil {
+			t.Fatalf("Failed to undispatch domain: %v", err)
+		}
+	}
+}
+
+func TestDispatchLinkBuckets(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLimit, origBuckets := walker.Config.Dispatcher.MaxLinksPerSegment, walker.Config.Cassandra.LinkBuckets
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLimit
+		walker.Config.Cassandra.LinkBuckets = origBuckets
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 3
+	walker.Config.Cassandra.LinkBuckets = 4
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	for _, path := range []string{"/a.html", "/b.html", "/c.html", "/d.html", "/e.html", "/f.html", "/g.html"} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?, ?)`,
+			"test.com", LinkBucket("", path), "", path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	// Though the links are spread over buckets, uncrawled links are still
+	// taken in order from where the last dispatch left off
+	expected := [][]string{
+		{"/a.html", "/b.html", "/c.html"},
+		{"/d.html", "/e.html", "/f.html"},
+		{"/a.html", "/b.html", "/g.html"},
+	}
+	for i, exp := range expected {
+		runDispatcher(t)
+
+		itr := db.Query("SELECT path FROM segments WHERE dom = ?", "test.com").Iter()
+		var path string
+		var got []string
+		for itr.Scan(&path) {
+			got = append(got, path)
+		}
+		if err := itr.Close(); err != nil {
+			t.Fatalf("Failed to read segments: %v", err)
+		}
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("Dispatch %d: got segment %v, expected %v", i+1, got, exp)
+		}
+
+		err := db.Query(`DELETE FROM segments WHERE dom = ?`, "test.com").Exec()
+		if err != nil {
+			t.Fatalf("Failed to clear segments: %v", err)
+		}
+		err = db.Query(`UPDATE domain_info SET dispatched = false WHERE dom = ?`, "test.com").Exec()
+		if err != nil {
+			t.Fatalf("Failed to undispatch domain: %v", err)
+		}
+	}
+
+	var total int
+	err = db.Query(`SELECT tot_links FROM domain_info WHERE dom = ?`, "test.com").Scan(&total)
+	if err != nil || total != 7 {
+		t.Errorf("Expected 7 links counted, got %v (%v)", total, err)
+	}
+}
+
+func TestDispatchSampling(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLimit := walker.Config.Dispatcher.MaxLinksPerSegment
+	origThreshold := walker.Config.Dispatcher.SamplingThreshold
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLimit
+		walker.Config.Dispatcher.SamplingThreshold = origThreshold
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 3
+	walker.Config.Dispatcher.SamplingThreshold = 10
+
+	// The domain had more links than the threshold at its last dispatch
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, tot_links)
+						VALUES (?, ?, ?, false, ?)`, "test.com", gocql.UUID{}, 1, 30).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	// Links sorting first all fall in one section of the site, so a normal
+	// dispatch would only take from /a
+	for _, section := range []string{"a", "b", "c"} {
+		for i := 0; i < 10; i++ {
+			err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+				"test.com", "", fmt.Sprintf("/%v/%d.html", section, i), "http", walker.NotYetCrawled).Exec()
+			if err != nil {
+				t.Fatalf("Failed to insert link: %v", err)
+			}
+		}
+	}
+
+	runDispatcher(t)
+
+	itr := db.Query("SELECT path FROM segments WHERE dom = ?", "test.com").Iter()
+	var path string
+	sections := map[string]bool{}
+	for itr.Scan(&path) {
+		sections[pathStratum(path)] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if len(sections) != 3 {
+		t.Errorf("Expected a link from each of 3 sections, got %v", sections)
+	}
+}
+
+func TestDispatchPaginationOrder(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLimit := walker.Config.Dispatcher.MaxLinksPerSegment
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLimit
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 3
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+
+	// Deep pages sort first by path, so they'd be dispatched first if we
+	// didn't account for the chain position
+	links := []struct {
+		path     string
+		chainPos int
+	}{
+		{"/a-list?page=400", 400},
+		{"/a-list?page=3", 3},
+		{"/a-list?page=2", 2},
+		{"/b-item.html", 0},
+	}
+	for _, l := range links {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, chain_pos) VALUES (?, 0, ?, ?, ?, ?, ?)`,
+			"test.com", "", l.path, "http", walker.NotYetCrawled, l.chainPos).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	itr := db.Query("SELECT path, chain_pos FROM segments WHERE dom = ?", "test.com").Iter()
+	var path string
+	var chainPos int
+	got := map[string]int{}
+	for itr.Scan(&path, &chainPos) {
+		got[path] = chainPos
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+
+	expected := map[string]int{
+		"/b-item.html":   0,
+		"/a-list?page=2": 2,
+		"/a-list?page=3": 3,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Segment mismatch, got %v, expected %v", got, expected)
+	}
+}
+
+func TestDispatchSegmentBatches(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origBatch := walker.Config.Dispatcher.SegmentBatchSize
+	defer func() {
+		walker.Config.Dispatcher.SegmentBatchSize = origBatch
+	}()
+	walker.Config.Dispatcher.SegmentBatchSize = 2
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			"test.com", "", fmt.Sprintf("/page%d.html", i), "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	var count int
+	if err := db.Query(`SELECT COUNT(*) FROM segments WHERE dom = ?`, "test.com").Scan(&count); err != nil {
+		t.Fatalf("Failed to count segment links: %v", err)
+	}
+	if count != 5 {
+		t.Errorf("Expected all 5 links in the segment when written 2 at a time, got %d", count)
+	}
+
+	var total, queued int
+	err = db.Query(`SELECT tot_links, queued_links FROM domain_info WHERE dom = ?`, "test.com").Scan(&total, &queued)
+	if err != nil {
+		t.Fatalf("Failed to read domain_info: %v", err)
+	}
+	if total != 5 || queued != 5 {
+		t.Errorf("Expected tot_links and queued_links of 5, got %d and %d", total, queued)
+	}
+}
+
+func TestDomainStatsChanged(t *testing.T) {
+	prev := domainStats{total: 10, uncrawled: 4, failed: 1, recent: 3}
+	cur := domainStats{total: 12, uncrawled: 4, failed: 1, recent: 2, queued: 6}
+
+	var names []string
+	for _, f := range cur.changed(prev) {
+		names = append(names, f.name)
+	}
+	expected := []string{"tot_links", "recent_links", "queued_links"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Changed columns mismatch, got %v, expected %v", names, expected)
+	}
+	if fields := prev.changed(prev); len(fields) != 0 {
+		t.Errorf("Expected no columns to change, got %v", fields)
+	}
+}
+
+func TestDispatchDomainTimeout(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origTimeout := walker.Config.Dispatcher.DomainTimeout
+	defer func() {
+		walker.Config.Dispatcher.DomainTimeout = origTimeout
+	}()
+	walker.Config.Dispatcher.DomainTimeout = "1ns"
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			"test.com", "", fmt.Sprintf("/page%d.html", i), "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	d := &Dispatcher{}
+	if err := d.oneShot(1); err != nil {
+		t.Fatalf("Failed to run dispatcher: %v", err)
+	}
+
+	var count int
+	if err := db.Query(`SELECT COUNT(*) FROM segments WHERE dom = ?`, "test.com").Scan(&count); err != nil {
+		t.Fatalf("Failed to count segment links: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no segment for a domain that timed out, got %d links", count)
+	}
+	if !d.skipping("test.com") {
+		t.Errorf("Expected test.com to be skipped after timing out")
+	}
+}
+
+func TestDispatcherSkipDomainBackoff(t *testing.T) {
+	d := &Dispatcher{
+		domainRetryInterval: time.Minute,
+		retries:             map[string]*domainRetry{},
+	}
+	for i := 1; i <= 7; i++ {
+		d.skipDomain("test.com")
+		expected := time.Minute * time.Duration(1<<uint(imin(i-1, 4)))
+		wait := d.retries["test.com"].after.Sub(time.Now())
+		if wait > expected || wait < expected-time.Second {
+			t.Errorf("Failure %d: expected to skip for %v, got %v", i, expected, wait)
+		}
+	}
+	if !d.skipping("test.com") || d.skipping("other.com") {
+		t.Errorf("Expected only test.com to be skipped")
+	}
+}
+
+func TestRecoverInterruptedDispatch(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	started := time.Now().Add(-time.Hour)
+
+	// finished.com got its whole segment written, but not marked dispatched
+	// partial.com only got one of its three segment links written
+	for _, dom := range []struct {
+		domain string
+		size   int
+	}{
+		{"finished.com", 2},
+		{"partial.com", 3},
+	} {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, dispatch_started,
+							dispatch_size) VALUES (?, ?, ?, false, ?, ?)`,
+			dom.domain, gocql.UUID{}, 1, started, dom.size).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+	}
+	segments := []struct{ domain, path string }{
+		{"finished.com", "/a.html"},
+		{"finished.com", "/b.html"},
+		{"partial.com", "/stale.html"},
+	}
+	for _, s := range segments {
+		err := db.Query(`INSERT INTO segments (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+			s.domain, "", s.path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert segment link: %v", err)
+		}
+	}
+	err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+		"partial.com", "", "/fresh.html", "http", walker.NotYetCrawled).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert link: %v", err)
+	}
+
+	runDispatcher(t)
+
+	for _, dom := range []string{"finished.com", "partial.com"} {
+		var dispatched bool
+		var journal time.Time
+		err := db.Query(`SELECT dispatched, dispatch_started FROM domain_info WHERE dom = ?`, dom).Scan(
+			&dispatched, &journal)
+		if err != nil {
+			t.Fatalf("Failed to read domain_info for %v: %v", dom, err)
+		}
+		if !dispatched {
+			t.Errorf("Expected %v to be dispatched", dom)
+		}
+		if !journal.IsZero() {
+			t.Errorf("Expected dispatch journal of %v to be cleared, got %v", dom, journal)
+		}
+	}
+
+	got := map[string]bool{}
+	itr := db.Query(`SELECT path FROM segments WHERE dom = ?`, "partial.com").Iter()
+	var path string
+	for itr.Scan(&path) {
+		got[path] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, map[string]bool{"/fresh.html": true}) {
+		t.Errorf("Expected the partial segment to be replaced by a new one, got %v", got)
+	}
+}
+
+func TestDispatchLeavesRecentJournal(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	// Another dispatcher started writing busy.com's segment a moment ago
+	started := time.Now()
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, dispatch_started,
+						dispatch_size) VALUES (?, ?, ?, false, ?, ?)`,
+		"busy.com", gocql.UUID{}, 1, started, 2).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	err = db.Query(`INSERT INTO segments (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+		"busy.com", "", "/a.html", "http", walker.NotYetCrawled).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert segment link: %v", err)
+	}
+	err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+		"busy.com", "", "/b.html", "http", walker.NotYetCrawled).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert link: %v", err)
+	}
+
+	runDispatcher(t)
+
+	var dispatched bool
+	var journal time.Time
+	err = db.Query(`SELECT dispatched, dispatch_started FROM domain_info WHERE dom = ?`, "busy.com").Scan(
+		&dispatched, &journal)
+	if err != nil {
+		t.Fatalf("Failed to read domain_info: %v", err)
+	}
+	if dispatched || journal.IsZero() {
+		t.Errorf("Expected the recent journal of busy.com to be left alone, got dispatched %v, journal %v",
+			dispatched, journal)
+	}
+
+	got := map[string]bool{}
+	itr := db.Query(`SELECT path FROM segments WHERE dom = ?`, "busy.com").Iter()
+	var path string
+	for itr.Scan(&path) {
+		got[path] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	if !reflect.DeepEqual(got, map[string]bool{"/a.html": true}) {
+		t.Errorf("Expected the segment being written to be left alone, got %v", got)
+	}
+}
+
+// probeTransport answers alias probes with the body it holds for the URL, and
+// a 404 for any other
+type probeTransport map[string]string
+
+func (pt probeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, ok := pt[req.URL.String()]
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusNotFound
+	}
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestDetectAliases(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origInterval := walker.Config.Dispatcher.AliasProbeInterval
+	defer func() {
+		walker.Config.Dispatcher.AliasProbeInterval = origInterval
+	}()
+	walker.Config.Dispatcher.AliasProbeInterval = "24h"
+
+	domains := []struct {
+		domain   string
+		priority int
+	}{
+		{"mirror.com", 1},
+		{"original.com", 5},
+		{"mirror2.com", 1},
+		{"different.com", 1},
+		{"elsewhere.com", 1},
+	}
+	for _, dom := range domains {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+							VALUES (?, ?, ?, false)`, dom.domain, gocql.UUID{}, dom.priority).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+		err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			dom.domain, "", "/page.html", "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	pages := probeTransport{}
+	for _, dom := range []string{"mirror.com", "original.com", "mirror2.com", "elsewhere.com"} {
+		pages["http://"+dom+"/"] = "<html>the same site</html>"
+		pages["http://"+dom+"/robots.txt"] = "User-agent: *\n"
+	}
+	pages["http://different.com/"] = "<html>a different site</html>"
+	pages["http://different.com/robots.txt"] = "User-agent: *\n"
+
+	d := &Dispatcher{
+		prober: &aliasProber{
+			paths:  []string{"/", "/robots.txt"},
+			client: &http.Client{Transport: pages},
+			lookupHost: func(host string) ([]string, error) {
+				if host == "elsewhere.com" {
+					return []string{"10.0.0.2"}, nil
+				}
+				return []string{"10.0.0.1"}, nil
+			},
+		},
+	}
+	if err := d.oneShot(1); err != nil {
+		t.Fatalf("Failed to run dispatcher: %v", err)
+	}
+
+	expected := map[string]string{
+		"mirror.com":    "original.com",
+		"mirror2.com":   "original.com",
+		"original.com":  "",
+		"different.com": "",
+		"elsewhere.com": "",
+	}
+	for dom, mirrorOf := range expected {
+		var got string
+		var dispatched bool
+		err := db.Query(`SELECT mirr_for, dispatched FROM domain_info WHERE dom = ?`, dom).Scan(&got, &dispatched)
+		if err != nil {
+			t.Fatalf("Failed to read domain_info of %v: %v", dom, err)
+		}
+		if got != mirrorOf {
+			t.Errorf("Expected %v to be an alias of %q, got %q", dom, mirrorOf, got)
+		}
+		if dispatched != (mirrorOf == "") {
+			t.Errorf("Expected %v dispatched to be %v", dom, mirrorOf == "")
+		}
+	}
+}
+
+func TestCanonicalAlias(t *testing.T) {
+	group := []*aliasCandidate{
+		{domain: "www-example.com", priority: 1},
+		{domain: "example.net", priority: 1},
+		{domain: "example.com", priority: 1},
+	}
+	if got := canonicalAlias(group); got.domain != "example.com" {
+		t.Errorf("Expected example.com to be canonical, got %v", got.domain)
+	}
+	group = append(group, &aliasCandidate{domain: "example-mirror.com", priority: 2})
+	if got := canonicalAlias(group); got.domain != "example-mirror.com" {
+		t.Errorf("Expected the highest priority domain to be canonical, got %v", got.domain)
+	}
+}
+
+func TestDispatchTrapEscape(t *testing.T) {
+	origMinLinks := walker.Config.Dispatcher.TrapMinLinks
+	defer func() {
+		walker.Config.Dispatcher.TrapMinLinks = origMinLinks
+	}()
+	walker.Config.Dispatcher.TrapMinLinks = 20
+
+	db := GetTestDB() // runs between tests to reset the db
+	ds := getDS(t)
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "test.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	paths := []string{"/a.html", "/b.html"}
+	for i := 0; i < 30; i++ {
+		paths = append(paths, fmt.Sprintf("/cal?day=%d&lang=en", i))
+	}
+	for _, path := range paths {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?, ?)`,
+			"test.com", LinkBucket("", path), "", path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+	segment := func() []string {
+		itr := db.Query("SELECT path FROM segments WHERE dom = ?", "test.com").Iter()
+		var path string
+		var got []string
+		for itr.Scan(&path) {
+			got = append(got, path)
+		}
+		if err := itr.Close(); err != nil {
+			t.Fatalf("Failed to read segments: %v", err)
+		}
+		err := db.Query(`DELETE FROM segments WHERE dom = ?`, "test.com").Exec()
+		if err != nil {
+			t.Fatalf("Failed to clear segments: %v", err)
+		}
+		err = db.Query(`UPDATE domain_info SET dispatched = false WHERE dom = ?`, "test.com").Exec()
+		if err != nil {
+			t.Fatalf("Failed to undispatch domain: %v", err)
+		}
+		return got
+	}
+
+	// The calendar is proposed for collapsing its day parameter, but until
+	// the rule is confirmed its links are still dispatched
+	runDispatcher(t)
+	if got := segment(); len(got) != len(paths) {
+		t.Errorf("Expected all %d links dispatched before confirmation, got %d", len(paths), len(got))
+	}
+	rules, err := ds.ListParamRules("test.com")
+	if err != nil {
+		t.Fatalf("Failed to list param rules: %v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("Expected 1 param rule, got %d", len(rules))
+	}
+	r := rules[0]
+	if r.Path != "/cal" || !reflect.DeepEqual(r.Params, []string{"day"}) || r.Status != ParamRuleProposed ||
+		r.Links != 30 {
+		t.Errorf("Unexpected param rule: %+v", r)
+	}
+
+	// Once confirmed, the calendar is dispatched collapsed
+	if err := ds.SetParamRuleStatus("test.com", "", "/cal", ParamRuleActive); err != nil {
+		t.Fatalf("Failed to confirm param rule: %v", err)
+	}
+	runDispatcher(t)
+	if got, expected := segment(), []string{"/a.html", "/b.html"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got segment %v, expected %v", got, expected)
+	}
+	runDispatcher(t)
+	if got, expected := segment(), []string{"/a.html", "/b.html", "/cal?lang=en"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got segment %v, expected %v", got, expected)
+	}
+
+	// New links on the calendar are stored collapsed
+	ds.StoreParsedURL(walker.MustParse("http://test.com/cal?day=99&lang=fr"), page1Fetch)
+	var count int
+	err = db.Query(`SELECT COUNT(*) FROM links WHERE dom = 'test.com' AND bucket = ? AND subdom = ''
+						AND path = '/cal?lang=fr'`, LinkBucket("", "/cal?lang=fr")).Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed to read collapsed link: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected the new calendar link to be stored collapsed")
+	}
+
+	if err := ds.SetParamRuleStatus("test.com", "", "/nowhere", ParamRuleActive); !walker.IsError(err, walker.ErrNotFound) {
+		t.Errorf("Expected setting a missing rule to fail with ErrNotFound, got %v", err)
+	}
+}
+
+func TestTrapDetector(t *testing.T) {
+	origMinLinks := walker.Config.Dispatcher.TrapMinLinks
+	defer func() {
+		walker.Config.Dispatcher.TrapMinLinks = origMinLinks
+	}()
+	walker.Config.Dispatcher.TrapMinLinks = 100
+
+	traps := newTrapDetector()
+	for i := 0; i < 150; i++ {
+		traps.add("www", fmt.Sprintf("/search?q=%d&page=%d&sort=asc", i, i%3))
+		if i%2 == 0 {
+			traps.add("www", fmt.Sprintf("/cal?m=%d&y=%d", i%12, i%5))
+		}
+	}
+	traps.add("www", "/about.html")
+	traps.add("", "/search?q=1")
+
+	rule := traps.detect("test.com", 227)
+	if rule == nil {
+		t.Fatal("Expected a trap to be detected")
+	}
+	if rule.Subdomain != "www" || rule.Path != "/search" || !reflect.DeepEqual(rule.Params, []string{"q"}) ||
+		rule.Links != 150 {
+		t.Errorf("Unexpected rule: %+v", rule)
+	}
+
+	// Without a dominant path there is no trap
+	if rule := traps.detect("test.com", 1000); rule != nil {
+		t.Errorf("Expected no trap among 1000 uncrawled links, got %+v", rule)
+	}
+
+	// A path of bounded parameters has them all collapsed
+	traps = newTrapDetector()
+	for i := 0; i < 150; i++ {
+		traps.add("", fmt.Sprintf("/cal?m=%d&y=%d", i%12, i%5))
+	}
+	if rule := traps.detect("test.com", 150); rule == nil || len(rule.Params) != 0 {
+		t.Errorf("Expected a rule collapsing all parameters, got %+v", rule)
+	}
+	if uri, ok := (&ParamRule{Path: "/cal"}).Collapse("/cal?m=1&y=2"); !ok || uri != "/cal" {
+		t.Errorf("Expected /cal?m=1&y=2 collapsed to /cal, got %q", uri)
+	}
+}
+
+func TestDispatcherRounds(t *testing.T) {
+	origOverdue := walker.Config.Webhooks.RoundOverdueTime
+	defer func() {
+		walker.Config.Webhooks.RoundOverdueTime = origOverdue
+	}()
+	walker.Config.Webhooks.RoundOverdueTime = "1h"
+
+	db := GetTestDB() // runs between tests to reset the db
+	ds := getDS(t)
+	d := &Dispatcher{db: db}
+	d.startRounds()
+	start := time.Now()
+	d.startRound(start)
+	d.roundGenerated("ok.com", nil)
+	d.roundGenerated("bad.com", fmt.Errorf("timed out"))
+	d.finishRound(nil)
+
+	statuses, err := ds.ListDispatchers()
+	if err != nil {
+		t.Fatalf("Failed to list dispatchers: %v", err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("Expected 1 dispatcher, got %d", len(statuses))
+	}
+	s := statuses[0]
+	if s.Token != d.token || s.Rounds != 1 || s.Domains != 2 || s.Error != "" {
+		t.Errorf("Unexpected dispatcher status: %+v", s)
+	}
+	if !reflect.DeepEqual(s.Failed, map[string]string{"bad.com": "timed out"}) {
+		t.Errorf("Expected bad.com to have failed, got %v", s.Failed)
+	}
+	if s.Started.Before(start.Add(-time.Second)) || s.Finished.Before(s.Started) {
+		t.Errorf("Expected the round to have started at %v and finished after, got %v and %v",
+			start, s.Started, s.Finished)
+	}
+	if s.Stalled(time.Now()) {
+		t.Error("Expected a dispatcher that just finished a round not to be stalled")
+	}
+	if !s.Stalled(time.Now().Add(2 * time.Hour)) {
+		t.Error("Expected a dispatcher that finished no round for 2h to be stalled")
+	}
+
+	// A round failing to read domain_info doesn't count as finished
+	d.startRound(time.Now())
+	d.finishRound(fmt.Errorf("read timeout"))
+	statuses, err = ds.ListDispatchers()
+	if err != nil {
+		t.Fatalf("Failed to list dispatchers: %v", err)
+	}
+	if s := statuses[0]; s.Rounds != 1 || s.Error != "read timeout" || !s.Finished.Before(s.Started) {
+		t.Errorf("Expected the failed round not to be finished, got %+v", s)
+	}
+
+	// A dispatcher stopped on purpose isn't listed
+	d.stopRounds()
+	statuses, err = ds.ListDispatchers()
+	if err != nil {
+		t.Fatalf("Failed to list dispatchers: %v", err)
+	}
+	if len(statuses) != 0 {
+		t.Errorf("Expected no dispatchers after stopping, got %d", len(statuses))
+	}
+}
+
+func TestPipelinedDispatch(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	ds := getDS(t)
+
+	origLimit := walker.Config.Dispatcher.MaxLinksPerSegment
+	origMax := walker.Config.Dispatcher.MaxOutstandingSegments
+	origMinPriority := walker.Config.Dispatcher.PipelineMinPriority
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLimit
+		walker.Config.Dispatcher.MaxOutstandingSegments = origMax
+		walker.Config.Dispatcher.PipelineMinPriority = origMinPriority
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+	walker.Config.Dispatcher.MaxOutstandingSegments = 2
+	walker.Config.Dispatcher.PipelineMinPriority = 5
+
+	// hot.com is pipelined for its priority, cold.com isn't
+	for dom, priority := range map[string]int{"hot.com": 5, "cold.com": 1} {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+							VALUES (?, ?, ?, false)`, dom, gocql.UUID{}, priority).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+		for _, path := range []string{"/a.html", "/b.html", "/c.html", "/d.html", "/e.html"} {
+			err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+				dom, "", path, "http", walker.NotYetCrawled).Exec()
+			if err != nil {
+				t.Fatalf("Failed to insert link: %v", err)
+			}
+		}
+	}
+
+	paths := func(table, dom string) []string {
+		itr := db.Query(fmt.Sprintf(`SELECT path FROM %v WHERE dom = ?`, table), dom).Iter()
+		var path string
+		var got []string
+		for itr.Scan(&path) {
+			got = append(got, path)
+		}
+		if err := itr.Close(); err != nil {
+			t.Fatalf("Failed to read %v: %v", table, err)
+		}
+		return got
+	}
+
+	// The second and third rounds generate one segment ahead for hot.com,
+	// leaving out the links of the current one
+	runDispatcher(t)
+	runDispatcher(t)
+	runDispatcher(t)
+	if got := paths("segments", "hot.com"); !reflect.DeepEqual(got, []string{"/a.html", "/b.html"}) {
+		t.Errorf("Expected hot.com's current segment [/a.html /b.html], got %v", got)
+	}
+	if got := paths("pending_segments", "hot.com"); !reflect.DeepEqual(got, []string{"/c.html", "/d.html"}) {
+		t.Errorf("Expected hot.com's pending segment [/c.html /d.html], got %v", got)
+	}
+	if got := paths("pending_segments", "cold.com"); len(got) != 0 {
+		t.Errorf("Expected no pending segment for cold.com, got %v", got)
+	}
+
+	// Finishing the current segment queues the pending one right away
+	ds.UnclaimHost("hot.com")
+	if got := paths("segments", "hot.com"); !reflect.DeepEqual(got, []string{"/c.html", "/d.html"}) {
+		t.Errorf("Expected the pending segment queued after unclaiming, got %v", got)
+	}
+	var dispatched bool
+	var queued int
+	err := db.Query(`SELECT dispatched, queued_links FROM domain_info WHERE dom = ?`, "hot.com").Scan(&dispatched, &queued)
+	if err != nil {
+		t.Fatalf("Failed to read domain_info: %v", err)
+	}
+	if !dispatched || queued != 2 {
+		t.Errorf("Expected hot.com dispatched with 2 links queued, got %v and %v", dispatched, queued)
+	}
+	if seqs, err := pendingSegmentSeqs(db, "hot.com"); err != nil || len(seqs) != 0 {
+		t.Errorf("Expected no pending segments left, got %v (%v)", seqs, err)
+	}
+
+	ds.UnclaimHost("cold.com")
+	if err := db.Query(`SELECT dispatched FROM domain_info WHERE dom = ?`, "cold.com").Scan(&dispatched); err != nil {
+		t.Fatalf("Failed to read domain_info: %v", err)
+	}
+	if dispatched {
+		t.Errorf("Expected cold.com undispatched after unclaiming")
+	}
+}
+
+func TestPipelineUnclaimRace(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	ds := getDS(t)
+
+	origLimit := walker.Config.Dispatcher.MaxLinksPerSegment
+	origMax := walker.Config.Dispatcher.MaxOutstandingSegments
+	origMinPriority := walker.Config.Dispatcher.PipelineMinPriority
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLimit
+		walker.Config.Dispatcher.MaxOutstandingSegments = origMax
+		walker.Config.Dispatcher.PipelineMinPriority = origMinPriority
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+	walker.Config.Dispatcher.MaxOutstandingSegments = 2
+	walker.Config.Dispatcher.PipelineMinPriority = 5
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, ?, false)`,
+		"hot.com", gocql.UUID{}, 5).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	for _, path := range []string{"/a.html", "/b.html", "/c.html", "/d.html"} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			"hot.com", "", path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+	runDispatcher(t)
+	runDispatcher(t)
+
+	// The fetcher unclaims hot.com while the dispatcher is still writing its
+	// pending segment, so there is nothing to promote yet and the domain is
+	// left undispatched; the pending segment is completed after
+	var size int
+	var generated time.Time
+	err = db.Query(`SELECT size, generated FROM pending_segment_sizes WHERE dom = ? AND seq = 1`,
+		"hot.com").Scan(&size, &generated)
+	if err != nil {
+		t.Fatalf("Failed to read pending segment: %v", err)
+	}
+	if err := db.Query(`DELETE FROM pending_segment_sizes WHERE dom = ?`, "hot.com").Exec(); err != nil {
+		t.Fatalf("Failed to delete pending segment size: %v", err)
+	}
+	ds.UnclaimHost("hot.com")
+	err = db.Query(`INSERT INTO pending_segment_sizes (dom, seq, size, generated) VALUES (?, 1, ?, ?)`,
+		"hot.com", size, generated).Exec()
+	if err != nil {
+		t.Fatalf("Failed to complete pending segment: %v", err)
+	}
+
+	// The next segment is generated from scratch, so the leftover pending
+	// segment must not be queued after it
+	runDispatcher(t)
+	if seqs, err := pendingSegmentSeqs(db, "hot.com"); err != nil || len(seqs) != 0 {
+		t.Errorf("Expected the leftover pending segment to be dropped, got %v (%v)", seqs, err)
+	}
+	var count int
+	if err := db.Query(`SELECT COUNT(*) FROM pending_segments WHERE dom = ?`, "hot.com").Scan(&count); err != nil {
+		t.Fatalf("Failed to count pending segment links: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected no pending segment links left, got %d", count)
+	}
+}
+
+func TestPipelineDepth(t *testing.T) {
+	origMax := walker.Config.Dispatcher.MaxOutstandingSegments
+	origMinPriority := walker.Config.Dispatcher.PipelineMinPriority
+	defer func() {
+		walker.Config.Dispatcher.MaxOutstandingSegments = origMax
+		walker.Config.Dispatcher.PipelineMinPriority = origMinPriority
+	}()
+	walker.Config.Dispatcher.MaxOutstandingSegments = 3
+	walker.Config.Dispatcher.PipelineMinPriority = 5
+
+	tests := []struct {
+		priority, maxSegments, depth int
+	}{
+		{1, 0, 0},
+		{5, 0, 2},
+		{1, 2, 1},
+		{10, 1, 0},
+	}
+	for _, test := range tests {
+		if depth := pipelineDepth(test.priority, test.maxSegments); depth != test.depth {
+			t.Errorf("Priority %v with max_segs %v: expected depth %v, got %v", test.priority, test.maxSegments,
+				test.depth, depth)
+		}
+	}
+}
+
+func TestDispatchMaxCrawlDepth(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	orig := walker.Config.Dispatcher.MaxCrawlDepth
+	defer func() { walker.Config.Dispatcher.MaxCrawlDepth = orig }()
+	walker.Config.Dispatcher.MaxCrawlDepth = 2
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, ?, false)`,
+		"deep.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	crawled := time.Now().AddDate(0, 0, -30)
+	for _, l := range []struct {
+		path  string
+		time  time.Time
+		depth interface{}
+	}{
+		{"/seed.html", walker.NotYetCrawled, 0},
+		{"/old.html", walker.NotYetCrawled, nil},
+		{"/two.html", walker.NotYetCrawled, 2},
+		{"/three.html", walker.NotYetCrawled, 3},
+		// Crawled at depth 1, since found again deeper
+		{"/shallow.html", walker.NotYetCrawled, 4},
+		{"/shallow.html", crawled, 1},
+	} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, depth) VALUES (?, 0, ?, ?, ?, ?, ?)`,
+			"deep.com", "", l.path, "http", l.time, l.depth).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	got := map[string]int{}
+	itr := db.Query(`SELECT path, depth FROM segments WHERE dom = ?`, "deep.com").Iter()
+	var path string
+	var depth int
+	for itr.Scan(&path, &depth) {
+		got[path] = depth
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	expected := map[string]int{"/seed.html": 0, "/old.html": 0, "/two.html": 2, "/shallow.html": 1}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected segment links (by depth) %v, got %v", expected, got)
+	}
+}
+
+func TestRediscoveredLinkDepth(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	ds := getDS(t)
+	defer ds.Close()
+
+	orig := walker.Config.Dispatcher.MaxCrawlDepth
+	defer func() { walker.Config.Dispatcher.MaxCrawlDepth = orig }()
+	walker.Config.Dispatcher.MaxCrawlDepth = 2
+
+	if err := ds.InsertLink("http://deep.com/seed.html", ""); err != nil {
+		t.Fatalf("Failed to insert seed: %v", err)
+	}
+	page := &walker.FetchResults{URL: walker.MustParse("http://deep.com/page.html"), FetchTime: time.Now()}
+	found := func(link string, depth int) {
+		u := walker.MustParse(link)
+		u.Depth = depth
+		ds.StoreParsedURL(u, page)
+	}
+	// A navigation link found near a seed, then on every page below it
+	found("http://deep.com/nav.html", 1)
+	found("http://deep.com/nav.html", 3)
+	// Seeds stay seeds when found again
+	found("http://deep.com/seed.html", 3)
+	// and links found before become seeds when seeded
+	found("http://deep.com/reseeded.html", 3)
+	if err := ds.InsertLink("http://deep.com/reseeded.html", ""); err != nil {
+		t.Fatalf("Failed to insert seed: %v", err)
+	}
+
+	runDispatcher(t)
+
+	got := map[string]int{}
+	itr := db.Query(`SELECT path, depth FROM segments WHERE dom = ?`, "deep.com").Iter()
+	var path string
+	var depth int
+	for itr.Scan(&path, &depth) {
+		got[path] = depth
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	expected := map[string]int{"/seed.html": 0, "/nav.html": 1, "/reseeded.html": 0}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected segment links (by depth) %v, got %v", expected, got)
+	}
+}
+
+func TestDispatchBurst(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLinks := walker.Config.Dispatcher.MaxLinksPerSegment
+	origMult := walker.Config.Dispatcher.BurstSegmentMultiplier
+	defer func() {
+		walker.Config.Dispatcher.MaxLinksPerSegment = origLinks
+		walker.Config.Dispatcher.BurstSegmentMultiplier = origMult
+	}()
+	walker.Config.Dispatcher.MaxLinksPerSegment = 2
+	walker.Config.Dispatcher.BurstSegmentMultiplier = 2
+
+	for _, dom := range []string{"burst.com", "done.com"} {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, burst_until)
+							VALUES (?, ?, ?, false, ?)`,
+			dom, gocql.UUID{}, 1, time.Now().Add(time.Hour)).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain: %v", err)
+		}
+	}
+	crawled := time.Now().AddDate(0, 0, -30)
+	for _, l := range []struct {
+		dom, path string
+		time      time.Time
+	}{
+		{"burst.com", "/a.html", walker.NotYetCrawled},
+		{"burst.com", "/b.html", walker.NotYetCrawled},
+		{"burst.com", "/c.html", walker.NotYetCrawled},
+		{"burst.com", "/crawled.html", crawled},
+		{"done.com", "/crawled.html", crawled},
+	} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+			l.dom, "", l.path, "http", l.time).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	// The burst segment is twice as large, with no refreshes
+	got := map[string]bool{}
+	itr := db.Query(`SELECT path FROM segments WHERE dom = ?`, "burst.com").Iter()
+	var path string
+	for itr.Scan(&path) {
+		got[path] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read segments: %v", err)
+	}
+	expected := map[string]bool{"/a.html": true, "/b.html": true, "/c.html": true}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected burst segment %v, got %v", expected, got)
+	}
+
+	// A domain with nothing left to crawl leaves burst mode
+	for dom, bursting := range map[string]bool{"burst.com": true, "done.com": false} {
+		var until time.Time
+		if err := db.Query(`SELECT burst_until FROM domain_info WHERE dom = ?`, dom).Scan(&until); err != nil {
+			t.Fatalf("Failed to read domain_info: %v", err)
+		}
+		if burstActive(until) != bursting {
+			t.Errorf("Expected %v to be bursting: %v, burst ends %v", dom, bursting, until)
+		}
+	}
+}
+
+func TestDispatchContentStats(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+
+	origLimit := walker.Config.Dispatcher.ContentStatsLimit
+	defer func() {
+		walker.Config.Dispatcher.ContentStatsLimit = origLimit
+	}()
+	walker.Config.Dispatcher.ContentStatsLimit = 2
+
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched)
+						VALUES (?, ?, ?, false)`, "composed.com", gocql.UUID{}, 1).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert domain: %v", err)
+	}
+	crawled := time.Now().AddDate(0, 0, -30)
+	for _, l := range []struct {
+		path, mime, fetchErr string
+		status               int
+		time                 time.Time
+	}{
+		{"/a.html", "text/html; charset=UTF-8", "", 200, crawled},
+		{"/b.html", "TEXT/HTML", "", 200, crawled},
+		{"/c.pdf", "application/pdf", "", 200, crawled},
+		{"/d.zip", "application/zip", "", 200, crawled},
+		{"/moved", "", "", 301, crawled},
+		{"/gone", "text/html", "", 404, crawled},
+		{"/timeout", "", "timed out", 0, crawled},
+		{"/new", "", "", 0, walker.NotYetCrawled},
+	} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time, mime, err, stat)
+							VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?)`,
+			"composed.com", "", l.path, "http", l.time, l.mime, l.fetchErr, l.status).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	runDispatcher(t)
+
+	var types, statuses map[string]int
+	err = db.Query(`SELECT type_counts, status_counts FROM domain_info WHERE dom = ?`,
+		"composed.com").Scan(&types, &statuses)
+	if err != nil {
+		t.Fatalf("Failed to read domain_info: %v", err)
+	}
+	expectedTypes := map[string]int{"text/html": 2, "application/pdf": 1, ContentOther: 1}
+	if !reflect.DeepEqual(types, expectedTypes) {
+		t.Errorf("Expected type counts %v, got %v", expectedTypes, types)
+	}
+	expectedStatuses := map[string]int{Status2xx: 4, Status3xx: 1, Status4xx: 1, StatusError: 1}
+	if !reflect.DeepEqual(statuses, expectedStatuses) {
+		t.Errorf("Expected status counts %v, got %v", expectedStatuses, statuses)
+	}
+}
@@ -0,0 +1,107 @@
+package cassandra
+
+import (
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// verifyDomainChecks runs the verification of new domains, a variable so tests
+// needn't go to the network
+var verifyDomainChecks = walker.VerifyDomain
+
+// verifyDomain returns the result of running the cassandra.verify_new_domains
+// checks on dom, cached, or nil if there are none
+func (ds *Datastore) verifyDomain(dom string) *walker.PreflightReport {
+	if ds.verified == nil {
+		return nil
+	}
+	if v, ok := ds.verified.Get(dom); ok {
+		return v.(*walker.PreflightReport)
+	}
+	v := verifyDomainChecks(dom, walker.Config.Cassandra.VerifyNewDomains, nil)
+	ds.verified.Add(dom, v)
+	return v
+}
+
+// admitDomain returns true if parsed links on dom are stored: dom is in
+// domain_info, or is added to it because cassandra.add_new_domains is set and
+// it isn't blocklisted and passes cassandra.verify_new_domains. If r isn't nil it is a dry run (see DryRunLinks):
+// why is recorded in r, and dom isn't added.
+func (ds *Datastore) admitDomain(dom string, r *walker.FilterReport) bool {
+	if ds.hasDomain(dom) {
+		r.Add(walker.FilterDomain, true, "%v is in domain_info", dom)
+		return true
+	}
+	if !walker.Config.Cassandra.AddNewDomains {
+		r.Add(walker.FilterDomain, false, "%v isn't in domain_info, and cassandra.add_new_domains is off", dom)
+		return false
+	}
+
+	var list string
+	if r != nil {
+		list = r.Blocklist
+	} else {
+		list = walker.DomainBlocklisted(dom)
+	}
+	if list != "" {
+		log4go.Fine("Not adding new domain %v, it is on blocklist %v", dom, list)
+		r.Add(walker.FilterDomain, false, "%v is new, but on blocklist %v so isn't added", dom, list)
+		return false
+	}
+
+	if v := ds.verifyDomain(dom); v != nil {
+		for _, c := range v.Checks {
+			if !c.Passed {
+				log4go.Fine("Not adding new domain %v, it failed verification %v: %v", dom, c.Name, c.Detail)
+				r.Add(walker.FilterDomain, false, "%v is new, but failed verification %v (%v) so isn't added",
+					dom, c.Name, c.Detail)
+				return false
+			}
+		}
+	}
+
+	if r != nil {
+		r.Add(walker.FilterDomain, true, "%v is new, and would be added (cassandra.add_new_domains)", dom)
+		return true
+	}
+	log4go.Debug("Adding new domain to system: %v", dom)
+	ds.addDomain(dom)
+	return true
+}
+
+// DryRunLinks is documented on the ModelDatastore interface.
+func (ds *Datastore) DryRunLinks(links []string) []*walker.FilterReport {
+	var reports []*walker.FilterReport
+	for _, link := range links {
+		r := walker.FilterLink(link)
+		reports = append(reports, r)
+		if !r.Stored {
+			continue
+		}
+
+		u, err := walker.ParseURL(r.URL)
+		if err != nil {
+			r.Add(walker.FilterDomain, false, "%v", err)
+			continue
+		}
+		dom, subdom, err := u.TLDPlusOneAndSubdomain()
+		if err != nil {
+			r.Add(walker.FilterDomain, false, "No domain: %v", err)
+			continue
+		}
+		if !ds.admitDomain(dom, r) {
+			continue
+		}
+
+		if ds.paramRules == nil {
+			continue
+		}
+		if c := ds.collapseTrapped(u, dom, subdom); c != u {
+			r.URL = c.String()
+			r.Add(walker.FilterParamRule, true, "An active rule for its path collapses it to %v", r.URL)
+		} else {
+			r.Add(walker.FilterParamRule, true, "No active rule collapses it")
+		}
+	}
+	return reports
+}
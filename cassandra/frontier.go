@@ -0,0 +1,210 @@
+package cassandra
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// The frontier is the work the crawl has in front of it: links not yet
+// crawled, and crawled links due to be refreshed. The dispatcher counts both
+// as it scans a domain's links, keeping them in domain_info like its other
+// counts: uncrawled_ages holds the uncrawled links by how long ago they were
+// found (links.found, over FrontierAgeBuckets), and refresh_due and
+// refresh_overdue the crawled links due for refresh. FrontierSnapshot sums
+// them by domain priority.
+
+// FrontierAgeBuckets are the upper bounds of the discovery age buckets
+// uncrawled links are counted in; links found longer ago than the last bound
+// have a bucket of their own
+var FrontierAgeBuckets = []time.Duration{
+	time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+	30 * 24 * time.Hour,
+}
+
+// frontierAgeBucket returns the discovery age bucket of a link found at found
+func frontierAgeBucket(found, now time.Time) int {
+	age := now.Sub(found)
+	for i, b := range FrontierAgeBuckets {
+		if age <= b {
+			return i
+		}
+	}
+	return len(FrontierAgeBuckets)
+}
+
+// FrontierAgeLabels returns a short label for each discovery age bucket, ex.
+// "<= 1h", "<= 1d", "> 30d"
+func FrontierAgeLabels() []string {
+	format := func(d time.Duration) string {
+		if d%(24*time.Hour) == 0 {
+			return fmt.Sprintf("%dd", d/(24*time.Hour))
+		} else if d%time.Hour == 0 {
+			return fmt.Sprintf("%dh", d/time.Hour)
+		}
+		return d.String()
+	}
+	var labels []string
+	for _, b := range FrontierAgeBuckets {
+		labels = append(labels, "<= "+format(b))
+	}
+	return append(labels, "> "+format(FrontierAgeBuckets[len(FrontierAgeBuckets)-1]))
+}
+
+// frontierStats holds the frontier counts the dispatcher keeps in domain_info
+type frontierStats struct {
+	ages                    []int
+	refreshDue, refreshOver int
+}
+
+func newFrontierStats() frontierStats {
+	return frontierStats{ages: make([]int, len(FrontierAgeBuckets)+1)}
+}
+
+// changed returns the domain_info columns of s that differ from prev
+func (s frontierStats) changed(prev frontierStats) []dbfield {
+	var fields []dbfield
+	if !reflect.DeepEqual(s.ages, prev.ages) {
+		fields = append(fields, dbfield{"uncrawled_ages", s.ages})
+	}
+	if s.refreshDue != prev.refreshDue {
+		fields = append(fields, dbfield{"refresh_due", s.refreshDue})
+	}
+	if s.refreshOver != prev.refreshOver {
+		fields = append(fields, dbfield{"refresh_overdue", s.refreshOver})
+	}
+	return fields
+}
+
+// stampFound sets links.found to now on the not-yet-crawled rows of cells,
+// links of domain the dispatcher saw for the first time, so their discovery
+// age can be told on later dispatches
+func (d *Dispatcher) stampFound(domain string, cells []cell, now time.Time) {
+	batch := d.db.NewBatch(gocql.UnloggedBatch)
+	flush := func() {
+		if batch.Size() == 0 {
+			return
+		}
+		if err := d.db.ExecuteBatch(batch); err != nil {
+			log4go.Error("Failed to stamp %v new links of %v as found: %v", batch.Size(), domain, err)
+		}
+		batch = d.db.NewBatch(gocql.UnloggedBatch)
+	}
+	for _, c := range cells {
+		batch.Query(`UPDATE links SET found = ?
+					WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+			now, domain, LinkBucket(c.subdom, c.path), c.subdom, c.path, c.proto, walker.NotYetCrawled)
+		if batch.Size() >= walker.Config.Dispatcher.SegmentBatchSize {
+			flush()
+		}
+	}
+	flush()
+}
+
+// FrontierCounts are the frontier counts of a set of domains, as of each
+// domain's last dispatch
+type FrontierCounts struct {
+	// Number of domains counted
+	Domains int
+
+	// Number of links not yet crawled, and how many of them were found in
+	// each bucket of FrontierAgeBuckets (and the one beyond it)
+	Uncrawled int
+	Ages      []int
+
+	// Number of crawled links due for refresh (last crawled longer than
+	// dispatcher.min_link_refresh_time ago, and past their declared cache
+	// lifetime), and how many of them were last crawled more than twice that
+	// long ago, so should have been refreshed by now
+	RefreshDue     int
+	RefreshOverdue int
+}
+
+func (c *FrontierCounts) add(uncrawled int, ages []int, due, overdue int) {
+	if c.Ages == nil {
+		c.Ages = make([]int, len(FrontierAgeBuckets)+1)
+	}
+	c.Domains++
+	c.Uncrawled += uncrawled
+	for i := 0; i < len(ages) && i < len(c.Ages); i++ {
+		c.Ages[i] += ages[i]
+	}
+	c.RefreshDue += due
+	c.RefreshOverdue += overdue
+}
+
+// FallingBehind returns true if links are waiting longer to be refreshed than
+// they should: some are overdue
+func (c *FrontierCounts) FallingBehind() bool {
+	return c.RefreshOverdue > 0
+}
+
+// FrontierPriority is the FrontierCounts of the domains of one priority
+type FrontierPriority struct {
+	Priority int
+	FrontierCounts
+}
+
+// Frontier is the outcome of FrontierSnapshot
+type Frontier struct {
+	// dispatcher.min_link_refresh_time, which refresh counts are relative to
+	MinLinkRefreshTime time.Duration
+
+	// The counts of all domains not excluded from the crawl
+	Total FrontierCounts
+
+	// The counts of each domain priority, highest priority first
+	Priorities []*FrontierPriority
+}
+
+// FrontierSnapshot is documented on the ModelDatastore interface.
+func (ds *Datastore) FrontierSnapshot() (*Frontier, error) {
+	minRefresh, err := time.ParseDuration(walker.Config.Dispatcher.MinLinkRefreshTime)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	f := &Frontier{MinLinkRefreshTime: minRefresh}
+	f.Total.Ages = make([]int, len(FrontierAgeBuckets)+1)
+
+	priorities := map[int]*FrontierPriority{}
+	var priority, uncrawled, due, overdue int
+	var excluded bool
+	var ages []int
+	itr := ds.db.Query(`SELECT priority, excluded, uncrawled_links, uncrawled_ages, refresh_due, refresh_overdue
+						FROM domain_info`).Iter()
+	for itr.Scan(&priority, &excluded, &uncrawled, &ages, &due, &overdue) {
+		if excluded {
+			continue
+		}
+		p := priorities[priority]
+		if p == nil {
+			p = &FrontierPriority{Priority: priority}
+			priorities[priority] = p
+		}
+		p.add(uncrawled, ages, due, overdue)
+		f.Total.add(uncrawled, ages, due, overdue)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read frontier counts: %v", err)
+	}
+
+	for _, p := range priorities {
+		f.Priorities = append(f.Priorities, p)
+	}
+	sort.Sort(byPriorityDesc(f.Priorities))
+	return f, nil
+}
+
+// byPriorityDesc sorts frontier counts by descending priority
+type byPriorityDesc []*FrontierPriority
+
+func (s byPriorityDesc) Len() int           { return len(s) }
+func (s byPriorityDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPriorityDesc) Less(i, j int) bool { return s[i].Priority > s[j].Priority }
@@ -0,0 +1,196 @@
+package cassandra
+
+import (
+	"fmt"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// Fsck checks the crawl's scheduling state for inconsistencies that can be
+// left behind when fetchers or dispatchers die part way through an update, or
+// when links are deleted out from under a segment. It is safe to run against
+// a live crawl, though a domain claimed or unclaimed while Fsck runs may be
+// reported (and repaired) needlessly; this does no harm beyond the domain
+// being dispatched again.
+
+// The kinds of problem Fsck finds
+const (
+	// A domain marked dispatched, and not claimed, with no segment links. It
+	// would never be claimed (there is nothing to crawl) nor dispatched again.
+	// Repaired by marking it undispatched.
+	FsckEmptySegment = "empty_segment"
+
+	// A domain claimed by a fetcher that no longer has a heartbeat in
+	// active_fetchers. Repaired the way the dispatcher cleans up after dead
+	// fetchers: the segment is deleted and the domain unclaimed and marked
+	// undispatched.
+	FsckExpiredClaim = "expired_claim"
+
+	// A segment link with no row in the links table. Repaired by deleting it
+	// from the segment.
+	FsckMissingLink = "missing_link"
+)
+
+// FsckProblem is an inconsistency found by Fsck
+type FsckProblem struct {
+	// One of the Fsck* constants above
+	Kind string
+
+	Domain string
+
+	// The segment link, for FsckMissingLink problems
+	Link string
+
+	// True if the problem was repaired. If repairing it was attempted but
+	// failed, Error says why.
+	Repaired bool
+	Error    string
+}
+
+// FsckReport is the outcome of Fsck
+type FsckReport struct {
+	// Numbers of domains and segment links checked
+	Domains      int
+	SegmentLinks int
+
+	Problems []*FsckProblem
+}
+
+// Repaired returns the number of problems repaired
+func (r *FsckReport) Repaired() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// fsckDomain is the domain_info state Fsck checks
+type fsckDomain struct {
+	dom        string
+	dispatched bool
+	claimTok   gocql.UUID
+}
+
+// Fsck is documented on the ModelDatastore interface.
+func (ds *Datastore) Fsck(repair bool) (*FsckReport, error) {
+	active := map[gocql.UUID]bool{}
+	var tok gocql.UUID
+	itr := ds.db.Query(`SELECT tok FROM active_fetchers`).Iter()
+	for itr.Scan(&tok) {
+		active[tok] = true
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read active_fetchers: %v", err)
+	}
+
+	var domains []fsckDomain
+	itr = ds.db.Query(`SELECT dom, dispatched, claim_tok FROM domain_info`).Iter()
+	for {
+		var d fsckDomain
+		if !itr.Scan(&d.dom, &d.dispatched, &d.claimTok) {
+			break
+		}
+		domains = append(domains, d)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read domain_info: %v", err)
+	}
+
+	r := &FsckReport{}
+	for _, d := range domains {
+		r.Domains++
+		if err := ds.fsckDomain(r, d, active, repair); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// fsckDomain checks one domain, adding its problems to r
+func (ds *Datastore) fsckDomain(r *FsckReport, d fsckDomain, active map[gocql.UUID]bool, repair bool) error {
+	claimed := d.claimTok != gocql.UUID{}
+	if claimed && !active[d.claimTok] {
+		p := &FsckProblem{Kind: FsckExpiredClaim, Domain: d.dom}
+		r.Problems = append(r.Problems, p)
+		if repair {
+			ds.fsckRepair(p, `DELETE FROM segments WHERE dom = ?`, d.dom)
+			if p.Error == "" {
+				ds.fsckRepair(p, `UPDATE domain_info
+									SET claim_tok = 00000000-0000-0000-0000-000000000000,
+										dispatched = false
+									WHERE dom = ?`, d.dom)
+			}
+		}
+		return nil
+	}
+
+	type segmentLink struct {
+		subdom, path, proto string
+	}
+	var links []segmentLink
+	itr := ds.db.Query(`SELECT subdom, path, proto FROM segments WHERE dom = ?`, d.dom).Iter()
+	for {
+		var l segmentLink
+		if !itr.Scan(&l.subdom, &l.path, &l.proto) {
+			break
+		}
+		links = append(links, l)
+	}
+	if err := itr.Close(); err != nil {
+		return fmt.Errorf("Failed to read segment of %v: %v", d.dom, err)
+	}
+
+	remaining := len(links)
+	for _, l := range links {
+		r.SegmentLinks++
+		var found string
+		err := ds.db.Query(`SELECT dom FROM links
+								WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ? LIMIT 1`,
+			d.dom, LinkBucket(l.subdom, l.path), l.subdom, l.path, l.proto).Scan(&found)
+		if err == nil {
+			continue
+		} else if err != gocql.ErrNotFound {
+			return fmt.Errorf("Failed to look up segment link of %v: %v", d.dom, err)
+		}
+
+		p := &FsckProblem{Kind: FsckMissingLink, Domain: d.dom}
+		if u, err := walker.CreateURL(d.dom, l.subdom, l.path, l.proto, walker.NotYetCrawled); err == nil {
+			p.Link = u.String()
+		} else {
+			p.Link = fmt.Sprintf("%v://%v %v", l.proto, l.subdom, l.path)
+		}
+		r.Problems = append(r.Problems, p)
+		if repair {
+			ds.fsckRepair(p, `DELETE FROM segments WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+				d.dom, l.subdom, l.path, l.proto)
+			if p.Repaired {
+				remaining--
+			}
+		}
+	}
+
+	if d.dispatched && !claimed && remaining == 0 {
+		p := &FsckProblem{Kind: FsckEmptySegment, Domain: d.dom}
+		r.Problems = append(r.Problems, p)
+		if repair {
+			ds.fsckRepair(p, `UPDATE domain_info SET dispatched = false, queued_links = 0 WHERE dom = ?`, d.dom)
+		}
+	}
+	return nil
+}
+
+// fsckRepair runs a query repairing p, recording whether it worked
+func (ds *Datastore) fsckRepair(p *FsckProblem, query string, args ...interface{}) {
+	if err := ds.db.Query(query, args...).Exec(); err != nil {
+		log4go.Error("Failed to repair %v of %v: %v", p.Kind, p.Domain, err)
+		p.Repaired = false
+		p.Error = err.Error()
+		return
+	}
+	p.Repaired = true
+}
@@ -31,6 +31,12 @@ func GetConfig() *gocql.ClusterConfig {
 	config.DiscoverHosts = walker.Config.Cassandra.DiscoverHosts
 	config.MaxPreparedStmts = walker.Config.Cassandra.MaxPreparedStmts
 	config.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: walker.Config.Cassandra.NumQueryRetries}
+	if walker.Config.Cassandra.Username != "" {
+		config.Authenticator = gocql.PasswordAuthenticator{
+			Username: walker.Config.Cassandra.Username,
+			Password: walker.Config.Cassandra.Password,
+		}
+	}
 	return config
 }
 
@@ -102,6 +108,10 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- top-level domain plus one component, ex. "google.com"
 	dom text,
 
+	-- the partition of the domain's links this link is kept in, a hash of
+	-- subdom and path (see cassandra.link_buckets)
+	bucket int,
+
 	-- subdomain, ex. "www" (does not include .)
 	subdom text,
 
@@ -124,10 +134,22 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- (null implies we were not excluded)
 	robot_ex boolean,
 
+	-- true if this link was not fetched because the domain's sitemap said it
+	-- hasn't changed since it was last crawled (see fetcher.sitemap_trust)
+	sitemap_fresh boolean,
+
+	-- true if this link was not fetched because its file extension is denied
+	-- (see fetcher.deny_extensions)
+	ext_denied boolean,
+
 	-- If this link redirects to another link target, the target link is stored
 	-- in this field
 	redto_url text,
 
+	-- the status the link redirected with (ex. 301), null if it didn't
+	-- redirect. See dispatcher.redirect_confirmations.
+	redto_stat int,
+
 	-- getnow is true if this link should be queued ASAP to be crawled
 	getnow boolean,
 
@@ -137,12 +159,104 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- fnv fingerprint, a hash of the page contents for identity comparison
 	fnv bigint,
 
+	-- size of the fetched content in bytes
+	size bigint,
+
 	-- body stores the content for this link (if cassandra.store_response_body is true)
 	body text,
 
 	-- headers stores the http headers for this link (if cassandra.store_response_headers is true)
 	headers MAP<text,text>,
 
+	-- AMP, mobile and canonical versions of this page, as declared by its
+	-- <link> tags (null if not declared)
+	amp_url text,
+	mobile_url text,
+	canon_url text,
+
+	-- position of this link in a rel=next pagination chain, 1 being the first
+	-- page (null if not part of a chain)
+	chain_pos int,
+
+	-- how many links away from a seed this link was found, 0 for seeds (null
+	-- if not known, as for seeds). See dispatcher.max_crawl_depth.
+	depth int,
+
+	-- true if the page was marked noindex or nofollow by its robots <meta>
+	-- tag (null implies not marked)
+	noindex boolean,
+	nofollow boolean,
+
+	-- usage directives from the page's robots <meta> tag or X-Robots-Tag
+	-- header (null implies not set)
+	noai boolean,
+	noimageai boolean,
+	nosnippet boolean,
+	max_snippet int,
+
+	-- image metadata (see fetcher.extract_image_metadata): format (ex.
+	-- "jpeg"), dimensions in pixels, EXIF camera maker and model, and EXIF GPS
+	-- position in decimal degrees (null if not an image or not present)
+	img_format text,
+	img_width int,
+	img_height int,
+	exif_make text,
+	exif_model text,
+	gps_lat double,
+	gps_lon double,
+
+	-- why the page couldn't be parsed for links (ex. it took longer than
+	-- fetcher.parse_timeout), null if it was parsed or isn't parsed
+	parse_err text,
+
+	-- cache lifetime declared by the response: its Cache-Control max-age in
+	-- seconds or else its Expires time (null if not declared). The dispatcher
+	-- won't refresh the link before it is up; see
+	-- dispatcher.max_refresh_interval
+	cache_max_age int,
+	expires timestamp,
+
+	-- how often the publisher says the page changes, in seconds: its
+	-- revisit-after <meta> or sitemap changefreq (null if not given, or
+	-- fetcher.refresh_hints is off). The dispatcher refreshes the link at
+	-- this interval if no cache lifetime was declared.
+	refresh_hint int,
+
+	-- the domains (TLD+1) other than its own this page linked to, and how
+	-- many of its links went to each (see
+	-- walker.FetchResults.OutlinkDomains); null if it linked to none
+	outlink_doms map<text, int>,
+
+	-- the node (see walker.NodeID) that fetched this link
+	node text,
+
+	-- the <lastmod> and <priority> of the link's entry in its host's
+	-- sitemap, when it was found there (see fetcher.sitemap_discovery);
+	-- null if not given. Only set on uncrawled rows.
+	sitemap_lastmod timestamp,
+	sitemap_prio double,
+
+	-- the earliest time this link may be dispatched, set from a Retry-After
+	-- header (see fetcher.honor_retry_after), by a handler or through the
+	-- API (null if there is no constraint). The dispatcher holds the link out
+	-- of segments until then, even if it is marked getnow.
+	crawl_at timestamp,
+
+	-- the error the handler returned if it failed to handle the response
+	-- (see walker.HandlerV2), null if it handled it. A handler asking for a
+	-- retry also sets getnow, and crawl_at to when it may be retried.
+	handler_err text,
+
+	-- true if the document was too large to fetch whole, so only its first
+	-- fetcher.range_fetch_bytes were fetched; size, fnv and body are of just
+	-- that part
+	partial boolean,
+
+	-- when the dispatcher first saw this link uncrawled, roughly when it was
+	-- found; only set on the not-yet-crawled row. Links found before this
+	-- column existed are stamped at their next dispatch.
+	found timestamp,
+
 	---- Items yet to be added to walker
 
 	-- structure fingerprint, a hash of the page structure only (defined as:
@@ -160,7 +274,7 @@ CREATE TABLE {{.Keyspace}}.links (
 	-- encoding of the text, ex. "utf8"
 	--encoding text,
 
-	PRIMARY KEY (dom, subdom, path, proto, time)
+	PRIMARY KEY ((dom, bucket), subdom, path, proto, time)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' }
 	AND caching = 'NONE';
 
@@ -175,6 +289,16 @@ CREATE TABLE {{.Keyspace}}.segments (
 	-- time this link was last crawled, so that we can use if-modified-since headers
 	time timestamp,
 
+	-- position in a pagination chain, copied from links.chain_pos
+	chain_pos int,
+
+	-- the link's depth, copied from links.depth
+	depth int,
+
+	-- the fnv of the link's last crawl, copied from links.fnv (see
+	-- fetcher.skip_unchanged_pages)
+	fnv bigint,
+
 	PRIMARY KEY (dom, subdom, path, proto)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' }
 	AND caching = 'NONE'
@@ -188,6 +312,37 @@ CREATE TABLE {{.Keyspace}}.segments (
 	-- extra factor of D*G in query time
 	AND gc_grace_seconds = 0;
 
+-- pending_segments holds the segments the dispatcher generated ahead for a
+-- domain while its current segment is being crawled (see
+-- dispatcher.max_outstanding_segments), numbered by seq. When the current
+-- segment is finished the lowest numbered one is moved into segments, so the
+-- domain can be claimed again right away. A pending segment is only complete
+-- once its pending_segment_sizes row is written.
+CREATE TABLE {{.Keyspace}}.pending_segments (
+	dom text,
+	seq int,
+	subdom text,
+	path text,
+	proto text,
+	time timestamp,
+	chain_pos int,
+	depth int,
+	fnv bigint,
+	PRIMARY KEY (dom, seq, subdom, path, proto)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' }
+	AND caching = 'NONE'
+	AND gc_grace_seconds = 0;
+
+-- pending_segment_sizes lists the complete pending segments of each domain,
+-- with how many links they hold and when they were generated
+CREATE TABLE {{.Keyspace}}.pending_segment_sizes (
+	dom text,
+	seq int,
+	size int,
+	generated timestamp,
+	PRIMARY KEY (dom, seq)
+) WITH gc_grace_seconds = 0;
+
 CREATE TABLE {{.Keyspace}}.domain_info (
 	dom text,
 
@@ -208,6 +363,11 @@ CREATE TABLE {{.Keyspace}}.domain_info (
 	-- stopped abnormally)
 	claim_time timestamp, -- define as last time crawled?
 
+	-- The node (see walker.NodeID) that last claimed this domain; like
+	-- claim_time it remains set after the domain is unclaimed. Used by the
+	-- affinity claim strategy.
+	claim_node text,
+
 	-- true if this domain has had a segment generated and is ready for crawling
 	dispatched boolean,
 
@@ -228,6 +388,40 @@ CREATE TABLE {{.Keyspace}}.domain_info (
 	-- domain. See NOTE over tot_links above.
 	queued_links int,
 
+	-- How many crawled links failed (an error or a status of 400 or more) on
+	-- their last fetch. See NOTE over tot_links above.
+	error_links int,
+
+	-- How many crawled links were fetched fine but couldn't be parsed for links
+	-- (see links.parse_err) on their last fetch. See NOTE over tot_links above.
+	parse_error_links int,
+
+	-- Coverage losses: how many links were never fetched because robots.txt
+	-- excludes them (see links.robot_ex), and how many crawled pages were
+	-- marked noindex or nofollow (see links.noindex and links.nofollow) on
+	-- their last fetch. See NOTE over tot_links above.
+	robots_excluded_links int,
+	noindex_links int,
+	nofollow_links int,
+
+	-- The (subdom, path, proto) of the last uncrawled link the dispatcher
+	-- queued for this domain, joined by NUL characters. The next dispatch
+	-- starts taking uncrawled links after it, so every uncrawled link gets its
+	-- turn.
+	uncrawled_cursor text,
+
+	-- How many links were crawled in the day (cassandra.FetchRateWindow) before
+	-- the last dispatch; the domain's fetch rate. See NOTE over tot_links above.
+	recent_links int,
+
+	-- The frontier (see cassandra.FrontierSnapshot): how many uncrawled links
+	-- were found in each bucket of cassandra.FrontierAgeBuckets, how many
+	-- crawled links are due for refresh, and how many of those are overdue
+	-- (last crawled over twice their refresh interval ago). See NOTE over
+	-- tot_links above.
+	uncrawled_ages list<int>,
+	refresh_due int,
+	refresh_overdue int,
 
 	-- The last time this domain was dispatched
 	last_dispatch timestamp,
@@ -235,10 +429,92 @@ CREATE TABLE {{.Keyspace}}.domain_info (
 	-- The last time the dispatcher saw that this domain had no links to dispatch
 	last_empty_dispatch timestamp,
 
-	---- Items yet to be added to walker
-
-	-- If not null, identifies another domain as a mirror of this one
-	--mirr_for text,
+	-- The number of bytes that may be downloaded from this domain per day. Null
+	-- or 0 means cassandra.default_daily_byte_quota is used, and a negative
+	-- value means this domain has no quota.
+	byte_quota bigint,
+
+	-- The number of bytes downloaded from this domain on quota_day
+	quota_bytes bigint,
+
+	-- The (UTC) day quota_bytes was counted for
+	quota_day timestamp,
+
+	-- The last time a robots.txt of this domain was seen to change (see the
+	-- robots_txt table), and how many previously crawled links the change
+	-- blocked. A non-zero robots_blocked flags the domain in the console.
+	robots_changed timestamp,
+	robots_blocked int,
+
+	-- The last time a control file of this domain (a robots.txt or sitemap)
+	-- was over its size limit (fetcher.max_robots_bytes or
+	-- fetcher.max_sitemap_bytes), and its URL
+	over_limit timestamp,
+	over_limit_link text,
+
+	-- Crawl delay in milliseconds set by an operator (ex. as agreed with the
+	-- site owner). If non-zero it overrides both the robots.txt Crawl-delay
+	-- and fetcher.default_crawl_delay, and is not limited by
+	-- fetcher.max_crawl_delay.
+	crawl_delay int,
+
+	-- The crawl scope set by an operator for this domain: which of the links
+	-- found on its pages are stored (see walker.CrawlScope). scope is the mode
+	-- (null is walker.ScopeAll), scope_subdoms the subdomains kept with
+	-- walker.ScopeSubdomains and scope_pattern the regular expression of
+	-- walker.ScopeCustom.
+	scope text,
+	scope_subdoms list<text>,
+	scope_pattern text,
+
+	-- The most segments of this domain that may be outstanding at once (the
+	-- one being crawled and those generated ahead in pending_segments), set
+	-- by an operator. Null or 0 follows dispatcher.max_outstanding_segments.
+	max_segs int,
+
+	-- The dispatcher's journal of the segment it is writing for this domain:
+	-- when it started writing it and how many links it holds. Both are set
+	-- before the first segment link is written and cleared when the domain is
+	-- marked dispatched, so if they are set on a domain that isn't dispatched
+	-- the dispatcher was interrupted part way through (see
+	-- Dispatcher.recoverInterrupted).
+	dispatch_started timestamp,
+	dispatch_size int,
+
+	-- Host alias detection (see dispatcher.alias_probe_interval): the
+	-- addresses the domain resolved to and the fingerprints of its probe
+	-- paths when it was last probed, and when that was. Domains with the same
+	-- probe_key are aliases of one another.
+	probe_key text,
+	probe_time timestamp,
+
+	-- If not null, the canonical domain this domain is an alias (mirror) of;
+	-- the dispatcher doesn't dispatch it unless dispatcher.crawl_aliases is set
+	mirr_for text,
+
+	-- The end of the domain's bootstrap boost (see
+	-- dispatcher.new_domain_boost_period): until then it is claimed with a
+	-- higher priority and gets larger segments. Null if it was never boosted.
+	boost_until timestamp,
+
+	-- The end of the domain's burst mode, set by an operator for a full
+	-- snapshot of it (see dispatcher.burst_segment_multiplier): until then,
+	-- or until it has no uncrawled links left, it gets larger segments of
+	-- uncrawled links and is crawled at fetcher.burst_crawl_delay. Null if it
+	-- isn't in burst mode.
+	burst_until timestamp,
+
+	-- The domain's composition as of its last complete dispatch (see
+	-- dispatcher.content_stats_limit): its 2xx pages by Content-Type, and its
+	-- crawled links by status class ("2xx", "3xx", "4xx", "5xx", "error")
+	type_counts map<text, int>,
+	status_counts map<text, int>,
+
+	-- If after now, the domain doesn't resolve or its robots.txt is
+	-- unavailable, and it is quarantined: the dispatcher won't dispatch it
+	-- until then (see fetcher.dns_quarantine_failures and
+	-- fetcher.robots_error_policy)
+	quarantine_until timestamp,
 
 	PRIMARY KEY (dom)
 ) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
@@ -249,15 +525,363 @@ CREATE INDEX ON {{.Keyspace}}.domain_info (dispatched);
 -- active_fetchers lists the uuids of running fetchers
 CREATE TABLE {{.Keyspace}}.active_fetchers (
 	tok uuid,
+
+	-- The node (see walker.NodeID) the fetcher runs on
+	node text,
+
 	PRIMARY KEY (tok)
 );
 
+-- fetcher_claims tracks how far each running fetcher has got through the
+-- segments of the domains it holds. Rows are refreshed with the fetcher's
+-- heartbeat in active_fetchers and expire with it.
+CREATE TABLE {{.Keyspace}}.fetcher_claims (
+	tok uuid,
+	dom text,
+
+	-- Links of the domain's segment the fetcher has stored results for
+	fetched int,
+
+	PRIMARY KEY (tok, dom)
+);
+
 CREATE TABLE {{.Keyspace}}.domain_counters (
 	dom text,
 	next_crawl counter,
 	PRIMARY KEY (dom)
 );
 
+-- link_expansions records links to redirector hosts (see
+-- fetcher.redirector_hosts) and the URLs they resolved to. Only the resolved
+-- URL is stored in the links table.
+CREATE TABLE {{.Keyspace}}.link_expansions (
+	-- the link as it was found on a page, ex. "http://bit.ly/abc"
+	src text,
+
+	-- the page the link was found on
+	ref text,
+
+	-- the URL src redirected to
+	dst text,
+
+	-- the time ref was fetched
+	time timestamp,
+
+	PRIMARY KEY (src, ref)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- robots_txt stores the last robots.txt fetched for each host, so changes can
+-- be detected across crawls
+CREATE TABLE {{.Keyspace}}.robots_txt (
+	dom text,
+	subdom text,
+
+	-- fnv fingerprint of body
+	fnv bigint,
+
+	-- the robots.txt contents
+	body text,
+
+	-- the time body was first seen
+	changed timestamp,
+
+	PRIMARY KEY (dom, subdom)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- host_context holds what the last fetcher to crawl a host learned that the
+-- next one to claim it can reuse (see walker.HostContext). Rows expire after
+-- fetcher.host_context_ttl.
+CREATE TABLE {{.Keyspace}}.host_context (
+	dom text,
+
+	-- robots.txt body for each host crawled, and the hosts that had none
+	robots map<text, blob>,
+	no_robots set<text>,
+
+	-- when the oldest of the robots.txt files was fetched
+	robots_time timestamp,
+
+	-- resolved ip:port for each host:port dialed
+	addrs map<text, text>,
+
+	-- crawl delay last used for the host, in milliseconds
+	crawl_delay int,
+
+	PRIMARY KEY (dom)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- subdomain_stats holds link counts for the largest and most error prone
+-- subdomains of each domain (see dispatcher.subdomain_stats_limit). The
+-- dispatcher rewrites a domain's rows every time it dispatches the domain.
+CREATE TABLE {{.Keyspace}}.subdomain_stats (
+	dom text,
+	subdom text,
+
+	-- Same as the domain_info columns of the same name, for just this
+	-- subdomain
+	tot_links int,
+	uncrawled_links int,
+	error_links int,
+
+	PRIMARY KEY (dom, subdom)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- audit_log records changes made through the console and REST API, newest
+-- first within each day
+CREATE TABLE {{.Keyspace}}.audit_log (
+	-- the (UTC) day of the change
+	day timestamp,
+	id timeuuid,
+	time timestamp,
+
+	-- who made the change: a REST API token name, or the console and the
+	-- address the request came from
+	actor text,
+
+	-- what kind of change this was (ex. "exclude"), what it was made to (ex. a
+	-- domain), and any details like the new value
+	action text,
+	target text,
+	detail text,
+
+	PRIMARY KEY (day, id)
+) WITH CLUSTERING ORDER BY (id DESC);
+
+-- samples holds fetches picked at random for QA capture (see
+-- fetcher.sample_percentage), newest first within each day. Rows expire after
+-- cassandra.sample_ttl.
+CREATE TABLE {{.Keyspace}}.samples (
+	-- the (UTC) day of the fetch
+	day timestamp,
+	id timeuuid,
+
+	-- the link fetched and when
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+	time timestamp,
+
+	-- the response: status, Content-Type, headers (encoded like
+	-- links.headers) and full body
+	stat int,
+	mime text,
+	headers map<text, text>,
+	body text,
+
+	-- errors fetching or parsing the page, null if there were none
+	err text,
+	parse_err text,
+
+	PRIMARY KEY (day, id)
+) WITH CLUSTERING ORDER BY (id DESC);
+
+-- page_state holds the content fingerprint and outlinks of each page handled
+-- in differential crawl mode (see walker.PageState and fetcher.differential),
+-- or watched by a watch rule (see watch.rules), to compare the next crawl of
+-- the page against.
+CREATE TABLE {{.Keyspace}}.page_state (
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+
+	-- when the page was first fetched with this content
+	time timestamp,
+
+	-- fnv fingerprint of the content, and the links stored from it
+	fnv bigint,
+	outlinks set<text>,
+
+	-- the value each watch rule applying to the page selected, by rule name
+	watches map<text, text>,
+
+	PRIMARY KEY (dom, subdom, path, proto)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- watch_events records the changes watch rules saw (see walker.WatchChange),
+-- newest first within each day
+CREATE TABLE {{.Keyspace}}.watch_events (
+	-- the (UTC) day of the change
+	day timestamp,
+	id timeuuid,
+
+	-- the rule that saw the change
+	rule text,
+
+	-- the page that changed, and when the change was seen
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+	time timestamp,
+
+	-- the watched value before and after the change, and what the rule
+	-- expected, if anything
+	prev text,
+	cur text,
+	expected text,
+
+	PRIMARY KEY (day, id)
+) WITH CLUSTERING ORDER BY (id DESC);
+
+-- screenshots holds renderings of pages matching screenshots.patterns (see
+-- walker.Screenshot), newest first for each page
+CREATE TABLE {{.Keyspace}}.screenshots (
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+
+	-- when the screenshot was taken
+	time timestamp,
+
+	-- the screenshot as the renderer gave it, with its Content-Type, and a
+	-- PNG thumbnail of it
+	mime text,
+	image blob,
+	thumb blob,
+
+	PRIMARY KEY ((dom, subdom, path, proto), time)
+) WITH CLUSTERING ORDER BY (time DESC);
+
+-- link_provenance records the page each parsed link was first found on (see
+-- cassandra.store_link_provenance), to trace how links entered the crawl
+CREATE TABLE {{.Keyspace}}.link_provenance (
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+
+	-- the page the link was found on, and when it was fetched
+	ref text,
+	found timestamp,
+
+	PRIMARY KEY (dom, subdom, path, proto)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- surrogate_keys indexes the pages handlers tagged with surrogate keys (see
+-- walker.FetchResults.SurrogateKeys), so all the pages with a key can be
+-- listed
+CREATE TABLE {{.Keyspace}}.surrogate_keys (
+	key text,
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+
+	-- the latest fetch of the page tagged with key
+	time timestamp,
+
+	PRIMARY KEY (key, dom, subdom, path, proto)
+) WITH compaction = { 'class' : 'LeveledCompactionStrategy' };
+
+-- fetch_latency rolls up response times (see walker.FetchResults.ResponseTime)
+-- per domain and (UTC) day
+CREATE TABLE {{.Keyspace}}.fetch_latency (
+	day timestamp,
+	dom text,
+
+	-- index of the first of cassandra.LatencyBuckets the response times
+	-- counted here were within (len(LatencyBuckets) if beyond the last)
+	bucket int,
+
+	-- how many fetches took that long, and how many of them took longer than
+	-- fetcher.response_time_slo
+	fetches counter,
+	slow counter,
+
+	PRIMARY KEY (day, dom, bucket)
+);
+
+-- slow_pages records the pages that took longer than
+-- fetcher.response_time_slo to fetch: the latest such fetch of each page per
+-- (UTC) day. Rows expire after cassandra.LatencyMaxDays.
+CREATE TABLE {{.Keyspace}}.slow_pages (
+	day timestamp,
+	dom text,
+	subdom text,
+	path text,
+	proto text,
+
+	-- when the page was fetched, how long it took in milliseconds and the
+	-- status it answered (null if the fetch failed)
+	time timestamp,
+	resp_ms int,
+	stat int,
+
+	PRIMARY KEY (day, dom, subdom, path, proto)
+);
+
+-- param_rules holds the rules collapsing the query strings of crawler trap
+-- paths (see dispatcher.trap_escape and cassandra.ParamRule)
+CREATE TABLE {{.Keyspace}}.param_rules (
+	dom text,
+	subdom text,
+
+	-- the path the rule applies to, without query string
+	path text,
+
+	-- the query parameters the rule drops, empty to drop the whole query
+	-- string
+	params list<text>,
+
+	-- proposed, active or rejected
+	status text,
+
+	-- the number of uncrawled links on the path when the rule was
+	-- synthesized, and when that was
+	links int,
+	created timestamp,
+
+	PRIMARY KEY (dom, subdom, path)
+);
+
+-- dispatchers holds the round status of each running dispatcher (see
+-- cassandra.DispatcherStatus). Rows of dispatchers that stop updating them
+-- expire after a week.
+CREATE TABLE {{.Keyspace}}.dispatchers (
+	-- unique to each dispatcher run
+	tok uuid,
+	host text,
+
+	-- when the dispatcher started, and how many rounds it finished
+	up timestamp,
+	rounds int,
+
+	-- when the latest round started, and when the last round to finish did
+	started timestamp,
+	finished timestamp,
+
+	-- the number of domains generated in the last round to finish, and those
+	-- that failed to, mapped to their error
+	domains int,
+	failed map<text, text>,
+
+	-- the error the latest round failed with reading domain_info, if it did
+	err text,
+
+	PRIMARY KEY (tok)
+);
+
+-- domain_reports lists who gets each domain's periodic crawl summary (see
+-- cassandra.DomainReport)
+CREATE TABLE {{.Keyspace}}.domain_reports (
+	dom text,
+
+	-- an email address, or an http(s) URL the summary is POSTed to
+	rcpt text,
+
+	-- how often the summary is sent, in seconds
+	period int,
+
+	-- when it was last sent, and the error sending it failed with, if any
+	sent timestamp,
+	err text,
+
+	PRIMARY KEY (dom, rcpt)
+);
+
 CREATE TABLE {{.Keyspace}}.walker_globals (
 	key text,
 	val int,
@@ -290,7 +914,10 @@ func GetTestDB() *gocql.Session {
 		panic(fmt.Sprintf("Could not connect to local cassandra db: %v", err))
 	}
 
-	tables := []string{"links", "segments", "domain_info", "active_fetchers"}
+	tables := []string{"links", "segments", "domain_info", "active_fetchers", "fetcher_claims", "link_expansions", "robots_txt", "audit_log", "host_context", "samples",
+		"subdomain_stats", "page_state", "watch_events",
+		"screenshots", "link_provenance", "surrogate_keys", "fetch_latency", "slow_pages",
+		"param_rules", "dispatchers", "domain_reports", "pending_segments", "pending_segment_sizes"}
 	for _, table := range tables {
 		err := db.Query(fmt.Sprintf(`TRUNCATE %v`, table)).Exec()
 		if err != nil {
@@ -1,6 +1,7 @@
 package cassandra
 
 import (
+	"io"
 	"net/http"
 	"time"
 
@@ -20,7 +21,8 @@ type ModelDatastore interface {
 	FindDomain(domain string) (*DomainInfo, error)
 
 	// ListDomains returns a slice of DomainInfo structs populated according to
-	// the specified DQ (domain query)
+	// the specified DQ (domain query). A sorted query whose Seed doesn't exist
+	// fails with walker.ErrNotFound.
 	ListDomains(query DQ) ([]*DomainInfo, error)
 
 	// UpdateDomain updates the given domain with fields from `info`. Which
@@ -28,7 +30,9 @@ type ModelDatastore interface {
 	// configured from the DomainInfoUpdateConfig argument. For example, to
 	// persist the Priority field in the info strut, one would pass
 	// DomainInfoUpdateConfig{Priority: true} as the cfg argument to
-	// UpdateDomain.
+	// UpdateDomain. Boosting a domain fails with walker.ErrNotFound if it
+	// doesn't exist, and walker.ErrExcluded if it is excluded; so does putting
+	// it in burst mode.
 	UpdateDomain(domain string, info *DomainInfo, cfg DomainInfoUpdateConfig) error
 
 	// FindLink returns a LinkInfo matching the given URL. Arguments to this
@@ -52,6 +56,156 @@ type ModelDatastore interface {
 	// will insert as many as it can (it won't stop once it hits a bad link)
 	// and only return errors for problematic links or domains.
 	InsertLinks(links []string, excludeDomainReason string) []error
+
+	// ScheduleLink sets the time an already inserted link may be crawled no
+	// earlier than; the dispatcher won't put it in a segment before then. A
+	// zero at removes the constraint. Fails with walker.ErrNotFound if the link
+	// hasn't been inserted.
+	ScheduleLink(link string, at time.Time) error
+
+	// ExportCheckpoint writes the crawl's scheduling state (every domain_info
+	// and segments row, but no links or page contents) to w, so it can be
+	// backed up or moved to another cluster.
+	ExportCheckpoint(w io.Writer) error
+
+	// ImportCheckpoint restores scheduling state written by ExportCheckpoint.
+	// Existing rows for the same domains are overwritten, and all imported
+	// domains are left unclaimed. Domains currently claimed by a fetcher are
+	// skipped, so as not to pull their segments out from under it; if any
+	// were, the rest of the checkpoint is still imported and the error
+	// returned is a walker.ErrAlreadyClaimed naming them.
+	ImportCheckpoint(r io.Reader) error
+
+	// RecordAudit adds entry to the audit log. If entry.Time is zero it is
+	// set to now.
+	RecordAudit(entry *AuditEntry) error
+
+	// ListAudit returns up to limit of the most recent audit log entries,
+	// newest first
+	ListAudit(limit int) ([]*AuditEntry, error)
+
+	// ListSamples returns up to limit of the most recent fetches sampled for
+	// QA capture, newest first. Their Body and Headers are not filled in.
+	ListSamples(limit int) ([]*Sample, error)
+
+	// FindSample returns the sample with the given ID, or nil if it doesn't
+	// exist (or has expired)
+	FindSample(id gocql.UUID) (*Sample, error)
+
+	// ListWatchEvents returns up to limit of the most recent changes seen by
+	// watch rules, newest first
+	ListWatchEvents(limit int) ([]*WatchEvent, error)
+
+	// ListScreenshots returns the screenshots taken of u, newest first. Their
+	// Image and Thumbnail are not filled in.
+	ListScreenshots(u *walker.URL) ([]*walker.Screenshot, error)
+
+	// FindScreenshot returns the screenshot of u taken at the given time, or
+	// nil if there is none
+	FindScreenshot(u *walker.URL, at time.Time) (*walker.Screenshot, error)
+
+	// FindLinkProvenance returns where u was first found, or nil if that
+	// wasn't recorded (ex. u was added rather than parsed from a page, or
+	// cassandra.store_link_provenance is off)
+	FindLinkProvenance(u *walker.URL) (*LinkProvenance, error)
+
+	// ListSurrogateKeyLinks returns up to limit (0 for no limit) of the pages
+	// a handler tagged with surrogate key on their latest fetch (see
+	// walker.FetchResults.SurrogateKeys), in no particular order
+	ListSurrogateKeyLinks(key string, limit int) ([]*SurrogateKeyLink, error)
+
+	// DiffCrawls compares domain as crawled at from and at to (which must be
+	// later): the links new by to, those gone since from, and those whose
+	// status changed. Fails with walker.ErrNotFound if the domain doesn't
+	// exist.
+	DiffCrawls(domain string, from, to time.Time) (*CrawlDiff, error)
+
+	// ListRedirects returns the links of domain that redirected on their
+	// latest fetch, ordered by link. Fails with walker.ErrNotFound if the
+	// domain doesn't exist.
+	ListRedirects(domain string) ([]*RedirectInfo, error)
+
+	// OutlinkProfile returns the external link profile of domain: the other
+	// domains its pages link to, as of each page's latest fetch. It returns
+	// an ErrNotFound error if domain isn't in domain_info.
+	OutlinkProfile(domain string) (*OutlinkProfile, error)
+
+	// ReportLatency reports response times over the last days (UTC) days,
+	// including up to limit (0 for no limit) of the domains that missed
+	// fetcher.response_time_slo most and of the slowest pages
+	ReportLatency(days, limit int) (*LatencyReport, error)
+
+	// FrontierSnapshot sums up the links the crawl has yet to crawl or
+	// refresh, by domain priority, as of each domain's last dispatch
+	FrontierSnapshot() (*Frontier, error)
+
+	// ListParamRules returns the param rules synthesized to escape crawler
+	// traps on domain, or on all domains if domain is empty, proposed rules
+	// first
+	ListParamRules(domain string) ([]*ParamRule, error)
+
+	// SetParamRuleStatus sets the status of the param rule of path on
+	// subdomain.domain, ex. to ParamRuleActive to confirm it. Fails with
+	// walker.ErrNotFound if there is no such rule.
+	SetParamRuleStatus(domain, subdomain, path, status string) error
+
+	// ListDispatchers returns the round status of each dispatcher, latest
+	// started first, including dispatchers that died within the last week
+	ListDispatchers() ([]*DispatcherStatus, error)
+
+	// DryRunLinks reports, for each of links, how it would be normalized and
+	// which rules would keep it from being stored if a fetcher found it on a
+	// page: the fetcher's (see walker.FilterLink), then whether its domain is
+	// known or would be added, and the active param rule that would collapse
+	// it. Nothing is stored.
+	DryRunLinks(links []string) []*walker.FilterReport
+
+	// ProjectCrawl estimates how long the crawl will take to get through its
+	// backlog at current fetch rates, including the `slowest` domains with the
+	// longest ETAs.
+	ProjectCrawl(slowest int) (*CrawlProjection, error)
+
+	// ListSubdomainStats returns the per-subdomain link counts recorded the
+	// last time domain was dispatched, most links first. It is empty unless
+	// dispatcher.subdomain_stats_limit is set.
+	ListSubdomainStats(domain string) ([]*SubdomainStats, error)
+
+	// ListClaims returns the running fetchers (those with a heartbeat in
+	// active_fetchers) and the domains each currently holds, ordered by node
+	ListClaims() ([]*FetcherClaims, error)
+
+	// SummarizeDomain sums up how the crawl of domain went between from and
+	// to, as sent in its reports, listing up to limit links (and watch
+	// changes) of each kind. Fails with walker.ErrNotFound if the domain
+	// doesn't exist.
+	SummarizeDomain(domain string, from, to time.Time, limit int) (*DomainSummary, error)
+
+	// ListDomainReports returns who gets the periodic summaries of domain, or
+	// of all domains if domain is empty
+	ListDomainReports(domain string) ([]*DomainReport, error)
+
+	// SetDomainReport sends recipient (an email address or an http(s) URL)
+	// the summary of domain every period (at least an hour), or changes the
+	// period if it already gets it. Fails with walker.ErrNotFound if the
+	// domain doesn't exist.
+	SetDomainReport(domain, recipient string, period time.Duration) error
+
+	// DeleteDomainReport stops sending recipient the summary of domain
+	DeleteDomainReport(domain, recipient string) error
+
+	// SendDomainReport sends recipient the summary of domain now, rather than
+	// when it's due. Fails with walker.ErrNotFound if it doesn't get it.
+	SendDomainReport(domain, recipient string) error
+
+	// Fsck checks domain_info and segments for inconsistencies (see the Fsck*
+	// problem kinds), repairing them if repair is true. The report lists every
+	// problem found; an error means the check couldn't be completed.
+	Fsck(repair bool) (*FsckReport, error)
+
+	// Canonicalize merges links stored under non-canonical keys into their
+	// canonical form (see walker.URL.Canonicalize), if repair is true. The
+	// report lists every such link found.
+	Canonicalize(repair bool) (*CanonicalizeReport, error)
 }
 
 // LQ is a link query struct used for gettings links from cassandra.
@@ -67,6 +221,24 @@ type LQ struct {
 	Limit int
 
 	FilterRegex string
+
+	// Only return links whose mime type starts with MimeType (ex.
+	// "application/pdf" or "image/").
+	// Default: any mime type
+	MimeType string
+
+	// Only return links whose fetched content was at least MinSize bytes.
+	// Default: no minimum
+	MinSize int64
+
+	// Only return links whose fetched content was at most MaxSize bytes.
+	// Default: no maximum
+	MaxSize int64
+
+	// Only return links that were fetched but could not be parsed for links
+	// (LinkInfo.ParseError is set) on their latest fetch.
+	// Default: any link
+	ParseFailed bool
 }
 
 // LinkInfo defines a row from the link or segment table
@@ -83,6 +255,10 @@ type LinkInfo struct {
 	// Any error reported when attempting to fetch the URL
 	Error string
 
+	// Set if the fetched page could not be parsed for links (see
+	// walker.FetchResults.ParseError)
+	ParseError string
+
 	// Was this excluded by robots
 	RobotsExcluded bool
 
@@ -98,6 +274,51 @@ type LinkInfo struct {
 	// FNV hash of the contents
 	FnvFingerprint int64
 
+	// Size of the fetched content in bytes
+	Size int64
+
+	// The earliest time the link may be crawled again, or zero if there is
+	// no constraint (see walker.FetchResults.CrawlAt). Only populated by
+	// ListLinkHistorical.
+	CrawlAt time.Time
+
+	// The error the handler returned for this fetch, if it failed to handle
+	// it (see walker.FetchResults.HandlerError). Only populated by
+	// ListLinkHistorical.
+	HandlerError string
+
+	// True if only the start of the document was fetched (see
+	// walker.FetchResults.Partial). Only populated by ListLinkHistorical.
+	Partial bool
+
+	// The other domains the page linked to, with its number of links to
+	// each (see walker.FetchResults.OutlinkDomains). Only populated by
+	// ListLinkHistorical.
+	OutlinkDomains map[string]int
+
+	// The node that fetched the link (see walker.FetchResults.Node). Only
+	// populated by ListLinkHistorical.
+	Node string
+
+	// AMP, mobile and canonical versions of this page, as declared by its
+	// <link> tags (empty if not declared). Only populated by
+	// ListLinkHistorical.
+	AMPURL       string
+	MobileURL    string
+	CanonicalURL string
+
+	// Robots usage directives (see walker.FetchResults.MetaNoAI and
+	// friends). Only populated by ListLinkHistorical.
+	NoAI       bool
+	NoImageAI  bool
+	NoSnippet  bool
+	MaxSnippet int
+
+	// Image metadata, if the link was an image and
+	// fetcher.extract_image_metadata was set when it was fetched. Only
+	// populated by ListLinkHistorical.
+	Image *walker.ImageInfo
+
 	// Body of request (if configured to be stored)
 	Body string
 
@@ -121,8 +342,65 @@ type DQ struct {
 	// Set to true to get only dispatched domains
 	// default: get all domains
 	Working bool
+
+	// Filter on whether domains are excluded, dispatched, or claimed by a
+	// fetcher
+	// Default: FilterAny
+	Excluded   BoolFilter
+	Dispatched BoolFilter
+	Claimed    BoolFilter
+
+	// Only return domains with at least this priority
+	// Default: no minimum
+	MinPriority int
+
+	// Only return domains whose ErrorRate() is at least this
+	// Default: no minimum
+	MinErrorRate float64
+
+	// The order to return domains in. When sorting, the seed is the last
+	// domain of the previous page and must exist. Note that sorting (or
+	// filtering on anything but Working/Dispatched) has to read the whole
+	// domain_info table.
+	// Default: SortByToken
+	Sort DomainSort
+
+	// Set to true to sort in descending order
+	SortDesc bool
+}
+
+// BoolFilter is used to filter domains on a boolean attribute
+type BoolFilter int
+
+const (
+	FilterAny BoolFilter = iota
+	FilterTrue
+	FilterFalse
+)
+
+func (f BoolFilter) match(v bool) bool {
+	return f == FilterAny || (f == FilterTrue) == v
 }
 
+// DomainSort is the order domains are listed in
+type DomainSort string
+
+const (
+	// SortByToken lists domains in cassandra token order, which is the only
+	// order that doesn't require reading every domain
+	SortByToken        DomainSort = ""
+	SortByPriority     DomainSort = "priority"
+	SortByLinks        DomainSort = "links"
+	SortByUncrawled    DomainSort = "uncrawled"
+	SortByClaimTime    DomainSort = "claim_time"
+	SortByErrorRate    DomainSort = "error_rate"
+	SortByCoverageLoss DomainSort = "coverage_loss"
+)
+
+// DomainSorts lists the valid DomainSort values
+var DomainSorts = []DomainSort{SortByToken, SortByPriority, SortByLinks, SortByUncrawled,
+	SortByClaimTime, SortByErrorRate, SortByCoverageLoss}
+
 // DomainInfo defines a row from the domain_info table
 type DomainInfo struct {
 	// TLD+1
@@ -140,6 +418,12 @@ type DomainInfo struct {
 	// What was the UUID of the crawler that last crawled the domain
 	ClaimToken gocql.UUID
 
+	// The node (see walker.NodeID) that last claimed the domain
+	ClaimNode string
+
+	// Is this domain currently dispatched (has a segment)?
+	Dispatched bool
+
 	// Number of (unique) links found in this domain
 	NumberLinksTotal int
 
@@ -149,8 +433,267 @@ type DomainInfo struct {
 	// Number of links not yet crawled
 	NumberLinksUncrawled int
 
+	// Number of crawled links whose last fetch failed (an error or a status of
+	// 400 or more), as of the last time the domain was dispatched
+	NumberLinksFailed int
+
+	// Number of crawled links that were fetched successfully but could not be
+	// parsed for links on their last fetch, as of the last time the domain was
+	// dispatched
+	NumberLinksParseFailed int
+
+	// Number of links crawled in the FetchRateWindow before the domain was
+	// last dispatched
+	NumberLinksRecent int
+
+	// Coverage losses, as of the last time the domain was dispatched: the
+	// number of links never fetched because robots.txt excludes them, and of
+	// crawled pages marked noindex (so not handled if
+	// fetcher.honor_meta_noindex is set) or nofollow (so their links weren't
+	// followed if fetcher.honor_meta_nofollow is set) on their last fetch
+	NumberLinksRobotsExcluded int
+	NumberLinksNoIndex        int
+	NumberLinksNoFollow       int
+
 	// Priority of this domain
 	Priority int
+
+	// Daily download quota for this domain in bytes (0 means use the default
+	// quota, negative means no quota)
+	ByteQuota int64
+
+	// Number of bytes downloaded from this domain on QuotaDay
+	BytesDownloaded int64
+
+	// The day BytesDownloaded was counted for
+	QuotaDay time.Time
+
+	// The last time one of this domain's robots.txt files changed (zero if
+	// never seen to change), and how many previously crawled links the change
+	// newly blocked
+	RobotsChanged      time.Time
+	RobotsNewlyBlocked int
+
+	// The last time one of this domain's control files (a robots.txt or
+	// sitemap) was over its size limit (zero if never), and its URL
+	OverLimit     time.Time
+	OverLimitLink string
+
+	// Crawl delay set by an operator for this domain, overriding robots.txt
+	// and fetcher.default_crawl_delay (0 means no override)
+	CrawlDelay time.Duration
+
+	// Crawl scope set by an operator for this domain, deciding which of the
+	// links found on its pages are stored (a zero Scope keeps them all)
+	Scope walker.CrawlScope
+
+	// The most segments of this domain that may be outstanding at once, set
+	// by an operator (0 follows dispatcher.max_outstanding_segments)
+	MaxSegments int
+
+	// The canonical domain this domain was detected to be an alias (mirror)
+	// of, or "" if it isn't one (see dispatcher.alias_probe_interval)
+	MirrorOf string
+
+	// The end of the domain's bootstrap boost, or zero if it was never
+	// boosted (see dispatcher.new_domain_boost_period and Boosted)
+	BoostUntil time.Time
+
+	// The end of the domain's burst mode, or zero if it isn't in burst mode
+	// (see dispatcher.burst_segment_multiplier and Bursting)
+	BurstUntil time.Time
+
+	// When the domain's quarantine ends, or zero if it was never
+	// quarantined (see fetcher.dns_quarantine_failures,
+	// fetcher.robots_error_policy and Quarantined)
+	QuarantineUntil time.Time
+
+	// The domain's 2xx pages by Content-Type and its crawled links by status
+	// class, as of its last complete dispatch (see
+	// dispatcher.content_stats_limit, TypeComposition and StatusComposition)
+	TypeCounts   map[string]int
+	StatusCounts map[string]int
+}
+
+// Quarantined returns true if the domain is quarantined for failing DNS or
+// for its robots.txt being unavailable
+func (d *DomainInfo) Quarantined() bool {
+	return time.Now().Before(d.QuarantineUntil)
+}
+
+// ErrorRate returns the fraction of this domain's crawled links whose last
+// fetch failed
+func (d *DomainInfo) ErrorRate() float64 {
+	crawled := d.NumberLinksTotal - d.NumberLinksUncrawled
+	if crawled <= 0 {
+		return 0
+	}
+	return float64(d.NumberLinksFailed) / float64(crawled)
+}
+
+// CoverageLoss returns the fraction of this domain's links that are
+// invisible to the crawl: excluded by robots.txt or marked noindex. Pages
+// marked nofollow are visible themselves, so aren't counted.
+func (d *DomainInfo) CoverageLoss() float64 {
+	if d.NumberLinksTotal <= 0 {
+		return 0
+	}
+	return float64(d.NumberLinksRobotsExcluded+d.NumberLinksNoIndex) / float64(d.NumberLinksTotal)
+}
+
+// SubdomainStats holds the link counts of one subdomain of a domain, as of the
+// last time the domain was dispatched
+type SubdomainStats struct {
+	// The TLD+1 and subdomain (empty for the domain itself)
+	Domain    string
+	Subdomain string
+
+	// Same as the DomainInfo fields, but for just this subdomain
+	NumberLinksTotal     int
+	NumberLinksUncrawled int
+	NumberLinksFailed    int
+}
+
+// Host returns the full host name of the subdomain
+func (s *SubdomainStats) Host() string {
+	if s.Subdomain == "" {
+		return s.Domain
+	}
+	return s.Subdomain + "." + s.Domain
+}
+
+// ErrorRate returns the fraction of this subdomain's crawled links whose last
+// fetch failed
+func (s *SubdomainStats) ErrorRate() float64 {
+	crawled := s.NumberLinksTotal - s.NumberLinksUncrawled
+	if crawled <= 0 {
+		return 0
+	}
+	return float64(s.NumberLinksFailed) / float64(crawled)
+}
+
+// The actions recorded in the audit log
+const (
+	AuditAddLinks   = "add_links"
+	AuditExclude    = "exclude"
+	AuditUnexclude  = "unexclude"
+	AuditPriority   = "priority"
+	AuditCrawlDelay = "crawl_delay"
+	AuditScope      = "scope"
+	AuditSegments   = "max_segments"
+	AuditBoost      = "boost"
+	AuditBurst      = "burst"
+	AuditParamRule  = "param_rule"
+	AuditReport     = "report"
+)
+
+// AuditEntry defines a row from the audit_log table: a change made by an
+// operator through the console or REST API
+type AuditEntry struct {
+	// When the change was made
+	Time time.Time
+
+	// Who made the change
+	Actor string
+
+	// What kind of change it was (one of the Audit* constants)
+	Action string
+
+	// What the change was made to, usually a domain
+	Target string
+
+	// Details of the change, like the new value
+	Detail string
+}
+
+// LinkProvenance defines a row from the link_provenance table: the page a
+// link was first found on
+type LinkProvenance struct {
+	// The page the link was parsed from
+	Referrer *walker.URL
+
+	// When that page was fetched
+	Found time.Time
+}
+
+// SurrogateKeyLink defines a row from the surrogate_keys table: a page tagged
+// with a surrogate key
+type SurrogateKeyLink struct {
+	URL *walker.URL
+
+	// When the page was last fetched and tagged with the key
+	Tagged time.Time
+}
+
+// Sample defines a row from the samples table: a fetch picked for QA capture
+// (see fetcher.sample_percentage)
+type Sample struct {
+	ID gocql.UUID
+
+	// The link fetched and when
+	URL  *walker.URL
+	Time time.Time
+
+	// The response
+	Status   int
+	MimeType string
+	Headers  http.Header
+	Body     string
+
+	// Errors fetching or parsing the page, "" if there were none
+	FetchError string
+	ParseError string
+}
+
+// WatchEvent defines a row from the watch_events table: a change seen by a
+// watch rule (see walker.WatchChange)
+type WatchEvent struct {
+	// The rule that saw the change
+	Rule string
+
+	// The page that changed, and when the change was seen
+	URL  *walker.URL
+	Time time.Time
+
+	// The watched value before and after the change, and what the rule
+	// expected ("" if nothing)
+	Previous string
+	Current  string
+	Expected string
+}
+
+// FetcherClaims is a running fetcher and the domains it has claimed
+type FetcherClaims struct {
+	// The fetcher's claim_tok, and the node (walker.NodeID) it runs
+	// on, "" if it is too old to record it
+	Token gocql.UUID
+	Node  string
+
+	Claims []*Claim
+}
+
+// Claim is a domain held by a fetcher
+type Claim struct {
+	Domain    string
+	ClaimTime time.Time
+
+	// Links in the domain's segment (domain_info.queued_links), and how many
+	// of them the fetcher has stored results for. Fetched is reported with
+	// the fetcher's heartbeat, so it can lag by a little.
+	Queued  int
+	Fetched int
+}
+
+// Progress returns the fraction of the segment fetched so far
+func (c *Claim) Progress() float64 {
+	if c.Queued <= 0 {
+		return 0
+	}
+	p := float64(c.Fetched) / float64(c.Queued)
+	if p > 1 {
+		p = 1
+	}
+	return p
 }
 
 // DomainInfoUpdateConfig is used to configure the method Datastore.UpdateDomain
@@ -163,4 +706,33 @@ type DomainInfoUpdateConfig struct {
 	// Setting Priority to true indicates that the Priority field of the
 	// DomainInfo passed to UpdateDomain should be persisted to the database.
 	Priority bool
+
+	// Setting ByteQuota to true indicates that the ByteQuota field of the
+	// DomainInfo passed to UpdateDomain should be persisted to the database.
+	ByteQuota bool
+
+	// Setting CrawlDelay to true indicates that the CrawlDelay field of the
+	// DomainInfo passed to UpdateDomain should be persisted to the database.
+	// A CrawlDelay of 0 removes the override.
+	CrawlDelay bool
+
+	// Setting Scope to true indicates that the Scope field of the DomainInfo
+	// passed to UpdateDomain should be persisted to the database. A zero
+	// Scope (or one of mode walker.ScopeAll) removes it.
+	Scope bool
+
+	// Setting MaxSegments to true indicates that the MaxSegments field of the
+	// DomainInfo passed to UpdateDomain should be persisted to the database.
+	// A MaxSegments of 0 removes the override.
+	MaxSegments bool
+
+	// Setting BoostUntil to true indicates that the BoostUntil field of the
+	// DomainInfo passed to UpdateDomain should be persisted to the database.
+	// A zero BoostUntil removes the boost.
+	BoostUntil bool
+
+	// Setting BurstUntil to true indicates that the BurstUntil field of the
+	// DomainInfo passed to UpdateDomain should be persisted to the database.
+	// A zero BurstUntil ends burst mode.
+	BurstUntil bool
 }
@@ -0,0 +1,79 @@
+package cassandra
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// recoverInterrupted finishes or clears the segments a dispatcher was
+// writing when it stopped (ex. crashed) part way through. generateSegment
+// journals each segment in domain_info (dispatch_started and dispatch_size)
+// before writing it and clears the journal when it marks the domain
+// dispatched, so a domain that isn't dispatched but has a journal was
+// interrupted. If every link of its segment made it in, the domain is marked
+// dispatched; otherwise the partial segment is deleted and the domain is
+// dispatched again like any other.
+//
+// Journals younger than dispatcher.domain_timeout are left alone, since
+// another dispatcher may still be writing them.
+func (d *Dispatcher) recoverInterrupted() {
+	iter := d.db.Query(`SELECT dom, dispatched, dispatch_started, dispatch_size FROM domain_info`).Iter()
+	var domain string
+	var dispatched bool
+	var started time.Time
+	var size int
+	completed, cleared := 0, 0
+	for iter.Scan(&domain, &dispatched, &started, &size) {
+		if started.IsZero() || dispatched {
+			continue
+		}
+		if d.domainTimeout > 0 && time.Since(started) < d.domainTimeout {
+			continue
+		}
+
+		var count int
+		err := d.db.Query(`SELECT COUNT(*) FROM segments WHERE dom = ?`, domain).Scan(&count)
+		if err != nil {
+			log4go.Error("Failed to count interrupted segment of %v: %v", domain, err)
+			continue
+		}
+		if count == size && size > 0 {
+			err = d.db.Query(`UPDATE domain_info
+								SET dispatched = true, queued_links = ?, last_dispatch = ?,
+									dispatch_started = null, dispatch_size = null
+								WHERE dom = ?`, size, started, domain).Exec()
+			if err != nil {
+				log4go.Error("Failed to finish interrupted segment of %v: %v", domain, err)
+				continue
+			}
+			completed++
+		} else {
+			if err := d.clearInterrupted(domain); err != nil {
+				log4go.Error("%v", err)
+				continue
+			}
+			cleared++
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log4go.Error("Failed to read dispatch journals from domain_info: %v", err)
+	}
+	if completed > 0 || cleared > 0 {
+		log4go.Info("Recovered interrupted dispatches: %v segments finished, %v cleared", completed, cleared)
+	}
+}
+
+// clearInterrupted deletes the partial segment of domain and its journal
+func (d *Dispatcher) clearInterrupted(domain string) error {
+	if err := d.db.Query(`DELETE FROM segments WHERE dom = ?`, domain).Exec(); err != nil {
+		return fmt.Errorf("error deleting interrupted segment of %v: %v", domain, err)
+	}
+	err := d.db.Query(`UPDATE domain_info SET dispatch_started = null, dispatch_size = null WHERE dom = ?`,
+		domain).Exec()
+	if err != nil {
+		return fmt.Errorf("error clearing dispatch journal of %v: %v", domain, err)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// Response times (walker.FetchResults.ResponseTime) are rolled up per domain
+// and day in fetch_latency, a histogram of fetches over LatencyBuckets that
+// also counts the fetches slower than fetcher.response_time_slo. The pages
+// behind those slow fetches are kept in slow_pages. Both tables are
+// partitioned by day like audit_log, so ReportLatency reads a partition per
+// day it covers.
+
+// LatencyBuckets are the upper bounds of the response time histogram buckets
+// of fetch_latency; fetches slower than the last bound have a bucket of their
+// own
+var LatencyBuckets = []time.Duration{
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// LatencyMaxDays is how many days back ReportLatency can look; slow_pages
+// rows expire after this long
+const LatencyMaxDays = 30
+
+// latencyBucket returns the fetch_latency bucket of response time d
+func latencyBucket(d time.Duration) int {
+	for i, b := range LatencyBuckets {
+		if d <= b {
+			return i
+		}
+	}
+	return len(LatencyBuckets)
+}
+
+// storeLatency rolls up the response time of fr, and records url as a slow
+// page if it missed fetcher.response_time_slo
+func (ds *Datastore) storeLatency(fr *walker.FetchResults, url *walker.URL, dom, subdom string) {
+	if fr.ResponseTime <= 0 {
+		return
+	}
+	var slow int64
+	if fr.ResponseTime > ds.responseTimeSLO {
+		slow = 1
+	}
+	day := auditDay(fr.FetchTime)
+	err := ds.db.Query(`UPDATE fetch_latency SET fetches = fetches + 1, slow = slow + ?
+						WHERE day = ? AND dom = ? AND bucket = ?`,
+		slow, day, dom, latencyBucket(fr.ResponseTime)).Exec()
+	if err != nil {
+		log4go.Error("Failed to roll up response time of %v: %v", url, err)
+	}
+	if slow == 0 {
+		return
+	}
+
+	var status interface{}
+	if fr.Response != nil {
+		status = fr.Response.StatusCode
+	}
+	err = ds.db.Query(`INSERT INTO slow_pages (day, dom, subdom, path, proto, time, resp_ms, stat)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		day, dom, subdom, url.RequestURI(), url.Scheme, fr.FetchTime,
+		int(fr.ResponseTime/time.Millisecond), status, LatencyMaxDays*24*60*60).Exec()
+	if err != nil {
+		log4go.Error("Failed to store slow page %v: %v", url, err)
+	}
+}
+
+// LatencyStats summarizes a set of response times
+type LatencyStats struct {
+	// Number of fetches, and how many of them took longer than
+	// fetcher.response_time_slo
+	Fetches     int64
+	SlowFetches int64
+
+	// Number of fetches in each bucket of LatencyBuckets (and the one beyond
+	// it)
+	Buckets []int64
+}
+
+func (s *LatencyStats) add(bucket int, fetches, slow int64) {
+	if s.Buckets == nil {
+		s.Buckets = make([]int64, len(LatencyBuckets)+1)
+	}
+	if bucket < 0 || bucket >= len(s.Buckets) {
+		return
+	}
+	s.Buckets[bucket] += fetches
+	s.Fetches += fetches
+	s.SlowFetches += slow
+}
+
+// Percentile returns the response time p percent of fetches were within, to
+// the precision of LatencyBuckets: the upper bound of the bucket the
+// percentile falls in (the last bound if beyond it). It returns 0 if there
+// were no fetches.
+func (s *LatencyStats) Percentile(p float64) time.Duration {
+	if s.Fetches == 0 {
+		return 0
+	}
+	want := int64(float64(s.Fetches)*p/100 + 0.5)
+	var seen int64
+	for i, n := range s.Buckets {
+		seen += n
+		if seen >= want && i < len(LatencyBuckets) {
+			return LatencyBuckets[i]
+		}
+	}
+	return LatencyBuckets[len(LatencyBuckets)-1]
+}
+
+// Attainment returns the fraction of fetches that were within
+// fetcher.response_time_slo (1 if there were no fetches)
+func (s *LatencyStats) Attainment() float64 {
+	if s.Fetches == 0 {
+		return 1
+	}
+	return float64(s.Fetches-s.SlowFetches) / float64(s.Fetches)
+}
+
+// DomainLatency is the LatencyStats of one domain
+type DomainLatency struct {
+	Domain string
+	LatencyStats
+}
+
+// SlowPage is a fetch that took longer than fetcher.response_time_slo
+type SlowPage struct {
+	URL          *walker.URL
+	FetchTime    time.Time
+	ResponseTime time.Duration
+
+	// The status the page answered, 0 if the fetch failed
+	Status int
+}
+
+// LatencyReport is the outcome of ReportLatency
+type LatencyReport struct {
+	// The first day covered (days are UTC), and fetcher.response_time_slo
+	Since time.Time
+	SLO   time.Duration
+
+	// The response times of all fetches since Since
+	Total LatencyStats
+
+	// The domains that missed the SLO most (by the share of their fetches
+	// that did), then those slowest at the 90th percentile
+	Domains []*DomainLatency
+
+	// The slowest pages, slowest first
+	Pages []*SlowPage
+}
+
+// ReportLatency is documented on the ModelDatastore interface.
+func (ds *Datastore) ReportLatency(days, limit int) (*LatencyReport, error) {
+	if days < 1 || days > LatencyMaxDays {
+		return nil, fmt.Errorf("Latency report days must be between 1 and %d, got %d", LatencyMaxDays, days)
+	}
+	today := auditDay(time.Now())
+	r := &LatencyReport{Since: today.AddDate(0, 0, 1-days), SLO: ds.responseTimeSLO}
+
+	domains := map[string]*DomainLatency{}
+	pages := map[string]*SlowPage{}
+	for day := r.Since; !day.After(today); day = day.AddDate(0, 0, 1) {
+		var dom string
+		var bucket int
+		var fetches, slow int64
+		itr := ds.db.Query(`SELECT dom, bucket, fetches, slow FROM fetch_latency WHERE day = ?`, day).Iter()
+		for itr.Scan(&dom, &bucket, &fetches, &slow) {
+			d := domains[dom]
+			if d == nil {
+				d = &DomainLatency{Domain: dom}
+				domains[dom] = d
+			}
+			d.add(bucket, fetches, slow)
+			r.Total.add(bucket, fetches, slow)
+		}
+		if err := itr.Close(); err != nil {
+			return nil, fmt.Errorf("Failed to read response times of %v: %v", day.Format("2006-01-02"), err)
+		}
+
+		var subdom, path, proto string
+		var p SlowPage
+		var ms int
+		itr = ds.db.Query(`SELECT dom, subdom, path, proto, time, resp_ms, stat FROM slow_pages WHERE day = ?`,
+			day).Iter()
+		for itr.Scan(&dom, &subdom, &path, &proto, &p.FetchTime, &ms, &p.Status) {
+			u, err := walker.CreateURL(dom, subdom, path, proto, p.FetchTime)
+			if err != nil {
+				log4go.Error("Failed to create slow page link: %v", err)
+				continue
+			}
+			p.URL, p.ResponseTime = u, time.Duration(ms)*time.Millisecond
+			link := u.String()
+			if prev := pages[link]; prev == nil || p.ResponseTime > prev.ResponseTime {
+				page := p
+				pages[link] = &page
+			}
+		}
+		if err := itr.Close(); err != nil {
+			return nil, fmt.Errorf("Failed to read slow pages of %v: %v", day.Format("2006-01-02"), err)
+		}
+	}
+
+	for _, d := range domains {
+		r.Domains = append(r.Domains, d)
+	}
+	sort.Sort(slowestDomains(r.Domains))
+	if limit > 0 && len(r.Domains) > limit {
+		r.Domains = r.Domains[:limit]
+	}
+	for _, p := range pages {
+		r.Pages = append(r.Pages, p)
+	}
+	sort.Sort(slowestPages(r.Pages))
+	if limit > 0 && len(r.Pages) > limit {
+		r.Pages = r.Pages[:limit]
+	}
+	return r, nil
+}
+
+// slowestDomains sorts domains by ascending SLO attainment, then descending
+// 90th percentile
+type slowestDomains []*DomainLatency
+
+func (s slowestDomains) Len() int      { return len(s) }
+func (s slowestDomains) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s slowestDomains) Less(i, j int) bool {
+	if a, b := s[i].Attainment(), s[j].Attainment(); a != b {
+		return a < b
+	}
+	if a, b := s[i].Percentile(90), s[j].Percentile(90); a != b {
+		return a > b
+	}
+	return s[i].Domain < s[j].Domain
+}
+
+// slowestPages sorts pages by descending response time
+type slowestPages []*SlowPage
+
+func (s slowestPages) Len() int      { return len(s) }
+func (s slowestPages) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s slowestPages) Less(i, j int) bool {
+	if s[i].ResponseTime != s[j].ResponseTime {
+		return s[i].ResponseTime > s[j].ResponseTime
+	}
+	return s[i].URL.String() < s[j].URL.String()
+}
@@ -1,6 +1,12 @@
 package cassandra
 
-import "github.com/iParadigms/walker"
+import (
+	"io"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
 
 // MockModelDatastore implements walker/cassandra's ModelDatastore interface
 // for testing.
@@ -33,6 +39,11 @@ func (ds *MockModelDatastore) InsertLinks(links []string, excludeDomainReason st
 	return args.Get(0).([]error)
 }
 
+func (ds *MockModelDatastore) ScheduleLink(link string, at time.Time) error {
+	args := ds.Mock.Called(link, at)
+	return args.Error(0)
+}
+
 func (ds *MockModelDatastore) FindDomain(domain string) (*DomainInfo, error) {
 	args := ds.Mock.Called(domain)
 	return args.Get(0).(*DomainInfo), args.Error(1)
@@ -47,3 +58,153 @@ func (ds *MockModelDatastore) UpdateDomain(domain string, info *DomainInfo, cfg
 	args := ds.Mock.Called(domain, info, cfg)
 	return args.Error(0)
 }
+
+func (ds *MockModelDatastore) ExportCheckpoint(w io.Writer) error {
+	args := ds.Mock.Called(w)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) ImportCheckpoint(r io.Reader) error {
+	args := ds.Mock.Called(r)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) RecordAudit(entry *AuditEntry) error {
+	args := ds.Mock.Called(entry)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) ListAudit(limit int) ([]*AuditEntry, error) {
+	args := ds.Mock.Called(limit)
+	return args.Get(0).([]*AuditEntry), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListSamples(limit int) ([]*Sample, error) {
+	args := ds.Mock.Called(limit)
+	return args.Get(0).([]*Sample), args.Error(1)
+}
+
+func (ds *MockModelDatastore) FindSample(id gocql.UUID) (*Sample, error) {
+	args := ds.Mock.Called(id)
+	return args.Get(0).(*Sample), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListWatchEvents(limit int) ([]*WatchEvent, error) {
+	args := ds.Mock.Called(limit)
+	return args.Get(0).([]*WatchEvent), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListScreenshots(u *walker.URL) ([]*walker.Screenshot, error) {
+	args := ds.Mock.Called(u)
+	return args.Get(0).([]*walker.Screenshot), args.Error(1)
+}
+
+func (ds *MockModelDatastore) FindScreenshot(u *walker.URL, at time.Time) (*walker.Screenshot, error) {
+	args := ds.Mock.Called(u, at)
+	return args.Get(0).(*walker.Screenshot), args.Error(1)
+}
+
+func (ds *MockModelDatastore) FindLinkProvenance(u *walker.URL) (*LinkProvenance, error) {
+	args := ds.Mock.Called(u)
+	return args.Get(0).(*LinkProvenance), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListSurrogateKeyLinks(key string, limit int) ([]*SurrogateKeyLink, error) {
+	args := ds.Mock.Called(key, limit)
+	return args.Get(0).([]*SurrogateKeyLink), args.Error(1)
+}
+
+func (ds *MockModelDatastore) DiffCrawls(domain string, from, to time.Time) (*CrawlDiff, error) {
+	args := ds.Mock.Called(domain, from, to)
+	return args.Get(0).(*CrawlDiff), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListRedirects(domain string) ([]*RedirectInfo, error) {
+	args := ds.Mock.Called(domain)
+	return args.Get(0).([]*RedirectInfo), args.Error(1)
+}
+
+func (ds *MockModelDatastore) SummarizeDomain(domain string, from, to time.Time, limit int) (*DomainSummary, error) {
+	args := ds.Mock.Called(domain, from, to, limit)
+	return args.Get(0).(*DomainSummary), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListDomainReports(domain string) ([]*DomainReport, error) {
+	args := ds.Mock.Called(domain)
+	return args.Get(0).([]*DomainReport), args.Error(1)
+}
+
+func (ds *MockModelDatastore) SetDomainReport(domain, recipient string, period time.Duration) error {
+	args := ds.Mock.Called(domain, recipient, period)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) DeleteDomainReport(domain, recipient string) error {
+	args := ds.Mock.Called(domain, recipient)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) SendDomainReport(domain, recipient string) error {
+	args := ds.Mock.Called(domain, recipient)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) OutlinkProfile(domain string) (*OutlinkProfile, error) {
+	args := ds.Mock.Called(domain)
+	return args.Get(0).(*OutlinkProfile), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ReportLatency(days, limit int) (*LatencyReport, error) {
+	args := ds.Mock.Called(days, limit)
+	return args.Get(0).(*LatencyReport), args.Error(1)
+}
+
+func (ds *MockModelDatastore) FrontierSnapshot() (*Frontier, error) {
+	args := ds.Mock.Called()
+	return args.Get(0).(*Frontier), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListParamRules(domain string) ([]*ParamRule, error) {
+	args := ds.Mock.Called(domain)
+	return args.Get(0).([]*ParamRule), args.Error(1)
+}
+
+func (ds *MockModelDatastore) SetParamRuleStatus(domain, subdomain, path, status string) error {
+	args := ds.Mock.Called(domain, subdomain, path, status)
+	return args.Error(0)
+}
+
+func (ds *MockModelDatastore) ListDispatchers() ([]*DispatcherStatus, error) {
+	args := ds.Mock.Called()
+	return args.Get(0).([]*DispatcherStatus), args.Error(1)
+}
+
+func (ds *MockModelDatastore) DryRunLinks(links []string) []*walker.FilterReport {
+	args := ds.Mock.Called(links)
+	return args.Get(0).([]*walker.FilterReport)
+}
+
+func (ds *MockModelDatastore) ProjectCrawl(slowest int) (*CrawlProjection, error) {
+	args := ds.Mock.Called(slowest)
+	return args.Get(0).(*CrawlProjection), args.Error(1)
+}
+
+func (ds *MockModelDatastore) Fsck(repair bool) (*FsckReport, error) {
+	args := ds.Mock.Called(repair)
+	return args.Get(0).(*FsckReport), args.Error(1)
+}
+
+func (ds *MockModelDatastore) Canonicalize(repair bool) (*CanonicalizeReport, error) {
+	args := ds.Mock.Called(repair)
+	return args.Get(0).(*CanonicalizeReport), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListSubdomainStats(domain string) ([]*SubdomainStats, error) {
+	args := ds.Mock.Called(domain)
+	return args.Get(0).([]*SubdomainStats), args.Error(1)
+}
+
+func (ds *MockModelDatastore) ListClaims() ([]*FetcherClaims, error) {
+	args := ds.Mock.Called()
+	return args.Get(0).([]*FetcherClaims), args.Error(1)
+}
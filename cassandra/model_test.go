@@ -12,6 +12,9 @@ package cassandra
 
 import (
 	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
 	"testing"
 	"time"
 
@@ -243,7 +246,8 @@ func getModelTestDatastore(t *testing.T) *Datastore {
 	insertDomainInfo := `INSERT INTO domain_info (dom, claim_time, priority) VALUES (?, ?, 1)`
 	insertDomainToCrawl := `INSERT INTO domain_info (dom, claim_tok, claim_time, dispatched, priority) VALUES (?, ?, ?, true, 1)`
 	insertSegment := `INSERT INTO segments (dom, subdom, path, proto) VALUES (?, ?, ?, ?)`
-	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, stat, err, robot_ex) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	insertLink := `INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, err, robot_ex)
+					VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?)`
 	queries := []*gocql.Query{
 		db.Query(insertDomainToCrawl, "test.com", gocql.UUID{}, testTime),
 		db.Query(insertLink, "test.com", "", "/page1.html", "http", walker.NotYetCrawled, 200, "", false),
@@ -306,7 +310,7 @@ func getModelTestDatastore(t *testing.T) *Datastore {
 	//
 	// Need to record the order that the test.com urls come off on
 	//
-	itr := db.Query("SELECT dom, subdom, path, proto FROM links WHERE dom = 'test.com'").Iter()
+	itr := db.Query("SELECT dom, subdom, path, proto FROM links WHERE dom = 'test.com' AND bucket = 0").Iter()
 	var domain, subdomain, path, protocol string
 	testComLinkOrder = nil
 	for itr.Scan(&domain, &subdomain, &path, &protocol) {
@@ -326,7 +330,7 @@ func getModelTestDatastore(t *testing.T) *Datastore {
 	//
 	// Need to record order for baz
 	//
-	itr = db.Query("SELECT time FROM links WHERE dom = 'baz.com'").Iter()
+	itr = db.Query("SELECT time FROM links WHERE dom = 'baz.com' AND bucket = 0").Iter()
 	var crawlTime time.Time
 	bazLinkHistoryOrder = nil
 	for itr.Scan(&crawlTime) {
@@ -500,6 +504,73 @@ func TestListDomains(t *testing.T) {
 	store.Close()
 }
 
+func TestListDomainsFilteredAndSorted(t *testing.T) {
+	store := getModelTestDatastore(t)
+	defer store.Close()
+
+	tests := []struct {
+		tag      string
+		query    DQ
+		expected []string
+	}{
+		{
+			tag:      "Excluded",
+			query:    DQ{Excluded: FilterTrue},
+			expected: []string{"excluded.com"},
+		},
+		{
+			tag:      "Claimed",
+			query:    DQ{Claimed: FilterTrue},
+			expected: []string{"baz.com"},
+		},
+		{
+			tag:      "Not Excluded & Limited",
+			query:    DQ{Excluded: FilterFalse, Limit: 2},
+			expected: []string{"baz.com", "filter.com"},
+		},
+		{
+			tag:      "Sort By Links",
+			query:    DQ{Sort: SortByLinks},
+			expected: []string{"bar.com", "excluded.com", "baz.com", "foo.com", "filter.com", "test.com"},
+		},
+		{
+			tag:      "Sort By Links Descending & Limited",
+			query:    DQ{Sort: SortByLinks, SortDesc: true, Limit: 3},
+			expected: []string{"test.com", "filter.com", "foo.com"},
+		},
+		{
+			tag:      "Sort By Links Descending & Seeded",
+			query:    DQ{Sort: SortByLinks, SortDesc: true, Limit: 2, Seed: "foo.com"},
+			expected: []string{"baz.com", "bar.com"},
+		},
+		{
+			tag:      "Sorted & Filtered",
+			query:    DQ{Sort: SortByUncrawled, SortDesc: true, Excluded: FilterFalse, Limit: 2, Seed: "test.com"},
+			expected: []string{"filter.com", "bar.com"},
+		},
+	}
+
+	for _, test := range tests {
+		dinfos, err := store.ListDomains(test.query)
+		if err != nil {
+			t.Errorf("ListDomains for tag %q error: %v", test.tag, err)
+			continue
+		}
+		var got []string
+		for _, d := range dinfos {
+			got = append(got, d.Domain)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("ListDomains for tag %q got %v, expected %v", test.tag, got, test.expected)
+		}
+	}
+
+	_, err := store.ListDomains(DQ{Sort: SortByLinks, Seed: "notadomain.com"})
+	if err == nil {
+		t.Errorf("Expected an error listing sorted domains with an unknown seed")
+	}
+}
+
 func TestFindDomain(t *testing.T) {
 	store := getModelTestDatastore(t)
 
@@ -741,6 +812,62 @@ func TestListLinks(t *testing.T) {
 	store.Close()
 }
 
+func TestListLinksBucketed(t *testing.T) {
+	orig := walker.Config.Cassandra.LinkBuckets
+	defer func() { walker.Config.Cassandra.LinkBuckets = orig }()
+	walker.Config.Cassandra.LinkBuckets = 4
+
+	store := getModelTestDatastore(t)
+	defer store.Close()
+
+	var links []string
+	for i := 0; i < 10; i++ {
+		links = append(links, fmt.Sprintf("http://buckets.com/page%d.html", i))
+	}
+	if errs := store.InsertLinks(links, ""); len(errs) != 0 {
+		t.Fatalf("InsertLinks failed: %v", errs)
+	}
+
+	db := GetTestDB()
+	buckets := map[int]bool{}
+	var bucket int
+	itr := db.Query(`SELECT bucket FROM links WHERE dom = ? AND bucket IN ?`, "buckets.com", linkBuckets()).Iter()
+	for itr.Scan(&bucket) {
+		buckets[bucket] = true
+	}
+	if err := itr.Close(); err != nil {
+		t.Fatalf("Failed to read links: %v", err)
+	}
+	if len(buckets) != 4 {
+		t.Errorf("Expected links spread over 4 buckets, got %v", buckets)
+	}
+
+	// Links come out in order across buckets, page by page
+	var got []string
+	var seed *walker.URL
+	for len(got) < len(links) {
+		linfos, err := store.ListLinks("buckets.com", LQ{Seed: seed, Limit: 3})
+		if err != nil {
+			t.Fatalf("ListLinks failed: %v", err)
+		}
+		if len(linfos) == 0 {
+			break
+		}
+		for _, linfo := range linfos {
+			got = append(got, linfo.URL.String())
+		}
+		seed = linfos[len(linfos)-1].URL
+	}
+	if !reflect.DeepEqual(got, links) {
+		t.Errorf("ListLinks pages mismatch: got %v, expected %v", got, links)
+	}
+
+	linfo, err := store.FindLink(walker.MustParse(links[7]), false)
+	if err != nil || linfo == nil {
+		t.Errorf("Expected to find %v, got %v (%v)", links[7], linfo, err)
+	}
+}
+
 func TestListLinkHistorical(t *testing.T) {
 	store := getModelTestDatastore(t)
 
@@ -1143,3 +1270,350 @@ func TestFilterRegex(t *testing.T) {
 	store.Close()
 
 }
+
+func TestAuditLog(t *testing.T) {
+	GetTestDB() // runs between tests to reset the db
+	store := getDS(t)
+	defer store.Close()
+
+	now := time.Now()
+	entries := []AuditEntry{
+		{Time: now.AddDate(0, 0, -2), Actor: "api:alice", Action: AuditAddLinks, Target: "a.com", Detail: "2 links"},
+		{Time: now.Add(-time.Minute), Actor: "console@10.0.0.1", Action: AuditExclude, Target: "b.com",
+			Detail: "Manual exclude"},
+		{Time: now, Actor: "api:bob", Action: AuditPriority, Target: "c.com", Detail: "5"},
+	}
+	for i := range entries {
+		if err := store.RecordAudit(&entries[i]); err != nil {
+			t.Fatalf("RecordAudit failed: %v", err)
+		}
+	}
+
+	got, err := store.ListAudit(10)
+	if err != nil {
+		t.Fatalf("ListAudit failed: %v", err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("ListAudit got %d entries, expected %d", len(got), len(entries))
+	}
+	// Newest first
+	for i, e := range got {
+		exp := entries[len(entries)-1-i]
+		if e.Actor != exp.Actor || e.Action != exp.Action || e.Target != exp.Target || e.Detail != exp.Detail {
+			t.Errorf("ListAudit entry %d got %+v, expected %+v", i, *e, exp)
+		}
+		if !timeClose(e.Time, exp.Time) {
+			t.Errorf("ListAudit entry %d time got %v, expected %v", i, e.Time, exp.Time)
+		}
+	}
+
+	got, err = store.ListAudit(2)
+	if err != nil {
+		t.Fatalf("ListAudit failed: %v", err)
+	}
+	if len(got) != 2 || got[1].Target != "b.com" {
+		t.Errorf("Limited ListAudit got %v entries, expected the 2 newest", len(got))
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	GetTestDB() // runs between tests to reset the db
+	store := getDS(t)
+	defer store.Close()
+
+	now := time.Now()
+	u := walker.MustParse("http://test.com/product.html")
+	store.StoreURLFetchResults(&walker.FetchResults{
+		URL:       u,
+		FetchTime: now,
+		Response:  &http.Response{StatusCode: 200},
+		WatchChanges: []walker.WatchChange{
+			{Rule: "price", Previous: "9.99", Current: "8.99", Time: now.Add(-time.Second)},
+			{Rule: "stock", Previous: "In stock", Current: "Sold out", Expected: "In stock", Time: now},
+		},
+	})
+
+	got, err := store.ListWatchEvents(10)
+	if err != nil {
+		t.Fatalf("ListWatchEvents failed: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("ListWatchEvents got %d events, expected 2", len(got))
+	}
+	// Newest first
+	e := got[0]
+	if e.Rule != "stock" || e.Previous != "In stock" || e.Current != "Sold out" || e.Expected != "In stock" {
+		t.Errorf("ListWatchEvents got %+v, expected the stock change", *e)
+	}
+	if e.URL.String() != u.String() || !timeClose(e.Time, now) {
+		t.Errorf("ListWatchEvents got URL %v at %v, expected %v at %v", e.URL, e.Time, u, now)
+	}
+	if got[1].Rule != "price" || got[1].Current != "8.99" {
+		t.Errorf("ListWatchEvents got %+v, expected the price change", *got[1])
+	}
+
+	got, err = store.ListWatchEvents(1)
+	if err != nil {
+		t.Fatalf("ListWatchEvents failed: %v", err)
+	}
+	if len(got) != 1 || got[0].Rule != "stock" {
+		t.Errorf("Limited ListWatchEvents got %v events, expected the newest", len(got))
+	}
+}
+
+func TestProjectCrawl(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	store := getDS(t)
+	defer store.Close()
+
+	domains := []struct {
+		dom       string
+		uncrawled int
+		recent    int
+		excluded  bool
+	}{
+		{"fast.com", 240, 480, false},   // 20 links/hour -> 12h
+		{"slow.com", 48, 24, false},     // 1 link/hour -> 48h
+		{"stalled.com", 10, 0, false},   // no rate
+		{"done.com", 0, 240, false},     // no backlog
+		{"excluded.com", 1000, 0, true}, // never crawled
+	}
+	for _, d := range domains {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched, excluded,
+							uncrawled_links, recent_links)
+						VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			d.dom, gocql.UUID{}, 1, false, d.excluded, d.uncrawled, d.recent).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain_info: %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		err := db.Query(`INSERT INTO active_fetchers (tok) VALUES (?)`, gocql.TimeUUID()).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert active_fetchers: %v", err)
+		}
+	}
+
+	cp, err := store.ProjectCrawl(2)
+	if err != nil {
+		t.Fatalf("ProjectCrawl failed: %v", err)
+	}
+	if cp.Domains != 5 || cp.DomainsWithBacklog != 3 || cp.DomainsStalled != 1 {
+		t.Errorf("Domain counts got %d/%d/%d, expected 5/3/1", cp.Domains, cp.DomainsWithBacklog, cp.DomainsStalled)
+	}
+	if cp.Backlog != 298 {
+		t.Errorf("Backlog got %d, expected %d", cp.Backlog, 298)
+	}
+	if cp.Rate != 31 {
+		t.Errorf("Rate got %v, expected %v", cp.Rate, 31)
+	}
+	// The slowest domain takes longer than the whole backlog at the total rate
+	if cp.ETA != 48*time.Hour {
+		t.Errorf("ETA got %v, expected %v", cp.ETA, 48*time.Hour)
+	}
+	if cp.ActiveFetchers != 2 {
+		t.Errorf("ActiveFetchers got %d, expected 2", cp.ActiveFetchers)
+	}
+
+	var slowest []string
+	for _, d := range cp.Slowest {
+		slowest = append(slowest, d.Domain+" "+d.String())
+	}
+	expected := []string{"stalled.com stalled", "slow.com 48h0m0s"}
+	if !reflect.DeepEqual(slowest, expected) {
+		t.Errorf("Slowest got %v, expected %v", slowest, expected)
+	}
+
+	// 298 links at 15.5 links/hour/fetcher in 2 hours
+	if n := cp.FetchersNeeded(2 * time.Hour); n != 10 {
+		t.Errorf("FetchersNeeded got %d, expected %d", n, 10)
+	}
+}
+
+func TestFsck(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	store := getDS(t)
+	defer store.Close()
+
+	alive, dead := gocql.TimeUUID(), gocql.TimeUUID()
+	if err := db.Query(`INSERT INTO active_fetchers (tok) VALUES (?)`, alive).Exec(); err != nil {
+		t.Fatalf("Failed to insert active_fetchers: %v", err)
+	}
+	domains := []struct {
+		dom        string
+		dispatched bool
+		tok        gocql.UUID
+	}{
+		{"ok.com", true, gocql.UUID{}},
+		{"claimed.com", true, alive},
+		{"dead.com", true, dead},
+		{"empty.com", true, gocql.UUID{}},
+		{"missing.com", true, gocql.UUID{}},
+		{"idle.com", false, gocql.UUID{}},
+	}
+	for _, d := range domains {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, ?, ?)`,
+			d.dom, d.tok, 1, d.dispatched).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain_info: %v", err)
+		}
+	}
+	// missing.com's only segment link was deleted from links, so once it is
+	// repaired the domain's segment is empty too
+	for _, l := range []struct {
+		dom, path string
+		inLinks   bool
+	}{
+		{"ok.com", "/a", true},
+		{"ok.com", "/b", true},
+		{"claimed.com", "/a", true},
+		{"dead.com", "/a", true},
+		{"missing.com", "/gone", false},
+	} {
+		err := db.Query(`INSERT INTO segments (dom, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?)`,
+			l.dom, "", l.path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert segment link: %v", err)
+		}
+		if l.inLinks {
+			err = db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, 0, ?, ?, ?, ?)`,
+				l.dom, "", l.path, "http", walker.NotYetCrawled).Exec()
+			if err != nil {
+				t.Fatalf("Failed to insert link: %v", err)
+			}
+		}
+	}
+
+	summarize := func(r *FsckReport) []string {
+		var s []string
+		for _, p := range r.Problems {
+			s = append(s, fmt.Sprintf("%v %v %v %v", p.Kind, p.Domain, p.Link, p.Repaired))
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	report, err := store.Fsck(false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if report.Domains != 6 || report.SegmentLinks != 4 {
+		t.Errorf("Expected 6 domains and 4 segment links checked, got %d and %d", report.Domains,
+			report.SegmentLinks)
+	}
+	expected := []string{
+		"empty_segment empty.com  false",
+		"expired_claim dead.com  false",
+		"missing_link missing.com http://missing.com/gone false",
+	}
+	if got := summarize(report); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Dry run found\n%v\nexpected\n%v", got, expected)
+	}
+
+	report, err = store.Fsck(true)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	expected = []string{
+		"empty_segment empty.com  true",
+		"empty_segment missing.com  true",
+		"expired_claim dead.com  true",
+		"missing_link missing.com http://missing.com/gone true",
+	}
+	if got := summarize(report); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Repair found\n%v\nexpected\n%v", got, expected)
+	}
+
+	report, err = store.Fsck(false)
+	if err != nil {
+		t.Fatalf("Fsck failed: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Expected no problems after repair, got %v", summarize(report))
+	}
+	dinfo, err := store.FindDomain("dead.com")
+	if err != nil {
+		t.Fatalf("FindDomain failed: %v", err)
+	}
+	if dinfo.ClaimToken != (gocql.UUID{}) || dinfo.Dispatched {
+		t.Errorf("Expected dead.com to be unclaimed and undispatched, got %+v", dinfo)
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	db := GetTestDB() // runs between tests to reset the db
+	store := getDS(t)
+	defer store.Close()
+
+	for _, dom := range []string{"canon.com", "Canon.com"} {
+		err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, ?, ?)`,
+			dom, gocql.UUID{}, 1, false).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert domain_info: %v", err)
+		}
+	}
+	for _, l := range []struct {
+		dom, subdom, path string
+	}{
+		{"canon.com", "", "/a"},
+		{"canon.com", "WWW", "/b"},
+		{"canon.com", "", ""},
+		{"Canon.com", "", "/a"},
+	} {
+		err := db.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?, ?)`,
+			l.dom, LinkBucket(l.subdom, l.path), l.subdom, l.path, "http", walker.NotYetCrawled).Exec()
+		if err != nil {
+			t.Fatalf("Failed to insert link: %v", err)
+		}
+	}
+
+	summarize := func(r *CanonicalizeReport) []string {
+		var s []string
+		for _, m := range r.Merges {
+			s = append(s, fmt.Sprintf("%v %v %v %v", m.Link, m.Canonical, m.Duplicate, m.Repaired))
+		}
+		sort.Strings(s)
+		return s
+	}
+
+	report, err := store.Canonicalize(false)
+	if err != nil {
+		t.Fatalf("Canonicalize failed: %v", err)
+	}
+	if report.Domains != 2 || report.Links != 4 {
+		t.Errorf("Expected 2 domains and 4 links checked, got %d and %d", report.Domains, report.Links)
+	}
+	expected := []string{
+		"http://Canon.com/a http://canon.com/a true false",
+		"http://WWW.canon.com/b http://www.canon.com/b false false",
+		"http://canon.com http://canon.com/ false false",
+	}
+	if got := summarize(report); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Dry run found\n%v\nexpected\n%v", got, expected)
+	}
+	if !reflect.DeepEqual(report.StaleDomains, []string{"Canon.com"}) {
+		t.Errorf("Expected Canon.com to be stale, got %v", report.StaleDomains)
+	}
+
+	report, err = store.Canonicalize(true)
+	if err != nil {
+		t.Fatalf("Canonicalize failed: %v", err)
+	}
+	if report.Repaired() != 3 {
+		t.Errorf("Expected 3 links merged, got %v", summarize(report))
+	}
+
+	report, err = store.Canonicalize(false)
+	if err != nil {
+		t.Fatalf("Canonicalize failed: %v", err)
+	}
+	if len(report.Merges) != 0 || report.Domains != 1 || report.Links != 3 {
+		t.Errorf("Expected 3 canonical links of 1 domain after merging, got %+v (%v)", report, summarize(report))
+	}
+	var subdom string
+	err = db.Query(`SELECT subdom FROM links WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ? AND proto = ?`,
+		"canon.com", LinkBucket("www", "/b"), "www", "/b", "http").Scan(&subdom)
+	if err != nil {
+		t.Errorf("Expected http://www.canon.com/b to be stored: %v", err)
+	}
+}
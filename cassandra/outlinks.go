@@ -0,0 +1,105 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/iParadigms/walker"
+)
+
+// OutlinkProfile is a domain's external link profile, as returned by
+// OutlinkProfile: the other domains its pages link to
+type OutlinkProfile struct {
+	Domain string
+
+	// The domain's pages that have been fetched, and how many of those link
+	// to at least one other domain, as of their latest fetch
+	Pages        int
+	LinkingPages int
+
+	// The domains linked to, most linked from first
+	Domains []*OutlinkDomain
+}
+
+// OutlinkDomain is a domain linked to in an OutlinkProfile
+type OutlinkDomain struct {
+	Domain string
+
+	// The pages linking to it, and their links to it in all
+	Pages int
+	Links int
+}
+
+// OutlinkProfile is documented on the ModelDatastore interface.
+func (ds *Datastore) OutlinkProfile(domain string) (*OutlinkProfile, error) {
+	dinfo, err := ds.FindDomain(domain)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find domain %v: %v", domain, err)
+	} else if dinfo == nil {
+		return nil, walker.NewError(walker.ErrNotFound, fmt.Errorf("Domain %v not found", domain))
+	}
+
+	profile := &OutlinkProfile{Domain: domain}
+	counts := map[string]*OutlinkDomain{}
+
+	// A link's rows come out together, ordered by fetch time, so its latest
+	// fetch is the last of them
+	var last, cur cell
+	var lastDoms, curDoms map[string]int
+	flush := func() {
+		if !last.crawlTime.After(walker.NotYetCrawled) {
+			return
+		}
+		profile.Pages++
+		if len(lastDoms) > 0 {
+			profile.LinkingPages++
+		}
+		for dom, links := range lastDoms {
+			c := counts[dom]
+			if c == nil {
+				c = &OutlinkDomain{Domain: dom}
+				counts[dom] = c
+			}
+			c.Pages++
+			c.Links += links
+		}
+	}
+
+	start := true
+	itr := ds.db.Query(`SELECT subdom, path, proto, time, outlink_doms FROM links
+							WHERE dom = ? AND bucket IN ?`, domain, linkBuckets()).Iter()
+	for itr.Scan(&cur.subdom, &cur.path, &cur.proto, &cur.crawlTime, &curDoms) {
+		if !start && !cur.equivalent(&last) {
+			flush()
+		}
+		last, lastDoms = cur, curDoms
+		curDoms = nil
+		start = false
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read links of %v: %v", domain, err)
+	}
+	if !start {
+		flush()
+	}
+
+	for _, c := range counts {
+		profile.Domains = append(profile.Domains, c)
+	}
+	sort.Sort(outlinkDomainsByPages(profile.Domains))
+	return profile, nil
+}
+
+type outlinkDomainsByPages []*OutlinkDomain
+
+func (l outlinkDomainsByPages) Len() int { return len(l) }
+func (l outlinkDomainsByPages) Less(i, j int) bool {
+	if l[i].Pages != l[j].Pages {
+		return l[i].Pages > l[j].Pages
+	}
+	if l[i].Links != l[j].Links {
+		return l[i].Links > l[j].Links
+	}
+	return l[i].Domain < l[j].Domain
+}
+func (l outlinkDomainsByPages) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
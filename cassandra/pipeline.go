@@ -0,0 +1,137 @@
+package cassandra
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// Pipelined dispatch: a domain may have more than one segment outstanding
+// (dispatcher.max_outstanding_segments, or the domain's own max_segs). While
+// its current segment is being crawled, the dispatcher generates the next ones
+// ahead into pending_segments, and when the fetcher unclaims the domain the
+// lowest numbered one is moved into segments, leaving the domain dispatched
+// and ready to be claimed again without waiting for a dispatch round.
+
+// pipelineDepth returns how many segments may be generated ahead of the one
+// being crawled for a domain of the given priority and max_segs
+func pipelineDepth(priority, maxSegments int) int {
+	if maxSegments > 0 {
+		return maxSegments - 1
+	}
+	if priority < walker.Config.Dispatcher.PipelineMinPriority {
+		return 0
+	}
+	return walker.Config.Dispatcher.MaxOutstandingSegments - 1
+}
+
+// pendingSegmentSeqs returns the numbers of the complete pending segments of
+// domain, lowest first
+func pendingSegmentSeqs(db *gocql.Session, domain string) ([]int, error) {
+	var seqs []int
+	var seq int
+	itr := db.Query(`SELECT seq FROM pending_segment_sizes WHERE dom = ?`, domain).Iter()
+	for itr.Scan(&seq) {
+		seqs = append(seqs, seq)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("error reading pending segments of %v: %v", domain, err)
+	}
+	return seqs, nil
+}
+
+// queuedLinks returns the cell keys of the links in the current and pending
+// segments of domain, so generating another pending segment leaves them out
+func (d *Dispatcher) queuedLinks(domain string) (map[string]bool, error) {
+	queued := map[string]bool{}
+	var c cell
+	for _, table := range []string{"segments", "pending_segments"} {
+		itr := d.db.Query(fmt.Sprintf(`SELECT subdom, path, proto FROM %v WHERE dom = ?`, table), domain).Iter()
+		for itr.Scan(&c.subdom, &c.path, &c.proto) {
+			queued[c.key()] = true
+		}
+		if err := itr.Close(); err != nil {
+			return nil, fmt.Errorf("error reading %v of %v: %v", table, domain, err)
+		}
+	}
+	return queued, nil
+}
+
+// promotePendingSegment moves the lowest numbered pending segment of domain
+// into segments, returning how many links it holds (0 if it has none). The
+// pending segments of an excluded domain are dropped instead.
+func (ds *Datastore) promotePendingSegment(domain string) int {
+	seqs, err := pendingSegmentSeqs(ds.db, domain)
+	if err != nil {
+		log4go.Error("Not promoting a pending segment: %v", err)
+		return 0
+	}
+	if len(seqs) == 0 {
+		return 0
+	}
+
+	var excluded bool
+	err = ds.db.Query(`SELECT excluded FROM domain_info WHERE dom = ?`, domain).Scan(&excluded)
+	if err != nil {
+		log4go.Error("Not promoting a pending segment of %v: %v", domain, err)
+		return 0
+	}
+	if excluded {
+		log4go.Info("Dropping the pending segments of excluded domain %v", domain)
+		dropPendingSegments(ds.db, domain)
+		return 0
+	}
+
+	seq := seqs[0]
+	itr := ds.db.Query(`SELECT subdom, path, proto, time, chain_pos, depth, fnv FROM pending_segments
+						WHERE dom = ? AND seq = ?`, domain, seq).Iter()
+	var subdom, path, proto string
+	var crawled time.Time
+	var chainPos, depth, promoted int
+	var fp int64
+	batch := ds.db.NewBatch(gocql.UnloggedBatch)
+	flush := func() {
+		if batch.Size() == 0 {
+			return
+		}
+		if err := ds.db.ExecuteBatch(batch); err != nil {
+			log4go.Error("Failed to promote %v pending segment links of %v: %v", batch.Size(), domain, err)
+		}
+		batch = ds.db.NewBatch(gocql.UnloggedBatch)
+	}
+	for itr.Scan(&subdom, &path, &proto, &crawled, &chainPos, &depth, &fp) {
+		batch.Query(`INSERT INTO segments (dom, subdom, path, proto, time, chain_pos, depth, fnv)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			domain, subdom, path, proto, crawled, chainPos, depth, fp)
+		promoted++
+		if batch.Size() >= walker.Config.Dispatcher.SegmentBatchSize {
+			flush()
+		}
+	}
+	flush()
+	if err := itr.Close(); err != nil {
+		log4go.Error("Failed reading pending segment %v of %v: %v", seq, domain, err)
+	}
+
+	if err := ds.db.Query(`DELETE FROM pending_segment_sizes WHERE dom = ? AND seq = ?`, domain, seq).Exec(); err != nil {
+		log4go.Error("Failed deleting pending segment %v of %v: %v", seq, domain, err)
+	}
+	if err := ds.db.Query(`DELETE FROM pending_segments WHERE dom = ? AND seq = ?`, domain, seq).Exec(); err != nil {
+		log4go.Error("Failed deleting pending segment %v links of %v: %v", seq, domain, err)
+	}
+	log4go.Info("Queued pending segment %v of %v (%v links)", seq, domain, promoted)
+	return promoted
+}
+
+// dropPendingSegments deletes all the pending segments of domain
+func dropPendingSegments(db *gocql.Session, domain string) {
+	for _, table := range []string{"pending_segment_sizes", "pending_segments"} {
+		err := db.Query(fmt.Sprintf(`DELETE FROM %v WHERE dom = ?`, table), domain).Exec()
+		if err != nil {
+			log4go.Error("Failed deleting %v of %v: %v", table, domain, err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// RedirectInfo is a link that redirected on its latest fetch, as listed by
+// ListRedirects
+type RedirectInfo struct {
+	URL *walker.URL
+
+	// Where the link redirected to, the status it redirected with (0 if it
+	// wasn't recorded) and when
+	Target    string
+	Status    int
+	CrawlTime time.Time
+
+	// The number of fetches in a row the link permanently redirected to
+	// Target (0 if its latest redirect wasn't permanent)
+	Confirmations int
+
+	// True if the link isn't refreshed anymore, having permanently redirected
+	// to Target dispatcher.redirect_confirmations times
+	Settled bool
+}
+
+// ListRedirects is documented on the ModelDatastore interface.
+func (ds *Datastore) ListRedirects(domain string) ([]*RedirectInfo, error) {
+	dinfo, err := ds.FindDomain(domain)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find domain %v: %v", domain, err)
+	} else if dinfo == nil {
+		return nil, walker.NewError(walker.ErrNotFound, fmt.Errorf("Domain %v not found", domain))
+	}
+
+	// A link's rows come out together, ordered by fetch time, so its latest
+	// fetch is the last of them
+	var redirects []*RedirectInfo
+	var last, cur cell
+	flush := func() error {
+		if last.redtoURL == "" {
+			return nil
+		}
+		u, err := walker.CreateURL(domain, last.subdom, last.path, last.proto, last.crawlTime)
+		if err != nil {
+			return err
+		}
+		redirects = append(redirects, &RedirectInfo{
+			URL:           u,
+			Target:        last.redtoURL,
+			Status:        last.redtoStatus,
+			CrawlTime:     last.crawlTime,
+			Confirmations: last.permRedirects,
+			Settled:       last.redirectSettled(),
+		})
+		return nil
+	}
+
+	start := true
+	itr := ds.db.Query(`SELECT subdom, path, proto, time, redto_url, redto_stat FROM links
+							WHERE dom = ? AND bucket IN ?`, domain, linkBuckets()).Iter()
+	for itr.Scan(&cur.subdom, &cur.path, &cur.proto, &cur.crawlTime, &cur.redtoURL, &cur.redtoStatus) {
+		same := !start && cur.equivalent(&last)
+		if same {
+			cur.countRedirects(&last)
+		} else {
+			cur.countRedirects(nil)
+		}
+		if !start && !same {
+			if err := flush(); err != nil {
+				itr.Close()
+				return nil, fmt.Errorf("Failed to list redirect of %v: %v", domain, err)
+			}
+		}
+		last = cur
+		start = false
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read links of %v: %v", domain, err)
+	}
+	if err := flush(); err != nil {
+		return nil, fmt.Errorf("Failed to list redirect of %v: %v", domain, err)
+	}
+
+	sort.Sort(redirectsByLink(redirects))
+	return redirects, nil
+}
+
+type redirectsByLink []*RedirectInfo
+
+func (l redirectsByLink) Len() int           { return len(l) }
+func (l redirectsByLink) Less(i, j int) bool { return l[i].URL.String() < l[j].URL.String() }
+func (l redirectsByLink) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
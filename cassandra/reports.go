@@ -0,0 +1,423 @@
+package cassandra
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// Domain reports are periodic summaries of how the crawl of a domain went
+// (the pages fetched, the links new, broken and changed since the last
+// summary, and the changes watch rules saw), sent to the domain's
+// stakeholders. Who gets them and how often is kept per domain in the
+// domain_reports table (see SetDomainReport, and the console's
+// /reports/{domain} page). A recipient is either an email address, mailed
+// through reports.smtp_server, or an http(s) URL the summary is POSTed to as
+// JSON.
+//
+// Every reports.check_interval each dispatcher sends the reports that are due.
+// A report is claimed with a lightweight transaction on its last sent time
+// before it is sent, so with several dispatchers running each is sent once.
+
+// DomainReport is a recipient of a domain's periodic summary
+type DomainReport struct {
+	Domain    string
+	Recipient string
+
+	// How often the summary is sent
+	Period time.Duration
+
+	// When it was last sent (zero if never), and the error sending it failed
+	// with, if it did
+	LastSent  time.Time
+	LastError string
+}
+
+// IsEmail returns true if the recipient is an email address, rather than a
+// URL to POST to
+func (r *DomainReport) IsEmail() bool {
+	return !strings.HasPrefix(r.Recipient, "http://") && !strings.HasPrefix(r.Recipient, "https://")
+}
+
+// Due returns true if the report should be sent at now
+func (r *DomainReport) Due(now time.Time) bool {
+	return !r.LastSent.Add(r.Period).After(now)
+}
+
+// DomainSummary is how the crawl of a domain went between From and To, as
+// sent in its reports
+type DomainSummary struct {
+	Domain   string
+	From, To time.Time
+
+	// Fetches made between From and To, and the links fetched by To
+	Fetched int
+	Links   int
+
+	// Links first fetched after From, links that answered fine at From but
+	// are gone (404 or 410) at To, and other links whose status changed.
+	// These, and WatchChanges, hold no more than the limit SummarizeDomain is
+	// given; the Num fields count them all.
+	New, Broken, Changed          []*CrawlDiffLink
+	NumNew, NumBroken, NumChanged int
+	WatchChanges                  []*WatchEvent
+	NumWatchChanges               int
+}
+
+// SummarizeDomain is documented on the ModelDatastore interface.
+func (ds *Datastore) SummarizeDomain(domain string, from, to time.Time, limit int) (*DomainSummary, error) {
+	diff, err := ds.DiffCrawls(domain, from, to)
+	if err != nil {
+		return nil, err
+	}
+	s := &DomainSummary{
+		Domain:     domain,
+		From:       from,
+		To:         to,
+		Fetched:    diff.Fetched,
+		Links:      diff.LinksTo,
+		NumNew:     len(diff.New),
+		NumBroken:  len(diff.Disappeared),
+		NumChanged: len(diff.Changed),
+	}
+	s.New = firstDiffLinks(diff.New, limit)
+	s.Broken = firstDiffLinks(diff.Disappeared, limit)
+	s.Changed = firstDiffLinks(diff.Changed, limit)
+
+	for day := auditDay(to); !day.Before(auditDay(from)); day = day.Add(-24 * time.Hour) {
+		itr := ds.db.Query(`SELECT rule, dom, subdom, path, proto, time, prev, cur, expected FROM watch_events
+							WHERE day = ?`, day).Iter()
+		var dom, subdom, path, proto string
+		var e WatchEvent
+		for itr.Scan(&e.Rule, &dom, &subdom, &path, &proto, &e.Time, &e.Previous, &e.Current, &e.Expected) {
+			if dom != domain || !e.Time.After(from) || e.Time.After(to) {
+				continue
+			}
+			s.NumWatchChanges++
+			if len(s.WatchChanges) >= limit {
+				continue
+			}
+			u, err := walker.CreateURL(dom, subdom, path, proto, e.Time)
+			if err != nil {
+				log4go.Error("Failed to create URL for watch event %v: %v", e.Rule, err)
+				continue
+			}
+			event := e
+			event.URL = u
+			s.WatchChanges = append(s.WatchChanges, &event)
+		}
+		if err := itr.Close(); err != nil {
+			return nil, fmt.Errorf("Failed to list watch events for %v: %v", day, err)
+		}
+	}
+	return s, nil
+}
+
+func firstDiffLinks(links []*CrawlDiffLink, limit int) []*CrawlDiffLink {
+	if len(links) > limit {
+		return links[:limit]
+	}
+	return links
+}
+
+// ListDomainReports is documented on the ModelDatastore interface.
+func (ds *Datastore) ListDomainReports(domain string) ([]*DomainReport, error) {
+	q := ds.db.Query(`SELECT dom, rcpt, period, sent, err FROM domain_reports`)
+	if domain != "" {
+		q = ds.db.Query(`SELECT dom, rcpt, period, sent, err FROM domain_reports WHERE dom = ?`, domain)
+	}
+	var reports []*DomainReport
+	itr := q.Iter()
+	var r DomainReport
+	var period int
+	for itr.Scan(&r.Domain, &r.Recipient, &period, &r.LastSent, &r.LastError) {
+		report := r
+		report.Period = time.Duration(period) * time.Second
+		reports = append(reports, &report)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to list domain reports: %v", err)
+	}
+	return reports, nil
+}
+
+// SetDomainReport is documented on the ModelDatastore interface.
+func (ds *Datastore) SetDomainReport(domain, recipient string, period time.Duration) error {
+	if err := checkReportRecipient(recipient); err != nil {
+		return err
+	}
+	if period < time.Hour {
+		return fmt.Errorf("Report period %v is shorter than an hour", period)
+	}
+	dinfo, err := ds.FindDomain(domain)
+	if err != nil {
+		return fmt.Errorf("Failed to find domain %v: %v", domain, err)
+	} else if dinfo == nil {
+		return walker.NewError(walker.ErrNotFound, fmt.Errorf("Domain %v not found", domain))
+	}
+	err = ds.db.Query(`UPDATE domain_reports SET period = ? WHERE dom = ? AND rcpt = ?`,
+		int(period/time.Second), domain, recipient).Exec()
+	if err != nil {
+		return fmt.Errorf("Failed to set report of %v for %v: %v", domain, recipient, err)
+	}
+	return nil
+}
+
+// DeleteDomainReport is documented on the ModelDatastore interface.
+func (ds *Datastore) DeleteDomainReport(domain, recipient string) error {
+	err := ds.db.Query(`DELETE FROM domain_reports WHERE dom = ? AND rcpt = ?`, domain, recipient).Exec()
+	if err != nil {
+		return fmt.Errorf("Failed to delete report of %v for %v: %v", domain, recipient, err)
+	}
+	return nil
+}
+
+// SendDomainReport is documented on the ModelDatastore interface.
+func (ds *Datastore) SendDomainReport(domain, recipient string) error {
+	reports, err := ds.ListDomainReports(domain)
+	if err != nil {
+		return err
+	}
+	for _, r := range reports {
+		if r.Recipient == recipient {
+			return ds.sendReport(r, time.Now())
+		}
+	}
+	return walker.NewError(walker.ErrNotFound, fmt.Errorf("No report of %v for %v", domain, recipient))
+}
+
+// sendDueReports sends every report due at now that no other dispatcher
+// claims first, returning how many were sent
+func (ds *Datastore) sendDueReports(now time.Time) int {
+	reports, err := ds.ListDomainReports("")
+	if err != nil {
+		log4go.Error("Failed to send domain reports: %v", err)
+		return 0
+	}
+	sent := 0
+	for _, r := range reports {
+		if !r.Due(now) {
+			continue
+		}
+		var prev interface{}
+		if !r.LastSent.IsZero() {
+			prev = r.LastSent
+		}
+		applied, err := ds.db.Query(`UPDATE domain_reports SET sent = ? WHERE dom = ? AND rcpt = ? IF sent = ?`,
+			now, r.Domain, r.Recipient, prev).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			log4go.Error("Failed to claim report of %v for %v: %v", r.Domain, r.Recipient, err)
+			continue
+		} else if !applied {
+			log4go.Fine("Report of %v for %v was sent by another dispatcher", r.Domain, r.Recipient)
+			continue
+		}
+		if ds.sendReport(r, now) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// sendReport sends r the summary of its domain since it was last sent (or
+// for its period, the first time), recording when it was sent and any error
+func (ds *Datastore) sendReport(r *DomainReport, now time.Time) error {
+	from := r.LastSent
+	if from.IsZero() {
+		from = now.Add(-r.Period)
+	}
+	s, err := ds.SummarizeDomain(r.Domain, from, now, walker.Config.Reports.MaxLinks)
+	if err == nil {
+		if r.IsEmail() {
+			err = mailReport(r.Recipient, s)
+		} else {
+			err = postReport(r.Recipient, s)
+		}
+	}
+
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+		log4go.Error("Failed to send report of %v to %v: %v", r.Domain, r.Recipient, err)
+	} else {
+		log4go.Info("Sent report of %v to %v", r.Domain, r.Recipient)
+	}
+	if qerr := ds.db.Query(`UPDATE domain_reports SET sent = ?, err = ? WHERE dom = ? AND rcpt = ?`,
+		now, errText, r.Domain, r.Recipient).Exec(); qerr != nil {
+		log4go.Error("Failed to record report of %v for %v: %v", r.Domain, r.Recipient, qerr)
+	}
+	return err
+}
+
+// checkReportRecipient fails unless recipient looks like an email address or
+// an http(s) URL
+func checkReportRecipient(recipient string) error {
+	if strings.HasPrefix(recipient, "http://") || strings.HasPrefix(recipient, "https://") {
+		return nil
+	}
+	at := strings.Index(recipient, "@")
+	if at <= 0 || at == len(recipient)-1 || strings.ContainsAny(recipient, " \t\r\n<>,") {
+		return fmt.Errorf("Report recipient %q is neither an email address nor an http(s) URL", recipient)
+	}
+	return nil
+}
+
+// sendReportMail sends an email, smtp.SendMail unless testing
+var sendReportMail = smtp.SendMail
+
+// reportMailTemplate is the text of report emails, executed with a
+// DomainSummary
+var reportMailTemplate = template.Must(template.New("report").Parse(
+	`Walker crawl summary for {{.Domain}}
+From {{.From.UTC.Format "2006-01-02 15:04 MST"}} to {{.To.UTC.Format "2006-01-02 15:04 MST"}}
+
+Pages fetched:              {{.Fetched}}
+Links crawled:              {{.Links}}
+New links:                  {{.NumNew}}
+Broken links:               {{.NumBroken}}
+Links whose status changed: {{.NumChanged}}
+Watched content changes:    {{.NumWatchChanges}}
+{{if .Broken}}
+Broken links{{if gt .NumBroken (len .Broken)}} (the first {{len .Broken}}){{end}}:
+{{range .Broken}}  {{.URL}} ({{.FromState}} before, now {{.ToState}})
+{{end}}{{end}}{{if .Changed}}
+Changed links{{if gt .NumChanged (len .Changed)}} (the first {{len .Changed}}){{end}}:
+{{range .Changed}}  {{.URL}} ({{.FromState}} before, now {{.ToState}})
+{{end}}{{end}}{{if .WatchChanges}}
+Watched content changes{{if gt .NumWatchChanges (len .WatchChanges)}} (the first {{len .WatchChanges}}){{end}}:
+{{range .WatchChanges}}  {{.URL}} ({{.Rule}}): {{printf "%q" .Previous}} -> {{printf "%q" .Current}}
+{{end}}{{end}}{{if .New}}
+New links{{if gt .NumNew (len .New)}} (the first {{len .New}}){{end}}:
+{{range .New}}  {{.URL}} ({{.ToState}})
+{{end}}{{end}}`))
+
+// mailReport emails s to recipient through reports.smtp_server
+func mailReport(recipient string, s *DomainSummary) error {
+	cfg := &walker.Config.Reports
+	if cfg.SMTPServer == "" {
+		return fmt.Errorf("No reports.smtp_server to send email through")
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", recipient)
+	fmt.Fprintf(&msg, "Subject: Walker crawl summary for %v\r\n", s.Domain)
+	fmt.Fprintf(&msg, "Date: %v\r\n", s.To.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	var body bytes.Buffer
+	if err := reportMailTemplate.Execute(&body, s); err != nil {
+		return fmt.Errorf("Failed to write report: %v", err)
+	}
+	msg.WriteString(strings.Replace(body.String(), "\n", "\r\n", -1))
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host := strings.Split(cfg.SMTPServer, ":")[0]
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return sendReportMail(cfg.SMTPServer, auth, cfg.From, []string{recipient}, msg.Bytes())
+}
+
+// reportLinkJSON is how a link is described in a POSTed report
+type reportLinkJSON struct {
+	URL    string `json:"url"`
+	Before string `json:"before,omitempty"`
+	Now    string `json:"now"`
+}
+
+// postReport POSTs s to link as JSON
+func postReport(link string, s *DomainSummary) error {
+	links := func(l []*CrawlDiffLink) []reportLinkJSON {
+		out := []reportLinkJSON{}
+		for _, dl := range l {
+			out = append(out, reportLinkJSON{URL: dl.URL.String(), Before: dl.FromState(), Now: dl.ToState()})
+		}
+		return out
+	}
+	changes := []map[string]interface{}{}
+	for _, e := range s.WatchChanges {
+		changes = append(changes, map[string]interface{}{
+			"rule":     e.Rule,
+			"url":      e.URL.String(),
+			"time":     e.Time,
+			"previous": e.Previous,
+			"current":  e.Current,
+		})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"domain":            s.Domain,
+		"from":              s.From,
+		"to":                s.To,
+		"fetched":           s.Fetched,
+		"links":             s.Links,
+		"num_new":           s.NumNew,
+		"num_broken":        s.NumBroken,
+		"num_changed":       s.NumChanged,
+		"num_watch_changes": s.NumWatchChanges,
+		"new":               links(s.New),
+		"broken":            links(s.Broken),
+		"changed":           links(s.Changed),
+		"watch_changes":     changes,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to encode report: %v", err)
+	}
+
+	timeout, err := time.ParseDuration(walker.Config.Reports.Timeout)
+	if err != nil {
+		panic(err) // Should not happen since it is parsed at config load
+	}
+	req, err := http.NewRequest("POST", link, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", walker.Config.Fetcher.UserAgent)
+	res, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("%v answered %v", link, res.Status)
+	}
+	return nil
+}
+
+// pollReports sends the domain reports that are due every
+// reports.check_interval until the dispatcher quits. It opens its own
+// Datastore the first time it looks.
+func (d *Dispatcher) pollReports() {
+	ticker := time.NewTicker(d.reportInterval)
+	defer ticker.Stop()
+	var ds *Datastore
+	defer func() {
+		if ds != nil {
+			ds.Close()
+		}
+	}()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+			if ds == nil {
+				var err error
+				ds, err = NewDatastore()
+				if err != nil {
+					log4go.Error("Failed to open datastore to send domain reports: %v", err)
+					ds = nil
+					continue
+				}
+			}
+			ds.sendDueReports(time.Now())
+		}
+	}
+}
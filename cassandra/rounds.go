@@ -0,0 +1,222 @@
+package cassandra
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// Each dispatcher keeps a row of the dispatchers table up to date with its
+// domain iterations (rounds): when the last one started and when the last one
+// finished, and which domains failed to generate in it. A dispatcher whose
+// rounds stop finishing leaves the crawl draining without new segments, so
+// once none has finished for webhooks.round_overdue_time the dispatcher fires
+// WebhookDispatcherRoundOverdue, and ListDispatchers reports it as stalled,
+// even if it is no longer running to say so itself.
+
+const (
+	// dispatcherStatusTTL is how long the row of a dispatcher that stopped
+	// updating it is kept
+	dispatcherStatusTTL = 7 * 24 * 60 * 60
+
+	// roundFailuresLimit is the most failed domains recorded per round
+	roundFailuresLimit = 100
+)
+
+// DispatcherStatus is the round status of a dispatcher, as listed by
+// ListDispatchers
+type DispatcherStatus struct {
+	// The dispatcher's token, unique to each run, and the host it runs on
+	Token gocql.UUID
+	Host  string
+
+	// When the dispatcher started, and how many rounds it has finished
+	Up     time.Time
+	Rounds int
+
+	// When the latest round started, and when the last round to finish did
+	// (zero if none did yet)
+	Started  time.Time
+	Finished time.Time
+
+	// The number of domains generated in the last round to finish, and those
+	// that failed to, mapped to their error (up to roundFailuresLimit of
+	// them)
+	Domains int
+	Failed  map[string]string
+
+	// The error the latest round failed with reading domain_info, "" if it
+	// didn't
+	Error string
+}
+
+// SinceFinished returns how long it has been since the dispatcher last
+// finished a round, or since it started if it has yet to finish one
+func (s *DispatcherStatus) SinceFinished(now time.Time) time.Duration {
+	if s.Finished.IsZero() {
+		return now.Sub(s.Up)
+	}
+	return now.Sub(s.Finished)
+}
+
+// Stalled returns true if the dispatcher hasn't finished a round for
+// webhooks.round_overdue_time (never if that is 0)
+func (s *DispatcherStatus) Stalled(now time.Time) bool {
+	overdue, err := time.ParseDuration(walker.Config.Webhooks.RoundOverdueTime)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	return overdue > 0 && s.SinceFinished(now) >= overdue
+}
+
+// ListDispatchers is documented on the ModelDatastore interface.
+func (ds *Datastore) ListDispatchers() ([]*DispatcherStatus, error) {
+	var statuses []*DispatcherStatus
+	var s DispatcherStatus
+	var errText string
+	itr := ds.db.Query(`SELECT tok, host, up, rounds, started, finished, domains, failed, err
+						FROM dispatchers`).Iter()
+	for itr.Scan(&s.Token, &s.Host, &s.Up, &s.Rounds, &s.Started, &s.Finished, &s.Domains, &s.Failed,
+		&errText) {
+		status := s
+		status.Error = errText
+		statuses = append(statuses, &status)
+		s, errText = DispatcherStatus{}, ""
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read dispatchers: %v", err)
+	}
+	sort.Sort(dispatchersByStart(statuses))
+	return statuses, nil
+}
+
+// dispatchersByStart sorts dispatchers latest started first
+type dispatchersByStart []*DispatcherStatus
+
+func (l dispatchersByStart) Len() int           { return len(l) }
+func (l dispatchersByStart) Less(i, j int) bool { return l[i].Up.After(l[j].Up) }
+func (l dispatchersByStart) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// startRounds records that the dispatcher started, as a new row of the
+// dispatchers table
+func (d *Dispatcher) startRounds() {
+	var err error
+	d.token, err = gocql.RandomUUID()
+	if err != nil {
+		log4go.Error("Failed to create dispatcher token: %v", err)
+	}
+	d.up = time.Now()
+	host, _ := os.Hostname()
+	err = d.db.Query(`INSERT INTO dispatchers (tok, host, up, rounds) VALUES (?, ?, ?, 0) USING TTL ?`,
+		d.token, host, d.up, dispatcherStatusTTL).Exec()
+	if err != nil {
+		log4go.Error("Failed to record dispatcher start: %v", err)
+	}
+}
+
+// startRound records that a round started at start
+func (d *Dispatcher) startRound(start time.Time) {
+	d.iterationMu.Lock()
+	d.iterationStart = start
+	d.iterationStalled = false
+	d.roundDomains = 0
+	d.roundFailed = map[string]string{}
+	d.iterationMu.Unlock()
+
+	err := d.db.Query(`UPDATE dispatchers USING TTL ? SET started = ? WHERE tok = ?`,
+		dispatcherStatusTTL, start, d.token).Exec()
+	if err != nil {
+		log4go.Error("Failed to record dispatcher round start: %v", err)
+	}
+}
+
+// roundGenerated counts a domain generated in this round, failed with err if
+// not nil
+func (d *Dispatcher) roundGenerated(domain string, err error) {
+	d.iterationMu.Lock()
+	defer d.iterationMu.Unlock()
+	d.roundDomains++
+	if err != nil && d.roundFailed != nil && len(d.roundFailed) < roundFailuresLimit {
+		d.roundFailed[domain] = err.Error()
+	}
+}
+
+// finishRound records the end of the running round. It only counts as
+// finished if reading domain_info didn't fail with scanErr.
+func (d *Dispatcher) finishRound(scanErr error) {
+	now := time.Now()
+	d.iterationMu.Lock()
+	d.iterationStart = time.Time{}
+	domains, failed := d.roundDomains, d.roundFailed
+	if scanErr == nil {
+		d.rounds++
+		d.roundFinished = now
+		d.roundOverdue = false
+	}
+	rounds := d.rounds
+	d.iterationMu.Unlock()
+
+	var err error
+	if scanErr != nil {
+		err = d.db.Query(`UPDATE dispatchers USING TTL ? SET err = ? WHERE tok = ?`,
+			dispatcherStatusTTL, scanErr.Error(), d.token).Exec()
+	} else {
+		err = d.db.Query(`UPDATE dispatchers USING TTL ?
+							SET finished = ?, rounds = ?, domains = ?, failed = ?, err = null WHERE tok = ?`,
+			dispatcherStatusTTL, now, rounds, domains, failed, d.token).Exec()
+	}
+	if err != nil {
+		log4go.Error("Failed to record dispatcher round end: %v", err)
+	}
+}
+
+// stopRounds removes the dispatcher's row, so a dispatcher stopped on purpose
+// isn't reported as stalled
+func (d *Dispatcher) stopRounds() {
+	if err := d.db.Query(`DELETE FROM dispatchers WHERE tok = ?`, d.token).Exec(); err != nil {
+		log4go.Error("Failed to remove dispatcher status: %v", err)
+	}
+}
+
+// watchRounds fires the WebhookDispatcherRoundOverdue event when no round has
+// finished for roundOverdueTime (counting from when the dispatcher started),
+// and again after each round that finishes and goes overdue
+func (d *Dispatcher) watchRounds() {
+	ticker := time.NewTicker(d.roundOverdueTime / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+
+		d.iterationMu.Lock()
+		finished := d.roundFinished
+		last := finished
+		if last.IsZero() {
+			last = d.up
+		}
+		since := time.Since(last)
+		overdue := !d.roundOverdue && since >= d.roundOverdueTime
+		if overdue {
+			d.roundOverdue = true
+		}
+		d.iterationMu.Unlock()
+
+		if overdue {
+			msg := fmt.Sprintf("No dispatcher round has finished for %v", since)
+			log4go.Warn(msg)
+			data := map[string]interface{}{"since": since.String()}
+			if !finished.IsZero() {
+				data["finished"] = finished
+			}
+			walker.FireWebhook(walker.NewWebhookEvent(walker.WebhookDispatcherRoundOverdue, "", msg, data))
+		}
+	}
+}
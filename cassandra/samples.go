@@ -0,0 +1,125 @@
+package cassandra
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// The samples table is partitioned by day like audit_log; ListSamples walks
+// back through days until it has enough samples. Since samples expire after
+// cassandra.sample_ttl, it doesn't look further back than that.
+
+// encodeHeaders encodes HTTP headers for a map<text, text> column, joining
+// repeated headers with NUL
+func encodeHeaders(header http.Header) map[string]string {
+	h := map[string]string{}
+	for k, v := range header {
+		h[k] = strings.Join(v, "\000")
+	}
+	return h
+}
+
+// decodeHeaders reverses encodeHeaders
+func decodeHeaders(h map[string]string) http.Header {
+	if h == nil {
+		return nil
+	}
+	header := http.Header{}
+	for k, v := range h {
+		header[k] = strings.Split(v, "\000")
+	}
+	return header
+}
+
+// storeSample records a fetch picked for QA capture
+func (ds *Datastore) storeSample(fr *walker.FetchResults, url *walker.URL, dom, subdom string) {
+	var status int
+	var headers map[string]string
+	if fr.Response != nil {
+		status = fr.Response.StatusCode
+		headers = encodeHeaders(fr.Response.Header)
+	}
+	var fetchErr, parseErr string
+	if fr.FetchError != nil {
+		fetchErr = fr.FetchError.Error()
+	}
+	if fr.ParseError != nil {
+		parseErr = fr.ParseError.Error()
+	}
+
+	err := ds.db.Query(`INSERT INTO samples (day, id, dom, subdom, path, proto, time, stat, mime, headers, body,
+							err, parse_err)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		auditDay(fr.FetchTime), gocql.UUIDFromTime(fr.FetchTime), dom, subdom, url.RequestURI(), url.Scheme,
+		fr.FetchTime, status, fr.MimeType, headers, fr.Body, fetchErr, parseErr, ds.sampleTTL).Exec()
+	if err != nil {
+		log4go.Error("Failed to store sample of %v: %v", url, err)
+	}
+}
+
+// ListSamples is documented on the ModelDatastore interface.
+func (ds *Datastore) ListSamples(limit int) ([]*Sample, error) {
+	var samples []*Sample
+	now := time.Now()
+	oldest := auditDay(now.Add(-time.Duration(ds.sampleTTL) * time.Second))
+	for day := auditDay(now); !day.Before(oldest) && len(samples) < limit; day = day.Add(-24 * time.Hour) {
+		itr := ds.db.Query(`SELECT id, dom, subdom, path, proto, time, stat, mime, err, parse_err FROM samples
+							WHERE day = ? LIMIT ?`, day, limit-len(samples)).Iter()
+		for {
+			s, ok := scanSample(itr, false)
+			if !ok {
+				break
+			}
+			if s != nil {
+				samples = append(samples, s)
+			}
+		}
+		if err := itr.Close(); err != nil {
+			return samples, fmt.Errorf("Failed to list samples for %v: %v", day, err)
+		}
+	}
+	return samples, nil
+}
+
+// FindSample is documented on the ModelDatastore interface.
+func (ds *Datastore) FindSample(id gocql.UUID) (*Sample, error) {
+	itr := ds.db.Query(`SELECT id, dom, subdom, path, proto, time, stat, mime, err, parse_err, headers, body
+						FROM samples WHERE day = ? AND id = ?`, auditDay(id.Time()), id).Iter()
+	s, _ := scanSample(itr, true)
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to find sample %v: %v", id, err)
+	}
+	return s, nil
+}
+
+// scanSample scans the next row of a samples query selecting id, dom,
+// subdom, path, proto, time, stat, mime, err and parse_err, followed by
+// headers and body if withContent is set. ok is false once there are no more
+// rows; the sample is nil if its row was bad.
+func scanSample(itr *gocql.Iter, withContent bool) (*Sample, bool) {
+	s := &Sample{}
+	var dom, subdom, path, proto string
+	var headers map[string]string
+	dest := []interface{}{&s.ID, &dom, &subdom, &path, &proto, &s.Time, &s.Status, &s.MimeType,
+		&s.FetchError, &s.ParseError}
+	if withContent {
+		dest = append(dest, &headers, &s.Body)
+	}
+	if !itr.Scan(dest...) {
+		return nil, false
+	}
+	u, err := walker.CreateURL(dom, subdom, path, proto, s.Time)
+	if err != nil {
+		log4go.Error("Failed to create URL for sample %v: %v", s.ID, err)
+		return nil, true
+	}
+	s.URL = u
+	s.Headers = decodeHeaders(headers)
+	return s, true
+}
@@ -0,0 +1,155 @@
+package cassandra
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/iParadigms/walker"
+)
+
+// Domains with more links than dispatcher.sampling_threshold are dispatched
+// in sampling mode: rather than working through their links in order, each
+// segment is a stratified random sample of the links due to be crawled, the
+// strata being the first segments of the links' paths. That way every round
+// covers the breadth of the site, in proportion to the size of each part of
+// it, even though full coverage isn't feasible.
+
+// samplingOverflowStratum holds the links of strata found once a linkSampler
+// is tracking as many strata as it has room for
+const samplingOverflowStratum = "\x00overflow"
+
+// pathStratum returns the stratum a link with the given path (and query) is
+// sampled in: the path's first segment, or "" for links at the root
+func pathStratum(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.IndexAny(path, "/?"); i >= 0 {
+		if path[i] == '?' {
+			// A page at the root, like /index.html?page=2
+			return ""
+		}
+		return path[:i]
+	}
+	return ""
+}
+
+// linkSampler picks a stratified random sample of the links added to it. It
+// keeps a uniform random sample (a reservoir) of up to size links for each of
+// up to size strata, so its memory use is bounded however many links a domain
+// has.
+type linkSampler struct {
+	size   int
+	rng    *rand.Rand
+	strata map[string]*linkStratum
+}
+
+type linkStratum struct {
+	name  string
+	seen  int
+	links []walker.CompactURL
+}
+
+func newLinkSampler(size int) *linkSampler {
+	return &linkSampler{
+		size:   size,
+		rng:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		strata: map[string]*linkStratum{},
+	}
+}
+
+// add offers cu, a link with the given path, for sampling
+func (s *linkSampler) add(path string, cu walker.CompactURL) {
+	name := pathStratum(path)
+	st := s.strata[name]
+	if st == nil {
+		if len(s.strata) >= s.size {
+			name = samplingOverflowStratum
+			st = s.strata[name]
+		}
+		if st == nil {
+			st = &linkStratum{name: name}
+			s.strata[name] = st
+		}
+	}
+
+	st.seen++
+	if len(st.links) < s.size {
+		st.links = append(st.links, cu)
+	} else if i := s.rng.Intn(st.seen); i < s.size {
+		st.links[i] = cu
+	}
+}
+
+// sample returns up to n of the links added. Each stratum gets one link
+// (strata picked at random if there are more than n), then the remaining
+// room is shared out in proportion to the number of links each stratum had
+// beyond the first.
+func (s *linkSampler) sample(n int) []walker.CompactURL {
+	strata := make([]*linkStratum, 0, len(s.strata))
+	for _, st := range s.strata {
+		strata = append(strata, st)
+	}
+	// Sort before shuffling, so the order doesn't depend on map iteration
+	sort.Sort(stratumsByName(strata))
+	for i := len(strata) - 1; i > 0; i-- {
+		j := s.rng.Intn(i + 1)
+		strata[i], strata[j] = strata[j], strata[i]
+	}
+
+	shares := make([]int, len(strata))
+	room, rest := n, 0
+	for i, st := range strata {
+		if room == 0 {
+			break
+		}
+		shares[i] = 1
+		room--
+		rest += st.seen - 1
+	}
+	if room > 0 && rest > 0 {
+		// Largest remainder allocation of what's left
+		type remainder struct {
+			i    int
+			frac float64
+		}
+		var rems []remainder
+		given := 0
+		for i, st := range strata {
+			exact := float64(room) * float64(st.seen-1) / float64(rest)
+			shares[i] += int(exact)
+			given += int(exact)
+			rems = append(rems, remainder{i, exact - float64(int(exact))})
+		}
+		sort.SliceStable(rems, func(a, b int) bool { return rems[a].frac > rems[b].frac })
+		for _, r := range rems[:room-given] {
+			shares[r.i]++
+		}
+	}
+
+	// Strata whose reservoirs hold fewer links than their share leave room
+	// that the others fill
+	var links, spare []walker.CompactURL
+	for i, st := range strata {
+		s.rng.Shuffle(len(st.links), func(a, b int) { st.links[a], st.links[b] = st.links[b], st.links[a] })
+		take := shares[i]
+		if take > len(st.links) {
+			take = len(st.links)
+		}
+		links = append(links, st.links[:take]...)
+		spare = append(spare, st.links[take:]...)
+	}
+	s.rng.Shuffle(len(spare), func(a, b int) { spare[a], spare[b] = spare[b], spare[a] })
+	for len(links) < n && len(spare) > 0 {
+		links = append(links, spare[0])
+		spare = spare[1:]
+	}
+	return links
+}
+
+// stratumsByName sorts strata by name
+type stratumsByName []*linkStratum
+
+func (s stratumsByName) Len() int           { return len(s) }
+func (s stratumsByName) Less(i, j int) bool { return s[i].name < s[j].name }
+func (s stratumsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,97 @@
+//go:build cassandra
+// +build cassandra
+
+package cassandra
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/iParadigms/walker"
+)
+
+func TestPathStratum(t *testing.T) {
+	tests := map[string]string{
+		"/":                      "",
+		"/index.html":            "",
+		"/index.html?page=2":     "",
+		"/products/shoes/1.html": "products",
+		"/blog/":                 "blog",
+		"/blog?x=/y":             "",
+		"/search/?q=1":           "search",
+	}
+	for path, expected := range tests {
+		if got := pathStratum(path); got != expected {
+			t.Errorf("pathStratum(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+}
+
+func TestLinkSampler(t *testing.T) {
+	hosts := walker.NewHostTable()
+	s := newLinkSampler(10)
+	counts := map[string]int{"products": 900, "blog": 90, "about": 9, "": 1}
+	for stratum, n := range counts {
+		for i := 0; i < n; i++ {
+			path := fmt.Sprintf("/%v/%d.html", stratum, i)
+			if stratum == "" {
+				path = fmt.Sprintf("/%d.html", i)
+			}
+			s.add(path, hosts.Compact(walker.MustParse("http://test.com"+path)))
+		}
+	}
+
+	sampled := map[string]int{}
+	for _, cu := range s.sample(10) {
+		u, err := hosts.Expand(cu)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sampled[pathStratum(u.RequestURI())]++
+	}
+	// Every stratum gets one link, and the other 6 are shared 899:89:8:0,
+	// which is 5.42, 0.54, 0.05 and 0 links, rounded by largest remainder
+	expected := map[string]int{"products": 6, "blog": 2, "about": 1, "": 1}
+	for stratum, n := range expected {
+		if sampled[stratum] != n {
+			t.Errorf("Expected %d links sampled from %q, got %d (%v)", n, stratum, sampled[stratum], sampled)
+		}
+	}
+
+	// Small strata leave room for others, and a sample never repeats links
+	s = newLinkSampler(10)
+	for i := 0; i < 3; i++ {
+		s.add(fmt.Sprintf("/a/%d", i), hosts.Compact(walker.MustParse(fmt.Sprintf("http://test.com/a/%d", i))))
+	}
+	s.add("/b/0", hosts.Compact(walker.MustParse("http://test.com/b/0")))
+	links := s.sample(10)
+	seen := map[string]bool{}
+	for _, cu := range links {
+		u, _ := hosts.Expand(cu)
+		seen[u.String()] = true
+	}
+	if len(links) != 4 || len(seen) != 4 {
+		t.Errorf("Expected all 4 links once each, got %d links (%v)", len(links), seen)
+	}
+
+	// With more strata than room, each link comes from a different stratum
+	s = newLinkSampler(10)
+	for i := 0; i < 20; i++ {
+		for j := 0; j < 5; j++ {
+			path := fmt.Sprintf("/s%d/%d", i, j)
+			s.add(path, hosts.Compact(walker.MustParse("http://test.com"+path)))
+		}
+	}
+	strata := map[string]bool{}
+	links = s.sample(5)
+	for _, cu := range links {
+		u, _ := hosts.Expand(cu)
+		strata[pathStratum(u.RequestURI())] = true
+	}
+	if len(links) != 5 || len(strata) != 5 {
+		t.Errorf("Expected 5 links from 5 strata, got %d links from %v", len(links), strata)
+	}
+	if len(s.strata) != 11 || s.strata[samplingOverflowStratum] == nil {
+		t.Errorf("Expected 10 strata plus the overflow, got %d", len(s.strata))
+	}
+}
@@ -0,0 +1,59 @@
+package cassandra
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// storeScreenshot records the screenshot taken of a fetched page
+func (ds *Datastore) storeScreenshot(shot *walker.Screenshot, url *walker.URL, dom, subdom string) {
+	err := ds.db.Query(`INSERT INTO screenshots (dom, subdom, path, proto, time, mime, image, thumb)
+						VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		dom, subdom, url.RequestURI(), url.Scheme, shot.Time, shot.MimeType, shot.Image, shot.Thumbnail).Exec()
+	if err != nil {
+		log4go.Error("Failed to store screenshot of %v: %v", url, err)
+	}
+}
+
+// ListScreenshots is documented on the ModelDatastore interface.
+func (ds *Datastore) ListScreenshots(u *walker.URL) ([]*walker.Screenshot, error) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return nil, err
+	}
+	itr := ds.db.Query(`SELECT time, mime FROM screenshots
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+		dom, subdom, u.RequestURI(), u.Scheme).Iter()
+	var shots []*walker.Screenshot
+	var shot walker.Screenshot
+	for itr.Scan(&shot.Time, &shot.MimeType) {
+		s := shot
+		shots = append(shots, &s)
+	}
+	if err := itr.Close(); err != nil {
+		return shots, fmt.Errorf("Failed to list screenshots of %v: %v", u, err)
+	}
+	return shots, nil
+}
+
+// FindScreenshot is documented on the ModelDatastore interface.
+func (ds *Datastore) FindScreenshot(u *walker.URL, at time.Time) (*walker.Screenshot, error) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return nil, err
+	}
+	shot := &walker.Screenshot{}
+	err = ds.db.Query(`SELECT time, mime, image, thumb FROM screenshots
+						WHERE dom = ? AND subdom = ? AND path = ? AND proto = ? AND time = ?`,
+		dom, subdom, u.RequestURI(), u.Scheme, at).Scan(&shot.Time, &shot.MimeType, &shot.Image, &shot.Thumbnail)
+	if err == gocql.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to find screenshot of %v at %v: %v", u, at, err)
+	}
+	return shot, nil
+}
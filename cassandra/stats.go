@@ -0,0 +1,244 @@
+package cassandra
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// FetchRateWindow is how far back the dispatcher looks when counting a
+// domain's recently crawled links (DomainInfo.NumberLinksRecent). Fetch rates,
+// and so projections, are averages over this window.
+const FetchRateWindow = 24 * time.Hour
+
+// Projection estimates how long it will take to crawl a backlog of links at
+// the current fetch rate.
+type Projection struct {
+	// Number of links not yet crawled
+	Backlog int
+
+	// Links crawled per hour over the last FetchRateWindow
+	Rate float64
+
+	// How long crawling the backlog should take at Rate. Zero if there is no
+	// backlog, or if the crawl is stalled.
+	ETA time.Duration
+
+	// True if there is a backlog but nothing has been crawled recently, so no
+	// ETA can be given
+	Stalled bool
+}
+
+func newProjection(backlog int, rate float64) Projection {
+	p := Projection{Backlog: backlog, Rate: rate}
+	if backlog > 0 {
+		if rate > 0 {
+			p.ETA = time.Duration(float64(backlog) / rate * float64(time.Hour))
+		} else {
+			p.Stalled = true
+		}
+	}
+	return p
+}
+
+// String returns the ETA rounded to the minute, or why there isn't one
+func (p Projection) String() string {
+	switch {
+	case p.Stalled:
+		return "stalled"
+	case p.Backlog == 0:
+		return "done"
+	}
+	return ((p.ETA + time.Minute - 1) / time.Minute * time.Minute).String()
+}
+
+// Projection returns the projected time to crawl this domain's uncrawled
+// links. Excluded domains are never crawled, so have no backlog.
+func (d *DomainInfo) Projection() Projection {
+	if d.Excluded {
+		return Projection{}
+	}
+	return newProjection(d.NumberLinksUncrawled, float64(d.NumberLinksRecent)/FetchRateWindow.Hours())
+}
+
+// DomainProjection is the Projection for one domain
+type DomainProjection struct {
+	Domain string
+	Projection
+}
+
+// CrawlProjection projects how long the whole crawl will take to get through
+// its backlog
+type CrawlProjection struct {
+	// The backlog and fetch rate summed over all domains. The ETA is the
+	// longer of the time to crawl the total backlog at the total rate, and the
+	// slowest domain's ETA, since a domain is only ever crawled by one fetcher
+	// at a time.
+	Projection
+
+	// Number of domains, and how many of them have a backlog or are stalled
+	Domains            int
+	DomainsWithBacklog int
+	DomainsStalled     int
+
+	// Number of fetchers currently running
+	ActiveFetchers int
+
+	// The domains that will take longest to crawl, stalled ones first
+	Slowest []DomainProjection
+}
+
+// FetchersNeeded returns how many fetchers would be needed to get through the
+// backlog within d, assuming each fetcher crawls as fast as the current ones
+// do on average. It returns 0 if that can't be estimated because nothing is
+// being crawled. Note that more fetchers won't speed up domains that are
+// limited by their crawl delay.
+func (p *CrawlProjection) FetchersNeeded(d time.Duration) int {
+	if p.Rate <= 0 || p.ActiveFetchers <= 0 || d <= 0 {
+		return 0
+	}
+	perFetcher := p.Rate / float64(p.ActiveFetchers)
+	return int(math.Ceil(float64(p.Backlog) / (perFetcher * d.Hours())))
+}
+
+// slowestProjections sorts stalled domains first, then by descending ETA
+type slowestProjections []DomainProjection
+
+func (s slowestProjections) Len() int      { return len(s) }
+func (s slowestProjections) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s slowestProjections) Less(i, j int) bool {
+	if s[i].Stalled != s[j].Stalled {
+		return s[i].Stalled
+	}
+	if s[i].ETA != s[j].ETA {
+		return s[i].ETA > s[j].ETA
+	}
+	return s[i].Domain < s[j].Domain
+}
+
+// ProjectCrawl is documented on the ModelDatastore interface.
+func (ds *Datastore) ProjectCrawl(slowest int) (*CrawlProjection, error) {
+	cp := &CrawlProjection{}
+	var rate float64
+	var domains slowestProjections
+	var slowestETA time.Duration
+
+	itr := ds.db.Query(`SELECT ` + domainInfoColumns + ` FROM domain_info`).Iter()
+	for dinfo := scanDomainInfo(itr); dinfo != nil; dinfo = scanDomainInfo(itr) {
+		cp.Domains++
+		p := dinfo.Projection()
+		cp.Backlog += p.Backlog
+		rate += p.Rate
+		if p.Backlog == 0 {
+			continue
+		}
+		cp.DomainsWithBacklog++
+		if p.Stalled {
+			cp.DomainsStalled++
+		}
+		if p.ETA > slowestETA {
+			slowestETA = p.ETA
+		}
+
+		if slowest > 0 {
+			domains = append(domains, DomainProjection{Domain: dinfo.Domain, Projection: p})
+			if len(domains) >= 2*slowest {
+				sort.Sort(domains)
+				domains = domains[:slowest]
+			}
+		}
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read domain_info for projection: %v", err)
+	}
+
+	sort.Sort(domains)
+	if len(domains) > slowest {
+		domains = domains[:slowest]
+	}
+	cp.Slowest = domains
+
+	cp.Projection = newProjection(cp.Backlog, rate)
+	if cp.ETA < slowestETA {
+		cp.ETA = slowestETA
+	}
+
+	itr = ds.db.Query(`SELECT tok FROM active_fetchers`).Iter()
+	var tok gocql.UUID
+	for itr.Scan(&tok) {
+		cp.ActiveFetchers++
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read active_fetchers for projection: %v", err)
+	}
+
+	return cp, nil
+}
+
+// bySubdomainLinks sorts subdomains by descending link count
+type bySubdomainLinks []*SubdomainStats
+
+func (s bySubdomainLinks) Len() int      { return len(s) }
+func (s bySubdomainLinks) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySubdomainLinks) Less(i, j int) bool {
+	if s[i].NumberLinksTotal != s[j].NumberLinksTotal {
+		return s[i].NumberLinksTotal > s[j].NumberLinksTotal
+	}
+	return s[i].Subdomain < s[j].Subdomain
+}
+
+// bySubdomainErrorRate sorts subdomains by descending error rate
+type bySubdomainErrorRate []*SubdomainStats
+
+func (s bySubdomainErrorRate) Len() int      { return len(s) }
+func (s bySubdomainErrorRate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySubdomainErrorRate) Less(i, j int) bool {
+	if s[i].ErrorRate() != s[j].ErrorRate() {
+		return s[i].ErrorRate() > s[j].ErrorRate()
+	}
+	return bySubdomainLinks(s).Less(i, j)
+}
+
+// topSubdomains returns the n subdomains with the most links, plus the n
+// (other) subdomains with the highest error rates, most links first
+func topSubdomains(stats map[string]*SubdomainStats, n int) []*SubdomainStats {
+	var all []*SubdomainStats
+	for _, s := range stats {
+		all = append(all, s)
+	}
+	if len(all) <= n {
+		sort.Sort(bySubdomainLinks(all))
+		return all
+	}
+
+	sort.Sort(bySubdomainLinks(all))
+	top := append([]*SubdomainStats{}, all[:n]...)
+	rest := all[n:]
+	sort.Sort(bySubdomainErrorRate(rest))
+	for i := 0; i < n && i < len(rest) && rest[i].ErrorRate() > 0; i++ {
+		top = append(top, rest[i])
+	}
+	sort.Sort(bySubdomainLinks(top))
+	return top
+}
+
+// ListSubdomainStats is documented on the ModelDatastore interface.
+func (ds *Datastore) ListSubdomainStats(domain string) ([]*SubdomainStats, error) {
+	itr := ds.db.Query(`SELECT subdom, tot_links, uncrawled_links, error_links
+						FROM subdomain_stats WHERE dom = ?`, domain).Iter()
+	var stats []*SubdomainStats
+	var s SubdomainStats
+	for itr.Scan(&s.Subdomain, &s.NumberLinksTotal, &s.NumberLinksUncrawled, &s.NumberLinksFailed) {
+		s.Domain = domain
+		sc := s
+		stats = append(stats, &sc)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read subdomain_stats for %v: %v", domain, err)
+	}
+	sort.Sort(bySubdomainLinks(stats))
+	return stats, nil
+}
@@ -0,0 +1,87 @@
+package cassandra
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// The surrogate_keys table maps each surrogate key handlers give pages to the
+// pages given it. A fetch re-tagging a page moves its row's time forward, but
+// nothing removes the key from a page that stops being given it, since the
+// datastore doesn't know the keys a page had before. Instead
+// ListSurrogateKeyLinks drops (and deletes) rows that are older than a later
+// successful fetch of their page: that fetch was handled without the key.
+
+// storeSurrogateKeys records the SurrogateKeys of fr
+func (ds *Datastore) storeSurrogateKeys(fr *walker.FetchResults, url *walker.URL, dom, subdom string) {
+	seen := map[string]bool{}
+	for _, key := range fr.SurrogateKeys {
+		key = strings.TrimSpace(key)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		err := ds.db.Query(`INSERT INTO surrogate_keys (key, dom, subdom, path, proto, time)
+							VALUES (?, ?, ?, ?, ?, ?)`,
+			key, dom, subdom, url.RequestURI(), url.Scheme, fr.FetchTime).Exec()
+		if err != nil {
+			log4go.Error("Failed to store surrogate key %q of %v: %v", key, url, err)
+		}
+	}
+}
+
+// ListSurrogateKeyLinks is documented on the ModelDatastore interface.
+func (ds *Datastore) ListSurrogateKeyLinks(key string, limit int) ([]*SurrogateKeyLink, error) {
+	itr := ds.db.Query(`SELECT dom, subdom, path, proto, time FROM surrogate_keys WHERE key = ?`, key).Iter()
+	var candidates []*SurrogateKeyLink
+	var dom, subdom, path, proto string
+	var l SurrogateKeyLink
+	for itr.Scan(&dom, &subdom, &path, &proto, &l.Tagged) {
+		u, err := walker.CreateURL(dom, subdom, path, proto, l.Tagged)
+		if err != nil {
+			log4go.Error("Failed to create URL for surrogate key %q: %v", key, err)
+			continue
+		}
+		link := l
+		link.URL = u
+		candidates = append(candidates, &link)
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to list links with surrogate key %q: %v", key, err)
+	}
+
+	var links []*SurrogateKeyLink
+	for _, l := range candidates {
+		if limit > 0 && len(links) >= limit {
+			break
+		}
+		latest, err := ds.FindLink(l.URL, false)
+		if err != nil {
+			return links, fmt.Errorf("Failed to find %v: %v", l.URL, err)
+		}
+		if latest != nil && latest.Status == http.StatusOK && latest.CrawlTime.After(l.Tagged) {
+			log4go.Fine("Dropping surrogate key %q of %v, it was since fetched without it", key, l.URL)
+			ds.deleteSurrogateKey(key, l.URL)
+			continue
+		}
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+// deleteSurrogateKey removes key from the page u
+func (ds *Datastore) deleteSurrogateKey(key string, u *walker.URL) {
+	dom, subdom, err := u.TLDPlusOneAndSubdomain()
+	if err != nil {
+		return
+	}
+	err = ds.db.Query(`DELETE FROM surrogate_keys WHERE key = ? AND dom = ? AND subdom = ? AND path = ? AND proto = ?`,
+		key, dom, subdom, u.RequestURI(), u.Scheme).Exec()
+	if err != nil {
+		log4go.Error("Failed to delete surrogate key %q of %v: %v", key, u, err)
+	}
+}
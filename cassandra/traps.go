@@ -0,0 +1,372 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// Trap escape (see walker.TrapEscapeConfirm and dispatcher.trap_escape): as
+// the dispatcher scans a domain's links, a trapDetector counts the uncrawled
+// links of each path with a query string, and how many distinct values each
+// of their parameters takes. If one path has most of the domain's uncrawled
+// links, its rule is stored in param_rules. Active rules are applied both
+// when links are stored (StoreParsedURL stores new links collapsed) and when
+// they are dispatched (links found before the rule are left in links, but
+// their collapsed link is dispatched in their place), so rejecting a rule
+// later loses nothing.
+
+// The ParamRule statuses
+const (
+	// Synthesized, waiting for an operator to confirm it
+	ParamRuleProposed = "proposed"
+
+	// Collapsing links
+	ParamRuleActive = "active"
+
+	// Rejected by an operator; the path isn't proposed again
+	ParamRuleRejected = "rejected"
+)
+
+const (
+	// trapMaxPaths is the most paths a trapDetector counts per domain scan
+	trapMaxPaths = 10000
+
+	// trapMaxValues is the most distinct values a trapDetector tracks per
+	// path parameter; parameters taking more are unbounded
+	trapMaxValues = 100
+
+	// paramRulesCacheTTL is how long the Datastore keeps the active rules of
+	// a domain before reading them again
+	paramRulesCacheTTL = time.Minute
+)
+
+// ParamRule collapses the query strings of the links on one path of a
+// domain, to escape a crawler trap
+type ParamRule struct {
+	Domain    string
+	Subdomain string
+
+	// The path the rule applies to, without query string
+	Path string
+
+	// The query parameters dropped from the path's links, sorted; empty drops
+	// the whole query string
+	Params []string
+
+	// One of ParamRuleProposed, ParamRuleActive or ParamRuleRejected
+	Status string
+
+	// The number of uncrawled links on the path when the rule was
+	// synthesized, and when that was
+	Links   int
+	Created time.Time
+}
+
+// Host returns the host the rule applies to
+func (r *ParamRule) Host() string {
+	if r.Subdomain == "" {
+		return r.Domain
+	}
+	return r.Subdomain + "." + r.Domain
+}
+
+// Collapse returns request URI uri with the rule's parameters dropped, and
+// false if it had none of them or isn't on the rule's path
+func (r *ParamRule) Collapse(uri string) (string, bool) {
+	if trapPathOf(uri) != r.Path {
+		return uri, false
+	}
+	return walker.CollapseQuery(uri, r.Params)
+}
+
+// trapPathOf returns request URI uri without its query string
+func trapPathOf(uri string) string {
+	if i := strings.Index(uri, "?"); i >= 0 {
+		return uri[:i]
+	}
+	return uri
+}
+
+func paramRuleKey(subdom, path string) string {
+	return subdom + "\x00" + path
+}
+
+// readParamRules reads the rules of domain, or of all domains if domain is
+// empty
+func readParamRules(db *gocql.Session, domain string) ([]*ParamRule, error) {
+	var itr *gocql.Iter
+	if domain == "" {
+		itr = db.Query(`SELECT dom, subdom, path, params, status, links, created FROM param_rules`).Iter()
+	} else {
+		itr = db.Query(`SELECT dom, subdom, path, params, status, links, created FROM param_rules
+							WHERE dom = ?`, domain).Iter()
+	}
+	var rules []*ParamRule
+	var r ParamRule
+	for itr.Scan(&r.Domain, &r.Subdomain, &r.Path, &r.Params, &r.Status, &r.Links, &r.Created) {
+		rule := r
+		rules = append(rules, &rule)
+		r = ParamRule{}
+	}
+	if err := itr.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to read param rules: %v", err)
+	}
+	return rules, nil
+}
+
+// ListParamRules is documented on the ModelDatastore interface.
+func (ds *Datastore) ListParamRules(domain string) ([]*ParamRule, error) {
+	rules, err := readParamRules(ds.db, domain)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(paramRulesByStatus(rules))
+	return rules, nil
+}
+
+// SetParamRuleStatus is documented on the ModelDatastore interface.
+func (ds *Datastore) SetParamRuleStatus(domain, subdomain, path, status string) error {
+	switch status {
+	case ParamRuleProposed, ParamRuleActive, ParamRuleRejected:
+	default:
+		return fmt.Errorf("Bad param rule status %q", status)
+	}
+	var links int
+	err := ds.db.Query(`SELECT links FROM param_rules WHERE dom = ? AND subdom = ? AND path = ?`,
+		domain, subdomain, path).Scan(&links)
+	if err == gocql.ErrNotFound {
+		return walker.NewError(walker.ErrNotFound,
+			fmt.Errorf("No param rule for %v on %v.%v", path, subdomain, domain))
+	} else if err != nil {
+		return fmt.Errorf("Failed to find param rule for %v on %v.%v: %v", path, subdomain, domain, err)
+	}
+	err = ds.db.Query(`UPDATE param_rules SET status = ? WHERE dom = ? AND subdom = ? AND path = ?`,
+		status, domain, subdomain, path).Exec()
+	if err != nil {
+		return fmt.Errorf("Failed to set param rule for %v on %v.%v %v: %v", path, subdomain, domain, status, err)
+	}
+	if ds.paramRules != nil {
+		ds.paramRules.Remove(domain)
+	}
+	return nil
+}
+
+// cachedParamRules are the active rules of a domain, by paramRuleKey
+type cachedParamRules struct {
+	rules map[string]*ParamRule
+	read  time.Time
+}
+
+// activeParamRules returns the active rules of domain, by paramRuleKey,
+// reading them again if they were cached longer than paramRulesCacheTTL ago
+func (ds *Datastore) activeParamRules(domain string) map[string]*ParamRule {
+	if c, ok := ds.paramRules.Get(domain); ok && time.Since(c.(*cachedParamRules).read) < paramRulesCacheTTL {
+		return c.(*cachedParamRules).rules
+	}
+	rules, err := readParamRules(ds.db, domain)
+	if err != nil {
+		log4go.Error("Failed to read param rules of %v: %v", domain, err)
+		return nil
+	}
+	active := map[string]*ParamRule{}
+	for _, r := range rules {
+		if r.Status == ParamRuleActive {
+			active[paramRuleKey(r.Subdomain, r.Path)] = r
+		}
+	}
+	ds.paramRules.Add(domain, &cachedParamRules{rules: active, read: time.Now()})
+	return active
+}
+
+// collapseTrapped returns u collapsed by the active rule of its path, or u
+// itself if there is none (or trap escape is off)
+func (ds *Datastore) collapseTrapped(u *walker.URL, dom, subdom string) *walker.URL {
+	if ds.paramRules == nil || u.RawQuery == "" {
+		return u
+	}
+	uri := u.RequestURI()
+	rule := ds.activeParamRules(dom)[paramRuleKey(subdom, trapPathOf(uri))]
+	if rule == nil {
+		return u
+	}
+	collapsed, ok := rule.Collapse(uri)
+	if !ok {
+		return u
+	}
+	c := u.Clone()
+	c.RawQuery = strings.TrimPrefix(collapsed[len(rule.Path):], "?")
+	log4go.Fine("Collapsed trapped link %v to %v", u, c)
+	return c
+}
+
+// trapPath counts the uncrawled links of a path with a query string
+type trapPath struct {
+	links int
+
+	// The distinct values of each parameter, until there are more than
+	// trapMaxValues of them and the parameter is in unbounded instead
+	values    map[string]map[string]bool
+	unbounded map[string]bool
+}
+
+// trapDetector looks for the path dominating the uncrawled links of a domain
+type trapDetector struct {
+	paths map[string]*trapPath
+}
+
+func newTrapDetector() *trapDetector {
+	return &trapDetector{paths: map[string]*trapPath{}}
+}
+
+// add counts the uncrawled link at request URI uri of subdomain subdom
+func (t *trapDetector) add(subdom, uri string) {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return
+	}
+	key := paramRuleKey(subdom, uri[:i])
+	p := t.paths[key]
+	if p == nil {
+		if len(t.paths) >= trapMaxPaths {
+			return
+		}
+		p = &trapPath{values: map[string]map[string]bool{}, unbounded: map[string]bool{}}
+		t.paths[key] = p
+	}
+	p.links++
+	for _, pair := range strings.Split(uri[i+1:], "&") {
+		name, value := pair, ""
+		if j := strings.Index(pair, "="); j >= 0 {
+			name, value = pair[:j], pair[j+1:]
+		}
+		if name == "" || p.unbounded[name] {
+			continue
+		}
+		values := p.values[name]
+		if values == nil {
+			values = map[string]bool{}
+			p.values[name] = values
+		}
+		values[value] = true
+		if len(values) > trapMaxValues {
+			delete(p.values, name)
+			p.unbounded[name] = true
+		}
+	}
+}
+
+// detect returns a rule for the path with the most links, if it has at least
+// dispatcher.trap_min_links links and dispatcher.trap_dominance of the
+// domain's uncrawled links, or nil. The rule collapses the parameters taking
+// a distinct value on at least half of the path's links, or all of them if
+// none does (the query strings are then combinations of bounded values).
+func (t *trapDetector) detect(domain string, uncrawled int) *ParamRule {
+	var top string
+	var most *trapPath
+	for key, p := range t.paths {
+		if most == nil || p.links > most.links || (p.links == most.links && key < top) {
+			top, most = key, p
+		}
+	}
+	if most == nil || most.links < walker.Config.Dispatcher.TrapMinLinks ||
+		float64(most.links) < walker.Config.Dispatcher.TrapDominance*float64(uncrawled) {
+		return nil
+	}
+
+	parts := strings.SplitN(top, "\x00", 2)
+	rule := &ParamRule{Domain: domain, Subdomain: parts[0], Path: parts[1], Links: most.links}
+	for name := range most.unbounded {
+		rule.Params = append(rule.Params, name)
+	}
+	for name, values := range most.values {
+		if 2*len(values) >= most.links {
+			rule.Params = append(rule.Params, name)
+		}
+	}
+	sort.Strings(rule.Params)
+	return rule
+}
+
+// storeParamRule stores rule, synthesized by the dispatcher, proposed or
+// active according to dispatcher.trap_escape
+func (d *Dispatcher) storeParamRule(rule *ParamRule) {
+	rule.Status = ParamRuleProposed
+	if walker.Config.Dispatcher.TrapEscape == walker.TrapEscapeAggressive {
+		rule.Status = ParamRuleActive
+	}
+	rule.Created = time.Now()
+	params := "all query parameters"
+	if len(rule.Params) > 0 {
+		params = "query parameters " + strings.Join(rule.Params, ", ")
+	}
+	if rule.Status == ParamRuleActive {
+		log4go.Info("Trap escape: collapsing %v of %v%v (%v uncrawled links)",
+			params, rule.Host(), rule.Path, rule.Links)
+	} else {
+		log4go.Info("Trap escape: proposing to collapse %v of %v%v (%v uncrawled links), confirm it on the console",
+			params, rule.Host(), rule.Path, rule.Links)
+	}
+	err := d.db.Query(`INSERT INTO param_rules (dom, subdom, path, params, status, links, created)
+						VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rule.Domain, rule.Subdomain, rule.Path, rule.Params, rule.Status, rule.Links, rule.Created).Exec()
+	if err != nil {
+		log4go.Error("Failed to store param rule for %v%v: %v", rule.Host(), rule.Path, err)
+	}
+}
+
+// storeCollapsed stores the links the trapped links of domain were collapsed
+// to on this dispatch (collapsed maps their cell keys to how many links each
+// stands for), so they get crawled
+func (d *Dispatcher) storeCollapsed(domain string, collapsed map[string]int) {
+	batch := d.db.NewBatch(gocql.UnloggedBatch)
+	flush := func() {
+		if batch.Size() == 0 {
+			return
+		}
+		if err := d.db.ExecuteBatch(batch); err != nil {
+			log4go.Error("Failed to store %v collapsed links of %v: %v", batch.Size(), domain, err)
+		}
+		batch = d.db.NewBatch(gocql.UnloggedBatch)
+	}
+	total := 0
+	for key, n := range collapsed {
+		parts := strings.SplitN(key, "\x00", 3)
+		subdom, path, proto := parts[0], parts[1], parts[2]
+		total += n
+		log4go.Fine("Trap escape: collapsed %v links of %v to %v", n, domain, path)
+		batch.Query(`INSERT INTO links (dom, bucket, subdom, path, proto, time) VALUES (?, ?, ?, ?, ?, ?)`,
+			domain, LinkBucket(subdom, path), subdom, path, proto, walker.NotYetCrawled)
+		if batch.Size() >= walker.Config.Dispatcher.SegmentBatchSize {
+			flush()
+		}
+	}
+	flush()
+	log4go.Info("Trap escape: collapsed %v uncrawled links of %v to %v links", total, domain, len(collapsed))
+}
+
+// paramRulesByStatus sorts rules proposed first, then active, then rejected,
+// then by host and path
+type paramRulesByStatus []*ParamRule
+
+var paramRuleStatusOrder = map[string]int{ParamRuleProposed: 0, ParamRuleActive: 1, ParamRuleRejected: 2}
+
+func (l paramRulesByStatus) Len() int      { return len(l) }
+func (l paramRulesByStatus) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l paramRulesByStatus) Less(i, j int) bool {
+	if a, b := paramRuleStatusOrder[l[i].Status], paramRuleStatusOrder[l[j].Status]; a != b {
+		return a < b
+	}
+	if l[i].Domain != l[j].Domain {
+		return l[i].Domain < l[j].Domain
+	}
+	if l[i].Subdomain != l[j].Subdomain {
+		return l[i].Subdomain < l[j].Subdomain
+	}
+	return l[i].Path < l[j].Path
+}
@@ -0,0 +1,59 @@
+package cassandra
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// The watch_events table records the changes watch rules (see watch.rules)
+// see. It is partitioned by day like audit_log; ListWatchEvents walks back
+// through days until it has enough events.
+
+// watchEventsMaxDays is how many days back ListWatchEvents will look for
+// events
+const watchEventsMaxDays = 90
+
+// storeWatchChanges records the WatchChanges of fr
+func (ds *Datastore) storeWatchChanges(fr *walker.FetchResults, url *walker.URL, dom, subdom string) {
+	for _, c := range fr.WatchChanges {
+		err := ds.db.Query(`INSERT INTO watch_events (day, id, rule, dom, subdom, path, proto, time,
+								prev, cur, expected)
+							VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			auditDay(c.Time), gocql.UUIDFromTime(c.Time), c.Rule, dom, subdom, url.RequestURI(), url.Scheme,
+			c.Time, c.Previous, c.Current, c.Expected).Exec()
+		if err != nil {
+			log4go.Error("Failed to store watch event %v for %v: %v", c.Rule, url, err)
+		}
+	}
+}
+
+// ListWatchEvents is documented on the ModelDatastore interface.
+func (ds *Datastore) ListWatchEvents(limit int) ([]*WatchEvent, error) {
+	var events []*WatchEvent
+	day := auditDay(time.Now())
+	for i := 0; i < watchEventsMaxDays && len(events) < limit; i++ {
+		itr := ds.db.Query(`SELECT rule, dom, subdom, path, proto, time, prev, cur, expected FROM watch_events
+							WHERE day = ? LIMIT ?`, day, limit-len(events)).Iter()
+		var dom, subdom, path, proto string
+		var e WatchEvent
+		for itr.Scan(&e.Rule, &dom, &subdom, &path, &proto, &e.Time, &e.Previous, &e.Current, &e.Expected) {
+			u, err := walker.CreateURL(dom, subdom, path, proto, e.Time)
+			if err != nil {
+				log4go.Error("Failed to create URL for watch event %v: %v", e.Rule, err)
+				continue
+			}
+			event := e
+			event.URL = u
+			events = append(events, &event)
+		}
+		if err := itr.Close(); err != nil {
+			return events, fmt.Errorf("Failed to list watch events for %v: %v", day, err)
+		}
+		day = day.Add(-24 * time.Hour)
+	}
+	return events, nil
+}
@@ -0,0 +1,230 @@
+package cassandra
+
+import (
+	"sync"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+)
+
+// With cassandra.async_writes set, StoreURLFetchResults and StoreParsedURL
+// hand their writes to a pipeline of cassandra.async_writers goroutines
+// instead of making them before returning, so a slow cassandra node doesn't
+// hold up the fetchers. The queue holds up to cassandra.async_write_queue
+// writes; when it is full the Store calls block until there is room.
+//
+// Writes finish (are acked) in any order. Each is tracked by the domain
+// claimed by the fetcher that made it, and UnclaimHost waits for all of a
+// domain's writes to be acked before releasing it, so the dispatcher never
+// reads a domain's links while its fetch results are still queued. Close waits
+// for all writes.
+
+// The counters the async write pipeline adds to the Metrics set with
+// SetMetrics
+const (
+	MetricWritesQueued = "walker_cassandra_writes_queued"
+	MetricWritesAcked  = "walker_cassandra_writes_acked"
+	MetricWritesFailed = "walker_cassandra_writes_failed"
+)
+
+// WriteStats counts the writes of the async write pipeline
+type WriteStats struct {
+	// Writes queued, and those acked (whether they failed or not), since the
+	// datastore was created
+	Queued int64
+	Acked  int64
+
+	// Writes that failed
+	Failed int64
+
+	// Writes queued but not acked yet
+	Pending int64
+
+	// Every write up to this one (numbered from 1 in the order they were
+	// queued) has been acked
+	Watermark uint64
+}
+
+// writeOp is a write queued in a writePipeline
+type writeOp struct {
+	// Its sequence number, and the domain it is tracked by
+	seq uint64
+	dom string
+
+	// Makes the write, returning an error if it failed
+	run func() error
+}
+
+// writePipeline runs writes queued with add on a pool of goroutines
+type writePipeline struct {
+	queue chan *writeOp
+	wg    sync.WaitGroup
+	once  sync.Once
+
+	// mu protects all that follows; cond is signaled as writes are acked
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// The sequence number of the last write queued, and the writes acked
+	// above stats.Watermark
+	seq   uint64
+	acked map[uint64]bool
+
+	// The number of unacked writes of each domain
+	pending map[string]int
+
+	stats WriteStats
+
+	// Where the writes are counted, or nil
+	metrics walker.Metrics
+}
+
+// newWritePipeline starts a pipeline of writers goroutines taking writes from
+// a queue of size writes
+func newWritePipeline(size, writers int) *writePipeline {
+	p := &writePipeline{
+		queue:   make(chan *writeOp, size),
+		acked:   map[uint64]bool{},
+		pending: map[string]int{},
+	}
+	p.cond = sync.NewCond(&p.mu)
+	p.wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		go p.writer()
+	}
+	return p
+}
+
+// add queues run as a write of dom, blocking while the queue is full
+func (p *writePipeline) add(dom string, run func() error) {
+	p.mu.Lock()
+	p.seq++
+	op := &writeOp{seq: p.seq, dom: dom, run: run}
+	p.pending[dom]++
+	p.stats.Queued++
+	p.stats.Pending++
+	p.mu.Unlock()
+	p.count(MetricWritesQueued, 1)
+
+	p.queue <- op
+}
+
+// writer makes the queued writes until the queue is closed
+func (p *writePipeline) writer() {
+	defer p.wg.Done()
+	for op := range p.queue {
+		p.ack(op, op.run())
+	}
+}
+
+// ack records that op finished, failing with err if not nil
+func (p *writePipeline) ack(op *writeOp, err error) {
+	p.mu.Lock()
+	p.stats.Acked++
+	p.stats.Pending--
+	if err != nil {
+		p.stats.Failed++
+	}
+	if p.pending[op.dom]--; p.pending[op.dom] <= 0 {
+		delete(p.pending, op.dom)
+	}
+	p.acked[op.seq] = true
+	for p.acked[p.stats.Watermark+1] {
+		delete(p.acked, p.stats.Watermark+1)
+		p.stats.Watermark++
+	}
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	p.count(MetricWritesAcked, 1)
+	if err != nil {
+		p.count(MetricWritesFailed, 1)
+	}
+}
+
+// count adds delta to the named counter of p.metrics, if set
+func (p *writePipeline) count(name string, delta int64) {
+	p.mu.Lock()
+	m := p.metrics
+	p.mu.Unlock()
+	if m != nil {
+		m.Add(name, delta)
+	}
+}
+
+// wait blocks until all the writes of dom queued so far are acked
+func (p *writePipeline) wait(dom string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for p.pending[dom] > 0 {
+		p.cond.Wait()
+	}
+}
+
+// close waits for all queued writes, then stops the writers. No writes may be
+// added after.
+func (p *writePipeline) close() {
+	p.once.Do(func() {
+		close(p.queue)
+		p.wg.Wait()
+	})
+}
+
+// write makes a write of dom (the domain claimed by the fetcher making it,
+// or the one written to if there is none): in the async write pipeline if
+// cassandra.async_writes is set, otherwise right away
+func (ds *Datastore) write(dom string, run func() error) {
+	if ds.writes == nil {
+		run()
+		return
+	}
+	ds.writes.add(dom, run)
+}
+
+// waitWrites blocks until the writes of dom queued so far are acked
+func (ds *Datastore) waitWrites(dom string) {
+	if ds.writes != nil {
+		ds.writes.wait(dom)
+	}
+}
+
+// SetMetrics sets the Metrics the datastore counts its claims and unclaims in,
+// and the async write pipeline its writes (see the MetricWrites* names, which
+// are only counted if cassandra.async_writes is set). Set it before the
+// datastore is used.
+func (ds *Datastore) SetMetrics(m walker.Metrics) {
+	ds.metrics = m
+	if ds.writes == nil {
+		return
+	}
+	ds.writes.mu.Lock()
+	ds.writes.metrics = m
+	ds.writes.mu.Unlock()
+}
+
+// WriteStats returns the counts of the async write pipeline (all zero unless
+// cassandra.async_writes is set)
+func (ds *Datastore) WriteStats() WriteStats {
+	if ds.writes == nil {
+		return WriteStats{}
+	}
+	ds.writes.mu.Lock()
+	defer ds.writes.mu.Unlock()
+	return ds.writes.stats
+}
+
+// closeWrites waits for the async write pipeline to drain and stops it
+func (ds *Datastore) closeWrites() {
+	if ds.writes == nil {
+		return
+	}
+	stats := ds.WriteStats()
+	if stats.Pending > 0 {
+		log4go.Info("Waiting for %v queued cassandra writes", stats.Pending)
+	}
+	ds.writes.close()
+	stats = ds.WriteStats()
+	if stats.Failed > 0 {
+		log4go.Warn("%v of %v async cassandra writes failed", stats.Failed, stats.Queued)
+	}
+}
@@ -0,0 +1,113 @@
+//go:build cassandra
+// +build cassandra
+
+package cassandra
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/iParadigms/walker"
+)
+
+// countingMetrics is a walker.Metrics that keeps its counts
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (m *countingMetrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	m.counts[name] += delta
+	m.mu.Unlock()
+}
+
+func TestWritePipelineAcks(t *testing.T) {
+	p := newWritePipeline(10, 2)
+	metrics := &countingMetrics{counts: map[string]int64{}}
+	p.metrics = metrics
+
+	release := make(chan struct{})
+	p.add("a.com", func() error {
+		<-release
+		return nil
+	})
+	p.add("b.com", func() error { return errors.New("write timed out") })
+
+	// The second write is acked before the first
+	p.wait("b.com")
+	p.mu.Lock()
+	stats := p.stats
+	p.mu.Unlock()
+	expected := WriteStats{Queued: 2, Acked: 1, Failed: 1, Pending: 1, Watermark: 0}
+	if stats != expected {
+		t.Errorf("Expected stats %+v before the first write finished, got %+v", expected, stats)
+	}
+
+	close(release)
+	p.wait("a.com")
+	p.close()
+	expected = WriteStats{Queued: 2, Acked: 2, Failed: 1, Pending: 0, Watermark: 2}
+	if p.stats != expected {
+		t.Errorf("Expected stats %+v, got %+v", expected, p.stats)
+	}
+	if len(p.pending) != 0 || len(p.acked) != 0 {
+		t.Errorf("Expected no writes tracked after close, got pending %v, acked %v", p.pending, p.acked)
+	}
+
+	for name, count := range map[string]int64{
+		MetricWritesQueued: 2,
+		MetricWritesAcked:  2,
+		MetricWritesFailed: 1,
+	} {
+		if metrics.counts[name] != count {
+			t.Errorf("Expected %v to be %v, got %v", name, count, metrics.counts[name])
+		}
+	}
+}
+
+func TestAsyncWrites(t *testing.T) {
+	orig := walker.Config.Cassandra.AsyncWrites
+	defer func() {
+		walker.Config.Cassandra.AsyncWrites = orig
+	}()
+	walker.Config.Cassandra.AsyncWrites = true
+
+	db := GetTestDB()
+	err := db.Query(`INSERT INTO domain_info (dom, claim_tok, priority, dispatched) VALUES (?, ?, ?, ?)`,
+		"test.com", gocql.UUID{}, 1, true).Exec()
+	if err != nil {
+		t.Fatalf("Failed to insert test domain info: %v", err)
+	}
+	ds := getDS(t)
+
+	fr := &walker.FetchResults{
+		URL:       walker.MustParse("http://test.com/page1.html"),
+		FetchTime: time.Now().Truncate(time.Millisecond),
+	}
+	ds.StoreURLFetchResults(fr)
+	ds.StoreParsedURL(walker.MustParse("http://test.com/page2.html"), fr)
+	ds.UnclaimHost("test.com")
+
+	// UnclaimHost waited for both writes
+	for _, path := range []string{"/page1.html", "/page2.html"} {
+		var count int
+		err := db.Query(`SELECT COUNT(*) FROM links WHERE dom = ? AND bucket = ? AND subdom = ? AND path = ?`,
+			"test.com", LinkBucket("", path), "", path).Scan(&count)
+		if err != nil {
+			t.Fatalf("Failed to read links: %v", err)
+		}
+		if count != 1 {
+			t.Errorf("Expected %v stored before UnclaimHost returned, got %d rows", path, count)
+		}
+	}
+
+	ds.Close()
+	stats := ds.WriteStats()
+	if stats.Queued != 2 || stats.Acked != 2 || stats.Failed != 0 || stats.Watermark != 2 {
+		t.Errorf("Unexpected write stats: %+v", stats)
+	}
+}
@@ -33,16 +33,16 @@ import (
 	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
 	"sort"
 	"strings"
-	"syscall"
+	"time"
 
 	// allow http profile
 	_ "net/http/pprof"
 
 	"code.google.com/p/log4go"
 	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/bench"
 	"github.com/iParadigms/walker/cassandra"
 	"github.com/iParadigms/walker/console"
 	"github.com/iParadigms/walker/simplehandler"
@@ -116,6 +116,8 @@ func initCommand() {
 	if os.Getenv("WALKER_PPROF") == "1" {
 		go func() {
 			log4go.Debug("pprof enabled, starting http listener")
+			http.HandleFunc("/debug/config", walker.ConfigHandler)
+			http.HandleFunc("/debug/blocklists", walker.BlocklistHandler)
 			err := http.ListenAndServe(":6060", nil)
 			if err != nil {
 				log4go.Error("Had problem listening for pprof handler: %v", err)
@@ -147,6 +149,71 @@ func fatalf(format string, args ...interface{}) {
 	os.Exit(1)
 }
 
+// modelDatastore returns the commander's datastore as a
+// cassandra.ModelDatastore, creating a cassandra datastore if none was set. It
+// exits if the datastore can't be created or upgraded.
+func modelDatastore() cassandra.ModelDatastore {
+	errorf := commander.Streams.Errorf
+	exit := commander.Streams.Exit
+
+	if commander.Datastore == nil {
+		ds, err := cassandra.NewDatastore()
+		if err != nil {
+			errorf("Failed creating Cassandra datastore: %v\n", err)
+			exit(1)
+		}
+		commander.Datastore = ds
+	}
+
+	mds, ok := commander.Datastore.(cassandra.ModelDatastore)
+	if !ok {
+		errorf("Tried to use pre-configured datastore, but couldn't upgrade it to a cassandra.ModelDatastore\n")
+		exit(1)
+	}
+	return mds
+}
+
+// newMetrics returns the metrics to serve at metrics.listen, with the
+// commander's datastore and dispatcher counting in them, or nil if
+// metrics.listen isn't set
+func newMetrics() *walker.PrometheusMetrics {
+	if walker.Config.Metrics.Listen == "" {
+		return nil
+	}
+	m := walker.NewPrometheusMetrics(nil)
+	if ds, ok := commander.Datastore.(*cassandra.Datastore); ok {
+		ds.SetMetrics(m)
+	}
+	if d, ok := commander.Dispatcher.(*cassandra.Dispatcher); ok {
+		d.Metrics = m
+	}
+	return m
+}
+
+// fetchManagerOptions returns the options of the FetchManager of the crawl
+// and fetch commands
+func fetchManagerOptions(m *walker.PrometheusMetrics) []walker.Option {
+	opts := []walker.Option{
+		walker.WithDatastore(commander.Datastore),
+		walker.WithHandler(commander.Handler),
+	}
+	if m != nil {
+		opts = append(opts, walker.WithMetrics(m))
+	}
+	return opts
+}
+
+// serveMetrics adds m's /metrics endpoint to crawler's services, if m is set
+func serveMetrics(crawler *walker.Crawler, m *walker.PrometheusMetrics) {
+	if m == nil {
+		return
+	}
+	if crawler.Services == nil {
+		crawler.Services = map[string]walker.Service{}
+	}
+	crawler.Services["metrics"] = walker.NewMetricsService(walker.Config.Metrics.Listen, m)
+}
+
 // Options to control the readlink command
 var readLinkLink string
 var readLinkBodyOnly bool
@@ -177,20 +244,7 @@ var readLinkCommand = &cobra.Command{
 			exit(1)
 		}
 
-		if commander.Datastore == nil {
-			ds, err := cassandra.NewDatastore()
-			if err != nil {
-				errorf("Failed creating Cassandra datastore: %v\n", err)
-				exit(1)
-			}
-			commander.Datastore = ds
-		}
-
-		mds, ok := commander.Datastore.(cassandra.ModelDatastore)
-		if !ok {
-			errorf("Tried to use pre-configured datastore, but couldn't upgrade it to a cassandra.ModelDatastore\n")
-			exit(1)
-		}
+		mds := modelDatastore()
 
 		u, err := walker.ParseURL(readLinkLink)
 		if err != nil {
@@ -264,6 +318,392 @@ var readLinkCommand = &cobra.Command{
 	},
 }
 
+// checkpointFile is the file read or written by the checkpoint commands
+var checkpointFile string
+
+// CheckpointClearOptions allows tests to clear checkpoint options
+func CheckpointClearOptions() {
+	checkpointFile = ""
+}
+
+var checkpointExportCommand = &cobra.Command{
+	Use:   "export",
+	Short: "write a checkpoint of the crawl to a file",
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		if checkpointFile == "" {
+			errorf("An output file is needed to execute; add with --out/-o\n")
+			exit(1)
+		}
+		mds := modelDatastore()
+
+		out, err := os.Create(checkpointFile)
+		if err != nil {
+			errorf("Failed to create %v: %v\n", checkpointFile, err)
+			exit(1)
+		}
+		defer out.Close()
+
+		if err := mds.ExportCheckpoint(out); err != nil {
+			errorf("Failed to export checkpoint: %v\n", err)
+			exit(1)
+		}
+		printf("Wrote checkpoint to %v\n", checkpointFile)
+		exit(0)
+	},
+}
+
+var checkpointImportCommand = &cobra.Command{
+	Use:   "import",
+	Short: "restore the crawl from a checkpoint file",
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		if checkpointFile == "" {
+			errorf("A checkpoint file is needed to execute; add with --in/-i\n")
+			exit(1)
+		}
+		mds := modelDatastore()
+
+		in, err := os.Open(checkpointFile)
+		if err != nil {
+			errorf("Failed to open %v: %v\n", checkpointFile, err)
+			exit(1)
+		}
+		defer in.Close()
+
+		if err := mds.ImportCheckpoint(in); err != nil {
+			errorf("Failed to import checkpoint: %v\n", err)
+			exit(1)
+		}
+		printf("Imported checkpoint from %v\n", checkpointFile)
+		exit(0)
+	},
+}
+
+// Options to control the status command
+var statusWithin string
+var statusSlowest int
+
+// StatusClearOptions allows tests to clear status options
+func StatusClearOptions() {
+	statusWithin = "24h"
+	statusSlowest = 10
+}
+
+var statusCommand = &cobra.Command{
+	Use:   "status",
+	Short: "print the crawl backlog and projected time to crawl it",
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		within, err := time.ParseDuration(statusWithin)
+		if err != nil || within <= 0 {
+			errorf("Failed to parse --within %q; use a duration like 24h\n", statusWithin)
+			exit(1)
+		}
+		mds := modelDatastore()
+
+		proj, err := mds.ProjectCrawl(statusSlowest)
+		if err != nil {
+			errorf("Failed to project crawl: %v\n", err)
+			exit(1)
+		}
+
+		printf("Domains:          %d (%d with a backlog, %d stalled)\n", proj.Domains, proj.DomainsWithBacklog,
+			proj.DomainsStalled)
+		printf("Backlog:          %d links\n", proj.Backlog)
+		printf("Fetch rate:       %.1f links/hour\n", proj.Rate)
+		printf("Active fetchers:  %d\n", proj.ActiveFetchers)
+		printf("ETA:              %v\n", proj.Projection)
+		if n := proj.FetchersNeeded(within); n > 0 {
+			printf("Fetchers needed to finish within %v: %d\n", within, n)
+		} else {
+			printf("Fetchers needed to finish within %v: unknown (nothing crawled recently)\n", within)
+		}
+		if len(proj.Slowest) > 0 {
+			printf("\nSlowest domains:\n")
+			for _, d := range proj.Slowest {
+				printf("    %-40s %8d links %8.1f/hour  %v\n", d.Domain, d.Backlog, d.Rate, d.Projection)
+			}
+		}
+		exit(0)
+	},
+}
+
+// Options to control the latency command
+var latencyDays int
+var latencyLimit int
+
+// LatencyClearOptions allows tests to clear latency options
+func LatencyClearOptions() {
+	latencyDays = 7
+	latencyLimit = 10
+}
+
+var latencyCommand = &cobra.Command{
+	Use:   "latency",
+	Short: "print response times against the SLO, and the slowest domains and pages",
+	Long: `Latency reports the response times of fetches over the last few (UTC) days
+against fetcher.response_time_slo: how many fetches were within it, response
+time percentiles, and the domains that missed it most and slowest pages.
+Percentiles are rounded up to the nearest histogram bucket.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		mds := modelDatastore()
+		r, err := mds.ReportLatency(latencyDays, latencyLimit)
+		if err != nil {
+			errorf("Failed to report latency: %v\n", err)
+			exit(1)
+		}
+
+		printf("Fetches:      %d since %v (UTC)\n", r.Total.Fetches, r.Since.Format("2006-01-02"))
+		printf("Within SLO:   %.1f%% within %v (%d slower)\n", 100*r.Total.Attainment(), r.SLO,
+			r.Total.SlowFetches)
+		printf("Percentiles:  p50 %v, p90 %v, p99 %v\n", r.Total.Percentile(50), r.Total.Percentile(90),
+			r.Total.Percentile(99))
+		if len(r.Domains) > 0 {
+			printf("\nSlowest domains:\n")
+			for _, d := range r.Domains {
+				printf("    %-40s %8d fetches %6.1f%% within SLO  p50 %v, p90 %v, p99 %v\n", d.Domain, d.Fetches,
+					100*d.Attainment(), d.Percentile(50), d.Percentile(90), d.Percentile(99))
+			}
+		}
+		if len(r.Pages) > 0 {
+			printf("\nSlowest pages:\n")
+			for _, p := range r.Pages {
+				status := "failed"
+				if p.Status != 0 {
+					status = fmt.Sprint(p.Status)
+				}
+				printf("    %-60s %10v  %v\n", p.URL, p.ResponseTime, status)
+			}
+		}
+		exit(0)
+	},
+}
+
+// Options to control the canonicalize command
+var canonicalizeDryRun bool
+
+// CanonicalizeClearOptions allows tests to clear canonicalize options
+func CanonicalizeClearOptions() {
+	canonicalizeDryRun = false
+}
+
+var canonicalizeCommand = &cobra.Command{
+	Use:   "canonicalize",
+	Short: "merge links stored more than once under non-canonical keys",
+	Long: `Canonicalize is a one-time migration for links stored by versions of walker
+that didn't canonicalize links when parsing them. It finds links stored under
+keys differing from their canonical form only by:
+    - the case of their domain, subdomain or protocol
+    - a default port on their domain (:80 for http, :443 for https)
+    - an empty path
+and merges each into its canonical link, deleting it and storing the
+canonical link as not yet crawled if it wasn't stored already. Domains left
+without links are deleted from domain_info. It exits with status 1 if any link
+was left unmerged (always the case with --dry-run).
+    $ walker canonicalize --dry-run
+    $ walker canonicalize
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		mds := modelDatastore()
+		report, err := mds.Canonicalize(!canonicalizeDryRun)
+		if report != nil {
+			for _, m := range report.Merges {
+				outcome := "not merged"
+				switch {
+				case m.Repaired:
+					outcome = "merged"
+				case m.Error != "":
+					outcome = "merge failed: " + m.Error
+				}
+				if m.Duplicate {
+					outcome += " (duplicate)"
+				}
+				printf("%v -> %v %s\n", m.Link, m.Canonical, outcome)
+			}
+			for _, dom := range report.StaleDomains {
+				printf("%v has no canonical links\n", dom)
+			}
+		}
+		if err != nil {
+			errorf("Failed to canonicalize links: %v\n", err)
+			exit(1)
+		}
+		merged := report.Repaired()
+		printf("Checked %d domains and %d links: %d non-canonical, %d merged\n",
+			report.Domains, report.Links, len(report.Merges), merged)
+		if merged < len(report.Merges) {
+			exit(1)
+		}
+		exit(0)
+	},
+}
+
+// Options to control the fsck command
+var fsckDryRun bool
+
+// FsckClearOptions allows tests to clear fsck options
+func FsckClearOptions() {
+	fsckDryRun = false
+}
+
+var fsckCommand = &cobra.Command{
+	Use:   "fsck",
+	Short: "find and repair inconsistent crawl scheduling state",
+	Long: `Fsck checks domain_info and segments for inconsistencies left by fetchers
+or dispatchers that died part way through an update, and repairs them:
+    - domains marked dispatched, but unclaimed, with no segment links
+    - domains claimed by fetchers that no longer have a heartbeat
+    - segment links that are missing from the links table
+Each problem is printed along with whether it was repaired. It exits with
+status 1 if any problem was left unrepaired (always the case with --dry-run).
+    $ walker fsck --dry-run
+    $ walker fsck
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		mds := modelDatastore()
+		report, err := mds.Fsck(!fsckDryRun)
+		if report != nil {
+			for _, p := range report.Problems {
+				outcome := "not repaired"
+				switch {
+				case p.Repaired:
+					outcome = "repaired"
+				case p.Error != "":
+					outcome = "repair failed: " + p.Error
+				}
+				printf("%-14s %-30s %s\n", p.Kind, strings.TrimSpace(p.Domain+" "+p.Link), outcome)
+			}
+		}
+		if err != nil {
+			errorf("Failed to check crawl state: %v\n", err)
+			exit(1)
+		}
+		repaired := report.Repaired()
+		printf("Checked %d domains and %d segment links: %d problems, %d repaired\n",
+			report.Domains, report.SegmentLinks, len(report.Problems), repaired)
+		if repaired < len(report.Problems) {
+			exit(1)
+		}
+		exit(0)
+	},
+}
+
+// Options to control the bench command
+var benchOpts bench.Options
+var benchLatency string
+var benchCrawlDelay string
+var benchTimeout string
+var benchDatastore string
+
+// BenchClearOptions allows tests to clear bench options
+func BenchClearOptions() {
+	benchOpts = bench.DefaultOptions()
+	benchLatency = benchOpts.Latency.String()
+	benchCrawlDelay = benchOpts.CrawlDelay.String()
+	benchTimeout = benchOpts.Timeout.String()
+	benchDatastore = "memory"
+}
+
+var benchCommand = &cobra.Command{
+	Use:   "bench",
+	Short: "crawl a generated site and report fetch throughput",
+	Long: `Bench serves a generated site from a local server and crawls it with the
+configured fetcher settings, reporting throughput, request latency and
+allocations. No network access is needed; every request goes to the local
+server. By default links are kept in memory; with --datastore=cassandra the
+configured keyspace and a dispatcher are used, so point --config at a test
+keyspace:
+    $ walker bench --domains 20 --pages 500 --latency 50ms
+    $ walker bench -c bench-walker.yaml --datastore cassandra
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initCommand()
+		printf := commander.Streams.Printf
+		errorf := commander.Streams.Errorf
+		exit := commander.Streams.Exit
+
+		opts := benchOpts
+		for _, d := range []struct {
+			flag string
+			val  string
+			dest *time.Duration
+		}{
+			{"latency", benchLatency, &opts.Latency},
+			{"crawl-delay", benchCrawlDelay, &opts.CrawlDelay},
+			{"timeout", benchTimeout, &opts.Timeout},
+		} {
+			var err error
+			*d.dest, err = time.ParseDuration(d.val)
+			if err != nil {
+				errorf("Failed to parse --%v %q: %v\n", d.flag, d.val, err)
+				exit(1)
+			}
+		}
+
+		var ds walker.Datastore
+		var dispatcher walker.Dispatcher
+		switch benchDatastore {
+		case "memory":
+		case "cassandra":
+			orig := walker.Config.Cassandra.AddNewDomains
+			defer func() { walker.Config.Cassandra.AddNewDomains = orig }()
+			walker.Config.Cassandra.AddNewDomains = true
+
+			cds, err := cassandra.NewDatastore()
+			if err != nil {
+				errorf("Failed creating Cassandra datastore: %v\n", err)
+				exit(1)
+			}
+			defer cds.Close()
+			ds = cds
+			dispatcher = &cassandra.Dispatcher{}
+		default:
+			errorf("Unknown --datastore %q; use memory or cassandra\n", benchDatastore)
+			exit(1)
+		}
+
+		report, err := bench.Run(opts, ds, dispatcher, commander.Handler)
+		if err != nil {
+			errorf("Benchmark failed: %v\n", err)
+			exit(1)
+		}
+		report.Print(printf)
+		if !report.Complete {
+			exit(1)
+		}
+		exit(0)
+	},
+}
+
 func init() {
 	walkerCommand := &cobra.Command{
 		Use: "walker",
@@ -292,33 +732,21 @@ func init() {
 				commander.Handler = &simplehandler.Handler{}
 			}
 
-			manager := &walker.FetchManager{
-				Datastore: commander.Datastore,
-				Handler:   commander.Handler,
+			metrics := newMetrics()
+			manager, err := walker.NewFetchManager(fetchManagerOptions(metrics)...)
+			if err != nil {
+				fatalf("Failed creating fetch manager: %v", err)
 			}
-			go manager.Start()
 
-			if commander.Dispatcher != nil {
-				go func() {
-					err := commander.Dispatcher.StartDispatcher()
-					if err != nil {
-						panic(err.Error())
-					}
-				}()
+			crawler := &walker.Crawler{
+				FetchManager: manager,
+				Dispatcher:   commander.Dispatcher,
 			}
-
 			if !noConsole {
-				console.Start()
+				crawler.Services = map[string]walker.Service{"console": console.Service{}}
 			}
-
-			sig := make(chan os.Signal)
-			signal.Notify(sig, syscall.SIGINT)
-			<-sig
-
-			if commander.Dispatcher != nil {
-				commander.Dispatcher.StopDispatcher()
-			}
-			manager.Stop()
+			serveMetrics(crawler, metrics)
+			crawler.Run()
 		},
 	}
 	crawlCommand.Flags().BoolVarP(&noConsole, "no-console", "C", false, "Do not start the console")
@@ -330,6 +758,17 @@ func init() {
 		Run: func(cmd *cobra.Command, args []string) {
 			initCommand()
 
+			if commander.Datastore == nil && walker.Config.Frontier.QueueURL != "" {
+				queue, err := walker.NewHTTPFrontierQueue(walker.Config.Frontier.QueueURL)
+				if err != nil {
+					fatalf("Failed creating frontier queue: %v", err)
+				}
+				ds, err := walker.NewFrontierDatastore(queue)
+				if err != nil {
+					fatalf("Failed creating frontier datastore: %v", err)
+				}
+				commander.Datastore = ds
+			}
 			if commander.Datastore == nil {
 				ds, err := cassandra.NewDatastore()
 				if err != nil {
@@ -343,17 +782,15 @@ func init() {
 				commander.Handler = &simplehandler.Handler{}
 			}
 
-			manager := &walker.FetchManager{
-				Datastore: commander.Datastore,
-				Handler:   commander.Handler,
+			metrics := newMetrics()
+			manager, err := walker.NewFetchManager(fetchManagerOptions(metrics)...)
+			if err != nil {
+				fatalf("Failed creating fetch manager: %v", err)
 			}
-			go manager.Start()
-
-			sig := make(chan os.Signal)
-			signal.Notify(sig, syscall.SIGINT)
-			<-sig
 
-			manager.Stop()
+			crawler := &walker.Crawler{FetchManager: manager}
+			serveMetrics(crawler, metrics)
+			crawler.Run()
 		},
 	}
 	walkerCommand.AddCommand(fetchCommand)
@@ -368,23 +805,15 @@ func init() {
 				commander.Dispatcher = &cassandra.Dispatcher{}
 			}
 
-			go func() {
-				err := commander.Dispatcher.StartDispatcher()
-				if err != nil {
-					panic(err.Error())
-				}
-			}()
-
-			sig := make(chan os.Signal)
-			signal.Notify(sig, syscall.SIGINT)
-			<-sig
-
-			commander.Dispatcher.StopDispatcher()
+			crawler := &walker.Crawler{Dispatcher: commander.Dispatcher}
+			serveMetrics(crawler, newMetrics())
+			crawler.Run()
 		},
 	}
 	walkerCommand.AddCommand(dispatchCommand)
 
 	var seedURL string
+	var seedScope walker.CrawlScope
 	seedCommand := &cobra.Command{
 		Use:   "seed",
 		Short: "add a seed URL to the datastore",
@@ -394,7 +823,13 @@ func init() {
     - Adding any other link that needs to be crawled soon
 
 This command will insert the provided link and also add its domain to the
-crawl, regardless of the add_new_domains configuration setting.`,
+crawl, regardless of the add_new_domains configuration setting. With --scope,
+it also sets which of the links found on the domain are kept:
+    all         links on any domain (the default)
+    host        links on the same host as the page they were found on
+    domain      links on the domain and any of its subdomains
+    subdomains  links on the domain and the --scope-subdomains given
+    custom      links matching the --scope-pattern regular expression`,
 		Run: func(cmd *cobra.Command, args []string) {
 			initCommand()
 
@@ -409,6 +844,9 @@ crawl, regardless of the add_new_domains configuration setting.`,
 			if err != nil {
 				fatalf("Could not parse %v as a url: %v", seedURL, err)
 			}
+			if err := seedScope.Compile(); err != nil {
+				fatalf("Bad --scope: %v", err)
+			}
 
 			if commander.Datastore == nil {
 				ds, err := cassandra.NewDatastore()
@@ -419,9 +857,27 @@ crawl, regardless of the add_new_domains configuration setting.`,
 			}
 
 			commander.Datastore.StoreParsedURL(u, nil)
+
+			if seedScope.Mode != "" {
+				dom, err := u.ToplevelDomainPlusOne()
+				if err != nil {
+					fatalf("Could not find the domain of %v: %v", u, err)
+				}
+				info := &cassandra.DomainInfo{Scope: seedScope}
+				err = modelDatastore().UpdateDomain(dom, info, cassandra.DomainInfoUpdateConfig{Scope: true})
+				if err != nil {
+					fatalf("Failed to set the crawl scope of %v: %v", dom, err)
+				}
+			}
 		},
 	}
 	seedCommand.Flags().StringVarP(&seedURL, "url", "u", "", "URL to add as a seed")
+	seedCommand.Flags().StringVar(&seedScope.Mode, "scope", "",
+		"Crawl scope of the seed's domain (all, host, domain, subdomains or custom)")
+	seedCommand.Flags().StringSliceVar(&seedScope.Subdomains, "scope-subdomains", nil,
+		"Subdomains kept with --scope subdomains (comma separated)")
+	seedCommand.Flags().StringVar(&seedScope.Pattern, "scope-pattern", "",
+		"Regular expression of the links kept with --scope custom")
 	walkerCommand.AddCommand(seedCommand)
 
 	var outfile string
@@ -472,5 +928,54 @@ Useful for something like:
 		"Use this flag to omit the body from printed results")
 	walkerCommand.AddCommand(readLinkCommand)
 
+	checkpointCommand := &cobra.Command{
+		Use:   "checkpoint",
+		Short: "export or import crawl scheduling state",
+		Long: `Checkpoint saves and restores the crawl's scheduling state: the
+domain_info and segments tables. Links and page contents are not included.
+Useful for backing up a crawl, moving it to another cluster, or recovering
+from a destructive mistake:
+    $ walker checkpoint export -o crawl.checkpoint
+    $ walker checkpoint import -i crawl.checkpoint
+`,
+	}
+	checkpointExportCommand.Flags().StringVarP(&checkpointFile, "out", "o", "", "File to write the checkpoint to")
+	checkpointCommand.AddCommand(checkpointExportCommand)
+	checkpointImportCommand.Flags().StringVarP(&checkpointFile, "in", "i", "", "Checkpoint file to import")
+	checkpointCommand.AddCommand(checkpointImportCommand)
+	walkerCommand.AddCommand(checkpointCommand)
+
+	statusCommand.Flags().StringVarP(&statusWithin, "within", "w", "24h",
+		"Print how many fetchers are needed to crawl the backlog within this long")
+	statusCommand.Flags().IntVarP(&statusSlowest, "slowest", "s", 10, "Number of slowest domains to list")
+	walkerCommand.AddCommand(statusCommand)
+
+	latencyCommand.Flags().IntVarP(&latencyDays, "days", "d", 7, "Number of days to report on, up to 30")
+	latencyCommand.Flags().IntVarP(&latencyLimit, "limit", "l", 10, "Number of slowest domains and pages to list")
+	walkerCommand.AddCommand(latencyCommand)
+
+	fsckCommand.Flags().BoolVarP(&fsckDryRun, "dry-run", "n", false, "Report problems without repairing them")
+	walkerCommand.AddCommand(fsckCommand)
+
+	canonicalizeCommand.Flags().BoolVarP(&canonicalizeDryRun, "dry-run", "n", false,
+		"Report non-canonical links without merging them")
+	walkerCommand.AddCommand(canonicalizeCommand)
+
+	BenchClearOptions()
+	benchCommand.Flags().IntVarP(&benchOpts.Domains, "domains", "n", benchOpts.Domains, "Number of domains in the site")
+	benchCommand.Flags().IntVarP(&benchOpts.Pages, "pages", "p", benchOpts.Pages, "Number of pages on each domain")
+	benchCommand.Flags().IntVarP(&benchOpts.FanOut, "fanout", "f", benchOpts.FanOut, "Number of links on each page")
+	benchCommand.Flags().IntVarP(&benchOpts.PageSize, "size", "s", benchOpts.PageSize, "Page size in bytes")
+	benchCommand.Flags().Int64Var(&benchOpts.Seed, "seed", benchOpts.Seed, "Seed for generating the site's links")
+	benchCommand.Flags().StringVarP(&benchLatency, "latency", "l", benchLatency,
+		"How long the server takes to answer each request")
+	benchCommand.Flags().StringVar(&benchCrawlDelay, "crawl-delay", benchCrawlDelay,
+		"Crawl delay used in place of fetcher.default_crawl_delay")
+	benchCommand.Flags().StringVarP(&benchTimeout, "timeout", "t", benchTimeout,
+		"Give up if the site hasn't been fetched by then")
+	benchCommand.Flags().StringVarP(&benchDatastore, "datastore", "d", benchDatastore,
+		"Datastore to crawl with: memory or cassandra")
+	walkerCommand.AddCommand(benchCommand)
+
 	commander.Command = walkerCommand
 }
@@ -468,3 +468,431 @@ HEADERS:
 		os.Args = origArgs
 	}
 }
+
+func TestCheckpointCommand(t *testing.T) {
+	tests := []struct {
+		tag    string
+		call   []string
+		method string
+		err    error
+		estat  int
+		stdout string
+		stderr string
+	}{
+		{
+			tag:    "export",
+			call:   []string{os.Args[0], "checkpoint", "export", "-o", "test.checkpoint"},
+			method: "ExportCheckpoint",
+			estat:  0,
+			stdout: "Wrote checkpoint to test.checkpoint",
+		},
+		{
+			tag:    "exportFails",
+			call:   []string{os.Args[0], "checkpoint", "export", "-o", "test.checkpoint"},
+			method: "ExportCheckpoint",
+			err:    fmt.Errorf("boom"),
+			estat:  1,
+			stderr: "Failed to export checkpoint: boom",
+		},
+		{
+			tag:    "exportNoFile",
+			call:   []string{os.Args[0], "checkpoint", "export"},
+			estat:  1,
+			stderr: "An output file is needed to execute; add with --out/-o",
+		},
+		{
+			tag:    "import",
+			call:   []string{os.Args[0], "checkpoint", "import", "-i", "test.checkpoint"},
+			method: "ImportCheckpoint",
+			estat:  0,
+			stdout: "Imported checkpoint from test.checkpoint",
+		},
+		{
+			tag:    "importNoFile",
+			call:   []string{os.Args[0], "checkpoint", "import"},
+			estat:  1,
+			stderr: "A checkpoint file is needed to execute; add with --in/-i",
+		},
+	}
+	defer os.Remove("test.checkpoint")
+
+	for _, tst := range tests {
+		CheckpointClearOptions()
+
+		datastore := &cassandra.MockModelDatastore{}
+		if tst.method != "" {
+			datastore.On(tst.method, mock.Anything).Return(tst.err)
+		}
+		Datastore(datastore)
+		origArgs := os.Args
+		os.Args = tst.call
+		stdout, stderr, estat := executeInSandbox(t)
+		os.Args = origArgs
+
+		if estat != tst.estat {
+			t.Errorf("Estat mismatch for tag %v expected %d, but got %d", tst.tag, tst.estat, estat)
+		}
+		if strings.TrimSpace(stdout) != tst.stdout {
+			t.Errorf("Stdout mismatch for tag %v expected %q, but got %q", tst.tag, tst.stdout, stdout)
+		}
+		if strings.TrimSpace(stderr) != tst.stderr {
+			t.Errorf("Stderr mismatch for tag %v expected %q, but got %q", tst.tag, tst.stderr, stderr)
+		}
+		datastore.AssertExpectations(t)
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	proj := &cassandra.CrawlProjection{
+		Domains:            3,
+		DomainsWithBacklog: 2,
+		DomainsStalled:     1,
+		ActiveFetchers:     2,
+		Slowest: []cassandra.DomainProjection{
+			{Domain: "stalled.com", Projection: cassandra.Projection{Backlog: 10, Stalled: true}},
+			{Domain: "slow.com", Projection: cassandra.Projection{Backlog: 48, Rate: 1, ETA: 48 * time.Hour}},
+		},
+	}
+	proj.Projection = cassandra.Projection{Backlog: 58, Rate: 4, ETA: 48 * time.Hour}
+
+	tests := []struct {
+		tag    string
+		call   []string
+		err    error
+		estat  int
+		stdout string
+		stderr string
+	}{
+		{
+			tag:   "status",
+			call:  []string{os.Args[0], "status", "--within", "4h"},
+			estat: 0,
+			stdout: `Domains:          3 (2 with a backlog, 1 stalled)
+Backlog:          58 links
+Fetch rate:       4.0 links/hour
+Active fetchers:  2
+ETA:              48h0m0s
+Fetchers needed to finish within 4h0m0s: 8
+
+Slowest domains:
+    stalled.com                                    10 links      0.0/hour  stalled
+    slow.com                                       48 links      1.0/hour  48h0m0s`,
+		},
+		{
+			tag:    "statusFails",
+			call:   []string{os.Args[0], "status"},
+			err:    fmt.Errorf("boom"),
+			estat:  1,
+			stderr: "Failed to project crawl: boom",
+		},
+		{
+			tag:    "statusBadWithin",
+			call:   []string{os.Args[0], "status", "--within", "soon"},
+			estat:  1,
+			stderr: `Failed to parse --within "soon"; use a duration like 24h`,
+		},
+	}
+
+	for _, tst := range tests {
+		StatusClearOptions()
+
+		datastore := &cassandra.MockModelDatastore{}
+		if tst.err != nil {
+			datastore.On("ProjectCrawl", 10).Return((*cassandra.CrawlProjection)(nil), tst.err)
+		} else if tst.estat == 0 {
+			datastore.On("ProjectCrawl", 10).Return(proj, nil)
+		}
+		Datastore(datastore)
+		origArgs := os.Args
+		os.Args = tst.call
+		stdout, stderr, estat := executeInSandbox(t)
+		os.Args = origArgs
+
+		if estat != tst.estat {
+			t.Errorf("Estat mismatch for tag %v expected %d, but got %d", tst.tag, tst.estat, estat)
+		}
+		if strings.TrimSpace(stdout) != tst.stdout {
+			t.Errorf("Stdout mismatch for tag %v expected\n%v\nbut got\n%v", tst.tag, tst.stdout, stdout)
+		}
+		if strings.TrimSpace(stderr) != tst.stderr {
+			t.Errorf("Stderr mismatch for tag %v expected %q, but got %q", tst.tag, tst.stderr, stderr)
+		}
+		datastore.AssertExpectations(t)
+	}
+}
+
+func TestLatencyCommand(t *testing.T) {
+	stats := cassandra.LatencyStats{Fetches: 10, SlowFetches: 1, Buckets: []int64{0, 5, 3, 1, 0, 1, 0, 0, 0}}
+	report := &cassandra.LatencyReport{
+		Since:   time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC),
+		SLO:     2 * time.Second,
+		Total:   stats,
+		Domains: []*cassandra.DomainLatency{{Domain: "slow.com", LatencyStats: stats}},
+		Pages: []*cassandra.SlowPage{
+			{URL: walker.MustParse("http://slow.com/big.html"), ResponseTime: 6500 * time.Millisecond, Status: 200},
+			{URL: walker.MustParse("http://slow.com/dead.html"), ResponseTime: 3 * time.Second},
+		},
+	}
+
+	tests := []struct {
+		tag    string
+		call   []string
+		days   int
+		err    error
+		estat  int
+		stdout string
+		stderr string
+	}{
+		{
+			tag:   "latency",
+			call:  []string{os.Args[0], "latency", "--days", "3"},
+			days:  3,
+			estat: 0,
+			stdout: `Fetches:      10 since 2015-01-02 (UTC)
+Within SLO:   90.0% within 2s (1 slower)
+Percentiles:  p50 250ms, p90 1s, p99 5s
+
+Slowest domains:
+    slow.com                                       10 fetches   90.0% within SLO  p50 250ms, p90 1s, p99 5s
+
+Slowest pages:
+    http://slow.com/big.html                                           6.5s  200
+    http://slow.com/dead.html                                            3s  failed`,
+		},
+		{
+			tag:    "latencyFails",
+			call:   []string{os.Args[0], "latency"},
+			days:   7,
+			err:    fmt.Errorf("boom"),
+			estat:  1,
+			stderr: "Failed to report latency: boom",
+		},
+	}
+
+	for _, tst := range tests {
+		LatencyClearOptions()
+
+		datastore := &cassandra.MockModelDatastore{}
+		if tst.err != nil {
+			datastore.On("ReportLatency", tst.days, 10).Return((*cassandra.LatencyReport)(nil), tst.err)
+		} else {
+			datastore.On("ReportLatency", tst.days, 10).Return(report, nil)
+		}
+		Datastore(datastore)
+		origArgs := os.Args
+		os.Args = tst.call
+		stdout, stderr, estat := executeInSandbox(t)
+		os.Args = origArgs
+
+		if estat != tst.estat {
+			t.Errorf("Estat mismatch for tag %v expected %d, but got %d", tst.tag, tst.estat, estat)
+		}
+		if strings.TrimSpace(stdout) != tst.stdout {
+			t.Errorf("Stdout mismatch for tag %v expected\n%v\nbut got\n%v", tst.tag, tst.stdout, stdout)
+		}
+		if strings.TrimSpace(stderr) != tst.stderr {
+			t.Errorf("Stderr mismatch for tag %v expected %q, but got %q", tst.tag, tst.stderr, stderr)
+		}
+		datastore.AssertExpectations(t)
+	}
+}
+
+func TestFsckCommand(t *testing.T) {
+	problems := func(repaired bool) *cassandra.FsckReport {
+		return &cassandra.FsckReport{
+			Domains:      3,
+			SegmentLinks: 7,
+			Problems: []*cassandra.FsckProblem{
+				{Kind: cassandra.FsckExpiredClaim, Domain: "dead.com", Repaired: repaired},
+				{Kind: cassandra.FsckMissingLink, Domain: "a.com", Link: "http://a.com/gone", Repaired: repaired},
+			},
+		}
+	}
+
+	tests := []struct {
+		tag    string
+		call   []string
+		repair bool
+		report *cassandra.FsckReport
+		err    error
+		estat  int
+		stdout string
+		stderr string
+	}{
+		{
+			tag:    "repair",
+			call:   []string{os.Args[0], "fsck"},
+			repair: true,
+			report: problems(true),
+			estat:  0,
+			stdout: `expired_claim  dead.com                       repaired
+missing_link   a.com http://a.com/gone        repaired
+Checked 3 domains and 7 segment links: 2 problems, 2 repaired`,
+		},
+		{
+			tag:    "dryRun",
+			call:   []string{os.Args[0], "fsck", "--dry-run"},
+			repair: false,
+			report: problems(false),
+			estat:  1,
+			stdout: `expired_claim  dead.com                       not repaired
+missing_link   a.com http://a.com/gone        not repaired
+Checked 3 domains and 7 segment links: 2 problems, 0 repaired`,
+		},
+		{
+			tag:    "clean",
+			call:   []string{os.Args[0], "fsck"},
+			repair: true,
+			report: &cassandra.FsckReport{Domains: 2},
+			estat:  0,
+			stdout: "Checked 2 domains and 0 segment links: 0 problems, 0 repaired",
+		},
+		{
+			tag:    "fails",
+			call:   []string{os.Args[0], "fsck"},
+			repair: true,
+			err:    fmt.Errorf("boom"),
+			estat:  1,
+			stderr: "Failed to check crawl state: boom",
+		},
+	}
+
+	for _, tst := range tests {
+		FsckClearOptions()
+
+		datastore := &cassandra.MockModelDatastore{}
+		datastore.On("Fsck", tst.repair).Return(tst.report, tst.err)
+		Datastore(datastore)
+		origArgs := os.Args
+		os.Args = tst.call
+		stdout, stderr, estat := executeInSandbox(t)
+		os.Args = origArgs
+
+		if estat != tst.estat {
+			t.Errorf("Estat mismatch for tag %v expected %d, but got %d", tst.tag, tst.estat, estat)
+		}
+		if strings.TrimSpace(stdout) != tst.stdout {
+			t.Errorf("Stdout mismatch for tag %v expected\n%v\nbut got\n%v", tst.tag, tst.stdout, stdout)
+		}
+		if strings.TrimSpace(stderr) != tst.stderr {
+			t.Errorf("Stderr mismatch for tag %v expected %q, but got %q", tst.tag, tst.stderr, stderr)
+		}
+		datastore.AssertExpectations(t)
+	}
+}
+
+func TestCanonicalizeCommand(t *testing.T) {
+	report := func(merged bool) *cassandra.CanonicalizeReport {
+		return &cassandra.CanonicalizeReport{
+			Domains: 3,
+			Links:   9,
+			Merges: []*cassandra.CanonicalMerge{
+				{Link: "http://A.com/", Canonical: "http://a.com/", Duplicate: true, Repaired: merged},
+				{Link: "http://www.A.com/x", Canonical: "http://www.a.com/x", Repaired: merged},
+			},
+			StaleDomains: []string{"A.com"},
+		}
+	}
+
+	tests := []struct {
+		tag    string
+		call   []string
+		repair bool
+		report *cassandra.CanonicalizeReport
+		estat  int
+		stdout string
+	}{
+		{
+			tag:    "repair",
+			call:   []string{os.Args[0], "canonicalize"},
+			repair: true,
+			report: report(true),
+			estat:  0,
+			stdout: `http://A.com/ -> http://a.com/ merged (duplicate)
+http://www.A.com/x -> http://www.a.com/x merged
+A.com has no canonical links
+Checked 3 domains and 9 links: 2 non-canonical, 2 merged`,
+		},
+		{
+			tag:    "dryRun",
+			call:   []string{os.Args[0], "canonicalize", "-n"},
+			repair: false,
+			report: report(false),
+			estat:  1,
+			stdout: `http://A.com/ -> http://a.com/ not merged (duplicate)
+http://www.A.com/x -> http://www.a.com/x not merged
+A.com has no canonical links
+Checked 3 domains and 9 links: 2 non-canonical, 0 merged`,
+		},
+	}
+
+	for _, tst := range tests {
+		CanonicalizeClearOptions()
+
+		datastore := &cassandra.MockModelDatastore{}
+		datastore.On("Canonicalize", tst.repair).Return(tst.report, nil)
+		Datastore(datastore)
+		origArgs := os.Args
+		os.Args = tst.call
+		stdout, _, estat := executeInSandbox(t)
+		os.Args = origArgs
+
+		if estat != tst.estat {
+			t.Errorf("Estat mismatch for tag %v expected %d, but got %d", tst.tag, tst.estat, estat)
+		}
+		if strings.TrimSpace(stdout) != tst.stdout {
+			t.Errorf("Stdout mismatch for tag %v expected\n%v\nbut got\n%v", tst.tag, tst.stdout, stdout)
+		}
+		datastore.AssertExpectations(t)
+	}
+}
+
+func TestBenchCommand(t *testing.T) {
+	tests := []struct {
+		tag    string
+		call   []string
+		estat  int
+		stdout string
+		stderr string
+	}{
+		{
+			tag:    "site",
+			call:   []string{os.Args[0], "bench", "-n", "2", "-p", "3", "-f", "2", "-l", "0s", "-t", "30s"},
+			estat:  0,
+			stdout: "Pages:       6 (6 fetched, complete)",
+		},
+		{
+			tag:    "badLatency",
+			call:   []string{os.Args[0], "bench", "--latency", "soon"},
+			estat:  1,
+			stderr: `Failed to parse --latency "soon": `,
+		},
+		{
+			tag:    "badDatastore",
+			call:   []string{os.Args[0], "bench", "--datastore", "mysql"},
+			estat:  1,
+			stderr: `Unknown --datastore "mysql"; use memory or cassandra`,
+		},
+	}
+
+	walker.LoadTestConfig("test-walker.yaml")
+	Handler(nil)
+	for _, tst := range tests {
+		BenchClearOptions()
+
+		origArgs := os.Args
+		os.Args = tst.call
+		stdout, stderr, estat := executeInSandbox(t)
+		os.Args = origArgs
+
+		if estat != tst.estat {
+			t.Errorf("Estat mismatch for tag %v expected %d, but got %d", tst.tag, tst.estat, estat)
+		}
+		if tst.stdout != "" && !strings.HasPrefix(stdout, tst.stdout) {
+			t.Errorf("Stdout mismatch for tag %v expected to start with %q, but got\n%v", tst.tag, tst.stdout, stdout)
+		}
+		if !strings.HasPrefix(stderr, tst.stderr) || (tst.stderr == "" && stderr != "") {
+			t.Errorf("Stderr mismatch for tag %v expected to start with %q, but got %q", tst.tag, tst.stderr, stderr)
+		}
+	}
+}
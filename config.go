@@ -1,14 +1,26 @@
 package walker
 
 import (
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
 	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker/mimetools"
 )
 
 // Config is the configuration instance the rest of walker should access for
@@ -33,6 +45,14 @@ func init() {
 // ConfigStruct defines the available global configuration parameters for
 // walker. It reads values straight from the config file (walker.yaml by
 // default). See sample-walker.yaml for explanations and default values.
+//
+// Any value can also be overridden with an environment variable named
+// WALKER_<SECTION>_<KEY>, ex. WALKER_FETCHER_USER_AGENT or
+// WALKER_CASSANDRA_HOSTS. Lists are given comma separated.
+//
+// Fields tagged secret:"true" hold credentials, or values that usually embed
+// them (like URLs with a user and password), and are never reported by
+// EffectiveConfig.
 type ConfigStruct struct {
 
 	//TODO: allow -1 as a no max value
@@ -43,6 +63,8 @@ type ConfigStruct struct {
 		AcceptFormats            []string `yaml:"accept_formats"`
 		AcceptProtocols          []string `yaml:"accept_protocols"`
 		MaxHTTPContentSizeBytes  int64    `yaml:"max_http_content_size_bytes"`
+		MaxResponseHeaderBytes   int64    `yaml:"max_response_header_bytes"`
+		MaxResponseHeaders       int      `yaml:"max_response_headers"`
 		IgnoreTags               []string `yaml:"ignore_tags"`
 		MaxLinksPerPage          int      `yaml:"max_links_per_page"`
 		NumSimultaneousFetchers  int      `yaml:"num_simultaneous_fetchers"`
@@ -50,27 +72,104 @@ type ConfigStruct struct {
 		HTTPTimeout              string   `yaml:"http_timeout"`
 		HonorMetaNoindex         bool     `yaml:"honor_meta_noindex"`
 		HonorMetaNofollow        bool     `yaml:"honor_meta_nofollow"`
+		HonorMetaNoai            bool     `yaml:"honor_meta_noai"`
 		ExcludeLinkPatterns      []string `yaml:"exclude_link_patterns"`
 		IncludeLinkPatterns      []string `yaml:"include_link_patterns"`
+		DenyExtensions           []string `yaml:"deny_extensions"`
 		DefaultCrawlDelay        string   `yaml:"default_crawl_delay"`
+		BurstCrawlDelay          string   `yaml:"burst_crawl_delay"`
 		MaxCrawlDelay            string   `yaml:"max_crawl_delay"`
 		PurgeSidList             []string `yaml:"purge_sid_list"`
+		HashRoutes               string   `yaml:"hash_routes"`
+		HashRoutePatterns        []string `yaml:"hash_route_patterns"`
+		HashRouteRenderer        string   `yaml:"hash_route_renderer"`
+		NodeIDFile               string   `yaml:"node_id_file"`
 		ActiveFetchersTTL        string   `yaml:"active_fetchers_ttl"`
 		ActiveFetchersCacheratio float32  `yaml:"active_fetchers_cacheratio"`
 		ActiveFetchersKeepratio  float32  `yaml:"active_fetchers_keepratio"`
 		HTTPKeepAlive            string   `yaml:"http_keep_alive"`
 		HTTPKeepAliveThreshold   string   `yaml:"http_keep_alive_threshold"`
 		MaxPathLength            int      `yaml:"max_path_length"`
+		RedirectorHosts          []string `yaml:"redirector_hosts"`
+		MaxRedirectorHops        int      `yaml:"max_redirector_hops"`
+		AlternatePolicy          string   `yaml:"alternate_policy"`
+		MaxPaginationDepth       int      `yaml:"max_pagination_depth"`
+		ExtractImageMetadata     bool     `yaml:"extract_image_metadata"`
+		ParsePDF                 bool     `yaml:"parse_pdf"`
+		MaxParseBytes            int64    `yaml:"max_parse_bytes"`
+		ParseTimeout             string   `yaml:"parse_timeout"`
+		ParseScriptLinks         bool     `yaml:"parse_script_links"`
+		HostContextTTL           string   `yaml:"host_context_ttl"`
+		SamplePercentage         float64  `yaml:"sample_percentage"`
+		SitemapTrust             string   `yaml:"sitemap_trust"`
+		SitemapMaxSkipAge        string   `yaml:"sitemap_max_skip_age"`
+		MaxSitemapEntries        int      `yaml:"max_sitemap_entries"`
+		MaxSitemapBytes          int64    `yaml:"max_sitemap_bytes"`
+		SitemapDiscovery         bool     `yaml:"sitemap_discovery"`
+		MaxRobotsBytes           int64    `yaml:"max_robots_bytes"`
+		RefreshHints             bool     `yaml:"refresh_hints"`
+		SourceAddresses          []string `yaml:"source_addresses"`
+		SourceAddressPolicy      string   `yaml:"source_address_policy"`
+		ProxyURL                 string   `yaml:"proxy_url" secret:"true"`
+		ReportFile               string   `yaml:"report_file"`
+		ReportTopContentTypes    int      `yaml:"report_top_content_types"`
+		HonorRetryAfter          bool     `yaml:"honor_retry_after"`
+		MaxRetryAfter            string   `yaml:"max_retry_after"`
+		Differential             bool     `yaml:"differential"`
+		DNSNegativeTTL           string   `yaml:"dns_negative_ttl"`
+		DNSQuarantineFailures    int      `yaml:"dns_quarantine_failures"`
+		DNSQuarantinePeriod      string   `yaml:"dns_quarantine_period"`
+		DNSOverHTTPSURL          string   `yaml:"dns_over_https_url"`
+		DNSOverHTTPSTimeout      string   `yaml:"dns_over_https_timeout"`
+		DNSOverHTTPSFallback     bool     `yaml:"dns_over_https_fallback"`
+		DrainTimeout             string   `yaml:"drain_timeout"`
+		RangeFetchBytes          int64    `yaml:"range_fetch_bytes"`
+		RangeFetchTypes          []string `yaml:"range_fetch_types"`
+		PolitenessGrouping       string   `yaml:"politeness_grouping"`
+		HandlerFormats           []string `yaml:"handler_formats"`
+		RobotsErrorPolicy        string   `yaml:"robots_error_policy"`
+		RobotsFetchRetries       int      `yaml:"robots_fetch_retries"`
+		RobotsRetryBackoff       string   `yaml:"robots_retry_backoff"`
+		RobotsUnavailableBackoff string   `yaml:"robots_unavailable_backoff"`
+		ResponseTimeSLO          string   `yaml:"response_time_slo"`
+		RejectUnacceptedTypes    bool     `yaml:"reject_unaccepted_types"`
+		FollowRedirects          bool     `yaml:"follow_redirects"`
+		SkipUnchangedPages       bool     `yaml:"skip_unchanged_pages"`
+
+		PinnedHosts        []HostPin           `yaml:"pinned_hosts"`
+		ExtensionOverrides []ExtensionOverride `yaml:"extension_overrides"`
+		ProxyOverrides     []ProxyOverride     `yaml:"proxy_overrides" secret:"true"`
 	} `yaml:"fetcher"`
 
 	Dispatcher struct {
-		MaxLinksPerSegment         int     `yaml:"num_links_per_segment"`
-		RefreshPercentage          float64 `yaml:"refresh_percentage"`
-		NumConcurrentDomains       int     `yaml:"num_concurrent_domains"`
-		MinLinkRefreshTime         string  `yaml:"min_link_refresh_time"`
-		DispatchInterval           string  `yaml:"dispatch_interval"`
-		CorrectLinkNormalization   bool    `yaml:"correct_link_normalization"`
-		EmptyDispatchRetryInterval string  `yaml:"empty_dispatch_retry_interval"`
+		MaxLinksPerSegment         int      `yaml:"num_links_per_segment"`
+		RefreshPercentage          float64  `yaml:"refresh_percentage"`
+		NumConcurrentDomains       int      `yaml:"num_concurrent_domains"`
+		MinLinkRefreshTime         string   `yaml:"min_link_refresh_time"`
+		MaxRefreshInterval         string   `yaml:"max_refresh_interval"`
+		DispatchInterval           string   `yaml:"dispatch_interval"`
+		CorrectLinkNormalization   bool     `yaml:"correct_link_normalization"`
+		EmptyDispatchRetryInterval string   `yaml:"empty_dispatch_retry_interval"`
+		SubdomainStatsLimit        int      `yaml:"subdomain_stats_limit"`
+		ContentStatsLimit          int      `yaml:"content_stats_limit"`
+		SegmentBatchSize           int      `yaml:"segment_batch_size"`
+		DomainTimeout              string   `yaml:"domain_timeout"`
+		DomainRetryInterval        string   `yaml:"domain_retry_interval"`
+		AliasProbeInterval         string   `yaml:"alias_probe_interval"`
+		AliasProbePaths            []string `yaml:"alias_probe_paths"`
+		CrawlAliases               bool     `yaml:"crawl_aliases"`
+		NewDomainBoostPeriod       string   `yaml:"new_domain_boost_period"`
+		NewDomainPriorityBoost     int      `yaml:"new_domain_priority_boost"`
+		NewDomainSegmentMultiplier int      `yaml:"new_domain_segment_multiplier"`
+		BurstSegmentMultiplier     int      `yaml:"burst_segment_multiplier"`
+		SamplingThreshold          int      `yaml:"sampling_threshold"`
+		RedirectConfirmations      int      `yaml:"redirect_confirmations"`
+		TrapEscape                 string   `yaml:"trap_escape"`
+		TrapMinLinks               int      `yaml:"trap_min_links"`
+		TrapDominance              float64  `yaml:"trap_dominance"`
+		MaxOutstandingSegments     int      `yaml:"max_outstanding_segments"`
+		PipelineMinPriority        int      `yaml:"pipeline_min_priority"`
+		MaxCrawlDepth              int      `yaml:"max_crawl_depth"`
 	} `yaml:"dispatcher"`
 
 	Cassandra struct {
@@ -87,15 +186,32 @@ type ConfigStruct struct {
 		MaxPreparedStmts      int      `yaml:"max_prepared_stmts"`
 		AddNewDomains         bool     `yaml:"add_new_domains"`
 		AddedDomainsCacheSize int      `yaml:"added_domains_cache_size"`
+		VerifyNewDomains      []string `yaml:"verify_new_domains"`
+		VerifyTXTRecord       string   `yaml:"verify_txt_record"`
 		StoreResponseBody     bool     `yaml:"store_response_body"`
 		StoreResponseHeaders  bool     `yaml:"store_response_headers"`
+		SampleTTL             string   `yaml:"sample_ttl"`
+		StoreLinkProvenance   bool     `yaml:"store_link_provenance"`
+		LinkProvenanceCache   int      `yaml:"link_provenance_cache_size"`
 		NumQueryRetries       int      `yaml:"num_query_retries"`
 		DefaultDomainPriority int      `yaml:"default_domain_priority"`
+		DefaultDailyByteQuota int64    `yaml:"default_daily_byte_quota"`
+		PriorityAgingPeriod   string   `yaml:"priority_aging_period"`
+		PriorityAgingExponent float64  `yaml:"priority_aging_exponent"`
+		SegmentReadChunkSize  int      `yaml:"segment_read_chunk_size"`
+		LinkBuckets           int      `yaml:"link_buckets"`
+		ClaimStrategy         string   `yaml:"claim_strategy"`
+		ClaimNodeID           string   `yaml:"claim_node_id"`
+		ClaimAffinityWait     string   `yaml:"claim_affinity_wait"`
+		Username              string   `yaml:"username"`
+		Password              string   `yaml:"password" secret:"true"`
+		AsyncWrites           bool     `yaml:"async_writes"`
+		AsyncWriteQueue       int      `yaml:"async_write_queue"`
+		AsyncWriters          int      `yaml:"async_writers"`
 
 		//TODO: Currently only exposing values needed for testing; should expose more?
 		//Consistency      Consistency
 		//Compressor       Compressor
-		//Authenticator    Authenticator
 		//RetryPolicy      RetryPolicy
 		//SocketKeepalive  time.Duration
 		//ConnPoolType     NewPoolFunc
@@ -103,11 +219,73 @@ type ConfigStruct struct {
 	} `yaml:"cassandra"`
 
 	Console struct {
-		Port                     int    `yaml:"port"`
-		TemplateDirectory        string `yaml:"template_directory"`
-		PublicFolder             string `yaml:"public_folder"`
-		MaxAllowedDomainPriority int    `yaml:"max_allowed_domain_priority"`
+		Port                     int      `yaml:"port"`
+		TemplateDirectory        string   `yaml:"template_directory"`
+		PublicFolder             string   `yaml:"public_folder"`
+		MaxAllowedDomainPriority int      `yaml:"max_allowed_domain_priority"`
+		APITokens                []string `yaml:"api_tokens" secret:"true"`
 	} `yaml:"console"`
+
+	Blocklist struct {
+		Lists           []string `yaml:"lists"`
+		RefreshInterval string   `yaml:"refresh_interval"`
+	} `yaml:"blocklist"`
+
+	Webhooks struct {
+		Hooks               []WebhookConfig `yaml:"hooks" secret:"true"`
+		Timeout             string          `yaml:"timeout"`
+		ErrorRateThreshold  float64         `yaml:"error_rate_threshold"`
+		ErrorRateMinFetches int             `yaml:"error_rate_min_fetches"`
+		DispatcherStallTime string          `yaml:"dispatcher_stall_time"`
+		RoundOverdueTime    string          `yaml:"round_overdue_time"`
+	} `yaml:"webhooks"`
+
+	Watch struct {
+		Rules []WatchRule `yaml:"rules"`
+	} `yaml:"watch"`
+
+	Screenshots struct {
+		RendererURL    string   `yaml:"renderer_url"`
+		Patterns       []string `yaml:"patterns"`
+		Width          int      `yaml:"width"`
+		Height         int      `yaml:"height"`
+		ThumbnailWidth int      `yaml:"thumbnail_width"`
+		Timeout        string   `yaml:"timeout"`
+	} `yaml:"screenshots"`
+
+	Sessions struct {
+		Bootstraps []SessionBootstrap `yaml:"bootstraps" secret:"true"`
+		Timeout    string             `yaml:"timeout"`
+	} `yaml:"sessions"`
+
+	Reports struct {
+		CheckInterval string `yaml:"check_interval"`
+		SMTPServer    string `yaml:"smtp_server"`
+		SMTPUsername  string `yaml:"smtp_username"`
+		SMTPPassword  string `yaml:"smtp_password" secret:"true"`
+		From          string `yaml:"from"`
+		MaxLinks      int    `yaml:"max_links"`
+		Timeout       string `yaml:"timeout"`
+	} `yaml:"reports"`
+
+	Domains struct {
+		PrivateSuffixes []string `yaml:"private_suffixes"`
+		CacheSize       int      `yaml:"cache_size"`
+	} `yaml:"domains"`
+
+	Metrics struct {
+		Listen string `yaml:"listen"`
+	} `yaml:"metrics"`
+
+	Frontier struct {
+		QueueURL       string `yaml:"queue_url" secret:"true"`
+		ReceiveBatch   int    `yaml:"receive_batch"`
+		ReceiveWait    string `yaml:"receive_wait"`
+		Timeout        string `yaml:"timeout"`
+		ResultsTopic   string `yaml:"results_topic"`
+		LinksTopic     string `yaml:"links_topic"`
+		LinksCacheSize int    `yaml:"links_cache_size"`
+	} `yaml:"frontier"`
 }
 
 // SetDefaultConfig resets the Config object to default values, regardless of
@@ -125,6 +303,8 @@ func SetDefaultConfig() {
 	Config.Fetcher.AcceptFormats = []string{"text/html", "text/*;"} //NOTE you can add quality factors by doing "text/html; q=0.4"
 	Config.Fetcher.AcceptProtocols = []string{"http", "https"}
 	Config.Fetcher.MaxHTTPContentSizeBytes = 20 * 1024 * 1024 // 20MB
+	Config.Fetcher.MaxResponseHeaderBytes = 64 * 1024         // 64KB
+	Config.Fetcher.MaxResponseHeaders = 200
 	Config.Fetcher.IgnoreTags = []string{"script", "img", "link"}
 	Config.Fetcher.MaxLinksPerPage = 1000
 	Config.Fetcher.NumSimultaneousFetchers = 10
@@ -132,25 +312,101 @@ func SetDefaultConfig() {
 	Config.Fetcher.HTTPTimeout = "30s"
 	Config.Fetcher.HonorMetaNoindex = true
 	Config.Fetcher.HonorMetaNofollow = false
+	Config.Fetcher.HonorMetaNoai = false
 	Config.Fetcher.ExcludeLinkPatterns = nil
 	Config.Fetcher.IncludeLinkPatterns = nil
+	Config.Fetcher.DenyExtensions = nil
+	Config.Fetcher.ExtensionOverrides = nil
 	Config.Fetcher.DefaultCrawlDelay = "1s"
+	Config.Fetcher.BurstCrawlDelay = "100ms"
 	Config.Fetcher.MaxCrawlDelay = "5m"
 	Config.Fetcher.PurgeSidList = nil
+	Config.Fetcher.HashRoutes = HashRoutesDrop
+	Config.Fetcher.HashRoutePatterns = []string{}
+	Config.Fetcher.HashRouteRenderer = ""
+	Config.Fetcher.NodeIDFile = ""
 	Config.Fetcher.ActiveFetchersTTL = "15m"
 	Config.Fetcher.ActiveFetchersCacheratio = 0.75
 	Config.Fetcher.ActiveFetchersKeepratio = 0.75
 	Config.Fetcher.HTTPKeepAlive = "always"
 	Config.Fetcher.HTTPKeepAliveThreshold = "15s"
 	Config.Fetcher.MaxPathLength = 2048
+	Config.Fetcher.RedirectorHosts = nil
+	Config.Fetcher.MaxRedirectorHops = 5
+	Config.Fetcher.AlternatePolicy = "canonical"
+	Config.Fetcher.MaxPaginationDepth = 0
+	Config.Fetcher.ExtractImageMetadata = false
+	Config.Fetcher.ParsePDF = false
+	Config.Fetcher.MaxParseBytes = 5 * 1024 * 1024 // 5MB
+	Config.Fetcher.ParseTimeout = "10s"
+	Config.Fetcher.ParseScriptLinks = false
+	Config.Fetcher.HostContextTTL = "1h"
+	Config.Fetcher.SamplePercentage = 0
+	Config.Fetcher.SitemapTrust = "none"
+	Config.Fetcher.SitemapMaxSkipAge = "720h"
+	Config.Fetcher.MaxSitemapEntries = 50000
+	Config.Fetcher.MaxSitemapBytes = 50 * 1024 * 1024 // 50MB
+	Config.Fetcher.MaxRobotsBytes = 500 * 1024        // 500KB
+	Config.Fetcher.SitemapDiscovery = false
+	Config.Fetcher.RefreshHints = false
+	Config.Fetcher.SourceAddresses = nil
+	Config.Fetcher.PinnedHosts = nil
+	Config.Fetcher.SourceAddressPolicy = "per_fetcher"
+	Config.Fetcher.ProxyURL = ""
+	Config.Fetcher.ProxyOverrides = nil
+	Config.Fetcher.ReportFile = ""
+	Config.Fetcher.ReportTopContentTypes = 10
+	Config.Fetcher.HonorRetryAfter = true
+	Config.Fetcher.MaxRetryAfter = "24h"
+	Config.Fetcher.Differential = false
+	Config.Fetcher.DNSNegativeTTL = "5m"
+	Config.Fetcher.DNSQuarantineFailures = 5
+	Config.Fetcher.DNSQuarantinePeriod = "24h"
+	Config.Fetcher.DNSOverHTTPSURL = ""
+	Config.Fetcher.DNSOverHTTPSTimeout = "5s"
+	Config.Fetcher.DNSOverHTTPSFallback = true
+	Config.Fetcher.DrainTimeout = "1m"
+	Config.Fetcher.RangeFetchBytes = 0
+	Config.Fetcher.RangeFetchTypes = []string{"text/html", "application/pdf"}
+	Config.Fetcher.PolitenessGrouping = PolitenessGroupNone
+	Config.Fetcher.HandlerFormats = []string{}
+	Config.Fetcher.RobotsErrorPolicy = RobotsErrorPolicyAllow
+	Config.Fetcher.RobotsFetchRetries = 3
+	Config.Fetcher.RobotsRetryBackoff = "5s"
+	Config.Fetcher.RobotsUnavailableBackoff = "24h"
+	Config.Fetcher.ResponseTimeSLO = "2s"
+	Config.Fetcher.RejectUnacceptedTypes = true
+	Config.Fetcher.FollowRedirects = true
+	Config.Fetcher.SkipUnchangedPages = false
 
 	Config.Dispatcher.MaxLinksPerSegment = 500
 	Config.Dispatcher.RefreshPercentage = 25
 	Config.Dispatcher.NumConcurrentDomains = 1
 	Config.Dispatcher.MinLinkRefreshTime = "0s"
+	Config.Dispatcher.MaxRefreshInterval = "168h"
 	Config.Dispatcher.DispatchInterval = "10s"
 	Config.Dispatcher.CorrectLinkNormalization = false
 	Config.Dispatcher.EmptyDispatchRetryInterval = "0s"
+	Config.Dispatcher.SubdomainStatsLimit = 0
+	Config.Dispatcher.ContentStatsLimit = 10
+	Config.Dispatcher.SegmentBatchSize = 100
+	Config.Dispatcher.DomainTimeout = "10m"
+	Config.Dispatcher.DomainRetryInterval = "5m"
+	Config.Dispatcher.AliasProbeInterval = "0s"
+	Config.Dispatcher.AliasProbePaths = []string{"/", "/robots.txt"}
+	Config.Dispatcher.CrawlAliases = false
+	Config.Dispatcher.NewDomainBoostPeriod = "0s"
+	Config.Dispatcher.NewDomainPriorityBoost = 5
+	Config.Dispatcher.NewDomainSegmentMultiplier = 2
+	Config.Dispatcher.BurstSegmentMultiplier = 5
+	Config.Dispatcher.SamplingThreshold = 0
+	Config.Dispatcher.RedirectConfirmations = 3
+	Config.Dispatcher.MaxCrawlDepth = 0
+	Config.Dispatcher.TrapEscape = TrapEscapeConfirm
+	Config.Dispatcher.TrapMinLinks = 1000
+	Config.Dispatcher.TrapDominance = 0.5
+	Config.Dispatcher.MaxOutstandingSegments = 1
+	Config.Dispatcher.PipelineMinPriority = 5
 
 	Config.Cassandra.Hosts = []string{"localhost"}
 	Config.Cassandra.Keyspace = "walker"
@@ -165,15 +421,77 @@ func SetDefaultConfig() {
 	Config.Cassandra.MaxPreparedStmts = 1000
 	Config.Cassandra.AddNewDomains = false
 	Config.Cassandra.AddedDomainsCacheSize = 20000
+	Config.Cassandra.VerifyNewDomains = []string{}
+	Config.Cassandra.VerifyTXTRecord = ""
 	Config.Cassandra.StoreResponseBody = false
 	Config.Cassandra.StoreResponseHeaders = false
+	Config.Cassandra.SampleTTL = "168h"
+	Config.Cassandra.StoreLinkProvenance = true
+	Config.Cassandra.LinkProvenanceCache = 20000
 	Config.Cassandra.NumQueryRetries = 3
 	Config.Cassandra.DefaultDomainPriority = 1
+	Config.Cassandra.DefaultDailyByteQuota = 0
+	Config.Cassandra.PriorityAgingPeriod = "24h"
+	Config.Cassandra.PriorityAgingExponent = 1.0
+	Config.Cassandra.SegmentReadChunkSize = 500
+	Config.Cassandra.LinkBuckets = 1
+	Config.Cassandra.ClaimStrategy = "priority"
+	Config.Cassandra.ClaimNodeID = ""
+	Config.Cassandra.ClaimAffinityWait = "10m"
+	Config.Cassandra.Username = ""
+	Config.Cassandra.Password = ""
+	Config.Cassandra.AsyncWrites = false
+	Config.Cassandra.AsyncWriteQueue = 10000
+	Config.Cassandra.AsyncWriters = 8
 
 	Config.Console.Port = 3000
 	Config.Console.TemplateDirectory = "console/templates"
 	Config.Console.PublicFolder = "console/public"
 	Config.Console.MaxAllowedDomainPriority = 100
+	Config.Console.APITokens = nil
+
+	Config.Blocklist.Lists = nil
+	Config.Blocklist.RefreshInterval = "1h"
+
+	Config.Webhooks.Hooks = nil
+	Config.Webhooks.Timeout = "10s"
+	Config.Webhooks.ErrorRateThreshold = 50
+	Config.Webhooks.ErrorRateMinFetches = 20
+	Config.Webhooks.DispatcherStallTime = "1h"
+	Config.Webhooks.RoundOverdueTime = "2h"
+
+	Config.Watch.Rules = nil
+
+	Config.Screenshots.RendererURL = ""
+	Config.Screenshots.Patterns = nil
+	Config.Screenshots.Width = 1280
+	Config.Screenshots.Height = 800
+	Config.Screenshots.ThumbnailWidth = 320
+	Config.Screenshots.Timeout = "60s"
+
+	Config.Sessions.Bootstraps = nil
+	Config.Sessions.Timeout = "30s"
+
+	Config.Reports.CheckInterval = "10m"
+	Config.Reports.SMTPServer = ""
+	Config.Reports.SMTPUsername = ""
+	Config.Reports.SMTPPassword = ""
+	Config.Reports.From = "walker@localhost"
+	Config.Reports.MaxLinks = 20
+	Config.Reports.Timeout = "30s"
+
+	Config.Domains.PrivateSuffixes = nil
+	Config.Domains.CacheSize = 50000
+
+	Config.Metrics.Listen = ""
+
+	Config.Frontier.QueueURL = ""
+	Config.Frontier.ReceiveBatch = 100
+	Config.Frontier.ReceiveWait = "5s"
+	Config.Frontier.Timeout = "30s"
+	Config.Frontier.ResultsTopic = "walker-results"
+	Config.Frontier.LinksTopic = "walker-links"
+	Config.Frontier.LinksCacheSize = 100000
 }
 
 // ReadConfigFile sets a new path to find the walker yaml config file and
@@ -209,6 +527,10 @@ func assertConfigInvariants() error {
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Dispatcher.MinLinkRefreshTime failed to parse: %v", err))
 	}
+	_, err = time.ParseDuration(dis.MaxRefreshInterval)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Dispatcher.MaxRefreshInterval failed to parse: %v", err))
+	}
 	_, err = time.ParseDuration(dis.DispatchInterval)
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Dispatcher.DispatchInterval failed to parse: %v", err))
@@ -217,12 +539,86 @@ func assertConfigInvariants() error {
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Dispatcher.EmptyDispatchRetryInterval failed to parse: %v", err))
 	}
+	if dis.SubdomainStatsLimit < 0 {
+		errs = append(errs, "Dispatcher.SubdomainStatsLimit must be >= 0")
+	}
+	if dis.ContentStatsLimit < 0 {
+		errs = append(errs, "Dispatcher.ContentStatsLimit must be >= 0")
+	}
+	if dis.SegmentBatchSize < 1 {
+		errs = append(errs, "Dispatcher.SegmentBatchSize must be >= 1")
+	}
+	if d, err := time.ParseDuration(dis.DomainTimeout); err != nil {
+		errs = append(errs, fmt.Sprintf("Dispatcher.DomainTimeout failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Dispatcher.DomainTimeout must be >= 0")
+	}
+	if d, err := time.ParseDuration(dis.DomainRetryInterval); err != nil {
+		errs = append(errs, fmt.Sprintf("Dispatcher.DomainRetryInterval failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Dispatcher.DomainRetryInterval must be >= 0")
+	}
+	if d, err := time.ParseDuration(dis.AliasProbeInterval); err != nil {
+		errs = append(errs, fmt.Sprintf("Dispatcher.AliasProbeInterval failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Dispatcher.AliasProbeInterval must be >= 0")
+	}
+	if len(dis.AliasProbePaths) == 0 {
+		errs = append(errs, "Dispatcher.AliasProbePaths must not be empty")
+	}
+	for _, p := range dis.AliasProbePaths {
+		if !strings.HasPrefix(p, "/") {
+			errs = append(errs, "Dispatcher.AliasProbePaths entries must start with /")
+			break
+		}
+	}
+	if d, err := time.ParseDuration(dis.NewDomainBoostPeriod); err != nil {
+		errs = append(errs, fmt.Sprintf("Dispatcher.NewDomainBoostPeriod failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Dispatcher.NewDomainBoostPeriod must be >= 0")
+	}
+	if dis.NewDomainPriorityBoost < 0 {
+		errs = append(errs, "Dispatcher.NewDomainPriorityBoost must be >= 0")
+	}
+	if dis.NewDomainSegmentMultiplier < 1 {
+		errs = append(errs, "Dispatcher.NewDomainSegmentMultiplier must be >= 1")
+	}
+	if dis.BurstSegmentMultiplier < 1 {
+		errs = append(errs, "Dispatcher.BurstSegmentMultiplier must be >= 1")
+	}
+	if dis.SamplingThreshold < 0 {
+		errs = append(errs, "Dispatcher.SamplingThreshold must be >= 0")
+	}
+	if dis.RedirectConfirmations < 0 {
+		errs = append(errs, "Dispatcher.RedirectConfirmations must be >= 0")
+	}
+	if dis.MaxCrawlDepth < 0 {
+		errs = append(errs, "Dispatcher.MaxCrawlDepth must be >= 0")
+	}
+	switch dis.TrapEscape {
+	case TrapEscapeOff, TrapEscapeConfirm, TrapEscapeAggressive:
+	default:
+		errs = append(errs, "Dispatcher.TrapEscape not one of (off, confirm, aggressive)")
+	}
+	if dis.TrapMinLinks < 1 {
+		errs = append(errs, "Dispatcher.TrapMinLinks must be >= 1")
+	}
+	if dis.TrapDominance <= 0 || dis.TrapDominance > 1 {
+		errs = append(errs, "Dispatcher.TrapDominance must be > 0 and <= 1")
+	}
+	if dis.MaxOutstandingSegments < 1 {
+		errs = append(errs, "Dispatcher.MaxOutstandingSegments must be >= 1")
+	}
 
 	fet := &Config.Fetcher
 	_, err = time.ParseDuration(fet.HTTPTimeout)
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("HTTPTimeout failed to parse: %v", err))
 	}
+	_, err = time.ParseDuration(fet.ParseTimeout)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("ParseTimeout failed to parse: %v", err))
+	}
 	_, err = aggregateRegex(fet.ExcludeLinkPatterns, "exclude_link_patterns")
 	if err != nil {
 		errs = append(errs, err.Error())
@@ -231,6 +627,21 @@ func assertConfigInvariants() error {
 	if err != nil {
 		errs = append(errs, err.Error())
 	}
+	_, err = aggregateRegex(fet.HashRoutePatterns, "hash_route_patterns")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	switch fet.HashRoutes {
+	case HashRoutesDrop, HashRoutesEscapedFragment:
+	case HashRoutesRendered:
+		if u, err := url.Parse(fet.HashRouteRenderer); err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+			!strings.Contains(fet.HashRouteRenderer, "{url}") {
+			errs = append(errs, "Fetcher.HashRouteRenderer must be an http(s) URL containing {url} when "+
+				"Fetcher.HashRoutes is rendered")
+		}
+	default:
+		errs = append(errs, "Fetcher.HashRoutes not one of (drop, escaped_fragment, rendered)")
+	}
 	afTTL, err := time.ParseDuration(fet.ActiveFetchersTTL)
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Fetcher.ActiveFetchersTTL failed to parse: %v", err))
@@ -250,6 +661,141 @@ func assertConfigInvariants() error {
 	if def > max {
 		errs = append(errs, "Consistency problem: MaxCrawlDelay > DefaultCrawlDealy")
 	}
+	if burst, err := time.ParseDuration(fet.BurstCrawlDelay); err != nil {
+		errs = append(errs, fmt.Sprintf("BurstCrawlDelay failed to parse: %v", err))
+	} else if burst < 0 {
+		errs = append(errs, "BurstCrawlDelay must be >= 0")
+	}
+
+	_, err = time.ParseDuration(fet.HostContextTTL)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.HostContextTTL failed to parse: %v", err))
+	}
+	if fet.SamplePercentage < 0.0 || fet.SamplePercentage > 100.0 {
+		errs = append(errs, "Fetcher.SamplePercentage must be a floating point number b/w 0 and 100")
+	}
+	switch fet.SitemapTrust {
+	case "none", "conservative", "full":
+	default:
+		errs = append(errs, "Fetcher.SitemapTrust not one of (none, conservative, full)")
+	}
+	_, err = time.ParseDuration(fet.SitemapMaxSkipAge)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.SitemapMaxSkipAge failed to parse: %v", err))
+	}
+	if fet.MaxSitemapEntries < 1 {
+		errs = append(errs, "Fetcher.MaxSitemapEntries must be >= 1")
+	}
+	if fet.MaxSitemapBytes < 1 {
+		errs = append(errs, "Fetcher.MaxSitemapBytes must be >= 1")
+	}
+	if fet.MaxRobotsBytes < 1 {
+		errs = append(errs, "Fetcher.MaxRobotsBytes must be >= 1")
+	}
+	for _, addr := range fet.SourceAddresses {
+		if net.ParseIP(addr) == nil {
+			errs = append(errs, fmt.Sprintf("Fetcher.SourceAddresses entry %q is not an IP address", addr))
+		}
+	}
+	if err := checkHostPins(fet.PinnedHosts); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.PinnedHosts: %v", err))
+	}
+	if err := checkProxies(fet.ProxyURL, fet.ProxyOverrides); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.ProxyURL/ProxyOverrides: %v", err))
+	}
+	if err := checkExtensions(fet.DenyExtensions); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.DenyExtensions: %v", err))
+	}
+	if err := checkExtensionOverrides(fet.ExtensionOverrides); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.ExtensionOverrides: %v", err))
+	}
+	switch fet.SourceAddressPolicy {
+	case "per_fetcher", "rotate":
+	default:
+		errs = append(errs, "Fetcher.SourceAddressPolicy not one of (per_fetcher, rotate)")
+	}
+	if fet.ReportTopContentTypes < 0 {
+		errs = append(errs, "Fetcher.ReportTopContentTypes must be >= 0")
+	}
+	if d, err := time.ParseDuration(fet.MaxRetryAfter); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.MaxRetryAfter failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Fetcher.MaxRetryAfter must be >= 0")
+	}
+	if d, err := time.ParseDuration(fet.DNSNegativeTTL); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.DNSNegativeTTL failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Fetcher.DNSNegativeTTL must be >= 0")
+	}
+	if fet.DNSQuarantineFailures < 0 {
+		errs = append(errs, "Fetcher.DNSQuarantineFailures must be >= 0")
+	}
+	if d, err := time.ParseDuration(fet.DNSQuarantinePeriod); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.DNSQuarantinePeriod failed to parse: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, "Fetcher.DNSQuarantinePeriod must be > 0")
+	}
+	if fet.DNSOverHTTPSURL != "" {
+		if u, err := url.Parse(fet.DNSOverHTTPSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, "Fetcher.DNSOverHTTPSURL must be an http(s) URL")
+		}
+	}
+	if d, err := time.ParseDuration(fet.DNSOverHTTPSTimeout); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.DNSOverHTTPSTimeout failed to parse: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, "Fetcher.DNSOverHTTPSTimeout must be > 0")
+	}
+	if d, err := time.ParseDuration(fet.DrainTimeout); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.DrainTimeout failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Fetcher.DrainTimeout must be >= 0")
+	}
+	if fet.MaxResponseHeaderBytes <= 0 {
+		errs = append(errs, "Fetcher.MaxResponseHeaderBytes must be > 0")
+	}
+	if fet.MaxResponseHeaders <= 0 {
+		errs = append(errs, "Fetcher.MaxResponseHeaders must be > 0")
+	}
+	if fet.RangeFetchBytes < 0 || fet.RangeFetchBytes > fet.MaxHTTPContentSizeBytes {
+		errs = append(errs, "Fetcher.RangeFetchBytes must be >= 0 and <= Fetcher.MaxHTTPContentSizeBytes")
+	}
+	if _, err := mimetools.AcceptHeader(fet.AcceptFormats); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.AcceptFormats failed to parse: %v", err))
+	}
+	if _, err := mimetools.NewMatcher(fet.RangeFetchTypes); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.RangeFetchTypes failed to parse: %v", err))
+	}
+	if _, err := mimetools.NewMatcher(fet.HandlerFormats); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.HandlerFormats failed to parse: %v", err))
+	}
+	switch fet.PolitenessGrouping {
+	case PolitenessGroupNone, PolitenessGroupIP, PolitenessGroupSubnet:
+	default:
+		errs = append(errs, "Fetcher.PolitenessGrouping not one of (none, ip, subnet)")
+	}
+	switch fet.RobotsErrorPolicy {
+	case RobotsErrorPolicyAllow, RobotsErrorPolicyRFC:
+	default:
+		errs = append(errs, "Fetcher.RobotsErrorPolicy not one of (allow, rfc)")
+	}
+	if fet.RobotsFetchRetries < 0 {
+		errs = append(errs, "Fetcher.RobotsFetchRetries must be >= 0")
+	}
+	if d, err := time.ParseDuration(fet.RobotsRetryBackoff); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.RobotsRetryBackoff failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Fetcher.RobotsRetryBackoff must be >= 0")
+	}
+	if d, err := time.ParseDuration(fet.RobotsUnavailableBackoff); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.RobotsUnavailableBackoff failed to parse: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, "Fetcher.RobotsUnavailableBackoff must be > 0")
+	}
+	if d, err := time.ParseDuration(fet.ResponseTimeSLO); err != nil {
+		errs = append(errs, fmt.Sprintf("Fetcher.ResponseTimeSLO failed to parse: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, "Fetcher.ResponseTimeSLO must be > 0")
+	}
 
 	switch strings.ToLower(fet.HTTPKeepAlive) {
 	case "always", "threshold", "never":
@@ -260,6 +806,17 @@ func assertConfigInvariants() error {
 	if err != nil {
 		errs = append(errs, fmt.Sprintf("Fetcher.HTTPKeepAliveThreshold failed to parse: %v", err))
 	}
+	if fet.MaxRedirectorHops < 1 {
+		errs = append(errs, "Fetcher.MaxRedirectorHops must be greater than 0")
+	}
+	if fet.ParsePDF && !pdfSupported {
+		errs = append(errs, "Fetcher.ParsePDF requires walker to be built with the pdf build tag")
+	}
+	switch strings.ToLower(fet.AlternatePolicy) {
+	case "canonical", "both":
+	default:
+		errs = append(errs, "Fetcher.AlternatePolicy not one of (canonical, both)")
+	}
 
 	cas := &Config.Cassandra
 	_, err = time.ParseDuration(cas.Timeout)
@@ -269,6 +826,52 @@ func assertConfigInvariants() error {
 	if cas.DefaultDomainPriority < 1 {
 		errs = append(errs, fmt.Sprintf("Cassandra.DefaultDomainPriority must be >= 1"))
 	}
+	if cas.DefaultDailyByteQuota < 0 {
+		errs = append(errs, "Cassandra.DefaultDailyByteQuota must be >= 0")
+	}
+	_, err = time.ParseDuration(cas.PriorityAgingPeriod)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Cassandra.PriorityAgingPeriod failed to parse: %v", err))
+	}
+	if cas.PriorityAgingExponent <= 0 {
+		errs = append(errs, "Cassandra.PriorityAgingExponent must be > 0")
+	}
+	_, err = time.ParseDuration(cas.SampleTTL)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Cassandra.SampleTTL failed to parse: %v", err))
+	}
+	if cas.StoreLinkProvenance && cas.LinkProvenanceCache < 1 {
+		errs = append(errs, "Cassandra.LinkProvenanceCache must be greater than 0")
+	}
+	if cas.SegmentReadChunkSize < 1 {
+		errs = append(errs, "Cassandra.SegmentReadChunkSize must be greater than 0")
+	}
+	if cas.LinkBuckets < 1 {
+		errs = append(errs, "Cassandra.LinkBuckets must be greater than 0")
+	}
+	switch cas.ClaimStrategy {
+	case "priority", "round_robin", "affinity":
+	default:
+		errs = append(errs, "Cassandra.ClaimStrategy not one of (priority, round_robin, affinity)")
+	}
+	_, err = time.ParseDuration(cas.ClaimAffinityWait)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Cassandra.ClaimAffinityWait failed to parse: %v", err))
+	}
+	if cas.AsyncWriteQueue < 1 {
+		errs = append(errs, "Cassandra.AsyncWriteQueue must be >= 1")
+	}
+	if cas.AsyncWriters < 1 {
+		errs = append(errs, "Cassandra.AsyncWriters must be >= 1")
+	}
+	for _, check := range cas.VerifyNewDomains {
+		if !containsString(VerifyChecks, check) {
+			errs = append(errs, fmt.Sprintf("Cassandra.VerifyNewDomains entry %q not one of %v", check, VerifyChecks))
+		}
+	}
+	if containsString(cas.VerifyNewDomains, VerifyTXT) && cas.VerifyTXTRecord == "" {
+		errs = append(errs, "Cassandra.VerifyTXTRecord must be set to verify new domains by TXT record")
+	}
 
 	keeprat := Config.Fetcher.ActiveFetchersKeepratio
 	if keeprat < 0 || keeprat >= 1.0 {
@@ -282,6 +885,143 @@ func assertConfigInvariants() error {
 			" must choose X such that 0 <= X < 1")
 	}
 
+	for _, tok := range Config.Console.APITokens {
+		parts := strings.SplitN(tok, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, "Console.APITokens entries must look like \"name:token\"")
+			break
+		}
+	}
+
+	for _, list := range Config.Blocklist.Lists {
+		parts := strings.SplitN(list, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			errs = append(errs, "Blocklist.Lists entries must look like \"type:location\"")
+			break
+		}
+	}
+	_, err = time.ParseDuration(Config.Blocklist.RefreshInterval)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Blocklist.RefreshInterval failed to parse: %v", err))
+	}
+
+	hooks := &Config.Webhooks
+	if _, err := NewWebhooks(hooks.Hooks, 0); err != nil {
+		errs = append(errs, fmt.Sprintf("Webhooks.Hooks: %v", err))
+	}
+	_, err = time.ParseDuration(hooks.Timeout)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Webhooks.Timeout failed to parse: %v", err))
+	}
+	if hooks.ErrorRateThreshold <= 0 || hooks.ErrorRateThreshold > 100 {
+		errs = append(errs, "Webhooks.ErrorRateThreshold must be a percentage > 0 and <= 100")
+	}
+	if hooks.ErrorRateMinFetches < 1 {
+		errs = append(errs, "Webhooks.ErrorRateMinFetches must be >= 1")
+	}
+	_, err = time.ParseDuration(hooks.DispatcherStallTime)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Webhooks.DispatcherStallTime failed to parse: %v", err))
+	}
+	if d, err := time.ParseDuration(hooks.RoundOverdueTime); err != nil {
+		errs = append(errs, fmt.Sprintf("Webhooks.RoundOverdueTime failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Webhooks.RoundOverdueTime must be >= 0")
+	}
+
+	if _, err := compileWatchRules(Config.Watch.Rules); err != nil {
+		errs = append(errs, fmt.Sprintf("Watch.Rules: %v", err))
+	}
+
+	shots := &Config.Screenshots
+	if shots.RendererURL != "" {
+		u, err := url.Parse(shots.RendererURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Sprintf("Screenshots.RendererURL must be an http(s) URL, got %q",
+				shots.RendererURL))
+		}
+	}
+	for _, p := range shots.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			errs = append(errs, fmt.Sprintf("Screenshots.Patterns entry %q failed to compile: %v", p, err))
+		}
+	}
+	if shots.Width < 1 || shots.Height < 1 {
+		errs = append(errs, "Screenshots.Width and Screenshots.Height must be >= 1")
+	}
+	if shots.ThumbnailWidth < 1 {
+		errs = append(errs, "Screenshots.ThumbnailWidth must be >= 1")
+	}
+	_, err = time.ParseDuration(shots.Timeout)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Screenshots.Timeout failed to parse: %v", err))
+	}
+
+	if err := checkSessionBootstraps(Config.Sessions.Bootstraps); err != nil {
+		errs = append(errs, fmt.Sprintf("Sessions.Bootstraps: %v", err))
+	}
+	_, err = time.ParseDuration(Config.Sessions.Timeout)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("Sessions.Timeout failed to parse: %v", err))
+	}
+
+	reports := &Config.Reports
+	if d, err := time.ParseDuration(reports.CheckInterval); err != nil {
+		errs = append(errs, fmt.Sprintf("Reports.CheckInterval failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Reports.CheckInterval must be >= 0")
+	}
+	if reports.SMTPServer != "" {
+		if _, _, err := net.SplitHostPort(reports.SMTPServer); err != nil {
+			errs = append(errs, fmt.Sprintf("Reports.SMTPServer must be a host:port: %v", err))
+		}
+	}
+	if reports.MaxLinks < 0 {
+		errs = append(errs, "Reports.MaxLinks must be >= 0")
+	}
+	if d, err := time.ParseDuration(reports.Timeout); err != nil {
+		errs = append(errs, fmt.Sprintf("Reports.Timeout failed to parse: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, "Reports.Timeout must be > 0")
+	}
+
+	for _, s := range Config.Domains.PrivateSuffixes {
+		if s == "" || s != strings.ToLower(s) || strings.Trim(s, ".") != s || strings.ContainsAny(s, "/:* ") {
+			errs = append(errs, fmt.Sprintf("Domains.PrivateSuffixes entries must be lower case domain names, like internal.corp, not %q", s))
+		}
+	}
+	if Config.Domains.CacheSize < 0 {
+		errs = append(errs, "Domains.CacheSize must be >= 0")
+	}
+
+	if Config.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(Config.Metrics.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("Metrics.Listen must be a [host]:port: %v", err))
+		}
+	}
+
+	if Config.Frontier.QueueURL != "" {
+		if u, err := url.Parse(Config.Frontier.QueueURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Sprintf("Frontier.QueueURL must be an http(s) URL, not %q", Config.Frontier.QueueURL))
+		}
+	}
+	if Config.Frontier.ReceiveBatch < 1 {
+		errs = append(errs, "Frontier.ReceiveBatch must be >= 1")
+	}
+	if d, err := time.ParseDuration(Config.Frontier.ReceiveWait); err != nil {
+		errs = append(errs, fmt.Sprintf("Frontier.ReceiveWait failed to parse: %v", err))
+	} else if d < 0 {
+		errs = append(errs, "Frontier.ReceiveWait must be >= 0")
+	}
+	if d, err := time.ParseDuration(Config.Frontier.Timeout); err != nil {
+		errs = append(errs, fmt.Sprintf("Frontier.Timeout failed to parse: %v", err))
+	} else if d <= 0 {
+		errs = append(errs, "Frontier.Timeout must be > 0")
+	}
+	if Config.Frontier.LinksCacheSize < 0 {
+		errs = append(errs, "Frontier.LinksCacheSize must be >= 0")
+	}
+
 	if len(errs) > 0 {
 		em := ""
 		for _, err := range errs {
@@ -310,23 +1050,76 @@ func PostConfigHooks() {
 
 func readConfig() error {
 	SetDefaultConfig()
+	configSources = map[string]string{}
+	configRefs = map[string]interface{}{}
 
 	// See NOTE in SetDefaultConfig regarding sequence values
 	Config.Fetcher.AcceptFormats = []string{}
 	Config.Fetcher.AcceptProtocols = []string{}
 	Config.Fetcher.IgnoreTags = []string{}
 	Config.Fetcher.PurgeSidList = []string{}
+	Config.Fetcher.HashRoutePatterns = []string{}
+	Config.Fetcher.SourceAddresses = []string{}
+	Config.Fetcher.PinnedHosts = []HostPin{}
+	Config.Fetcher.DenyExtensions = []string{}
+	Config.Fetcher.ExtensionOverrides = []ExtensionOverride{}
+	Config.Fetcher.ProxyOverrides = []ProxyOverride{}
+	Config.Fetcher.RangeFetchTypes = []string{}
+	Config.Fetcher.HandlerFormats = []string{}
 
 	Config.Cassandra.Hosts = []string{}
+	Config.Cassandra.VerifyNewDomains = []string{}
+
+	Config.Dispatcher.AliasProbePaths = []string{}
 
+	Config.Console.APITokens = []string{}
+
+	Config.Blocklist.Lists = []string{}
+
+	Config.Webhooks.Hooks = []WebhookConfig{}
+
+	Config.Watch.Rules = []WatchRule{}
+
+	Config.Screenshots.Patterns = []string{}
+
+	Config.Sessions.Bootstraps = []SessionBootstrap{}
+
+	Config.Domains.PrivateSuffixes = []string{}
+
+	configFiles = nil
+	configStrict = false
 	data, err := ioutil.ReadFile(ConfigName)
 	if err != nil {
+		// Running without a config file is allowed, so still take
+		// environment overrides
+		if envErr := applyConfigEnv(); envErr != nil {
+			log4go.Error("Config Error: %v", envErr)
+		} else if refErr := resolveConfigRefs(); refErr != nil {
+			log4go.Error("Config Error: %v", refErr)
+		}
 		return fmt.Errorf("Failed to read config file (%v): %v", ConfigName, err)
 	}
+	layers, err := readConfigLayers(ConfigName, data, map[string]bool{})
+	if err != nil {
+		return err
+	}
+	err = checkConfigKeys(layers)
+	if err != nil {
+		return err
+	}
+	data, err = yaml.Marshal(layers)
+	if err != nil {
+		return fmt.Errorf("Failed to merge config files: %v", err)
+	}
 	err = yaml.Unmarshal(data, &Config)
 	if err != nil {
 		return fmt.Errorf("Failed to unmarshal yaml from config file (%v): %v", ConfigName, err)
 	}
+	for section, keys := range layers {
+		for key := range keys {
+			configSources[fmt.Sprintf("%v.%v", section, key)] = ConfigFromFile
+		}
+	}
 
 	// See NOTE in SetDefaultConfig regarding sequence values
 	fet := &Config.Fetcher
@@ -342,11 +1135,28 @@ func readConfig() error {
 	if len(fet.PurgeSidList) == 0 {
 		fet.PurgeSidList = []string{"jsessionid", "phpsessid", "aspsessionid"}
 	}
+	if len(fet.RangeFetchTypes) == 0 {
+		fet.RangeFetchTypes = []string{"text/html", "application/pdf"}
+	}
 
 	if len(Config.Cassandra.Hosts) == 0 {
 		Config.Cassandra.Hosts = []string{"localhost"}
 	}
 
+	if len(Config.Dispatcher.AliasProbePaths) == 0 {
+		Config.Dispatcher.AliasProbePaths = []string{"/", "/robots.txt"}
+	}
+
+	err = applyConfigEnv()
+	if err != nil {
+		return err
+	}
+
+	err = resolveConfigRefs()
+	if err != nil {
+		return err
+	}
+
 	err = assertConfigInvariants()
 	if err != nil {
 		log4go.Info("Loaded config file %v", ConfigName)
@@ -356,3 +1166,579 @@ func readConfig() error {
 
 	return err
 }
+
+// configLayer holds the values set by a config file (and the files it
+// includes), by section then key
+type configLayer map[string]map[interface{}]interface{}
+
+// merge sets every value of over in l. Values are replaced whole; lists are
+// not appended to.
+func (l configLayer) merge(over configLayer) {
+	for section, keys := range over {
+		if l[section] == nil {
+			l[section] = map[interface{}]interface{}{}
+		}
+		for key, v := range keys {
+			l[section][key] = v
+		}
+	}
+}
+
+// configFiles lists the config files the last readConfig loaded, lowest
+// precedence first
+var configFiles []string
+
+// readConfigLayers parses data, the contents of config file path, merging
+// in the files listed by its include key. Included files are applied in
+// order, each overriding those before it, and then path's own values
+// override them all. Includes may be nested; relative paths are relative to
+// the including file. visiting holds the files being read, to catch include
+// cycles.
+func readConfigLayers(path string, data []byte, visiting map[string]bool) (configLayer, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	if visiting[abs] {
+		return nil, fmt.Errorf("Config file %v includes itself", path)
+	}
+	visiting[abs] = true
+	defer delete(visiting, abs)
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal yaml from config file (%v): %v", path, err)
+	}
+
+	merged := configLayer{}
+	if strict, ok := doc["strict"]; ok && strict != nil {
+		s, ok := strict.(bool)
+		if !ok {
+			return nil, fmt.Errorf("Config file %v: strict must be true or false", path)
+		}
+		configStrict = configStrict || s
+	}
+
+	if inc, ok := doc["include"]; ok && inc != nil {
+		list, ok := inc.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Config file %v: include must be a list of files", path)
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("Config file %v: include entry %v is not a file name", path, item)
+			}
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(path), name)
+			}
+			incData, err := ioutil.ReadFile(name)
+			if os.IsNotExist(err) {
+				// Not reported as a missing file, which init ignores
+				return nil, fmt.Errorf("Config file %v includes %v, which does not exist", path, name)
+			} else if err != nil {
+				return nil, fmt.Errorf("Failed to read config file (%v) included by %v: %v", name, path, err)
+			}
+			layer, err := readConfigLayers(name, incData, visiting)
+			if err != nil {
+				return nil, err
+			}
+			merged.merge(layer)
+		}
+	}
+
+	own := configLayer{}
+	for section, v := range doc {
+		if section == "include" || section == "strict" || v == nil {
+			continue
+		}
+		keys, ok := v.(map[interface{}]interface{})
+		if !ok && isConfigSection(section) {
+			return nil, fmt.Errorf("Failed to unmarshal yaml from config file (%v): section %v is not a mapping",
+				path, section)
+		} else if !ok {
+			// Not a section walker knows; kept (empty) so checkConfigKeys
+			// reports it
+			keys = map[interface{}]interface{}{}
+		}
+		own[section] = keys
+	}
+	merged.merge(own)
+	configFiles = append(configFiles, path)
+	return merged, nil
+}
+
+// isConfigSection returns true if section is one of the sections of Config
+func isConfigSection(section string) bool {
+	found := false
+	forEachConfigValue(func(s, key string, v reflect.Value) {
+		found = found || s == section
+	})
+	return found
+}
+
+// configStrict is true if any config file the last readConfig loaded set
+// strict: true
+var configStrict bool
+
+// deprecatedConfigKeys maps deprecated "section.key" names to the
+// "section.key" that replaced them, or "" if the setting was removed. Values
+// given under a renamed key are applied to its replacement (unless that is
+// set too). Add an entry here whenever a key is renamed or dropped.
+var deprecatedConfigKeys = map[string]string{}
+
+// checkConfigKeys warns about keys in layers that walker doesn't know, which
+// are likely typos that would otherwise silently leave the default in place,
+// and about deprecated keys, moving the values of renamed ones to their
+// replacements. In strict mode these are errors instead.
+func checkConfigKeys(layers configLayer) error {
+	known := map[string]map[string]reflect.Type{}
+	var sections []string
+	forEachConfigValue(func(section, key string, v reflect.Value) {
+		if known[section] == nil {
+			known[section] = map[string]reflect.Type{}
+			sections = append(sections, section)
+		}
+		known[section][key] = v.Type()
+	})
+
+	var problems []string
+	for section, keys := range layers {
+		if known[section] == nil {
+			problems = append(problems, fmt.Sprintf("unknown section %v%v", section,
+				didYouMean(section, sections)))
+			continue
+		}
+		var names []string
+		for key := range known[section] {
+			names = append(names, key)
+		}
+		for k, v := range keys {
+			key := fmt.Sprint(k)
+			name := section + "." + key
+			if repl, ok := deprecatedConfigKeys[name]; ok {
+				delete(keys, k)
+				if repl == "" {
+					problems = append(problems, fmt.Sprintf("%v is deprecated and no longer used", name))
+					continue
+				}
+				problems = append(problems, fmt.Sprintf("%v is deprecated, use %v instead", name, repl))
+				parts := strings.SplitN(repl, ".", 2)
+				if layers[parts[0]] == nil {
+					layers[parts[0]] = map[interface{}]interface{}{}
+				}
+				if _, set := layers[parts[0]][parts[1]]; !set {
+					layers[parts[0]][parts[1]] = v
+				}
+				continue
+			}
+			typ, ok := known[section][key]
+			if !ok {
+				problems = append(problems, fmt.Sprintf("unknown key %v%v", name, didYouMean(key, names)))
+				continue
+			}
+			problems = append(problems, checkListKeys(name, typ, v)...)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	sort.Strings(problems)
+	if configStrict {
+		return fmt.Errorf("Config problems (strict mode): %v", strings.Join(problems, "; "))
+	}
+	for _, p := range problems {
+		log4go.Warn("Config: %v", p)
+	}
+	return nil
+}
+
+// checkListKeys returns the unknown keys of the entries of v, the value of
+// config key name, if it is a list of structs (ex. webhooks.hooks)
+func checkListKeys(name string, typ reflect.Type, v interface{}) []string {
+	list, ok := v.([]interface{})
+	if typ.Kind() != reflect.Slice || typ.Elem().Kind() != reflect.Struct || !ok {
+		return nil
+	}
+	var fields []string
+	for i := 0; i < typ.Elem().NumField(); i++ {
+		fields = append(fields, strings.Split(typ.Elem().Field(i).Tag.Get("yaml"), ",")[0])
+	}
+
+	var problems []string
+	for i, item := range list {
+		entry, ok := item.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		for k := range entry {
+			key := fmt.Sprint(k)
+			if !containsString(fields, key) {
+				problems = append(problems, fmt.Sprintf("unknown key %v in %v entry %d%v",
+					key, name, i, didYouMean(key, fields)))
+			}
+		}
+	}
+	return problems
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// didYouMean returns a suggestion of the name in names closest to name, or ""
+// if none are close enough to be a likely typo
+func didYouMean(name string, names []string) string {
+	best, bestDist := "", len(name)/3+1
+	for _, n := range names {
+		if d := editDistance(name, n); d < bestDist || (d == bestDist && best != "" && n < best) {
+			best, bestDist = n, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %v?)", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Where a configuration value came from, as reported by EffectiveConfig
+const (
+	ConfigFromDefault = "default"
+	ConfigFromFile    = "file"
+	ConfigFromEnv     = "env"
+)
+
+// configSources maps "section.key" to ConfigFromFile or ConfigFromEnv for
+// every value that was not left at its default by the last readConfig
+var configSources = map[string]string{}
+
+// secretConfigKeys holds the section.key names of the ConfigStruct fields
+// tagged secret:"true", whose values EffectiveConfig never reports
+var secretConfigKeys = func() map[string]bool {
+	keys := map[string]bool{}
+	cfg := reflect.TypeOf(Config)
+	for i := 0; i < cfg.NumField(); i++ {
+		section := cfg.Field(i)
+		for j := 0; j < section.Type.NumField(); j++ {
+			f := section.Type.Field(j)
+			if f.Tag.Get("secret") == "true" {
+				keys[configYAMLName(section)+"."+configYAMLName(f)] = true
+			}
+		}
+	}
+	return keys
+}()
+
+// configYAMLName returns the name f is given in the yaml file
+func configYAMLName(f reflect.StructField) string {
+	return strings.Split(f.Tag.Get("yaml"), ",")[0]
+}
+
+// forEachConfigValue calls fn with every settable value in Config, along with
+// its yaml section and key names.
+func forEachConfigValue(fn func(section, key string, v reflect.Value)) {
+	cfg := reflect.ValueOf(&Config).Elem()
+	for i := 0; i < cfg.NumField(); i++ {
+		section := configYAMLName(cfg.Type().Field(i))
+		sv := cfg.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			fn(section, configYAMLName(sv.Type().Field(j)), sv.Field(j))
+		}
+	}
+}
+
+// applyConfigEnv overrides config values with any WALKER_<SECTION>_<KEY>
+// environment variables that are set.
+func applyConfigEnv() error {
+	var errs []string
+	forEachConfigValue(func(section, key string, v reflect.Value) {
+		name := "WALKER_" + strings.ToUpper(section+"_"+key)
+		val := os.Getenv(name)
+		if val == "" {
+			return
+		}
+
+		var err error
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(val)
+		case reflect.Bool:
+			var b bool
+			b, err = strconv.ParseBool(val)
+			v.SetBool(b)
+		case reflect.Int, reflect.Int64:
+			var n int64
+			n, err = strconv.ParseInt(val, 10, 64)
+			v.SetInt(n)
+		case reflect.Float32, reflect.Float64:
+			var n float64
+			n, err = strconv.ParseFloat(val, 64)
+			v.SetFloat(n)
+		case reflect.Slice:
+			if v.Type().Elem().Kind() != reflect.String {
+				err = fmt.Errorf("unsupported type %v", v.Type())
+				break
+			}
+			var list []string
+			for _, s := range strings.Split(val, ",") {
+				list = append(list, strings.TrimSpace(s))
+			}
+			v.Set(reflect.ValueOf(list))
+		default:
+			err = fmt.Errorf("unsupported type %v", v.Type())
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			return
+		}
+		configSources[section+"."+key] = ConfigFromEnv
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to apply config from environment: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// configRefPattern matches a ${ENV_VAR} reference in a config value
+var configRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// unresolvedConfigKeys are not resolved by resolveConfigRefs. Blocklists have
+// their own "file:<path>" syntax.
+var unresolvedConfigKeys = map[string]bool{
+	"blocklist.lists": true,
+}
+
+// configRefs holds, by "section.key", the values as written of those
+// resolveConfigRefs changed, so EffectiveConfig shows the references rather
+// than the secrets they resolved to
+var configRefs = map[string]interface{}{}
+
+// resolveConfigRefs resolves credential references in config values, so
+// secrets needn't be written in the config file itself. In any string value
+// (including list entries and the fields of webhooks and session bootstraps),
+// ${ENV_VAR} is replaced with the variable's value, and a value that is a
+// file:///path URL is replaced with the contents of the file, less any
+// trailing newline. Referring to an unset variable or unreadable file is an
+// error.
+func resolveConfigRefs() error {
+	var errs []string
+	forEachConfigValue(func(section, key string, v reflect.Value) {
+		name := section + "." + key
+		if unresolvedConfigKeys[name] {
+			return
+		}
+		orig := copyConfigValue(v).Interface()
+		changed, err := resolveConfigValue(v)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", name, err))
+			return
+		}
+		if changed {
+			configRefs[name] = orig
+		}
+	})
+	if len(errs) > 0 {
+		return fmt.Errorf("Failed to resolve config references: %v", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// copyConfigValue copies v, including the elements of slices (and slices
+// within those), so resolving v leaves the copy unchanged
+func copyConfigValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyConfigValue(v.Index(i)))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyConfigValue(v.Field(i)))
+			}
+		}
+		return c
+	}
+	return v
+}
+
+// resolveConfigValue resolves the references in v, a string, a struct or a
+// slice of either, returning true if any were found
+func resolveConfigValue(v reflect.Value) (bool, error) {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := resolveConfigRef(v.String())
+		if err != nil || s == v.String() {
+			return false, err
+		}
+		v.SetString(s)
+		return true, nil
+	case reflect.Slice, reflect.Struct:
+		n := v.Len
+		field := v.Index
+		if v.Kind() == reflect.Struct {
+			n, field = v.NumField, v.Field
+		}
+		changed := false
+		for i := 0; i < n(); i++ {
+			c, err := resolveConfigValue(field(i))
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+		return changed, nil
+	}
+	return false, nil
+}
+
+// resolveConfigRef resolves the references in a single config string
+func resolveConfigRef(s string) (string, error) {
+	if strings.HasPrefix(s, "file://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", fmt.Errorf("Failed to parse %q: %v", s, err)
+		}
+		b, err := ioutil.ReadFile(u.Path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+
+	var missing []string
+	s = configRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := configRefPattern.FindStringSubmatch(ref)[1]
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return val
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable %v is not set", strings.Join(missing, ", "))
+	}
+	return s, nil
+}
+
+// ConfigValue is a single configuration value and where it came from (one of
+// ConfigFromDefault, ConfigFromFile or ConfigFromEnv)
+type ConfigValue struct {
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// ConfigReport describes the running configuration; see EffectiveConfig.
+type ConfigReport struct {
+	// The config file that was loaded
+	ConfigFile string `json:"config_file"`
+
+	// Every config file loaded (ConfigFile and those it includes), lowest
+	// precedence first
+	ConfigFiles []string `json:"config_files"`
+
+	// A hash of Values. Processes running with the same configuration report
+	// the same fingerprint, making configuration drift across nodes easy to
+	// spot.
+	Fingerprint string `json:"fingerprint"`
+
+	// Values by section then key, named as in the yaml file
+	Values map[string]map[string]ConfigValue `json:"values"`
+}
+
+// EffectiveConfig returns the configuration this process is running with.
+// Secrets (passwords, tokens, etc.; see ConfigStruct) are redacted.
+func EffectiveConfig() *ConfigReport {
+	rep := &ConfigReport{
+		ConfigFile:  ConfigName,
+		ConfigFiles: append([]string{}, configFiles...),
+		Values:      map[string]map[string]ConfigValue{},
+	}
+	forEachConfigValue(func(section, key string, v reflect.Value) {
+		if rep.Values[section] == nil {
+			rep.Values[section] = map[string]ConfigValue{}
+		}
+		cv := ConfigValue{Value: v.Interface(), Source: configSources[section+"."+key]}
+		if cv.Source == "" {
+			cv.Source = ConfigFromDefault
+		}
+		if ref, ok := configRefs[section+"."+key]; ok {
+			cv.Value = ref
+		}
+		if secretConfigKeys[section+"."+key] && !isZeroConfigValue(v) {
+			cv.Value = "<redacted>"
+		}
+		rep.Values[section][key] = cv
+	})
+
+	// json sorts map keys, so this is stable for the same values
+	b, err := json.Marshal(rep.Values)
+	if err == nil {
+		h := fnv.New64()
+		h.Write(b)
+		rep.Fingerprint = fmt.Sprintf("%016x", h.Sum64())
+	}
+	return rep
+}
+
+// isZeroConfigValue returns true if v is unset: an empty list, or the zero
+// value of any other type
+func isZeroConfigValue(v reflect.Value) bool {
+	if v.Kind() == reflect.Slice {
+		return v.Len() == 0
+	}
+	return v.Interface() == reflect.Zero(v.Type()).Interface()
+}
+
+// ConfigHandler serves EffectiveConfig as JSON. cmd registers it at
+// /debug/config on the debug (pprof) listener.
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.MarshalIndent(EffectiveConfig(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
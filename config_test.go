@@ -1,9 +1,14 @@
 package walker
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
 	"path"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 
 	"code.google.com/p/log4go"
@@ -91,3 +96,320 @@ func TestSequenceOverwrites(t *testing.T) {
 			Config.Cassandra.Hosts)
 	}
 }
+
+func TestSecretConfigKeys(t *testing.T) {
+	// Catch new credential settings that weren't tagged secret
+	looksSecret := regexp.MustCompile(`password|secret|token|credential`)
+	forEachConfigValue(func(section, key string, v reflect.Value) {
+		if looksSecret.MatchString(key) && !secretConfigKeys[section+"."+key] {
+			t.Errorf("Expected %v.%v to be tagged secret", section, key)
+		}
+	})
+	for _, key := range []string{"fetcher.proxy_url", "webhooks.hooks", "sessions.bootstraps", "frontier.queue_url"} {
+		if !secretConfigKeys[key] {
+			t.Errorf("Expected %v to be secret", key)
+		}
+	}
+	if secretConfigKeys["fetcher.user_agent"] {
+		t.Errorf("Expected fetcher.user_agent not to be secret")
+	}
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	defer func() {
+		os.Setenv("WALKER_FETCHER_MAX_LINKS_PER_PAGE", "")
+		os.Setenv("WALKER_CASSANDRA_HOSTS", "")
+		os.Setenv("WALKER_CONSOLE_API_TOKENS", "")
+		// Reset config for the remaining tests
+		LoadTestConfig("test-walker.yaml")
+	}()
+
+	os.Setenv("WALKER_FETCHER_MAX_LINKS_PER_PAGE", "7")
+	os.Setenv("WALKER_CASSANDRA_HOSTS", "a.host.com, b.host.com")
+	os.Setenv("WALKER_CONSOLE_API_TOKENS", "ops:abc123")
+	LoadTestConfig("test-walker2.yaml")
+
+	if Config.Fetcher.MaxLinksPerPage != 7 {
+		t.Errorf("Expected max_links_per_page to be set from env, got %v", Config.Fetcher.MaxLinksPerPage)
+	}
+	if !reflect.DeepEqual(Config.Cassandra.Hosts, []string{"a.host.com", "b.host.com"}) {
+		t.Errorf("Expected hosts to be set from env, got %v", Config.Cassandra.Hosts)
+	}
+
+	rep := EffectiveConfig()
+	tests := []struct {
+		section, key string
+		value        interface{}
+		source       string
+	}{
+		{"fetcher", "user_agent", "Test Agent (set in yaml)", ConfigFromFile},
+		{"fetcher", "max_links_per_page", 7, ConfigFromEnv},
+		{"fetcher", "http_timeout", "30s", ConfigFromDefault},
+		{"cassandra", "hosts", []string{"a.host.com", "b.host.com"}, ConfigFromEnv},
+		{"console", "api_tokens", "<redacted>", ConfigFromEnv},
+	}
+	for _, tst := range tests {
+		cv := rep.Values[tst.section][tst.key]
+		if !reflect.DeepEqual(cv.Value, tst.value) || cv.Source != tst.source {
+			t.Errorf("%v.%v: got %v (from %v), expected %v (from %v)", tst.section, tst.key,
+				cv.Value, cv.Source, tst.value, tst.source)
+		}
+	}
+
+	os.Setenv("WALKER_FETCHER_MAX_LINKS_PER_PAGE", "")
+	LoadTestConfig("test-walker2.yaml")
+	if EffectiveConfig().Fingerprint == rep.Fingerprint {
+		t.Errorf("Expected fingerprint to change along with the config")
+	}
+
+	os.Setenv("WALKER_FETCHER_MAX_LINKS_PER_PAGE", "lots")
+	err := ReadConfigFile(path.Join(GetTestFileDir(), "test-walker2.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "WALKER_FETCHER_MAX_LINKS_PER_PAGE") {
+		t.Errorf("Expected an error for a bad environment value, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	ConfigHandler(w, nil)
+	var served ConfigReport
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil {
+		t.Fatalf("Failed to decode ConfigHandler response: %v", err)
+	}
+	if served.Values["fetcher"]["user_agent"].Source != ConfigFromFile {
+		t.Errorf("ConfigHandler served unexpected report: %v", w.Body.String())
+	}
+}
+
+func TestConfigInclude(t *testing.T) {
+	defer func() {
+		// Reset config for the remaining tests
+		LoadTestConfig("test-walker.yaml")
+	}()
+
+	dir, err := ioutil.TempDir("", "walker-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"base.yaml": `
+fetcher:
+    user_agent: "Base Agent"
+    max_links_per_page: 5
+cassandra:
+    hosts: ["base1", "base2"]
+    keyspace: "walker_base"
+`,
+		"env/prod.yaml": `
+include: ["../defaults.yaml"]
+cassandra:
+    hosts: ["prod1"]
+`,
+		"defaults.yaml": `
+fetcher:
+    http_timeout: 11s
+`,
+		"walker.yaml": `
+include: ["base.yaml", "env/prod.yaml"]
+fetcher:
+    user_agent: "Crawl Agent"
+`,
+		"loop.yaml": `
+include: ["loop.yaml"]
+`,
+		"missing.yaml": `
+include: ["nope.yaml"]
+`,
+	}
+	for name, contents := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatalf("Failed to create %v: %v", path.Dir(p), err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %v: %v", p, err)
+		}
+	}
+
+	if err := ReadConfigFile(path.Join(dir, "walker.yaml")); err != nil {
+		t.Fatalf("Failed to read layered config: %v", err)
+	}
+	if Config.Fetcher.UserAgent != "Crawl Agent" {
+		t.Errorf("Expected the including file to win, got user_agent %q", Config.Fetcher.UserAgent)
+	}
+	if Config.Fetcher.MaxLinksPerPage != 5 || Config.Cassandra.Keyspace != "walker_base" {
+		t.Errorf("Expected values from base.yaml, got %v and %q",
+			Config.Fetcher.MaxLinksPerPage, Config.Cassandra.Keyspace)
+	}
+	if !reflect.DeepEqual(Config.Cassandra.Hosts, []string{"prod1"}) {
+		t.Errorf("Expected the later include to replace hosts, got %v", Config.Cassandra.Hosts)
+	}
+	if Config.Fetcher.HTTPTimeout != "11s" {
+		t.Errorf("Expected the nested include to be read, got http_timeout %q", Config.Fetcher.HTTPTimeout)
+	}
+
+	rep := EffectiveConfig()
+	expected := []string{"base.yaml", "defaults.yaml", "env/prod.yaml", "walker.yaml"}
+	if len(rep.ConfigFiles) != len(expected) {
+		t.Fatalf("Expected config files %v, got %v", expected, rep.ConfigFiles)
+	}
+	for i, name := range expected {
+		if !strings.HasSuffix(rep.ConfigFiles[i], name) {
+			t.Errorf("Expected config file %d to be %v, got %v", i, name, rep.ConfigFiles[i])
+		}
+	}
+	if rep.Values["fetcher"]["http_timeout"].Source != ConfigFromFile {
+		t.Errorf("Expected included values to come from file, got %v", rep.Values["fetcher"]["http_timeout"])
+	}
+
+	err = ReadConfigFile(path.Join(dir, "loop.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "includes itself") {
+		t.Errorf("Expected an include cycle error, got %v", err)
+	}
+	err = ReadConfigFile(path.Join(dir, "missing.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Errorf("Expected a missing include error, got %v", err)
+	}
+}
+
+func TestConfigRefs(t *testing.T) {
+	defer func() {
+		os.Setenv("WALKER_CASSANDRA_PASSWORD", "")
+		os.Unsetenv("TEST_WALKER_TOKEN")
+		// Reset config for the remaining tests
+		LoadTestConfig("test-walker.yaml")
+	}()
+
+	dir, err := ioutil.TempDir("", "walker-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secret := path.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte("hunter2\n"), 0600); err != nil {
+		t.Fatalf("Failed to write %v: %v", secret, err)
+	}
+	cfg := path.Join(dir, "walker.yaml")
+	err = ioutil.WriteFile(cfg, []byte(`
+cassandra:
+    username: walker
+console:
+    api_tokens: ["ops:${TEST_WALKER_TOKEN}"]
+webhooks:
+    hooks:
+      - url: https://hooks.example.com/${TEST_WALKER_TOKEN}
+        events: [domain_completed]
+blocklist:
+    lists: ["file:///${TEST_WALKER_TOKEN}"]
+sessions:
+    bootstraps:
+      - domain: example.com
+        steps:
+          - url: https://login.example.com/
+            form:
+              - name: password
+                value: ${TEST_WALKER_TOKEN}
+`), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write %v: %v", cfg, err)
+	}
+
+	os.Setenv("TEST_WALKER_TOKEN", "abc123")
+	os.Setenv("WALKER_CASSANDRA_PASSWORD", "file://"+secret)
+	if err := ReadConfigFile(cfg); err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+	if Config.Cassandra.Password != "hunter2" {
+		t.Errorf("Expected password from file, got %q", Config.Cassandra.Password)
+	}
+	if !reflect.DeepEqual(Config.Console.APITokens, []string{"ops:abc123"}) {
+		t.Errorf("Expected api token from env, got %v", Config.Console.APITokens)
+	}
+	if len(Config.Webhooks.Hooks) != 1 || Config.Webhooks.Hooks[0].URL != "https://hooks.example.com/abc123" {
+		t.Errorf("Expected webhook url from env, got %v", Config.Webhooks.Hooks)
+	}
+	if !reflect.DeepEqual(Config.Blocklist.Lists, []string{"file:///${TEST_WALKER_TOKEN}"}) {
+		t.Errorf("Expected blocklists to be left alone, got %v", Config.Blocklist.Lists)
+	}
+	if v := Config.Sessions.Bootstraps[0].Steps[0].Form[0].Value; v != "abc123" {
+		t.Errorf("Expected session form value from env, got %q", v)
+	}
+
+	rep := EffectiveConfig()
+	if v := rep.Values["console"]["api_tokens"].Value; !reflect.DeepEqual(v, "<redacted>") {
+		t.Errorf("Expected api tokens to stay redacted, got %v", v)
+	}
+	if v := rep.Values["cassandra"]["password"].Value; !reflect.DeepEqual(v, "<redacted>") {
+		t.Errorf("Expected password to stay redacted, got %v", v)
+	}
+	if v := rep.Values["cassandra"]["username"].Value; !reflect.DeepEqual(v, "walker") {
+		t.Errorf("Expected username to be reported, got %v", v)
+	}
+	if v := rep.Values["sessions"]["bootstraps"].Value; !reflect.DeepEqual(v, "<redacted>") {
+		t.Errorf("Expected session bootstraps to stay redacted, got %v", v)
+	}
+
+	os.Unsetenv("TEST_WALKER_TOKEN")
+	err = ReadConfigFile(cfg)
+	if err == nil || !strings.Contains(err.Error(), "TEST_WALKER_TOKEN is not set") {
+		t.Errorf("Expected an error for an unset variable, got %v", err)
+	}
+}
+
+func TestConfigKeyChecks(t *testing.T) {
+	defer func() {
+		delete(deprecatedConfigKeys, "fetcher.old_user_agent")
+		delete(deprecatedConfigKeys, "fetcher.removed")
+		// Reset config for the remaining tests
+		LoadTestConfig("test-walker.yaml")
+	}()
+	deprecatedConfigKeys["fetcher.old_user_agent"] = "fetcher.user_agent"
+	deprecatedConfigKeys["fetcher.removed"] = ""
+
+	dir, err := ioutil.TempDir("", "walker-config")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	contents := `
+fetcher:
+    old_user_agent: "Renamed Agent"
+    removed: 1
+dispatcher:
+    num_links_per_segement: 10
+fetchr:
+    user_agent: "Lost"
+webhooks:
+    hooks:
+      - url: http://hooks.example.com/
+        evnets: [domain_completed]
+`
+	cfg := path.Join(dir, "walker.yaml")
+	if err := ioutil.WriteFile(cfg, []byte(contents), 0644); err != nil {
+		t.Fatalf("Failed to write %v: %v", cfg, err)
+	}
+	if err := ReadConfigFile(cfg); err != nil {
+		t.Fatalf("Expected only warnings outside of strict mode, got %v", err)
+	}
+	if Config.Fetcher.UserAgent != "Renamed Agent" {
+		t.Errorf("Expected the deprecated key to set its replacement, got %q", Config.Fetcher.UserAgent)
+	}
+
+	if err := ioutil.WriteFile(cfg, []byte("strict: true\n"+contents), 0644); err != nil {
+		t.Fatalf("Failed to write %v: %v", cfg, err)
+	}
+	err = ReadConfigFile(cfg)
+	if err == nil {
+		t.Fatalf("Expected an error in strict mode")
+	}
+	for _, problem := range []string{
+		"fetcher.old_user_agent is deprecated, use fetcher.user_agent instead",
+		"fetcher.removed is deprecated and no longer used",
+		"unknown key dispatcher.num_links_per_segement (did you mean num_links_per_segment?)",
+		"unknown section fetchr (did you mean fetcher?)",
+		"unknown key evnets in webhooks.hooks entry 0 (did you mean events?)",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected error to contain %q, got %v", problem, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package console
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/cassandra"
+)
+
+// AuditPageLength is the number of entries shown on the /audit page
+const AuditPageLength = 250
+
+// recordAudit adds an entry to the audit log. Failing to record it is logged
+// but doesn't fail the change itself, which has already been made.
+func recordAudit(actor, action, target, detail string) {
+	entry := &cassandra.AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	log4go.Info("Audit: %v %v %v %v", actor, action, target, detail)
+	if err := DS.RecordAudit(entry); err != nil {
+		log4go.Error("Failed to record audit entry: %v", err)
+	}
+}
+
+// recordLinksAdded records an audit entry for each domain links were added to
+func recordLinksAdded(actor string, links []string, excludeReason string) {
+	counts := map[string]int{}
+	for _, link := range links {
+		u, err := walker.ParseURL(link)
+		if err != nil {
+			continue
+		}
+		dom, err := u.ToplevelDomainPlusOne()
+		if err != nil {
+			continue
+		}
+		counts[dom]++
+	}
+
+	var domains []string
+	for dom := range counts {
+		domains = append(domains, dom)
+	}
+	sort.Strings(domains)
+	for _, dom := range domains {
+		detail := fmt.Sprintf("%d links", counts[dom])
+		if excludeReason != "" {
+			detail += fmt.Sprintf(" (excluded: %v)", excludeReason)
+		}
+		recordAudit(actor, cassandra.AuditAddLinks, dom, detail)
+	}
+}
+
+// remoteHost returns the address a request came from, without the port
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// consoleActor returns who is making a console request, for the audit log.
+// The console has no logins, so this is just where the request came from.
+func consoleActor(req *http.Request) string {
+	return "console@" + remoteHost(req)
+}
+
+// AuditController returns the page rooted at /audit
+func AuditController(w http.ResponseWriter, req *http.Request) {
+	entries, err := DS.ListAudit(AuditPageLength)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListAudit failed: %v", err))
+		return
+	}
+
+	mp := map[string]interface{}{
+		"Entries": entries,
+	}
+	Render.HTML(w, http.StatusOK, "audit", mp)
+}
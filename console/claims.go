@@ -0,0 +1,28 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ClaimsController returns the page rooted at /claims, showing the running
+// fetchers and the domains each holds, with how long it has held them and
+// how far through their segments it is
+func ClaimsController(w http.ResponseWriter, req *http.Request) {
+	fetchers, err := DS.ListClaims()
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListClaims failed: %v", err))
+		return
+	}
+
+	claimed := 0
+	for _, f := range fetchers {
+		claimed += len(f.Claims)
+	}
+
+	mp := map[string]interface{}{
+		"Fetchers": fetchers,
+		"Claimed":  claimed,
+	}
+	Render.HTML(w, http.StatusOK, "claims", mp)
+}
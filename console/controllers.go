@@ -5,8 +5,10 @@ import (
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"code.google.com/p/log4go"
 	"github.com/gorilla/mux"
@@ -42,20 +44,89 @@ func Routes() []Route {
 		Route{Path: "/links/{domain}", Controller: LinksController},
 		Route{Path: "/links/{domain}/{seedURL}", Controller: LinksController},
 		Route{Path: "/historical/{url}", Controller: LinksHistoricalController},
+		Route{Path: "/screenshot/{url}/{time}", Controller: ScreenshotController},
 		Route{Path: "/findLinks", Controller: FindLinksController},
 		Route{Path: "/filterLinks", Controller: FilterLinksController},
+		Route{Path: "/filterTester", Controller: FilterTesterController},
 		Route{Path: "/excludeToggle/{domain}/{direction}", Controller: ExcludeToggleController},
 		Route{Path: "/changePriority", Controller: ChangePriorityController},
+		Route{Path: "/changeCrawlDelay", Controller: ChangeCrawlDelayController},
+		Route{Path: "/changeScope", Controller: ChangeScopeController},
+		Route{Path: "/changeMaxSegments", Controller: ChangeMaxSegmentsController},
+		Route{Path: "/config", Controller: ConfigController},
+		Route{Path: "/audit", Controller: AuditController},
+		Route{Path: "/samples", Controller: SamplesController},
+		Route{Path: "/sample/{id}", Controller: SampleController},
+		Route{Path: "/claims", Controller: ClaimsController},
+		Route{Path: "/coverage", Controller: CoverageController},
+		Route{Path: "/crawldiff/{domain}", Controller: CrawlDiffController},
+		Route{Path: "/redirects/{domain}", Controller: RedirectsController},
+		Route{Path: "/outlinks/{domain}", Controller: OutlinksController},
+		Route{Path: "/reports/{domain}", Controller: ReportsController},
+		Route{Path: "/latency", Controller: LatencyController},
+		Route{Path: "/frontier", Controller: FrontierController},
+		Route{Path: "/traps", Controller: TrapsController},
+		Route{Path: "/setParamRule", Controller: SetParamRuleController},
+		Route{Path: "/dispatchers", Controller: DispatchersController},
 	}
 }
 
 // HomeController returns / page
 func HomeController(w http.ResponseWriter, req *http.Request) {
 	mp := map[string]interface{}{}
+	proj, err := DS.ProjectCrawl(HomeSlowestDomains)
+	if err != nil {
+		log4go.Error("ProjectCrawl failed: %v", err)
+		mp["HasErrorMessage"] = true
+		mp["ErrorMessage"] = []string{fmt.Sprintf("Failed to project crawl: %v", err)}
+	} else {
+		mp["Projection"] = proj
+		mp["FetchersNeeded"] = proj.FetchersNeeded(24 * time.Hour)
+	}
 	Render.HTML(w, http.StatusOK, "home", mp)
 	return
 }
 
+// HomeSlowestDomains is the number of slowest domains listed on the home page
+const HomeSlowestDomains = 10
+
+// ConfigController shows the configuration the console is running with
+func ConfigController(w http.ResponseWriter, req *http.Request) {
+	rep := walker.EffectiveConfig()
+
+	var sections []string
+	for s := range rep.Values {
+		sections = append(sections, s)
+	}
+	sort.Strings(sections)
+
+	type configRow struct {
+		Key    string
+		Value  interface{}
+		Source string
+	}
+	var rows []configRow
+	for _, s := range sections {
+		var keys []string
+		for k := range rep.Values[s] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := rep.Values[s][k]
+			rows = append(rows, configRow{Key: s + "." + k, Value: v.Value, Source: v.Source})
+		}
+	}
+
+	mp := map[string]interface{}{
+		"ConfigFile":  rep.ConfigFile,
+		"ConfigFiles": rep.ConfigFiles,
+		"Fingerprint": rep.Fingerprint,
+		"Rows":        rows,
+	}
+	Render.HTML(w, http.StatusOK, "config", mp)
+}
+
 // The links and list templates have a hidden form that is used to track the list of previous links
 // so that the previous button works correctly (see https://jira2.iparadigms.com/browse/TRN-134). The
 // same form is used to allow the user to reset the window-length (i.e. number of results per page).
@@ -200,7 +271,13 @@ func ListDomainsController(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	query := cassandra.DQ{Limit: session.ListPageWindowLength()}
+	var errorMessage []string
+	query, err := parseDomainFilters(req.URL.Query())
+	if err != nil {
+		errorMessage = append(errorMessage, err.Error())
+		query = cassandra.DQ{}
+	}
+	query.Limit = session.ListPageWindowLength()
 	if seed == "" {
 		prevButtonClass = "disabled"
 	} else {
@@ -222,6 +299,9 @@ func ListDomainsController(w http.ResponseWriter, req *http.Request) {
 	nextButtonClass := "disabled"
 	if len(dinfos) == query.Limit {
 		nextLink = url.QueryEscape(dinfos[len(dinfos)-1].Domain)
+		if req.URL.RawQuery != "" {
+			nextLink += "?" + req.URL.RawQuery
+		}
 		nextButtonClass = ""
 	}
 
@@ -241,10 +321,62 @@ func ListDomainsController(w http.ResponseWriter, req *http.Request) {
 		"Prev":            prevLink,
 		"PrevList":        prevList,
 		"PageLengthLinks": pageLenDropdown,
+		"Params":          req.URL.Query(),
+		"Sorts":           cassandra.DomainSorts,
+		"FilterNames":     []string{"excluded", "dispatched", "claimed"},
+		"HasErrorMessage": len(errorMessage) > 0,
+		"ErrorMessage":    errorMessage,
 	}
 	Render.HTML(w, http.StatusOK, "list", mp)
 }
 
+// parseDomainFilters reads the filter and sort parameters of the domain list
+// page into a DQ. Boolean filters take "yes" or "no", anything else (or
+// nothing) matches any domain.
+func parseDomainFilters(v url.Values) (cassandra.DQ, error) {
+	boolFilter := func(name string) cassandra.BoolFilter {
+		switch v.Get(name) {
+		case "yes":
+			return cassandra.FilterTrue
+		case "no":
+			return cassandra.FilterFalse
+		}
+		return cassandra.FilterAny
+	}
+
+	query := cassandra.DQ{
+		Excluded:   boolFilter("excluded"),
+		Dispatched: boolFilter("dispatched"),
+		Claimed:    boolFilter("claimed"),
+		SortDesc:   v.Get("desc") != "",
+	}
+
+	var err error
+	if s := v.Get("min_priority"); s != "" {
+		query.MinPriority, err = strconv.Atoi(s)
+		if err != nil {
+			return query, fmt.Errorf("Bad minimum priority %q", s)
+		}
+	}
+	if s := v.Get("min_error_rate"); s != "" {
+		// Given as a percentage
+		pct, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return query, fmt.Errorf("Bad minimum error rate %q", s)
+		}
+		query.MinErrorRate = pct / 100
+	}
+
+	sort := cassandra.DomainSort(v.Get("sort"))
+	for _, s := range cassandra.DomainSorts {
+		if s == sort {
+			query.Sort = sort
+			return query, nil
+		}
+	}
+	return query, fmt.Errorf("Unknown sort %q", sort)
+}
+
 // FindDomainController returns pages rooted at /find
 func FindDomainController(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
@@ -387,6 +519,39 @@ func AddLinkIndexController(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// Checking shows the pre-flight results, keeping the links in the form to
+	// be submitted (or edited) after
+	if len(req.Form["preflight"]) > 0 {
+		reports, perrs := runPreflight(links)
+		for _, err := range perrs {
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		}
+		var checked []*walker.PreflightReport
+		for _, r := range reports {
+			if r != nil {
+				checked = append(checked, r)
+			}
+		}
+		info := "All pre-flight checks passed; submit to add the links"
+		if len(errs) > 0 || !preflightPassed(checked) {
+			info = "Some pre-flight checks failed; the links have not been added"
+		}
+		mp := map[string]interface{}{
+			"HasText":         true,
+			"Text":            text,
+			"Exclude":         len(req.Form["exclude"]) > 0,
+			"Preflight":       checked,
+			"HasInfoMessage":  true,
+			"InfoMessage":     []string{info},
+			"HasErrorMessage": len(errs) > 0,
+			"ErrorMessage":    errs,
+		}
+		Render.HTML(w, http.StatusOK, "add", mp)
+		return
+	}
+
 	excludeReason := ""
 	if len(req.Form["exclude"]) > 0 {
 		excludeReason = "Manual exclude"
@@ -404,6 +569,7 @@ func AddLinkIndexController(w http.ResponseWriter, req *http.Request) {
 		Render.HTML(w, http.StatusOK, "add", mp)
 		return
 	}
+	recordLinksAdded(consoleActor(req), links, excludeReason)
 
 	type HistoryLink struct {
 		URL         string
@@ -476,10 +642,17 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 	seedURL := vars["seedURL"]
 	needHeader := false
 	prevButtonClass := ""
+	var subdomainStats []*cassandra.SubdomainStats
 	if seedURL == "" {
 		needHeader = true
 		query.Limit /= 2
 		prevButtonClass = "disabled"
+
+		subdomainStats, err = DS.ListSubdomainStats(domain)
+		if err != nil {
+			replyServerError(w, fmt.Errorf("ListSubdomainStats: %v", err))
+			return
+		}
 	} else {
 		ss, err := decode32(seedURL)
 		if err != nil {
@@ -494,21 +667,56 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 	}
 
 	//
-	// Get the filterRegex if there is one
+	// Get the filters if there are any
 	//
-	filterRegex := ""
 	filterURLSuffix := ""
 	filterRegexSuffix := ""
+	var filterParams, filterDescs []string
 	filterRegexArr, filterRegexOk := req.Form["filterRegex"]
 	if filterRegexOk && len(filterRegexArr) > 0 {
-		filterRegex = filterRegexArr[0]
-		filterURLSuffix = "?filterRegex=" + filterRegex
+		filterRegex := filterRegexArr[0]
+		filterParams = append(filterParams, "filterRegex="+filterRegex)
 		query.FilterRegex, err = decode32(filterRegex)
 		if err != nil {
 			replyServerError(w, fmt.Errorf("decode32 error: %v", err))
 			return
 		}
-		filterRegexSuffix = fmt.Sprintf("(filtered by /%s/)", query.FilterRegex)
+		filterDescs = append(filterDescs, fmt.Sprintf("/%s/", query.FilterRegex))
+	}
+	filterMimeArr, filterMimeOk := req.Form["filterMime"]
+	if filterMimeOk && len(filterMimeArr) > 0 && filterMimeArr[0] != "" {
+		query.MimeType = filterMimeArr[0]
+		filterParams = append(filterParams, "filterMime="+url.QueryEscape(query.MimeType))
+		filterDescs = append(filterDescs, fmt.Sprintf("mime %s", query.MimeType))
+	}
+	minSizeArr, minSizeOk := req.Form["minSize"]
+	if minSizeOk && len(minSizeArr) > 0 && minSizeArr[0] != "" {
+		query.MinSize, err = strconv.ParseInt(minSizeArr[0], 10, 64)
+		if err != nil {
+			replyServerError(w, fmt.Errorf("minSize parse error: %v", err))
+			return
+		}
+		filterParams = append(filterParams, fmt.Sprintf("minSize=%d", query.MinSize))
+		filterDescs = append(filterDescs, fmt.Sprintf("size >= %d bytes", query.MinSize))
+	}
+	maxSizeArr, maxSizeOk := req.Form["maxSize"]
+	if maxSizeOk && len(maxSizeArr) > 0 && maxSizeArr[0] != "" {
+		query.MaxSize, err = strconv.ParseInt(maxSizeArr[0], 10, 64)
+		if err != nil {
+			replyServerError(w, fmt.Errorf("maxSize parse error: %v", err))
+			return
+		}
+		filterParams = append(filterParams, fmt.Sprintf("maxSize=%d", query.MaxSize))
+		filterDescs = append(filterDescs, fmt.Sprintf("size <= %d bytes", query.MaxSize))
+	}
+	if req.Form.Get("parseFailed") != "" {
+		query.ParseFailed = true
+		filterParams = append(filterParams, "parseFailed=1")
+		filterDescs = append(filterDescs, "failed to parse")
+	}
+	if len(filterParams) > 0 {
+		filterURLSuffix = "?" + strings.Join(filterParams, "&")
+		filterRegexSuffix = fmt.Sprintf("(filtered by %s)", strings.Join(filterDescs, ", "))
 	}
 
 	//
@@ -589,6 +797,8 @@ func LinksController(w http.ResponseWriter, req *http.Request) {
 
 		"MaxAllowedPrio": maxAllowedPrio,
 
+		"SubdomainStats": subdomainStats,
+
 		"HasInfoMessage":  len(infos) > 0,
 		"InfoMessage":     infos,
 		"HasErrorMessage": len(errors) > 0,
@@ -628,10 +838,26 @@ func LinksHistoricalController(w http.ResponseWriter, req *http.Request) {
 		replyServerError(w, fmt.Errorf("ListLinkHistorical - ToplevelDomainPlusOne (%v): %v", u, err))
 		return
 	}
+	shots, err := DS.ListScreenshots(u)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListScreenshots (%v): %v", u, err))
+		return
+	}
+	prov, err := DS.FindLinkProvenance(u)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("FindLinkProvenance (%v): %v", u, err))
+		return
+	}
 	mp := map[string]interface{}{
-		"Domain":    domain,
-		"LinkTopic": u.String(),
-		"Linfos":    linfos,
+		"Domain":      domain,
+		"LinkTopic":   u.String(),
+		"Linfos":      linfos,
+		"URL32":       url,
+		"Screenshots": shots,
+		"Provenance":  prov,
+	}
+	if prov != nil {
+		mp["ProvenancePath"] = "/historical/" + encode32(prov.Referrer.String())
 	}
 	Render.HTML(w, http.StatusOK, "historical", mp)
 }
@@ -740,13 +966,16 @@ func ExcludeToggleController(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 	info := &cassandra.DomainInfo{}
+	var action string
 	switch direction {
 	case "ex":
 		info.Excluded = true
 		info.ExcludeReason = "Manual exclude"
+		action = cassandra.AuditExclude
 	case "un":
 		info.Excluded = false
 		info.ExcludeReason = ""
+		action = cassandra.AuditUnexclude
 	default:
 		replyServerError(w, fmt.Errorf("Ill formed URL passed when trying to change domain exclusion"))
 		return
@@ -757,6 +986,7 @@ func ExcludeToggleController(w http.ResponseWriter, req *http.Request) {
 		replyServerError(w, err)
 		return
 	}
+	recordAudit(consoleActor(req), action, domain, info.ExcludeReason)
 
 	http.Redirect(w, req, fmt.Sprintf("/links/%s", domain), http.StatusFound)
 }
@@ -819,6 +1049,163 @@ func ChangePriorityController(w http.ResponseWriter, req *http.Request) {
 		replyServerError(w, err)
 		return
 	}
+	recordAudit(consoleActor(req), cassandra.AuditPriority, domain, strconv.Itoa(priority))
+
+	redirect()
+	return
+}
+
+// ChangeCrawlDelayController handles web-based crawl delay overrides. An empty
+// or zero delay removes the override.
+func ChangeCrawlDelayController(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	domain := req.Form.Get("domain")
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("domain inexplicably is NOT in the hidden form"))
+		return
+	}
+	redirect := func() {
+		http.Redirect(w, req, fmt.Sprintf("/links/%s", domain), http.StatusFound)
+	}
+
+	var delay time.Duration
+	delayStr := strings.TrimSpace(req.Form.Get("crawldelay"))
+	if delayStr != "" {
+		delay, err = time.ParseDuration(delayStr)
+		if err != nil {
+			session.AddErrorFlash(fmt.Sprintf("Failed to parse crawl delay %q (use a duration like \"5s\")", delayStr))
+			redirect()
+			return
+		}
+		if delay < 0 {
+			session.AddErrorFlash(fmt.Sprintf("Crawl delay must not be negative, not %q", delayStr))
+			redirect()
+			return
+		}
+	}
+
+	info := cassandra.DomainInfo{CrawlDelay: delay}
+	cfg := cassandra.DomainInfoUpdateConfig{CrawlDelay: true}
+	err = DS.UpdateDomain(domain, &info, cfg)
+	if err != nil {
+		err = fmt.Errorf("UpdateDomain failed: %v", err)
+		replyServerError(w, err)
+		return
+	}
+	recordAudit(consoleActor(req), cassandra.AuditCrawlDelay, domain, delay.String())
+
+	redirect()
+	return
+}
+
+// ChangeScopeController handles web-based changes of a domain's crawl scope.
+// The subdomains (for the subdomains scope) are comma separated; the "all"
+// scope removes it.
+func ChangeScopeController(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	domain := req.Form.Get("domain")
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("domain inexplicably is NOT in the hidden form"))
+		return
+	}
+	redirect := func() {
+		http.Redirect(w, req, fmt.Sprintf("/links/%s", domain), http.StatusFound)
+	}
+
+	scope := walker.CrawlScope{Mode: strings.TrimSpace(req.Form.Get("scope"))}
+	switch scope.Mode {
+	case walker.ScopeSubdomains:
+		scope.Subdomains = strings.Split(req.Form.Get("subdomains"), ",")
+	case walker.ScopeCustom:
+		scope.Pattern = strings.TrimSpace(req.Form.Get("pattern"))
+	}
+	if err := scope.Compile(); err != nil {
+		session.AddErrorFlash(fmt.Sprintf("Failed to set crawl scope: %v", err))
+		redirect()
+		return
+	}
+
+	info := cassandra.DomainInfo{Scope: scope}
+	cfg := cassandra.DomainInfoUpdateConfig{Scope: true}
+	err = DS.UpdateDomain(domain, &info, cfg)
+	if err != nil {
+		err = fmt.Errorf("UpdateDomain failed: %v", err)
+		replyServerError(w, err)
+		return
+	}
+	recordAudit(consoleActor(req), cassandra.AuditScope, domain, scope.String())
+
+	redirect()
+	return
+}
+
+// ChangeMaxSegmentsController handles web-based overrides of the most segments
+// a domain may have outstanding (see dispatcher.max_outstanding_segments). An
+// empty or zero maximum removes the override.
+func ChangeMaxSegmentsController(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	domain := req.Form.Get("domain")
+	if domain == "" {
+		replyServerError(w, fmt.Errorf("domain inexplicably is NOT in the hidden form"))
+		return
+	}
+	redirect := func() {
+		http.Redirect(w, req, fmt.Sprintf("/links/%s", domain), http.StatusFound)
+	}
+
+	var max int
+	maxStr := strings.TrimSpace(req.Form.Get("maxsegments"))
+	if maxStr != "" {
+		max, err = strconv.Atoi(maxStr)
+		if err != nil || max < 0 {
+			session.AddErrorFlash(fmt.Sprintf("Max segments must be a non-negative number, not %q", maxStr))
+			redirect()
+			return
+		}
+	}
+
+	info := cassandra.DomainInfo{MaxSegments: max}
+	cfg := cassandra.DomainInfoUpdateConfig{MaxSegments: true}
+	err = DS.UpdateDomain(domain, &info, cfg)
+	if err != nil {
+		err = fmt.Errorf("UpdateDomain failed: %v", err)
+		replyServerError(w, err)
+		return
+	}
+	recordAudit(consoleActor(req), cassandra.AuditSegments, domain, strconv.Itoa(max))
 
 	redirect()
 	return
@@ -828,8 +1215,11 @@ func ChangePriorityController(w http.ResponseWriter, req *http.Request) {
 func FilterLinksController(w http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		mp := map[string]interface{}{
-			"InputDomainValue": "",
-			"InputRegexValue":  "",
+			"InputDomainValue":  "",
+			"InputRegexValue":   "",
+			"InputMimeValue":    "",
+			"InputMinSizeValue": "",
+			"InputMaxSizeValue": "",
 		}
 		Render.HTML(w, http.StatusOK, "filterLinks", mp)
 		return
@@ -848,6 +1238,22 @@ func FilterLinksController(w http.ResponseWriter, req *http.Request) {
 		replyServerError(w, err)
 		return
 	}
+	mime := req.FormValue("mime")
+	minSize := req.FormValue("minSize")
+	maxSize := req.FormValue("maxSize")
+
+	renderError := func(estring string) {
+		mp := map[string]interface{}{
+			"HasErrorMessage":   true,
+			"ErrorMessage":      []string{estring},
+			"InputDomainValue":  domain[0],
+			"InputRegexValue":   regex[0],
+			"InputMimeValue":    mime,
+			"InputMinSizeValue": minSize,
+			"InputMaxSizeValue": maxSize,
+		}
+		Render.HTML(w, http.StatusOK, "filterLinks", mp)
+	}
 
 	dinfo, err := DS.FindDomain(domain[0])
 	if dinfo == nil || err != nil {
@@ -855,32 +1261,32 @@ func FilterLinksController(w http.ResponseWriter, req *http.Request) {
 		if err != nil {
 			reason = err.Error()
 		}
-		estring := fmt.Sprintf("Failed to find domain %q: %v", domain[0], reason)
-		mp := map[string]interface{}{
-			"HasErrorMessage":  true,
-			"ErrorMessage":     []string{estring},
-			"InputDomainValue": domain[0],
-			"InputRegexValue":  regex[0],
-		}
-		Render.HTML(w, http.StatusOK, "filterLinks", mp)
+		renderError(fmt.Sprintf("Failed to find domain %q: %v", domain[0], reason))
 		return
 	}
 
 	_, err = regexp.Compile(regex[0])
 	if err != nil {
-		err = fmt.Errorf("Failed to compile regex %q: %v", regex[0], err)
-		mp := map[string]interface{}{
-			"HasErrorMessage":  true,
-			"ErrorMessage":     []string{err.Error()},
-			"InputDomainValue": domain[0],
-			"InputRegexValue":  regex[0],
-		}
-		Render.HTML(w, http.StatusOK, "filterLinks", mp)
+		renderError(fmt.Sprintf("Failed to compile regex %q: %v", regex[0], err))
 		return
 	}
 
-	url := fmt.Sprintf("/links/%s?filterRegex=%s", domain[0], encode32(regex[0]))
-	http.Redirect(w, req, url, http.StatusSeeOther)
+	target := fmt.Sprintf("/links/%s?filterRegex=%s", domain[0], encode32(regex[0]))
+	if mime != "" {
+		target += "&filterMime=" + url.QueryEscape(mime)
+	}
+	for _, sz := range []struct{ name, value string }{{"minSize", minSize}, {"maxSize", maxSize}} {
+		if sz.value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(sz.value, 10, 64)
+		if err != nil || n < 0 {
+			renderError(fmt.Sprintf("Bad %s %q: must be a non-negative number of bytes", sz.name, sz.value))
+			return
+		}
+		target += fmt.Sprintf("&%s=%d", sz.name, n)
+	}
+	http.Redirect(w, req, target, http.StatusSeeOther)
 	return
 }
 
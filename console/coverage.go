@@ -0,0 +1,42 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/iParadigms/walker/cassandra"
+)
+
+// CoverageController returns the page rooted at /coverage, showing the
+// domains losing the most of their links to robots.txt exclusions and
+// noindex pages, and why. The counts are those kept by the dispatcher, so are
+// as of each domain's last dispatch.
+func CoverageController(w http.ResponseWriter, req *http.Request) {
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	dinfos, err := DS.ListDomains(cassandra.DQ{
+		Sort:     cassandra.SortByCoverageLoss,
+		SortDesc: true,
+		Limit:    session.ListPageWindowLength(),
+	})
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListDomains failed: %v", err))
+		return
+	}
+
+	var losing []*cassandra.DomainInfo
+	for _, d := range dinfos {
+		if d.NumberLinksRobotsExcluded > 0 || d.NumberLinksNoIndex > 0 || d.NumberLinksNoFollow > 0 {
+			losing = append(losing, d)
+		}
+	}
+
+	mp := map[string]interface{}{
+		"Domains": losing,
+	}
+	Render.HTML(w, http.StatusOK, "coverage", mp)
+}
@@ -0,0 +1,71 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iParadigms/walker"
+)
+
+// DefaultCrawlDiffPeriod is how far back the /crawldiff page compares a
+// domain's crawl to by default
+const DefaultCrawlDiffPeriod = 7 * 24 * time.Hour
+
+// crawlDiffTimeFormats are the formats crawl diff times may be given in
+var crawlDiffTimeFormats = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"}
+
+// parseCrawlDiffTime parses a time given to the /crawldiff page (UTC unless
+// it says otherwise), or returns def if s is empty
+func parseCrawlDiffTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	for _, format := range crawlDiffTimeFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Bad time %q, expected a date (ex. 2015-01-02), optionally with a time "+
+		"(ex. 2015-01-02 15:04)", s)
+}
+
+// CrawlDiffController returns the page rooted at /crawldiff/{domain},
+// comparing the domain as crawled at two times given by the from and to
+// parameters (by default a week ago and now): the links found since, the
+// links that have gone, and those whose status changed.
+func CrawlDiffController(w http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+	v := req.URL.Query()
+
+	var errorMessage []string
+	now := time.Now().UTC()
+	from, err := parseCrawlDiffTime(v.Get("from"), now.Add(-DefaultCrawlDiffPeriod))
+	if err != nil {
+		errorMessage = append(errorMessage, err.Error())
+	}
+	to, err := parseCrawlDiffTime(v.Get("to"), now)
+	if err != nil {
+		errorMessage = append(errorMessage, err.Error())
+	}
+
+	mp := map[string]interface{}{
+		"Domain": domain,
+		"From":   from.Format(crawlDiffTimeFormats[1]),
+		"To":     to.Format(crawlDiffTimeFormats[1]),
+	}
+	if len(errorMessage) == 0 {
+		diff, err := DS.DiffCrawls(domain, from, to)
+		if walker.IsError(err, walker.ErrNotFound) {
+			errorMessage = append(errorMessage, fmt.Sprintf("Domain %v not found", domain))
+		} else if err != nil {
+			errorMessage = append(errorMessage, err.Error())
+		} else {
+			mp["Diff"] = diff
+		}
+	}
+	mp["HasErrorMessage"] = len(errorMessage) > 0
+	mp["ErrorMessage"] = errorMessage
+	Render.HTML(w, http.StatusOK, "crawldiff", mp)
+}
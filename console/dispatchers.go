@@ -0,0 +1,65 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/cassandra"
+)
+
+// dispatcherRow is a dispatcher as listed on the /dispatchers page
+type dispatcherRow struct {
+	*cassandra.DispatcherStatus
+
+	// How long since the dispatcher last finished a round, rounded to the
+	// second, and whether that is too long
+	Since   time.Duration
+	Stalled bool
+
+	// The domains that failed in the last round to finish, sorted
+	FailedDomains []string
+}
+
+// DispatchersController returns the page rooted at /dispatchers, showing when
+// each dispatcher's last domain iteration (round) started and finished, which
+// domains failed in it, and flagging dispatchers that haven't finished a round
+// for webhooks.round_overdue_time.
+func DispatchersController(w http.ResponseWriter, req *http.Request) {
+	mp := map[string]interface{}{
+		"OverdueTime": walker.Config.Webhooks.RoundOverdueTime,
+	}
+	statuses, err := DS.ListDispatchers()
+	if err != nil {
+		log4go.Error("ListDispatchers failed: %v", err)
+		mp["HasErrorMessage"] = true
+		mp["ErrorMessage"] = []string{fmt.Sprintf("Failed to list dispatchers: %v", err)}
+		Render.HTML(w, http.StatusOK, "dispatchers", mp)
+		return
+	}
+
+	now := time.Now()
+	var rows []*dispatcherRow
+	stalled := 0
+	for _, s := range statuses {
+		row := &dispatcherRow{
+			DispatcherStatus: s,
+			Since:            s.SinceFinished(now) / time.Second * time.Second,
+			Stalled:          s.Stalled(now),
+		}
+		for domain := range s.Failed {
+			row.FailedDomains = append(row.FailedDomains, domain)
+		}
+		sort.Strings(row.FailedDomains)
+		if row.Stalled {
+			stalled++
+		}
+		rows = append(rows, row)
+	}
+	mp["Dispatchers"] = rows
+	mp["Stalled"] = stalled
+	Render.HTML(w, http.StatusOK, "dispatchers", mp)
+}
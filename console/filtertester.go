@@ -0,0 +1,45 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// maxFilterTesterLinks caps how many links the /filterTester page checks at
+// once
+const maxFilterTesterLinks = 100
+
+// FilterTesterController returns the page rooted at /filterTester, where links
+// pasted one per line are run through the rules applied to links parsed from
+// pages (see cassandra's DryRunLinks), showing which rules match each and the
+// form it would be stored in. Nothing is stored.
+func FilterTesterController(w http.ResponseWriter, req *http.Request) {
+	mp := map[string]interface{}{}
+	if req.Method != "POST" {
+		Render.HTML(w, http.StatusOK, "filterTester", mp)
+		return
+	}
+
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+	text := req.Form.Get("links")
+	mp["Text"] = text
+
+	var links []string
+	for _, line := range strings.Split(text, "\n") {
+		if link := strings.TrimSpace(line); link != "" {
+			links = append(links, link)
+		}
+	}
+	if len(links) > maxFilterTesterLinks {
+		mp["HasErrorMessage"] = true
+		mp["ErrorMessage"] = []string{fmt.Sprintf("Only the first %d links were checked", maxFilterTesterLinks)}
+		links = links[:maxFilterTesterLinks]
+	}
+	mp["Reports"] = DS.DryRunLinks(links)
+	Render.HTML(w, http.StatusOK, "filterTester", mp)
+}
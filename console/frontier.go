@@ -0,0 +1,28 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker/cassandra"
+)
+
+// FrontierController returns the page rooted at /frontier, showing the links
+// the crawl has yet to crawl, by how long ago they were found, and the crawled
+// links due for refresh, for all domains and by domain priority. Counts are
+// as of each domain's last dispatch.
+func FrontierController(w http.ResponseWriter, req *http.Request) {
+	mp := map[string]interface{}{
+		"AgeLabels": cassandra.FrontierAgeLabels(),
+	}
+	f, err := DS.FrontierSnapshot()
+	if err != nil {
+		log4go.Error("FrontierSnapshot failed: %v", err)
+		mp["HasErrorMessage"] = true
+		mp["ErrorMessage"] = []string{fmt.Sprintf("Failed to read the frontier: %v", err)}
+	} else {
+		mp["Frontier"] = f
+	}
+	Render.HTML(w, http.StatusOK, "frontier", mp)
+}
@@ -0,0 +1,46 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// DefaultLatencyDays is how many days the /latency page covers by default, and
+// LatencyListLength how many of the slowest domains and pages it lists
+const (
+	DefaultLatencyDays = 7
+	LatencyListLength  = 50
+)
+
+// LatencyController returns the page rooted at /latency, reporting response
+// times over the last days (the days parameter) against
+// fetcher.response_time_slo: percentiles over all fetches, the domains that
+// missed the SLO most, and the slowest pages.
+func LatencyController(w http.ResponseWriter, req *http.Request) {
+	days := DefaultLatencyDays
+	var errorMessage []string
+	if s := req.URL.Query().Get("days"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			errorMessage = append(errorMessage, fmt.Sprintf("Bad number of days %q", s))
+		} else {
+			days = n
+		}
+	}
+
+	mp := map[string]interface{}{
+		"Days": days,
+	}
+	if len(errorMessage) == 0 {
+		r, err := DS.ReportLatency(days, LatencyListLength)
+		if err != nil {
+			errorMessage = append(errorMessage, err.Error())
+		} else {
+			mp["Report"] = r
+		}
+	}
+	mp["HasErrorMessage"] = len(errorMessage) > 0
+	mp["ErrorMessage"] = errorMessage
+	Render.HTML(w, http.StatusOK, "latency", mp)
+}
@@ -240,3 +240,19 @@ func Run() {
 	shutdownWaitGroup.Wait()
 	log4go.Info("Console shutdown complete")
 }
+
+// Service runs the console as a walker.Service, so a walker.Crawler can stop
+// it in turn when the crawl shuts down
+type Service struct{}
+
+// Start calls Start
+func (Service) Start() error {
+	Start()
+	return nil
+}
+
+// Stop calls Stop
+func (Service) Stop() error {
+	Stop()
+	return nil
+}
@@ -0,0 +1,30 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/iParadigms/walker"
+)
+
+// OutlinksController returns the page rooted at /outlinks/{domain}, the
+// external link profile of the domain: the other domains its pages link to,
+// with how many pages link to each and how many links they hold.
+func OutlinksController(w http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+
+	var errorMessage []string
+	mp := map[string]interface{}{"Domain": domain}
+	profile, err := DS.OutlinkProfile(domain)
+	if walker.IsError(err, walker.ErrNotFound) {
+		errorMessage = append(errorMessage, fmt.Sprintf("Domain %v not found", domain))
+	} else if err != nil {
+		errorMessage = append(errorMessage, err.Error())
+	} else {
+		mp["Profile"] = profile
+	}
+	mp["HasErrorMessage"] = len(errorMessage) > 0
+	mp["ErrorMessage"] = errorMessage
+	Render.HTML(w, http.StatusOK, "outlinks", mp)
+}
@@ -0,0 +1,40 @@
+package console
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/iParadigms/walker"
+)
+
+// preflightTransport is the transport pre-flight checks are made with
+// (http.DefaultTransport if nil); tests replace it
+var preflightTransport http.RoundTripper
+
+// runPreflight runs the pre-flight checks (see walker.Preflight) of links
+// concurrently, returning a report per link in the same order. Links that
+// can't be checked at all get a nil report and an error.
+func runPreflight(links []string) ([]*walker.PreflightReport, []error) {
+	reports := make([]*walker.PreflightReport, len(links))
+	errs := make([]error, len(links))
+	var wg sync.WaitGroup
+	for i, link := range links {
+		wg.Add(1)
+		go func(i int, link string) {
+			defer wg.Done()
+			reports[i], errs[i] = walker.Preflight(link, preflightTransport)
+		}(i, link)
+	}
+	wg.Wait()
+	return reports, errs
+}
+
+// preflightPassed returns true if every report passed
+func preflightPassed(reports []*walker.PreflightReport) bool {
+	for _, r := range reports {
+		if r == nil || !r.Passed() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,34 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/iParadigms/walker"
+)
+
+// RedirectsController returns the page rooted at /redirects/{domain}, listing
+// the links of the domain that redirected on their latest fetch, where they
+// redirect to, and whether they are still refreshed (see
+// dispatcher.redirect_confirmations).
+func RedirectsController(w http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+
+	var errorMessage []string
+	mp := map[string]interface{}{
+		"Domain":        domain,
+		"Confirmations": walker.Config.Dispatcher.RedirectConfirmations,
+	}
+	redirects, err := DS.ListRedirects(domain)
+	if walker.IsError(err, walker.ErrNotFound) {
+		errorMessage = append(errorMessage, fmt.Sprintf("Domain %v not found", domain))
+	} else if err != nil {
+		errorMessage = append(errorMessage, err.Error())
+	} else {
+		mp["Redirects"] = redirects
+	}
+	mp["HasErrorMessage"] = len(errorMessage) > 0
+	mp["ErrorMessage"] = errorMessage
+	Render.HTML(w, http.StatusOK, "redirects", mp)
+}
@@ -5,6 +5,7 @@ package console
 */
 
 import (
+	"fmt"
 	"html/template"
 	"net/http"
 	"time"
@@ -58,6 +59,17 @@ func ftime2Func(t time.Time) string {
 	return t.Format(timeFormat)
 }
 
+func fsizeFunc(size int64) string {
+	if size <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", size)
+}
+
+func fpercentFunc(f float64) string {
+	return fmt.Sprintf("%.1f%%", 100*f)
+}
+
 func fuuidFunc(u gocql.UUID) string {
 	if u == zeroUUID {
 		return ""
@@ -82,6 +94,8 @@ func BuildRender() {
 				"ftime":       ftimeFunc,
 				"ftime2":      ftime2Func,
 				"fuuid":       fuuidFunc,
+				"fsize":       fsizeFunc,
+				"fpercent":    fpercentFunc,
 				"statusText":  http.StatusText,
 				"yesOnTrue":   yesOnTrueFunc,
 			},
@@ -0,0 +1,97 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/cassandra"
+)
+
+// ReportsController returns the page rooted at /reports/{domain}, listing who
+// gets the domain's periodic crawl summary. POSTing to it adds a recipient
+// (or changes their period), removes one, or sends one the summary now,
+// depending on the action form value (add, delete or send).
+func ReportsController(w http.ResponseWriter, req *http.Request) {
+	domain := mux.Vars(req)["domain"]
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	if req.Method == "POST" {
+		if err := req.ParseForm(); err != nil {
+			replyServerError(w, err)
+			return
+		}
+		changeReport(req, session, domain)
+		http.Redirect(w, req, fmt.Sprintf("/reports/%s", domain), http.StatusFound)
+		return
+	}
+
+	infos, errors := session.Flashes()
+	mp := map[string]interface{}{
+		"Domain":        domain,
+		"CheckInterval": walker.Config.Reports.CheckInterval,
+		"SMTPServer":    walker.Config.Reports.SMTPServer,
+	}
+	reports, err := DS.ListDomainReports(domain)
+	if err != nil {
+		errors = append(errors, err.Error())
+	} else {
+		mp["Reports"] = reports
+	}
+	mp["HasInfoMessage"] = len(infos) > 0
+	mp["InfoMessage"] = infos
+	mp["HasErrorMessage"] = len(errors) > 0
+	mp["ErrorMessage"] = errors
+	Render.HTML(w, http.StatusOK, "reports", mp)
+}
+
+// changeReport makes the change to the reports of domain the form of req
+// asks for, flashing the outcome
+func changeReport(req *http.Request, session *Session, domain string) {
+	recipient := strings.TrimSpace(req.Form.Get("recipient"))
+	if recipient == "" {
+		session.AddErrorFlash("No recipient given")
+		return
+	}
+
+	switch action := req.Form.Get("action"); action {
+	case "add":
+		periodStr := strings.TrimSpace(req.Form.Get("period"))
+		period, err := time.ParseDuration(periodStr)
+		if err != nil {
+			session.AddErrorFlash(fmt.Sprintf("Failed to parse period %q (use a duration like \"24h\")", periodStr))
+			return
+		}
+		if err := DS.SetDomainReport(domain, recipient, period); err != nil {
+			session.AddErrorFlash(fmt.Sprintf("Failed to add report: %v", err))
+			return
+		}
+		recordAudit(consoleActor(req), cassandra.AuditReport, domain, fmt.Sprintf("%v every %v", recipient, period))
+		session.AddInfoFlash(fmt.Sprintf("%v will get the summary of %v every %v", recipient, domain, period))
+
+	case "delete":
+		if err := DS.DeleteDomainReport(domain, recipient); err != nil {
+			session.AddErrorFlash(fmt.Sprintf("Failed to remove report: %v", err))
+			return
+		}
+		recordAudit(consoleActor(req), cassandra.AuditReport, domain, fmt.Sprintf("%v removed", recipient))
+		session.AddInfoFlash(fmt.Sprintf("%v will no longer get the summary of %v", recipient, domain))
+
+	case "send":
+		if err := DS.SendDomainReport(domain, recipient); err != nil {
+			session.AddErrorFlash(fmt.Sprintf("Failed to send report: %v", err))
+			return
+		}
+		session.AddInfoFlash(fmt.Sprintf("Sent the summary of %v to %v", domain, recipient))
+
+	default:
+		session.AddErrorFlash(fmt.Sprintf("Unknown report action %q", action))
+	}
+}
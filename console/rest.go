@@ -2,11 +2,16 @@ package console
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/cassandra"
 )
 
 //
@@ -18,14 +23,69 @@ import (
 // The next thing to note is the format of each message exchanged with the rest API. Each message will have at least
 // a version attribute.
 //
+// If console.api_tokens is set, every request must carry one of the tokens as "Authorization: Bearer <token>" or
+// gets a 401.
+//
 
 // RestRoutes returns all Route's used in the Rest space.
 func RestRoutes() []Route {
 	return []Route{
-		Route{Path: "/rest/add", Controller: RestAdd},
+		Route{Path: "/rest/add", Controller: requireToken(RestAdd)},
+		Route{Path: "/rest/links", Controller: requireToken(RestLinks)},
+		Route{Path: "/rest/config", Controller: requireToken(RestConfig)},
+		Route{Path: "/rest/crawldelay", Controller: requireToken(RestCrawlDelay)},
+		Route{Path: "/rest/scope", Controller: requireToken(RestScope)},
+		Route{Path: "/rest/boost", Controller: requireToken(RestBoost)},
+		Route{Path: "/rest/burst", Controller: requireToken(RestBurst)},
+		Route{Path: "/rest/audit", Controller: requireToken(RestAudit)},
+		Route{Path: "/rest/watchevents", Controller: requireToken(RestWatchEvents)},
+		Route{Path: "/rest/provenance", Controller: requireToken(RestProvenance)},
+		Route{Path: "/rest/surrogatekeys", Controller: requireToken(RestSurrogateKeys)},
+		Route{Path: "/rest/crawldiff", Controller: requireToken(RestCrawlDiff)},
+		Route{Path: "/rest/frontier", Controller: requireToken(RestFrontier)},
+		Route{Path: "/rest/dispatchers", Controller: requireToken(RestDispatchers)},
+	}
+}
+
+// restTokenName returns the name console.api_tokens gives the bearer token of
+// req, or "" if it has none of them.
+func restTokenName(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	given := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	for _, tok := range walker.Config.Console.APITokens {
+		parts := strings.SplitN(tok, ":", 2)
+		if len(parts) == 2 && parts[1] != "" &&
+			subtle.ConstantTimeCompare([]byte(parts[1]), []byte(given)) == 1 {
+			return parts[0]
+		}
+	}
+	return ""
+}
+
+// requireToken wraps a rest controller so it is only called for requests with
+// a valid token, when console.api_tokens is set.
+func requireToken(controller func(w http.ResponseWriter, req *http.Request)) func(w http.ResponseWriter, req *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if len(walker.Config.Console.APITokens) > 0 && restTokenName(req) == "" {
+			log4go.Warn("Rejecting rest request to %v from %v: missing or unknown token", req.URL.Path, req.RemoteAddr)
+			Render.JSON(w, http.StatusUnauthorized, buildError("unauthorized", "A valid API token is required"))
+			return
+		}
+		controller(w, req)
 	}
 }
 
+// restActor returns who is making a rest request, for the audit log
+func restActor(req *http.Request) string {
+	if name := restTokenName(req); name != "" {
+		return "api:" + name
+	}
+	return "api@" + remoteHost(req)
+}
+
 type restErrorResponse struct {
 	Version int    `json:"version"`
 	Tag     string `json:"tag"`
@@ -44,10 +104,47 @@ type restAddRequest struct {
 	Version int `json:"version"`
 	Links   []struct {
 		URL string `json:"url"`
+
+		// If set, the link is not crawled before this time (RFC 3339)
+		CrawlAt time.Time `json:"crawl_at"`
+
+		// If set, the crawl scope given the link's domain
+		Scope *restScope `json:"scope"`
 	} `json:"links"`
+
+	// If set, the links are only added if they all pass the pre-flight
+	// checks (see walker.Preflight)
+	Preflight bool `json:"preflight"`
+}
+
+// restPreflightResponse answers a /rest/add request with preflight set; when
+// a check fails, Tag and Message are set as for an error
+type restPreflightResponse struct {
+	Version   int                       `json:"version"`
+	Tag       string                    `json:"tag,omitempty"`
+	Message   string                    `json:"message,omitempty"`
+	Preflight []*walker.PreflightReport `json:"preflight"`
+}
+
+// restScope is a walker.CrawlScope in a rest request
+type restScope struct {
+	Mode       string   `json:"mode"`
+	Subdomains []string `json:"subdomains"`
+	Pattern    string   `json:"pattern"`
 }
 
-// RestAdd manages the rest endpoint rooted at /rest/add.
+// crawlScope returns the walker.CrawlScope s describes, or an error if it is
+// invalid
+func (s *restScope) crawlScope() (walker.CrawlScope, error) {
+	scope := walker.CrawlScope{Mode: s.Mode, Subdomains: s.Subdomains, Pattern: s.Pattern}
+	return scope, scope.Compile()
+}
+
+// RestAdd manages the rest endpoint rooted at /rest/add. Links given a
+// crawl_at are scheduled to be crawled no earlier than then, and links given a
+// scope (a mode, subdomains and pattern; see walker.CrawlScope) set the crawl
+// scope of their domain. If the request sets preflight, the links are checked
+// first, and the reports returned.
 func RestAdd(w http.ResponseWriter, req *http.Request) {
 	decoder := json.NewDecoder(req.Body)
 	var adds restAddRequest
@@ -64,6 +161,7 @@ func RestAdd(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var links []string
+	scopes := map[string]walker.CrawlScope{}
 	for _, l := range adds.Links {
 		u := l.URL
 		if u == "" {
@@ -71,6 +169,47 @@ func RestAdd(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		links = append(links, u)
+
+		if l.Scope == nil {
+			continue
+		}
+		scope, err := l.Scope.crawlScope()
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-scope", "%v: %v", u, err))
+			return
+		}
+		parsed, err := walker.ParseURL(u)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-link-element", "%v: %v", u, err))
+			return
+		}
+		dom, err := parsed.ToplevelDomainPlusOne()
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-link-element", "%v: %v", u, err))
+			return
+		}
+		scopes[dom] = scope
+	}
+
+	var reports []*walker.PreflightReport
+	if adds.Preflight {
+		var errs []error
+		reports, errs = runPreflight(links)
+		for i, err := range errs {
+			if err != nil {
+				Render.JSON(w, http.StatusBadRequest, buildError("bad-link-element", "%v: %v", links[i], err))
+				return
+			}
+		}
+		if !preflightPassed(reports) {
+			Render.JSON(w, http.StatusBadRequest, restPreflightResponse{
+				Version:   1,
+				Tag:       "preflight-failed",
+				Message:   "Some pre-flight checks failed; no links added",
+				Preflight: reports,
+			})
+			return
+		}
 	}
 
 	errList := DS.InsertLinks(links, "")
@@ -83,7 +222,762 @@ func RestAdd(w http.ResponseWriter, req *http.Request) {
 		Render.JSON(w, http.StatusBadRequest, buildError("insert-links-error", buffer.String()))
 		return
 	}
+	recordLinksAdded(restActor(req), links, "")
+
+	for dom, scope := range scopes {
+		info := cassandra.DomainInfo{Scope: scope}
+		if err := DS.UpdateDomain(dom, &info, cassandra.DomainInfoUpdateConfig{Scope: true}); err != nil {
+			Render.JSON(w, http.StatusInternalServerError, buildError("update-domain-error", "%v", err))
+			return
+		}
+		recordAudit(restActor(req), cassandra.AuditScope, dom, scope.String())
+	}
+
+	for _, l := range adds.Links {
+		if l.CrawlAt.IsZero() {
+			continue
+		}
+		if err := DS.ScheduleLink(l.URL, l.CrawlAt); err != nil {
+			Render.JSON(w, http.StatusInternalServerError, buildError("schedule-link-error", "%v", err))
+			return
+		}
+	}
+
+	if adds.Preflight {
+		Render.JSON(w, http.StatusOK, restPreflightResponse{Version: 1, Preflight: reports})
+		return
+	}
+	Render.JSON(w, http.StatusOK, "")
+	return
+}
+
+// DefaultRestLinksLimit is the number of links returned by /rest/links if the
+// request doesn't set a limit.
+const DefaultRestLinksLimit = 100
+
+type restLinksRequest struct {
+	Version     int    `json:"version"`
+	Domain      string `json:"domain"`
+	Seed        string `json:"seed"`
+	Limit       int    `json:"limit"`
+	FilterRegex string `json:"filter_regex"`
+	Mime        string `json:"mime"`
+	MinSize     int64  `json:"min_size"`
+	MaxSize     int64  `json:"max_size"`
+	ParseFailed bool   `json:"parse_failed"`
+}
+
+type restLink struct {
+	URL            string    `json:"url"`
+	Status         int       `json:"status"`
+	CrawlTime      time.Time `json:"crawl_time"`
+	Error          string    `json:"error,omitempty"`
+	ParseError     string    `json:"parse_error,omitempty"`
+	RobotsExcluded bool      `json:"robots_excluded"`
+	Mime           string    `json:"mime"`
+	Size           int64     `json:"size"`
+}
+
+type restLinksResponse struct {
+	Version int        `json:"version"`
+	Links   []restLink `json:"links"`
+}
+
+// RestLinks manages the rest endpoint rooted at /rest/links. It lists the
+// links of a domain, optionally filtered by link regex, mime type, content
+// size and whether the page failed to parse.
+func RestLinks(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var lreq restLinksRequest
+	err := decoder.Decode(&lreq)
+	if err != nil {
+		log4go.Error("RestLinks failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+
+	if lreq.Domain == "" {
+		Render.JSON(w, http.StatusBadRequest, buildError("empty-domain", "No domain provided"))
+		return
+	}
+
+	if lreq.MinSize < 0 || lreq.MaxSize < 0 {
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-size", "min_size and max_size must be >= 0"))
+		return
+	}
+
+	query := cassandra.LQ{
+		Limit:       lreq.Limit,
+		FilterRegex: lreq.FilterRegex,
+		MimeType:    lreq.Mime,
+		MinSize:     lreq.MinSize,
+		MaxSize:     lreq.MaxSize,
+		ParseFailed: lreq.ParseFailed,
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultRestLinksLimit
+	}
+	if lreq.Seed != "" {
+		query.Seed, err = walker.ParseURL(lreq.Seed)
+		if err != nil {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-seed", "%v", err))
+			return
+		}
+	}
+
+	linfos, err := DS.ListLinks(lreq.Domain, query)
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("list-links-error", "%v", err))
+		return
+	}
+
+	resp := restLinksResponse{Version: 1, Links: []restLink{}}
+	for _, linfo := range linfos {
+		resp.Links = append(resp.Links, restLink{
+			URL:            linfo.URL.String(),
+			Status:         linfo.Status,
+			CrawlTime:      linfo.CrawlTime,
+			Error:          linfo.Error,
+			ParseError:     linfo.ParseError,
+			RobotsExcluded: linfo.RobotsExcluded,
+			Mime:           linfo.Mime,
+			Size:           linfo.Size,
+		})
+	}
+
+	Render.JSON(w, http.StatusOK, resp)
+	return
+}
+
+type restCrawlDelayRequest struct {
+	Version    int    `json:"version"`
+	Domain     string `json:"domain"`
+	CrawlDelay string `json:"crawl_delay"`
+}
+
+// RestCrawlDelay manages the rest endpoint rooted at /rest/crawldelay. It sets
+// the crawl delay override of a domain to crawl_delay, a duration like "5s".
+// An empty or zero crawl_delay removes the override.
+func RestCrawlDelay(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var creq restCrawlDelayRequest
+	err := decoder.Decode(&creq)
+	if err != nil {
+		log4go.Error("RestCrawlDelay failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+
+	if creq.Domain == "" {
+		Render.JSON(w, http.StatusBadRequest, buildError("empty-domain", "No domain provided"))
+		return
+	}
+
+	var delay time.Duration
+	if creq.CrawlDelay != "" {
+		delay, err = time.ParseDuration(creq.CrawlDelay)
+		if err != nil || delay < 0 {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-crawl-delay",
+				"crawl_delay must be a non-negative duration, got %q", creq.CrawlDelay))
+			return
+		}
+	}
+
+	info := cassandra.DomainInfo{CrawlDelay: delay}
+	err = DS.UpdateDomain(creq.Domain, &info, cassandra.DomainInfoUpdateConfig{CrawlDelay: true})
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("update-domain-error", "%v", err))
+		return
+	}
+	recordAudit(restActor(req), cassandra.AuditCrawlDelay, creq.Domain, delay.String())
+
+	Render.JSON(w, http.StatusOK, "")
+	return
+}
+
+type restScopeRequest struct {
+	Version int       `json:"version"`
+	Domain  string    `json:"domain"`
+	Scope   restScope `json:"scope"`
+}
+
+// RestScope manages the rest endpoint rooted at /rest/scope. It sets the crawl
+// scope of a domain (see walker.CrawlScope); a scope of mode "all" (or none)
+// removes it.
+func RestScope(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var sreq restScopeRequest
+	err := decoder.Decode(&sreq)
+	if err != nil {
+		log4go.Error("RestScope failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+
+	if sreq.Domain == "" {
+		Render.JSON(w, http.StatusBadRequest, buildError("empty-domain", "No domain provided"))
+		return
+	}
+
+	scope, err := sreq.Scope.crawlScope()
+	if err != nil {
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-scope", "%v", err))
+		return
+	}
+
+	info := cassandra.DomainInfo{Scope: scope}
+	err = DS.UpdateDomain(sreq.Domain, &info, cassandra.DomainInfoUpdateConfig{Scope: true})
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("update-domain-error", "%v", err))
+		return
+	}
+	recordAudit(restActor(req), cassandra.AuditScope, sreq.Domain, scope.String())
+
+	Render.JSON(w, http.StatusOK, "")
+	return
+}
+
+type restBoostRequest struct {
+	Version  int    `json:"version"`
+	Domain   string `json:"domain"`
+	Duration string `json:"duration"`
+}
+
+// RestBoost manages the rest endpoint rooted at /rest/boost. It gives domain a
+// bootstrap boost (see dispatcher.new_domain_boost_period) lasting duration
+// from now, a duration like "6h". An empty or zero duration ends the boost.
+func RestBoost(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var breq restBoostRequest
+	err := decoder.Decode(&breq)
+	if err != nil {
+		log4go.Error("RestBoost failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+
+	if breq.Domain == "" {
+		Render.JSON(w, http.StatusBadRequest, buildError("empty-domain", "No domain provided"))
+		return
+	}
+
+	var dur time.Duration
+	if breq.Duration != "" {
+		dur, err = time.ParseDuration(breq.Duration)
+		if err != nil || dur < 0 {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-duration",
+				"duration must be a non-negative duration, got %q", breq.Duration))
+			return
+		}
+	}
+
+	info := cassandra.DomainInfo{}
+	if dur > 0 {
+		info.BoostUntil = time.Now().Add(dur)
+	}
+	err = DS.UpdateDomain(breq.Domain, &info, cassandra.DomainInfoUpdateConfig{BoostUntil: true})
+	switch {
+	case walker.IsError(err, walker.ErrNotFound):
+		Render.JSON(w, http.StatusNotFound, buildError("domain-not-found", "%v", err))
+		return
+	case walker.IsError(err, walker.ErrExcluded):
+		Render.JSON(w, http.StatusConflict, buildError("domain-excluded", "%v", err))
+		return
+	case err != nil:
+		Render.JSON(w, http.StatusInternalServerError, buildError("update-domain-error", "%v", err))
+		return
+	}
+	recordAudit(restActor(req), cassandra.AuditBoost, breq.Domain, dur.String())
+
+	Render.JSON(w, http.StatusOK, "")
+	return
+}
+
+type restBurstRequest struct {
+	Version  int    `json:"version"`
+	Domain   string `json:"domain"`
+	Duration string `json:"duration"`
+}
+
+// RestBurst manages the rest endpoint rooted at /rest/burst. It puts domain in
+// burst mode (see dispatcher.burst_segment_multiplier) for duration from now,
+// a duration like "12h", or until the domain has no uncrawled links left. An
+// empty or zero duration ends burst mode.
+func RestBurst(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var breq restBurstRequest
+	err := decoder.Decode(&breq)
+	if err != nil {
+		log4go.Error("RestBurst failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+
+	if breq.Domain == "" {
+		Render.JSON(w, http.StatusBadRequest, buildError("empty-domain", "No domain provided"))
+		return
+	}
+
+	var dur time.Duration
+	if breq.Duration != "" {
+		dur, err = time.ParseDuration(breq.Duration)
+		if err != nil || dur < 0 {
+			Render.JSON(w, http.StatusBadRequest, buildError("bad-duration",
+				"duration must be a non-negative duration, got %q", breq.Duration))
+			return
+		}
+	}
+
+	info := cassandra.DomainInfo{}
+	if dur > 0 {
+		info.BurstUntil = time.Now().Add(dur)
+	}
+	err = DS.UpdateDomain(breq.Domain, &info, cassandra.DomainInfoUpdateConfig{BurstUntil: true})
+	switch {
+	case walker.IsError(err, walker.ErrNotFound):
+		Render.JSON(w, http.StatusNotFound, buildError("domain-not-found", "%v", err))
+		return
+	case walker.IsError(err, walker.ErrExcluded):
+		Render.JSON(w, http.StatusConflict, buildError("domain-excluded", "%v", err))
+		return
+	case err != nil:
+		Render.JSON(w, http.StatusInternalServerError, buildError("update-domain-error", "%v", err))
+		return
+	}
+	recordAudit(restActor(req), cassandra.AuditBurst, breq.Domain, dur.String())
 
 	Render.JSON(w, http.StatusOK, "")
 	return
 }
+
+// RestConfig responds with the configuration the console is running with
+// (see walker.EffectiveConfig)
+func RestConfig(w http.ResponseWriter, req *http.Request) {
+	Render.JSON(w, http.StatusOK, walker.EffectiveConfig())
+}
+
+// DefaultRestAuditLimit is the number of entries returned by /rest/audit if
+// the request doesn't set a limit.
+const DefaultRestAuditLimit = 100
+
+type restAuditRequest struct {
+	Version int `json:"version"`
+	Limit   int `json:"limit"`
+}
+
+type restAuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+type restAuditResponse struct {
+	Version int              `json:"version"`
+	Entries []restAuditEntry `json:"entries"`
+}
+
+// RestAudit manages the rest endpoint rooted at /rest/audit. It lists the most
+// recent audit log entries, newest first.
+func RestAudit(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var areq restAuditRequest
+	err := decoder.Decode(&areq)
+	if err != nil {
+		log4go.Error("RestAudit failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+	if areq.Limit <= 0 {
+		areq.Limit = DefaultRestAuditLimit
+	}
+
+	entries, err := DS.ListAudit(areq.Limit)
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("list-audit-error", "%v", err))
+		return
+	}
+
+	resp := restAuditResponse{Version: 1, Entries: []restAuditEntry{}}
+	for _, e := range entries {
+		resp.Entries = append(resp.Entries, restAuditEntry{
+			Time:   e.Time,
+			Actor:  e.Actor,
+			Action: e.Action,
+			Target: e.Target,
+			Detail: e.Detail,
+		})
+	}
+
+	Render.JSON(w, http.StatusOK, resp)
+	return
+}
+
+// DefaultRestWatchEventsLimit is the number of events returned by
+// /rest/watchevents if the request doesn't set a limit.
+const DefaultRestWatchEventsLimit = 100
+
+type restWatchEventsRequest struct {
+	Version int `json:"version"`
+	Limit   int `json:"limit"`
+}
+
+type restWatchEvent struct {
+	Rule     string    `json:"rule"`
+	URL      string    `json:"url"`
+	Time     time.Time `json:"time"`
+	Previous string    `json:"previous"`
+	Current  string    `json:"current"`
+	Expected string    `json:"expected,omitempty"`
+}
+
+type restWatchEventsResponse struct {
+	Version int              `json:"version"`
+	Events  []restWatchEvent `json:"events"`
+}
+
+// RestWatchEvents manages the rest endpoint rooted at /rest/watchevents. It
+// lists the most recent changes seen by watch rules (see watch.rules), newest
+// first.
+func RestWatchEvents(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var wreq restWatchEventsRequest
+	err := decoder.Decode(&wreq)
+	if err != nil {
+		log4go.Error("RestWatchEvents failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+	if wreq.Limit <= 0 {
+		wreq.Limit = DefaultRestWatchEventsLimit
+	}
+
+	events, err := DS.ListWatchEvents(wreq.Limit)
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("list-watch-events-error", "%v", err))
+		return
+	}
+
+	resp := restWatchEventsResponse{Version: 1, Events: []restWatchEvent{}}
+	for _, e := range events {
+		resp.Events = append(resp.Events, restWatchEvent{
+			Rule:     e.Rule,
+			URL:      e.URL.String(),
+			Time:     e.Time,
+			Previous: e.Previous,
+			Current:  e.Current,
+			Expected: e.Expected,
+		})
+	}
+
+	Render.JSON(w, http.StatusOK, resp)
+	return
+}
+
+type restProvenanceRequest struct {
+	Version int    `json:"version"`
+	URL     string `json:"url"`
+}
+
+type restProvenanceResponse struct {
+	Version  int       `json:"version"`
+	URL      string    `json:"url"`
+	Referrer string    `json:"referrer"`
+	Found    time.Time `json:"found"`
+}
+
+// RestProvenance manages the rest endpoint rooted at /rest/provenance. It
+// returns the page a link was first found on (see
+// cassandra.store_link_provenance).
+func RestProvenance(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var preq restProvenanceRequest
+	err := decoder.Decode(&preq)
+	if err != nil {
+		log4go.Error("RestProvenance failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+
+	u, err := walker.ParseAndNormalizeURL(preq.URL)
+	if err != nil || !u.IsAbs() {
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-url", "Bad url %q", preq.URL))
+		return
+	}
+
+	prov, err := DS.FindLinkProvenance(u)
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("find-provenance-error", "%v", err))
+		return
+	} else if prov == nil {
+		Render.JSON(w, http.StatusNotFound, buildError("provenance-not-found",
+			"No provenance recorded for %v", u))
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, restProvenanceResponse{
+		Version:  1,
+		URL:      u.String(),
+		Referrer: prov.Referrer.String(),
+		Found:    prov.Found,
+	})
+	return
+}
+
+type restSurrogateKeysRequest struct {
+	Version int    `json:"version"`
+	Key     string `json:"key"`
+
+	// The most links to return; 0 for all of them
+	Limit int `json:"limit"`
+}
+
+type restSurrogateKeyLink struct {
+	URL    string    `json:"url"`
+	Tagged time.Time `json:"tagged"`
+}
+
+type restSurrogateKeysResponse struct {
+	Version int                    `json:"version"`
+	Key     string                 `json:"key"`
+	Links   []restSurrogateKeyLink `json:"links"`
+}
+
+// RestSurrogateKeys manages the rest endpoint rooted at /rest/surrogatekeys.
+// It lists the pages handlers tagged with a surrogate key (see
+// walker.FetchResults.SurrogateKeys), ex. to find the pages to recrawl when
+// the template they share changes.
+func RestSurrogateKeys(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var sreq restSurrogateKeysRequest
+	err := decoder.Decode(&sreq)
+	if err != nil {
+		log4go.Error("RestSurrogateKeys failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+	if strings.TrimSpace(sreq.Key) == "" {
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-key", "A surrogate key is required"))
+		return
+	}
+
+	links, err := DS.ListSurrogateKeyLinks(strings.TrimSpace(sreq.Key), sreq.Limit)
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("list-surrogate-keys-error", "%v", err))
+		return
+	}
+
+	resp := restSurrogateKeysResponse{Version: 1, Key: sreq.Key, Links: []restSurrogateKeyLink{}}
+	for _, l := range links {
+		resp.Links = append(resp.Links, restSurrogateKeyLink{URL: l.URL.String(), Tagged: l.Tagged})
+	}
+	Render.JSON(w, http.StatusOK, resp)
+	return
+}
+
+type restCrawlDiffRequest struct {
+	Version int       `json:"version"`
+	Domain  string    `json:"domain"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+}
+
+type restCrawlDiffLink struct {
+	URL          string    `json:"url"`
+	FromTime     time.Time `json:"from_time"`
+	FromStatus   int       `json:"from_status,omitempty"`
+	FromError    string    `json:"from_error,omitempty"`
+	FromRedirect string    `json:"from_redirect,omitempty"`
+	ToTime       time.Time `json:"to_time"`
+	ToStatus     int       `json:"to_status,omitempty"`
+	ToError      string    `json:"to_error,omitempty"`
+	ToRedirect   string    `json:"to_redirect,omitempty"`
+}
+
+type restCrawlDiffResponse struct {
+	Version     int                 `json:"version"`
+	Domain      string              `json:"domain"`
+	LinksFrom   int                 `json:"links_from"`
+	LinksTo     int                 `json:"links_to"`
+	New         []restCrawlDiffLink `json:"new"`
+	Disappeared []restCrawlDiffLink `json:"disappeared"`
+	Changed     []restCrawlDiffLink `json:"changed"`
+}
+
+func restCrawlDiffLinks(links []*cassandra.CrawlDiffLink) []restCrawlDiffLink {
+	rlinks := []restCrawlDiffLink{}
+	for _, l := range links {
+		rlinks = append(rlinks, restCrawlDiffLink{
+			URL:          l.URL.String(),
+			FromTime:     l.FromTime,
+			FromStatus:   l.FromStatus,
+			FromError:    l.FromError,
+			FromRedirect: l.FromRedirect,
+			ToTime:       l.ToTime,
+			ToStatus:     l.ToStatus,
+			ToError:      l.ToError,
+			ToRedirect:   l.ToRedirect,
+		})
+	}
+	return rlinks
+}
+
+// RestCrawlDiff manages the rest endpoint rooted at /rest/crawldiff. It
+// compares a domain as crawled at two times (see cassandra.DiffCrawls); to
+// defaults to now.
+func RestCrawlDiff(w http.ResponseWriter, req *http.Request) {
+	decoder := json.NewDecoder(req.Body)
+	var dreq restCrawlDiffRequest
+	err := decoder.Decode(&dreq)
+	if err != nil {
+		log4go.Error("RestCrawlDiff failed to decode %v", err)
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-json-decode", "%v", err))
+		return
+	}
+	if dreq.To.IsZero() {
+		dreq.To = time.Now()
+	}
+	if !dreq.From.Before(dreq.To) {
+		Render.JSON(w, http.StatusBadRequest, buildError("bad-times", "from (%v) must be before to (%v)",
+			dreq.From, dreq.To))
+		return
+	}
+
+	diff, err := DS.DiffCrawls(dreq.Domain, dreq.From, dreq.To)
+	if walker.IsError(err, walker.ErrNotFound) {
+		Render.JSON(w, http.StatusNotFound, buildError("domain-not-found", "%v", err))
+		return
+	} else if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("crawl-diff-error", "%v", err))
+		return
+	}
+
+	Render.JSON(w, http.StatusOK, restCrawlDiffResponse{
+		Version:     1,
+		Domain:      diff.Domain,
+		LinksFrom:   diff.LinksFrom,
+		LinksTo:     diff.LinksTo,
+		New:         restCrawlDiffLinks(diff.New),
+		Disappeared: restCrawlDiffLinks(diff.Disappeared),
+		Changed:     restCrawlDiffLinks(diff.Changed),
+	})
+	return
+}
+
+type restFrontierCounts struct {
+	Priority       *int  `json:"priority,omitempty"`
+	Domains        int   `json:"domains"`
+	Uncrawled      int   `json:"uncrawled"`
+	UncrawledAges  []int `json:"uncrawled_ages"`
+	RefreshDue     int   `json:"refresh_due"`
+	RefreshOverdue int   `json:"refresh_overdue"`
+}
+
+type restFrontierResponse struct {
+	Version            int                  `json:"version"`
+	MinLinkRefreshTime string               `json:"min_link_refresh_time"`
+	AgeBuckets         []string             `json:"age_buckets"`
+	Total              restFrontierCounts   `json:"total"`
+	Priorities         []restFrontierCounts `json:"priorities"`
+}
+
+func newRestFrontierCounts(c *cassandra.FrontierCounts) restFrontierCounts {
+	return restFrontierCounts{
+		Domains:        c.Domains,
+		Uncrawled:      c.Uncrawled,
+		UncrawledAges:  c.Ages,
+		RefreshDue:     c.RefreshDue,
+		RefreshOverdue: c.RefreshOverdue,
+	}
+}
+
+// RestFrontier manages the rest endpoint rooted at /rest/frontier. It
+// responds with a snapshot of the frontier (see cassandra.FrontierSnapshot),
+// for monitoring whether the crawl is keeping up; uncrawled_ages counts the
+// uncrawled links found in each of age_buckets.
+func RestFrontier(w http.ResponseWriter, req *http.Request) {
+	f, err := DS.FrontierSnapshot()
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("frontier-error", "%v", err))
+		return
+	}
+
+	resp := restFrontierResponse{
+		Version:            1,
+		MinLinkRefreshTime: f.MinLinkRefreshTime.String(),
+		AgeBuckets:         cassandra.FrontierAgeLabels(),
+		Total:              newRestFrontierCounts(&f.Total),
+		Priorities:         []restFrontierCounts{},
+	}
+	for _, p := range f.Priorities {
+		c := newRestFrontierCounts(&p.FrontierCounts)
+		priority := p.Priority
+		c.Priority = &priority
+		resp.Priorities = append(resp.Priorities, c)
+	}
+	Render.JSON(w, http.StatusOK, resp)
+}
+
+type restDispatcher struct {
+	Token        string            `json:"token"`
+	Host         string            `json:"host"`
+	Up           time.Time         `json:"up"`
+	Rounds       int               `json:"rounds"`
+	Started      *time.Time        `json:"round_started,omitempty"`
+	Finished     *time.Time        `json:"round_finished,omitempty"`
+	SinceSeconds int64             `json:"seconds_since_finished"`
+	Stalled      bool              `json:"stalled"`
+	Domains      int               `json:"domains"`
+	Failed       map[string]string `json:"failed"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type restDispatchersResponse struct {
+	Version          int              `json:"version"`
+	RoundOverdueTime string           `json:"round_overdue_time"`
+	Dispatchers      []restDispatcher `json:"dispatchers"`
+}
+
+// RestDispatchers manages the rest endpoint rooted at /rest/dispatchers. It
+// responds with the round status of each dispatcher (see
+// cassandra.DispatcherStatus), for alerting on dispatchers that stopped
+// finishing rounds.
+func RestDispatchers(w http.ResponseWriter, req *http.Request) {
+	statuses, err := DS.ListDispatchers()
+	if err != nil {
+		Render.JSON(w, http.StatusInternalServerError, buildError("dispatchers-error", "%v", err))
+		return
+	}
+
+	now := time.Now()
+	resp := restDispatchersResponse{
+		Version:          1,
+		RoundOverdueTime: walker.Config.Webhooks.RoundOverdueTime,
+		Dispatchers:      []restDispatcher{},
+	}
+	for _, s := range statuses {
+		d := restDispatcher{
+			Token:        s.Token.String(),
+			Host:         s.Host,
+			Up:           s.Up,
+			Rounds:       s.Rounds,
+			SinceSeconds: int64(s.SinceFinished(now) / time.Second),
+			Stalled:      s.Stalled(now),
+			Domains:      s.Domains,
+			Failed:       s.Failed,
+			Error:        s.Error,
+		}
+		if d.Failed == nil {
+			d.Failed = map[string]string{}
+		}
+		if started := s.Started; !started.IsZero() {
+			d.Started = &started
+		}
+		if finished := s.Finished; !finished.IsZero() {
+			d.Finished = &finished
+		}
+		resp.Dispatchers = append(resp.Dispatchers, d)
+	}
+	Render.JSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,59 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/gocql/gocql"
+	"github.com/gorilla/mux"
+)
+
+// SamplesPageLength is the number of samples listed on the /samples page
+const SamplesPageLength = 250
+
+// SamplesController returns the page rooted at /samples, listing the most
+// recent fetches sampled for QA capture
+func SamplesController(w http.ResponseWriter, req *http.Request) {
+	samples, err := DS.ListSamples(SamplesPageLength)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("ListSamples failed: %v", err))
+		return
+	}
+
+	mp := map[string]interface{}{
+		"Samples": samples,
+	}
+	Render.HTML(w, http.StatusOK, "samples", mp)
+}
+
+// SampleController returns the page rooted at /sample/{id}, showing the
+// headers and body captured for one sample
+func SampleController(w http.ResponseWriter, req *http.Request) {
+	id, err := gocql.ParseUUID(mux.Vars(req)["id"])
+	if err != nil {
+		replyServerError(w, fmt.Errorf("Bad sample id: %v", err))
+		return
+	}
+	sample, err := DS.FindSample(id)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("FindSample failed: %v", err))
+		return
+	}
+	if sample == nil {
+		replyServerError(w, fmt.Errorf("Sample %v not found, it may have expired", id))
+		return
+	}
+
+	var headerNames []string
+	for name := range sample.Headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+
+	mp := map[string]interface{}{
+		"Sample":      sample,
+		"HeaderNames": headerNames,
+	}
+	Render.HTML(w, http.StatusOK, "sample", mp)
+}
@@ -0,0 +1,54 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/iParadigms/walker"
+)
+
+// ScreenshotController returns the screenshot rooted at /screenshot/{url}/{time},
+// where url is base32 encoded (as for /historical/{url}) and time is when the
+// screenshot was taken, in nanoseconds since the epoch. It serves the thumbnail
+// instead if the thumb query parameter is set.
+func ScreenshotController(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	link, err := decode32(vars["url"])
+	if err != nil {
+		replyServerError(w, fmt.Errorf("decode32 (%s): %v", vars["url"], err))
+		return
+	}
+	u, err := walker.ParseURL(link)
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+	nanos, err := strconv.ParseInt(vars["time"], 10, 64)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("Bad screenshot time: %v", err))
+		return
+	}
+
+	shot, err := DS.FindScreenshot(u, time.Unix(0, nanos))
+	if err != nil {
+		replyServerError(w, fmt.Errorf("FindScreenshot failed: %v", err))
+		return
+	}
+	if shot == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.URL.Query().Get("thumb") != "" {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(shot.Thumbnail)
+		return
+	}
+	if shot.MimeType != "" {
+		w.Header().Set("Content-Type", shot.MimeType)
+	}
+	w.Write(shot.Image)
+}
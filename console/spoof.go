@@ -79,7 +79,8 @@ func spoofDataLong() {
 	insertDomainInfoExcluded := `INSERT INTO domain_info (dom, priority, excluded, exclude_reason) VALUES (?, 1, true, ?)`
 	insertDomainToCrawl := `INSERT INTO domain_info (dom, claim_tok, claim_time, priority) VALUES (?, ?, ?, 1)`
 	insertSegment := `INSERT INTO segments (dom, subdom, path, proto) VALUES (?, ?, ?, ?)`
-	insertLink := `INSERT INTO links (dom, subdom, path, proto, time, stat, err, robot_ex) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	insertLink := `INSERT INTO links (dom, bucket, subdom, path, proto, time, stat, err, robot_ex)
+					VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
 
 	for i := 0; i < 100; i++ {
 		domain := fmt.Sprintf("x%d.com", i)
@@ -95,10 +96,19 @@ func spoofDataLong() {
 			crawlTime = walker.NotYetCrawled
 			excluded = true
 		}
-		err = db.Query(insertLink, domain, "subd", "/page1.html", "http", crawlTime, status, "", excluded).Exec()
+		err = db.Query(insertLink, domain, cassandra.LinkBucket("subd", "/page1.html"), "subd", "/page1.html", "http",
+			crawlTime, status, "", excluded).Exec()
 		if err != nil {
 			panic(err)
 		}
+		if excluded {
+			// The coverage losses the dispatcher would count
+			err = db.Query(`UPDATE domain_info SET tot_links = 1, uncrawled_links = 1, robots_excluded_links = 1
+							WHERE dom = ?`, domain).Exec()
+			if err != nil {
+				panic(err)
+			}
+		}
 	}
 
 	for i := 0; i < 10; i++ {
@@ -127,7 +137,8 @@ func spoofDataLong() {
 				excluded = true
 			}
 			page := fmt.Sprintf("/page%d.html", i)
-			err = db.Query(insertLink, domain, "link", page, "http", crawlTime, status, "", excluded).Exec()
+			err = db.Query(insertLink, domain, cassandra.LinkBucket("link", page), "link", page, "http", crawlTime,
+				status, "", excluded).Exec()
 			if err != nil {
 				panic(err)
 			}
@@ -157,7 +168,8 @@ func spoofDataLong() {
 				status = http.StatusOK
 				fakeError = errorBC[rand.Intn(len(errorBC))]
 			}
-			err = db.Query(insertLink, domain, "link", "/page1.html", "http", crawlTime, status, fakeError, false).Exec()
+			err = db.Query(insertLink, domain, cassandra.LinkBucket("link", "/page1.html"), "link", "/page1.html", "http",
+				crawlTime, status, fakeError, false).Exec()
 			if err != nil {
 				panic(err)
 			}
@@ -174,7 +186,8 @@ func spoofDataLong() {
 
 		for i := 0; i < 20; i++ {
 			page := fmt.Sprintf("/page%d.html", i)
-			err = db.Query(insertLink, domain, "link", page, "http", walker.NotYetCrawled, http.StatusOK, "", false).Exec()
+			err = db.Query(insertLink, domain, cassandra.LinkBucket("link", page), "link", page, "http",
+				walker.NotYetCrawled, http.StatusOK, "", false).Exec()
 			if err != nil {
 				panic(err)
 			}
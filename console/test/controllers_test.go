@@ -7,6 +7,7 @@ import (
 	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -113,6 +114,11 @@ func TestLayout(t *testing.T) {
 		"/findLinks":   "Find Links",
 		"/add":         "Add",
 		"/filterLinks": "Filter Links",
+		"/config":      "Config",
+		"/audit":       "Audit Log",
+		"/samples":     "Samples",
+		"/claims":      "Claims",
+		"/coverage":    "Coverage",
 	}
 	sub := doc.Find("nav ul li a")
 	if sub.Size() != len(mainLinks) {
@@ -227,8 +233,11 @@ func TestListDomainsWeb(t *testing.T) {
 	}
 	header := []string{
 		"Domain",
+		"Priority",
 		"Total Links",
+		"Uncrawled",
 		"Links Dispatched",
+		"Error Rate",
 		"Excluded",
 		"Last Claimed By Fetcher",
 	}
@@ -346,7 +355,15 @@ func TestListLinksWeb(t *testing.T) {
 		"Links Dispatched",
 		"Unique Links Crawled",
 		"Unique Links Not Yet Crawled",
+		"Links That Failed To Parse",
+		"Coverage Losses",
+		"Fetch Rate",
+		"Estimated Time To Crawl",
 		"Priority",
+		"Crawl Delay Override",
+		"Daily Byte Quota",
+		"Bytes Downloaded On Quota Day",
+		"robots.txt Last Changed",
 	}
 
 	sub = domainTable.Find("tr > td:nth-child(1)")
@@ -380,7 +397,10 @@ func TestListLinksWeb(t *testing.T) {
 		"Link",
 		"Status",
 		"Error?",
+		"Parse Error?",
 		"Excluded by robots.txt?",
+		"Mime",
+		"Size",
 		"Last Fetch",
 	}
 
@@ -560,7 +580,10 @@ func TestListLinksSecondPage(t *testing.T) {
 		"Link",
 		"Status",
 		"Error?",
+		"Parse Error?",
 		"Excluded by robots.txt?",
+		"Mime",
+		"Size",
 		"Last Fetch",
 	}
 	sub := linksTable.Find("thead th")
@@ -1293,3 +1316,284 @@ func TestSetPageLength(t *testing.T) {
 	}
 
 }
+
+func TestAddLinksPreflight(t *testing.T) {
+	spoofData()
+
+	randLink := fmt.Sprintf("http://sub.rand%d.com/page0.html", rand.Uint32())
+	rawBody := "links=" + randLink + "%0D%0A&preflight=preflight"
+	doc, body, status := callController("http://localhost:3000/add", rawBody, "/add", console.AddLinkIndexController)
+	if status != http.StatusOK {
+		t.Errorf("TestAddLinksPreflight bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+
+	var headers []string
+	doc.Find(".container h2").Each(func(index int, sel *goquery.Selection) {
+		headers = append(headers, strings.TrimSpace(sel.Text()))
+	})
+	expected := []string{"Pre-flight Checks", "Add Links"}
+	if !reflect.DeepEqual(headers, expected) {
+		t.Errorf("[.container h2] Headers mismatch got %q, expected %q", headers, expected)
+	}
+	if rows := doc.Find(".container table tbody tr").Size(); rows != 4 {
+		t.Errorf("[.container table tbody tr] Expected a row per check, got %d", rows)
+	}
+	if text := doc.Find(".container form textarea").Text(); !strings.Contains(text, randLink) {
+		t.Errorf("Expected the checked links to be kept in the form, got %q", text)
+	}
+
+	// Checking mustn't add the link
+	linfo, err := console.DS.FindLink(walker.MustParse(randLink), false)
+	if err != nil {
+		t.Fatalf("Failed to look up link: %v", err)
+	}
+	if linfo != nil {
+		t.Errorf("Expected the checked link not to be added, found %+v", linfo)
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/coverage", "", "/coverage", console.CoverageController)
+	if status != http.StatusOK {
+		t.Errorf("TestCoverage bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+
+	rows := doc.Find(".container table tbody tr")
+	if rows.Size() < 1 {
+		t.Fatalf("[.container table tbody tr] Bad size expected > 0")
+	}
+	rows.Each(func(index int, sel *goquery.Selection) {
+		cols := sel.Find("td")
+		if cols.Size() != 6 {
+			t.Fatalf("[.container table tbody tr td] Size mismatch got %d, expected %d", cols.Size(), 6)
+		}
+		link, _ := cols.First().Find("a").Attr("href")
+		if !strings.HasPrefix(link, "/links/x") {
+			t.Errorf("Expected only spoofed domains with robots.txt exclusions, got %q", link)
+		}
+		if excluded := strings.TrimSpace(cols.Eq(2).Text()); excluded != "1" {
+			t.Errorf("Robots Excluded mismatch for %v: got %q, expected %q", link, excluded, "1")
+		}
+		if lost := strings.TrimSpace(cols.Eq(5).Text()); lost != "100.0%" {
+			t.Errorf("Lost mismatch for %v: got %q, expected %q", link, lost, "100.0%")
+		}
+	})
+}
+
+func TestCrawlDiff(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/crawldiff/t1.com?from=2000-01-01", "",
+		"/crawldiff/{domain}", console.CrawlDiffController)
+	if status != http.StatusOK {
+		t.Errorf("TestCrawlDiff bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+
+	h4 := []string{"Gone", "Changed", "New"}
+	sub := doc.Find(".container h4")
+	if sub.Size() != len(h4) {
+		t.Fatalf("[.container h4] Size mismatch got %d, expected %d", sub.Size(), len(h4))
+	}
+	sub.Each(func(index int, sel *goquery.Selection) {
+		if text := strings.TrimSpace(sel.Text()); text != h4[index] {
+			t.Errorf("[.container h4] Text mismatch got %q, expected %q", text, h4[index])
+		}
+	})
+
+	// Nothing was crawled as early as 2000, so every crawled link is new
+	rows := doc.Find(".container table").Last().Find("tbody tr td:nth-child(1)")
+	if rows.Size() < 1 || strings.Contains(rows.First().Text(), "No new links") {
+		t.Errorf("Expected new links, got %q", rows.Text())
+	}
+
+	_, body, status = callController("http://localhost:3000/crawldiff/t1.com?from=yesterday", "",
+		"/crawldiff/{domain}", console.CrawlDiffController)
+	if status != http.StatusOK || !strings.Contains(body, "Bad time") {
+		t.Errorf("Expected a bad time to be reported, got status %d", status)
+	}
+}
+
+func TestRedirects(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/redirects/t1.com", "",
+		"/redirects/{domain}", console.RedirectsController)
+	if status != http.StatusOK {
+		t.Errorf("TestRedirects bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	// None of t1.com's links have been fetched yet
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "No redirects" {
+		t.Errorf("Expected no redirects, got %q", text)
+	}
+
+	_, body, status = callController("http://localhost:3000/redirects/nowhere.com", "",
+		"/redirects/{domain}", console.RedirectsController)
+	if status != http.StatusOK || !strings.Contains(body, "Domain nowhere.com not found") {
+		t.Errorf("Expected a missing domain to be reported, got status %d", status)
+	}
+}
+
+func TestOutlinks(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/outlinks/t1.com", "",
+		"/outlinks/{domain}", console.OutlinksController)
+	if status != http.StatusOK {
+		t.Errorf("TestOutlinks bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	// None of t1.com's links have been fetched yet
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "No external links" {
+		t.Errorf("Expected no external links, got %q", text)
+	}
+
+	_, body, status = callController("http://localhost:3000/outlinks/nowhere.com", "",
+		"/outlinks/{domain}", console.OutlinksController)
+	if status != http.StatusOK || !strings.Contains(body, "Domain nowhere.com not found") {
+		t.Errorf("Expected a missing domain to be reported, got status %d", status)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/latency", "", "/latency", console.LatencyController)
+	if status != http.StatusOK {
+		t.Errorf("TestLatency bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	// None of the spoofed fetches have a response time
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "No fetches" {
+		t.Errorf("Expected no fetches, got %q", text)
+	}
+
+	for _, days := range []string{"x", "0"} {
+		_, body, status = callController("http://localhost:3000/latency?days="+days, "", "/latency",
+			console.LatencyController)
+		if status != http.StatusOK || strings.Contains(body, "Slowest Domains") {
+			t.Errorf("Expected days=%v to be reported as an error, got status %d", days, status)
+		}
+	}
+}
+
+func TestFrontier(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/frontier", "", "/frontier", console.FrontierController)
+	if status != http.StatusOK {
+		t.Errorf("TestFrontier bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	// The spoofed domains haven't been dispatched, so have no frontier counts
+	if !strings.Contains(body, "The crawl is keeping up") {
+		t.Error("Expected the crawl to be keeping up")
+	}
+	headers := doc.Find(".container table thead th").Length()
+	if expected := len(cassandra.FrontierAgeBuckets) + 6; headers != expected {
+		t.Errorf("Expected %d columns, got %d", expected, headers)
+	}
+}
+
+func TestTraps(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/traps", "", "/traps", console.TrapsController)
+	if status != http.StatusOK {
+		t.Errorf("TestTraps bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	// The spoofed domains haven't been dispatched, so no traps were found
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "No crawler traps found" {
+		t.Errorf("Expected no crawler traps, got %q", text)
+	}
+
+	// Confirming a missing rule fails, back on the traps page
+	_, _, status = callController("http://localhost:3000/setParamRule", "domain=t1.com&path=/cal&status=active",
+		"/setParamRule", console.SetParamRuleController)
+	if status != http.StatusFound {
+		t.Errorf("TestTraps bad status code got %d, expected %d", status, http.StatusFound)
+	}
+}
+
+func TestFilterTester(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/filterTester",
+		"links=http%3A%2F%2Ft1.com%2Fpage1.html%23top%0Aftp%3A%2F%2Ft1.com%2Ffile.txt", "/filterTester",
+		console.FilterTesterController)
+	if status != http.StatusOK {
+		t.Errorf("TestFilterTester bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+
+	var outcomes []string
+	doc.Find(".container table thead th").Each(func(i int, s *goquery.Selection) {
+		outcome := strings.TrimSpace(s.Closest("table").Find("tbody tr").Last().Text())
+		outcomes = append(outcomes, strings.TrimSpace(s.Text())+": "+outcome)
+	})
+	expected := []string{
+		"http://t1.com/page1.html#top: Stored as http://t1.com/page1.html",
+		"ftp://t1.com/file.txt: Not stored",
+	}
+	if !reflect.DeepEqual(outcomes, expected) {
+		t.Errorf("Expected outcomes %v\nBut got: %v", expected, outcomes)
+	}
+}
+
+func TestDispatchers(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/dispatchers", "", "/dispatchers",
+		console.DispatchersController)
+	if status != http.StatusOK {
+		t.Errorf("TestDispatchers bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	// No dispatcher is running against the spoofed data
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "No dispatchers running" {
+		t.Errorf("Expected no dispatchers, got %q", text)
+	}
+}
+
+func TestReports(t *testing.T) {
+	spoofData()
+	doc, body, status := callController("http://localhost:3000/reports/t1.com", "",
+		"/reports/{domain}", console.ReportsController)
+	if status != http.StatusOK {
+		t.Errorf("TestReports bad status code got %d, expected %d", status, http.StatusOK)
+		t.Log(body)
+		t.FailNow()
+	}
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "Nobody gets reports of this domain" {
+		t.Errorf("Expected no reports, got %q", text)
+	}
+
+	_, _, status = callController("http://localhost:3000/reports/t1.com",
+		"action=add&recipient=ops%40t1.com&period=24h", "/reports/{domain}", console.ReportsController)
+	if status != http.StatusFound {
+		t.Errorf("TestReports bad status code got %d, expected %d", status, http.StatusFound)
+	}
+	doc, _, _ = callController("http://localhost:3000/reports/t1.com", "",
+		"/reports/{domain}", console.ReportsController)
+	if text := strings.TrimSpace(doc.Find(".container table tbody td").First().Text()); text != "ops@t1.com" {
+		t.Errorf("Expected ops@t1.com to get reports, got %q", text)
+	}
+
+	_, _, status = callController("http://localhost:3000/reports/t1.com",
+		"action=delete&recipient=ops%40t1.com", "/reports/{domain}", console.ReportsController)
+	if status != http.StatusFound {
+		t.Errorf("TestReports bad status code got %d, expected %d", status, http.StatusFound)
+	}
+	doc, _, _ = callController("http://localhost:3000/reports/t1.com", "",
+		"/reports/{domain}", console.ReportsController)
+	if n := doc.Find(".container table tbody tr").Length(); n != 1 {
+		t.Errorf("Expected the report to be removed, got %d rows", n)
+	}
+}
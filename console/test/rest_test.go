@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/cassandra"
 	"github.com/iParadigms/walker/console"
 )
 
@@ -153,3 +154,71 @@ func TestAdd(t *testing.T) {
 
 	fixtureEnd()
 }
+
+func TestRestTokens(t *testing.T) {
+	orig := walker.Config.Console.APITokens
+	defer func() {
+		walker.Config.Console.APITokens = orig
+	}()
+	walker.Config.Console.APITokens = []string{"tester:s3cret"}
+
+	fixtureStart()
+	defer fixtureEnd()
+
+	post := func(token string, mp map[string]interface{}) int {
+		b, err := json.Marshal(mp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", target("add"), bytes.NewBuffer(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	domain := fmt.Sprintf("tok%x.com", rand.Uint32())
+	mp := map[string]interface{}{
+		"version": 1,
+		"links": []interface{}{
+			map[string]interface{}{"url": "http://" + domain + "/page1.html"},
+		},
+	}
+
+	if status := post("", mp); status != http.StatusUnauthorized {
+		t.Errorf("Without a token got status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := post("wrong", mp); status != http.StatusUnauthorized {
+		t.Errorf("With a bad token got status code %d, expected %d", status, http.StatusUnauthorized)
+	}
+	if status := post("s3cret", mp); status != http.StatusOK {
+		t.Fatalf("With a good token got status code %d, expected %d", status, http.StatusOK)
+	}
+
+	entries, err := console.DS.ListAudit(10)
+	if err != nil {
+		t.Fatalf("ListAudit failed: %v", err)
+	}
+	found := false
+	for _, e := range entries {
+		if e.Target == domain {
+			found = true
+			if e.Actor != "api:tester" || e.Action != cassandra.AuditAddLinks {
+				t.Errorf("Audit entry for %v got actor %q action %q, expected %q %q",
+					domain, e.Actor, e.Action, "api:tester", cassandra.AuditAddLinks)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected an audit entry for adding %v, got %v", domain, entries)
+	}
+}
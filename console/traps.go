@@ -0,0 +1,71 @@
+package console
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/iParadigms/walker"
+	"github.com/iParadigms/walker/cassandra"
+)
+
+// TrapsController returns the page rooted at /traps, listing the param rules
+// the dispatcher synthesized to escape crawler traps (see
+// dispatcher.trap_escape), where proposed rules can be confirmed or rejected.
+func TrapsController(w http.ResponseWriter, req *http.Request) {
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+	infos, errors := session.Flashes()
+
+	mp := map[string]interface{}{
+		"TrapEscape": walker.Config.Dispatcher.TrapEscape,
+	}
+	rules, err := DS.ListParamRules("")
+	if err != nil {
+		errors = append(errors, fmt.Sprintf("Failed to list param rules: %v", err))
+	} else {
+		mp["Rules"] = rules
+	}
+	mp["HasInfoMessage"] = len(infos) > 0
+	mp["InfoMessage"] = infos
+	mp["HasErrorMessage"] = len(errors) > 0
+	mp["ErrorMessage"] = errors
+	Render.HTML(w, http.StatusOK, "traps", mp)
+}
+
+// SetParamRuleController handles confirming (or rejecting, or deactivating)
+// a param rule from the /traps page
+func SetParamRuleController(w http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+	if err != nil {
+		replyServerError(w, err)
+		return
+	}
+
+	session, err := GetSession(w, req)
+	if err != nil {
+		replyServerError(w, fmt.Errorf("GetSession failed: %v", err))
+		return
+	}
+
+	domain := req.Form.Get("domain")
+	subdomain := req.Form.Get("subdomain")
+	path := req.Form.Get("path")
+	status := req.Form.Get("status")
+	if domain == "" || path == "" {
+		replyServerError(w, fmt.Errorf("domain or path inexplicably is NOT in the hidden form"))
+		return
+	}
+
+	err = DS.SetParamRuleStatus(domain, subdomain, path, status)
+	if err != nil {
+		session.AddErrorFlash(fmt.Sprintf("Failed to set param rule: %v", err))
+	} else {
+		rule := &cassandra.ParamRule{Domain: domain, Subdomain: subdomain, Path: path}
+		recordAudit(consoleActor(req), cassandra.AuditParamRule, domain, fmt.Sprintf("%v%v %v", rule.Host(), path, status))
+		session.AddInfoFlash(fmt.Sprintf("Param rule for %v%v is now %v", rule.Host(), path, status))
+	}
+	http.Redirect(w, req, "/traps", http.StatusFound)
+}
@@ -0,0 +1,51 @@
+package walker
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"code.google.com/p/log4go"
+)
+
+// A site's control files (its robots.txt and sitemaps) are read on every claim
+// of the host, before any page, so a huge (or endless) one would tie up the
+// fetcher and its memory. They are capped independently of
+// fetcher.max_http_content_size_bytes: a robots.txt at fetcher.max_robots_bytes,
+// past which its rules are ignored, and a sitemap at fetcher.max_sitemap_bytes
+// (after decompressing it, so a small gzipped sitemap can't blow up), past
+// which it isn't used. Each time a file goes over its limit the datastore is
+// told (see Datastore.StoreControlFileOverLimit).
+
+// errOverLimit is returned by readCapped for a body over the limit
+var errOverLimit = errors.New("over the size limit")
+
+// readCapped reads r up to limit bytes, returning what it read and
+// errOverLimit if r held more.
+func readCapped(r io.Reader, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return body[:limit], errOverLimit
+	}
+	return body, nil
+}
+
+// truncateRobots cuts a robots.txt read up to the limit back to its last
+// whole line, so a rule cut in half isn't taken for a different one
+func truncateRobots(body []byte) []byte {
+	if i := bytes.LastIndexAny(body, "\r\n"); i >= 0 {
+		return body[:i+1]
+	}
+	return nil
+}
+
+// overLimit records that the control file at link, fetched for host, was
+// larger than limit bytes
+func (f *fetcher) overLimit(host, link string, limit int64) {
+	log4go.Warn("%v is over the limit of %v bytes", link, limit)
+	f.fm.Datastore.StoreControlFileOverLimit(host, link, limit)
+}
@@ -0,0 +1,269 @@
+package walker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// A Crawler runs the parts of a crawl a walker process is responsible for (a
+// FetchManager, a Dispatcher, and servers like the console) until it is sent
+// SIGINT or SIGTERM, then shuts them down in order:
+//
+//  1. the fetchers finish their current fetches and unclaim their domains
+//  2. the dispatcher stops, once no more domains will be unclaimed
+//  3. the services (console, metrics) stop, so the crawl can be watched until
+//     the end
+//
+// The whole shutdown is given fetcher.drain_timeout. Whatever hasn't stopped
+// by then is abandoned, and listed in the ShutdownReport Run returns.
+
+// Service is a server run alongside the crawl, like the console or a metrics
+// endpoint
+type Service interface {
+	// Start starts the service, without blocking
+	Start() error
+
+	// Stop stops the service, blocking until it has
+	Stop() error
+}
+
+// Crawler runs a crawl's components; set the ones this process runs, then call
+// Run
+type Crawler struct {
+	// The fetchers, or nil to not fetch
+	FetchManager *FetchManager
+
+	// The dispatcher, or nil to not dispatch
+	Dispatcher Dispatcher
+
+	// Named services, started after the FetchManager and Dispatcher and
+	// stopped after them
+	Services map[string]Service
+
+	// How long shutdown may take; Config.Fetcher.DrainTimeout if 0
+	DrainTimeout time.Duration
+
+	initOnce sync.Once
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// ShutdownReport is what a Crawler left undone when it shut down
+type ShutdownReport struct {
+	// Hosts fetchers still had claimed when the drain timeout ran out
+	UnfinishedHosts []string
+
+	// Components that hadn't stopped when the drain timeout ran out
+	// ("fetchers", "dispatcher" or a service name)
+	TimedOut []string
+
+	// Errors components returned starting, running or stopping
+	Errors []error
+}
+
+// Clean returns true if everything stopped cleanly and in time
+func (r *ShutdownReport) Clean() bool {
+	return len(r.UnfinishedHosts) == 0 && len(r.TimedOut) == 0 && len(r.Errors) == 0
+}
+
+// NewHTTPService returns a Service serving handler on addr (ex. ":9090"), for
+// metrics or debugging endpoints
+func NewHTTPService(addr string, handler http.Handler) Service {
+	return &httpService{server: &http.Server{Addr: addr, Handler: handler}}
+}
+
+type httpService struct {
+	server *http.Server
+}
+
+func (s *httpService) Start() error {
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := s.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log4go.Error("Failed serving %v: %v", s.server.Addr, err)
+		}
+	}()
+	return nil
+}
+
+func (s *httpService) Stop() error {
+	return s.server.Shutdown(context.Background())
+}
+
+// Run starts the crawl's components and blocks until the process is sent
+// SIGINT or SIGTERM, Stop is called, or the dispatcher fails, then shuts them
+// down and returns what was left undone. SIGUSR1 writes the FetchManager's
+// crawl report (see fetcher.report_file) without stopping.
+func (c *Crawler) Run() *ShutdownReport {
+	c.init()
+	r := &ShutdownReport{}
+	drain := c.DrainTimeout
+	if drain == 0 {
+		// Already validated by assertConfigInvariants
+		drain, _ = time.ParseDuration(Config.Fetcher.DrainTimeout)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1)
+	defer signal.Stop(sig)
+
+	if c.FetchManager != nil {
+		go c.FetchManager.Start()
+	}
+	// dispatcherDone receives what StartDispatcher returns; it is set to nil
+	// once received
+	var dispatcherDone chan error
+	if c.Dispatcher != nil {
+		dispatcherDone = make(chan error, 1)
+		go func() {
+			dispatcherDone <- c.Dispatcher.StartDispatcher()
+		}()
+	}
+	var started []string
+	for _, name := range c.serviceNames() {
+		if err := c.Services[name].Start(); err != nil {
+			r.Errors = append(r.Errors, fmt.Errorf("Failed to start %v: %v", name, err))
+			continue
+		}
+		started = append(started, name)
+	}
+
+	dispatcherFailed := false
+wait:
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGUSR1 {
+				if c.FetchManager != nil {
+					if err := c.FetchManager.WriteReport(); err != nil {
+						log4go.Error(err.Error())
+					}
+				}
+				continue
+			}
+			log4go.Info("Caught %v, shutting down", s)
+		case <-c.stop:
+			log4go.Info("Shutting down")
+		case err := <-dispatcherDone:
+			dispatcherDone = nil
+			if err == nil {
+				// Nothing left for it to do; the rest of the crawl carries on
+				log4go.Info("Dispatcher finished")
+				continue
+			}
+			dispatcherFailed = true
+			r.Errors = append(r.Errors, fmt.Errorf("dispatcher: %v", err))
+			log4go.Error("Dispatcher failed, shutting down: %v", err)
+		}
+		break wait
+	}
+
+	var deadline time.Time
+	if drain > 0 {
+		deadline = time.Now().Add(drain)
+	}
+	remaining := func() time.Duration {
+		if deadline.IsZero() {
+			return 0
+		}
+		if d := deadline.Sub(time.Now()); d > 0 {
+			return d
+		}
+		return time.Nanosecond
+	}
+
+	if c.FetchManager != nil {
+		r.UnfinishedHosts = c.FetchManager.StopWithin(remaining())
+		if len(r.UnfinishedHosts) > 0 {
+			r.TimedOut = append(r.TimedOut, "fetchers")
+		}
+	}
+	if c.Dispatcher != nil && !dispatcherFailed {
+		r.wait("dispatcher", remaining(), func() error {
+			if err := c.Dispatcher.StopDispatcher(); err != nil {
+				return err
+			}
+			if dispatcherDone != nil {
+				return <-dispatcherDone
+			}
+			return nil
+		})
+	}
+	for i := len(started) - 1; i >= 0; i-- {
+		r.wait(started[i], remaining(), c.Services[started[i]].Stop)
+	}
+
+	r.log()
+	return r
+}
+
+// Stop makes Run shut the crawl down, as if the process had been sent SIGTERM
+func (c *Crawler) Stop() {
+	c.init()
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+func (c *Crawler) init() {
+	c.initOnce.Do(func() { c.stop = make(chan struct{}) })
+}
+
+// serviceNames returns the names of c.Services, sorted
+func (c *Crawler) serviceNames() []string {
+	var names []string
+	for name := range c.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// wait calls stop, waiting at most timeout (forever if 0) for it to return,
+// and records the outcome for the named component
+func (r *ShutdownReport) wait(name string, timeout time.Duration, stop func() error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- stop()
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			r.Errors = append(r.Errors, fmt.Errorf("%v: %v", name, err))
+		}
+	case <-expired:
+		r.TimedOut = append(r.TimedOut, name)
+	}
+}
+
+// log logs what r says was left undone
+func (r *ShutdownReport) log() {
+	if r.Clean() {
+		log4go.Info("Crawl shut down cleanly")
+		return
+	}
+	for _, name := range r.TimedOut {
+		log4go.Warn("Shutdown abandoned %v, which did not stop in time", name)
+	}
+	for _, host := range r.UnfinishedHosts {
+		log4go.Warn("Shutdown left %v claimed", host)
+	}
+	for _, err := range r.Errors {
+		log4go.Error("Shutdown error: %v", err)
+	}
+}
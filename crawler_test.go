@@ -0,0 +1,107 @@
+package walker
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stopRecorder records the order components are stopped in
+type stopRecorder struct {
+	mu      sync.Mutex
+	stopped []string
+}
+
+func (r *stopRecorder) record(name string) {
+	r.mu.Lock()
+	r.stopped = append(r.stopped, name)
+	r.mu.Unlock()
+}
+
+type testDispatcher struct {
+	r    *stopRecorder
+	quit chan struct{}
+}
+
+func (d *testDispatcher) StartDispatcher() error {
+	<-d.quit
+	return nil
+}
+
+func (d *testDispatcher) StopDispatcher() error {
+	d.r.record("dispatcher")
+	close(d.quit)
+	return nil
+}
+
+type testService struct {
+	r       *stopRecorder
+	name    string
+	started bool
+	block   time.Duration
+	err     error
+}
+
+func (s *testService) Start() error {
+	s.started = true
+	return nil
+}
+
+func (s *testService) Stop() error {
+	time.Sleep(s.block)
+	s.r.record(s.name)
+	return s.err
+}
+
+func TestCrawlerShutdown(t *testing.T) {
+	r := &stopRecorder{}
+	console := &testService{r: r, name: "console"}
+	metrics := &testService{r: r, name: "metrics", err: errors.New("failed")}
+	c := &Crawler{
+		Dispatcher: &testDispatcher{r: r, quit: make(chan struct{})},
+		Services:   map[string]Service{"console": console, "metrics": metrics},
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.Stop()
+	}()
+	report := c.Run()
+
+	if !console.started || !metrics.started {
+		t.Error("Expected the services to be started")
+	}
+	expected := []string{"dispatcher", "metrics", "console"}
+	if !reflect.DeepEqual(r.stopped, expected) {
+		t.Errorf("Expected components stopped in order %v, got %v", expected, r.stopped)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].Error() != "metrics: failed" {
+		t.Errorf("Expected the metrics service's error to be reported, got %v", report.Errors)
+	}
+	if len(report.TimedOut) != 0 || report.Clean() {
+		t.Errorf("Unexpected shutdown report %+v", report)
+	}
+}
+
+func TestCrawlerDrainTimeout(t *testing.T) {
+	r := &stopRecorder{}
+	c := &Crawler{
+		Services: map[string]Service{
+			// Stopped in reverse order of name, so metrics first
+			"console": &testService{r: r, name: "console", block: time.Second},
+			"metrics": &testService{r: r, name: "metrics"},
+		},
+		DrainTimeout: 50 * time.Millisecond,
+	}
+	c.Stop()
+	start := time.Now()
+	report := c.Run()
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected shutdown to give up after the drain timeout, took %v", elapsed)
+	}
+	if !reflect.DeepEqual(report.TimedOut, []string{"console"}) {
+		t.Errorf("Expected the console service to time out, got %v", report.TimedOut)
+	}
+}
@@ -0,0 +1,176 @@
+package walker
+
+import (
+	"sort"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// In differential crawl mode (fetcher.differential) handlers are only given
+// pages whose content changed since they were last crawled, for monitoring
+// use cases. The fingerprint and outlinks of every handled page are kept in
+// the Datastore as its PageState; a page whose fingerprint matches its last
+// state (or that got a 304) is marked Unchanged and not handled, and one that
+// changed is handled with a PageDiff summarizing how. Page states are also
+// kept for pages watch rules apply to (see watch.go), whatever the mode.
+
+// PageState is what differential crawl mode remembers of a page between
+// crawls
+type PageState struct {
+	// When the page was first fetched with this content (the state isn't
+	// rewritten while the content stays the same)
+	FetchTime time.Time
+
+	// The FNV fingerprint of its content
+	Fingerprint int64
+
+	// The links parsed out of it and stored, sorted
+	Outlinks []string
+
+	// The value each watch rule applying to the page selected, by rule name
+	Watches map[string]string
+}
+
+// PageDiff summarizes how a page changed since it was last crawled, in
+// differential crawl mode
+type PageDiff struct {
+	// True if there was no record of the page, in which case all its
+	// outlinks are in AddedLinks
+	New bool
+
+	// When the page's previous content was first fetched, and its
+	// fingerprint (zero if New)
+	PreviousFetchTime   time.Time
+	PreviousFingerprint int64
+
+	// Outlinks found on the page now that weren't before, and ones that were
+	// found before but are gone now, sorted
+	AddedLinks   []string
+	RemovedLinks []string
+
+	// The number of outlinks found both times
+	KeptLinks int
+}
+
+// recordOutlink notes a link stored from the current page, for its PageState
+func (f *fetcher) recordOutlink(u *URL) {
+	if Config.Fetcher.Differential || len(f.fm.watchRules) > 0 {
+		f.outlinks = append(f.outlinks, u.String())
+	}
+}
+
+// trackPage compares the page fetched in fr (with the given body) with its
+// last PageState, in differential crawl mode or if watch rules apply to it.
+// It sets fr.Unchanged if the content is the same as last time; otherwise it
+// sets fr.Diff (in differential mode) and fr.WatchChanges, and the new state
+// for storePageState to store.
+func (f *fetcher) trackPage(fr *FetchResults, body []byte) {
+	f.pageState = nil
+	var rules []*watchRule
+	if isHTML(fr.Response) {
+		rules = f.fm.watchRulesFor(fr.URL)
+	}
+	if !Config.Fetcher.Differential && len(rules) == 0 {
+		return
+	}
+
+	prev := f.fm.Datastore.LoadPageState(fr.URL)
+	same := prev != nil && prev.Fingerprint == fr.FnvFingerprint
+	if same {
+		log4go.Fine("Content of %v unchanged since %v", fr.URL, prev.FetchTime)
+		fr.Unchanged = true
+		if prev.watching(rules) {
+			return
+		}
+	}
+
+	cur := &PageState{
+		FetchTime:   fr.FetchTime,
+		Fingerprint: fr.FnvFingerprint,
+		Outlinks:    sortedUnique(f.outlinks),
+	}
+	var prevWatches map[string]string
+	if prev != nil {
+		prevWatches = prev.Watches
+		if same {
+			// Only new watch rules need recording
+			cur.FetchTime = prev.FetchTime
+		}
+	}
+	if len(rules) > 0 {
+		cur.Watches = watchValues(body, rules)
+		fr.WatchChanges = watchChanges(rules, prevWatches, cur.Watches, fr.FetchTime)
+	}
+	f.pageState = cur
+	if Config.Fetcher.Differential && !same {
+		fr.Diff = diffPageStates(prev, cur)
+	}
+	fireWatchChanges(fr)
+}
+
+// storePageState stores the state trackPage made for the page fetched in fr,
+// unless the handler failed to handle it: the old state is kept then, so in
+// differential mode the page is handled again the next time it is crawled.
+func (f *fetcher) storePageState(fr *FetchResults) {
+	if f.pageState == nil || fr.HandlerError != nil {
+		return
+	}
+	f.fm.Datastore.StorePageState(fr.URL, f.pageState)
+	f.pageState = nil
+}
+
+// watching returns true if ps has a value for each of rules
+func (ps *PageState) watching(rules []*watchRule) bool {
+	for _, r := range rules {
+		if _, ok := ps.Watches[r.Name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// diffPageStates returns how cur differs from prev, which is nil if there is
+// no record of the page
+func diffPageStates(prev, cur *PageState) *PageDiff {
+	d := &PageDiff{AddedLinks: []string{}, RemovedLinks: []string{}}
+	if prev == nil {
+		d.New = true
+		d.AddedLinks = append(d.AddedLinks, cur.Outlinks...)
+		return d
+	}
+	d.PreviousFetchTime = prev.FetchTime
+	d.PreviousFingerprint = prev.Fingerprint
+
+	// Both lists are sorted, so walk them together
+	before := sortedUnique(prev.Outlinks)
+	i, j := 0, 0
+	for i < len(before) || j < len(cur.Outlinks) {
+		switch {
+		case j == len(cur.Outlinks) || (i < len(before) && before[i] < cur.Outlinks[j]):
+			d.RemovedLinks = append(d.RemovedLinks, before[i])
+			i++
+		case i == len(before) || cur.Outlinks[j] < before[i]:
+			d.AddedLinks = append(d.AddedLinks, cur.Outlinks[j])
+			j++
+		default:
+			d.KeptLinks++
+			i++
+			j++
+		}
+	}
+	return d
+}
+
+// sortedUnique returns a sorted copy of links without duplicates
+func sortedUnique(links []string) []string {
+	sorted := append([]string{}, links...)
+	sort.Strings(sorted)
+	out := sorted[:0]
+	for i, l := range sorted {
+		if i == 0 || l != sorted[i-1] {
+			out = append(out, l)
+		}
+	}
+	return out
+}
@@ -0,0 +1,46 @@
+package walker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffPageStates(t *testing.T) {
+	cur := &PageState{
+		FetchTime:   time.Now(),
+		Fingerprint: 2,
+		Outlinks:    []string{"http://a.com/1", "http://a.com/3", "http://a.com/4"},
+	}
+
+	d := diffPageStates(nil, cur)
+	if !d.New || !reflect.DeepEqual(d.AddedLinks, cur.Outlinks) || len(d.RemovedLinks) != 0 {
+		t.Errorf("Expected a new page diff adding all outlinks, got %+v", d)
+	}
+
+	prev := &PageState{
+		FetchTime:   time.Now().Add(-time.Hour),
+		Fingerprint: 1,
+		Outlinks:    []string{"http://a.com/0", "http://a.com/3", "http://a.com/1", "http://a.com/3"},
+	}
+	expected := &PageDiff{
+		PreviousFetchTime:   prev.FetchTime,
+		PreviousFingerprint: 1,
+		AddedLinks:          []string{"http://a.com/4"},
+		RemovedLinks:        []string{"http://a.com/0"},
+		KeptLinks:           2,
+	}
+	if d := diffPageStates(prev, cur); !reflect.DeepEqual(d, expected) {
+		t.Errorf("Diff mismatch\nExpected: %+v\nGot:      %+v", expected, d)
+	}
+}
+
+func TestSortedUnique(t *testing.T) {
+	got := sortedUnique([]string{"c", "a", "b", "a", "c"})
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("sortedUnique got %v, expected %v", got, expected)
+	}
+	if got := sortedUnique(nil); len(got) != 0 {
+		t.Errorf("Expected no links, got %v", got)
+	}
+}
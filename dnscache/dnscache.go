@@ -5,6 +5,7 @@ package dnscache
 
 import (
 	"net"
+	"net/url"
 	"sync"
 	"time"
 
@@ -14,37 +15,108 @@ import (
 //TODO:
 //  - use a time-based cache instead of entry-capped, since we know we'll
 //    need most of the recently-accessed domains and few of the aging entries
-//  - consider not caching failures or doing any blacklisting here; the more
-//    likely usecase will be to retry a few times (in which case we don't want
-//    caching) and then not bother crawling this host at all
+
+// DefaultTTL is how long resolutions, and by default failed lookups, are
+// cached before the host is looked up again
+const DefaultTTL = 5 * time.Minute
 
 // Dial wraps the given dial function with Caching of DNS resolutions. When a
 // hostname is found in the cache it will call the provided dial with the IP
 // address instead of the hostname, so no DNS lookup need be performed. It will
-// also cache DNS failures.
+// also cache DNS failures (see IsDNSError); other dial errors, like refused
+// connections, are not cached.
 //
 // If the given wrappedDial is nil, net.Dial will be automatically used.
 func Dial(wrappedDial func(network, addr string) (net.Conn, error), maxEntries int) (func(network, addr string) (net.Conn, error), error) {
-	if wrappedDial == nil {
-		wrappedDial = net.Dial
+	c, err := New(maxEntries)
+	if err != nil {
+		return nil, err
 	}
+	return c.Dial(wrappedDial), nil
+}
+
+// Cache is an LRU cache of DNS resolutions that can be shared by several
+// caching Dial functions, and read or seeded directly (ex. to hand
+// resolutions from one process to another).
+type Cache struct {
+	cache *lru.Cache
+	mu    sync.RWMutex
+
+	// How long a failed lookup is cached, during which dialing the address
+	// fails right away with the same error. DefaultTTL unless set; set it
+	// before dialing.
+	NegativeTTL time.Duration
+}
+
+// New creates a Cache holding at most maxEntries resolutions
+func New(maxEntries int) (*Cache, error) {
 	cache, err := lru.New(maxEntries)
 	if err != nil {
 		return nil, err
 	}
-	c := &dnsCache{
+	return &Cache{cache: cache, NegativeTTL: DefaultTTL}, nil
+}
+
+// IsDNSError returns true if err, as returned by a Dial function or an HTTP
+// request made through one, is a failure to resolve a host name (ex.
+// NXDOMAIN)
+func IsDNSError(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *net.DNSError:
+			return true
+		case *net.OpError:
+			err = e.Err
+		case *url.Error:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
+
+// Dial wraps the given dial function like the package level Dial, caching
+// resolutions in c. If wrappedDial is nil, net.Dial is used.
+func (c *Cache) Dial(wrappedDial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if wrappedDial == nil {
+		wrappedDial = net.Dial
+	}
+	d := &dnsCache{
 		wrappedDial: wrappedDial,
-		cache:       cache,
+		Cache:       c,
+	}
+	return d.cachingDial
+}
+
+// Addr returns the address (ip:port) cached for dialing addr on network. ok
+// is false if there is none, or the last lookup failed.
+func (c *Cache) Addr(network, addr string) (ipaddr string, ok bool) {
+	record, ok := c.get(network, addr)
+	if !ok || record.blacklisted {
+		return "", false
 	}
-	return c.cachingDial, nil
+	return record.ipaddr, true
+}
+
+// Seed caches ipaddr as the address to dial for addr on network, unless addr
+// is already cached.
+func (c *Cache) Seed(network, addr, ipaddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.cache.Get(network + addr); ok {
+		return
+	}
+	c.cache.Add(network+addr, hostrecord{
+		ipaddr:    ipaddr,
+		lastQuery: time.Now(),
+	})
 }
 
 // dnsCache wraps a net.Dial-type function with it's own version that will
-// cache DNS entries in an LRU cache.
+// cache DNS entries in a Cache.
 type dnsCache struct {
 	wrappedDial func(network, address string) (net.Conn, error)
-	cache       *lru.Cache
-	mu          sync.RWMutex
+	*Cache
 }
 
 type hostrecord struct {
@@ -59,13 +131,13 @@ func (c *dnsCache) cachingDial(network, addr string) (net.Conn, error) {
 	c.mu.RLock()
 	if entry, ok := c.cache.Get(mapEntryName); ok {
 		record := entry.(hostrecord)
-		lastQueryTime := record.lastQuery
-		if time.Since(lastQueryTime) > 5*time.Minute {
+		ttl := DefaultTTL
+		if record.blacklisted {
+			ttl = c.NegativeTTL
+		}
+		if time.Since(record.lastQuery) > ttl {
 			c.mu.RUnlock()
-			c.cacheHost(network, addr)
-			c.mu.RLock()
-			entry, _ = c.cache.Get(mapEntryName)
-			record = entry.(hostrecord)
+			return c.cacheHost(network, addr)
 		}
 		resolvedAddr := record.ipaddr
 		if record.blacklisted {
@@ -83,11 +155,15 @@ func (c *dnsCache) cachingDial(network, addr string) (net.Conn, error) {
 }
 
 // cacheHost caches the DNS lookup for this host, overwriting any entry
-// that may have previously existed.
+// that may have previously existed. Dial errors other than DNS failures
+// leave the cache as it was.
 func (c *dnsCache) cacheHost(network, addr string) (net.Conn, error) {
 	mapEntryName := network + addr
 	newConn, err := c.wrappedDial(network, addr)
 	queryTime := time.Now()
+	if err != nil && !IsDNSError(err) {
+		return nil, err
+	}
 	c.mu.Lock()
 	if err != nil {
 		c.cache.Add(mapEntryName, hostrecord{
@@ -113,7 +189,7 @@ func (c *dnsCache) cacheHost(network, addr string) (net.Conn, error) {
 
 // get returns the hostrecord associated with the passed network:address, if it exists.
 // The second return value represents whether the record exists.
-func (c *dnsCache) get(network, addr string) (hostrecord, bool) {
+func (c *Cache) get(network, addr string) (hostrecord, bool) {
 	key := network + addr
 	c.mu.RLock()
 	valinterface, ok := c.cache.Get(key)
@@ -1,7 +1,9 @@
 package dnscache
 
 import (
+	"fmt"
 	"net"
+	"net/url"
 	"testing"
 	"time"
 
@@ -116,3 +118,100 @@ func TestHostPushedOutOfCache(t *testing.T) {
 	cdial("tcp", "host3.com")
 	cdial("tcp", "host1.com")
 }
+
+func TestCacheSeed(t *testing.T) {
+	addr := &MockAddr{}
+	addr.On("String").Return("1.2.3.4:80")
+
+	conn := &MockConn{}
+	conn.On("RemoteAddr").Return(addr)
+
+	dialer := &MockDialer{}
+	dialer.On("Dial", "tcp", "5.6.7.8:80").Return(conn, nil).Once()
+	dialer.On("Dial", "tcp", "other.com:80").Return(conn, nil).Once()
+
+	c, err := New(10)
+	if err != nil {
+		panic(err)
+	}
+	c.Seed("tcp", "seeded.com:80", "5.6.7.8:80")
+	cdial := c.Dial(dialer.Dial)
+	cdial("tcp", "seeded.com:80")
+	cdial("tcp", "other.com:80")
+	dialer.AssertExpectations(t)
+
+	if ip, ok := c.Addr("tcp", "other.com:80"); !ok || ip != "1.2.3.4:80" {
+		t.Errorf("Expected other.com to be cached as 1.2.3.4:80, got %q (%v)", ip, ok)
+	}
+
+	// Seeding doesn't replace a cached resolution
+	c.Seed("tcp", "other.com:80", "9.9.9.9:80")
+	if ip, _ := c.Addr("tcp", "other.com:80"); ip != "1.2.3.4:80" {
+		t.Errorf("Expected Seed to leave other.com cached as 1.2.3.4:80, got %q", ip)
+	}
+	if _, ok := c.Addr("tcp", "missing.com:80"); ok {
+		t.Errorf("Expected no cached address for missing.com")
+	}
+}
+
+func TestFailuresCached(t *testing.T) {
+	dnsErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "dead.com"}}
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	dials := map[string]int{}
+	dialer := func(network, addr string) (net.Conn, error) {
+		dials[addr]++
+		if addr == "dead.com:80" {
+			return nil, dnsErr
+		}
+		return nil, refused
+	}
+
+	c, err := New(10)
+	if err != nil {
+		panic(err)
+	}
+	cdial := c.Dial(dialer)
+
+	// DNS failures are cached until NegativeTTL is up
+	for i := 0; i < 3; i++ {
+		if _, err := cdial("tcp", "dead.com:80"); err != dnsErr {
+			t.Errorf("Expected the DNS error dialing dead.com, got %v", err)
+		}
+	}
+	if dials["dead.com:80"] != 1 {
+		t.Errorf("Expected dead.com to be looked up once, got %d", dials["dead.com:80"])
+	}
+	c.NegativeTTL = 0
+	cdial("tcp", "dead.com:80")
+	if dials["dead.com:80"] != 2 {
+		t.Errorf("Expected dead.com to be looked up again once its failure expired, got %d lookups",
+			dials["dead.com:80"])
+	}
+
+	// Other dial errors aren't
+	cdial("tcp", "refused.com:80")
+	cdial("tcp", "refused.com:80")
+	if dials["refused.com:80"] != 2 {
+		t.Errorf("Expected refused.com to be dialed every time, got %d dials", dials["refused.com:80"])
+	}
+}
+
+func TestIsDNSError(t *testing.T) {
+	dnsErr := &net.DNSError{Err: "no such host", Name: "dead.com"}
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{dnsErr, true},
+		{&net.OpError{Op: "dial", Err: dnsErr}, true},
+		{&url.Error{Op: "Get", URL: "http://dead.com/", Err: &net.OpError{Op: "dial", Err: dnsErr}}, true},
+		{&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, false},
+		{fmt.Errorf("other"), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := IsDNSError(test.err); got != test.expected {
+			t.Errorf("IsDNSError(%v) got %v, expected %v", test.err, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package dnscache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DNS response codes and record types of the DoH JSON API
+const (
+	dohNoError  = 0
+	dohNXDomain = 3
+	dohTypeA    = 1
+	dohTypeAAAA = 28
+)
+
+// maxDoHResponseBytes caps the answers read from a resolver
+const maxDoHResponseBytes = 64 * 1024
+
+// DoHResolver resolves host names with DNS-over-HTTPS, for networks whose own
+// DNS is unreliable or filtered. The resolver at URL must speak the JSON API
+// (application/dns-json) served by Google (https://dns.google/resolve) and
+// Cloudflare (https://cloudflare-dns.com/dns-query), among others.
+type DoHResolver struct {
+	// The resolver's URL; the name and type are added as query parameters
+	URL string
+
+	// The client lookups are made with (http.DefaultClient if nil). It
+	// shouldn't dial through a DoHResolver itself.
+	Client *http.Client
+
+	// If set, a host the resolver fails to answer for (as opposed to one it
+	// answers doesn't exist) is dialed by name, resolving it with the system's
+	// DNS
+	Fallback bool
+
+	// If set, called after each lookup with how long it took and its error:
+	// nil if the host resolved, a *net.DNSError (see IsDNSError) if the
+	// resolver answered it doesn't, and anything else if the resolver failed
+	Observe func(took time.Duration, err error)
+}
+
+// dohResponse is the part of a DoH JSON API answer looked at
+type dohResponse struct {
+	Status int `json:"Status"`
+	Answer []struct {
+		Type int    `json:"type"`
+		Data string `json:"data"`
+	} `json:"Answer"`
+}
+
+// Lookup returns the IPv4 addresses of host, or its IPv6 ones if it has none.
+// A host the resolver answers doesn't exist, or has no address, is a
+// *net.DNSError.
+func (r *DoHResolver) Lookup(host string) ([]string, error) {
+	start := time.Now()
+	addrs, err := r.lookup(host, dohTypeA)
+	if err == nil && len(addrs) == 0 {
+		addrs, err = r.lookup(host, dohTypeAAAA)
+	}
+	if err == nil && len(addrs) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, Server: r.URL}
+	}
+	if r.Observe != nil {
+		r.Observe(time.Since(start), err)
+	}
+	return addrs, err
+}
+
+// lookup asks the resolver for the records of type rtype of host
+func (r *DoHResolver) lookup(host string, rtype int) ([]string, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("Bad DoH resolver URL %v: %v", r.URL, err)
+	}
+	q := u.Query()
+	q.Set("name", host)
+	q.Set("type", fmt.Sprint(rtype))
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create DoH request for %v: %v", host, err)
+	}
+	req.Header.Set("Accept", "application/dns-json")
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH lookup of %v failed: %v", host, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH lookup of %v failed: resolver answered %v", host, res.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxDoHResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("DoH lookup of %v failed: %v", host, err)
+	}
+	var ans dohResponse
+	if err := json.Unmarshal(body, &ans); err != nil {
+		return nil, fmt.Errorf("DoH lookup of %v failed to decode: %v", host, err)
+	}
+
+	switch ans.Status {
+	case dohNoError:
+	case dohNXDomain:
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.URL}
+	default:
+		return nil, fmt.Errorf("DoH lookup of %v failed: response code %v", host, ans.Status)
+	}
+	var addrs []string
+	for _, a := range ans.Answer {
+		// The answer may hold CNAMEs leading to the addresses
+		if a.Type == rtype && net.ParseIP(a.Data) != nil {
+			addrs = append(addrs, a.Data)
+		}
+	}
+	return addrs, nil
+}
+
+// Dial wraps the given dial function to resolve host names with r, dialing
+// the addresses found in turn until one connects. Addresses that are already
+// IPs are dialed as they are. If wrappedDial is nil, net.Dial is used.
+func (r *DoHResolver) Dial(wrappedDial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if wrappedDial == nil {
+		wrappedDial = net.Dial
+	}
+	return func(network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return wrappedDial(network, addr)
+		}
+		ips, err := r.Lookup(host)
+		if err != nil {
+			if r.Fallback && !IsDNSError(err) {
+				return wrappedDial(network, addr)
+			}
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		var conn net.Conn
+		for _, ip := range ips {
+			conn, err = wrappedDial(network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
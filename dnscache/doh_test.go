@@ -0,0 +1,104 @@
+package dnscache
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dohServer answers DoH JSON API lookups: a.com has an IPv4 address, six.com
+// only an IPv6 one, nothing.com doesn't exist, and anything else is a server
+// failure
+func dohServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Accept") != "application/dns-json" {
+			t.Errorf("Expected a DoH JSON API request, got Accept %q", req.Header.Get("Accept"))
+		}
+		name, rtype := req.URL.Query().Get("name"), req.URL.Query().Get("type")
+		switch {
+		case name == "a.com" && rtype == "1":
+			fmt.Fprint(w, `{"Status": 0, "Answer": [
+				{"name": "a.com.", "type": 5, "data": "cdn.a.com."},
+				{"name": "cdn.a.com.", "type": 1, "data": "10.0.0.1"},
+				{"name": "cdn.a.com.", "type": 1, "data": "10.0.0.2"}]}`)
+		case name == "six.com" && rtype == "28":
+			fmt.Fprint(w, `{"Status": 0, "Answer": [{"name": "six.com.", "type": 28, "data": "2001:db8::1"}]}`)
+		case name == "a.com" || name == "six.com":
+			fmt.Fprint(w, `{"Status": 0}`)
+		case name == "nothing.com":
+			fmt.Fprint(w, `{"Status": 3}`)
+		default:
+			http.Error(w, "resolver down", http.StatusBadGateway)
+		}
+	}))
+}
+
+func TestDoHLookup(t *testing.T) {
+	srv := dohServer(t)
+	defer srv.Close()
+
+	var observed []error
+	r := &DoHResolver{URL: srv.URL + "/resolve", Observe: func(took time.Duration, err error) {
+		observed = append(observed, err)
+	}}
+
+	addrs, err := r.Lookup("a.com")
+	if err != nil || fmt.Sprint(addrs) != "[10.0.0.1 10.0.0.2]" {
+		t.Errorf("Expected a.com to resolve to [10.0.0.1 10.0.0.2], got %v (%v)", addrs, err)
+	}
+	addrs, err = r.Lookup("six.com")
+	if err != nil || fmt.Sprint(addrs) != "[2001:db8::1]" {
+		t.Errorf("Expected six.com to resolve to [2001:db8::1], got %v (%v)", addrs, err)
+	}
+	if _, err := r.Lookup("nothing.com"); !IsDNSError(err) {
+		t.Errorf("Expected a DNS error for nothing.com, got %v", err)
+	}
+	if _, err := r.Lookup("broken.com"); err == nil || IsDNSError(err) {
+		t.Errorf("Expected a resolver failure for broken.com, got %v", err)
+	}
+	if len(observed) != 4 || observed[0] != nil || !IsDNSError(observed[2]) || observed[3] == nil {
+		t.Errorf("Expected each lookup observed with its error, got %v", observed)
+	}
+}
+
+func TestDoHDial(t *testing.T) {
+	srv := dohServer(t)
+	defer srv.Close()
+
+	var dialed []string
+	dial := func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == "10.0.0.1:80" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		return &net.TCPConn{}, nil
+	}
+
+	tests := []struct {
+		addr     string
+		fallback bool
+		dialed   string
+		dnsError bool
+	}{
+		{"a.com:80", false, "[10.0.0.1:80 10.0.0.2:80]", false},
+		{"10.1.1.1:80", false, "[10.1.1.1:80]", false},
+		{"nothing.com:80", true, "[]", true},
+		{"broken.com:80", true, "[broken.com:80]", false},
+		{"broken.com:80", false, "[]", false},
+	}
+	for _, test := range tests {
+		dialed = []string{}
+		r := &DoHResolver{URL: srv.URL, Fallback: test.fallback}
+		_, err := r.Dial(dial)("tcp", test.addr)
+		if fmt.Sprint(dialed) != test.dialed {
+			t.Errorf("Dialing %v (fallback %v): expected to dial %v, dialed %v", test.addr, test.fallback,
+				test.dialed, dialed)
+		}
+		if IsDNSError(err) != test.dnsError {
+			t.Errorf("Dialing %v (fallback %v): unexpected error %v", test.addr, test.fallback, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package walker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"code.google.com/p/go.net/publicsuffix"
+	"code.google.com/p/log4go"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// tldPlusOne is a cached result of TLDPlusOne
+type tldPlusOne struct {
+	dom string
+	err error
+}
+
+// domainCache memoizes TLDPlusOne by host. It is rebuilt when
+// domains.private_suffixes or domains.cache_size change, so cached results
+// always follow the config.
+var domainCache struct {
+	sync.Mutex
+	cache    *lru.Cache
+	suffixes []string
+	size     int
+
+	hits, misses int64
+}
+
+// TLDPlusOne returns the effective top level domain of host as defined by
+// https://publicsuffix.org/ plus one extra domain component, ex. 'bbc.co.uk'
+// for www.bbc.co.uk. The suffixes of domains.private_suffixes are treated like
+// public ones, so with "internal.corp" among them, team.internal.corp and
+// hr.internal.corp are two domains rather than subdomains of internal.corp.
+//
+// Results are cached (see domains.cache_size), as this is computed for every
+// link walker handles.
+func TLDPlusOne(host string) (string, error) {
+	cache := currentDomainCache()
+	if cache == nil {
+		return computeTLDPlusOne(host)
+	}
+	if c, ok := cache.Get(host); ok {
+		atomic.AddInt64(&domainCache.hits, 1)
+		return c.(*tldPlusOne).dom, c.(*tldPlusOne).err
+	}
+	atomic.AddInt64(&domainCache.misses, 1)
+	dom, err := computeTLDPlusOne(host)
+	cache.Add(host, &tldPlusOne{dom: dom, err: err})
+	return dom, err
+}
+
+// DomainCacheStats returns how many TLDPlusOne calls were answered from its
+// cache, and how many weren't, since the process started
+func DomainCacheStats() (hits, misses int64) {
+	return atomic.LoadInt64(&domainCache.hits), atomic.LoadInt64(&domainCache.misses)
+}
+
+// currentDomainCache returns the cache of TLDPlusOne for the current config,
+// or nil if domains.cache_size is 0
+func currentDomainCache() *lru.Cache {
+	dc := &domainCache
+	dc.Lock()
+	defer dc.Unlock()
+
+	suffixes := Config.Domains.PrivateSuffixes
+	size := Config.Domains.CacheSize
+	if dc.size == size && sameStrings(dc.suffixes, suffixes) {
+		return dc.cache
+	}
+
+	dc.cache = nil
+	if size > 0 {
+		var err error
+		dc.cache, err = lru.New(size)
+		if err != nil {
+			log4go.Error("Failed to create the domain cache: %v", err)
+		}
+	}
+	dc.suffixes = append([]string(nil), suffixes...)
+	dc.size = size
+	return dc.cache
+}
+
+// computeTLDPlusOne is TLDPlusOne without the cache
+func computeTLDPlusOne(host string) (string, error) {
+	lower := strings.ToLower(host)
+	private := ""
+	for _, s := range Config.Domains.PrivateSuffixes {
+		if (lower == s || strings.HasSuffix(lower, "."+s)) && len(s) > len(private) {
+			private = s
+		}
+	}
+	if private == "" {
+		return publicsuffix.EffectiveTLDPlusOne(host)
+	}
+	if public, _ := publicsuffix.PublicSuffix(host); len(public) >= len(private) {
+		return publicsuffix.EffectiveTLDPlusOne(host)
+	}
+
+	if lower == private {
+		return "", fmt.Errorf("Cannot derive TLD+1 for %v: it is a private suffix", host)
+	}
+	rest := strings.TrimSuffix(lower, "."+private)
+	if i := strings.LastIndex(rest, "."); i >= 0 {
+		rest = rest[i+1:]
+	}
+	if rest == "" {
+		return "", fmt.Errorf("Cannot derive TLD+1 for %v: empty label", host)
+	}
+	return rest + "." + private, nil
+}
+
+// sameStrings returns true if a and b hold the same strings in the same order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
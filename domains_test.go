@@ -0,0 +1,62 @@
+package walker
+
+import "testing"
+
+func TestTLDPlusOne(t *testing.T) {
+	orig := Config.Domains.PrivateSuffixes
+	defer func() { Config.Domains.PrivateSuffixes = orig }()
+
+	tests := []struct {
+		host, dom, subdom string
+	}{
+		{"www.bbc.co.uk", "bbc.co.uk", "www"},
+		{"docs.team.internal.corp", "internal.corp", "docs.team"},
+		{"internal.corp", "internal.corp", ""},
+	}
+	check := func(private []string) {
+		for _, test := range tests {
+			u := MustParse("http://" + test.host + "/")
+			dom, subdom, err := u.TLDPlusOneAndSubdomain()
+			if err != nil || dom != test.dom || subdom != test.subdom {
+				t.Errorf("With private suffixes %v, expected %v to be subdomain %q of %v, got %q of %v (%v)",
+					private, test.host, test.subdom, test.dom, subdom, dom, err)
+			}
+		}
+	}
+
+	Config.Domains.PrivateSuffixes = nil
+	check(nil)
+
+	// Changing the suffixes must not serve results cached before
+	Config.Domains.PrivateSuffixes = []string{"corp", "internal.corp", "uk"}
+	tests[1] = struct{ host, dom, subdom string }{"docs.team.internal.corp", "team.internal.corp", "docs"}
+	tests[2] = struct{ host, dom, subdom string }{"team.internal.corp", "team.internal.corp", ""}
+	check(Config.Domains.PrivateSuffixes)
+
+	if _, err := TLDPlusOne("internal.corp"); err == nil {
+		t.Errorf("Expected no TLD+1 for the private suffix internal.corp itself")
+	}
+}
+
+func TestTLDPlusOneCache(t *testing.T) {
+	orig := Config.Domains.CacheSize
+	defer func() { Config.Domains.CacheSize = orig }()
+
+	Config.Domains.CacheSize = 10
+	TLDPlusOne("a.cache-test.com")
+	hits, misses := DomainCacheStats()
+	TLDPlusOne("a.cache-test.com")
+	TLDPlusOne("b.cache-test.com")
+	if h, m := DomainCacheStats(); h != hits+1 || m != misses+1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %v hits and %v misses", h-hits, m-misses)
+	}
+
+	Config.Domains.CacheSize = 0
+	hits, misses = DomainCacheStats()
+	if dom, err := TLDPlusOne("a.cache-test.com"); err != nil || dom != "cache-test.com" {
+		t.Errorf("Expected cache-test.com without the cache, got %v (%v)", dom, err)
+	}
+	if h, m := DomainCacheStats(); h != hits || m != misses {
+		t.Errorf("Expected the cache unused with domains.cache_size 0")
+	}
+}
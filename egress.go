@@ -0,0 +1,92 @@
+package walker
+
+import (
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Outbound connections can be made from chosen local addresses (see
+// fetcher.source_addresses), for crawl boxes with several interfaces or to
+// spread load over addresses that targets rate limit separately. With the
+// per_fetcher policy each fetcher binds all its connections to one address;
+// with rotate every new connection takes the next address in turn.
+
+// parseSourceAddrs parses fetcher.source_addresses, skipping any that don't
+// parse (they are rejected when the config is loaded)
+func parseSourceAddrs(addrs []string) []net.IP {
+	var ips []net.IP
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// sourceDial returns a Dial function making connections from the local
+// address pick returns, or the one the OS chooses if it returns nil. The
+// remote address is picked from those of the local address's family.
+func sourceDial(timeout, keepAlive time.Duration, pick func() net.IP) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		d := &net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: keepAlive,
+		}
+		if ip := pick(); ip != nil {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+		return d.Dial(network, addr)
+	}
+}
+
+// rotateSourceAddr returns the next of fm.sourceAddrs in turn, or nil if
+// there are none or each fetcher is bound to its own
+func (fm *FetchManager) rotateSourceAddr() net.IP {
+	if len(fm.sourceAddrs) == 0 || Config.Fetcher.SourceAddressPolicy != "rotate" {
+		return nil
+	}
+	n := atomic.AddUint32(&fm.nextSourceAddr, 1) - 1
+	return fm.sourceAddrs[n%uint32(len(fm.sourceAddrs))]
+}
+
+// newTransport creates the http.Transport the FetchManager uses when none is
+// given, dialing with pick (see sourceDial) and sending requests through the
+// configured proxies (see proxy.go)
+func (fm *FetchManager) newTransport(timeout, keepAlive time.Duration, pick func() net.IP) *http.Transport {
+	proxy := http.ProxyFromEnvironment
+	if fm.proxies != nil {
+		proxy = fm.proxies.proxy
+	}
+	return &http.Transport{
+		Proxy:                  proxy,
+		Dial:                   sourceDial(timeout, keepAlive, pick),
+		TLSHandshakeTimeout:    10 * time.Second,
+		MaxResponseHeaderBytes: Config.Fetcher.MaxResponseHeaderBytes,
+	}
+}
+
+// bindFetcher gives fetcher number i its own transports bound to one of
+// fm.sourceAddrs, if the per_fetcher policy is in effect. It only applies to
+// transports the FetchManager created itself.
+func (fm *FetchManager) bindFetcher(f *fetcher, i int, timeout time.Duration) {
+	if len(fm.sourceAddrs) == 0 || Config.Fetcher.SourceAddressPolicy != "per_fetcher" || !fm.ownTransports {
+		return
+	}
+	ip := fm.sourceAddrs[i%len(fm.sourceAddrs)]
+	pick := func() net.IP { return ip }
+
+	t := fm.newTransport(timeout, fm.keepAlive, pick)
+	t.Dial = fm.pinnedDial(fm.cachingDial(t.Dial))
+	f.transport = t
+	if fm.TransNoKeepAlive != nil {
+		t = fm.newTransport(timeout, 0, pick)
+		t.Dial = fm.pinnedDial(fm.cachingDial(t.Dial))
+		f.transNoKeepAlive = t
+	}
+	f.httpclient.Transport = f.transport
+	if f.redirectorClient != nil {
+		f.redirectorClient.Transport = f.transport
+	}
+}
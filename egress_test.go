@@ -0,0 +1,64 @@
+package walker
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRotateSourceAddr(t *testing.T) {
+	orig := Config.Fetcher.SourceAddressPolicy
+	defer func() { Config.Fetcher.SourceAddressPolicy = orig }()
+
+	fm := &FetchManager{sourceAddrs: parseSourceAddrs([]string{"10.0.0.1", "bogus", "10.0.0.2"})}
+	if len(fm.sourceAddrs) != 2 {
+		t.Fatalf("Expected 2 source addresses, got %v", fm.sourceAddrs)
+	}
+
+	Config.Fetcher.SourceAddressPolicy = "per_fetcher"
+	if ip := fm.rotateSourceAddr(); ip != nil {
+		t.Errorf("Expected no rotation with per_fetcher policy, got %v", ip)
+	}
+
+	Config.Fetcher.SourceAddressPolicy = "rotate"
+	expected := []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2"}
+	for i, exp := range expected {
+		if ip := fm.rotateSourceAddr(); ip.String() != exp {
+			t.Errorf("Rotation %d: expected %v, got %v", i, exp, ip)
+		}
+	}
+}
+
+func TestSourceDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	dial := sourceDial(time.Second, 0, func() net.IP { return net.ParseIP("127.0.0.1") })
+	conn, err := dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if ip := conn.LocalAddr().(*net.TCPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Expected connection from 127.0.0.1, got %v", ip)
+	}
+
+	// A source address that isn't on this machine can't be bound
+	dial = sourceDial(time.Second, 0, func() net.IP { return net.ParseIP("192.0.2.1") })
+	if conn, err := dial("tcp", ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Expected dialing from 192.0.2.1 to fail")
+	}
+}
@@ -0,0 +1,225 @@
+package walker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Crawl runs a small crawl inside the calling program, without a datastore,
+// dispatcher or handler to set up:
+//
+//	results, err := walker.Crawl([]string{"http://example.com/"}, walker.CrawlOptions{MaxPages: 100})
+//	if err != nil {
+//		...
+//	}
+//	for fr := range results {
+//		fmt.Println(fr.URL, fr.Response.StatusCode)
+//	}
+//
+// Links are kept in a MemoryDatastore, so each is fetched once and nothing
+// outlives the crawl. The crawl is as polite as any other: it follows
+// robots.txt and crawl delays, and is otherwise configured by Config as usual
+// (the number of fetchers is fetcher.num_simultaneous_fetchers, for example).
+
+// CrawlOptions limits a crawl run by Crawl; the zero value crawls every page
+// of the seeds' domains that can be reached from the seeds
+type CrawlOptions struct {
+	// Follow links to other domains than the seeds'
+	FollowExternal bool
+
+	// Stop after this many fetch results (0 for no limit)
+	MaxPages int
+
+	// Don't follow links more than this many links away from a seed (0 for
+	// no limit)
+	MaxDepth int
+
+	// The http.RoundTripper to fetch with, instead of the one created from
+	// the fetcher config
+	Transport http.RoundTripper
+
+	// Closing Done stops the crawl early; results not yet received are
+	// dropped
+	Done <-chan struct{}
+}
+
+// crawlClaimPoll is how often an idle fetcher of a Crawl checks whether the
+// fetchers still crawling have found more work
+const crawlClaimPoll = 100 * time.Millisecond
+
+// Crawl crawls from seeds, sending the results of each fetch on the returned
+// channel, which is closed when the crawl is over. Results are sent whether or
+// not the fetch succeeded (see FetchResults.FetchError), and each one's Body
+// holds the page fetched, which Response.Body can also be read from. The
+// channel must be read until it is closed, or Done closed, for the crawl to
+// make progress.
+func Crawl(seeds []string, opts CrawlOptions) (<-chan FetchResults, error) {
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("Crawl given no seeds")
+	}
+	if opts.MaxPages < 0 || opts.MaxDepth < 0 {
+		return nil, fmt.Errorf("Crawl limits must not be negative (max pages %v, max depth %v)",
+			opts.MaxPages, opts.MaxDepth)
+	}
+
+	ds := newCrawlDatastore(opts)
+	var links []*URL
+	for _, seed := range seeds {
+		u, err := ParseAndNormalizeURL(seed)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse seed %q: %v", seed, err)
+		}
+		dom, err := u.ToplevelDomainPlusOne()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get domain of seed %q: %v", seed, err)
+		}
+		ds.domains[dom] = true
+		links = append(links, u)
+	}
+	for _, u := range links {
+		ds.StoreParsedURL(u, nil)
+	}
+
+	fmOpts := []Option{WithDatastore(ds), WithHandler(crawlHandler{})}
+	if opts.Transport != nil {
+		fmOpts = append(fmOpts, WithTransport(opts.Transport))
+	}
+	fm, err := NewFetchManager(fmOpts...)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		fm.oneShotRun()
+		close(ds.results)
+	}()
+	return ds.results, nil
+}
+
+// crawlHandler is the handler of a Crawl, which hands results over in
+// crawlDatastore.StoreURLFetchResults instead
+type crawlHandler struct{}
+
+func (crawlHandler) HandleResponse(fr *FetchResults) {}
+
+// crawlDatastore is the datastore of a Crawl: a MemoryDatastore that keeps to
+// the crawl's limits and sends the fetch results it is given to the caller
+type crawlDatastore struct {
+	*MemoryDatastore
+	opts    CrawlOptions
+	results chan FetchResults
+
+	// The seeds' domains, set before the crawl starts
+	domains map[string]bool
+
+	mu sync.Mutex
+
+	// How many links away from a seed each link stored is
+	depths map[string]int
+
+	// The number of results sent
+	sent int
+}
+
+func newCrawlDatastore(opts CrawlOptions) *crawlDatastore {
+	return &crawlDatastore{
+		MemoryDatastore: NewMemoryDatastore(),
+		opts:            opts,
+		results:         make(chan FetchResults, Config.Fetcher.NumSimultaneousFetchers),
+		domains:         map[string]bool{},
+		depths:          map[string]int{},
+	}
+}
+
+// finished returns true once the crawl has been stopped or has sent
+// opts.MaxPages results
+func (ds *crawlDatastore) finished() bool {
+	select {
+	case <-ds.opts.Done:
+		return true
+	default:
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.opts.MaxPages > 0 && ds.sent >= ds.opts.MaxPages
+}
+
+// ClaimNewHost implements Datastore. With nothing to claim it waits while
+// other fetchers are crawling, since they may yet find links to claim; it
+// returns "" once none are, ending the crawl.
+func (ds *crawlDatastore) ClaimNewHost() string {
+	for !ds.finished() {
+		if host := ds.MemoryDatastore.ClaimNewHost(); host != "" {
+			return host
+		}
+		ds.MemoryDatastore.mu.Lock()
+		crawling := len(ds.MemoryDatastore.claimed) > 0
+		ds.MemoryDatastore.mu.Unlock()
+		if !crawling {
+			break
+		}
+		time.Sleep(crawlClaimPoll)
+	}
+	return ""
+}
+
+// StoreParsedURL implements Datastore, dropping links outside the crawl
+func (ds *crawlDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
+	dom, err := u.ToplevelDomainPlusOne()
+	if err != nil || !ds.opts.FollowExternal && !ds.domains[dom] {
+		return
+	}
+	ds.mu.Lock()
+	depth := 0
+	if fr != nil {
+		depth = ds.depths[fr.URL.String()] + 1
+	}
+	if ds.opts.MaxDepth > 0 && depth > ds.opts.MaxDepth {
+		ds.mu.Unlock()
+		return
+	}
+	link := u.String()
+	if _, ok := ds.depths[link]; !ok {
+		ds.depths[link] = depth
+	}
+	ds.mu.Unlock()
+	ds.MemoryDatastore.StoreParsedURL(u, fr)
+}
+
+// StoreURLFetchResults implements Datastore, sending a copy of fr to the
+// caller. The copy gets its own body, since the fetcher reuses the buffer
+// fr.Response.Body reads from.
+func (ds *crawlDatastore) StoreURLFetchResults(fr *FetchResults) {
+	ds.mu.Lock()
+	if ds.opts.MaxPages > 0 && ds.sent >= ds.opts.MaxPages {
+		ds.mu.Unlock()
+		return
+	}
+	ds.sent++
+	ds.mu.Unlock()
+
+	res := *fr
+	if fr.Response != nil {
+		resp := *fr.Response
+		if res.Body == "" && resp.Body != nil {
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, Config.Fetcher.MaxHTTPContentSizeBytes))
+			res.Body = string(body)
+		}
+		resp.Body = ioutil.NopCloser(strings.NewReader(res.Body))
+		res.Response = &resp
+	}
+	select {
+	case ds.results <- res:
+	case <-ds.opts.Done:
+	}
+}
+
+// HostQuotaExceeded implements Datastore, stopping the fetchers once the
+// crawl is finished
+func (ds *crawlDatastore) HostQuotaExceeded(host string) bool {
+	return ds.finished()
+}
@@ -0,0 +1,78 @@
+package walker
+
+import (
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCrawl(t *testing.T) {
+	LoadTestConfig("test-walker.yaml")
+	defer LoadTestConfig("test-walker.yaml")
+	Config.Fetcher.NumSimultaneousFetchers = 2
+
+	page := func(links ...string) *http.Response {
+		res := response200()
+		body := "<html><body>"
+		for _, l := range links {
+			body += `<a href="` + l + `">link</a>`
+		}
+		res.Body = ioutil.NopCloser(strings.NewReader(body + "</body></html>"))
+		return res
+	}
+	// Responses can only be read once, so each crawl gets its own
+	transport := func() http.RoundTripper {
+		return &mapRoundTrip{Responses: map[string]*http.Response{
+			"http://a.com/":       page("/b.html", "http://other.com/"),
+			"http://a.com/b.html": page("/c.html"),
+			"http://a.com/c.html": page("/"),
+			"http://other.com/":   page(),
+		}}
+	}
+
+	tests := []struct {
+		tag     string
+		opts    CrawlOptions
+		fetched []string
+	}{
+		{"default", CrawlOptions{},
+			[]string{"http://a.com/", "http://a.com/b.html", "http://a.com/c.html"}},
+		{"follow external", CrawlOptions{FollowExternal: true},
+			[]string{"http://a.com/", "http://a.com/b.html", "http://a.com/c.html", "http://other.com/"}},
+		{"max depth", CrawlOptions{MaxDepth: 1},
+			[]string{"http://a.com/", "http://a.com/b.html"}},
+		{"max pages", CrawlOptions{MaxPages: 1},
+			[]string{"http://a.com/"}},
+	}
+	for _, test := range tests {
+		test.opts.Transport = transport()
+		results, err := Crawl([]string{"http://a.com/"}, test.opts)
+		if err != nil {
+			t.Errorf("%v: Crawl failed: %v", test.tag, err)
+			continue
+		}
+		var fetched []string
+		for fr := range results {
+			fetched = append(fetched, fr.URL.String())
+			if fr.FetchError != nil || fr.Response == nil || fr.Response.StatusCode != 200 {
+				t.Errorf("%v: expected %v to be fetched, got error %v", test.tag, fr.URL, fr.FetchError)
+				continue
+			}
+			body, _ := ioutil.ReadAll(fr.Response.Body)
+			if !strings.HasPrefix(fr.Body, "<html>") || string(body) != fr.Body {
+				t.Errorf("%v: expected the body of %v in the results, got %q and %q",
+					test.tag, fr.URL, fr.Body, body)
+			}
+		}
+		sort.Strings(fetched)
+		if strings.Join(fetched, " ") != strings.Join(test.fetched, " ") {
+			t.Errorf("%v: expected %v fetched, got %v", test.tag, test.fetched, fetched)
+		}
+	}
+
+	if _, err := Crawl(nil, CrawlOptions{}); err == nil {
+		t.Error("Expected an error from Crawl without seeds")
+	}
+}
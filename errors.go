@@ -0,0 +1,84 @@
+package walker
+
+import (
+	"errors"
+)
+
+// Errors returned by Datastore and Dispatcher implementations (and the
+// cassandra package's ModelDatastore) for failures callers may want to
+// handle, rather than report. They are usually wrapped in an *Error giving the
+// details; use IsError (or errors.Is) to check for them rather than comparing
+// error strings.
+var (
+	// Something looked up, like a link or domain, doesn't exist
+	ErrNotFound = errors.New("not found")
+
+	// The domain is claimed by a running fetcher, so can't be changed the way
+	// asked
+	ErrAlreadyClaimed = errors.New("domain is already claimed")
+
+	// The domain is excluded from the crawl, so the request would have no
+	// effect
+	ErrExcluded = errors.New("domain is excluded")
+
+	// The domain has used up its download quota for the day
+	ErrQuotaExceeded = errors.New("domain download quota exceeded")
+
+	// The datastore couldn't be reached (ex. no Cassandra hosts could be
+	// connected to); the call may succeed if retried later
+	ErrDatastoreUnavailable = errors.New("datastore unavailable")
+)
+
+// Error is an error of one of the kinds above, with the error describing it
+type Error struct {
+	// One of the Err* values above
+	Kind error
+
+	// The error describing what happened, or nil if Kind says it all
+	Err error
+}
+
+// NewError returns an *Error of the given kind wrapping err
+func NewError(kind error, err error) error {
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Kind.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns the wrapped error, for errors.Is and errors.As
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is e's Kind, for errors.Is
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// ErrorKind returns the kind of err: err itself if it is one of the Err*
+// values, the Kind of an *Error, or nil otherwise
+func ErrorKind(err error) error {
+	switch e := err.(type) {
+	case *Error:
+		return e.Kind
+	case nil:
+		return nil
+	}
+	for _, kind := range []error{ErrNotFound, ErrAlreadyClaimed, ErrExcluded, ErrQuotaExceeded,
+		ErrDatastoreUnavailable} {
+		if err == kind {
+			return kind
+		}
+	}
+	return nil
+}
+
+// IsError returns true if err is of the given kind (one of the Err* values)
+func IsError(err, kind error) bool {
+	return err != nil && ErrorKind(err) == kind
+}
@@ -0,0 +1,46 @@
+package walker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorKinds(t *testing.T) {
+	wrapped := NewError(ErrNotFound, fmt.Errorf("http://test.com/ # link not found"))
+	if wrapped.Error() != "http://test.com/ # link not found" {
+		t.Errorf("Expected the wrapped error's message, got %q", wrapped.Error())
+	}
+	if got := NewError(ErrExcluded, nil).Error(); got != ErrExcluded.Error() {
+		t.Errorf("Expected the kind's message for an empty error, got %q", got)
+	}
+
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{wrapped, ErrNotFound},
+		{ErrQuotaExceeded, ErrQuotaExceeded},
+		{NewError(ErrDatastoreUnavailable, fmt.Errorf("no hosts")), ErrDatastoreUnavailable},
+		{fmt.Errorf("not found"), nil},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		if kind := ErrorKind(test.err); kind != test.kind {
+			t.Errorf("Expected kind %v for %v, got %v", test.kind, test.err, kind)
+		}
+		if test.kind != nil {
+			if !IsError(test.err, test.kind) || !errors.Is(test.err, test.kind) {
+				t.Errorf("Expected %v to be a %v", test.err, test.kind)
+			}
+			if IsError(test.err, ErrAlreadyClaimed) || errors.Is(test.err, ErrAlreadyClaimed) {
+				t.Errorf("Expected %v not to be a %v", test.err, ErrAlreadyClaimed)
+			}
+		}
+	}
+
+	cause := fmt.Errorf("connection refused")
+	if !errors.Is(NewError(ErrDatastoreUnavailable, cause), cause) {
+		t.Errorf("Expected errors.Is to find the wrapped cause")
+	}
+}
@@ -0,0 +1,141 @@
+package walker
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Checking a link's Content-Type takes a request, so binaries linked to by
+// name (archives, installers, disk images) are better kept out of the crawl
+// by their file extension: fetcher.deny_extensions. Links with a denied
+// extension aren't stored when parsed, and links already stored aren't
+// fetched. fetcher.extension_overrides adjusts the list for a host and its
+// subdomains.
+
+// ExtensionOverride changes which extensions are denied on one host
+type ExtensionOverride struct {
+	// The host, ex. "example.com". Its subdomains (ex. "www.example.com") get
+	// the override too, unless they have one of their own.
+	Host string `yaml:"host"`
+
+	// Extensions of fetcher.deny_extensions to allow on the host, and more
+	// extensions to deny there
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// normalizeExtension lower-cases ext and strips its leading dot, so ".ZIP"
+// and "zip" are the same extension
+func normalizeExtension(ext string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+}
+
+// checkExtensions returns an error if exts has an empty extension
+func checkExtensions(exts []string) error {
+	for i, ext := range exts {
+		if normalizeExtension(ext) == "" {
+			return fmt.Errorf("extension %d is empty", i)
+		}
+	}
+	return nil
+}
+
+// checkExtensionOverrides returns an error if an override has no host, an
+// empty extension, or the same host as another
+func checkExtensionOverrides(overrides []ExtensionOverride) error {
+	hosts := map[string]bool{}
+	for i, o := range overrides {
+		host := normalizePinHost(o.Host)
+		if host == "" {
+			return fmt.Errorf("override %d has no host", i)
+		}
+		if hosts[host] {
+			return fmt.Errorf("host %q is overridden more than once", o.Host)
+		}
+		hosts[host] = true
+		if err := checkExtensions(o.Allow); err != nil {
+			return fmt.Errorf("host %q allow: %v", o.Host, err)
+		}
+		if err := checkExtensions(o.Deny); err != nil {
+			return fmt.Errorf("host %q deny: %v", o.Host, err)
+		}
+	}
+	return nil
+}
+
+// extensionSet is a set of normalized extensions
+type extensionSet map[string]bool
+
+func newExtensionSet(exts []string) extensionSet {
+	s := extensionSet{}
+	for _, ext := range exts {
+		if ext = normalizeExtension(ext); ext != "" {
+			s[ext] = true
+		}
+	}
+	return s
+}
+
+// extensionDenier decides which links have a denied extension
+type extensionDenier struct {
+	deny extensionSet
+
+	// The extensions denied on each overridden host
+	hosts map[string]extensionSet
+}
+
+// newExtensionDenier indexes deny and overrides, skipping overrides without
+// a host (they are rejected when the config is loaded)
+func newExtensionDenier(deny []string, overrides []ExtensionOverride) *extensionDenier {
+	d := &extensionDenier{deny: newExtensionSet(deny), hosts: map[string]extensionSet{}}
+	for _, o := range overrides {
+		host := normalizePinHost(o.Host)
+		if host == "" {
+			continue
+		}
+		allow := newExtensionSet(o.Allow)
+		s := newExtensionSet(o.Deny)
+		for ext := range d.deny {
+			if !allow[ext] {
+				s[ext] = true
+			}
+		}
+		d.hosts[host] = s
+	}
+	return d
+}
+
+// denied returns the extensions denied on host, by its own override or the
+// override of the nearest domain above it, or else fetcher.deny_extensions
+func (d *extensionDenier) denied(host string) extensionSet {
+	if len(d.hosts) > 0 {
+		h := normalizePinHost(host)
+		for {
+			if s, ok := d.hosts[h]; ok {
+				return s
+			}
+			i := strings.Index(h, ".")
+			if i < 0 {
+				break
+			}
+			h = h[i+1:]
+		}
+	}
+	return d.deny
+}
+
+// check returns the extension of u's path, and whether it is denied. An
+// extension with dots in it (ex. "tar.gz") is matched against the end of the
+// file name, so "src.tar.gz" is denied by either "tar.gz" or "gz".
+func (d *extensionDenier) check(u *URL) (string, bool) {
+	denied := d.denied(u.Hostname())
+	name := path.Base(u.Path)
+	for i := strings.Index(name, "."); i >= 0; i = strings.Index(name, ".") {
+		name = name[i+1:]
+		if ext := normalizeExtension(name); denied[ext] {
+			return ext, true
+		}
+	}
+	return normalizeExtension(path.Ext(u.Path)), false
+}
@@ -2,19 +2,23 @@ package walker
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"code.google.com/p/log4go"
+	lru "github.com/hashicorp/golang-lru"
 	"github.com/iParadigms/walker/dnscache"
 	"github.com/iParadigms/walker/mimetools"
 	"github.com/temoto/robotstxt.go"
@@ -42,6 +46,16 @@ type FetchResults struct {
 	// and this is the URL that furnished the http.Response.
 	RedirectedFrom []*URL
 
+	// The status of each redirect followed: RedirectStatuses[0] is the status
+	// URL redirected with, and RedirectStatuses[n] the status
+	// RedirectedFrom[n-1] redirected with (ex. 301 for a permanent redirect).
+	RedirectStatuses []int
+
+	// The URL that URL redirected to, or nil if it didn't: the URL the
+	// response came from (the last of RedirectedFrom) if the redirects were
+	// followed, or else the redirect's Location (see fetcher.follow_redirects)
+	RedirectedTo *URL
+
 	// Response object; nil if there was a FetchError or ExcludedByRobots is
 	// true. Response.Body may not be the same object the HTTP request actually
 	// returns; the fetcher may have read in the response to parse out links,
@@ -64,6 +78,14 @@ type FetchResults struct {
 	// robots.txt rules
 	ExcludedByRobots bool
 
+	// True if we did not request this link because the host's sitemap says it
+	// hasn't changed since it was last crawled (see fetcher.sitemap_trust)
+	SitemapFresh bool
+
+	// True if we did not request this link because its file extension is
+	// denied (see fetcher.deny_extensions)
+	ExtensionDenied bool
+
 	// True if the page was marked as 'noindex' via a <meta> tag. Whether it
 	// was crawled depends on the honor_meta_noindex configuration parameter
 	MetaNoIndex bool
@@ -72,17 +94,174 @@ type FetchResults struct {
 	// was crawled depends on the honor_meta_nofollow configuration parameter
 	MetaNoFollow bool
 
+	// Set by "noai", "noimageai" and "nosnippet" directives in a robots
+	// <meta> tag or X-Robots-Tag header. These don't change what walker
+	// crawls; handlers and downstream indexing can use them to decide how the
+	// content may be used. See the honor_meta_noai configuration parameter.
+	MetaNoAI      bool
+	MetaNoImageAI bool
+	MetaNoSnippet bool
+
+	// The smallest "max-snippet" directive given for the page, or 0 if there
+	// was none (or it allowed unlimited snippets). A max-snippet of 0 sets
+	// MetaNoSnippet instead.
+	MetaMaxSnippet int
+
 	// The Content-Type of the fetched page.
 	MimeType string
 
 	// Fingerprint computed with fnv algorithm (see hash/fnv in standard library)
 	FnvFingerprint int64
+
+	// The number of bytes read from the response body. Datastores use this to
+	// account for per-host download quotas.
+	ContentSize int64
+
+	// How long the fetch took, from sending the request until the response
+	// body was read (or the fetch failed). Zero if the link wasn't fetched.
+	ResponseTime time.Duration
+
+	// True if the document was too large to fetch whole, so only its start
+	// was fetched (see fetcher.range_fetch_bytes). The body, fingerprint and
+	// parsed links are of just that part.
+	Partial bool
+
+	// True if the response's Content-Type was one the crawl didn't ask for, so
+	// its body wasn't downloaded (see fetcher.reject_unaccepted_types). The
+	// response is stored without a body or fingerprint, and not handled.
+	TypeRejected bool
+
+	// Links on this page that pointed at one of fetcher.redirector_hosts,
+	// along with the URLs they resolved to. The resolved URLs are what get
+	// passed to StoreParsedURL; the datastore may record the mapping itself.
+	ExpandedLinks []LinkExpansion
+
+	// Alternate versions of this page declared with <link> tags: the AMP
+	// version (rel="amphtml"), the mobile version (rel="alternate" with a
+	// media query) and the canonical version (rel="canonical"). Each is nil
+	// if the page did not declare it.
+	AMPURL       *URL
+	MobileURL    *URL
+	CanonicalURL *URL
+
+	// Dimensions, format and EXIF basics of the fetched image, if it was one
+	// and fetcher.extract_image_metadata is set (nil otherwise).
+	Image *ImageInfo
+
+	// Text extracted from the page, if walker knows how to for its type.
+	// Currently only set for PDFs when fetcher.parse_pdf is true.
+	Text string
+
+	// Sampled is true if this fetch was picked for QA capture (see
+	// fetcher.sample_percentage). Body is set for sampled fetches whether or
+	// not cassandra.store_response_body is, and datastores should keep their
+	// body and headers.
+	Sampled bool
+
+	// ParseError is set if the page could not be parsed for links: the parser
+	// failed, crashed, or took longer than fetcher.parse_timeout. If it
+	// failed partway through the page, the links found before that are
+	// stored; otherwise none are.
+	ParseError error
+
+	// How long the server said the response may be cached for, from its
+	// Cache-Control max-age (in seconds) or, failing that, its Expires
+	// header. CacheMaxAge is 0 and CacheExpires the zero time if neither was
+	// given, or if the response was marked no-cache or no-store. The
+	// dispatcher won't refresh the link before this lifetime is up.
+	CacheMaxAge  int
+	CacheExpires time.Time
+
+	// How often the publisher says the page changes, if fetcher.refresh_hints
+	// is set: the <meta name="revisit-after"> of the page or, failing that,
+	// the <changefreq> of its entry in the host's sitemap. 0 if neither was
+	// given. The dispatcher refreshes the link at this interval when it has no
+	// declared cache lifetime.
+	RefreshHint time.Duration
+
+	// The domains (TLD+1) other than its own that the page links to, with the
+	// number of its http(s) links to each (after expanding links to
+	// redirector hosts), whether or not the links are stored. Nil if the page
+	// wasn't parsed or links to no other domain. At most maxOutlinkDomains
+	// domains are counted.
+	OutlinkDomains map[string]int
+
+	// The ID of the node that fetched the link (see NodeID)
+	Node string
+
+	// The earliest time the link may be fetched again, or zero for no
+	// constraint beyond the usual refresh scheduling. It is set from the
+	// Retry-After header of 429 and 503 responses (see
+	// fetcher.honor_retry_after); handlers may also set it, to hold a page
+	// back until some known time. The dispatcher won't dispatch the link
+	// before then.
+	CrawlAt time.Time
+
+	// Surrogate keys (tags) handlers may give the page, ex. the template or
+	// site section it was rendered from, so the pages sharing a key can be
+	// found later (ex. to recrawl those a CMS change affects). Datastores
+	// should index them.
+	SurrogateKeys []string
+
+	// Unchanged is set if the page's content hadn't changed since it was last
+	// crawled, when that is tracked: in differential crawl mode
+	// (fetcher.differential), where such pages are not given to handlers, with
+	// fetcher.skip_unchanged_pages, where they aren't parsed either, and for
+	// pages watch rules apply to. Otherwise Diff summarizes how the page
+	// changed; it is nil when not in differential mode.
+	Unchanged bool
+	Diff      *PageDiff
+
+	// Changes seen by watch rules (see watch.rules) on this page. Datastores
+	// should record them.
+	WatchChanges []WatchChange
+
+	// A rendering of the page, if it matched screenshots.patterns (nil
+	// otherwise, or if the capture failed). Datastores should keep it.
+	Screenshot *Screenshot
+
+	// The error the handler returned, if it implements HandlerV2 and couldn't
+	// handle the response. If it asked for the link to be fetched again (see
+	// RetryAfter), HandlerRetry is set and CrawlAt is no earlier than the
+	// time it asked for; datastores should queue the link to be fetched as
+	// soon as CrawlAt allows, rather than waiting for its usual refresh.
+	HandlerError error
+	HandlerRetry bool
+}
+
+// HostContext is what a fetcher learned about a host it crawled that the next
+// fetcher to claim the host can reuse, handed between them through the
+// Datastore (see fetcher.host_context_ttl).
+type HostContext struct {
+	// The robots.txt fetched for each host crawled (the claimed host and any
+	// of its subdomains), and the hosts that had none
+	Robots   map[string][]byte
+	NoRobots []string
+
+	// When the oldest of the robots.txt files was fetched
+	RobotsTime time.Time
+
+	// Resolved address (ip:port) for each host:port dialed
+	Addrs map[string]string
+
+	// The crawl delay last used for the claimed host
+	CrawlDelay time.Duration
+}
+
+// LinkExpansion maps a link to a redirector host (ex. a URL shortener) to the
+// URL it redirected to.
+type LinkExpansion struct {
+	// The link as it was found on the page
+	From *URL
+
+	// The URL that From redirected to
+	To *URL
 }
 
 // FetchManager configures and runs the crawl.
 //
-// The calling code must create a FetchManager, set a Datastore and handlers,
-// then call `Start()`
+// The calling code must create a FetchManager with a Datastore and handlers
+// (see NewFetchManager), then call `Start()`
 type FetchManager struct {
 	// Handler must be set to handle fetch responses.
 	Handler Handler
@@ -109,8 +288,19 @@ type FetchManager struct {
 	// used to match Content-Type headers
 	acceptFormats *mimetools.Matcher
 
-	defCrawlDelay time.Duration
-	maxCrawlDelay time.Duration
+	// the Accept header sent, built from Config.Fetcher.AcceptFormats
+	acceptHeader string
+
+	// matches the Content-Types of responses given to the handler,
+	// Config.Fetcher.HandlerFormats or acceptFormats if that's empty
+	handlerFormats *mimetools.Matcher
+
+	// matches Config.Fetcher.RangeFetchTypes
+	rangeFetchTypes *mimetools.Matcher
+
+	defCrawlDelay   time.Duration
+	maxCrawlDelay   time.Duration
+	burstCrawlDelay time.Duration
 
 	// how long to wait between Datastore.KeepAlive() calls.
 	activeFetcherHeartbeat time.Duration
@@ -120,6 +310,142 @@ type FetchManager struct {
 
 	// If this flag is set, oneShot is set on each child fetcher
 	oneShot bool
+
+	// DNS cache shared by Transport and TransNoKeepAlive (nil if neither is
+	// an *http.Transport)
+	dnsCache *dnscache.Cache
+
+	// Resolver of host names, if Config.Fetcher.DNSOverHTTPSURL is set
+	doh *dnscache.DoHResolver
+
+	// The ID of this node, recorded with every fetch (see NodeID)
+	nodeID string
+
+	// Parsed duration of Config.Fetcher.HostContextTTL
+	hostContextTTL time.Duration
+
+	// Parsed durations of Config.Fetcher.DNSNegativeTTL and
+	// Config.Fetcher.DNSQuarantinePeriod
+	dnsNegativeTTL      time.Duration
+	dnsQuarantinePeriod time.Duration
+
+	// Parsed durations of Config.Fetcher.RobotsRetryBackoff and
+	// Config.Fetcher.RobotsUnavailableBackoff
+	robotsRetryBackoff       time.Duration
+	robotsUnavailableBackoff time.Duration
+
+	// Parsed Config.Fetcher.SourceAddresses, the local addresses outbound
+	// connections are made from (nil to let the OS choose), and the count
+	// used to rotate through them
+	sourceAddrs    []net.IP
+	nextSourceAddr uint32
+
+	// Config.Fetcher.PinnedHosts, the addresses pinned hosts are dialed at
+	hostPins hostPins
+
+	// Config.Fetcher.ProxyURL and ProxyOverrides, the proxies of the
+	// transports the FetchManager creates
+	proxies *proxies
+
+	// True if the FetchManager created Transport and TransNoKeepAlive itself
+	// (rather than being given them), and the keep-alive period it used
+	ownTransports bool
+	keepAlive     time.Duration
+
+	// Tallies stored fetch results for Report
+	reporter *crawlReporter
+
+	// Compiled Config.Watch.Rules
+	watchRules []*watchRule
+
+	// Captures screenshots, nil if screenshots.renderer_url isn't set
+	screenshots *screenshotter
+
+	// Parsed duration of Config.Sessions.Timeout
+	sessionTimeout time.Duration
+
+	// Counts fetches for a monitoring system, if set (see WithMetrics)
+	metrics Metrics
+
+	// Spaces out requests to each server (see fetcher.politeness_grouping)
+	serverGate *serverGate
+
+	// The host each fetcher has claimed, for reporting the ones left claimed
+	// by StopWithin
+	crawlingMu sync.Mutex
+	crawling   map[*fetcher]string
+
+	// Run when fetchers claim and unclaim hosts (see WithClaimHook and
+	// WithUnclaimHook)
+	claimHooks   []ClaimHook
+	unclaimHooks []UnclaimHook
+}
+
+// setCrawling records that f is crawling host, or nothing if host is empty
+func (fm *FetchManager) setCrawling(f *fetcher, host string) {
+	fm.crawlingMu.Lock()
+	defer fm.crawlingMu.Unlock()
+	if fm.crawling == nil {
+		fm.crawling = map[*fetcher]string{}
+	}
+	if host == "" {
+		delete(fm.crawling, f)
+	} else {
+		fm.crawling[f] = host
+	}
+}
+
+// crawlingHosts returns the hosts fetchers have claimed, sorted
+func (fm *FetchManager) crawlingHosts() []string {
+	fm.crawlingMu.Lock()
+	defer fm.crawlingMu.Unlock()
+	hosts := make([]string, 0, len(fm.crawling))
+	for _, h := range fm.crawling {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// cachingDial wraps dial to cache DNS resolutions in fm.dnsCache, creating the
+// cache if needed, and to resolve host names with fm.doh if set
+func (fm *FetchManager) cachingDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if fm.doh != nil {
+		dial = fm.doh.Dial(dial)
+	}
+	if fm.dnsCache == nil {
+		var err error
+		fm.dnsCache, err = dnscache.New(Config.Fetcher.MaxDNSCacheEntries)
+		if err != nil {
+			// This should be a very rare panic
+			log4go.Error("Failed to construct dnscacheing Dialer: %v", err)
+			panic(err)
+		}
+		fm.dnsCache.NegativeTTL = fm.dnsNegativeTTL
+	}
+	return fm.dnsCache.Dial(dial)
+}
+
+// newDoHResolver creates the resolver of Config.Fetcher.DNSOverHTTPSURL. It
+// is reached through http.DefaultTransport, so its own host name is looked up
+// with the system's DNS.
+func (fm *FetchManager) newDoHResolver() (*dnscache.DoHResolver, error) {
+	timeout, err := time.ParseDuration(Config.Fetcher.DNSOverHTTPSTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := &dnscache.DoHResolver{
+		URL:      Config.Fetcher.DNSOverHTTPSURL,
+		Client:   &http.Client{Timeout: timeout},
+		Fallback: Config.Fetcher.DNSOverHTTPSFallback,
+	}
+	r.Observe = func(took time.Duration, err error) {
+		if err != nil && !dnscache.IsDNSError(err) {
+			log4go.Warn("DNS-over-HTTPS lookup failed: %v", err)
+		}
+		fm.reporter.dohLookup(took, err, r.Fallback)
+	}
+	return r, nil
 }
 
 // Start begins processing assuming that the datastore and any handlers have
@@ -138,8 +464,22 @@ func (fm *FetchManager) run() {
 	if fm.started {
 		panic("Cannot start a FetchManager multiple times")
 	}
+	fm.reporter = newCrawlReporter(fm.metrics)
+	fm.nodeID = NodeID()
+	log4go.Info("Fetcher node ID is %v", fm.nodeID)
 
 	var err error
+	fm.watchRules, err = compileWatchRules(Config.Watch.Rules)
+	if err != nil {
+		// This won't happen b/c the rules are checked in Config
+		panic(err)
+	}
+	fm.screenshots, err = newScreenshotter()
+	if err != nil {
+		// This won't happen b/c the screenshot settings are checked in Config
+		panic(err)
+	}
+
 	fm.defCrawlDelay, err = time.ParseDuration(Config.Fetcher.DefaultCrawlDelay)
 	if err != nil {
 		// This won't happen b/c this duration is checked in Config
@@ -152,6 +492,12 @@ func (fm *FetchManager) run() {
 		panic(err)
 	}
 
+	fm.burstCrawlDelay, err = time.ParseDuration(Config.Fetcher.BurstCrawlDelay)
+	if err != nil {
+		// This won't happen b/c this duration is checked in Config
+		panic(err)
+	}
+
 	ttl, err := time.ParseDuration(Config.Fetcher.ActiveFetchersTTL)
 	if err != nil {
 		panic(err) // This won't happen b/c this duration is checked in Config
@@ -162,6 +508,23 @@ func (fm *FetchManager) run() {
 	if err != nil {
 		panic(fmt.Errorf("mimetools.NewMatcher failed to initialize: %v", err))
 	}
+	fm.acceptHeader, err = mimetools.AcceptHeader(Config.Fetcher.AcceptFormats)
+	if err != nil {
+		panic(err) // This won't happen b/c the formats are checked in Config
+	}
+	fm.handlerFormats = fm.acceptFormats
+	if len(Config.Fetcher.HandlerFormats) > 0 {
+		fm.handlerFormats, err = mimetools.NewMatcher(Config.Fetcher.HandlerFormats)
+		if err != nil {
+			// This won't happen b/c the formats are checked in Config
+			panic(err)
+		}
+	}
+	fm.rangeFetchTypes, err = mimetools.NewMatcher(Config.Fetcher.RangeFetchTypes)
+	if err != nil {
+		// This won't happen b/c the types are checked in Config
+		panic(err)
+	}
 
 	// Make sure that the initial KeepAlive work is done
 	err = fm.Datastore.KeepAlive()
@@ -204,59 +567,91 @@ func (fm *FetchManager) run() {
 		panic(err)
 	}
 
+	fm.hostContextTTL, err = time.ParseDuration(Config.Fetcher.HostContextTTL)
+	if err != nil {
+		// Shouldn't happen since this variable is parsed in assertConfigInvariants
+		panic(err)
+	}
+
+	fm.dnsNegativeTTL, err = time.ParseDuration(Config.Fetcher.DNSNegativeTTL)
+	if err != nil {
+		// Shouldn't happen since this variable is parsed in assertConfigInvariants
+		panic(err)
+	}
+	fm.dnsQuarantinePeriod, err = time.ParseDuration(Config.Fetcher.DNSQuarantinePeriod)
+	if err != nil {
+		// Shouldn't happen since this variable is parsed in assertConfigInvariants
+		panic(err)
+	}
+	fm.robotsRetryBackoff, err = time.ParseDuration(Config.Fetcher.RobotsRetryBackoff)
+	if err != nil {
+		// Shouldn't happen since this variable is parsed in assertConfigInvariants
+		panic(err)
+	}
+	fm.robotsUnavailableBackoff, err = time.ParseDuration(Config.Fetcher.RobotsUnavailableBackoff)
+	if err != nil {
+		// Shouldn't happen since this variable is parsed in assertConfigInvariants
+		panic(err)
+	}
+	fm.sessionTimeout, err = time.ParseDuration(Config.Sessions.Timeout)
+	if err != nil {
+		// Shouldn't happen since this variable is parsed in assertConfigInvariants
+		panic(err)
+	}
+
+	if Config.Fetcher.DNSOverHTTPSURL != "" {
+		fm.doh, err = fm.newDoHResolver()
+		if err != nil {
+			// Shouldn't happen since these variables are parsed in assertConfigInvariants
+			panic(err)
+		}
+		log4go.Info("Resolving host names with DNS-over-HTTPS resolver %v", Config.Fetcher.DNSOverHTTPSURL)
+	}
+
+	fm.sourceAddrs = parseSourceAddrs(Config.Fetcher.SourceAddresses)
+	fm.hostPins = newHostPins(Config.Fetcher.PinnedHosts)
+	fm.proxies = newProxies(Config.Fetcher.ProxyURL, Config.Fetcher.ProxyOverrides)
+	fm.serverGate = newServerGate()
 	if fm.Transport == nil {
-		keepAlive := 30 * time.Second
+		fm.keepAlive = 30 * time.Second
 		if strings.ToLower(Config.Fetcher.HTTPKeepAlive) == "never" {
-			keepAlive = 0 * time.Second
+			fm.keepAlive = 0 * time.Second
 		}
 
 		// Set fm.Transport == http.DefaultTransport, but create a new one; we
 		// want to override Dial but don't want to globally override it in
 		// http.DefaultTransport.
-		fm.Transport = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   timeout,
-				KeepAlive: keepAlive,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
+		fm.Transport = fm.newTransport(timeout, fm.keepAlive, fm.rotateSourceAddr)
+		fm.ownTransports = true
+		log4go.Info("Using proxy %v", fm.proxies)
 	}
 	if fm.TransNoKeepAlive == nil && strings.ToLower(Config.Fetcher.HTTPKeepAlive) == "threshold" {
-		fm.TransNoKeepAlive = &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			Dial: (&net.Dialer{
-				Timeout:   timeout,
-				KeepAlive: 0 * time.Second,
-			}).Dial,
-			TLSHandshakeTimeout: 10 * time.Second,
-		}
+		fm.TransNoKeepAlive = fm.newTransport(timeout, 0*time.Second, fm.rotateSourceAddr)
+	}
+	if len(fm.sourceAddrs) > 0 {
+		log4go.Info("Making outbound connections from %v (%v)", Config.Fetcher.SourceAddresses,
+			Config.Fetcher.SourceAddressPolicy)
+	}
+
+	if len(fm.hostPins) > 0 {
+		log4go.Info("Dialing pinned hosts at their pinned addresses: %v", fm.hostPins)
 	}
 
 	t, ok := fm.Transport.(*http.Transport)
 	if ok {
-		var err error
-		t.Dial, err = dnscache.Dial(t.Dial, Config.Fetcher.MaxDNSCacheEntries)
-		if err != nil {
-			// This should be a very rare panic
-			log4go.Error("Failed to construct dnscacheing Dialer for Transport: %v", err)
-			panic(err)
-		}
+		t.Dial = fm.pinnedDial(fm.cachingDial(t.Dial))
+		t.MaxResponseHeaderBytes = Config.Fetcher.MaxResponseHeaderBytes
 	} else {
-		log4go.Info("Given an non-http Transport, not using dns caching")
+		log4go.Info("Given an non-http Transport, not using dns caching or host pins")
 	}
 
 	if fm.TransNoKeepAlive != nil {
 		t, ok = fm.TransNoKeepAlive.(*http.Transport)
 		if ok {
-			t.Dial, err = dnscache.Dial(t.Dial, Config.Fetcher.MaxDNSCacheEntries)
-			if err != nil {
-				// This should be a very rare panic
-				log4go.Error("Failed to construct dnscacheing Dialer for TransNoKeepAlive: %v", err)
-				panic(err)
-			}
+			t.Dial = fm.pinnedDial(fm.cachingDial(t.Dial))
+			t.MaxResponseHeaderBytes = Config.Fetcher.MaxResponseHeaderBytes
 		} else {
-			log4go.Info("Given a non-http TransNoKeepAlive, not using dns caching")
+			log4go.Info("Given a non-http TransNoKeepAlive, not using dns caching or host pins")
 		}
 	}
 
@@ -265,6 +660,7 @@ func (fm *FetchManager) run() {
 	var fetchWait sync.WaitGroup
 	for i := 0; i < numFetchers; i++ {
 		f := newFetcher(fm)
+		fm.bindFetcher(f, i, timeout)
 		f.oneShot = fm.oneShot
 		fm.fetchers[i] = f
 		fm.activeThreadsWait.Add(1)
@@ -299,11 +695,22 @@ func (fm *FetchManager) oneShotRun() {
 	fm.oneShot = true
 	fm.run()
 	fm.activeThreadsWait.Wait()
+	if err := fm.WriteReport(); err != nil {
+		log4go.Error(err.Error())
+	}
 }
 
 // Stop notifies the fetchers to finish their current requests. It blocks until
 // all fetchers have finished.
 func (fm *FetchManager) Stop() {
+	fm.StopWithin(0)
+}
+
+// StopWithin is Stop, but waits at most timeout (forever if 0) for the
+// fetchers to finish. It returns the hosts still claimed by fetchers that
+// hadn't finished in time; those stay claimed until the fetcher's claims
+// expire (see fetcher.active_fetchers_ttl), so another fetcher may crawl them.
+func (fm *FetchManager) StopWithin(timeout time.Duration) []string {
 	log4go.Info("Stopping FetchManager")
 	if !fm.started {
 		panic("Cannot stop a FetchManager that has not been started")
@@ -312,7 +719,28 @@ func (fm *FetchManager) Stop() {
 		go f.stop()
 	}
 	close(fm.keepAliveQuit)
-	fm.activeThreadsWait.Wait()
+
+	stopped := make(chan struct{})
+	go func() {
+		fm.activeThreadsWait.Wait()
+		close(stopped)
+	}()
+	var unfinished []string
+	if timeout > 0 {
+		select {
+		case <-stopped:
+		case <-time.After(timeout):
+			unfinished = fm.crawlingHosts()
+			log4go.Warn("Fetchers did not stop within %v, abandoning %d claimed hosts", timeout, len(unfinished))
+		}
+	} else {
+		<-stopped
+	}
+
+	if err := fm.WriteReport(); err != nil {
+		log4go.Error(err.Error())
+	}
+	return unfinished
 }
 
 // fetcher encompasses one of potentially many fetchers the FetchManager may
@@ -324,6 +752,18 @@ type fetcher struct {
 	httpclient *http.Client
 	crawldelay time.Duration
 
+	// The transports this fetcher uses; fm.Transport and fm.TransNoKeepAlive
+	// unless it is bound to its own source address (see bindFetcher)
+	transport        http.RoundTripper
+	transNoKeepAlive http.RoundTripper
+
+	// delayOverride is the crawl delay set for the current host in the
+	// datastore (see Datastore.CrawlDelayOverride), or 0 if there is none
+	delayOverride time.Duration
+
+	// What the claim and unclaim hooks are given about the current host
+	hostStats HostStats
+
 	// quit signals the fetcher to stop
 	quit chan struct{}
 
@@ -332,8 +772,8 @@ type fetcher struct {
 	// reading from quit
 	done chan struct{}
 
-	excludeLink *regexp.Regexp
-	includeLink *regexp.Regexp
+	// Decides which parsed links are stored (see shouldStoreParsedLink)
+	linkFilter *linkFilter
 
 	// defRobots holds the robots.txt definition used if a host doesn't
 	// publish a robots.txt file on it's own.
@@ -342,11 +782,77 @@ type fetcher struct {
 	// robotsMap maps host -> robots.txt definition to use
 	robotsMap map[string]*robotstxt.Group
 
+	// robotsBodies maps host -> robots.txt body (nil if it has none) for the
+	// hosts crawled since the current host was claimed, including those
+	// handed over in its HostContext; warmRobots holds just the handed over
+	// ones. robotsTime is when the oldest of them was fetched.
+	robotsBodies map[string][]byte
+	warmRobots   map[string][]byte
+	robotsTime   time.Time
+
+	// lastRobots holds the robots.txt bodies handed over in the current
+	// host's HostContext, however old, to spot robots.txt files that newly
+	// block us (see WebhookRobotsBlocked)
+	lastRobots map[string][]byte
+
+	// Links of the current host fetched and failed so far, and whether the
+	// WebhookDomainErrorRate event has been fired for it
+	fetched        int
+	fetchErrors    int
+	errorRateFired bool
+
+	// Fetches of the current host that failed DNS, and whether any resolved
+	// (see fetcher.dns_quarantine_failures)
+	dnsFailures int
+	dnsResolved bool
+
 	// Where to read content pages into
 	readBuffer bytes.Buffer
 
 	// Should this fetcher stop as soon as the datastore has no more work to processes
 	oneShot bool
+
+	// redirectorHosts is the set of hosts whose links are expanded at parse
+	// time (see fetcher.redirector_hosts)
+	redirectorHosts map[string]bool
+
+	// redirectorClient expands redirector links, apart from f.httpclient so
+	// its redirect policy is its own (see resolveRedirector), and
+	// redirectorCache holds the links it has expanded (nil if it couldn't be
+	// created)
+	redirectorClient *http.Client
+	redirectorCache  *lru.Cache
+
+	// parseTimeout is the parsed fetcher.parse_timeout
+	parseTimeout time.Duration
+
+	// sitemapMaxSkipAge is the parsed fetcher.sitemap_max_skip_age
+	sitemapMaxSkipAge time.Duration
+
+	// maxRetryAfter is the parsed fetcher.max_retry_after
+	maxRetryAfter time.Duration
+
+	// The links stored from the page being fetched, in differential crawl
+	// mode (see recordOutlink)
+	outlinks []string
+
+	// The PageState of the page being fetched, set by trackPage and stored
+	// once the page has been handled (see storePageState)
+	pageState *PageState
+
+	// The current host's sitemap entries by link, read the first time a link
+	// crawled before comes up (see sitemapFresh), or the first fetch if
+	// fetcher.refresh_hints is set
+	sitemap       map[string]sitemapEntry
+	sitemapLoaded bool
+
+	// The links listed in the current host's sitemaps, read along with
+	// sitemap if fetcher.sitemap_discovery is set
+	sitemapLinks []sitemapLink
+
+	// The politeness group of each host seen since the current host was
+	// claimed (see politenessGroup)
+	serverGroups map[string]string
 }
 
 func aggregateRegex(list []string, sourceName string) (*regexp.Regexp, error) {
@@ -387,26 +893,48 @@ func newFetcher(fm *FetchManager) *fetcher {
 
 	f := new(fetcher)
 	f.fm = fm
+	f.transport = fm.Transport
+	f.transNoKeepAlive = fm.TransNoKeepAlive
 	f.httpclient = &http.Client{
-		Transport: fm.Transport,
+		Transport: f.transport,
 		Timeout:   timeout,
 	}
+	f.parseTimeout, err = time.ParseDuration(Config.Fetcher.ParseTimeout)
+	if err != nil {
+		// This shouldn't happen because ParseTimeout is tested in assertConfigInvariants
+		panic(err)
+	}
+	f.sitemapMaxSkipAge, err = time.ParseDuration(Config.Fetcher.SitemapMaxSkipAge)
+	if err != nil {
+		// This shouldn't happen because SitemapMaxSkipAge is tested in assertConfigInvariants
+		panic(err)
+	}
+	f.maxRetryAfter, err = time.ParseDuration(Config.Fetcher.MaxRetryAfter)
+	if err != nil {
+		// This shouldn't happen because MaxRetryAfter is tested in assertConfigInvariants
+		panic(err)
+	}
 	f.quit = make(chan struct{})
 	f.done = make(chan struct{})
 
-	if len(Config.Fetcher.ExcludeLinkPatterns) > 0 {
-		f.excludeLink, err = aggregateRegex(Config.Fetcher.ExcludeLinkPatterns, "exclude_link_patterns")
-		if err != nil {
-			// This shouldn't happen b/c it's already been checked when loading config
-			panic(err)
-		}
+	f.linkFilter, err = newLinkFilter()
+	if err != nil {
+		// This shouldn't happen b/c it's already been checked when loading config
+		panic(err)
 	}
 
-	if len(Config.Fetcher.IncludeLinkPatterns) > 0 {
-		f.includeLink, err = aggregateRegex(Config.Fetcher.IncludeLinkPatterns, "include_link_patterns")
+	f.redirectorHosts = map[string]bool{}
+	for _, h := range Config.Fetcher.RedirectorHosts {
+		f.redirectorHosts[strings.ToLower(h)] = true
+	}
+	if len(f.redirectorHosts) > 0 {
+		f.redirectorClient = &http.Client{
+			Transport: f.transport,
+			Timeout:   timeout,
+		}
+		f.redirectorCache, err = lru.New(redirectorCacheSize)
 		if err != nil {
-			// This shouldn't happen b/c it's already been checked when loading config
-			panic(err)
+			log4go.Error("Failed to create the redirector cache: %v", err)
 		}
 	}
 
@@ -448,18 +976,45 @@ func (f *fetcher) crawlNewHost() bool {
 		time.Sleep(time.Second)
 		return true
 	}
+	log4go.Info("Claimed %v on node %v", f.host, f.fm.nodeID)
+	f.fm.reporter.claimed(f.host)
+	f.fm.setCrawling(f, f.host)
+	f.loadHostContext(f.host)
+	f.fetched, f.fetchErrors, f.errorRateFired = 0, 0, false
+	f.dnsFailures, f.dnsResolved = 0, false
+	f.sitemap, f.sitemapLoaded, f.sitemapLinks = nil, false, nil
+	f.serverGroups = nil
+	f.hostStats = HostStats{Host: f.host, Claimed: time.Now()}
 	defer func() {
-		log4go.Info("Finished crawling %v, unclaiming", f.host)
+		f.httpclient.Jar = nil
+		f.storeHostContext(f.host)
+		log4go.Info("Finished crawling %v on node %v, unclaiming", f.host, f.fm.nodeID)
 		f.fm.Datastore.UnclaimHost(f.host)
+		f.fm.setCrawling(f, "")
+		f.runUnclaimHooks()
 	}()
 
+	if !f.runClaimHooks() {
+		return true
+	}
+
 	if f.checkForBlacklisting(f.host) {
 		return true
 	}
 
+	// Log in first if the host needs a session; without one its pages would
+	// only be the login page
+	if !f.bootstrapSession(f.host) {
+		return true
+	}
+
 	// Set up robots map
 	log4go.Info("Crawling host: %v with crawl delay %v", f.host, f.crawldelay)
-	f.initializeRobotsMap(f.host)
+	if !f.initializeRobotsMap(f.host) {
+		f.holdBackHost()
+		return true
+	}
+	f.discoverSitemapLinks(f.host)
 
 	// Loop through the links
 	for link := range f.fm.Datastore.LinksForHost(f.host) {
@@ -471,9 +1026,21 @@ func (f *fetcher) crawlNewHost() bool {
 		default:
 		}
 
+		if f.fm.Datastore.HostQuotaExceeded(f.host) {
+			log4go.Info("Host %v exceeded its download quota, stopping crawl early", f.host)
+			return true
+		}
+
 		robots := f.fetchRobots(link.Host)
+		if robots == nil {
+			log4go.Debug("Not fetching %v, its host's robots.txt is unavailable", link)
+			continue
+		}
 
 		shouldDelay, crawlDelayClockStart := f.fetchAndHandle(link, robots)
+		if f.quarantineIfDead() {
+			return true
+		}
 		if shouldDelay {
 			// fetchTime is the last server GET (not counting robots.txt GET's). So
 			// delta represents the amount of the CrawlDelay that still needs to be
@@ -484,35 +1051,138 @@ func (f *fetcher) crawlNewHost() bool {
 			}
 		}
 	}
+
+	select {
+	case <-f.quit:
+		// Told to quit while waiting to fetch the last link
+		return false
+	default:
+	}
+
+	f.fm.reporter.domainCompleted(f.host)
+	f.hostStats.Completed = true
+	FireWebhook(NewWebhookEvent(WebhookDomainCompleted, f.host,
+		fmt.Sprintf("Finished crawling %v: %d links fetched, %d errors", f.host, f.fetched, f.fetchErrors),
+		map[string]interface{}{"fetched": f.fetched, "errors": f.fetchErrors}))
 	return true
 }
 
+// quarantineIfDead quarantines the current host, returning true, if
+// fetcher.dns_quarantine_failures of its fetches have failed DNS and none
+// resolved
+func (f *fetcher) quarantineIfDead() bool {
+	limit := Config.Fetcher.DNSQuarantineFailures
+	if limit == 0 || f.dnsResolved || f.dnsFailures < limit {
+		return false
+	}
+	until := time.Now().Add(f.fm.dnsQuarantinePeriod)
+	log4go.Warn("Host %v failed DNS %d times, quarantining it until %v", f.host, f.dnsFailures, until)
+	f.fm.Datastore.QuarantineHost(f.host, until)
+	return true
+}
+
+// storeFetchResults stores fr, counting it toward the current host's error
+// rate and firing WebhookDomainErrorRate if that goes over
+// webhooks.error_rate_threshold
+func (f *fetcher) storeFetchResults(fr *FetchResults) {
+	f.fm.Datastore.StoreURLFetchResults(fr)
+	f.fm.reporter.add(f.host, fr)
+	if fr.ExcludedByRobots || fr.SitemapFresh || fr.ExtensionDenied {
+		return
+	}
+
+	f.fetched++
+	if fr.FetchError != nil && dnscache.IsDNSError(fr.FetchError) {
+		f.dnsFailures++
+	} else if fr.Response != nil {
+		f.dnsResolved = true
+	}
+	if fr.FetchError != nil || (fr.Response != nil && fr.Response.StatusCode >= 500) {
+		f.fetchErrors++
+	}
+	if f.errorRateFired || f.fetched < Config.Webhooks.ErrorRateMinFetches {
+		return
+	}
+	rate := float64(f.fetchErrors) / float64(f.fetched)
+	if rate*100 < Config.Webhooks.ErrorRateThreshold {
+		return
+	}
+	f.errorRateFired = true
+	FireWebhook(NewWebhookEvent(WebhookDomainErrorRate, f.host,
+		fmt.Sprintf("Error rate crawling %v is %v after %d fetches", f.host, formatPercent(rate), f.fetched),
+		map[string]interface{}{"fetched": f.fetched, "errors": f.fetchErrors, "error_rate": rate}))
+}
+
 // fetchAndHandle takes care of fetching and processing a URL beginning to end.
 // Returns true if it did actually perform a fetch (even if it wasn't
 // successful), indicating that crawl-delay should be observed. Returns, also,
 // the time we start the clock for a return visit to the server.
 func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time.Time) {
-	fr := &FetchResults{URL: link, FetchTime: NotYetCrawled}
+	fr := &FetchResults{URL: link, FetchTime: NotYetCrawled, Node: f.fm.nodeID}
 
 	if !robots.Test(link.RequestURI()) {
 		log4go.Debug("Not fetching due to robots rules: %v", link)
 		fr.ExcludedByRobots = true
-		f.fm.Datastore.StoreURLFetchResults(fr)
+		f.storeFetchResults(fr)
+		return false, time.Now()
+	}
+
+	if ext, denied := f.linkFilter.extensions.check(link); denied {
+		log4go.Debug("Not fetching, extension %q is denied: %v", ext, link)
+		fr.FetchTime = time.Now()
+		fr.ExtensionDenied = true
+		f.storeFetchResults(fr)
+		return false, time.Now()
+	}
+
+	if f.sitemapFresh(link) {
+		log4go.Debug("Not fetching, sitemap says it hasn't changed since %v: %v", link.LastCrawled, link)
+		fr.FetchTime = time.Now()
+		fr.SitemapFresh = true
+		f.storeFetchResults(fr)
+		return false, time.Now()
+	}
+
+	// Only a request that will be made waits for its server's turn
+	if !f.waitForServer(link.Host, robots.CrawlDelay) {
 		return false, time.Now()
 	}
 
+	fr.RefreshHint = f.sitemapChangeFreq(link)
 	fr.FetchTime = time.Now()
+	fr.Sampled = rand.Float64()*100 < Config.Fetcher.SamplePercentage
 	fr.Response, fr.RedirectedFrom, fr.FetchError = f.fetch(link)
+	fr.ResponseTime = time.Since(fr.FetchTime)
 	if fr.FetchError != nil {
 		log4go.Debug("Error fetching %v: %v", link, fr.FetchError)
-		f.fm.Datastore.StoreURLFetchResults(fr)
+		f.storeFetchResults(fr)
 		return true, time.Now()
 	}
 	log4go.Debug("Fetched %v -- %v", link, fr.Response.Status)
+	if len(fr.RedirectedFrom) > 0 {
+		fr.RedirectStatuses = redirectStatuses(fr.Response)
+		fr.RedirectedTo = fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
+	} else if to := redirectTarget(fr.Response, link); to != nil {
+		log4go.Fine("%v redirects (%v) to %v, storing it as a parsed link", link, fr.Response.StatusCode, to)
+		fr.RedirectStatuses = []int{fr.Response.StatusCode}
+		fr.RedirectedTo = to
+		f.storeParsedLinks([]*URL{to}, fr)
+	}
+	fr.CacheMaxAge, fr.CacheExpires = parseCacheHeaders(fr.Response.Header)
+	if Config.Fetcher.HonorRetryAfter && (fr.Response.StatusCode == http.StatusTooManyRequests ||
+		fr.Response.StatusCode == http.StatusServiceUnavailable) {
+		fr.CrawlAt = parseRetryAfter(fr.Response.Header, fr.FetchTime, f.maxRetryAfter)
+	}
 
 	if fr.Response.StatusCode == http.StatusNotModified {
 		log4go.Fine("Received 304 when fetching %v", link)
-		f.fm.Datastore.StoreURLFetchResults(fr)
+		if Config.Fetcher.Differential || Config.Fetcher.SkipUnchangedPages {
+			// There's no body to fingerprint; the content is what it was
+			fr.Unchanged = true
+			fr.FnvFingerprint = link.LastFingerprint
+			f.storeFetchResults(fr)
+			return true, time.Now()
+		}
 
 		// There are some logical problems with this handler call.  For
 		// example, the page we're fetching could have been rejected by the
@@ -520,18 +1190,42 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 		// !f.isHandleable(fr.Response). BUT, then stored when we go back with
 		// a 304. By definition a 304 is never MetaNoIndex, and f.isHandleable
 		// always returns false. May need to address in the future.
-		f.fm.Handler.HandleResponse(fr)
+		f.handle(fr)
+		f.storeFetchResults(fr)
 
 		return true, time.Now()
 	}
 
+	if f.rejectsType(fr) {
+		log4go.Debug("Not downloading %v, its Content-Type %q wasn't asked for", link,
+			fr.Response.Header.Get("Content-Type"))
+		fr.Response.Body.Close()
+		fr.Response.Body = ioutil.NopCloser(strings.NewReader(""))
+		fr.MimeType = getMimeType(fr.Response)
+		fr.TypeRejected = true
+		f.fm.reporter.typeSkipped()
+		f.storeFetchResults(fr)
+		return true, time.Now()
+	}
+
 	//
 	// Nab the body of the request, and compute fingerprint
 	//
-	fr.FetchError = f.fillReadBuffer(fr.Response.Body, fr.Response.Header)
+	if f.rangeFetchable(fr.Response) && contentLength(fr.Response.Header) > Config.Fetcher.MaxHTTPContentSizeBytes {
+		f.fetchRange(fr)
+	} else {
+		fr.FetchError = f.fillReadBuffer(fr.Response.Body, fr.Response.Header)
+		if fr.FetchError == errContentTooLarge && f.rangeFetchable(fr.Response) {
+			// The size wasn't known up front; keep just the start of it
+			f.readBuffer.Truncate(int(Config.Fetcher.RangeFetchBytes))
+			fr.Partial = true
+			fr.FetchError = nil
+		}
+	}
+	fr.ResponseTime = time.Since(fr.FetchTime)
 	if fr.FetchError != nil {
 		log4go.Debug("Error reading body of %v: %v", link, fr.FetchError)
-		f.fm.Datastore.StoreURLFetchResults(fr)
+		f.storeFetchResults(fr)
 		return true, time.Now()
 	}
 
@@ -540,10 +1234,14 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 	crawlDelayClockStart := time.Now()
 
 	fr.MimeType = getMimeType(fr.Response)
+	fr.ContentSize = int64(f.readBuffer.Len())
+	for _, v := range fr.Response.Header[http.CanonicalHeaderKey("X-Robots-Tag")] {
+		parseRobotsDirectives(v).applyTo(fr)
+	}
 
 	// Replace the response body so the handler can read it.
 	fr.Response.Body = ioutil.NopCloser(bytes.NewReader(f.readBuffer.Bytes()))
-	if Config.Cassandra.StoreResponseBody {
+	if Config.Cassandra.StoreResponseBody || fr.Sampled {
 		fr.Body = string(f.readBuffer.Bytes())
 	}
 
@@ -554,24 +1252,114 @@ func (f *fetcher) fetchAndHandle(link *URL, robots *robotstxt.Group) (bool, time
 	fnv.Write(f.readBuffer.Bytes())
 	fr.FnvFingerprint = int64(fnv.Sum64())
 
+	if Config.Fetcher.SkipUnchangedPages && link.LastFingerprint != 0 && link.LastFingerprint == fr.FnvFingerprint {
+		log4go.Fine("Not parsing or handling %v, its content is unchanged since it was last crawled", link)
+		fr.Unchanged = true
+		f.storeFetchResults(fr)
+		return true, crawlDelayClockStart
+	}
+
 	//
 	// Handle html and generic handlers
 	//
+	f.outlinks = f.outlinks[:0]
 	if isHTML(fr.Response) {
 		log4go.Fine("Reading and parsing as HTML (%v)", link)
 		f.parseLinks(f.readBuffer.Bytes(), fr)
+	} else if parsesPDF(fr.MimeType) {
+		log4go.Fine("Reading and parsing as PDF (%v)", link)
+		f.parsePDFLinks(f.readBuffer.Bytes(), fr)
+	} else if Config.Fetcher.ExtractImageMetadata && strings.HasPrefix(fr.MimeType, "image/") {
+		log4go.Fine("Reading image metadata (%v)", link)
+		fr.Image = parseImage(f.readBuffer.Bytes())
 	}
 
-	if !(Config.Fetcher.HonorMetaNoindex && fr.MetaNoIndex) && f.isHandleable(fr.Response) {
-		f.fm.Handler.HandleResponse(fr)
+	handleable := f.isHandleable(fr.Response)
+	if !handleable {
+		f.fm.reporter.typeSkipped()
+	}
+	if !(Config.Fetcher.HonorMetaNoindex && fr.MetaNoIndex) && handleable {
+		f.trackPage(fr, f.readBuffer.Bytes())
+		if Config.Fetcher.Differential && fr.Unchanged {
+			log4go.Fine("Not handling %v, unchanged since it was last crawled", link)
+		} else {
+			f.handle(fr)
+		}
+		f.storePageState(fr)
 	}
 
+	f.captureScreenshot(fr)
+
 	//TODO: Wrap the reader and check for read error here
 	log4go.Fine("Storing fetch results for %v", link)
-	f.fm.Datastore.StoreURLFetchResults(fr)
+	f.storeFetchResults(fr)
 	return true, crawlDelayClockStart
 }
 
+// errContentTooLarge is the FetchError of responses larger than
+// MaxHTTPContentSizeBytes
+var errContentTooLarge = errors.New("Content size exceeded MaxHTTPContentSizeBytes")
+
+// contentLength returns the Content-Length given in headers, or -1 if there
+// isn't a valid one
+func contentLength(headers http.Header) int64 {
+	var size int64
+	if n, err := fmt.Sscanf(headers.Get("Content-Length"), "%d", &size); n != 1 || err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// rangeFetchable returns true if, should res be too large to fetch, the start
+// of it should be fetched instead (see fetcher.range_fetch_bytes)
+func (f *fetcher) rangeFetchable(res *http.Response) bool {
+	if Config.Fetcher.RangeFetchBytes <= 0 || res.StatusCode != http.StatusOK {
+		return false
+	}
+	matched, err := f.fm.rangeFetchTypes.Match(getMimeType(res))
+	return err == nil && matched
+}
+
+// fetchRange replaces fr.Response, which is too large to read, with a ranged
+// GET of its first Config.Fetcher.RangeFetchBytes, read into readBuffer. If
+// the server ignores the Range header only that much of the body is read.
+func (f *fetcher) fetchRange(fr *FetchResults) {
+	fr.Response.Body.Close()
+	n := Config.Fetcher.RangeFetchBytes
+
+	u := fr.URL
+	if fr.Response.Request != nil {
+		// Don't follow the redirects again
+		u = &URL{URL: fr.Response.Request.URL}
+	}
+	req, err := f.newRequest(u)
+	if err != nil {
+		fr.FetchError = err
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", n-1))
+	log4go.Fine("Fetching the first %d bytes of %v", n, u)
+	res, err := f.httpclient.Do(req)
+	if err != nil {
+		fr.FetchError = err
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
+		log4go.Debug("Ranged GET of %v answered %v", u, res.Status)
+		fr.FetchError = errContentTooLarge
+		return
+	}
+	fr.Response = res
+
+	f.readBuffer.Reset()
+	if _, err := f.readBuffer.ReadFrom(io.LimitReader(res.Body, n)); err != nil {
+		fr.FetchError = err
+		return
+	}
+	fr.Partial = true
+}
+
 //
 // fillReadBuffer will fill up readBuffer with the contents of reader. Any
 // problems with the read will be returned in an error; including (and
@@ -586,7 +1374,7 @@ func (f *fetcher) fillReadBuffer(reader io.Reader, headers http.Header) error {
 		if n != 1 || err != nil || size < 0 {
 			log4go.Error("Failed to process Content-Length: %v", err)
 		} else if size > Config.Fetcher.MaxHTTPContentSizeBytes {
-			return fmt.Errorf("Content size exceeded MaxHTTPContentSizeBytes")
+			return errContentTooLarge
 		} else {
 			f.readBuffer.Grow(int(size))
 		}
@@ -597,60 +1385,84 @@ func (f *fetcher) fillReadBuffer(reader io.Reader, headers http.Header) error {
 	if err != nil {
 		return err
 	} else if n > Config.Fetcher.MaxHTTPContentSizeBytes {
-		return fmt.Errorf("Content size exceeded MaxHTTPContentSizeBytes")
+		return errContentTooLarge
 	}
 
 	return nil
 }
 
 func (f *fetcher) resetTransport() {
-	if f.fm.TransNoKeepAlive != nil {
-		f.httpclient.Transport = f.fm.TransNoKeepAlive
+	if f.transNoKeepAlive != nil {
+		f.httpclient.Transport = f.transNoKeepAlive
 	}
 }
 
 func (f *fetcher) setTransportFromCrawlDelay(crawlDelay time.Duration) {
-	if f.fm.TransNoKeepAlive != nil {
+	if f.transNoKeepAlive != nil {
 		if crawlDelay > f.fm.KeepAliveThreshold {
-			f.httpclient.Transport = f.fm.TransNoKeepAlive
+			f.httpclient.Transport = f.transNoKeepAlive
 		} else {
-			f.httpclient.Transport = f.fm.Transport
+			f.httpclient.Transport = f.transport
 		}
 	}
 }
 
-// initializeRobotsMap inits the robotsMap system
-func (f *fetcher) initializeRobotsMap(host string) {
+// initializeRobotsMap inits the robotsMap system. It returns false if the
+// host is held back because its robots.txt is unavailable (see
+// fetcher.robots_error_policy).
+func (f *fetcher) initializeRobotsMap(host string) bool {
+
+	f.delayOverride = f.fm.Datastore.CrawlDelayOverride(host)
+	if f.delayOverride > 0 {
+		log4go.Info("Using crawl delay override of %v for %v", f.delayOverride, host)
+	}
 
 	// Set default robots
 	rdata, _ := robotstxt.FromBytes([]byte("User-agent: *\n"))
 	f.defRobots = rdata.FindGroup(Config.Fetcher.UserAgent)
 	f.defRobots.CrawlDelay = f.fm.defCrawlDelay
+	if f.delayOverride > 0 {
+		f.defRobots.CrawlDelay = f.delayOverride
+	} else if f.fm.Datastore.BurstMode(host) {
+		log4go.Info("%v is in burst mode, using crawl delay %v where robots.txt sets none", host,
+			f.fm.burstCrawlDelay)
+		f.defRobots.CrawlDelay = f.fm.burstCrawlDelay
+	}
 
 	// try read $host/robots.txt. Failure to GET, will just returns
 	// f.defRobots before call
 	f.resetTransport()
 	f.robotsMap = map[string]*robotstxt.Group{}
-	f.defRobots = f.getRobots(host)
+	grp := f.decideRobots(host)
+	if grp == nil {
+		return false
+	}
+	f.defRobots = grp
 	f.robotsMap[host] = f.defRobots
 	f.setTransportFromCrawlDelay(f.defRobots.CrawlDelay)
+	return true
 }
 
-// fetchRobots is a caching version of getRobots
+// fetchRobots is a caching version of getRobots, returning nil if host is
+// held back
 func (f *fetcher) fetchRobots(host string) *robotstxt.Group {
 	rob, robOk := f.robotsMap[host]
 	if !robOk {
 		f.resetTransport()
-		rob = f.getRobots(host)
+		rob = f.decideRobots(host)
 		f.robotsMap[host] = rob
 	}
-	f.setTransportFromCrawlDelay(rob.CrawlDelay)
+	if rob != nil {
+		f.setTransportFromCrawlDelay(rob.CrawlDelay)
+	}
 	return rob
 }
 
 // getRobots will return the robotstxt.Group for the given host, or the
-// default robotstxt.Group if the host doesn't support robots.txt
-func (f *fetcher) getRobots(host string) *robotstxt.Group {
+// default robotstxt.Group if the host doesn't support robots.txt, along with
+// the RobotsDecision taken. The group is nil if fetcher.robots_error_policy
+// holds the host back.
+func (f *fetcher) getRobots(host string) (*robotstxt.Group, string) {
 
 	u := &URL{
 		URL: &url.URL{
@@ -661,17 +1473,65 @@ func (f *fetcher) getRobots(host string) *robotstxt.Group {
 		LastCrawled: NotYetCrawled, //explicitly set this so that fetcher.fetch won't send If-Modified-Since
 	}
 
-	res, _, err := f.fetch(u)
-	gotRobots := err == nil && res.StatusCode >= 200 && res.StatusCode < 300
-	if !gotRobots {
-		if err != nil {
-			log4go.Debug("Could not fetch %v, assuming there is no robots.txt (error: %v)", u, err)
+	if body, ok := f.warmRobots[host]; ok {
+		log4go.Fine("Using handed over robots.txt for %v", host)
+		if body == nil {
+			return f.defRobots, RobotsDecisionHandedOver
+		}
+		return f.parseRobots(u, http.StatusOK, body), RobotsDecisionHandedOver
+	}
+
+	rfc := Config.Fetcher.RobotsErrorPolicy == RobotsErrorPolicyRFC
+	status, body, err := f.getRobotsTxt(u)
+	switch {
+	case err != nil && rfc:
+		log4go.Debug("Could not fetch %v, holding %v back (error: %v)", u, host, err)
+		return nil, RobotsDecisionUnreachable
+	case err != nil:
+		log4go.Debug("Could not fetch %v, assuming there is no robots.txt (error: %v)", u, err)
+		return f.defRobots, RobotsDecisionAssumedAllowed
+	case status >= 500 && rfc:
+		log4go.Debug("%v answered %v, holding %v back", u, status, host)
+		return nil, RobotsDecisionUnavailable
+	case status >= 500:
+		f.noteRobots(host, nil)
+		return f.defRobots, RobotsDecisionAssumedAllowed
+	case status < 200 || status >= 300:
+		f.noteRobots(host, nil)
+		return f.defRobots, RobotsDecisionMissing
+	}
+
+	f.fm.Datastore.StoreRobotsTxt(host, body)
+	f.noteRobots(host, body)
+
+	grp := f.parseRobots(u, status, body)
+	f.checkRobotsBlocked(host, grp)
+	return grp, RobotsDecisionFetched
+}
+
+// checkRobotsBlocked fires WebhookRobotsBlocked if grp, parsed from the
+// robots.txt just fetched for host, disallows "/" where the one handed over
+// for it in the HostContext didn't
+func (f *fetcher) checkRobotsBlocked(host string, grp *robotstxt.Group) {
+	last, ok := f.lastRobots[host]
+	if !ok || grp.Test("/") {
+		return
+	}
+	if last != nil {
+		robots, err := robotstxt.FromBytes(last)
+		if err == nil && !robots.FindGroup(Config.Fetcher.UserAgent).Test("/") {
+			return
 		}
-		return f.defRobots
 	}
+	FireWebhook(NewWebhookEvent(WebhookRobotsBlocked, f.host,
+		fmt.Sprintf("robots.txt of %v now disallows crawling it", host),
+		map[string]interface{}{"host": host}))
+}
 
-	robots, err := robotstxt.FromResponse(res)
-	res.Body.Close()
+// parseRobots returns the robotstxt.Group for our user agent in the robots.txt
+// body fetched from u, or the default robotstxt.Group if it can't be parsed
+func (f *fetcher) parseRobots(u *URL, status int, body []byte) *robotstxt.Group {
+	robots, err := robotstxt.FromStatusAndBytes(status, body)
 	if err != nil {
 		log4go.Debug("Error parsing robots.txt (%v) assuming there is no robots.txt: %v", u, err)
 		return f.defRobots
@@ -682,18 +1542,130 @@ func (f *fetcher) getRobots(host string) *robotstxt.Group {
 	if grp.CrawlDelay > max {
 		grp.CrawlDelay = max
 	}
+	// An operator-set override wins over robots.txt, and isn't limited by
+	// max_crawl_delay
+	if f.delayOverride > 0 {
+		grp.CrawlDelay = f.delayOverride
+	}
 
 	return grp
 }
 
-func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
+// noteRobots records the robots.txt body fetched for host (nil if it has
+// none), to be handed over in the HostContext
+func (f *fetcher) noteRobots(host string, body []byte) {
+	if f.robotsBodies == nil {
+		f.robotsBodies = map[string][]byte{}
+	}
+	f.robotsBodies[host] = body
+	if f.robotsTime.IsZero() {
+		f.robotsTime = time.Now()
+	}
+}
+
+// loadHostContext picks up the HostContext the last fetcher to crawl host
+// stored: its DNS resolutions are seeded into the DNS cache, and, unless they
+// are older than fetcher.host_context_ttl, its robots.txt bodies are used by
+// getRobots instead of fetching them again.
+func (f *fetcher) loadHostContext(host string) {
+	f.robotsMap = map[string]*robotstxt.Group{}
+	f.robotsBodies = map[string][]byte{}
+	f.warmRobots = map[string][]byte{}
+	f.lastRobots = map[string][]byte{}
+	f.robotsTime = time.Time{}
+	if f.fm.hostContextTTL <= 0 {
+		return
+	}
+
+	hc := f.fm.Datastore.LoadHostContext(host)
+	if hc == nil {
+		return
+	}
+	if f.fm.dnsCache != nil {
+		for addr, ipaddr := range hc.Addrs {
+			f.fm.dnsCache.Seed("tcp", addr, ipaddr)
+		}
+	}
+	for h, body := range hc.Robots {
+		f.lastRobots[h] = body
+	}
+	for _, h := range hc.NoRobots {
+		f.lastRobots[h] = nil
+	}
+	if time.Since(hc.RobotsTime) >= f.fm.hostContextTTL {
+		return
+	}
+	for h, body := range hc.Robots {
+		f.warmRobots[h] = body
+		f.robotsBodies[h] = body
+	}
+	for _, h := range hc.NoRobots {
+		f.warmRobots[h] = nil
+		f.robotsBodies[h] = nil
+	}
+	f.robotsTime = hc.RobotsTime
+	log4go.Info("Reusing robots.txt of %v hosts for %v (last crawl delay %v)", len(f.warmRobots), host,
+		hc.CrawlDelay)
+}
+
+// storeHostContext hands what this fetcher learned crawling host over to the
+// next fetcher to claim it; see loadHostContext
+func (f *fetcher) storeHostContext(host string) {
+	if f.fm.hostContextTTL <= 0 || len(f.robotsBodies) == 0 {
+		return
+	}
+
+	hc := &HostContext{
+		Robots:     map[string][]byte{},
+		Addrs:      map[string]string{},
+		RobotsTime: f.robotsTime,
+	}
+	if grp, ok := f.robotsMap[host]; ok {
+		hc.CrawlDelay = grp.CrawlDelay
+	}
+	for h, body := range f.robotsBodies {
+		if body == nil {
+			hc.NoRobots = append(hc.NoRobots, h)
+		} else {
+			hc.Robots[h] = body
+		}
+		if f.fm.dnsCache == nil {
+			continue
+		}
+		for _, port := range []string{"80", "443"} {
+			addr := net.JoinHostPort(h, port)
+			if ipaddr, ok := f.fm.dnsCache.Addr("tcp", addr); ok {
+				hc.Addrs[addr] = ipaddr
+			}
+		}
+	}
+	f.fm.Datastore.StoreHostContext(host, hc)
+}
+
+// newRequest returns a GET of u with the headers every fetch sends
+func (f *fetcher) newRequest(u *URL) (*http.Request, error) {
+	link := u.String()
+	if r := hashRouteRenderURL(u); r != "" {
+		log4go.Fine("Fetching hash route %v from %v", u, r)
+		link = r
+	}
+	req, err := http.NewRequest("GET", link, nil)
 	if err != nil {
-		return nil, nil, fmt.Errorf("Failed to create new request object for %v): %v", u, err)
+		return nil, fmt.Errorf("Failed to create new request object for %v): %v", u, err)
 	}
 
 	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
-	req.Header.Set("Accept", strings.Join(Config.Fetcher.AcceptFormats, ","))
+	if f.fm.acceptHeader != "" {
+		req.Header.Set("Accept", f.fm.acceptHeader)
+	}
+	return req, nil
+}
+
+func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
+	req, err := f.newRequest(u)
+	if err != nil {
+		return nil, nil, err
+	}
 	if !u.LastCrawled.Equal(NotYetCrawled) {
 		// Date format used is RFC1123 as specified by
 		// http://www.w3.org/Protocols/rfc2616/rfc2616-sec3.html#sec3.3.1
@@ -703,17 +1675,104 @@ func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
 
 	var redirectedFrom []*URL
 	f.httpclient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := checkHeaderCount(req.Response.Header); err != nil {
+			return err
+		}
+		if !Config.Fetcher.FollowRedirects {
+			return http.ErrUseLastResponse
+		}
 		redirectedFrom = append(redirectedFrom, &URL{URL: req.URL})
 		return nil
 	}
 
 	res, err := f.httpclient.Do(req)
 	if err != nil {
+		return nil, nil, headerLimitErr(err)
+	}
+	if err := checkHeaderCount(res.Header); err != nil {
+		res.Body.Close()
 		return nil, nil, err
 	}
 	return res, redirectedFrom, nil
 }
 
+// HeaderLimitError is the FetchError of responses whose headers exceed
+// fetcher.max_response_header_bytes or fetcher.max_response_headers. The
+// response is abandoned as soon as the limit is found to be exceeded.
+type HeaderLimitError struct {
+	// What was exceeded, ex. "200 header lines"
+	Limit string
+}
+
+func (e *HeaderLimitError) Error() string {
+	return fmt.Sprintf("Response headers exceeded %v", e.Limit)
+}
+
+// IsHeaderLimitError returns true if err is (or wraps) a *HeaderLimitError
+func IsHeaderLimitError(err error) bool {
+	var hl *HeaderLimitError
+	return errors.As(err, &hl)
+}
+
+// checkHeaderCount returns a *HeaderLimitError if header has more than
+// fetcher.max_response_headers lines
+func checkHeaderCount(header http.Header) error {
+	n := 0
+	for _, values := range header {
+		n += len(values)
+	}
+	if n > Config.Fetcher.MaxResponseHeaders {
+		return &HeaderLimitError{Limit: fmt.Sprintf("%d header lines", Config.Fetcher.MaxResponseHeaders)}
+	}
+	return nil
+}
+
+// headerLimitErr returns a *HeaderLimitError in place of the error net/http
+// gives when a response's headers exceed the transport's
+// MaxResponseHeaderBytes, and err as it is otherwise
+func headerLimitErr(err error) error {
+	if strings.Contains(err.Error(), "server response headers exceeded") {
+		return &HeaderLimitError{Limit: fmt.Sprintf("%d bytes", Config.Fetcher.MaxResponseHeaderBytes)}
+	}
+	return err
+}
+
+// redirectStatuses returns the statuses of the redirects followed to get res,
+// in the order they were followed
+func redirectStatuses(res *http.Response) []int {
+	var statuses []int
+	for req := res.Request; req != nil && req.Response != nil; req = req.Response.Request {
+		statuses = append([]int{req.Response.StatusCode}, statuses...)
+	}
+	return statuses
+}
+
+// redirectTarget returns the absolute URL res redirects link to, or nil if
+// res isn't a redirect (3xx with a Location other than 304)
+func redirectTarget(res *http.Response, link *URL) *URL {
+	if res.StatusCode/100 != 3 || res.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	loc := res.Header.Get("Location")
+	if loc == "" {
+		return nil
+	}
+	to, err := ParseAndNormalizeURL(loc)
+	if err != nil {
+		log4go.Debug("Ignoring bad Location %q of %v: %v", loc, link, err)
+		return nil
+	}
+	to.MakeAbsolute(link)
+	return to
+}
+
+// IsPermanentRedirect returns true if status redirects permanently (301 or
+// 308), so the link redirected is expected to keep redirecting to the same
+// place
+func IsPermanentRedirect(status int) bool {
+	return status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect
+}
+
 // shouldStoreParsedLink returns true if the argument URL should
 // be stored in datastore. The link can (currently) be rejected
 // because
@@ -721,25 +1780,9 @@ func (f *fetcher) fetch(u *URL) (*http.Response, []*URL, error) {
 //   (*) if the path matches exclude_link_patterns and doesn't match include_link_patterns.
 //   (*) the link's path is longer than (the positive) Config.Fetcher.MaxPathLength variable
 //
+// These are the rules of linkFilter, which FilterLink reports on.
 func (f *fetcher) shouldStoreParsedLink(u *URL) bool {
-	path := u.RequestURI()
-	if Config.Fetcher.MaxPathLength > 0 && len(path) > Config.Fetcher.MaxPathLength {
-		return false
-	}
-
-	include := !(f.excludeLink != nil && f.excludeLink.MatchString(path)) ||
-		(f.includeLink != nil && f.includeLink.MatchString(path))
-	if !include {
-		return false
-	}
-
-	for _, f := range Config.Fetcher.AcceptProtocols {
-		if u.Scheme == f {
-			return true
-		}
-	}
-
-	return false
+	return f.linkFilter.check(u, nil)
 }
 
 // checkForBlacklisting returns true if this site is blacklisted or should be
@@ -755,7 +1798,11 @@ func (f *fetcher) shouldStoreParsedLink(u *URL) bool {
 // TODO: write back to the database that this domain has been blacklisted so we
 // don't just keep re-dispatching it
 func (f *fetcher) checkForBlacklisting(host string) bool {
-	t, ok := f.fm.Transport.(*http.Transport)
+	if f.fm.pinnedAddr(host) != "" {
+		// Pinned on purpose, often to a private staging address
+		return false
+	}
+	t, ok := f.transport.(*http.Transport)
 	if !ok {
 		// We need to get the transport's Dial function in order to check the
 		// IP address
@@ -778,14 +1825,40 @@ func (f *fetcher) checkForBlacklisting(host string) bool {
 	return false
 }
 
+// rejectsType returns true if the body of fr.Response shouldn't be downloaded
+// because its Content-Type is one the crawl didn't ask for (see
+// fetcher.reject_unaccepted_types)
+func (f *fetcher) rejectsType(fr *FetchResults) bool {
+	if !Config.Fetcher.RejectUnacceptedTypes || fr.Sampled {
+		return false
+	}
+	mimeType := getMimeType(fr.Response)
+	if mimeType == "" {
+		// Nothing to go by until the body is read
+		return false
+	}
+	if parsesPDF(mimeType) ||
+		Config.Fetcher.ExtractImageMetadata && strings.HasPrefix(mimeType, "image/") {
+		return false
+	}
+	for _, formats := range []*mimetools.Matcher{f.fm.acceptFormats, f.fm.handlerFormats} {
+		if matched, err := formats.Match(mimeType); err == nil && matched {
+			return false
+		}
+	}
+	return true
+}
+
+// isHandleable returns true if r's Content-Type is one handlers are given
+// (see fetcher.handler_formats)
 func (f *fetcher) isHandleable(r *http.Response) bool {
 	for _, ct := range r.Header["Content-Type"] {
-		matched, err := f.fm.acceptFormats.Match(ct)
+		matched, err := f.fm.handlerFormats.Match(ct)
 		if err == nil && matched {
 			return true
 		}
 	}
 	ctype := strings.Join(r.Header["Content-Type"], ",")
-	log4go.Fine("URL (%v) did not match accepted content types, had: %v", r.Request.URL, ctype)
+	log4go.Fine("URL (%v) did not match handled content types, had: %v", r.Request.URL, ctype)
 	return false
 }
@@ -1,13 +1,30 @@
+//go:build sudo
 // +build sudo
 
 package walker
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,6 +54,15 @@ type LinkSpec struct {
 
 	// This should be true if this link is a robots.txt path
 	robots bool
+
+	// Position of this link in a pagination chain
+	chainPos int
+
+	// How many links away from a seed this link was found
+	depth int
+
+	// FNV fingerprint of the link's content when last crawled
+	fingerprint int64
 }
 
 // DomainSpec describes a mocked domain
@@ -74,6 +100,45 @@ type TestSpec struct {
 
 	// true means do not mock a remote server during this particular test
 	suppressMockServer bool
+
+	// This should be true if the mocked datastore should report every host
+	// as having exceeded its download quota
+	quotaExceeded bool
+
+	// The crawl delay override the mocked datastore returns for every host
+	crawlDelayOverride time.Duration
+
+	// True if the mocked datastore reports every host as in burst mode
+	burst bool
+
+	// Host contexts the mocked datastore starts with, by host
+	hostContexts map[string]*HostContext
+
+	// Page states the mocked datastore starts with, by link
+	pageStates map[string]*PageState
+
+	// Sites to serve from the mock server and crawl, each claimed as its own
+	// domain after those in hosts
+	sites []*TestSite
+
+	// If set, the handler implements HandlerV2, and HandleFetch returns what
+	// this does (calls are still recorded by the mock handler)
+	handleFetch func(fr *FetchResults) error
+
+	// Options applied to the FetchManager before it is run
+	options []Option
+}
+
+// mockHandlerV2 is a MockHandler implementing HandlerV2 for
+// TestSpec.handleFetch
+type mockHandlerV2 struct {
+	*MockHandler
+	handleFetch func(fr *FetchResults) error
+}
+
+func (h mockHandlerV2) HandleFetch(fr *FetchResults) error {
+	h.MockHandler.HandleResponse(fr)
+	return h.handleFetch(fr)
 }
 
 //
@@ -218,6 +283,26 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 
 	if !test.hasNoLinks {
 		ds.On("StoreURLFetchResults", mock.AnythingOfType("*walker.FetchResults")).Return()
+		ds.On("HostQuotaExceeded", mock.AnythingOfType("string")).Return(test.quotaExceeded)
+	}
+	ds.HostContexts = test.hostContexts
+	ds.PageStates = test.pageStates
+	if test.crawlDelayOverride > 0 {
+		ds.CrawlDelays = map[string]time.Duration{}
+		for _, host := range test.hosts {
+			ds.CrawlDelays[host.domain] = test.crawlDelayOverride
+		}
+	}
+	if test.burst {
+		ds.Bursts = map[string]bool{}
+		for _, host := range test.hosts {
+			ds.Bursts[host.domain] = true
+		}
+	}
+	for _, site := range test.sites {
+		for _, p := range site.Pages {
+			test.hasParsedLinks = test.hasParsedLinks || len(p.Links) > 0
+		}
 	}
 	if test.hasParsedLinks {
 		ds.On("StoreParsedURL",
@@ -239,6 +324,9 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 				if link.lastCrawled != zero {
 					u.LastCrawled = link.lastCrawled
 				}
+				u.ChainPos = link.chainPos
+				u.Depth = link.depth
+				u.LastFingerprint = link.fingerprint
 				urls = append(urls, u)
 			}
 
@@ -252,6 +340,15 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 		ds.On("UnclaimHost", host.domain).Return()
 
 	}
+	for _, site := range test.sites {
+		dom := site.Domain()
+		ds.On("ClaimNewHost").Return(dom).Once()
+		ds.On("LinksForHost", dom).Return(site.Links())
+		ds.On("UnclaimHost", dom).Return()
+		if !test.suppressMockServer {
+			site.Register(rs)
+		}
+	}
 	// This last call will make ClaimNewHost return "" on each subsequent call,
 	// which will put the fetcher to sleep.
 	ds.On("ClaimNewHost").Return("")
@@ -268,15 +365,24 @@ func runFetcherTimed(test TestSpec, duration time.Duration, t *testing.T) TestRe
 		}
 	}
 
+	var handler Handler = h
+	if test.handleFetch != nil {
+		handler = mockHandlerV2{h, test.handleFetch}
+	}
 	manager := &FetchManager{
 		Datastore: ds,
-		Handler:   h,
+		Handler:   handler,
 		Transport: transport,
 	}
 
 	if test.transNoKeepAlive != nil {
 		manager.TransNoKeepAlive = test.transNoKeepAlive
 	}
+	for _, opt := range test.options {
+		if err := opt(manager); err != nil {
+			t.Fatalf("Failed to apply option: %v", err)
+		}
+	}
 
 	zeroDur := 0 * time.Second
 	if duration == zeroDur {
@@ -813,10 +919,12 @@ func TestRedirects(t *testing.T) {
 		return fmt.Sprintf("http://sub.dom.com/page%d.html", index)
 	}
 
+	moved := response307(link(3))
+	moved.Status, moved.StatusCode = "301", http.StatusMovedPermanently
 	roundTriper := mapRoundTrip{
 		Responses: map[string]*http.Response{
 			link(1): response307(link(2)),
-			link(2): response307(link(3)),
+			link(2): moved,
 			link(3): response200(),
 		},
 	}
@@ -847,11 +955,60 @@ func TestRedirects(t *testing.T) {
 	if fr.RedirectedFrom[1].String() != link(3) {
 		t.Errorf("RedirectedFrom[0] mismatch, got %q, expected %q", fr.RedirectedFrom[1].String(), link(3))
 	}
+	if fmt.Sprint(fr.RedirectStatuses) != "[307 301]" {
+		t.Errorf("RedirectStatuses mismatch, got %v, expected [307 301]", fr.RedirectStatuses)
+	}
 
 	results.assertExpectations(t)
 
 }
 
+func TestRedirectsNotFollowed(t *testing.T) {
+	orig := Config.Fetcher.FollowRedirects
+	defer func() { Config.Fetcher.FollowRedirects = orig }()
+	Config.Fetcher.FollowRedirects = false
+
+	moved := response307("/page2.html")
+	moved.Status, moved.StatusCode = "301", http.StatusMovedPermanently
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://sub.dom.com/page1.html": moved,
+			"http://sub.dom.com/page2.html": response200(),
+		},
+	}
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://sub.dom.com/page1.html", nil),
+	}
+
+	results := runFetcher(tests, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 fetch stored, got %v", len(frs))
+	}
+	fr := frs[0]
+	if len(fr.RedirectedFrom) != 0 {
+		t.Errorf("Expected the redirect not to be followed, got RedirectedFrom %v", fr.RedirectedFrom)
+	}
+	if fr.Response.StatusCode != http.StatusMovedPermanently {
+		t.Errorf("Expected the 301 to be the fetch's response, got %v", fr.Response.StatusCode)
+	}
+	if fr.RedirectedTo == nil || fr.RedirectedTo.String() != "http://sub.dom.com/page2.html" {
+		t.Errorf("RedirectedTo mismatch, got %v, expected http://sub.dom.com/page2.html", fr.RedirectedTo)
+	}
+	if fmt.Sprint(fr.RedirectStatuses) != "[301]" {
+		t.Errorf("RedirectStatuses mismatch, got %v, expected [301]", fr.RedirectStatuses)
+	}
+
+	links, _ := results.dsStoreParsedURLCalls()
+	if len(links) != 1 || links[0].String() != "http://sub.dom.com/page2.html" {
+		t.Errorf("Expected the redirect target stored as a parsed link, got %v", links)
+	}
+}
+
 func TestHrefWithSpace(t *testing.T) {
 	testPage := "http://t.com/page1.html"
 	const html_with_href_space = `<!DOCTYPE html>
@@ -1640,6 +1797,39 @@ func TestStoreBody(t *testing.T) {
 	}
 }
 
+func TestSamplePercentage(t *testing.T) {
+	origBody := Config.Cassandra.StoreResponseBody
+	origPercentage := Config.Fetcher.SamplePercentage
+	defer func() {
+		Config.Cassandra.StoreResponseBody = origBody
+		Config.Fetcher.SamplePercentage = origPercentage
+	}()
+	Config.Cassandra.StoreResponseBody = false
+	Config.Fetcher.SamplePercentage = 100
+	html := `<html><body>Sampled for QA</body></html>`
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		hosts: singleLinkDomainSpecArr("http://a.com/page1.com", &MockResponse{
+			Body: html,
+		}),
+	}
+
+	results := runFetcher(tests, t)
+
+	stores := results.dsStoreURLFetchResultsCalls()
+	if len(stores) != 1 {
+		t.Fatalf("Expected select for a.com to render a single result, instead got %d results", len(stores))
+	}
+	fr := stores[0]
+	if !fr.Sampled {
+		t.Errorf("Expected fetch to be sampled with fetcher.sample_percentage at 100")
+	}
+	if fr.Body != html {
+		t.Errorf("Expected sampled fetch to keep its body, got %q", fr.Body)
+	}
+}
+
 func TestKeepAliveThreshold(t *testing.T) {
 	origKeepAlive := Config.Fetcher.HTTPKeepAlive
 	origThreshold := Config.Fetcher.HTTPKeepAliveThreshold
@@ -1878,3 +2068,2616 @@ func TestBugTrn210(t *testing.T) {
 		t.Errorf("Failed to find link %v", link)
 	}
 }
+
+func TestHostQuotaExceeded(t *testing.T) {
+	tests := TestSpec{
+		hasParsedLinks: false,
+		quotaExceeded:  true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://a.com/robots.txt",
+						response: &MockResponse{Status: 404},
+						robots:   true,
+					},
+
+					LinkSpec{
+						url:      "http://a.com/page1.html",
+						response: &MockResponse{Body: "<html><body>Hello</body></html>"},
+					},
+
+					LinkSpec{
+						url:      "http://a.com/page2.html",
+						response: &MockResponse{Body: "<html><body>Hello</body></html>"},
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcher(tests, t)
+
+	if stores := results.dsStoreURLFetchResultsCalls(); len(stores) != 0 {
+		t.Errorf("Expected no fetch results to be stored for host over quota, got %d", len(stores))
+	}
+	if calls := results.handlerCalls(); len(calls) != 0 {
+		t.Errorf("Expected no handler calls for host over quota, got %d", len(calls))
+	}
+	results.datastore.AssertCalled(t, "UnclaimHost", "a.com")
+}
+
+func TestRedirectorExpansion(t *testing.T) {
+	origHosts := Config.Fetcher.RedirectorHosts
+	origHops := Config.Fetcher.MaxRedirectorHops
+	defer func() {
+		Config.Fetcher.RedirectorHosts = origHosts
+		Config.Fetcher.MaxRedirectorHops = origHops
+	}()
+	Config.Fetcher.RedirectorHosts = []string{"short.ly"}
+	Config.Fetcher.MaxRedirectorHops = 1
+
+	const html string = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>Title</title>
+</head>
+<body>
+	<div id="menu">
+		<a href="http://short.ly/abc">shortened</a>
+		<a href="http://short.ly/chain">too many hops</a>
+		<a href="http://t1.com/plain">plain</a>
+	</div>
+</body>
+</html>`
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(html))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/target.html": page,
+			"http://short.ly/abc":       response307("http://t2.com/dest"),
+			"http://t2.com/dest":        response200(),
+			"http://short.ly/chain":     response307("http://short.ly/chain2"),
+			"http://short.ly/chain2":    response307("http://t2.com/far"),
+		},
+	}
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/target.html", nil),
+	}
+
+	results := runFetcher(tests, t)
+
+	expected := map[string]bool{
+		"http://t2.com/dest":     true,
+		"http://short.ly/chain2": true,
+		"http://t1.com/plain":    true,
+	}
+
+	ulst, frlst := results.dsStoreParsedURLCalls()
+	for i := range ulst {
+		u := ulst[i]
+		if expected[u.String()] {
+			delete(expected, u.String())
+		} else {
+			t.Errorf("StoreParsedURL mismatch found unexpected link %q", u.String())
+		}
+	}
+	for e := range expected {
+		t.Errorf("StoreParsedURL expected to see %q, but didn't", e)
+	}
+
+	if len(frlst) < 1 {
+		t.Fatalf("Expected StoreParsedURL calls, but found none")
+	}
+	exps := frlst[0].ExpandedLinks
+	if len(exps) != 2 {
+		t.Fatalf("ExpandedLinks length mismatch, got %d, expected %d", len(exps), 2)
+	}
+	if exps[0].From.String() != "http://short.ly/abc" || exps[0].To.String() != "http://t2.com/dest" {
+		t.Errorf("ExpandedLinks[0] mismatch, got %v -> %v", exps[0].From, exps[0].To)
+	}
+	if exps[1].From.String() != "http://short.ly/chain" || exps[1].To.String() != "http://short.ly/chain2" {
+		t.Errorf("ExpandedLinks[1] mismatch, got %v -> %v", exps[1].From, exps[1].To)
+	}
+
+	// Outlinks are counted by the domain they expand to
+	outlinks := map[string]int{"t2.com": 1, "short.ly": 1}
+	if !reflect.DeepEqual(frlst[0].OutlinkDomains, outlinks) {
+		t.Errorf("Expected OutlinkDomains %v, got %v", outlinks, frlst[0].OutlinkDomains)
+	}
+}
+
+// countingRoundTrip counts the requests made through a mapRoundTrip
+type countingRoundTrip struct {
+	mapRoundTrip
+	mu       sync.Mutex
+	requests map[string]int
+}
+
+func (crt *countingRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	crt.mu.Lock()
+	crt.requests[req.URL.String()]++
+	crt.mu.Unlock()
+	return crt.mapRoundTrip.RoundTrip(req)
+}
+
+func TestRedirectorExpansionStaysOnRedirectors(t *testing.T) {
+	origHosts := Config.Fetcher.RedirectorHosts
+	origHops := Config.Fetcher.MaxRedirectorHops
+	defer func() {
+		Config.Fetcher.RedirectorHosts = origHosts
+		Config.Fetcher.MaxRedirectorHops = origHops
+	}()
+	Config.Fetcher.RedirectorHosts = []string{"short.ly", "track.ly"}
+	Config.Fetcher.MaxRedirectorHops = 5
+
+	const html string = `<!DOCTYPE html>
+<html>
+<body>
+	<a href="http://short.ly/abc">shortened</a>
+	<a href="http://short.ly/tracked">tracked</a>
+</body>
+</html>`
+	page := func() *http.Response {
+		res := response200()
+		res.Body = ioutil.NopCloser(strings.NewReader(html))
+		return res
+	}
+	roundTriper := &countingRoundTrip{
+		mapRoundTrip: mapRoundTrip{
+			Responses: map[string]*http.Response{
+				"http://t1.com/a.html":     page(),
+				"http://t1.com/b.html":     page(),
+				"http://short.ly/abc":      response307("http://10.0.0.1/internal"),
+				"http://10.0.0.1/internal": response200(),
+				"http://short.ly/tracked":  response307("http://track.ly/hop"),
+				"http://track.ly/hop":      response307("http://t2.com/dest"),
+				"http://t2.com/dest":       response200(),
+			},
+		},
+		requests: map[string]int{},
+	}
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		transport:      roundTriper,
+		hosts: []DomainSpec{{
+			domain: "t1.com",
+			links: []LinkSpec{
+				{url: "http://t1.com/a.html"},
+				{url: "http://t1.com/b.html"},
+			},
+		}},
+	}
+
+	results := runFetcher(tests, t)
+
+	stored := map[string]int{}
+	ulst, _ := results.dsStoreParsedURLCalls()
+	for _, u := range ulst {
+		stored[u.String()]++
+	}
+	expected := map[string]int{"http://10.0.0.1/internal": 2, "http://t2.com/dest": 2}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("Expected stored links %v, got %v", expected, stored)
+	}
+
+	// Hops off the redirector hosts are never requested, and each redirector
+	// link is only expanded once
+	for link, n := range map[string]int{
+		"http://short.ly/abc":      1,
+		"http://short.ly/tracked":  1,
+		"http://track.ly/hop":      1,
+		"http://10.0.0.1/internal": 0,
+		"http://t2.com/dest":       0,
+	} {
+		if got := roundTriper.requests[link]; got != n {
+			t.Errorf("Expected %v to be requested %d times, got %d", link, n, got)
+		}
+	}
+}
+
+func TestCountOutlinkDomain(t *testing.T) {
+	fr := &FetchResults{URL: MustParse("http://www.test.com/page.html")}
+	for _, link := range []string{
+		"http://other.com/a.html",
+		"https://www.other.com/b.html",
+		"http://blog.test.com/",
+		"http://test.com/c.html",
+		"ftp://files.example.org/",
+		"http://example.co.uk/",
+	} {
+		countOutlinkDomain(fr, MustParse(link))
+	}
+	expected := map[string]int{"other.com": 2, "example.co.uk": 1}
+	if !reflect.DeepEqual(fr.OutlinkDomains, expected) {
+		t.Errorf("Expected OutlinkDomains %v, got %v", expected, fr.OutlinkDomains)
+	}
+
+	fr = &FetchResults{URL: MustParse("http://test.com/")}
+	countOutlinkDomain(fr, MustParse("http://test.com/a.html"))
+	if fr.OutlinkDomains != nil {
+		t.Errorf("Expected no OutlinkDomains for a page linking only to its own domain, got %v", fr.OutlinkDomains)
+	}
+
+	fr = &FetchResults{URL: MustParse("http://test.com/")}
+	for i := 0; i <= maxOutlinkDomains; i++ {
+		countOutlinkDomain(fr, MustParse(fmt.Sprintf("http://site%d.com/", i)))
+	}
+	countOutlinkDomain(fr, MustParse("http://site0.com/again.html"))
+	if len(fr.OutlinkDomains) != maxOutlinkDomains || fr.OutlinkDomains["site0.com"] != 2 {
+		t.Errorf("Expected %d domains counted, with site0.com twice, got %d domains, site0.com %d",
+			maxOutlinkDomains, len(fr.OutlinkDomains), fr.OutlinkDomains["site0.com"])
+	}
+}
+
+func TestAlternateLinks(t *testing.T) {
+	orig := Config.Fetcher.AlternatePolicy
+	defer func() {
+		Config.Fetcher.AlternatePolicy = orig
+	}()
+
+	const canonicalHTML string = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<link rel="amphtml" href="/amp/article.html">
+<link rel="alternate" media="only screen and (max-width: 640px)" href="http://m.t1.com/article.html">
+<link rel="alternate" hreflang="fr" href="/fr/article.html">
+<title>Title</title>
+</head>
+<body>
+	<a href="/other.html">other</a>
+</body>
+</html>`
+
+	const ampHTML string = `<!DOCTYPE html>
+<html amp>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<link rel="canonical" href="/article.html">
+<title>Title</title>
+</head>
+<body>
+	<a href="/other.html">other</a>
+</body>
+</html>`
+
+	tests := []struct {
+		policy   string
+		page     string
+		body     string
+		expected []string
+	}{
+		{"canonical", "http://t1.com/article.html", canonicalHTML, []string{
+			"http://t1.com/other.html",
+		}},
+		{"both", "http://t1.com/article.html", canonicalHTML, []string{
+			"http://t1.com/other.html",
+			"http://t1.com/amp/article.html",
+			"http://m.t1.com/article.html",
+		}},
+		{"canonical", "http://t1.com/amp/article.html", ampHTML, []string{
+			"http://t1.com/article.html",
+		}},
+		{"both", "http://t1.com/amp/article.html", ampHTML, []string{
+			"http://t1.com/other.html",
+		}},
+	}
+
+	for _, tst := range tests {
+		Config.Fetcher.AlternatePolicy = tst.policy
+		results := runFetcher(TestSpec{
+			hasParsedLinks: true,
+			hosts:          singleLinkDomainSpecArr(tst.page, &MockResponse{Body: tst.body}),
+		}, t)
+
+		ulst, frlst := results.dsStoreParsedURLCalls()
+		var got []string
+		for _, u := range ulst {
+			got = append(got, u.String())
+		}
+		if strings.Join(got, " ") != strings.Join(tst.expected, " ") {
+			t.Errorf("Policy %v, page %v: stored links %v, expected %v", tst.policy, tst.page, got, tst.expected)
+		}
+		if len(frlst) < 1 {
+			continue
+		}
+
+		fr := frlst[0]
+		if tst.body == canonicalHTML {
+			if fr.AMPURL == nil || fr.AMPURL.String() != "http://t1.com/amp/article.html" {
+				t.Errorf("Policy %v: AMPURL mismatch, got %v", tst.policy, fr.AMPURL)
+			}
+			if fr.MobileURL == nil || fr.MobileURL.String() != "http://m.t1.com/article.html" {
+				t.Errorf("Policy %v: MobileURL mismatch, got %v", tst.policy, fr.MobileURL)
+			}
+			if fr.CanonicalURL != nil {
+				t.Errorf("Policy %v: expected no CanonicalURL, got %v", tst.policy, fr.CanonicalURL)
+			}
+		} else {
+			if fr.CanonicalURL == nil || fr.CanonicalURL.String() != "http://t1.com/article.html" {
+				t.Errorf("Policy %v: CanonicalURL mismatch, got %v", tst.policy, fr.CanonicalURL)
+			}
+		}
+	}
+}
+
+func TestPaginationChain(t *testing.T) {
+	orig := Config.Fetcher.MaxPaginationDepth
+	defer func() {
+		Config.Fetcher.MaxPaginationDepth = orig
+	}()
+	Config.Fetcher.MaxPaginationDepth = 3
+
+	const html string = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<link rel="next" href="/list?page=next">
+<title>Title</title>
+</head>
+<body>
+	<a href="/item.html">item</a>
+	<a rel="next" href="/list?page=next">Next</a>
+</body>
+</html>`
+
+	tests := []struct {
+		chainPos     int
+		expectedNext int // expected ChainPos of the stored next link, 0 if not stored
+	}{
+		{0, 2},
+		{2, 3},
+		{3, 0},
+	}
+
+	for _, tst := range tests {
+		results := runFetcher(TestSpec{
+			hasParsedLinks: true,
+			hosts: []DomainSpec{
+				DomainSpec{
+					domain: "t1.com",
+					links: []LinkSpec{
+						LinkSpec{
+							url:      "http://t1.com/list",
+							response: &MockResponse{Body: html},
+							chainPos: tst.chainPos,
+						},
+					},
+				},
+			},
+		}, t)
+
+		var nextCount int
+		ulst, frlst := results.dsStoreParsedURLCalls()
+		for _, u := range ulst {
+			if u.String() != "http://t1.com/list?page=next" {
+				continue
+			}
+			nextCount++
+			if u.ChainPos != tst.expectedNext {
+				t.Errorf("Chain position %d: next link had ChainPos %d, expected %d",
+					tst.chainPos, u.ChainPos, tst.expectedNext)
+			}
+		}
+
+		expectedCount := 1
+		if tst.expectedNext == 0 {
+			expectedCount = 0
+		}
+		if nextCount != expectedCount {
+			t.Errorf("Chain position %d: next link stored %d times, expected %d",
+				tst.chainPos, nextCount, expectedCount)
+		}
+
+		if len(frlst) > 0 && tst.chainPos == 0 && frlst[0].URL.ChainPos != 1 {
+			t.Errorf("Expected the first page of the chain to get ChainPos 1, got %d", frlst[0].URL.ChainPos)
+		}
+	}
+}
+
+func TestParsedLinkDepth(t *testing.T) {
+	const html string = `<!DOCTYPE html>
+<html>
+<body>
+	<a href="/item.html">item</a>
+	<a href="http://other.com/">other</a>
+</body>
+</html>`
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/list",
+						response: &MockResponse{Body: html},
+						depth:    2,
+					},
+				},
+			},
+		},
+	}, t)
+
+	ulst, _ := results.dsStoreParsedURLCalls()
+	if len(ulst) != 2 {
+		t.Fatalf("Expected 2 parsed links stored, got %v", ulst)
+	}
+	for _, u := range ulst {
+		if u.Depth != 3 {
+			t.Errorf("Expected %v found at depth 2 to have depth 3, got %d", u, u.Depth)
+		}
+	}
+}
+
+func TestRobotsUsageDirectives(t *testing.T) {
+	const html string = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<meta name="robots" content="noai, max-snippet:50">
+<meta name="robots" content="max-snippet:120">
+<title>Title</title>
+</head>
+<body>
+	<a href="/other.html">other</a>
+</body>
+</html>`
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(html))
+	page.Header.Set("X-Robots-Tag", "noimageai, nosnippet")
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/page.html": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/page.html", nil),
+	}, t)
+
+	frs := results.handlerCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to handler, got %d", len(frs))
+	}
+	fr := frs[0]
+	if !fr.MetaNoAI {
+		t.Errorf("Expected MetaNoAI to be set")
+	}
+	if !fr.MetaNoImageAI {
+		t.Errorf("Expected MetaNoImageAI to be set")
+	}
+	if !fr.MetaNoSnippet {
+		t.Errorf("Expected MetaNoSnippet to be set")
+	}
+	if fr.MetaMaxSnippet != 50 {
+		t.Errorf("MetaMaxSnippet mismatch, got %d, expected %d", fr.MetaMaxSnippet, 50)
+	}
+
+	tests := []struct {
+		content  string
+		expected robotsDirectives
+	}{
+		{"noindex, nofollow", robotsDirectives{}},
+		{"NoAI,NoImageAI", robotsDirectives{noai: true, noimageai: true}},
+		{"max-snippet:0", robotsDirectives{nosnippet: true}},
+		{"max-snippet:-1", robotsDirectives{}},
+		{"max-snippet: 20, nosnippet", robotsDirectives{nosnippet: true, maxSnippet: 20}},
+	}
+	for _, tst := range tests {
+		d := parseRobotsDirectives(tst.content)
+		if d != tst.expected {
+			t.Errorf("parseRobotsDirectives(%q) = %+v, expected %+v", tst.content, d, tst.expected)
+		}
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader("<html><body>No links</body></html>"))
+	page.Header.Set("Cache-Control", "public, max-age=3600")
+	page.Header.Set("Expires", "Thu, 01 Dec 2094 16:00:00 GMT")
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/page.html": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: false,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/page.html", nil),
+	}, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to StoreURLFetchResults, got %d", len(frs))
+	}
+	if frs[0].CacheMaxAge != 3600 {
+		t.Errorf("CacheMaxAge mismatch, got %d, expected %d", frs[0].CacheMaxAge, 3600)
+	}
+	if !frs[0].CacheExpires.IsZero() {
+		t.Errorf("Expected max-age to take precedence over Expires, got %v", frs[0].CacheExpires)
+	}
+
+	expires := time.Date(2094, time.December, 1, 16, 0, 0, 0, time.UTC)
+	tests := []struct {
+		cacheControl   string
+		expires        string
+		expectedMaxAge int
+		expectedExp    time.Time
+	}{
+		{"", "", 0, time.Time{}},
+		{"max-age=60, s-maxage=10", "", 60, time.Time{}},
+		{`max-age="120"`, "", 120, time.Time{}},
+		{"max-age=60, no-cache", "", 0, time.Time{}},
+		{"no-store", "Thu, 01 Dec 2094 16:00:00 GMT", 0, time.Time{}},
+		{"max-age=bogus", "Thu, 01 Dec 2094 16:00:00 GMT", 0, expires},
+		{"", "Thu, 01 Dec 2094 16:00:00 GMT", 0, expires},
+		{"", "-1", 0, time.Time{}},
+	}
+	for _, tst := range tests {
+		h := http.Header{}
+		if tst.cacheControl != "" {
+			h.Set("Cache-Control", tst.cacheControl)
+		}
+		if tst.expires != "" {
+			h.Set("Expires", tst.expires)
+		}
+		maxAge, exp := parseCacheHeaders(h)
+		if maxAge != tst.expectedMaxAge || !exp.Equal(tst.expectedExp) {
+			t.Errorf("parseCacheHeaders(%q, %q) = %v, %v, expected %v, %v", tst.cacheControl, tst.expires,
+				maxAge, exp, tst.expectedMaxAge, tst.expectedExp)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	busy := response200()
+	busy.StatusCode = http.StatusServiceUnavailable
+	busy.Status = "503 Service Unavailable"
+	busy.Header.Set("Retry-After", "120")
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/page.html": busy,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: false,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/page.html", nil),
+	}, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to StoreURLFetchResults, got %d", len(frs))
+	}
+	if d := frs[0].CrawlAt.Sub(frs[0].FetchTime); d != 2*time.Minute {
+		t.Errorf("Expected CrawlAt 2m after the fetch, got %v", d)
+	}
+
+	fetchTime := time.Date(2094, time.December, 1, 16, 0, 0, 0, time.UTC)
+	tests := []struct {
+		retryAfter string
+		max        time.Duration
+		expected   time.Time
+	}{
+		{"", 0, time.Time{}},
+		{"60", 0, fetchTime.Add(time.Minute)},
+		{"0", 0, time.Time{}},
+		{"bogus", 0, time.Time{}},
+		{"Thu, 01 Dec 2094 17:00:00 GMT", 0, fetchTime.Add(time.Hour)},
+		{"Thu, 01 Dec 2094 15:00:00 GMT", 0, time.Time{}},
+		{"172800", 24 * time.Hour, fetchTime.Add(24 * time.Hour)},
+	}
+	for _, tst := range tests {
+		h := http.Header{}
+		if tst.retryAfter != "" {
+			h.Set("Retry-After", tst.retryAfter)
+		}
+		if at := parseRetryAfter(h, fetchTime, tst.max); !at.Equal(tst.expected) {
+			t.Errorf("parseRetryAfter(%q, %v) = %v, expected %v", tst.retryAfter, tst.max, at, tst.expected)
+		}
+	}
+}
+
+func TestDifferentialCrawl(t *testing.T) {
+	orig := Config.Fetcher.Differential
+	defer func() { Config.Fetcher.Differential = orig }()
+	Config.Fetcher.Differential = true
+
+	crawl := func(body string, states map[string]*PageState) TestResults {
+		page := response200()
+		page.Body = ioutil.NopCloser(strings.NewReader(body))
+		return runFetcher(TestSpec{
+			hasParsedLinks: true,
+			transport: &mapRoundTrip{
+				Responses: map[string]*http.Response{"http://t1.com/page.html": page},
+			},
+			hosts:      singleLinkDomainSpecArr("http://t1.com/page.html", nil),
+			pageStates: states,
+		}, t)
+	}
+	before := `<html><body><a href="/a.html">a</a><a href="/b.html">b</a></body></html>`
+	after := `<html><body><a href="/b.html">b</a><a href="/c.html">c</a></body></html>`
+
+	// The first crawl is handled as new
+	results := crawl(before, nil)
+	hcs := results.handlerCalls()
+	if len(hcs) != 1 {
+		t.Fatalf("Expected the new page to be handled once, got %d calls", len(hcs))
+	}
+	diff := hcs[0].Diff
+	expectedLinks := []string{"http://t1.com/a.html", "http://t1.com/b.html"}
+	if diff == nil || !diff.New || !reflect.DeepEqual(diff.AddedLinks, expectedLinks) {
+		t.Errorf("Expected a new page diff adding %v, got %+v", expectedLinks, diff)
+	}
+	states := results.datastore.PageStates
+	if ps := states["http://t1.com/page.html"]; ps == nil || !reflect.DeepEqual(ps.Outlinks, expectedLinks) {
+		t.Errorf("Expected page state with outlinks %v, got %+v", expectedLinks, ps)
+	}
+
+	// The same content again isn't handled
+	results = crawl(before, states)
+	if hcs := results.handlerCalls(); len(hcs) != 0 {
+		t.Errorf("Expected the unchanged page not to be handled, got %d calls", len(hcs))
+	}
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 || !frs[0].Unchanged {
+		t.Errorf("Expected the fetch to be stored as unchanged")
+	}
+
+	// Changed content is handled with the outlinks added and removed
+	prev := states["http://t1.com/page.html"]
+	results = crawl(after, states)
+	hcs = results.handlerCalls()
+	if len(hcs) != 1 {
+		t.Fatalf("Expected the changed page to be handled once, got %d calls", len(hcs))
+	}
+	expected := &PageDiff{
+		PreviousFetchTime:   prev.FetchTime,
+		PreviousFingerprint: prev.Fingerprint,
+		AddedLinks:          []string{"http://t1.com/c.html"},
+		RemovedLinks:        []string{"http://t1.com/a.html"},
+		KeptLinks:           1,
+	}
+	if !reflect.DeepEqual(hcs[0].Diff, expected) {
+		t.Errorf("Diff mismatch\nExpected: %+v\nGot:      %+v", expected, hcs[0].Diff)
+	}
+}
+
+func TestHandlerV2(t *testing.T) {
+	orig := Config.Fetcher.Differential
+	defer func() { Config.Fetcher.Differential = orig }()
+	Config.Fetcher.Differential = true
+
+	responses := map[string]*http.Response{}
+	var links []LinkSpec
+	for _, link := range []string{"http://t1.com/retry.html", "http://t1.com/fail.html", "http://t1.com/ok.html"} {
+		responses[link] = response200()
+		links = append(links, LinkSpec{url: link})
+	}
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &mapRoundTrip{Responses: responses},
+		hosts:          []DomainSpec{{domain: "t1.com", links: links}},
+		handleFetch: func(fr *FetchResults) error {
+			switch fr.URL.Path {
+			case "/retry.html":
+				return RetryAfter(time.Hour, errors.New("store unavailable"))
+			case "/fail.html":
+				return errors.New("bad page")
+			}
+			return nil
+		},
+	}, t)
+
+	if hcs := results.handlerCalls(); len(hcs) != 3 {
+		t.Fatalf("Expected 3 handler calls, got %d", len(hcs))
+	}
+	stored := map[string]*FetchResults{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		stored[fr.URL.Path] = fr
+	}
+
+	fr := stored["/retry.html"]
+	if fr == nil || fr.HandlerError == nil || !fr.HandlerRetry {
+		t.Fatalf("Expected a retry to be stored for retry.html, got %+v", fr)
+	}
+	if expected := fr.FetchTime.Add(time.Hour); !fr.CrawlAt.Equal(expected) {
+		t.Errorf("Expected retry.html CrawlAt %v, got %v", expected, fr.CrawlAt)
+	}
+
+	fr = stored["/fail.html"]
+	if fr == nil || fr.HandlerError == nil || fr.HandlerError.Error() != "bad page" {
+		t.Fatalf("Expected fail.html to be stored with its handler error, got %+v", fr)
+	}
+	if fr.HandlerRetry || !fr.CrawlAt.IsZero() {
+		t.Errorf("Expected no retry of fail.html, got HandlerRetry %v CrawlAt %v", fr.HandlerRetry, fr.CrawlAt)
+	}
+
+	fr = stored["/ok.html"]
+	if fr == nil || fr.HandlerError != nil || fr.HandlerRetry {
+		t.Errorf("Expected ok.html to be stored without a handler error, got %+v", fr)
+	}
+
+	// Only the handled page's state is kept, so the others are handled again
+	// next time even if they haven't changed
+	states := results.datastore.PageStates
+	if len(states) != 1 || states["http://t1.com/ok.html"] == nil {
+		t.Errorf("Expected only ok.html's page state to be stored, got %v", states)
+	}
+
+	report := results.manager.Report()
+	if report.Errors.HandlerErrors != 2 || report.Errors.HandlerRetries != 1 {
+		t.Errorf("Expected 2 handler errors and 1 retry reported, got %+v", report.Errors)
+	}
+}
+
+func TestWatchRules(t *testing.T) {
+	orig := Config.Watch.Rules
+	defer func() { Config.Watch.Rules = orig }()
+	Config.Watch.Rules = []WatchRule{
+		{Name: "price", Domain: "t1.com", Path: "^/product", Selector: "#price"},
+		{Name: "other", Domain: "t2.com", Selector: "#price"},
+	}
+
+	crawl := func(price string, states map[string]*PageState) TestResults {
+		page := response200()
+		page.Body = ioutil.NopCloser(strings.NewReader(
+			`<html><body><p id="price">` + price + `</p><a href="/a.html">a</a></body></html>`))
+		return runFetcher(TestSpec{
+			hasParsedLinks: true,
+			transport: &mapRoundTrip{
+				Responses: map[string]*http.Response{"http://t1.com/product.html": page},
+			},
+			hosts:      singleLinkDomainSpecArr("http://t1.com/product.html", nil),
+			pageStates: states,
+		}, t)
+	}
+
+	// The first crawl records the watched value without reporting a change
+	results := crawl("9.99", nil)
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 || len(frs[0].WatchChanges) != 0 {
+		t.Fatalf("Expected one stored fetch without watch changes, got %+v", frs)
+	}
+	states := results.datastore.PageStates
+	ps := states["http://t1.com/product.html"]
+	if ps == nil || !reflect.DeepEqual(ps.Watches, map[string]string{"price": "9.99"}) {
+		t.Fatalf("Expected page state watching price 9.99, got %+v", ps)
+	}
+
+	// Unchanged content is still handled outside differential mode
+	results = crawl("9.99", states)
+	if hcs := results.handlerCalls(); len(hcs) != 1 {
+		t.Errorf("Expected the unchanged page to be handled, got %d calls", len(hcs))
+	}
+	frs = results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 || !frs[0].Unchanged || len(frs[0].WatchChanges) != 0 {
+		t.Errorf("Expected an unchanged fetch without watch changes, got %+v", frs)
+	}
+
+	// A new price is reported
+	results = crawl("8.99", states)
+	frs = results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 || len(frs[0].WatchChanges) != 1 {
+		t.Fatalf("Expected one stored fetch with a watch change, got %+v", frs)
+	}
+	c := frs[0].WatchChanges[0]
+	if c.Rule != "price" || c.Previous != "9.99" || c.Current != "8.99" {
+		t.Errorf("Watch change not as expected: %+v", c)
+	}
+	if ps := states["http://t1.com/product.html"]; ps.Watches["price"] != "8.99" {
+		t.Errorf("Expected page state to watch the new price, got %+v", ps)
+	}
+}
+
+func TestScreenshotCapture(t *testing.T) {
+	shot := testPNG(t, 640, 400)
+	var requested []map[string]interface{}
+	renderer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Failed to decode renderer request: %v", err)
+		}
+		requested = append(requested, req)
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(shot)
+	}))
+	defer renderer.Close()
+
+	orig := Config.Screenshots
+	defer func() { Config.Screenshots = orig }()
+	Config.Screenshots.RendererURL = renderer.URL
+	Config.Screenshots.Patterns = []string{`/product`}
+	Config.Screenshots.ThumbnailWidth = 160
+
+	// The product2 page is disallowed, so it isn't fetched or captured
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader("User-agent: *\nDisallow: /product2\n"))
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport: &mapRoundTrip{
+			Responses: map[string]*http.Response{
+				"http://t1.com/robots.txt":    robots,
+				"http://t1.com/product.html":  response200(),
+				"http://t1.com/product2.html": response200(),
+				"http://t1.com/about.html":    response200(),
+			},
+		},
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/product.html"},
+					LinkSpec{url: "http://t1.com/product2.html"},
+					LinkSpec{url: "http://t1.com/about.html"},
+				},
+			},
+		},
+	}, t)
+
+	if len(requested) != 1 || requested[0]["url"] != "http://t1.com/product.html" {
+		t.Fatalf("Expected one screenshot request for the product page, got %v", requested)
+	}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		switch fr.URL.String() {
+		case "http://t1.com/product.html":
+			if fr.Screenshot == nil {
+				t.Fatalf("Expected a screenshot of %v", fr.URL)
+			}
+			if fr.Screenshot.MimeType != "image/png" || !bytes.Equal(fr.Screenshot.Image, shot) {
+				t.Errorf("Screenshot of %v not the renderer's image", fr.URL)
+			}
+			thumb, err := png.DecodeConfig(bytes.NewReader(fr.Screenshot.Thumbnail))
+			if err != nil || thumb.Width != 160 || thumb.Height != 100 {
+				t.Errorf("Expected a 160x100 PNG thumbnail, got %+v (%v)", thumb, err)
+			}
+		default:
+			if fr.Screenshot != nil {
+				t.Errorf("Expected no screenshot of %v", fr.URL)
+			}
+		}
+	}
+}
+
+// dnsFailRoundTrip fails requests to Dead hosts with a DNS error, and
+// answers others with a 200
+type dnsFailRoundTrip struct {
+	Dead map[string]bool
+}
+
+func (rt *dnsFailRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	if rt.Dead[req.URL.Host] {
+		return nil, &net.OpError{Op: "dial", Net: "tcp",
+			Err: &net.DNSError{Err: "no such host", Name: req.URL.Host}}
+	}
+	res := response200()
+	res.Request = req
+	return res, nil
+}
+
+func (rt *dnsFailRoundTrip) CancelRequest(req *http.Request) {}
+
+func TestDNSQuarantine(t *testing.T) {
+	orig := Config.Fetcher.DNSQuarantineFailures
+	defer func() { Config.Fetcher.DNSQuarantineFailures = orig }()
+	Config.Fetcher.DNSQuarantineFailures = 3
+
+	domain := func(dom string, n int) DomainSpec {
+		spec := DomainSpec{domain: dom}
+		for i := 0; i < n; i++ {
+			spec.links = append(spec.links, LinkSpec{url: fmt.Sprintf("http://%v/page%d.html", dom, i)})
+		}
+		return spec
+	}
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &dnsFailRoundTrip{Dead: map[string]bool{"dead.com": true, "few.com": true}},
+		hosts: []DomainSpec{
+			domain("dead.com", 6),
+			// Too few links to reach the limit
+			domain("few.com", 2),
+			domain("alive.com", 4),
+		},
+	}, t)
+	mixed := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &dnsFailRoundTrip{Dead: map[string]bool{"www.mixed.com": true}},
+		hosts: []DomainSpec{{
+			domain: "mixed.com",
+			links: []LinkSpec{
+				{url: "http://mixed.com/"},
+				{url: "http://www.mixed.com/1"},
+				{url: "http://www.mixed.com/2"},
+				{url: "http://www.mixed.com/3"},
+			},
+		}},
+	}, t)
+
+	q := results.datastore.Quarantined
+	until, ok := q["dead.com"]
+	if !ok || until.Before(time.Now().Add(23*time.Hour)) {
+		t.Errorf("Expected dead.com to be quarantined for a day, got %v", q)
+	}
+	if len(q) != 1 {
+		t.Errorf("Expected only dead.com to be quarantined, got %v", q)
+	}
+	if len(mixed.datastore.Quarantined) != 0 {
+		t.Errorf("Expected a domain with a resolving host not to be quarantined, got %v",
+			mixed.datastore.Quarantined)
+	}
+
+	// The rest of dead.com's segment isn't tried once it is quarantined
+	dead := 0
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		if fr.URL.Host == "dead.com" {
+			dead++
+		}
+	}
+	if dead != 3 {
+		t.Errorf("Expected 3 fetches of dead.com before it was quarantined, got %d", dead)
+	}
+}
+
+// robotsErrorRoundTrip answers robots.txt of Down hosts with a 503, fails
+// robots.txt of Unreachable hosts without a response (counting the attempts),
+// and answers everything else with a 404 for robots.txt and a 200 otherwise
+type robotsErrorRoundTrip struct {
+	Down        map[string]bool
+	Unreachable map[string]bool
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func (rt *robotsErrorRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	var res *http.Response
+	switch {
+	case req.URL.Path != "/robots.txt":
+		res = response200()
+	case rt.Down[req.URL.Host]:
+		res = response404()
+		res.StatusCode = http.StatusServiceUnavailable
+		res.Status = "503 Service Unavailable"
+	case rt.Unreachable[req.URL.Host]:
+		rt.mu.Lock()
+		rt.attempts[req.URL.Host]++
+		rt.mu.Unlock()
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	default:
+		res = response404()
+	}
+	res.Request = req
+	return res, nil
+}
+
+func (rt *robotsErrorRoundTrip) CancelRequest(req *http.Request) {}
+
+func TestRobotsErrorPolicy(t *testing.T) {
+	origPolicy, origBackoff := Config.Fetcher.RobotsErrorPolicy, Config.Fetcher.RobotsRetryBackoff
+	defer func() {
+		Config.Fetcher.RobotsErrorPolicy, Config.Fetcher.RobotsRetryBackoff = origPolicy, origBackoff
+	}()
+	Config.Fetcher.RobotsRetryBackoff = "1ms"
+
+	crawl := func(policy string) (TestResults, *robotsErrorRoundTrip) {
+		Config.Fetcher.RobotsErrorPolicy = policy
+		rt := &robotsErrorRoundTrip{
+			Down:        map[string]bool{"t1.com": true, "down.t4.com": true},
+			Unreachable: map[string]bool{"t2.com": true},
+			attempts:    map[string]int{},
+		}
+		return runFetcher(TestSpec{
+			hasParsedLinks: true,
+			transport:      rt,
+			hosts: []DomainSpec{
+				singleLinkDomainSpec("http://t1.com/page.html", nil),
+				singleLinkDomainSpec("http://t2.com/page.html", nil),
+				singleLinkDomainSpec("http://t3.com/page.html", nil),
+				{
+					domain: "t4.com",
+					links: []LinkSpec{
+						{url: "http://t4.com/page.html"},
+						{url: "http://down.t4.com/page.html"},
+					},
+				},
+			},
+		}, t), rt
+	}
+	fetched := func(results TestResults) map[string]bool {
+		urls := map[string]bool{}
+		for _, fr := range results.dsStoreURLFetchResultsCalls() {
+			urls[fr.URL.String()] = true
+		}
+		return urls
+	}
+
+	// The allow policy crawls everything, as if there were no robots.txt
+	results, rt := crawl(RobotsErrorPolicyAllow)
+	if urls := fetched(results); len(urls) != 5 {
+		t.Errorf("Expected all 5 links fetched under the allow policy, got %v", urls)
+	}
+	if len(results.datastore.Quarantined) != 0 {
+		t.Errorf("Expected nothing quarantined under the allow policy, got %v", results.datastore.Quarantined)
+	}
+	if n := rt.attempts["t2.com"]; n != 1 {
+		t.Errorf("Expected robots.txt fetched once under the allow policy, got %d attempts", n)
+	}
+	expected := map[string]int{RobotsDecisionAssumedAllowed: 3, RobotsDecisionMissing: 2}
+	if got := results.manager.Report().Policy.RobotsDecisions; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Robots decisions mismatch under the allow policy: got %v, expected %v", got, expected)
+	}
+
+	// The rfc policy retries the unreachable robots.txt, then holds back the
+	// hosts without one
+	results, rt = crawl(RobotsErrorPolicyRFC)
+	urls := fetched(results)
+	if len(urls) != 2 || !urls["http://t3.com/page.html"] || !urls["http://t4.com/page.html"] {
+		t.Errorf("Expected only t3.com and t4.com pages fetched under the rfc policy, got %v", urls)
+	}
+	q := results.datastore.Quarantined
+	for _, dom := range []string{"t1.com", "t2.com"} {
+		if until, ok := q[dom]; !ok || until.Before(time.Now().Add(23*time.Hour)) {
+			t.Errorf("Expected %v to be quarantined for a day, got %v", dom, q)
+		}
+	}
+	if len(q) != 2 {
+		t.Errorf("Expected only t1.com and t2.com quarantined, got %v", q)
+	}
+	if n := rt.attempts["t2.com"]; n != 4 {
+		t.Errorf("Expected robots.txt tried 4 times under the rfc policy, got %d attempts", n)
+	}
+	expected = map[string]int{RobotsDecisionUnavailable: 2, RobotsDecisionUnreachable: 1,
+		RobotsDecisionMissing: 2}
+	if got := results.manager.Report().Policy.RobotsDecisions; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Robots decisions mismatch under the rfc policy: got %v, expected %v", got, expected)
+	}
+}
+
+// exifJPEG returns a small JPEG carrying an EXIF segment with the given camera
+// make and model and a GPS position of 40°26'46"N 79°58'56"W
+func exifJPEG(t *testing.T, camMake, camModel string) []byte {
+	var img bytes.Buffer
+	err := jpeg.Encode(&img, image.NewGray(image.Rect(0, 0, 4, 3)), nil)
+	if err != nil {
+		t.Fatalf("Failed to encode jpeg: %v", err)
+	}
+
+	// Build a big-endian TIFF structure: IFD0 (make, model, GPS pointer)
+	// followed by the GPS IFD, then out-of-line values
+	bo := binary.BigEndian
+	var tiff bytes.Buffer
+	tiff.WriteString("MM")
+	binary.Write(&tiff, bo, uint16(42))
+	binary.Write(&tiff, bo, uint32(8))
+
+	const ifd0Len = 2 + 3*12 + 4
+	const gpsLen = 2 + 4*12 + 4
+	dataOff := uint32(8 + ifd0Len + gpsLen)
+	var data bytes.Buffer
+	entry := func(tag, typ uint16, count uint32, value []byte) {
+		binary.Write(&tiff, bo, tag)
+		binary.Write(&tiff, bo, typ)
+		binary.Write(&tiff, bo, count)
+		if len(value) <= 4 {
+			tiff.Write(append(value, make([]byte, 4-len(value))...))
+			return
+		}
+		binary.Write(&tiff, bo, dataOff+uint32(data.Len()))
+		data.Write(value)
+	}
+	ascii := func(s string) []byte { return append([]byte(s), 0) }
+	degrees := func(d, m, s uint32) []byte {
+		var b bytes.Buffer
+		for _, v := range []uint32{d, 1, m, 1, s, 1} {
+			binary.Write(&b, bo, v)
+		}
+		return b.Bytes()
+	}
+	gpsPtr := make([]byte, 4)
+	bo.PutUint32(gpsPtr, 8+ifd0Len)
+
+	binary.Write(&tiff, bo, uint16(3))
+	entry(exifTagMake, 2, uint32(len(camMake)+1), ascii(camMake))
+	entry(exifTagModel, 2, uint32(len(camModel)+1), ascii(camModel))
+	entry(exifTagGPSIFD, 4, 1, gpsPtr)
+	binary.Write(&tiff, bo, uint32(0))
+
+	binary.Write(&tiff, bo, uint16(4))
+	entry(exifTagGPSLatRef, 2, 2, ascii("N"))
+	entry(exifTagGPSLat, 5, 3, degrees(40, 26, 46))
+	entry(exifTagGPSLongRef, 2, 2, ascii("W"))
+	entry(exifTagGPSLong, 5, 3, degrees(79, 58, 56))
+	binary.Write(&tiff, bo, uint32(0))
+	tiff.Write(data.Bytes())
+
+	// Splice the APP1 segment in right after the SOI marker
+	app1 := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(img.Bytes()[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(&out, bo, uint16(len(app1)+2))
+	out.Write(app1)
+	out.Write(img.Bytes()[2:])
+	return out.Bytes()
+}
+
+func TestImageMetadata(t *testing.T) {
+	orig := Config.Fetcher.ExtractImageMetadata
+	defer func() {
+		Config.Fetcher.ExtractImageMetadata = orig
+	}()
+	Config.Fetcher.ExtractImageMetadata = true
+
+	var png32 bytes.Buffer
+	err := png.Encode(&png32, image.NewRGBA(image.Rect(0, 0, 32, 16)))
+	if err != nil {
+		t.Fatalf("Failed to encode png: %v", err)
+	}
+
+	imageResponse := func(contentType string, body []byte) *http.Response {
+		r := response200()
+		r.Header.Set("Content-Type", contentType)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return r
+	}
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/photo.jpg":  imageResponse("image/jpeg", exifJPEG(t, "Canon", "EOS 5D")),
+			"http://t1.com/icon.png":   imageResponse("image/png", png32.Bytes()),
+			"http://t1.com/broken.png": imageResponse("image/png", []byte("not an image")),
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		transport: &roundTriper,
+		hosts: []DomainSpec{
+			{
+				domain: "t1.com",
+				links: []LinkSpec{
+					{url: "http://t1.com/photo.jpg"},
+					{url: "http://t1.com/icon.png"},
+					{url: "http://t1.com/broken.png"},
+				},
+			},
+		},
+	}, t)
+
+	images := map[string]*ImageInfo{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		images[fr.URL.String()] = fr.Image
+	}
+
+	photo := images["http://t1.com/photo.jpg"]
+	if photo == nil {
+		t.Fatalf("Expected image metadata for photo.jpg")
+	}
+	if photo.Format != "jpeg" || photo.Width != 4 || photo.Height != 3 {
+		t.Errorf("photo.jpg format/size mismatch, got %v %vx%v", photo.Format, photo.Width, photo.Height)
+	}
+	if photo.CameraMake != "Canon" || photo.CameraModel != "EOS 5D" {
+		t.Errorf("photo.jpg camera mismatch, got %q %q", photo.CameraMake, photo.CameraModel)
+	}
+	expLat, expLong := 40+26.0/60+46.0/3600, -(79 + 58.0/60 + 56.0/3600)
+	if !photo.HasGPS || math.Abs(photo.Latitude-expLat) > 1e-9 || math.Abs(photo.Longitude-expLong) > 1e-9 {
+		t.Errorf("photo.jpg GPS mismatch, got %v (%v, %v), expected (%v, %v)",
+			photo.HasGPS, photo.Latitude, photo.Longitude, expLat, expLong)
+	}
+
+	icon := images["http://t1.com/icon.png"]
+	if icon == nil {
+		t.Fatalf("Expected image metadata for icon.png")
+	}
+	expIcon := ImageInfo{Format: "png", Width: 32, Height: 16}
+	if *icon != expIcon {
+		t.Errorf("icon.png metadata mismatch, got %+v, expected %+v", *icon, expIcon)
+	}
+
+	if broken, ok := images["http://t1.com/broken.png"]; !ok {
+		t.Errorf("Expected broken.png to be fetched")
+	} else if broken != nil {
+		t.Errorf("Expected no image metadata for broken.png, got %+v", *broken)
+	}
+}
+
+func TestMaxParseBytes(t *testing.T) {
+	orig := Config.Fetcher.MaxParseBytes
+	defer func() {
+		Config.Fetcher.MaxParseBytes = orig
+	}()
+	Config.Fetcher.MaxParseBytes = 1024
+
+	html := `<html><body><a href="/before.html">before</a>` +
+		strings.Repeat("<p>filler</p>", 200) +
+		`<a href="/after.html">after</a></body></html>`
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(html))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/big.html": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/big.html", nil),
+	}, t)
+
+	urls, _ := results.dsStoreParsedURLCalls()
+	if len(urls) != 1 || urls[0].String() != "http://t1.com/before.html" {
+		t.Errorf("Expected only http://t1.com/before.html to be parsed, got %v", urls)
+	}
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to StoreURLFetchResults, got %d", len(frs))
+	}
+	if frs[0].ParseError != nil {
+		t.Errorf("Expected no parse error for a truncated page, got %v", frs[0].ParseError)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	orig := Config.Fetcher.ParseTimeout
+	defer func() {
+		Config.Fetcher.ParseTimeout = orig
+	}()
+	Config.Fetcher.ParseTimeout = "1ns"
+
+	html := `<html><body>` + strings.Repeat(`<a href="/page.html">page</a>`, 1000) + `</body></html>`
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(html))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/slow.html": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/slow.html", nil),
+	}, t)
+
+	urls, _ := results.dsStoreParsedURLCalls()
+	if len(urls) != 0 {
+		t.Errorf("Expected no links to be stored from a page that timed out, got %v", urls)
+	}
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to StoreURLFetchResults, got %d", len(frs))
+	}
+	if frs[0].ParseError != errParseTimeout {
+		t.Errorf("Expected ParseError %v, got %v", errParseTimeout, frs[0].ParseError)
+	}
+}
+
+// failingReader reads like r, then fails with err instead of io.EOF
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.r.Read(p)
+	if err == io.EOF {
+		err = fr.err
+	}
+	return n, err
+}
+
+func TestParseErrorKeepsEarlierLinks(t *testing.T) {
+	readErr := errors.New("invalid byte sequence")
+	defer func(r func([]byte) (io.Reader, error)) { htmlReader = r }(htmlReader)
+	htmlReader = func(body []byte) (io.Reader, error) {
+		return &failingReader{r: bytes.NewReader(body), err: readErr}, nil
+	}
+
+	// The tokenizer fails where the body ends, partway through the page
+	html := `<html><head><meta name="robots" content="noindex, noai"></head>
+<body><a href="/before.html">before</a><a href="/tru`
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(html))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/broken.html": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/broken.html", nil),
+	}, t)
+
+	urls, _ := results.dsStoreParsedURLCalls()
+	if len(urls) != 1 || urls[0].String() != "http://t1.com/before.html" {
+		t.Errorf("Expected the link before the failure to be stored, got %v", urls)
+	}
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to StoreURLFetchResults, got %d", len(frs))
+	}
+	if _, ok := frs[0].ParseError.(*tokenizerError); !ok || !strings.Contains(frs[0].ParseError.Error(), readErr.Error()) {
+		t.Errorf("Expected a tokenizer ParseError, got %v", frs[0].ParseError)
+	}
+	if !frs[0].MetaNoIndex || !frs[0].MetaNoAI {
+		t.Errorf("Expected the page's robots directives to be kept, got noindex %v, noai %v",
+			frs[0].MetaNoIndex, frs[0].MetaNoAI)
+	}
+}
+
+func TestScriptLinks(t *testing.T) {
+	orig := Config.Fetcher.ParseScriptLinks
+	defer func() {
+		Config.Fetcher.ParseScriptLinks = orig
+	}()
+	Config.Fetcher.ParseScriptLinks = true
+
+	html := `<html><head>
+<script type="application/ld+json">
+{"@type": "Product", "url": "https:\/\/t1.com\/product.html", "brand": "https://other.com/brand.html"}
+</script>
+</head><body>
+<a href="/anchor.html">anchor</a>
+<script>
+	document.getElementById("next").onclick = function() { location.href = 'http://www.t1.com/js-nav.html'; };
+	var base = "http://t1.com/";
+	var item = ` + "`http://t1.com/item/${id}`" + `;
+</script>
+<p>Not in a script: "http://t1.com/text.html"</p>
+</body></html>`
+
+	page := response200()
+	page.Body = ioutil.NopCloser(strings.NewReader(html))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/script.html": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/script.html", nil),
+	}, t)
+
+	expected := map[string]bool{
+		"http://t1.com/anchor.html":     true,
+		"https://t1.com/product.html":   true,
+		"http://www.t1.com/js-nav.html": true,
+		"http://t1.com/":                true,
+	}
+	urls, _ := results.dsStoreParsedURLCalls()
+	for _, u := range urls {
+		if !expected[u.String()] {
+			t.Errorf("Unexpected parsed link %v", u)
+		}
+		delete(expected, u.String())
+	}
+	for link := range expected {
+		t.Errorf("Expected parsed link %v", link)
+	}
+}
+
+func TestRobotsTxtStored(t *testing.T) {
+	const robotsTxt = "User-agent: *\nDisallow: /private/\n"
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader(robotsTxt))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/robots.txt": robots,
+			"http://t1.com/page.html":  response200(),
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/page.html", nil),
+	}, t)
+
+	stored := results.datastore.RobotsTxt
+	if len(stored) != 1 || string(stored["t1.com"]) != robotsTxt {
+		t.Errorf("StoreRobotsTxt calls mismatch, got %q, expected %q for t1.com", stored, robotsTxt)
+	}
+}
+
+func TestControlFilesOverLimit(t *testing.T) {
+	origRobots := Config.Fetcher.MaxRobotsBytes
+	origSitemap := Config.Fetcher.MaxSitemapBytes
+	origTrust := Config.Fetcher.SitemapTrust
+	defer func() {
+		Config.Fetcher.MaxRobotsBytes = origRobots
+		Config.Fetcher.MaxSitemapBytes = origSitemap
+		Config.Fetcher.SitemapTrust = origTrust
+	}()
+	Config.Fetcher.SitemapTrust = "conservative"
+
+	// The limit falls in the middle of the second Disallow line, so only the
+	// first is kept
+	const robotsTxt = "User-agent: *\nDisallow: /private/\nDisallow: /page.html\n"
+	Config.Fetcher.MaxRobotsBytes = int64(strings.Index(robotsTxt, "/page.html"))
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader(robotsTxt))
+
+	lastCrawled := time.Now().Add(-24 * time.Hour)
+	sitemapXML := `<urlset><url><loc>http://t1.com/page.html</loc><lastmod>` +
+		lastCrawled.Add(-time.Hour).Format(time.RFC3339) + `</lastmod></url></urlset>`
+	Config.Fetcher.MaxSitemapBytes = int64(len(sitemapXML) - 1)
+	sitemap := response200()
+	sitemap.Header.Set("Content-Type", "application/xml")
+	sitemap.Body = ioutil.NopCloser(strings.NewReader(sitemapXML))
+
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/robots.txt":  robots,
+			"http://t1.com/sitemap.xml": sitemap,
+			"http://t1.com/page.html":   response200(),
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links:  []LinkSpec{LinkSpec{url: "http://t1.com/page.html", lastCrawled: lastCrawled}},
+			},
+		},
+	}, t)
+
+	if stored := string(results.datastore.RobotsTxt["t1.com"]); stored != "User-agent: *\nDisallow: /private/\n" {
+		t.Errorf("Expected robots.txt cut back to its last whole line, got %q", stored)
+	}
+	// The truncated robots.txt allows page.html, and the sitemap saying it is
+	// fresh is ignored
+	fetched := false
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		if fr.URL.String() == "http://t1.com/page.html" {
+			fetched = !fr.ExcludedByRobots && !fr.SitemapFresh && fr.Response != nil
+		}
+	}
+	if !fetched {
+		t.Error("Expected http://t1.com/page.html to be fetched")
+	}
+
+	expected := []string{"http://t1.com/robots.txt", "http://t1.com/sitemap.xml"}
+	if got := results.datastore.OverLimit["t1.com"]; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v recorded over their limits, got %v", expected, got)
+	}
+}
+
+func TestClaimHooks(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	var mu sync.Mutex
+	claimed := []string{}
+	unclaimed := map[string]HostStats{}
+	results := runFetcher(TestSpec{
+		hosts: []DomainSpec{
+			singleLinkDomainSpec("http://t1.com/page.html", nil),
+			singleLinkDomainSpec("http://t2.com/page.html", nil),
+			singleLinkDomainSpec("http://t3.com/page.html", nil),
+		},
+		options: []Option{
+			WithClaimHook(func(stats HostStats) error {
+				mu.Lock()
+				claimed = append(claimed, stats.Host)
+				mu.Unlock()
+				switch stats.Host {
+				case "t2.com":
+					return &HostVeto{Reason: "in its maintenance window", Until: until}
+				case "t3.com":
+					return errors.New("rate API says no")
+				}
+				return nil
+			}),
+			WithUnclaimHook(func(stats HostStats) {
+				mu.Lock()
+				unclaimed[stats.Host] = stats
+				mu.Unlock()
+			}),
+		},
+	}, t)
+
+	sort.Strings(claimed)
+	if !reflect.DeepEqual(claimed, []string{"t1.com", "t2.com", "t3.com"}) {
+		t.Errorf("Expected the claim hook to run for every host, got %v", claimed)
+	}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		if fr.URL.Host != "t1.com" {
+			t.Errorf("Expected only t1.com to be crawled, got %v", fr.URL)
+		}
+	}
+
+	if s := unclaimed["t1.com"]; !s.Completed || s.Fetched != 1 || s.Veto != nil || s.Unclaimed.Before(s.Claimed) {
+		t.Errorf("Unexpected unclaim stats for t1.com: %+v", s)
+	}
+	for _, host := range []string{"t2.com", "t3.com"} {
+		if s := unclaimed[host]; s.Completed || s.Fetched != 0 || s.Veto == nil {
+			t.Errorf("Unexpected unclaim stats for vetoed %v: %+v", host, s)
+		}
+	}
+	if q := results.datastore.Quarantined; len(q) != 1 || !q["t2.com"].Equal(until) {
+		t.Errorf("Expected only t2.com quarantined until %v, got %v", until, q)
+	}
+}
+
+func TestHostContextHandoff(t *testing.T) {
+	const fetchedRobots = "User-agent: *\nDisallow:\n"
+	const warmRobots = "User-agent: *\nDisallow: /private\n"
+
+	tests := []struct {
+		tag             string
+		robotsTime      time.Time
+		expectExcluded  bool
+		expectedRobots  string
+		expectFreshTime bool
+	}{
+		// The handed over robots.txt is used instead of fetching it
+		{"Warm", time.Now().Add(-time.Minute), true, warmRobots, false},
+		// It's too old, so robots.txt is fetched again
+		{"Expired", time.Now().Add(-2 * time.Hour), false, fetchedRobots, true},
+	}
+	for _, tst := range tests {
+		robots := response200()
+		robots.Header.Set("Content-Type", "text/plain")
+		robots.Body = ioutil.NopCloser(strings.NewReader(fetchedRobots))
+		roundTriper := mapRoundTrip{
+			Responses: map[string]*http.Response{
+				"http://t1.com/robots.txt":   robots,
+				"http://t1.com/private.html": response200(),
+			},
+		}
+
+		results := runFetcher(TestSpec{
+			hasParsedLinks: true,
+			transport:      &roundTriper,
+			hosts:          singleLinkDomainSpecArr("http://t1.com/private.html", nil),
+			hostContexts: map[string]*HostContext{
+				"t1.com": &HostContext{
+					Robots:     map[string][]byte{"t1.com": []byte(warmRobots)},
+					RobotsTime: tst.robotsTime,
+				},
+			},
+		}, t)
+
+		frs := results.dsStoreURLFetchResultsCalls()
+		if len(frs) != 1 {
+			t.Fatalf("For tag %v expected 1 call to StoreURLFetchResults, got %d", tst.tag, len(frs))
+		}
+		if frs[0].ExcludedByRobots != tst.expectExcluded {
+			t.Errorf("For tag %v expected ExcludedByRobots to be %v", tst.tag, tst.expectExcluded)
+		}
+
+		hc := results.datastore.HostContexts["t1.com"]
+		if hc == nil {
+			t.Fatalf("For tag %v expected a host context to be stored for t1.com", tst.tag)
+		}
+		if got := string(hc.Robots["t1.com"]); got != tst.expectedRobots {
+			t.Errorf("For tag %v expected stored robots.txt %q, got %q", tst.tag, tst.expectedRobots, got)
+		}
+		if fresh := !hc.RobotsTime.Equal(tst.robotsTime); fresh != tst.expectFreshTime {
+			t.Errorf("For tag %v got RobotsTime %v, original was %v", tst.tag, hc.RobotsTime, tst.robotsTime)
+		}
+	}
+}
+
+func TestCrawlDelayOverride(t *testing.T) {
+	// Like TestMaxCrawlDelay: the host asks for a very long Crawl-delay (and
+	// max_crawl_delay allows it), so the fetcher only gets through all the
+	// links in time if it honors the datastore's override.
+	origDefaultCrawlDelay := Config.Fetcher.DefaultCrawlDelay
+	origMaxCrawlDelay := Config.Fetcher.MaxCrawlDelay
+	defer func() {
+		Config.Fetcher.DefaultCrawlDelay = origDefaultCrawlDelay
+		Config.Fetcher.MaxCrawlDelay = origMaxCrawlDelay
+	}()
+	Config.Fetcher.MaxCrawlDelay = "5m"
+	Config.Fetcher.DefaultCrawlDelay = "0s"
+
+	tests := TestSpec{
+		hasParsedLinks:     true,
+		crawlDelayOverride: 100 * time.Millisecond,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url: "http://a.com/robots.txt",
+						response: &MockResponse{
+							Body: "User-agent: *\nCrawl-delay: 120\n",
+						},
+						robots: true,
+					},
+					LinkSpec{
+						url: "http://a.com/page1.html",
+					},
+					LinkSpec{
+						url: "http://a.com/page2.html",
+					},
+					LinkSpec{
+						url: "http://a.com/page3.html",
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcherTimed(tests, time.Second, t)
+
+	fetched := len(results.dsStoreURLFetchResultsCalls())
+	if fetched != 3 {
+		t.Errorf("Expected all 3 pages to be fetched with the crawl delay override, got %d", fetched)
+	}
+}
+
+func TestWebhookDomainEvents(t *testing.T) {
+	rec := newWebhookRecorder()
+	defer rec.Close()
+
+	origHooks := Config.Webhooks.Hooks
+	origMinFetches := Config.Webhooks.ErrorRateMinFetches
+	defer func() {
+		Config.Webhooks.Hooks = origHooks
+		Config.Webhooks.ErrorRateMinFetches = origMinFetches
+	}()
+	Config.Webhooks.Hooks = []WebhookConfig{{
+		URL:     rec.URL + "/hook",
+		Events:  []string{WebhookDomainCompleted, WebhookDomainErrorRate},
+		Payload: `{{.Event}} {{.Domain}} {{.Data.fetched}} {{.Data.errors}}`,
+	}}
+	Config.Webhooks.ErrorRateMinFetches = 2
+
+	tests := TestSpec{
+		hasParsedLinks: false,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://a.com/page1.html",
+						response: &MockResponse{Status: 500},
+					},
+					LinkSpec{
+						url:      "http://a.com/page2.html",
+						response: &MockResponse{Body: "<html></html>"},
+					},
+				},
+			},
+		},
+	}
+	runFetcher(tests, t)
+	configuredWebhooks().Wait()
+
+	got := rec.received("/hook")
+	expected := []string{"domain_error_rate a.com 2 1", "domain_completed a.com 2 1"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected webhooks %v, got %v", expected, got)
+	}
+	for _, e := range expected {
+		found := false
+		for _, g := range got {
+			found = found || g == e
+		}
+		if !found {
+			t.Errorf("Expected webhook %q, got %v", e, got)
+		}
+	}
+}
+
+func TestWebhookRobotsBlocked(t *testing.T) {
+	rec := newWebhookRecorder()
+	defer rec.Close()
+
+	origHooks := Config.Webhooks.Hooks
+	defer func() {
+		Config.Webhooks.Hooks = origHooks
+	}()
+	Config.Webhooks.Hooks = []WebhookConfig{{
+		URL:     rec.URL + "/hook",
+		Events:  []string{WebhookRobotsBlocked},
+		Payload: `{{.Domain}} {{.Data.host}}`,
+	}}
+
+	const blockingRobots = "User-agent: *\nDisallow: /\n"
+	tests := []struct {
+		tag        string
+		lastRobots string
+		expected   int
+	}{
+		// Newly blocked since the handed over robots.txt
+		{"Newly", "User-agent: *\nDisallow:\n", 1},
+		// Already blocked before
+		{"Already", blockingRobots, 0},
+	}
+	for _, tst := range tests {
+		robots := response200()
+		robots.Header.Set("Content-Type", "text/plain")
+		robots.Body = ioutil.NopCloser(strings.NewReader(blockingRobots))
+		roundTriper := mapRoundTrip{
+			Responses: map[string]*http.Response{
+				"http://t1.com/robots.txt": robots,
+				"http://t1.com/page.html":  response200(),
+			},
+		}
+
+		before := len(rec.received("/hook"))
+		runFetcher(TestSpec{
+			hasParsedLinks: true,
+			transport:      &roundTriper,
+			hosts:          singleLinkDomainSpecArr("http://t1.com/page.html", nil),
+			hostContexts: map[string]*HostContext{
+				"t1.com": &HostContext{
+					Robots:     map[string][]byte{"t1.com": []byte(tst.lastRobots)},
+					RobotsTime: time.Now().Add(-2 * time.Hour),
+				},
+			},
+		}, t)
+		configuredWebhooks().Wait()
+
+		got := rec.received("/hook")[before:]
+		if len(got) != tst.expected {
+			t.Fatalf("For tag %v expected %d robots_blocked webhooks, got %v", tst.tag, tst.expected, got)
+		}
+		if tst.expected > 0 && got[0] != "t1.com t1.com" {
+			t.Errorf("For tag %v got webhook payload %q", tst.tag, got[0])
+		}
+	}
+}
+
+func TestSitemapFresh(t *testing.T) {
+	origTrust := Config.Fetcher.SitemapTrust
+	defer func() {
+		Config.Fetcher.SitemapTrust = origTrust
+	}()
+	Config.Fetcher.SitemapTrust = "conservative"
+
+	lastCrawled := time.Now().Add(-24 * time.Hour)
+	sitemap := response200()
+	sitemap.Header.Set("Content-Type", "application/xml")
+	sitemap.Body = ioutil.NopCloser(strings.NewReader(`<urlset>
+		<url><loc>http://t1.com/unchanged.html</loc><lastmod>` +
+		lastCrawled.Add(-time.Hour).Format(time.RFC3339) + `</lastmod></url>
+		<url><loc>http://t1.com/changed.html</loc><lastmod>` +
+		lastCrawled.Add(time.Hour).Format(time.RFC3339) + `</lastmod></url>
+	</urlset>`))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/sitemap.xml":    sitemap,
+			"http://t1.com/unchanged.html": response200(),
+			"http://t1.com/changed.html":   response200(),
+			"http://t1.com/new.html":       response200(),
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/unchanged.html", lastCrawled: lastCrawled},
+					LinkSpec{url: "http://t1.com/changed.html", lastCrawled: lastCrawled},
+					LinkSpec{url: "http://t1.com/new.html"},
+				},
+			},
+		},
+	}, t)
+
+	skipped := map[string]bool{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		skipped[fr.URL.String()] = fr.SitemapFresh
+		if fr.SitemapFresh && fr.Response != nil {
+			t.Errorf("Expected %v not to be fetched", fr.URL)
+		}
+	}
+	expected := map[string]bool{
+		"http://t1.com/unchanged.html": true,
+		"http://t1.com/changed.html":   false,
+		"http://t1.com/new.html":       false,
+	}
+	for link, skip := range expected {
+		if skipped[link] != skip {
+			t.Errorf("Expected SitemapFresh for %v to be %v", link, skip)
+		}
+	}
+	if len(skipped) != len(expected) {
+		t.Errorf("Expected %d links stored, got %v", len(expected), skipped)
+	}
+}
+
+func TestRefreshHints(t *testing.T) {
+	origHints := Config.Fetcher.RefreshHints
+	defer func() {
+		Config.Fetcher.RefreshHints = origHints
+	}()
+	Config.Fetcher.RefreshHints = true
+
+	sitemap := response200()
+	sitemap.Header.Set("Content-Type", "application/xml")
+	sitemap.Body = ioutil.NopCloser(strings.NewReader(`<urlset>
+		<url><loc>http://t1.com/daily.html</loc><changefreq>daily</changefreq></url>
+		<url><loc>http://t1.com/meta.html</loc><changefreq>weekly</changefreq></url>
+	</urlset>`))
+	meta := response200()
+	meta.Body = ioutil.NopCloser(strings.NewReader(`<!DOCTYPE html>
+<html>
+<head>
+<meta name="Revisit-After" content="3 Days">
+<title>Revisit</title>
+</head>
+</html>`))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/sitemap.xml": sitemap,
+			"http://t1.com/daily.html":  response200(),
+			"http://t1.com/meta.html":   meta,
+			"http://t1.com/plain.html":  response200(),
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/daily.html"},
+					LinkSpec{url: "http://t1.com/meta.html"},
+					LinkSpec{url: "http://t1.com/plain.html"},
+				},
+			},
+		},
+	}, t)
+
+	hints := map[string]time.Duration{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		hints[fr.URL.String()] = fr.RefreshHint
+	}
+	expected := map[string]time.Duration{
+		"http://t1.com/daily.html": 24 * time.Hour,
+		"http://t1.com/meta.html":  3 * 24 * time.Hour,
+		"http://t1.com/plain.html": 0,
+	}
+	if !reflect.DeepEqual(hints, expected) {
+		t.Errorf("Expected refresh hints %v\nBut got: %v", expected, hints)
+	}
+}
+
+func TestSitemapDiscovery(t *testing.T) {
+	origDiscovery, origExclude := Config.Fetcher.SitemapDiscovery, Config.Fetcher.ExcludeLinkPatterns
+	defer func() {
+		Config.Fetcher.SitemapDiscovery = origDiscovery
+		Config.Fetcher.ExcludeLinkPatterns = origExclude
+	}()
+	Config.Fetcher.SitemapDiscovery = true
+	Config.Fetcher.ExcludeLinkPatterns = []string{`\.mov$`}
+
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader("User-agent: *\nSitemap: http://t1.com/maps/index.xml\n"))
+	index := response200()
+	index.Header.Set("Content-Type", "application/xml")
+	index.Body = ioutil.NopCloser(strings.NewReader(`<sitemapindex>
+		<sitemap><loc>http://t1.com/maps/pages.xml</loc></sitemap>
+	</sitemapindex>`))
+	pages := response200()
+	pages.Header.Set("Content-Type", "application/xml")
+	pages.Body = ioutil.NopCloser(strings.NewReader(`<urlset>
+		<url><loc>http://t1.com/new.html</loc><lastmod>2014-03-01</lastmod><priority>0.9</priority></url>
+		<url><loc>http://t1.com/plain.html</loc></url>
+		<url><loc>http://t1.com/movie.mov</loc></url>
+	</urlset>`))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/robots.txt":     robots,
+			"http://t1.com/maps/index.xml": index,
+			"http://t1.com/maps/pages.xml": pages,
+			"http://t1.com/plain.html":     response200(),
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links:  []LinkSpec{LinkSpec{url: "http://t1.com/plain.html"}},
+			},
+		},
+	}, t)
+
+	links, frs := results.dsStoreParsedURLCalls()
+	if len(links) != 2 {
+		t.Fatalf("Expected the 2 allowed sitemap links stored, got %v", links)
+	}
+	if links[0].String() != "http://t1.com/new.html" || links[0].SitemapPriority != 0.9 ||
+		!links[0].SitemapLastMod.Equal(time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected new.html stored with its sitemap hints, got %v (lastmod %v, priority %v)",
+			links[0], links[0].SitemapLastMod, links[0].SitemapPriority)
+	}
+	if links[1].String() != "http://t1.com/plain.html" {
+		t.Errorf("Expected plain.html stored, got %v", links[1])
+	}
+	for _, fr := range frs {
+		if fr.URL.String() != "http://t1.com/maps/pages.xml" {
+			t.Errorf("Expected sitemap links found on pages.xml, got %v", fr.URL)
+		}
+	}
+	if n := results.manager.Report().Coverage.SitemapLinks; n != 2 {
+		t.Errorf("Expected 2 sitemap links reported, got %d", n)
+	}
+}
+
+func TestParseRevisitAfter(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected time.Duration
+	}{
+		{"7 days", 7 * 24 * time.Hour},
+		{"1 day", 24 * time.Hour},
+		{" 2 weeks", 14 * 24 * time.Hour},
+		{"1 month", 30 * 24 * time.Hour},
+		{"12 hours", 12 * time.Hour},
+		{"10", 10 * 24 * time.Hour},
+		{"0 days", 0},
+		{"soon", 0},
+		{"", 0},
+	}
+	for _, tst := range tests {
+		if got := parseRevisitAfter(tst.content); got != tst.expected {
+			t.Errorf("parseRevisitAfter(%q) = %v, expected %v", tst.content, got, tst.expected)
+		}
+	}
+}
+
+func TestCrawlReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walker-report")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	origFile := Config.Fetcher.ReportFile
+	defer func() {
+		Config.Fetcher.ReportFile = origFile
+	}()
+	Config.Fetcher.ReportFile = filepath.Join(dir, "report.json")
+
+	robots := response200()
+	robots.Header.Set("Content-Type", "text/plain")
+	robots.Body = ioutil.NopCloser(strings.NewReader("User-agent: *\nDisallow: /private\n"))
+	large := response200()
+	large.Header.Set("Content-Length", fmt.Sprint(Config.Fetcher.MaxHTTPContentSizeBytes+1))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/robots.txt": robots,
+			"http://t1.com/page.html":  response200(),
+			"http://t1.com/large.html": large,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/page.html"},
+					LinkSpec{url: "http://t1.com/large.html"},
+					LinkSpec{url: "http://t1.com/missing.html"},
+					LinkSpec{url: "http://t1.com/private/page.html"},
+				},
+			},
+		},
+	}, t)
+
+	b, err := ioutil.ReadFile(Config.Fetcher.ReportFile)
+	if err != nil {
+		t.Fatalf("Expected the crawl report to be written: %v", err)
+	}
+	var written CrawlReport
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatalf("Failed to parse crawl report: %v", err)
+	}
+
+	for _, r := range []*CrawlReport{results.manager.Report(), &written} {
+		if r.Format != crawlReportFormat {
+			t.Errorf("Expected format %q, got %q", crawlReportFormat, r.Format)
+		}
+		if r.Coverage.Domains != 1 || r.Coverage.DomainsCompleted != 1 {
+			t.Errorf("Expected 1 domain crawled and completed, got %+v", r.Coverage)
+		}
+		if r.Coverage.LinksRequested != 3 || r.Coverage.LinksFetched != 2 {
+			t.Errorf("Expected 3 links requested and 2 fetched, got %+v", r.Coverage)
+		}
+		if r.Errors.FetchErrors != 1 || r.Errors.ClientErrors != 1 || r.Errors.Statuses["404"] != 1 {
+			t.Errorf("Expected 1 fetch error and 1 404, got %+v", r.Errors)
+		}
+		if r.Policy.RobotsExcluded != 1 || r.Policy.SizeRejected != 1 {
+			t.Errorf("Expected 1 robots exclusion and 1 size rejection, got %+v", r.Policy)
+		}
+		if len(r.TopContentTypes) == 0 || r.TopContentTypes[0].Name != "text/html" {
+			t.Errorf("Expected text/html to be the top content type, got %v", r.TopContentTypes)
+		}
+		if r.BytesByDomain["t1.com"] != r.Coverage.Bytes || r.Coverage.Bytes == 0 {
+			t.Errorf("Expected all bytes read from t1.com, got %v of %v",
+				r.BytesByDomain["t1.com"], r.Coverage.Bytes)
+		}
+	}
+}
+
+func TestTestSite(t *testing.T) {
+	site := &TestSite{
+		Host:   "t1.com",
+		Robots: "User-agent: *\nDisallow: /private\n",
+		Pages: []*TestPage{
+			{Path: "/", Links: []string{"/a.html", "/moved.html", "http://t2.com/"}},
+			{Path: "/a.html", Status: 404},
+			{Path: "/moved.html", RedirectTo: "/new.html"},
+			{Path: "/new.html", Body: "plain", ContentType: "text/plain"},
+			{Path: "/slow.html", Delay: 50 * time.Millisecond},
+			{Path: "/private/page.html"},
+		},
+	}
+
+	results := runFetcher(TestSpec{sites: []*TestSite{site}}, t)
+
+	statuses := map[string]int{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		switch {
+		case fr.ExcludedByRobots:
+			statuses[fr.URL.String()] = -1
+		case fr.Response != nil:
+			statuses[fr.URL.String()] = fr.Response.StatusCode
+		}
+	}
+	expected := map[string]int{
+		"http://t1.com/":                  200,
+		"http://t1.com/a.html":            404,
+		"http://t1.com/moved.html":        200,
+		"http://t1.com/new.html":          200,
+		"http://t1.com/slow.html":         200,
+		"http://t1.com/private/page.html": -1,
+	}
+	for link, status := range expected {
+		if statuses[link] != status {
+			t.Errorf("Expected %v to get %d, got %d", link, status, statuses[link])
+		}
+	}
+	if !results.server.Requested("GET", "http://t1.com/new.html") {
+		t.Errorf("Expected the redirect of /moved.html to be followed")
+	}
+
+	parsed := map[string]bool{}
+	links, _ := results.dsStoreParsedURLCalls()
+	for _, u := range links {
+		parsed[u.String()] = true
+	}
+	for _, link := range []string{"http://t1.com/a.html", "http://t1.com/moved.html", "http://t2.com/"} {
+		if !parsed[link] {
+			t.Errorf("Expected %v to be parsed from the home page, got %v", link, parsed)
+		}
+	}
+}
+
+func TestSessionBootstrap(t *testing.T) {
+	orig := Config.Sessions.Bootstraps
+	defer func() { Config.Sessions.Bootstraps = orig }()
+	Config.Sessions.Bootstraps = []SessionBootstrap{
+		{
+			Domain: "t1.com",
+			Steps: []SessionStep{{
+				URL:  "http://login.t1.com/session",
+				Form: []SessionField{{"username", "crawler"}, {"password", "hunter2"}},
+			}},
+		},
+	}
+
+	login := response200()
+	login.Header.Set("Set-Cookie", "sid=s3cret; Domain=t1.com; Path=/")
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport: &mapRoundTrip{
+			Responses: map[string]*http.Response{
+				"http://login.t1.com/session": login,
+				"http://t1.com/private.html":  response200(),
+				"http://t2.com/public.html":   response200(),
+			},
+		},
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links:  []LinkSpec{LinkSpec{url: "http://t1.com/private.html"}},
+			},
+			DomainSpec{
+				domain: "t2.com",
+				links:  []LinkSpec{LinkSpec{url: "http://t2.com/public.html"}},
+			},
+		},
+	}, t)
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 2 {
+		t.Fatalf("Expected 2 stored fetch results, got %d", len(frs))
+	}
+	for _, fr := range frs {
+		cookie := fr.Response.Request.Header.Get("Cookie")
+		switch fr.URL.String() {
+		case "http://t1.com/private.html":
+			if cookie != "sid=s3cret" {
+				t.Errorf("Expected the session cookie with %v, got %q", fr.URL, cookie)
+			}
+		default:
+			if cookie != "" {
+				t.Errorf("Expected no cookie with %v, got %q", fr.URL, cookie)
+			}
+		}
+	}
+}
+
+// rangeRoundTrip serves 50 byte documents that claim to be too large to fetch,
+// recording the Range headers it is sent. Only /ranged.html honors them.
+type rangeRoundTrip struct {
+	mu     sync.Mutex
+	ranges []string
+}
+
+func (rt *rangeRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path == "/robots.txt" {
+		return response404(), nil
+	}
+	body := strings.Repeat("0123456789", 5)
+	res := response200()
+	res.Request = req
+	switch req.URL.Path {
+	case "/chunked.html":
+		// No Content-Length, so the size is only found out by reading
+	case "/image.png":
+		res.Header.Set("Content-Type", "image/png")
+		res.Header.Set("Content-Length", "50")
+	default:
+		res.Header.Set("Content-Length", "50")
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		rt.mu.Lock()
+		rt.ranges = append(rt.ranges, req.URL.Path+" "+r)
+		rt.mu.Unlock()
+		if req.URL.Path == "/ranged.html" {
+			res.StatusCode = http.StatusPartialContent
+			res.Status = "206 Partial Content"
+			res.Header.Set("Content-Range", "bytes 0-7/50")
+			res.Header.Set("Content-Length", "8")
+			body = body[:8]
+		}
+	}
+	res.Body = ioutil.NopCloser(strings.NewReader(body))
+	return res, nil
+}
+
+func TestRangeFetch(t *testing.T) {
+	origMax, origRange := Config.Fetcher.MaxHTTPContentSizeBytes, Config.Fetcher.RangeFetchBytes
+	origReject := Config.Fetcher.RejectUnacceptedTypes
+	defer func() {
+		Config.Fetcher.MaxHTTPContentSizeBytes = origMax
+		Config.Fetcher.RangeFetchBytes = origRange
+		Config.Fetcher.RejectUnacceptedTypes = origReject
+	}()
+	Config.Fetcher.MaxHTTPContentSizeBytes = 20
+	Config.Fetcher.RangeFetchBytes = 8
+	// So the image gets as far as its size being checked
+	Config.Fetcher.RejectUnacceptedTypes = false
+
+	rt := &rangeRoundTrip{}
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      rt,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/ranged.html"},
+					LinkSpec{url: "http://t1.com/ignored.html"},
+					LinkSpec{url: "http://t1.com/chunked.html"},
+					LinkSpec{url: "http://t1.com/image.png"},
+				},
+			},
+		},
+	}, t)
+
+	expectedRanges := []string{"/ranged.html bytes=0-7", "/ignored.html bytes=0-7"}
+	if !reflect.DeepEqual(rt.ranges, expectedRanges) {
+		t.Errorf("Expected ranged GETs %v, got %v", expectedRanges, rt.ranges)
+	}
+
+	expectedStatus := map[string]int{
+		"http://t1.com/ranged.html":  http.StatusPartialContent,
+		"http://t1.com/ignored.html": http.StatusOK,
+		"http://t1.com/chunked.html": http.StatusOK,
+	}
+	stored := results.dsStoreURLFetchResultsCalls()
+	if len(stored) != 4 {
+		t.Fatalf("Expected 4 fetch results stored, got %d", len(stored))
+	}
+	for _, fr := range stored {
+		link := fr.URL.String()
+		if link == "http://t1.com/image.png" {
+			if fr.FetchError != errContentTooLarge || fr.Partial {
+				t.Errorf("Expected %v to be rejected as too large, got error %v", link, fr.FetchError)
+			}
+			continue
+		}
+		if fr.FetchError != nil || !fr.Partial || fr.ContentSize != 8 {
+			t.Errorf("Expected the first 8 bytes of %v, got error %v, partial %v, size %v",
+				link, fr.FetchError, fr.Partial, fr.ContentSize)
+		}
+		if fr.Response == nil || fr.Response.StatusCode != expectedStatus[link] {
+			t.Errorf("Expected %v to be stored with status %v, got %+v", link, expectedStatus[link], fr.Response)
+		}
+	}
+	if n := len(results.handlerCalls()); n != 3 {
+		t.Errorf("Expected the 3 partial documents to be handled, got %d handler calls", n)
+	}
+}
+
+func TestHandlerFormats(t *testing.T) {
+	orig := Config.Fetcher.HandlerFormats
+	defer func() {
+		Config.Fetcher.HandlerFormats = orig
+	}()
+	Config.Fetcher.HandlerFormats = []string{"text/html"}
+
+	text := response200()
+	text.Header.Set("Content-Type", "text/plain")
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/page.html": response200(),
+			"http://t1.com/page.txt":  text,
+		},
+	}
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/page.html"},
+					LinkSpec{url: "http://t1.com/page.txt"},
+				},
+			},
+		},
+	}, t)
+
+	hcalls := results.handlerCalls()
+	if len(hcalls) != 1 || hcalls[0].URL.String() != "http://t1.com/page.html" {
+		t.Errorf("Expected only the HTML page to be handled, got %d handler calls", len(hcalls))
+	}
+	if n := len(results.dsStoreURLFetchResultsCalls()); n != 2 {
+		t.Errorf("Expected both fetches to be stored, got %d", n)
+	}
+	if skipped := results.manager.Report().Policy.TypeSkipped; skipped != 1 {
+		t.Errorf("Expected 1 response skipped for its type, got %d", skipped)
+	}
+}
+
+func TestRejectUnacceptedTypes(t *testing.T) {
+	origAccept, origPDF := Config.Fetcher.AcceptFormats, Config.Fetcher.ParsePDF
+	defer func() {
+		Config.Fetcher.AcceptFormats = origAccept
+		Config.Fetcher.ParsePDF = origPDF
+	}()
+	Config.Fetcher.AcceptFormats = []string{"text/html", "text/*; q=0.5"}
+	Config.Fetcher.ParsePDF = true
+
+	withType := func(ctype string) *http.Response {
+		res := response200()
+		res.Header.Set("Content-Type", ctype)
+		res.Body = ioutil.NopCloser(strings.NewReader("not a page"))
+		return res
+	}
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/page.html": response200(),
+			"http://t1.com/page.txt":  withType("text/plain"),
+			"http://t1.com/image.png": withType("image/png"),
+			"http://t1.com/doc.pdf":   withType("application/pdf"),
+		},
+	}
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{url: "http://t1.com/page.html"},
+					LinkSpec{url: "http://t1.com/page.txt"},
+					LinkSpec{url: "http://t1.com/image.png"},
+					LinkSpec{url: "http://t1.com/doc.pdf"},
+				},
+			},
+		},
+	}, t)
+
+	stored := results.dsStoreURLFetchResultsCalls()
+	if len(stored) != 4 {
+		t.Fatalf("Expected 4 fetch results stored, got %d", len(stored))
+	}
+	for _, fr := range stored {
+		link := fr.URL.String()
+		if accept := fr.Response.Request.Header.Get("Accept"); accept != "text/html, text/*;q=0.5" {
+			t.Errorf("Expected %v to be fetched with the configured Accept header, got %q", link, accept)
+		}
+		// The PDF is downloaded for parse_pdf despite not being accepted, if
+		// walker is built to parse PDFs
+		rejected := link == "http://t1.com/image.png" || !pdfSupported && link == "http://t1.com/doc.pdf"
+		if fr.TypeRejected != rejected {
+			t.Errorf("Expected %v to have TypeRejected %v", link, rejected)
+		}
+		if rejected && (fr.ContentSize != 0 || fr.FnvFingerprint != 0) {
+			t.Errorf("Expected %v to be stored without its body, got size %d", link, fr.ContentSize)
+		}
+		if link == "http://t1.com/image.png" && fr.MimeType != "image/png" {
+			t.Errorf("Expected %v to be stored as an image, got mime type %q", link, fr.MimeType)
+		}
+	}
+	if n := len(results.handlerCalls()); n != 2 {
+		t.Errorf("Expected the 2 text documents to be handled, got %d handler calls", n)
+	}
+	if skipped := results.manager.Report().Policy.TypeSkipped; skipped != 2 {
+		t.Errorf("Expected 2 responses skipped for their type, got %d", skipped)
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	origBytes, origCount := Config.Fetcher.MaxResponseHeaderBytes, Config.Fetcher.MaxResponseHeaders
+	defer func() {
+		Config.Fetcher.MaxResponseHeaderBytes = origBytes
+		Config.Fetcher.MaxResponseHeaders = origCount
+	}()
+	Config.Fetcher.MaxResponseHeaderBytes = 4096
+	Config.Fetcher.MaxResponseHeaders = 20
+
+	many := http.Header{}
+	for i := 0; i < 30; i++ {
+		many.Add("X-Junk", fmt.Sprint(i))
+	}
+	results := runFetcher(TestSpec{
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/large.html",
+						response: &MockResponse{Headers: http.Header{"X-Junk": []string{strings.Repeat("x", 8192)}}},
+					},
+					LinkSpec{
+						url:      "http://t1.com/many.html",
+						response: &MockResponse{Headers: many},
+					},
+					LinkSpec{
+						url:      "http://t1.com/ok.html",
+						response: &MockResponse{Body: "<html>ok</html>"},
+					},
+				},
+			},
+		},
+	}, t)
+
+	stored := map[string]*FetchResults{}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		stored[fr.URL.Path] = fr
+	}
+	for _, path := range []string{"/large.html", "/many.html"} {
+		if fr := stored[path]; fr == nil || !IsHeaderLimitError(fr.FetchError) || fr.Response != nil {
+			t.Errorf("Expected %v to be abandoned with a header limit error, got %+v", path, fr)
+		}
+	}
+	if fr := stored["/ok.html"]; fr == nil || fr.FetchError != nil {
+		t.Errorf("Expected ok.html to be fetched, got %+v", fr)
+	}
+
+	report := results.manager.Report()
+	if report.Errors.HeaderLimitErrors != 2 || report.Errors.FetchErrors != 2 {
+		t.Errorf("Expected 2 header limit errors reported, got %+v", report.Errors)
+	}
+}
+
+func TestSkipUnchangedPages(t *testing.T) {
+	orig := Config.Fetcher.SkipUnchangedPages
+	defer func() {
+		Config.Fetcher.SkipUnchangedPages = orig
+	}()
+	Config.Fetcher.SkipUnchangedPages = true
+
+	const html string = `<!DOCTYPE html>
+<html>
+<body>
+	<a href="/other.html">other</a>
+</body>
+</html>`
+	h := fnv.New64()
+	h.Write([]byte(html))
+	fp := int64(h.Sum64())
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:         "http://t1.com/same.html",
+						response:    &MockResponse{Body: html},
+						fingerprint: fp,
+					},
+					LinkSpec{
+						url:         "http://t1.com/changed.html",
+						response:    &MockResponse{Body: html},
+						fingerprint: fp + 1,
+					},
+					LinkSpec{
+						url:         "http://t1.com/notmodified.html",
+						response:    &MockResponse{Status: 304},
+						lastCrawled: time.Now(),
+						fingerprint: fp,
+					},
+				},
+			},
+		},
+	}, t)
+
+	hcs := results.handlerCalls()
+	if len(hcs) != 1 || hcs[0].URL.String() != "http://t1.com/changed.html" {
+		t.Errorf("Expected only changed.html to be handled, got %v", hcs)
+	}
+	_, frs := results.dsStoreParsedURLCalls()
+	for _, fr := range frs {
+		if fr.URL.String() == "http://t1.com/same.html" {
+			t.Errorf("Expected no links parsed from the unchanged same.html")
+		}
+	}
+	frs = results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 3 {
+		t.Errorf("Expected 3 fetch results stored, got %v", len(frs))
+	}
+	for _, fr := range frs {
+		same := fr.URL.String() != "http://t1.com/changed.html"
+		if fr.Unchanged != same {
+			t.Errorf("Expected Unchanged to be %v for %v", same, fr.URL)
+		}
+		if fr.FnvFingerprint != fp {
+			t.Errorf("Expected %v stored with fingerprint %v, got %v", fr.URL, fp, fr.FnvFingerprint)
+		}
+	}
+}
+
+func TestDenyExtensions(t *testing.T) {
+	orig := Config.Fetcher.DenyExtensions
+	defer func() {
+		Config.Fetcher.DenyExtensions = orig
+	}()
+	Config.Fetcher.DenyExtensions = []string{".zip"}
+
+	const html string = `<!DOCTYPE html>
+<html>
+<body>
+	<a href="/other.html">other</a>
+	<a href="/archive.zip">archive</a>
+</body>
+</html>`
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "t1.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://t1.com/page.html",
+						response: &MockResponse{Body: html},
+					},
+					LinkSpec{
+						url:      "http://t1.com/stored.zip",
+						response: &MockResponse{Body: "binary"},
+					},
+				},
+			},
+		},
+	}, t)
+
+	hcs := results.handlerCalls()
+	if len(hcs) != 1 || hcs[0].URL.String() != "http://t1.com/page.html" {
+		t.Errorf("Expected only page.html to be fetched and handled, got %v", hcs)
+	}
+	for _, fr := range results.dsStoreURLFetchResultsCalls() {
+		denied := fr.URL.String() == "http://t1.com/stored.zip"
+		if fr.ExtensionDenied != denied {
+			t.Errorf("Expected ExtensionDenied to be %v for %v", denied, fr.URL)
+		}
+		if denied && fr.Response != nil {
+			t.Errorf("Expected no request made for %v", fr.URL)
+		}
+	}
+	ulst, _ := results.dsStoreParsedURLCalls()
+	if len(ulst) != 1 || ulst[0].String() != "http://t1.com/other.html" {
+		t.Errorf("Expected only other.html to be stored, got %v", ulst)
+	}
+}
+
+func TestBurstCrawlDelay(t *testing.T) {
+	// The host has no robots.txt and default_crawl_delay is long, so the
+	// fetcher only gets through all the links in time if it uses
+	// burst_crawl_delay for a host in burst mode.
+	origDefaultCrawlDelay := Config.Fetcher.DefaultCrawlDelay
+	origBurstCrawlDelay := Config.Fetcher.BurstCrawlDelay
+	defer func() {
+		Config.Fetcher.DefaultCrawlDelay = origDefaultCrawlDelay
+		Config.Fetcher.BurstCrawlDelay = origBurstCrawlDelay
+	}()
+	Config.Fetcher.DefaultCrawlDelay = "2m"
+	Config.Fetcher.BurstCrawlDelay = "10ms"
+
+	tests := TestSpec{
+		hasParsedLinks: true,
+		burst:          true,
+		hosts: []DomainSpec{
+			DomainSpec{
+				domain: "a.com",
+				links: []LinkSpec{
+					LinkSpec{
+						url:      "http://a.com/robots.txt",
+						response: &MockResponse{Status: 404},
+						robots:   true,
+					},
+					LinkSpec{
+						url: "http://a.com/page1.html",
+					},
+					LinkSpec{
+						url: "http://a.com/page2.html",
+					},
+					LinkSpec{
+						url: "http://a.com/page3.html",
+					},
+				},
+			},
+		},
+	}
+
+	results := runFetcherTimed(tests, time.Second, t)
+
+	fetched := len(results.dsStoreURLFetchResultsCalls())
+	if fetched != 3 {
+		t.Errorf("Expected all 3 pages to be fetched at the burst crawl delay, got %d", fetched)
+	}
+}
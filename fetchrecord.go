@@ -0,0 +1,630 @@
+package walker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// FetchResults can be serialized, as JSON or protocol buffers, so handlers
+// that pass them on (ex. to Kafka, over gRPC or to a webhook) and the
+// consumers at the other end share one wire format. Both are encodings of a
+// FetchRecord; the protocol buffer schema is in fetchrecord.proto, and the
+// JSON field names match its field names.
+//
+// Not everything in a FetchResults is serialized: page diffs, watch changes
+// and screenshots are left out, as are the details of the http.Response
+// beyond its status, headers and body.
+
+// FetchRecord is the serialized form of a FetchResults. Errors are kept as
+// their messages, URLs as strings and times as UTC (a zero or nil time means
+// not set).
+type FetchRecord struct {
+	URL              string    `json:"url"`
+	RedirectedFrom   []string  `json:"redirected_from,omitempty"`
+	FetchTime        time.Time `json:"fetch_time"`
+	FetchError       string    `json:"fetch_error,omitempty"`
+	ExcludedByRobots bool      `json:"excluded_by_robots,omitempty"`
+	SitemapFresh     bool      `json:"sitemap_fresh,omitempty"`
+
+	// The response, if one was received (StatusCode is 0 if not). Body is
+	// the content read (base64 in JSON).
+	StatusCode     int                 `json:"status_code,omitempty"`
+	Headers        map[string][]string `json:"headers,omitempty"`
+	Body           []byte              `json:"body,omitempty"`
+	MimeType       string              `json:"mime_type,omitempty"`
+	FnvFingerprint int64               `json:"fnv_fingerprint,omitempty"`
+	ContentSize    int64               `json:"content_size,omitempty"`
+	Partial        bool                `json:"partial,omitempty"`
+
+	MetaNoIndex    bool `json:"meta_noindex,omitempty"`
+	MetaNoFollow   bool `json:"meta_nofollow,omitempty"`
+	MetaNoAI       bool `json:"meta_noai,omitempty"`
+	MetaNoImageAI  bool `json:"meta_noimageai,omitempty"`
+	MetaNoSnippet  bool `json:"meta_nosnippet,omitempty"`
+	MetaMaxSnippet int  `json:"meta_max_snippet,omitempty"`
+
+	AMPURL       string `json:"amp_url,omitempty"`
+	MobileURL    string `json:"mobile_url,omitempty"`
+	CanonicalURL string `json:"canonical_url,omitempty"`
+
+	Text       string `json:"text,omitempty"`
+	ParseError string `json:"parse_error,omitempty"`
+
+	CacheMaxAge  int        `json:"cache_max_age,omitempty"`
+	CacheExpires *time.Time `json:"cache_expires,omitempty"`
+	CrawlAt      *time.Time `json:"crawl_at,omitempty"`
+	Unchanged    bool       `json:"unchanged,omitempty"`
+
+	// RefreshHint is in seconds
+	RefreshHint int `json:"refresh_hint,omitempty"`
+
+	OutlinkDomains map[string]int `json:"outlink_domains,omitempty"`
+
+	Node string `json:"node,omitempty"`
+
+	HandlerError string `json:"handler_error,omitempty"`
+	HandlerRetry bool   `json:"handler_retry,omitempty"`
+	Sampled      bool   `json:"sampled,omitempty"`
+
+	ExpandedLinks []FetchRecordExpansion `json:"expanded_links,omitempty"`
+	Image         *FetchRecordImage      `json:"image,omitempty"`
+}
+
+// FetchRecordExpansion is the serialized form of a LinkExpansion
+type FetchRecordExpansion struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// FetchRecordImage is the serialized form of an ImageInfo
+type FetchRecordImage struct {
+	Format      string  `json:"format"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	CameraMake  string  `json:"camera_make,omitempty"`
+	CameraModel string  `json:"camera_model,omitempty"`
+	HasGPS      bool    `json:"has_gps,omitempty"`
+	Latitude    float64 `json:"latitude,omitempty"`
+	Longitude   float64 `json:"longitude,omitempty"`
+}
+
+// NewFetchRecord returns the FetchRecord of fr. The body recorded is fr.Body
+// if it is set, and otherwise what is read from fr.Response.Body, which is
+// replaced with a reader of the same content.
+func NewFetchRecord(fr *FetchResults) (*FetchRecord, error) {
+	r := &FetchRecord{
+		FetchTime:        fr.FetchTime.UTC(),
+		FetchError:       errorString(fr.FetchError),
+		ExcludedByRobots: fr.ExcludedByRobots,
+		SitemapFresh:     fr.SitemapFresh,
+		MimeType:         fr.MimeType,
+		FnvFingerprint:   fr.FnvFingerprint,
+		ContentSize:      fr.ContentSize,
+		Partial:          fr.Partial,
+		RefreshHint:      int(fr.RefreshHint / time.Second),
+		OutlinkDomains:   fr.OutlinkDomains,
+		Node:             fr.Node,
+		MetaNoIndex:      fr.MetaNoIndex,
+		MetaNoFollow:     fr.MetaNoFollow,
+		MetaNoAI:         fr.MetaNoAI,
+		MetaNoImageAI:    fr.MetaNoImageAI,
+		MetaNoSnippet:    fr.MetaNoSnippet,
+		MetaMaxSnippet:   fr.MetaMaxSnippet,
+		AMPURL:           urlString(fr.AMPURL),
+		MobileURL:        urlString(fr.MobileURL),
+		CanonicalURL:     urlString(fr.CanonicalURL),
+		Text:             fr.Text,
+		ParseError:       errorString(fr.ParseError),
+		CacheMaxAge:      fr.CacheMaxAge,
+		CacheExpires:     timePtr(fr.CacheExpires),
+		CrawlAt:          timePtr(fr.CrawlAt),
+		Unchanged:        fr.Unchanged,
+		HandlerError:     errorString(fr.HandlerError),
+		HandlerRetry:     fr.HandlerRetry,
+		Sampled:          fr.Sampled,
+	}
+	if fr.URL == nil {
+		return nil, fmt.Errorf("FetchResults has no URL")
+	}
+	r.URL = fr.URL.String()
+	for _, u := range fr.RedirectedFrom {
+		r.RedirectedFrom = append(r.RedirectedFrom, u.String())
+	}
+	for _, e := range fr.ExpandedLinks {
+		r.ExpandedLinks = append(r.ExpandedLinks, FetchRecordExpansion{From: urlString(e.From), To: urlString(e.To)})
+	}
+	if img := fr.Image; img != nil {
+		r.Image = &FetchRecordImage{
+			Format:      img.Format,
+			Width:       img.Width,
+			Height:      img.Height,
+			CameraMake:  img.CameraMake,
+			CameraModel: img.CameraModel,
+			HasGPS:      img.HasGPS,
+			Latitude:    img.Latitude,
+			Longitude:   img.Longitude,
+		}
+	}
+
+	if res := fr.Response; res != nil {
+		r.StatusCode = res.StatusCode
+		if len(res.Header) > 0 {
+			r.Headers = map[string][]string(res.Header)
+		}
+		if fr.Body != "" {
+			r.Body = []byte(fr.Body)
+		} else if res.Body != nil {
+			body, err := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			res.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to read response body of %v: %v", r.URL, err)
+			}
+			if len(body) > 0 {
+				r.Body = body
+			}
+		}
+	}
+	return r, nil
+}
+
+// FetchResults returns the FetchResults r records. If there was a response
+// it is rebuilt from the status, headers and body recorded.
+func (r *FetchRecord) FetchResults() (*FetchResults, error) {
+	var err error
+	fr := &FetchResults{
+		FetchTime:        r.FetchTime,
+		FetchError:       stringError(r.FetchError),
+		ExcludedByRobots: r.ExcludedByRobots,
+		SitemapFresh:     r.SitemapFresh,
+		MimeType:         r.MimeType,
+		FnvFingerprint:   r.FnvFingerprint,
+		ContentSize:      r.ContentSize,
+		Partial:          r.Partial,
+		RefreshHint:      time.Duration(r.RefreshHint) * time.Second,
+		OutlinkDomains:   r.OutlinkDomains,
+		Node:             r.Node,
+		MetaNoIndex:      r.MetaNoIndex,
+		MetaNoFollow:     r.MetaNoFollow,
+		MetaNoAI:         r.MetaNoAI,
+		MetaNoImageAI:    r.MetaNoImageAI,
+		MetaNoSnippet:    r.MetaNoSnippet,
+		MetaMaxSnippet:   r.MetaMaxSnippet,
+		Text:             r.Text,
+		ParseError:       stringError(r.ParseError),
+		CacheMaxAge:      r.CacheMaxAge,
+		Unchanged:        r.Unchanged,
+		HandlerError:     stringError(r.HandlerError),
+		HandlerRetry:     r.HandlerRetry,
+		Sampled:          r.Sampled,
+	}
+	if r.CacheExpires != nil {
+		fr.CacheExpires = *r.CacheExpires
+	}
+	if r.CrawlAt != nil {
+		fr.CrawlAt = *r.CrawlAt
+	}
+	if img := r.Image; img != nil {
+		fr.Image = &ImageInfo{
+			Format:      img.Format,
+			Width:       img.Width,
+			Height:      img.Height,
+			CameraMake:  img.CameraMake,
+			CameraModel: img.CameraModel,
+			HasGPS:      img.HasGPS,
+			Latitude:    img.Latitude,
+			Longitude:   img.Longitude,
+		}
+	}
+
+	if fr.URL, err = ParseURL(r.URL); err != nil {
+		return nil, fmt.Errorf("Bad url %q: %v", r.URL, err)
+	}
+	for _, link := range r.RedirectedFrom {
+		u, err := ParseURL(link)
+		if err != nil {
+			return nil, fmt.Errorf("Bad redirected_from url %q: %v", link, err)
+		}
+		fr.RedirectedFrom = append(fr.RedirectedFrom, u)
+	}
+	for _, link := range []struct {
+		from string
+		to   **URL
+	}{{r.AMPURL, &fr.AMPURL}, {r.MobileURL, &fr.MobileURL}, {r.CanonicalURL, &fr.CanonicalURL}} {
+		if link.from == "" {
+			continue
+		}
+		if *link.to, err = ParseURL(link.from); err != nil {
+			return nil, fmt.Errorf("Bad url %q: %v", link.from, err)
+		}
+	}
+	for _, e := range r.ExpandedLinks {
+		from, err := ParseURL(e.From)
+		if err != nil {
+			return nil, fmt.Errorf("Bad expanded link %q: %v", e.From, err)
+		}
+		to, err := ParseURL(e.To)
+		if err != nil {
+			return nil, fmt.Errorf("Bad expanded link %q: %v", e.To, err)
+		}
+		fr.ExpandedLinks = append(fr.ExpandedLinks, LinkExpansion{From: from, To: to})
+	}
+
+	if r.StatusCode != 0 {
+		// The request that got the response was for the last redirect, if any
+		last := fr.URL
+		if len(fr.RedirectedFrom) > 0 {
+			last = fr.RedirectedFrom[len(fr.RedirectedFrom)-1]
+		}
+		fr.Response = &http.Response{
+			Status:     fmt.Sprintf("%d %s", r.StatusCode, http.StatusText(r.StatusCode)),
+			StatusCode: r.StatusCode,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header(r.Headers),
+			Body:       ioutil.NopCloser(bytes.NewReader(r.Body)),
+			Request:    &http.Request{Method: "GET", URL: last.URL},
+		}
+		if fr.Response.Header == nil {
+			fr.Response.Header = http.Header{}
+		}
+	}
+	return fr, nil
+}
+
+// EncodeFetchResultsJSON returns the JSON encoding of fr's FetchRecord
+func EncodeFetchResultsJSON(fr *FetchResults) ([]byte, error) {
+	r, err := NewFetchRecord(fr)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(r)
+}
+
+// DecodeFetchResultsJSON decodes a FetchResults encoded by
+// EncodeFetchResultsJSON
+func DecodeFetchResultsJSON(b []byte) (*FetchResults, error) {
+	var r FetchRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("Failed to decode fetch record: %v", err)
+	}
+	return r.FetchResults()
+}
+
+// EncodeFetchResultsProto returns the protocol buffer encoding of fr's
+// FetchRecord (see fetchrecord.proto)
+func EncodeFetchResultsProto(fr *FetchResults) ([]byte, error) {
+	r, err := NewFetchRecord(fr)
+	if err != nil {
+		return nil, err
+	}
+	return r.MarshalProto(), nil
+}
+
+// DecodeFetchResultsProto decodes a FetchResults encoded by
+// EncodeFetchResultsProto
+func DecodeFetchResultsProto(b []byte) (*FetchResults, error) {
+	var r FetchRecord
+	if err := r.UnmarshalProto(b); err != nil {
+		return nil, err
+	}
+	return r.FetchResults()
+}
+
+// MarshalProto returns the protocol buffer encoding of r. Headers and
+// outlink domains are written in sorted order, so equal records encode the
+// same.
+func (r *FetchRecord) MarshalProto() []byte {
+	w := &protoWriter{}
+	w.string(1, r.URL)
+	for _, u := range r.RedirectedFrom {
+		w.message(2, []byte(u))
+	}
+	w.int(3, protoTime(r.FetchTime))
+	w.string(4, r.FetchError)
+	w.bool(5, r.ExcludedByRobots)
+	w.bool(6, r.SitemapFresh)
+	w.int(7, int64(r.StatusCode))
+	names := make([]string, 0, len(r.Headers))
+	for name := range r.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := &protoWriter{}
+		h.string(1, name)
+		for _, v := range r.Headers[name] {
+			h.message(2, []byte(v))
+		}
+		w.message(8, h.b)
+	}
+	if len(r.Body) > 0 {
+		w.message(9, r.Body)
+	}
+	w.string(10, r.MimeType)
+	w.int(11, r.FnvFingerprint)
+	w.int(12, r.ContentSize)
+	w.bool(13, r.MetaNoIndex)
+	w.bool(14, r.MetaNoFollow)
+	w.bool(15, r.MetaNoAI)
+	w.bool(16, r.MetaNoImageAI)
+	w.bool(17, r.MetaNoSnippet)
+	w.int(18, int64(r.MetaMaxSnippet))
+	w.string(19, r.AMPURL)
+	w.string(20, r.MobileURL)
+	w.string(21, r.CanonicalURL)
+	w.string(22, r.Text)
+	w.string(23, r.ParseError)
+	w.int(24, int64(r.CacheMaxAge))
+	if r.CacheExpires != nil {
+		w.int(25, protoTime(*r.CacheExpires))
+	}
+	if r.CrawlAt != nil {
+		w.int(26, protoTime(*r.CrawlAt))
+	}
+	w.bool(27, r.Unchanged)
+	w.string(28, r.HandlerError)
+	w.bool(29, r.HandlerRetry)
+	w.bool(30, r.Sampled)
+	for _, e := range r.ExpandedLinks {
+		x := &protoWriter{}
+		x.string(1, e.From)
+		x.string(2, e.To)
+		w.message(31, x.b)
+	}
+	if img := r.Image; img != nil {
+		x := &protoWriter{}
+		x.string(1, img.Format)
+		x.int(2, int64(img.Width))
+		x.int(3, int64(img.Height))
+		x.string(4, img.CameraMake)
+		x.string(5, img.CameraModel)
+		x.bool(6, img.HasGPS)
+		x.double(7, img.Latitude)
+		x.double(8, img.Longitude)
+		w.message(32, x.b)
+	}
+	w.bool(33, r.Partial)
+	w.int(34, int64(r.RefreshHint))
+	doms := make([]string, 0, len(r.OutlinkDomains))
+	for dom := range r.OutlinkDomains {
+		doms = append(doms, dom)
+	}
+	sort.Strings(doms)
+	for _, dom := range doms {
+		x := &protoWriter{}
+		x.string(1, dom)
+		x.int(2, int64(r.OutlinkDomains[dom]))
+		w.message(35, x.b)
+	}
+	w.string(36, r.Node)
+	return w.b
+}
+
+// UnmarshalProto decodes the protocol buffer encoding of a FetchRecord into
+// r. Fields it doesn't know, from newer versions of the format, are ignored.
+func (r *FetchRecord) UnmarshalProto(b []byte) error {
+	*r = FetchRecord{}
+	err := readProto(b, func(f *protoField) error {
+		switch f.num {
+		case 1:
+			r.URL = f.string()
+		case 2:
+			r.RedirectedFrom = append(r.RedirectedFrom, f.string())
+		case 3:
+			r.FetchTime = fromProtoTime(f.int())
+		case 4:
+			r.FetchError = f.string()
+		case 5:
+			r.ExcludedByRobots = f.bool()
+		case 6:
+			r.SitemapFresh = f.bool()
+		case 7:
+			r.StatusCode = int(f.int())
+		case 8:
+			var name string
+			var values []string
+			err := readProto(f.data, func(h *protoField) error {
+				switch h.num {
+				case 1:
+					name = h.string()
+				case 2:
+					values = append(values, h.string())
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if r.Headers == nil {
+				r.Headers = map[string][]string{}
+			}
+			r.Headers[name] = append(r.Headers[name], values...)
+		case 9:
+			r.Body = append([]byte(nil), f.data...)
+		case 10:
+			r.MimeType = f.string()
+		case 11:
+			r.FnvFingerprint = f.int()
+		case 12:
+			r.ContentSize = f.int()
+		case 13:
+			r.MetaNoIndex = f.bool()
+		case 14:
+			r.MetaNoFollow = f.bool()
+		case 15:
+			r.MetaNoAI = f.bool()
+		case 16:
+			r.MetaNoImageAI = f.bool()
+		case 17:
+			r.MetaNoSnippet = f.bool()
+		case 18:
+			r.MetaMaxSnippet = int(f.int())
+		case 19:
+			r.AMPURL = f.string()
+		case 20:
+			r.MobileURL = f.string()
+		case 21:
+			r.CanonicalURL = f.string()
+		case 22:
+			r.Text = f.string()
+		case 23:
+			r.ParseError = f.string()
+		case 24:
+			r.CacheMaxAge = int(f.int())
+		case 25:
+			r.CacheExpires = timePtr(fromProtoTime(f.int()))
+		case 26:
+			r.CrawlAt = timePtr(fromProtoTime(f.int()))
+		case 27:
+			r.Unchanged = f.bool()
+		case 28:
+			r.HandlerError = f.string()
+		case 29:
+			r.HandlerRetry = f.bool()
+		case 30:
+			r.Sampled = f.bool()
+		case 31:
+			var e FetchRecordExpansion
+			err := readProto(f.data, func(x *protoField) error {
+				switch x.num {
+				case 1:
+					e.From = x.string()
+				case 2:
+					e.To = x.string()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			r.ExpandedLinks = append(r.ExpandedLinks, e)
+		case 32:
+			img := &FetchRecordImage{}
+			err := readProto(f.data, func(x *protoField) error {
+				switch x.num {
+				case 1:
+					img.Format = x.string()
+				case 2:
+					img.Width = int(x.int())
+				case 3:
+					img.Height = int(x.int())
+				case 4:
+					img.CameraMake = x.string()
+				case 5:
+					img.CameraModel = x.string()
+				case 6:
+					img.HasGPS = x.bool()
+				case 7:
+					img.Latitude = x.double()
+				case 8:
+					img.Longitude = x.double()
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			r.Image = img
+		case 33:
+			r.Partial = f.bool()
+		case 34:
+			r.RefreshHint = int(f.int())
+		case 35:
+			var dom string
+			var links int
+			err := readProto(f.data, func(x *protoField) error {
+				switch x.num {
+				case 1:
+					dom = x.string()
+				case 2:
+					links = int(x.int())
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if r.OutlinkDomains == nil {
+				r.OutlinkDomains = map[string]int{}
+			}
+			r.OutlinkDomains[dom] += links
+		case 36:
+			r.Node = f.string()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to decode fetch record: %v", err)
+	}
+	return nil
+}
+
+// readProto calls fn with each field of the message b
+func readProto(b []byte, fn func(f *protoField) error) error {
+	r := &protoReader{b: b}
+	for {
+		f, ok, err := r.next()
+		if err != nil {
+			return err
+		} else if !ok {
+			return nil
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+}
+
+// protoTime returns t in nanoseconds since the Unix epoch, or 0 if it is zero
+func protoTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// fromProtoTime is the inverse of protoTime, returning times in UTC
+func fromProtoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns).UTC()
+}
+
+// timePtr returns a pointer to t in UTC, or nil if it is zero
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func stringError(s string) error {
+	if s == "" {
+		return nil
+	}
+	return errors.New(s)
+}
+
+func urlString(u *URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
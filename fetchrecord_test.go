@@ -0,0 +1,140 @@
+package walker
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testFetchResults() *FetchResults {
+	fetched := time.Date(2015, 3, 4, 5, 6, 7, 8, time.UTC)
+	return &FetchResults{
+		URL:            MustParse("http://test.com/a.html"),
+		RedirectedFrom: []*URL{MustParse("http://test.com/b.html")},
+		Response: &http.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"Content-Type": []string{"text/html"},
+				"Set-Cookie":   []string{"a=1", "b=2"},
+			},
+			Body: ioutil.NopCloser(strings.NewReader("<html>hi</html>")),
+		},
+		FetchTime:      fetched,
+		MimeType:       "text/html",
+		FnvFingerprint: -1234567890123,
+		ContentSize:    15,
+		MetaNoFollow:   true,
+		MetaNoSnippet:  true,
+		MetaMaxSnippet: 20,
+		CanonicalURL:   MustParse("http://test.com/c.html"),
+		ExpandedLinks: []LinkExpansion{
+			{From: MustParse("http://bit.ly/x"), To: MustParse("http://test.com/d.html")},
+		},
+		Image:          &ImageInfo{Format: "jpeg", Width: 10, Height: 20, HasGPS: true, Latitude: -33.5, Longitude: 151.25},
+		ParseError:     errors.New("parse timed out"),
+		CacheMaxAge:    300,
+		CrawlAt:        fetched.Add(time.Hour),
+		HandlerError:   errors.New("store down"),
+		HandlerRetry:   true,
+		Sampled:        true,
+		Partial:        true,
+		RefreshHint:    24 * time.Hour,
+		OutlinkDomains: map[string]int{"other.com": 3, "example.org": 1},
+		Node:           "fetcher-1",
+	}
+}
+
+func TestFetchRecordRoundTrip(t *testing.T) {
+	codecs := []struct {
+		tag    string
+		encode func(*FetchResults) ([]byte, error)
+		decode func([]byte) (*FetchResults, error)
+	}{
+		{"JSON", EncodeFetchResultsJSON, DecodeFetchResultsJSON},
+		{"Proto", EncodeFetchResultsProto, DecodeFetchResultsProto},
+	}
+	for _, c := range codecs {
+		fr := testFetchResults()
+		expected, err := NewFetchRecord(fr)
+		if err != nil {
+			t.Fatalf("%v: NewFetchRecord failed: %v", c.tag, err)
+		}
+		b, err := c.encode(fr)
+		if err != nil {
+			t.Fatalf("%v: encoding failed: %v", c.tag, err)
+		}
+		body, _ := ioutil.ReadAll(fr.Response.Body)
+		if string(body) != "<html>hi</html>" {
+			t.Errorf("%v: expected the response body to be readable after encoding, got %q", c.tag, body)
+		}
+
+		decoded, err := c.decode(b)
+		if err != nil {
+			t.Fatalf("%v: decoding failed: %v", c.tag, err)
+		}
+		if decoded.URL.String() != "http://test.com/a.html" || decoded.Response.StatusCode != 200 ||
+			decoded.Response.Request.URL.String() != "http://test.com/b.html" {
+			t.Errorf("%v: unexpected decoded URL or response: %v %+v", c.tag, decoded.URL, decoded.Response)
+		}
+		if decoded.HandlerError == nil || decoded.HandlerError.Error() != "store down" {
+			t.Errorf("%v: expected the handler error to be decoded, got %v", c.tag, decoded.HandlerError)
+		}
+		got, err := NewFetchRecord(decoded)
+		if err != nil {
+			t.Fatalf("%v: NewFetchRecord of decoded results failed: %v", c.tag, err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: round trip changed the record:\ngot      %+v\nexpected %+v", c.tag, got, expected)
+		}
+	}
+}
+
+func TestFetchRecordJSONNames(t *testing.T) {
+	b, err := EncodeFetchResultsJSON(testFetchResults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{`"url":"http://test.com/a.html"`, `"status_code":200`,
+		`"fnv_fingerprint":-1234567890123`, `"handler_retry":true`, `"crawl_at":"2015-03-04T06:06:07.000000008Z"`,
+		`"image":{"format":"jpeg"`, `"node":"fetcher-1"`} {
+		if !strings.Contains(string(b), name) {
+			t.Errorf("Expected JSON to contain %s, got %s", name, b)
+		}
+	}
+}
+
+func TestFetchRecordProtoFormat(t *testing.T) {
+	// The wire format is stable, so this encoding must not change
+	fr := &FetchResults{
+		URL:              MustParse("http://t.co/"),
+		FetchTime:        time.Unix(0, 1),
+		ExcludedByRobots: true,
+	}
+	b, err := EncodeFetchResultsProto(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{0x0a, 0x0c, 'h', 't', 't', 'p', ':', '/', '/', 't', '.', 'c', 'o', '/', 0x18, 0x01, 0x28, 0x01}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("Expected encoding %x, got %x", expected, b)
+	}
+
+	// Fields it doesn't know are skipped
+	unknown := append(append([]byte{}, b...), 0xf8, 0x07, 0x01, 0xfa, 0x07, 0x02, 'h', 'i', 0xf9, 0x07, 0, 0, 0, 0, 0, 0, 0, 0)
+	decoded, err := DecodeFetchResultsProto(unknown)
+	if err != nil {
+		t.Fatalf("Failed to decode with unknown fields: %v", err)
+	}
+	if decoded.URL.String() != "http://t.co/" || !decoded.ExcludedByRobots || decoded.Response != nil {
+		t.Errorf("Unexpected decoded results %+v", decoded)
+	}
+
+	if _, err := DecodeFetchResultsProto(b[:5]); err == nil {
+		t.Errorf("Expected an error decoding a truncated record")
+	}
+}
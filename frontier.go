@@ -0,0 +1,523 @@
+package walker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// An external frontier is a pipeline outside walker that owns scheduling: it
+// decides what gets crawled when, and walker only fetches. Crawl requests
+// arrive on a queue (ex. an SQS queue, a RabbitMQ queue or a Kafka topic),
+// walker fetches them with its usual politeness (robots.txt, crawl delays,
+// one fetcher per domain), and publishes what it fetched and the links it
+// found back to the pipeline. FrontierDatastore adapts such a queue to the
+// Datastore interface, so a FetchManager can crawl from it without a
+// dispatcher or Cassandra.
+
+// FrontierQueue is the transport to an external frontier. Implementations
+// must be safe for concurrent use.
+type FrontierQueue interface {
+	// Receive returns up to max crawl requests, waiting at most wait for any
+	// to arrive. It returns no requests, and no error, if none did.
+	Receive(max int, wait time.Duration) ([]*CrawlRequest, error)
+
+	// Ack marks requests handled, so the queue doesn't deliver them again
+	Ack(reqs []*CrawlRequest) error
+
+	// Release gives requests back to the queue unhandled, so it can deliver
+	// them again (ex. after walker stopped crawling their domain because its
+	// quota ran out)
+	Release(reqs []*CrawlRequest) error
+
+	// Publish sends msg, encoded as JSON, to the named topic
+	Publish(topic string, msg interface{}) error
+}
+
+// CrawlRequest is a link an external frontier asks walker to fetch
+type CrawlRequest struct {
+	// The absolute URL to fetch
+	URL string `json:"url"`
+
+	// The handle the queue knows the request by, to ack or release it (ex.
+	// an SQS receipt handle or a RabbitMQ delivery tag)
+	Receipt string `json:"receipt,omitempty"`
+
+	// Passed back untouched in the request's FrontierResult, so the pipeline
+	// can tie it to its own records
+	Meta json.RawMessage `json:"meta,omitempty"`
+}
+
+// FrontierResult is published to frontier.results_topic for every crawl
+// request walker fetched (or didn't, because of robots.txt)
+type FrontierResult struct {
+	URL  string          `json:"url"`
+	Meta json.RawMessage `json:"meta,omitempty"`
+
+	// The HTTP status of the final response, 0 if there was none
+	Status int `json:"status,omitempty"`
+
+	// Where URL redirected to, if it did
+	RedirectedTo string `json:"redirected_to,omitempty"`
+
+	MimeType       string    `json:"mime_type,omitempty"`
+	FetchTime      time.Time `json:"fetch_time"`
+	ResponseMillis int64     `json:"response_ms"`
+	ContentSize    int64     `json:"content_size"`
+	Fingerprint    int64     `json:"fingerprint,omitempty"`
+
+	ExcludedByRobots bool `json:"excluded_by_robots,omitempty"`
+
+	// The fetch error, if any
+	Error string `json:"error,omitempty"`
+}
+
+// FrontierLink is published to frontier.links_topic for every link parsed out
+// of a fetched page
+type FrontierLink struct {
+	URL string `json:"url"`
+
+	// The page the link was found on
+	Referrer string `json:"referrer,omitempty"`
+}
+
+// FrontierDatastore is a Datastore crawling the requests of an external
+// frontier (see FrontierQueue). ClaimNewHost receives requests from the
+// queue, grouping them by domain, and claims a domain that has some;
+// StoreURLFetchResults publishes each fetch to frontier.results_topic and acks
+// its request, and StoreParsedURL publishes each link found to
+// frontier.links_topic. Requests handed out but not fetched when their domain
+// is unclaimed are released back to the queue.
+//
+// Like MemoryDatastore, host contexts are kept in memory; there are no quotas,
+// crawl delay overrides or page states.
+type FrontierDatastore struct {
+	queue FrontierQueue
+
+	mu       sync.Mutex
+	pending  map[string][]*CrawlRequest
+	claimed  map[string]bool
+	inflight map[string]map[string][]*CrawlRequest
+	contexts map[string]*HostContext
+	err      error
+
+	// links recently published, so pages linking the same URLs don't publish
+	// them over and over
+	published *lru.Cache
+}
+
+// NewFrontierDatastore creates a FrontierDatastore crawling the requests of
+// queue
+func NewFrontierDatastore(queue FrontierQueue) (*FrontierDatastore, error) {
+	ds := &FrontierDatastore{
+		queue:    queue,
+		pending:  map[string][]*CrawlRequest{},
+		claimed:  map[string]bool{},
+		inflight: map[string]map[string][]*CrawlRequest{},
+		contexts: map[string]*HostContext{},
+	}
+	if Config.Frontier.LinksCacheSize > 0 {
+		var err error
+		ds.published, err = lru.New(Config.Frontier.LinksCacheSize)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create the frontier links cache: %v", err)
+		}
+	}
+	return ds, nil
+}
+
+// ClaimNewHost implements Datastore. If no unclaimed domain has requests
+// waiting, it receives more from the queue.
+func (ds *FrontierDatastore) ClaimNewHost() string {
+	if dom := ds.claimPending(); dom != "" {
+		return dom
+	}
+
+	wait, err := time.ParseDuration(Config.Frontier.ReceiveWait)
+	if err != nil {
+		panic(err) // should not happen, config is validated
+	}
+	reqs, err := ds.queue.Receive(Config.Frontier.ReceiveBatch, wait)
+	ds.setErr(err)
+	if err != nil {
+		log4go.Error("Failed to receive crawl requests: %v", err)
+		return ""
+	}
+
+	var invalid []*CrawlRequest
+	ds.mu.Lock()
+	for _, req := range reqs {
+		dom, err := frontierDomain(req.URL)
+		if err != nil {
+			log4go.Warn("Dropping crawl request for %q: %v", req.URL, err)
+			invalid = append(invalid, req)
+			continue
+		}
+		ds.pending[dom] = append(ds.pending[dom], req)
+	}
+	ds.mu.Unlock()
+	if len(invalid) > 0 {
+		if err := ds.queue.Ack(invalid); err != nil {
+			log4go.Error("Failed to ack %v invalid crawl requests: %v", len(invalid), err)
+		}
+	}
+
+	return ds.claimPending()
+}
+
+// claimPending claims a domain with requests waiting, or returns "" if there
+// is none
+func (ds *FrontierDatastore) claimPending() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for dom, reqs := range ds.pending {
+		if len(reqs) > 0 && !ds.claimed[dom] {
+			ds.claimed[dom] = true
+			return dom
+		}
+	}
+	return ""
+}
+
+// UnclaimHost implements Datastore, releasing the requests of host that
+// weren't fetched
+func (ds *FrontierDatastore) UnclaimHost(host string) {
+	ds.mu.Lock()
+	var unfetched []*CrawlRequest
+	for _, reqs := range ds.inflight[host] {
+		unfetched = append(unfetched, reqs...)
+	}
+	delete(ds.inflight, host)
+	delete(ds.claimed, host)
+	ds.mu.Unlock()
+
+	if len(unfetched) > 0 {
+		log4go.Info("Releasing %v unfetched crawl requests of %v", len(unfetched), host)
+		if err := ds.queue.Release(unfetched); err != nil {
+			log4go.Error("Failed to release the crawl requests of %v: %v", host, err)
+		}
+	}
+}
+
+// LinksForHost implements Datastore
+func (ds *FrontierDatastore) LinksForHost(host string) <-chan *URL {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	reqs := ds.pending[host]
+	delete(ds.pending, host)
+
+	inflight := ds.inflight[host]
+	if inflight == nil {
+		inflight = map[string][]*CrawlRequest{}
+		ds.inflight[host] = inflight
+	}
+	c := make(chan *URL, len(reqs))
+	for _, req := range reqs {
+		u, err := ParseAndNormalizeURL(req.URL)
+		if err != nil {
+			continue // checked by frontierDomain
+		}
+		link := u.String()
+		if len(inflight[link]) == 0 {
+			c <- u
+		}
+		inflight[link] = append(inflight[link], req)
+	}
+	close(c)
+	return c
+}
+
+// StoreURLFetchResults implements Datastore, publishing a FrontierResult for
+// each request of fr.URL and acking them. Requests whose result fails to
+// publish are left for the queue to deliver again.
+func (ds *FrontierDatastore) StoreURLFetchResults(fr *FetchResults) {
+	dom, err := fr.URL.ToplevelDomainPlusOne()
+	if err != nil {
+		return
+	}
+	link := fr.URL.String()
+	ds.mu.Lock()
+	reqs := ds.inflight[dom][link]
+	delete(ds.inflight[dom], link)
+	ds.mu.Unlock()
+
+	var handled []*CrawlRequest
+	for _, req := range reqs {
+		if topic := Config.Frontier.ResultsTopic; topic != "" {
+			res := newFrontierResult(fr)
+			res.URL = req.URL
+			res.Meta = req.Meta
+			if err := ds.queue.Publish(topic, res); err != nil {
+				ds.setErr(err)
+				log4go.Error("Failed to publish the result of %v: %v", req.URL, err)
+				continue
+			}
+		}
+		handled = append(handled, req)
+	}
+	if len(handled) > 0 {
+		err := ds.queue.Ack(handled)
+		ds.setErr(err)
+		if err != nil {
+			log4go.Error("Failed to ack the crawl requests of %v: %v", link, err)
+		}
+	}
+}
+
+// newFrontierResult returns the FrontierResult of fr
+func newFrontierResult(fr *FetchResults) *FrontierResult {
+	res := &FrontierResult{
+		MimeType:         fr.MimeType,
+		FetchTime:        fr.FetchTime,
+		ResponseMillis:   int64(fr.ResponseTime / time.Millisecond),
+		ContentSize:      fr.ContentSize,
+		Fingerprint:      fr.FnvFingerprint,
+		ExcludedByRobots: fr.ExcludedByRobots,
+	}
+	if fr.Response != nil {
+		res.Status = fr.Response.StatusCode
+	}
+	if fr.RedirectedTo != nil {
+		res.RedirectedTo = fr.RedirectedTo.String()
+	}
+	if fr.FetchError != nil {
+		res.Error = fr.FetchError.Error()
+	}
+	return res
+}
+
+// StoreParsedURL implements Datastore, publishing a FrontierLink for u. Links
+// published recently (see frontier.links_cache_size) aren't published again.
+func (ds *FrontierDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
+	topic := Config.Frontier.LinksTopic
+	if topic == "" {
+		return
+	}
+	link := u.String()
+	if ds.published != nil {
+		if ok, _ := ds.published.ContainsOrAdd(link, true); ok {
+			return
+		}
+	}
+	fl := &FrontierLink{URL: link}
+	if fr != nil {
+		fl.Referrer = fr.URL.String()
+	}
+	if err := ds.queue.Publish(topic, fl); err != nil {
+		ds.setErr(err)
+		log4go.Error("Failed to publish link %v: %v", link, err)
+		if ds.published != nil {
+			ds.published.Remove(link)
+		}
+	}
+}
+
+// HostQuotaExceeded implements Datastore; quotas are left to the frontier
+func (ds *FrontierDatastore) HostQuotaExceeded(host string) bool {
+	return false
+}
+
+// StoreRobotsTxt implements Datastore
+func (ds *FrontierDatastore) StoreRobotsTxt(host string, body []byte) {}
+
+// StoreControlFileOverLimit implements Datastore
+func (ds *FrontierDatastore) StoreControlFileOverLimit(host, link string, limit int64) {}
+
+// CrawlDelayOverride implements Datastore
+func (ds *FrontierDatastore) CrawlDelayOverride(host string) time.Duration {
+	return 0
+}
+
+// BurstMode implements Datastore
+func (ds *FrontierDatastore) BurstMode(host string) bool {
+	return false
+}
+
+// StoreHostContext implements Datastore
+func (ds *FrontierDatastore) StoreHostContext(host string, hc *HostContext) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.contexts[host] = hc
+}
+
+// LoadHostContext implements Datastore
+func (ds *FrontierDatastore) LoadHostContext(host string) *HostContext {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.contexts[host]
+}
+
+// StorePageState implements Datastore; FrontierDatastore doesn't keep page
+// states
+func (ds *FrontierDatastore) StorePageState(u *URL, ps *PageState) {}
+
+// LoadPageState implements Datastore
+func (ds *FrontierDatastore) LoadPageState(u *URL) *PageState {
+	return nil
+}
+
+// QuarantineHost implements Datastore; FrontierDatastore doesn't quarantine
+// hosts
+func (ds *FrontierDatastore) QuarantineHost(host string, until time.Time) {}
+
+// KeepAlive implements Datastore, failing with ErrDatastoreUnavailable if the
+// last call to the queue failed
+func (ds *FrontierDatastore) KeepAlive() error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	if ds.err != nil {
+		return NewError(ErrDatastoreUnavailable, ds.err)
+	}
+	return nil
+}
+
+// Close implements Datastore, releasing the requests received but not handed
+// out to a fetcher
+func (ds *FrontierDatastore) Close() {
+	ds.mu.Lock()
+	var unfetched []*CrawlRequest
+	for _, reqs := range ds.pending {
+		unfetched = append(unfetched, reqs...)
+	}
+	ds.pending = map[string][]*CrawlRequest{}
+	ds.mu.Unlock()
+
+	if len(unfetched) > 0 {
+		if err := ds.queue.Release(unfetched); err != nil {
+			log4go.Error("Failed to release %v crawl requests on close: %v", len(unfetched), err)
+		}
+	}
+}
+
+// setErr records the outcome of the last call to the queue, for KeepAlive
+func (ds *FrontierDatastore) setErr(err error) {
+	ds.mu.Lock()
+	ds.err = err
+	ds.mu.Unlock()
+}
+
+// frontierDomain returns the domain of the crawl request link, or an error if
+// walker can't crawl it
+func frontierDomain(link string) (string, error) {
+	u, err := ParseAndNormalizeURL(link)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("not an absolute http(s) URL")
+	}
+	return u.ToplevelDomainPlusOne()
+}
+
+// HTTPFrontierQueue is a FrontierQueue speaking walker's frontier queue
+// protocol over HTTP, so a small bridge in front of SQS, RabbitMQ, Kafka or
+// the pipeline's own scheduler is all walker needs. Relative to the base URL:
+//
+//	GET  receive?max=N&wait=5s  responds with a JSON array of CrawlRequests
+//	                            (empty, or a 204, if none arrived in wait)
+//	POST ack                    a JSON array of the CrawlRequests handled
+//	POST release                a JSON array of the CrawlRequests to deliver
+//	                            again
+//	POST publish/TOPIC          a FrontierResult or FrontierLink to publish
+//	                            to TOPIC
+//
+// Any response but a 2xx is an error.
+type HTTPFrontierQueue struct {
+	base   string
+	client *http.Client
+}
+
+// NewHTTPFrontierQueue creates an HTTPFrontierQueue for the bridge at base
+// (ex. "http://localhost:8900/frontier/"), timing requests out after
+// frontier.timeout (plus the wait of receives)
+func NewHTTPFrontierQueue(base string) (*HTTPFrontierQueue, error) {
+	if _, err := url.Parse(base); err != nil {
+		return nil, fmt.Errorf("Invalid frontier queue URL %q: %v", base, err)
+	}
+	timeout, err := time.ParseDuration(Config.Frontier.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid frontier.timeout: %v", err)
+	}
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return &HTTPFrontierQueue{base: base, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Receive implements FrontierQueue
+func (q *HTTPFrontierQueue) Receive(max int, wait time.Duration) ([]*CrawlRequest, error) {
+	v := url.Values{}
+	v.Set("max", strconv.Itoa(max))
+	v.Set("wait", wait.String())
+	client := *q.client
+	client.Timeout += wait
+	res, err := client.Get(q.base + "receive?" + v.Encode())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to receive crawl requests: %v", err)
+	}
+	defer res.Body.Close()
+	if err := checkFrontierResponse(res); err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	var reqs []*CrawlRequest
+	if err := json.NewDecoder(res.Body).Decode(&reqs); err != nil {
+		return nil, fmt.Errorf("Failed to decode crawl requests: %v", err)
+	}
+	return reqs, nil
+}
+
+// Ack implements FrontierQueue
+func (q *HTTPFrontierQueue) Ack(reqs []*CrawlRequest) error {
+	return q.post("ack", reqs)
+}
+
+// Release implements FrontierQueue
+func (q *HTTPFrontierQueue) Release(reqs []*CrawlRequest) error {
+	return q.post("release", reqs)
+}
+
+// Publish implements FrontierQueue
+func (q *HTTPFrontierQueue) Publish(topic string, msg interface{}) error {
+	return q.post("publish/"+url.QueryEscape(topic), msg)
+}
+
+// post POSTs body as JSON to path
+func (q *HTTPFrontierQueue) post(path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("Failed to encode %v request: %v", path, err)
+	}
+	res, err := q.client.Post(q.base+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("Failed to %v: %v", path, err)
+	}
+	defer res.Body.Close()
+	if err := checkFrontierResponse(res); err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+// checkFrontierResponse returns an error if res isn't a 2xx
+func checkFrontierResponse(res *http.Response) error {
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	return fmt.Errorf("Frontier queue %v responded %v: %s", res.Request.URL, res.Status, bytes.TrimSpace(msg))
+}
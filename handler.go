@@ -0,0 +1,193 @@
+package walker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker/mimetools"
+)
+
+// HandlerRetry is an error returned by HandlerV2.HandleFetch asking for the
+// link to be fetched again, for failures that may pass (ex. the handler's
+// own downstream store being unavailable)
+type HandlerRetry struct {
+	// How long to wait before fetching the link again; 0 to fetch it again as
+	// soon as it can be dispatched
+	After time.Duration
+
+	// Why the response couldn't be handled
+	Err error
+}
+
+// RetryAfter returns a *HandlerRetry asking for the link to be fetched again
+// no sooner than after from now, because of err
+func RetryAfter(after time.Duration, err error) error {
+	return &HandlerRetry{After: after, Err: err}
+}
+
+func (e *HandlerRetry) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("retry after %v", e.After)
+	}
+	return fmt.Sprintf("%v (retry after %v)", e.Err, e.After)
+}
+
+// Unwrap returns the wrapped error, for errors.Is and errors.As
+func (e *HandlerRetry) Unwrap() error {
+	return e.Err
+}
+
+// handlerV2 adapts a HandlerV2 to the Handler interface
+type handlerV2 struct {
+	HandlerV2
+}
+
+// NewHandlerV2 returns h as a Handler, so it can be set as a FetchManager's
+// Handler. Fetchers still call its HandleFetch.
+func NewHandlerV2(h HandlerV2) Handler {
+	return handlerV2{h}
+}
+
+// HandleResponse calls HandleFetch, logging any error it returns
+func (h handlerV2) HandleResponse(fr *FetchResults) {
+	if err := h.HandleFetch(fr); err != nil {
+		log4go.Error("Failed to handle %v: %v", fr.URL, err)
+	}
+}
+
+// handle gives fr to the FetchManager's handler. If the handler implements
+// HandlerV2 and fails, the error is recorded in fr, and if it asked for a
+// retry the link is marked to be fetched again.
+func (f *fetcher) handle(fr *FetchResults) {
+	h, ok := f.fm.Handler.(HandlerV2)
+	if !ok {
+		f.fm.Handler.HandleResponse(fr)
+		return
+	}
+	err := h.HandleFetch(fr)
+	if err == nil {
+		return
+	}
+	fr.HandlerError = err
+	var retry *HandlerRetry
+	if !errors.As(err, &retry) {
+		log4go.Error("Handler failed for %v: %v", fr.URL, err)
+		return
+	}
+	log4go.Warn("Handler failed for %v, will retry after %v: %v", fr.URL, retry.After, retry.Err)
+	fr.HandlerRetry = true
+	if at := fr.FetchTime.Add(retry.After); at.After(fr.CrawlAt) {
+		fr.CrawlAt = at
+	}
+}
+
+// handlerChain is a Handler that gives fetch results to several handlers in
+// turn
+type handlerChain []Handler
+
+// ChainHandlers returns a Handler that gives each fetch result to each of
+// handlers in turn, rewinding the response body in between. It implements
+// HandlerV2: every handler is called even if one fails, and the first error
+// returned by a HandlerV2 is the chain's error (any others are logged).
+func ChainHandlers(handlers ...Handler) Handler {
+	return handlerChain(append([]Handler(nil), handlers...))
+}
+
+// HandleResponse calls HandleFetch, logging any error it returns
+func (c handlerChain) HandleResponse(fr *FetchResults) {
+	if err := c.HandleFetch(fr); err != nil {
+		log4go.Error("Failed to handle %v: %v", fr.URL, err)
+	}
+}
+
+// HandleFetch gives fr to each handler in the chain
+func (c handlerChain) HandleFetch(fr *FetchResults) error {
+	var body []byte
+	if fr.Response != nil && fr.Response.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(fr.Response.Body)
+		fr.Response.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to read response body of %v: %v", fr.URL, err)
+		}
+	}
+
+	var first error
+	for _, h := range c {
+		if fr.Response != nil {
+			fr.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		v2, ok := h.(HandlerV2)
+		if !ok {
+			h.HandleResponse(fr)
+			continue
+		}
+		if err := v2.HandleFetch(fr); err == nil {
+			continue
+		} else if first == nil {
+			first = err
+		} else {
+			log4go.Error("Handler failed for %v: %v", fr.URL, err)
+		}
+	}
+	if fr.Response != nil {
+		fr.Response.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return first
+}
+
+// FilterHandler returns a Handler giving h only the fetch results whose
+// Content-Type matches one of mediaTypes (written as for
+// fetcher.accept_formats, ex. "text/*"), so a handler chain can send, say,
+// pages to an indexer and images to a thumbnailer. Not Modified responses,
+// which have no content, are given to h whatever the types.
+func FilterHandler(h Handler, mediaTypes ...string) (Handler, error) {
+	formats, err := mimetools.NewMatcher(mediaTypes)
+	if err != nil {
+		return nil, fmt.Errorf("Bad media type given to FilterHandler: %v", err)
+	}
+	return &filteredHandler{h: h, formats: formats}, nil
+}
+
+type filteredHandler struct {
+	h       Handler
+	formats *mimetools.Matcher
+}
+
+// wants returns true if fr should be given to the filtered handler
+func (fh *filteredHandler) wants(fr *FetchResults) bool {
+	if fr.Response == nil {
+		return false
+	}
+	if fr.Response.StatusCode == http.StatusNotModified {
+		return true
+	}
+	for _, ct := range fr.Response.Header["Content-Type"] {
+		if matched, err := fh.formats.Match(ct); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (fh *filteredHandler) HandleResponse(fr *FetchResults) {
+	if fh.wants(fr) {
+		fh.h.HandleResponse(fr)
+	}
+}
+
+func (fh *filteredHandler) HandleFetch(fr *FetchResults) error {
+	if !fh.wants(fr) {
+		return nil
+	}
+	if v2, ok := fh.h.(HandlerV2); ok {
+		return v2.HandleFetch(fr)
+	}
+	fh.h.HandleResponse(fr)
+	return nil
+}
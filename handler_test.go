@@ -0,0 +1,47 @@
+package walker
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testHandlerV2 struct {
+	handled []*FetchResults
+}
+
+func (h *testHandlerV2) HandleFetch(fr *FetchResults) error {
+	h.handled = append(h.handled, fr)
+	return fmt.Errorf("wrapped: %w", RetryAfter(time.Minute, errors.New("down")))
+}
+
+func TestHandlerRetry(t *testing.T) {
+	err := RetryAfter(time.Minute, errors.New("down"))
+	if err.Error() != "down (retry after 1m0s)" {
+		t.Errorf("Unexpected retry error message %q", err.Error())
+	}
+	var retry *HandlerRetry
+	if !errors.As(fmt.Errorf("wrapped: %w", err), &retry) || retry.After != time.Minute {
+		t.Errorf("Expected to find the retry in a wrapped error, got %+v", retry)
+	}
+
+	// The adapter still gives fetchers the HandlerV2
+	h := &testHandlerV2{}
+	handler := NewHandlerV2(h)
+	fr := &FetchResults{URL: MustParse("http://test.com/page.html"), FetchTime: time.Now()}
+	handler.HandleResponse(fr)
+	if len(h.handled) != 1 {
+		t.Fatalf("Expected HandleResponse to call HandleFetch once, got %d calls", len(h.handled))
+	}
+
+	f := &fetcher{fm: &FetchManager{Handler: handler}}
+	f.handle(fr)
+	if len(h.handled) != 2 || fr.HandlerError == nil || !fr.HandlerRetry {
+		t.Errorf("Expected handle to record the retry, got HandlerError %v HandlerRetry %v",
+			fr.HandlerError, fr.HandlerRetry)
+	}
+	if expected := fr.FetchTime.Add(time.Minute); !fr.CrawlAt.Equal(expected) {
+		t.Errorf("Expected CrawlAt %v, got %v", expected, fr.CrawlAt)
+	}
+}
@@ -0,0 +1,103 @@
+package walker
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Single-page apps route on the URL fragment (ex. http://a.com/#!/about),
+// which normalization drops like any other fragment, so all of an app's pages
+// collapse into the one URL of its shell. fetcher.hash_routes decides what
+// becomes of hash routes: fragments starting with "!" (the AJAX crawling
+// scheme's hash-bangs) or matching one of fetcher.hash_route_patterns.
+//
+//   drop              (the default) drops them with the rest of the fragments
+//   escaped_fragment  keeps each route as a distinct link, in its escaped
+//                     fragment form (http://a.com/?_escaped_fragment_=%2Fabout),
+//                     which is fetched as is: sites following the scheme
+//                     serve crawlers a rendered snapshot of the route there
+//   rendered          keeps them the same way, but fetches each through the
+//                     prerendering service at fetcher.hash_route_renderer,
+//                     given the route in its original form
+//
+// Either way a route is stored, dispatched and shown under its escaped
+// fragment form, so it's a link like any other to the rest of walker.
+
+// The fetcher.hash_routes values
+const (
+	HashRoutesDrop            = "drop"
+	HashRoutesEscapedFragment = "escaped_fragment"
+	HashRoutesRendered        = "rendered"
+)
+
+// EscapedFragmentParam is the query parameter a hash route is kept in
+const EscapedFragmentParam = "_escaped_fragment_"
+
+// hashRoutePatterns matches the fragments of fetcher.hash_route_patterns, nil
+// if there are none. It's set up by setupNormalizeURL.
+var hashRoutePatterns *regexp.Regexp
+
+// hashRoute returns the route in fragment, and false if it isn't a hash
+// route.
+func hashRoute(fragment string) (string, bool) {
+	if strings.HasPrefix(fragment, "!") {
+		return fragment[1:], true
+	}
+	if hashRoutePatterns != nil && hashRoutePatterns.MatchString(fragment) {
+		return fragment, true
+	}
+	return "", false
+}
+
+// escapeHashRoute moves the hash route of u, if it has one and
+// fetcher.hash_routes keeps them, to its escaped fragment. An empty route
+// (a bare "#!") is the app's shell, and is dropped.
+func (u *URL) escapeHashRoute() {
+	if Config.Fetcher.HashRoutes == HashRoutesDrop || u.Fragment == "" {
+		return
+	}
+	route, ok := hashRoute(u.Fragment)
+	if !ok || route == "" {
+		return
+	}
+	params := u.Query()
+	params.Set(EscapedFragmentParam, route)
+	u.RawQuery = params.Encode()
+	u.Fragment = ""
+}
+
+// HashRouteForm returns the original form of u if it's a hash route kept in
+// its escaped fragment, or nil if it isn't one. Routes matching
+// fetcher.hash_route_patterns are given back as they are, and the rest as
+// hash-bangs.
+func (u *URL) HashRouteForm() *URL {
+	params := u.Query()
+	if _, ok := params[EscapedFragmentParam]; !ok {
+		return nil
+	}
+	route := params.Get(EscapedFragmentParam)
+	params.Del(EscapedFragmentParam)
+
+	c := u.Clone()
+	c.RawQuery = params.Encode()
+	if hashRoutePatterns != nil && hashRoutePatterns.MatchString(route) {
+		c.Fragment = route
+	} else {
+		c.Fragment = "!" + route
+	}
+	return c
+}
+
+// hashRouteRenderURL returns the link of the prerendering service to fetch u
+// from, or "" if u isn't a hash route or fetcher.hash_routes isn't rendered.
+func hashRouteRenderURL(u *URL) string {
+	if Config.Fetcher.HashRoutes != HashRoutesRendered {
+		return ""
+	}
+	h := u.HashRouteForm()
+	if h == nil {
+		return ""
+	}
+	return strings.Replace(Config.Fetcher.HashRouteRenderer, "{url}", url.QueryEscape(h.String()), -1)
+}
@@ -0,0 +1,83 @@
+package walker
+
+import (
+	"testing"
+)
+
+func TestHashRoutes(t *testing.T) {
+	orig := Config.Fetcher
+	defer func() {
+		Config.Fetcher = orig
+		PostConfigHooks()
+	}()
+	Config.Fetcher.HashRoutePatterns = []string{"^/"}
+	PostConfigHooks()
+
+	tests := []struct {
+		mode   string
+		input  string
+		expect string
+	}{
+		{HashRoutesDrop, "http://a.com/#!/about", "http://a.com/"},
+		{HashRoutesDrop, "http://a.com/#/about", "http://a.com/"},
+		{HashRoutesEscapedFragment, "http://a.com/#!/about", "http://a.com/?_escaped_fragment_=%2Fabout"},
+		{HashRoutesEscapedFragment, "http://a.com/app?b=2&a=1#!key=value",
+			"http://a.com/app?_escaped_fragment_=key%3Dvalue&a=1&b=2"},
+		{HashRoutesEscapedFragment, "http://a.com/#/about", "http://a.com/?_escaped_fragment_=%2Fabout"},
+		{HashRoutesEscapedFragment, "http://a.com/#!", "http://a.com/"},
+		{HashRoutesEscapedFragment, "http://a.com/page#section", "http://a.com/page"},
+		{HashRoutesRendered, "http://a.com/#!/about", "http://a.com/?_escaped_fragment_=%2Fabout"},
+	}
+	for _, test := range tests {
+		Config.Fetcher.HashRoutes = test.mode
+		u, err := ParseAndNormalizeURL(test.input)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", test.input, err)
+		}
+		if u.String() != test.expect {
+			t.Errorf("%v: expected %v to normalize to %v, got %v", test.mode, test.input, test.expect, u)
+		}
+	}
+
+	// A relative route resolves against the page it's found on
+	Config.Fetcher.HashRoutes = HashRoutesEscapedFragment
+	u, err := ParseAndNormalizeURL("#!/contact")
+	if err != nil {
+		t.Fatalf("Failed to parse relative route: %v", err)
+	}
+	base, _ := ParseURL("http://a.com/app")
+	u.MakeAbsolute(base)
+	if expect := "http://a.com/app?_escaped_fragment_=%2Fcontact"; u.String() != expect {
+		t.Errorf("Expected relative route to resolve to %v, got %v", expect, u)
+	}
+
+	forms := map[string]string{
+		"http://a.com/?_escaped_fragment_=%2Fabout":       "http://a.com/#/about",
+		"http://a.com/app?_escaped_fragment_=key%3Dvalue": "http://a.com/app#!key=value",
+		"http://a.com/?a=1&_escaped_fragment_=x":          "http://a.com/?a=1#!x",
+	}
+	for link, expect := range forms {
+		u, _ := ParseURL(link)
+		if h := u.HashRouteForm(); h == nil || h.String() != expect {
+			t.Errorf("Expected hash route form of %v to be %v, got %v", link, expect, h)
+		}
+	}
+	if u, _ := ParseURL("http://a.com/?a=1"); u.HashRouteForm() != nil {
+		t.Errorf("Expected no hash route form for %v", u)
+	}
+
+	Config.Fetcher.HashRouteRenderer = "http://render:3000/render?url={url}"
+	u, _ = ParseURL("http://a.com/?_escaped_fragment_=%2Fabout")
+	Config.Fetcher.HashRoutes = HashRoutesEscapedFragment
+	if r := hashRouteRenderURL(u); r != "" {
+		t.Errorf("Expected no render URL under escaped_fragment, got %v", r)
+	}
+	Config.Fetcher.HashRoutes = HashRoutesRendered
+	if r, expect := hashRouteRenderURL(u), "http://render:3000/render?url=http%3A%2F%2Fa.com%2F%23%2Fabout"; r != expect {
+		t.Errorf("Expected render URL %v, got %v", expect, r)
+	}
+	page, _ := ParseURL("http://a.com/about")
+	if r := hashRouteRenderURL(page); r != "" {
+		t.Errorf("Expected no render URL for %v, got %v", page, r)
+	}
+}
@@ -1,15 +1,21 @@
 package walker
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"code.google.com/p/log4go"
@@ -309,6 +315,8 @@ func (mrt *mapRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
 	if !resOk {
 		return response404(), nil
 	}
+	// Like a real transport, point the response back at its request
+	res.Request = req
 	return res, nil
 }
 
@@ -316,3 +324,292 @@ func (mrt *mapRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
 // errant robots.txt GET's to break TestRedirects.
 func (self *mapRoundTrip) CancelRequest(req *http.Request) {
 }
+
+// TestSite declares a site for end-to-end fetcher tests as a graph of pages
+// linking to one another. Register serves every page (and robots.txt) from a
+// MockRemoteServer, and Links gives the URLs a mock datastore should hand out
+// for the site, so a test needs only describe the site itself:
+//
+//	site := &TestSite{
+//		Host: "test.com",
+//		Pages: []*TestPage{
+//			{Path: "/", Links: []string{"/a.html", "/b.html"}},
+//			{Path: "/a.html", Status: 404},
+//			{Path: "/b.html", Delay: 100 * time.Millisecond},
+//		},
+//	}
+type TestSite struct {
+	// The host the site is served on, ex. "test.com"
+	Host string
+
+	// Body of the site's robots.txt; if empty the site has none (GETs of it
+	// get the mock server's default empty 200 response)
+	Robots string
+
+	Pages []*TestPage
+}
+
+// TestPage is one page of a TestSite
+type TestPage struct {
+	// Path (with any query) of the page, ex. "/index.html"
+	Path string
+
+	// The pages this page links to: paths on the same site, or absolute
+	// links to other sites
+	Links []string
+
+	// Status defaults to 200, or 301 if RedirectTo is set
+	Status int
+
+	// ContentType defaults to "text/html"
+	ContentType string
+
+	// The page's content. If empty, an HTML page linking to each of Links is
+	// generated.
+	Body string
+
+	// If set, the page redirects here (a path or an absolute link)
+	RedirectTo string
+
+	// How long the server waits before responding
+	Delay time.Duration
+}
+
+// URL returns the absolute link of path on the site
+func (s *TestSite) URL(path string) string {
+	if strings.Contains(path, "://") {
+		return path
+	}
+	return "http://" + s.Host + path
+}
+
+// Register sets the responses of rs to serve the site
+func (s *TestSite) Register(rs *MockRemoteServer) {
+	if s.Robots != "" {
+		rs.SetResponse(s.URL("/robots.txt"), &MockResponse{
+			Body:        s.Robots,
+			ContentType: "text/plain",
+		})
+	}
+	for _, p := range s.Pages {
+		rs.SetResponse(s.URL(p.Path), p.response(s))
+	}
+}
+
+// Links returns the URLs of the site's pages, in order
+func (s *TestSite) Links() []*URL {
+	var urls []*URL
+	for _, p := range s.Pages {
+		urls = append(urls, MustParse(s.URL(p.Path)))
+	}
+	return urls
+}
+
+// Domain returns the domain the site's host belongs to, ex. "test.com" for
+// "www.test.com"
+func (s *TestSite) Domain() string {
+	dom, err := MustParse(s.URL("/")).ToplevelDomainPlusOne()
+	if err != nil {
+		panic(err)
+	}
+	return dom
+}
+
+func (p *TestPage) response(s *TestSite) *MockResponse {
+	r := &MockResponse{
+		Status:      p.Status,
+		ContentType: p.ContentType,
+		Body:        p.Body,
+		Delay:       p.Delay,
+	}
+	if p.RedirectTo != "" {
+		if r.Status == 0 {
+			r.Status = http.StatusMovedPermanently
+		}
+		r.Headers = http.Header{"Location": []string{s.URL(p.RedirectTo)}}
+	}
+	if r.Body == "" && len(p.Links) > 0 {
+		var buf bytes.Buffer
+		buf.WriteString("<!DOCTYPE html>\n<html>\n<head><title>" + html.EscapeString(p.Path) + "</title></head>\n<body>\n")
+		for _, link := range p.Links {
+			fmt.Fprintf(&buf, "<a href=\"%s\">%s</a>\n", html.EscapeString(link), html.EscapeString(link))
+		}
+		buf.WriteString("</body>\n</html>\n")
+		r.Body = buf.String()
+	}
+	return r
+}
+
+// CassetteTransport is an http.RoundTripper that records the responses it
+// gets to a cassette file, and replays them on later runs instead of making
+// the requests again. It allows tests and local development against real
+// sites without hammering them: the first run records, every run after that
+// replays.
+//
+//	manager, err := NewFetchManager(
+//		WithTransport(NewCassetteTransport("testdata/site.cassette", nil)),
+//		...
+//	)
+//
+// Requests are matched on method and URL. Responses that failed (no
+// response at all) are not recorded. Delete the cassette to record afresh.
+type CassetteTransport struct {
+	// The cassette file
+	Path string
+
+	// Makes the requests that get recorded; http.DefaultTransport if nil
+	Transport http.RoundTripper
+
+	// If true, requests missing from the cassette fail rather than being
+	// made, ex. for tests that must never touch the network
+	ReplayOnly bool
+
+	mu       sync.Mutex
+	loaded   bool
+	episodes map[string]*cassetteEpisode
+}
+
+// cassetteEpisode is one recorded response
+type cassetteEpisode struct {
+	Method  string      `json:"method"`
+	URL     string      `json:"url"`
+	Status  int         `json:"status"`
+	Proto   string      `json:"proto"`
+	Headers http.Header `json:"headers"`
+	Body    []byte      `json:"body"`
+}
+
+// NewCassetteTransport creates a CassetteTransport recording to path, making
+// requests with transport (http.DefaultTransport if nil)
+func NewCassetteTransport(path string, transport http.RoundTripper) *CassetteTransport {
+	return &CassetteTransport{Path: path, Transport: transport}
+}
+
+func cassetteKey(method, link string) string {
+	return method + " " + link
+}
+
+// RoundTrip implements http.RoundTripper
+func (c *CassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := cassetteKey(req.Method, req.URL.String())
+	c.mu.Lock()
+	if err := c.load(); err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	ep, ok := c.episodes[key]
+	c.mu.Unlock()
+	if ok {
+		return ep.response(req), nil
+	}
+	if c.ReplayOnly {
+		return nil, fmt.Errorf("%v %v is not in cassette %v", req.Method, req.URL, c.Path)
+	}
+
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	res, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	ep = &cassetteEpisode{
+		Method:  req.Method,
+		URL:     req.URL.String(),
+		Status:  res.StatusCode,
+		Proto:   res.Proto,
+		Headers: res.Header,
+		Body:    body,
+	}
+
+	c.mu.Lock()
+	c.episodes[key] = ep
+	err = c.save()
+	c.mu.Unlock()
+	if err != nil {
+		log4go.Error("Failed to save cassette %v: %v", c.Path, err)
+	}
+	return ep.response(req), nil
+}
+
+// CancelRequest cancels req if the underlying transport can
+func (c *CassetteTransport) CancelRequest(req *http.Request) {
+	if t, ok := c.Transport.(interface {
+		CancelRequest(*http.Request)
+	}); ok {
+		t.CancelRequest(req)
+	}
+}
+
+// load reads the cassette the first time it is needed; a missing cassette
+// is empty. c.mu must be held.
+func (c *CassetteTransport) load() error {
+	if c.loaded {
+		return nil
+	}
+	c.episodes = map[string]*cassetteEpisode{}
+	b, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		c.loaded = true
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read cassette %v: %v", c.Path, err)
+	}
+	var episodes []*cassetteEpisode
+	if err := json.Unmarshal(b, &episodes); err != nil {
+		return fmt.Errorf("Failed to parse cassette %v: %v", c.Path, err)
+	}
+	for _, ep := range episodes {
+		c.episodes[cassetteKey(ep.Method, ep.URL)] = ep
+	}
+	c.loaded = true
+	return nil
+}
+
+// save writes every episode to the cassette, sorted so re-recording gives
+// stable diffs. c.mu must be held.
+func (c *CassetteTransport) save() error {
+	var keys []string
+	for key := range c.episodes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var episodes []*cassetteEpisode
+	for _, key := range keys {
+		episodes = append(episodes, c.episodes[key])
+	}
+	b, err := json.MarshalIndent(episodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.Path, b, 0644)
+}
+
+func (ep *cassetteEpisode) response(req *http.Request) *http.Response {
+	headers := http.Header{}
+	for key, values := range ep.Headers {
+		headers[key] = append([]string(nil), values...)
+	}
+	proto := ep.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+	major, minor, _ := http.ParseHTTPVersion(proto)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ep.Status, http.StatusText(ep.Status)),
+		StatusCode:    ep.Status,
+		Proto:         proto,
+		ProtoMajor:    major,
+		ProtoMinor:    minor,
+		Header:        headers,
+		Body:          ioutil.NopCloser(bytes.NewReader(ep.Body)),
+		ContentLength: int64(len(ep.Body)),
+		Request:       req,
+	}
+}
@@ -0,0 +1,64 @@
+package walker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCassetteTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walker-cassette")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.cassette")
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTeapot)
+		fmt.Fprintf(w, "response to %v", r.URL.Path)
+	}))
+	link := server.URL + "/page"
+
+	get := func(c *CassetteTransport) (*http.Response, string, error) {
+		res, err := (&http.Client{Transport: c}).Get(link)
+		if err != nil {
+			return nil, "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return res, string(body), err
+	}
+
+	// The first run records, later requests (and runs) replay
+	for i := 0; i < 2; i++ {
+		res, body, err := get(NewCassetteTransport(path, nil))
+		if err != nil {
+			t.Fatalf("Failed to get %v: %v", link, err)
+		}
+		if res.StatusCode != http.StatusTeapot || body != "response to /page" ||
+			res.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("Run %d: unexpected response %v %v %q", i, res.Status, res.Header, body)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request to reach the server, got %d", requests)
+	}
+
+	server.Close()
+	replay := &CassetteTransport{Path: path, ReplayOnly: true}
+	if _, body, err := get(replay); err != nil || body != "response to /page" {
+		t.Errorf("Expected replay after the server went away, got %q, %v", body, err)
+	}
+	link = server.URL + "/unrecorded"
+	if _, _, err := get(replay); err == nil {
+		t.Errorf("Expected an unrecorded request to fail in replay-only mode")
+	}
+}
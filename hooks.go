@@ -0,0 +1,122 @@
+package walker
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// Programs embedding walker can gate the crawl of each host on their own
+// logic (ex. a site's maintenance window, or a third-party rate API) without
+// changing the fetcher loop, by registering hooks with WithClaimHook and
+// WithUnclaimHook. A fetcher runs the claim hooks, in the order registered,
+// right after claiming a host and before making any request to it; if one
+// vetoes the claim the host is unclaimed without being crawled. The unclaim
+// hooks run after every host is unclaimed, vetoed or not.
+//
+// Hooks are called from many fetchers at once, so they must be safe for
+// concurrent use, and they hold up the fetcher calling them.
+
+// HostStats is what a fetcher knows of a host it claimed, as given to claim
+// and unclaim hooks
+type HostStats struct {
+	// The host (domain) claimed
+	Host string
+
+	// When the fetcher claimed it
+	Claimed time.Time
+
+	// The following are only set for unclaim hooks
+
+	// When the fetcher unclaimed it
+	Unclaimed time.Time
+
+	// The links fetched (not counting those excluded by robots.txt or skipped
+	// as fresh), and how many of those failed or answered 5xx
+	Fetched int
+	Errors  int
+
+	// True if the fetcher got through all the links dispatched for the host,
+	// rather than stopping early (ex. at its download quota or when told to
+	// quit)
+	Completed bool
+
+	// The error a claim hook vetoed the claim with, nil if none did
+	Veto error
+}
+
+// ClaimHook is called when a fetcher claims a host (see WithClaimHook).
+// Returning an error vetoes the claim.
+type ClaimHook func(stats HostStats) error
+
+// UnclaimHook is called when a fetcher unclaims a host (see WithUnclaimHook)
+type UnclaimHook func(stats HostStats)
+
+// HostVeto is an error a ClaimHook can veto a claim with to keep the host from
+// being claimed again until a given time, ex. the end of a maintenance window.
+// Any other error only vetoes this claim, and the host may be dispatched again
+// right away.
+type HostVeto struct {
+	Reason string
+
+	// The host is quarantined (see Datastore.QuarantineHost) until then
+	Until time.Time
+}
+
+func (v *HostVeto) Error() string {
+	return fmt.Sprintf("%v (until %v)", v.Reason, v.Until.Format(time.RFC3339))
+}
+
+// WithClaimHook adds h to the hooks run when a fetcher claims a host
+func WithClaimHook(h ClaimHook) Option {
+	return func(fm *FetchManager) error {
+		if h == nil {
+			return fmt.Errorf("WithClaimHook given a nil hook")
+		}
+		fm.claimHooks = append(fm.claimHooks, h)
+		return nil
+	}
+}
+
+// WithUnclaimHook adds h to the hooks run when a fetcher unclaims a host
+func WithUnclaimHook(h UnclaimHook) Option {
+	return func(fm *FetchManager) error {
+		if h == nil {
+			return fmt.Errorf("WithUnclaimHook given a nil hook")
+		}
+		fm.unclaimHooks = append(fm.unclaimHooks, h)
+		return nil
+	}
+}
+
+// runClaimHooks runs the claim hooks on the host f just claimed, returning
+// false if one vetoed the claim. A HostVeto quarantines the host.
+func (f *fetcher) runClaimHooks() bool {
+	for _, h := range f.fm.claimHooks {
+		err := h(f.hostStats)
+		if err == nil {
+			continue
+		}
+		f.hostStats.Veto = err
+		log4go.Info("Claim of %v vetoed: %v", f.host, err)
+		if v, ok := err.(*HostVeto); ok && v.Until.After(time.Now()) {
+			f.fm.Datastore.QuarantineHost(f.host, v.Until)
+		}
+		return false
+	}
+	return true
+}
+
+// runUnclaimHooks runs the unclaim hooks on the host f just unclaimed
+func (f *fetcher) runUnclaimHooks() {
+	if len(f.fm.unclaimHooks) == 0 {
+		return
+	}
+	stats := f.hostStats
+	stats.Unclaimed = time.Now()
+	stats.Fetched, stats.Errors = f.fetched, f.fetchErrors
+	for _, h := range f.fm.unclaimHooks {
+		h(stats)
+	}
+}
@@ -0,0 +1,229 @@
+package walker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"strings"
+
+	// Register the decoders image.DecodeConfig can use
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	"code.google.com/p/log4go"
+)
+
+// ImageInfo holds metadata read from a fetched image. Only this metadata is
+// kept; walker does not retain the image itself (unless
+// cassandra.store_response_body is set).
+type ImageInfo struct {
+	// The decoded format, ex. "jpeg", "png" or "gif"
+	Format string
+
+	// Dimensions in pixels
+	Width  int
+	Height int
+
+	// The camera maker and model from EXIF data, empty if not present
+	CameraMake  string
+	CameraModel string
+
+	// True if the EXIF data included a GPS position, in which case Latitude
+	// and Longitude hold it in decimal degrees (negative for S and W)
+	HasGPS    bool
+	Latitude  float64
+	Longitude float64
+}
+
+// parseImage reads the dimensions, format and EXIF basics out of an image.
+// It returns nil if body could not be decoded as an image.
+func parseImage(body []byte) *ImageInfo {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(body))
+	if err != nil {
+		log4go.Debug("Failed to decode image: %v", err)
+		return nil
+	}
+
+	info := &ImageInfo{
+		Format: format,
+		Width:  cfg.Width,
+		Height: cfg.Height,
+	}
+	if format == "jpeg" {
+		parseJPEGExif(body, info)
+	}
+	return info
+}
+
+// EXIF tags we read
+const (
+	exifTagMake       = 0x010F
+	exifTagModel      = 0x0110
+	exifTagGPSIFD     = 0x8825
+	exifTagGPSLatRef  = 0x0001
+	exifTagGPSLat     = 0x0002
+	exifTagGPSLongRef = 0x0003
+	exifTagGPSLong    = 0x0004
+)
+
+// parseJPEGExif finds the EXIF (APP1) segment of a JPEG and fills in info from
+// it. Anything malformed is silently skipped.
+func parseJPEGExif(b []byte, info *ImageInfo) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return
+	}
+
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return
+		}
+		marker := b[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of image data or end of image; metadata comes before
+			return
+		}
+		size := int(b[i+2])<<8 | int(b[i+3])
+		if size < 2 || i+2+size > len(b) {
+			return
+		}
+		seg := b[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) >= 6 && string(seg[:6]) == "Exif\x00\x00" {
+			parseTIFF(seg[6:], info)
+			return
+		}
+		i += 2 + size
+	}
+}
+
+// tiffEntry is a single IFD entry of a TIFF structure (which is how EXIF data
+// is laid out)
+type tiffEntry struct {
+	typ   uint16
+	count uint32
+	value []byte // the 4 byte value/offset field
+}
+
+// parseTIFF reads camera and GPS information from a TIFF structure
+func parseTIFF(t []byte, info *ImageInfo) {
+	if len(t) < 8 {
+		return
+	}
+	var bo binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return
+	}
+
+	ifd0 := readIFD(t, bo, int(bo.Uint32(t[4:8])))
+	info.CameraMake = tiffString(t, bo, ifd0[exifTagMake])
+	info.CameraModel = tiffString(t, bo, ifd0[exifTagModel])
+
+	ptr, ok := ifd0[exifTagGPSIFD]
+	if !ok {
+		return
+	}
+	gps := readIFD(t, bo, int(bo.Uint32(ptr.value)))
+	lat, latOk := tiffDegrees(t, bo, gps[exifTagGPSLat])
+	long, longOk := tiffDegrees(t, bo, gps[exifTagGPSLong])
+	if !latOk || !longOk {
+		return
+	}
+	if tiffString(t, bo, gps[exifTagGPSLatRef]) == "S" {
+		lat = -lat
+	}
+	if tiffString(t, bo, gps[exifTagGPSLongRef]) == "W" {
+		long = -long
+	}
+	info.HasGPS = true
+	info.Latitude = lat
+	info.Longitude = long
+}
+
+// readIFD returns the entries of the IFD at offset off, keyed by tag
+func readIFD(t []byte, bo binary.ByteOrder, off int) map[uint16]tiffEntry {
+	entries := map[uint16]tiffEntry{}
+	if off < 0 || off+2 > len(t) {
+		return entries
+	}
+	n := int(bo.Uint16(t[off:]))
+	for i := 0; i < n; i++ {
+		p := off + 2 + 12*i
+		if p+12 > len(t) {
+			break
+		}
+		entries[bo.Uint16(t[p:])] = tiffEntry{
+			typ:   bo.Uint16(t[p+2:]),
+			count: bo.Uint32(t[p+4:]),
+			value: t[p+8 : p+12],
+		}
+	}
+	return entries
+}
+
+// tiffTypeSizes maps TIFF field types to their size in bytes
+var tiffTypeSizes = map[uint16]int{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	7:  1, // UNDEFINED
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+}
+
+// tiffData returns the raw data of an entry, or nil if it doesn't fit in t
+func tiffData(t []byte, bo binary.ByteOrder, e tiffEntry) []byte {
+	if e.value == nil || int64(e.count) > int64(len(t)) {
+		return nil
+	}
+	size := tiffTypeSizes[e.typ] * int(e.count)
+	if size <= 4 {
+		return e.value[:size]
+	}
+	off := int(bo.Uint32(e.value))
+	if off < 0 || off+size > len(t) {
+		return nil
+	}
+	return t[off : off+size]
+}
+
+// tiffString returns the value of an ASCII entry, or "" if it isn't one
+func tiffString(t []byte, bo binary.ByteOrder, e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	s := string(tiffData(t, bo, e))
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// tiffDegrees converts a GPS coordinate entry (3 rationals: degrees, minutes
+// and seconds) to decimal degrees
+func tiffDegrees(t []byte, bo binary.ByteOrder, e tiffEntry) (float64, bool) {
+	if e.typ != 5 || e.count != 3 {
+		return 0, false
+	}
+	d := tiffData(t, bo, e)
+	if d == nil {
+		return 0, false
+	}
+
+	var parts [3]float64
+	for i := range parts {
+		num := bo.Uint32(d[8*i:])
+		den := bo.Uint32(d[8*i+4:])
+		if den == 0 {
+			return 0, false
+		}
+		parts[i] = float64(num) / float64(den)
+	}
+	return parts[0] + parts[1]/60 + parts[2]/3600, true
+}
@@ -1,5 +1,7 @@
 package walker
 
+import "time"
+
 // Handler defines the interface for objects that will be set as handlers on a
 // FetchManager.
 type Handler interface {
@@ -11,6 +13,19 @@ type Handler interface {
 	HandleResponse(res *FetchResults)
 }
 
+// HandlerV2 is implemented by handlers that report whether they handled a
+// response. If the FetchManager's Handler implements it, fetchers call
+// HandleFetch instead of HandleResponse; use NewHandlerV2 to set a handler
+// that only implements HandlerV2.
+type HandlerV2 interface {
+	// HandleFetch is called in place of HandleResponse, and is given the same
+	// responses. It returns nil if the response was handled, or an error
+	// saying why not. The error is recorded in the FetchResults the Datastore
+	// stores (see FetchResults.HandlerError); if it was made with RetryAfter,
+	// the link is queued to be fetched, and handled, again.
+	HandleFetch(res *FetchResults) error
+}
+
 // Datastore defines the interface for an object to be used as walker's datastore.
 //
 // Note that this is for link and metadata storage required to make walker
@@ -48,8 +63,58 @@ type Datastore interface {
 	// links (i.e. a fetcher should be safe feeding the same URL many times.
 	StoreParsedURL(u *URL, fr *FetchResults)
 
+	// HostQuotaExceeded returns true if `host` has used up its download quota
+	// for the day. Fetchers check this before each fetch and stop crawling
+	// (unclaiming the host) as soon as it returns true; links left in the
+	// segment will be picked up by a later dispatch.
+	HostQuotaExceeded(host string) bool
+
+	// StoreRobotsTxt is called with the contents of every robots.txt a
+	// fetcher successfully downloads. Datastores may keep it to detect when a
+	// host's rules change between crawls.
+	StoreRobotsTxt(host string, body []byte)
+
+	// StoreControlFileOverLimit is called when a control file fetched for
+	// host, its robots.txt or a sitemap at link, is larger than its limit
+	// (fetcher.max_robots_bytes or fetcher.max_sitemap_bytes).
+	StoreControlFileOverLimit(host, link string, limit int64)
+
+	// CrawlDelayOverride returns the crawl delay an operator has set for
+	// host, or 0 if none is set. A non-zero override replaces both the
+	// Crawl-delay in the host's robots.txt and fetcher.default_crawl_delay.
+	CrawlDelayOverride(host string) time.Duration
+
+	// BurstMode returns true if an operator has put host in burst mode, for a
+	// full snapshot of it: fetchers then use fetcher.burst_crawl_delay in
+	// place of fetcher.default_crawl_delay.
+	BurstMode(host string) bool
+
+	// StoreHostContext is called when a fetcher finishes crawling host, with
+	// what it learned that the next fetcher to claim host can reuse.
+	StoreHostContext(host string, hc *HostContext)
+
+	// LoadHostContext returns the context last stored for host, or nil if
+	// there is none or it has expired.
+	LoadHostContext(host string) *HostContext
+
+	// StorePageState records what differential crawl mode
+	// (fetcher.differential) knows of the page at u after fetching it.
+	StorePageState(u *URL, ps *PageState)
+
+	// LoadPageState returns the state last stored for u, or nil if there is
+	// none.
+	LoadPageState(u *URL) *PageState
+
+	// QuarantineHost keeps host from being dispatched or claimed until the
+	// given time, because it doesn't resolve (see
+	// fetcher.dns_quarantine_failures) or its robots.txt is unavailable (see
+	// fetcher.robots_error_policy).
+	QuarantineHost(host string, until time.Time)
+
 	// KeepAlive will be called periodically in fetcher. This method should
-	// notify the datastore that this fetcher is still alive.
+	// notify the datastore that this fetcher is still alive. It should fail
+	// with ErrDatastoreUnavailable (see errors.go) if the datastore couldn't
+	// be reached.
 	KeepAlive() error
 
 	// Close will be called when no more Datastore calls will be made, allowing
@@ -66,7 +131,9 @@ type Datastore interface {
 type Dispatcher interface {
 	// StartDispatcher should be a blocking call that starts the dispatcher. It
 	// should return an error if it could not start or stop properly and nil
-	// when it has safely shut down and stopped all internal processing.
+	// when it has safely shut down and stopped all internal processing. If it
+	// couldn't start because the datastore couldn't be reached the error
+	// should be an ErrDatastoreUnavailable.
 	StartDispatcher() error
 
 	// Stop signals the dispatcher to stop. It should block until all internal
@@ -0,0 +1,79 @@
+package walker
+
+import "time"
+
+// HostTable interns the scheme and host of URLs, giving each distinct
+// "scheme://host" a small integer id, so code holding many URLs (ex. the
+// links of a domain waiting to be dispatched) can keep them as CompactURLs
+// instead of full *URLs. A *URL costs a url.URL, a string holding the whole
+// link and several header words; a CompactURL is the host id and the path
+// bytes, with the scheme and host stored once per table.
+//
+// A HostTable is not safe for concurrent use, and never forgets a host, so it
+// should live as long as the URLs compacted with it rather than the process.
+type HostTable struct {
+	ids   map[string]uint32
+	hosts []string
+}
+
+// NewHostTable creates an empty HostTable
+func NewHostTable() *HostTable {
+	return &HostTable{ids: map[string]uint32{}}
+}
+
+// CompactURL is a URL compacted with a HostTable. It can only be expanded by
+// the table it was made with.
+type CompactURL struct {
+	// Id of the URL's scheme and host in its HostTable
+	Host uint32
+
+	// The URL's path and query (URL.RequestURI)
+	Path []byte
+
+	LastCrawled     time.Time
+	ChainPos        int
+	Depth           int
+	LastFingerprint int64
+}
+
+// Len returns the number of hosts in the table
+func (t *HostTable) Len() int {
+	return len(t.hosts)
+}
+
+// id returns the id of host, adding it if it isn't in the table yet
+func (t *HostTable) id(host string) uint32 {
+	if id, ok := t.ids[host]; ok {
+		return id
+	}
+	id := uint32(len(t.hosts))
+	t.ids[host] = id
+	t.hosts = append(t.hosts, host)
+	return id
+}
+
+// Compact returns the compact form of u. Fragments and user info aren't kept,
+// which walker's normalized links don't have anyway.
+func (t *HostTable) Compact(u *URL) CompactURL {
+	return CompactURL{
+		Host:            t.id(u.Scheme + "://" + u.Host),
+		Path:            []byte(u.RequestURI()),
+		LastCrawled:     u.LastCrawled,
+		ChainPos:        u.ChainPos,
+		Depth:           u.Depth,
+		LastFingerprint: u.LastFingerprint,
+	}
+}
+
+// Expand returns the URL c was compacted from
+func (t *HostTable) Expand(c CompactURL) (*URL, error) {
+	u, err := ParseURL(t.hosts[c.Host] + string(c.Path))
+	if err != nil {
+		return nil, err
+	}
+	u.LastCrawled = c.LastCrawled
+	u.ChainPos = c.ChainPos
+	u.Depth = c.Depth
+	u.LastFingerprint = c.LastFingerprint
+	return u, nil
+}
@@ -0,0 +1,46 @@
+package walker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostTableRoundTrip(t *testing.T) {
+	hosts := NewHostTable()
+	crawled := time.Unix(1400000000, 0)
+	links := []string{
+		"http://test.com/page1.html",
+		"http://test.com/page2.html?id=3&x=y",
+		"https://test.com/secure",
+		"http://sub.test.com:8080/a%20b/c",
+		"http://test.com",
+	}
+
+	var compact []CompactURL
+	for i, link := range links {
+		u := MustParse(link)
+		u.LastCrawled = crawled
+		u.ChainPos = i
+		compact = append(compact, hosts.Compact(u))
+	}
+	if hosts.Len() != 3 {
+		t.Errorf("Expected 3 distinct hosts, got %d", hosts.Len())
+	}
+	if compact[0].Host != compact[1].Host || compact[0].Host == compact[2].Host {
+		t.Errorf("Expected links to share a host id only when their scheme and host match, got %+v", compact)
+	}
+
+	for i, cu := range compact {
+		u, err := hosts.Expand(cu)
+		if err != nil {
+			t.Fatalf("Failed to expand %v: %v", links[i], err)
+		}
+		expected := MustParse(links[i])
+		if u.String() != expected.String() && u.String() != expected.String()+"/" {
+			t.Errorf("Expanded link mismatch, got %v, expected %v", u, expected)
+		}
+		if !u.LastCrawled.Equal(crawled) || u.ChainPos != i {
+			t.Errorf("Expanded %v lost LastCrawled or ChainPos, got %v and %d", u, u.LastCrawled, u.ChainPos)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package walker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Fetchers only store the links they parse that pass the link filter:
+// fetcher.max_path_length, fetcher.deny_extensions (with
+// fetcher.extension_overrides), fetcher.exclude_link_patterns (unless
+// fetcher.include_link_patterns overrides them) and fetcher.accept_protocols.
+// FilterLink runs a link through the same filter, and the normalization
+// parsed links get, to explain what the crawl would do with it; the console's
+// /filterTester page does this for links an operator pastes, with the
+// datastore adding the rules it applies when storing them (FilterDomain and
+// FilterParamRule).
+
+// The filter rules, in the order they are applied
+const (
+	FilterParse      = "parse"
+	FilterNormalize  = "normalize"
+	FilterAbsolute   = "absolute"
+	FilterRedirector = "redirector_hosts"
+	FilterPathLength = "max_path_length"
+	FilterExtension  = "deny_extensions"
+	FilterExclude    = "exclude_link_patterns"
+	FilterInclude    = "include_link_patterns"
+	FilterProtocol   = "accept_protocols"
+	FilterDomain     = "domain"
+	FilterParamRule  = "param_rules"
+)
+
+// FilterRule is how one filter rule treated a link
+type FilterRule struct {
+	// One of the Filter* constants above
+	Name string `json:"name"`
+
+	// True if the rule lets the link through
+	Passed bool `json:"passed"`
+
+	// Why, ex. the pattern that matched the link
+	Detail string `json:"detail"`
+}
+
+// FilterReport is what the filter rules made of a link (see FilterLink)
+type FilterReport struct {
+	// The link as given
+	Link string `json:"link"`
+
+	// The link as it would be stored, "" if it couldn't be parsed
+	URL string `json:"url"`
+
+	// Its domain (TLD+1), "" if it has none
+	Domain string `json:"domain"`
+
+	// True if every rule let it through, so it would be stored
+	Stored bool `json:"stored"`
+
+	Rules []FilterRule `json:"rules"`
+
+	// The configured blocklist (see blocklist.lists) Domain is on, "" if
+	// none
+	Blocklist string `json:"blocklist,omitempty"`
+}
+
+// Add records how the named rule treated the link; the link isn't stored if
+// any rule didn't pass it. It does nothing on a nil report, so the filter can
+// be run without one.
+func (r *FilterReport) Add(name string, passed bool, format string, args ...interface{}) {
+	if r == nil {
+		return
+	}
+	r.Rules = append(r.Rules, FilterRule{Name: name, Passed: passed, Detail: fmt.Sprintf(format, args...)})
+	r.Stored = r.Stored && passed
+}
+
+// linkFilter decides which parsed links fetchers store
+type linkFilter struct {
+	exclude, include *regexp.Regexp
+	extensions       *extensionDenier
+}
+
+// newLinkFilter compiles the link filter from Config
+func newLinkFilter() (*linkFilter, error) {
+	lf := linkFilter{
+		extensions: newExtensionDenier(Config.Fetcher.DenyExtensions, Config.Fetcher.ExtensionOverrides),
+	}
+	var err error
+	lf.exclude, err = aggregateRegex(Config.Fetcher.ExcludeLinkPatterns, "exclude_link_patterns")
+	if err != nil {
+		return nil, err
+	}
+	lf.include, err = aggregateRegex(Config.Fetcher.IncludeLinkPatterns, "include_link_patterns")
+	if err != nil {
+		return nil, err
+	}
+	return &lf, nil
+}
+
+// check returns true if u passes the filter, recording why in r if it isn't
+// nil
+func (lf *linkFilter) check(u *URL, r *FilterReport) bool {
+	path := u.RequestURI()
+	if max := Config.Fetcher.MaxPathLength; max > 0 && len(path) > max {
+		r.Add(FilterPathLength, false, "The path is %d bytes long, over %d", len(path), max)
+		return false
+	}
+	r.Add(FilterPathLength, true, "The path is %d bytes long", len(path))
+
+	if ext, denied := lf.extensions.check(u); denied {
+		r.Add(FilterExtension, false, "%q is denied on %v", ext, u.Host)
+		return false
+	} else if ext != "" {
+		r.Add(FilterExtension, true, "%q isn't denied on %v", ext, u.Host)
+	} else {
+		r.Add(FilterExtension, true, "No extension")
+	}
+
+	excluded := lf.exclude != nil && lf.exclude.MatchString(path)
+	included := excluded && lf.include != nil && lf.include.MatchString(path)
+	if r != nil {
+		switch {
+		case !excluded:
+			r.Add(FilterExclude, true, "No pattern matches")
+		case included:
+			r.Add(FilterExclude, true, "%q matches, but include_link_patterns overrides it",
+				matchingPattern(Config.Fetcher.ExcludeLinkPatterns, path))
+			r.Add(FilterInclude, true, "%q matches", matchingPattern(Config.Fetcher.IncludeLinkPatterns, path))
+		default:
+			r.Add(FilterExclude, false, "%q matches", matchingPattern(Config.Fetcher.ExcludeLinkPatterns, path))
+			r.Add(FilterInclude, false, "No pattern matches")
+		}
+	}
+	if excluded && !included {
+		return false
+	}
+
+	for _, p := range Config.Fetcher.AcceptProtocols {
+		if u.Scheme == p {
+			r.Add(FilterProtocol, true, "%v is accepted", u.Scheme)
+			return true
+		}
+	}
+	r.Add(FilterProtocol, false, "%q is not one of %v", u.Scheme, Config.Fetcher.AcceptProtocols)
+	return false
+}
+
+// matchingPattern returns the first of patterns that matches path
+func matchingPattern(patterns []string, path string) string {
+	for _, p := range patterns {
+		if re, err := regexp.Compile(p); err == nil && re.MatchString(path) {
+			return p
+		}
+	}
+	return ""
+}
+
+// FilterLink reports how a link found on a page would be normalized, and
+// which of the fetcher's filter rules would keep it from being stored, using
+// the rules in Config. A link to one of fetcher.redirector_hosts is checked as
+// is, though the fetcher would check the link it expands to instead.
+func FilterLink(link string) *FilterReport {
+	r := &FilterReport{Link: link, Stored: true}
+	u, err := ParseURL(strings.TrimSpace(link))
+	if err != nil {
+		r.Add(FilterParse, false, "%v", err)
+		return r
+	}
+	r.Add(FilterParse, true, "Parsed")
+
+	before := u.String()
+	u.Normalize()
+	r.URL = u.String()
+	if r.URL != before {
+		r.Add(FilterNormalize, true, "Normalized to %v", r.URL)
+	} else {
+		r.Add(FilterNormalize, true, "Already normalized")
+	}
+
+	if !u.IsAbs() || u.Host == "" {
+		r.Add(FilterAbsolute, false, "Not an absolute URL; links are made absolute against the page they're on")
+		return r
+	}
+	r.Add(FilterAbsolute, true, "Absolute")
+	if dom, err := u.ToplevelDomainPlusOne(); err == nil {
+		r.Domain = dom
+		if b := configuredBlocklists(); b != nil {
+			r.Blocklist = b.lookup(dom)
+		}
+	}
+
+	for _, h := range Config.Fetcher.RedirectorHosts {
+		if strings.EqualFold(h, u.Host) {
+			r.Add(FilterRedirector, true, "%v is a redirector host; the fetcher stores the link it redirects to "+
+				"instead, if it passes the rules below", u.Host)
+		}
+	}
+
+	lf, err := newLinkFilter()
+	if err != nil {
+		// This shouldn't happen b/c it's already been checked when loading config
+		r.Add(FilterExclude, false, "%v", err)
+		return r
+	}
+	lf.check(u, r)
+	return r
+}
@@ -0,0 +1,84 @@
+package walker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterLink(t *testing.T) {
+	origExclude := Config.Fetcher.ExcludeLinkPatterns
+	origInclude := Config.Fetcher.IncludeLinkPatterns
+	origMaxPath := Config.Fetcher.MaxPathLength
+	origDeny := Config.Fetcher.DenyExtensions
+	origOverrides := Config.Fetcher.ExtensionOverrides
+	defer func() {
+		Config.Fetcher.ExcludeLinkPatterns = origExclude
+		Config.Fetcher.IncludeLinkPatterns = origInclude
+		Config.Fetcher.MaxPathLength = origMaxPath
+		Config.Fetcher.DenyExtensions = origDeny
+		Config.Fetcher.ExtensionOverrides = origOverrides
+	}()
+	Config.Fetcher.ExcludeLinkPatterns = []string{`\.pdf$`, `^/private/`}
+	Config.Fetcher.IncludeLinkPatterns = []string{`^/private/public`}
+	Config.Fetcher.MaxPathLength = 30
+	Config.Fetcher.DenyExtensions = []string{".zip", "EXE", ".tar.gz"}
+	Config.Fetcher.ExtensionOverrides = []ExtensionOverride{
+		{Host: "files.com", Allow: []string{"zip"}, Deny: []string{".iso"}},
+	}
+
+	tests := []struct {
+		link   string
+		url    string
+		stored bool
+		failed []string
+	}{
+		{"http://test.com/page.html", "http://test.com/page.html", true, nil},
+		{"HTTP://Test.com/page.html#top", "http://test.com/page.html", true, nil},
+		{"http://test.com/doc.pdf", "http://test.com/doc.pdf", false, []string{FilterExclude, FilterInclude}},
+		{"http://test.com/private/x.html", "http://test.com/private/x.html", false,
+			[]string{FilterExclude, FilterInclude}},
+		{"http://test.com/private/public.html", "http://test.com/private/public.html", true, nil},
+		{"http://test.com/a-very-long-path/that-goes-on.html", "http://test.com/a-very-long-path/that-goes-on.html",
+			false, []string{FilterPathLength}},
+		{"http://test.com/setup.EXE", "http://test.com/setup.EXE", false, []string{FilterExtension}},
+		{"http://test.com/a.zip?v=1", "http://test.com/a.zip?v=1", false, []string{FilterExtension}},
+		{"http://www.files.com/a.zip", "http://www.files.com/a.zip", true, nil},
+		{"http://files.com:8080/a.zip", "http://files.com:8080/a.zip", true, nil},
+		{"http://test.com/src-1.2.tar.gz", "http://test.com/src-1.2.tar.gz", false, []string{FilterExtension}},
+		{"http://test.com/notes.gz", "http://test.com/notes.gz", true, nil},
+		{"http://files.com/disk.iso", "http://files.com/disk.iso", false, []string{FilterExtension}},
+		{"http://files.com/setup.exe", "http://files.com/setup.exe", false, []string{FilterExtension}},
+		{"ftp://test.com/file.txt", "ftp://test.com/file.txt", false, []string{FilterProtocol}},
+		{"/relative.html", "/relative.html", false, []string{FilterAbsolute}},
+		{"http://[::1", "", false, []string{FilterParse}},
+	}
+	for _, tst := range tests {
+		r := FilterLink(tst.link)
+		if r.URL != tst.url {
+			t.Errorf("Expected %q to be stored as %q, got %q", tst.link, tst.url, r.URL)
+		}
+		if r.Stored != tst.stored {
+			t.Errorf("Expected Stored of %q to be %v, got %+v", tst.link, tst.stored, r)
+		}
+		var failed []string
+		for _, rule := range r.Rules {
+			if !rule.Passed {
+				failed = append(failed, rule.Name)
+			}
+		}
+		if !reflect.DeepEqual(failed, tst.failed) {
+			t.Errorf("Expected %q to fail rules %v, got %+v", tst.link, tst.failed, r.Rules)
+		}
+
+		// The fetcher decides the same way
+		if u, err := ParseAndNormalizeURL(tst.link); err == nil && u.IsAbs() {
+			lf, err := newLinkFilter()
+			if err != nil {
+				t.Fatalf("newLinkFilter failed: %v", err)
+			}
+			if lf.check(u, nil) != tst.stored {
+				t.Errorf("Expected the fetcher to store %q: %v", tst.link, tst.stored)
+			}
+		}
+	}
+}
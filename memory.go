@@ -0,0 +1,148 @@
+package walker
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryDatastore is a Datastore that keeps everything in memory. Each link is
+// handed out once: ClaimNewHost claims any domain with links that haven't been
+// handed out yet, and LinksForHost hands out all of them. It needs no
+// dispatcher, and nothing it stores outlives the process, which makes it
+// suited to benchmarks, experiments and small embedded crawls (see Crawl)
+// rather than real crawls. Links waiting to be handed out are kept compacted
+// with a HostTable.
+type MemoryDatastore struct {
+	mu       sync.Mutex
+	hosts    *HostTable
+	pending  map[string][]CompactURL
+	seen     map[string]bool
+	claimed  map[string]bool
+	contexts map[string]*HostContext
+}
+
+// NewMemoryDatastore creates an empty MemoryDatastore
+func NewMemoryDatastore() *MemoryDatastore {
+	return &MemoryDatastore{
+		hosts:    NewHostTable(),
+		pending:  map[string][]CompactURL{},
+		seen:     map[string]bool{},
+		claimed:  map[string]bool{},
+		contexts: map[string]*HostContext{},
+	}
+}
+
+// ClaimNewHost implements Datastore
+func (ds *MemoryDatastore) ClaimNewHost() string {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	for dom, links := range ds.pending {
+		if len(links) > 0 && !ds.claimed[dom] {
+			ds.claimed[dom] = true
+			return dom
+		}
+	}
+	return ""
+}
+
+// UnclaimHost implements Datastore
+func (ds *MemoryDatastore) UnclaimHost(host string) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.claimed, host)
+}
+
+// LinksForHost implements Datastore
+func (ds *MemoryDatastore) LinksForHost(host string) <-chan *URL {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	links := ds.pending[host]
+	delete(ds.pending, host)
+
+	c := make(chan *URL, len(links))
+	for _, cu := range links {
+		u, err := ds.hosts.Expand(cu)
+		if err != nil {
+			continue
+		}
+		c <- u
+	}
+	close(c)
+	return c
+}
+
+// StoreURLFetchResults implements Datastore; MemoryDatastore doesn't
+// keep fetch results
+func (ds *MemoryDatastore) StoreURLFetchResults(fr *FetchResults) {}
+
+// StoreParsedURL implements Datastore
+func (ds *MemoryDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
+	dom, err := u.ToplevelDomainPlusOne()
+	if err != nil {
+		return
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	link := u.String()
+	if ds.seen[link] {
+		return
+	}
+	ds.seen[link] = true
+	ds.pending[dom] = append(ds.pending[dom], ds.hosts.Compact(u))
+}
+
+// HostQuotaExceeded implements Datastore; MemoryDatastore has no quotas
+func (ds *MemoryDatastore) HostQuotaExceeded(host string) bool {
+	return false
+}
+
+// StoreRobotsTxt implements Datastore
+func (ds *MemoryDatastore) StoreRobotsTxt(host string, body []byte) {}
+
+// StoreControlFileOverLimit implements Datastore
+func (ds *MemoryDatastore) StoreControlFileOverLimit(host, link string, limit int64) {}
+
+// CrawlDelayOverride implements Datastore
+func (ds *MemoryDatastore) CrawlDelayOverride(host string) time.Duration {
+	return 0
+}
+
+// BurstMode implements Datastore
+func (ds *MemoryDatastore) BurstMode(host string) bool {
+	return false
+}
+
+// StoreHostContext implements Datastore
+func (ds *MemoryDatastore) StoreHostContext(host string, hc *HostContext) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.contexts[host] = hc
+}
+
+// LoadHostContext implements Datastore
+func (ds *MemoryDatastore) LoadHostContext(host string) *HostContext {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.contexts[host]
+}
+
+// StorePageState implements Datastore; MemoryDatastore doesn't keep
+// page states
+func (ds *MemoryDatastore) StorePageState(u *URL, ps *PageState) {}
+
+// LoadPageState implements Datastore
+func (ds *MemoryDatastore) LoadPageState(u *URL) *PageState {
+	return nil
+}
+
+// QuarantineHost implements Datastore; MemoryDatastore doesn't
+// quarantine hosts
+func (ds *MemoryDatastore) QuarantineHost(host string, until time.Time) {}
+
+// KeepAlive implements Datastore
+func (ds *MemoryDatastore) KeepAlive() error {
+	return nil
+}
+
+// Close implements Datastore
+func (ds *MemoryDatastore) Close() {}
@@ -14,7 +14,9 @@ It primarily exports Matcher:
 package mimetools
 
 import (
+	"fmt"
 	"mime"
+	"strconv"
 	"strings"
 )
 
@@ -104,3 +106,34 @@ func (mm *Matcher) Match(mimeString string) (bool, error) {
 
 	return false, nil
 }
+
+// AcceptHeader builds the value of an Accept header from mediaTypes, in the
+// order given. A media type may set its quality factor with a q parameter (ex.
+// "text/*; q=0.5"), which must be between 0 and 1; those without one have the
+// default of 1. Media types that don't parse, or have a bad q, are an error.
+//
+//	AcceptHeader([]string{"text/html", "text/*; q=0.5"}) // returns "text/html, text/*;q=0.5", nil
+func AcceptHeader(mediaTypes []string) (string, error) {
+	var ranges []string
+	for _, x := range mediaTypes {
+		mediaName, params, err := mime.ParseMediaType(x)
+		if err != nil {
+			return "", fmt.Errorf("Bad media type %q: %v", x, err)
+		}
+		q, hasQ := params["q"]
+		delete(params, "q")
+		r := mime.FormatMediaType(mediaName, params)
+		if r == "" {
+			return "", fmt.Errorf("Bad media type %q", x)
+		}
+		if hasQ {
+			f, err := strconv.ParseFloat(q, 64)
+			if err != nil || f < 0 || f > 1 {
+				return "", fmt.Errorf("Bad quality factor in media type %q: must be between 0 and 1", x)
+			}
+			r += ";q=" + q
+		}
+		ranges = append(ranges, r)
+	}
+	return strings.Join(ranges, ", "), nil
+}
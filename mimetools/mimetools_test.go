@@ -59,3 +59,30 @@ func TestFailMatch(t *testing.T) {
 	testMatchFail(t, "", "text/*")
 	testMatchFail(t, "", "*/html")
 }
+
+func TestAcceptHeader(t *testing.T) {
+	tests := []struct {
+		mediaTypes []string
+		expected   string
+	}{
+		{[]string{"text/html"}, "text/html"},
+		{[]string{"text/html", "text/*;"}, "text/html, text/*"},
+		{[]string{"text/html", "text/*; q=0.5", "*/*;q=0"}, "text/html, text/*;q=0.5, */*;q=0"},
+		{[]string{"text/html; q=0.9; level=1"}, "text/html; level=1;q=0.9"},
+		{[]string{}, ""},
+	}
+	for _, test := range tests {
+		header, err := AcceptHeader(test.mediaTypes)
+		if err != nil {
+			t.Errorf("AcceptHeader(%q) failed: %v", test.mediaTypes, err)
+		} else if header != test.expected {
+			t.Errorf("AcceptHeader(%q) returned %q, expected %q", test.mediaTypes, header, test.expected)
+		}
+	}
+
+	for _, bad := range []string{"text/", "text/html; q=2", "text/html; q=high", "text/html; q=-1"} {
+		if _, err := AcceptHeader([]string{bad}); err == nil {
+			t.Errorf("Expected AcceptHeader to reject %q", bad)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -13,6 +15,36 @@ import (
 // MockDatastore implements walker's Datastore interface for testing.
 type MockDatastore struct {
 	mock.Mock
+
+	// RobotsTxt holds the last body passed to StoreRobotsTxt for each host
+	RobotsTxt map[string][]byte
+	robotsMu  sync.Mutex
+
+	// OverLimit holds the links passed to StoreControlFileOverLimit for each
+	// host
+	OverLimit map[string][]string
+
+	// CrawlDelays is what CrawlDelayOverride returns for each host (0 for
+	// hosts not in it). It should be set before the datastore is used.
+	CrawlDelays map[string]time.Duration
+
+	// Bursts is what BurstMode returns for each host (false for hosts not in
+	// it). It should be set before the datastore is used.
+	Bursts map[string]bool
+
+	// HostContexts holds the last context passed to StoreHostContext for
+	// each host, and is what LoadHostContext returns
+	HostContexts map[string]*HostContext
+	contextMu    sync.Mutex
+
+	// PageStates holds the last state passed to StorePageState for each link,
+	// and is what LoadPageState returns
+	PageStates map[string]*PageState
+	pageMu     sync.Mutex
+
+	// Quarantined holds the time passed to QuarantineHost for each host
+	Quarantined  map[string]time.Time
+	quarantineMu sync.Mutex
 }
 
 func (ds *MockDatastore) StoreParsedURL(u *URL, fr *FetchResults) {
@@ -51,6 +83,97 @@ func (ds *MockDatastore) LinksForHost(domain string) <-chan *URL {
 	return ch
 }
 
+// HostQuotaExceeded implements walker.Datastore interface
+func (ds *MockDatastore) HostQuotaExceeded(host string) bool {
+	args := ds.Mock.Called(host)
+	return args.Bool(0)
+}
+
+// StoreRobotsTxt implements walker.Datastore interface. It is recorded in
+// RobotsTxt instead of as a mock call, so tests don't need to expect it for
+// every host whose robots.txt is fetched.
+func (ds *MockDatastore) StoreRobotsTxt(host string, body []byte) {
+	ds.robotsMu.Lock()
+	defer ds.robotsMu.Unlock()
+	if ds.RobotsTxt == nil {
+		ds.RobotsTxt = map[string][]byte{}
+	}
+	ds.RobotsTxt[host] = body
+}
+
+// StoreControlFileOverLimit implements walker.Datastore interface. Like
+// StoreRobotsTxt it is recorded in OverLimit instead of as a mock call.
+func (ds *MockDatastore) StoreControlFileOverLimit(host, link string, limit int64) {
+	ds.robotsMu.Lock()
+	defer ds.robotsMu.Unlock()
+	if ds.OverLimit == nil {
+		ds.OverLimit = map[string][]string{}
+	}
+	ds.OverLimit[host] = append(ds.OverLimit[host], link)
+}
+
+// CrawlDelayOverride implements walker.Datastore interface, returning the
+// host's entry in CrawlDelays. Like StoreRobotsTxt it is not recorded as a mock
+// call, since whether it gets called depends on host blacklisting.
+func (ds *MockDatastore) CrawlDelayOverride(host string) time.Duration {
+	return ds.CrawlDelays[host]
+}
+
+// BurstMode implements walker.Datastore interface, returning the host's entry
+// in Bursts. Like CrawlDelayOverride it is not recorded as a mock call.
+func (ds *MockDatastore) BurstMode(host string) bool {
+	return ds.Bursts[host]
+}
+
+// StoreHostContext implements walker.Datastore interface. Like StoreRobotsTxt
+// it is recorded in HostContexts instead of as a mock call.
+func (ds *MockDatastore) StoreHostContext(host string, hc *HostContext) {
+	ds.contextMu.Lock()
+	defer ds.contextMu.Unlock()
+	if ds.HostContexts == nil {
+		ds.HostContexts = map[string]*HostContext{}
+	}
+	ds.HostContexts[host] = hc
+}
+
+// LoadHostContext implements walker.Datastore interface, returning the host's
+// entry in HostContexts.
+func (ds *MockDatastore) LoadHostContext(host string) *HostContext {
+	ds.contextMu.Lock()
+	defer ds.contextMu.Unlock()
+	return ds.HostContexts[host]
+}
+
+// StorePageState implements walker.Datastore interface. Like StoreRobotsTxt
+// it is recorded in PageStates instead of as a mock call.
+func (ds *MockDatastore) StorePageState(u *URL, ps *PageState) {
+	ds.pageMu.Lock()
+	defer ds.pageMu.Unlock()
+	if ds.PageStates == nil {
+		ds.PageStates = map[string]*PageState{}
+	}
+	ds.PageStates[u.String()] = ps
+}
+
+// LoadPageState implements walker.Datastore interface, returning the link's
+// entry in PageStates.
+func (ds *MockDatastore) LoadPageState(u *URL) *PageState {
+	ds.pageMu.Lock()
+	defer ds.pageMu.Unlock()
+	return ds.PageStates[u.String()]
+}
+
+// QuarantineHost implements walker.Datastore interface. Like StoreRobotsTxt
+// it is recorded in Quarantined instead of as a mock call.
+func (ds *MockDatastore) QuarantineHost(host string, until time.Time) {
+	ds.quarantineMu.Lock()
+	defer ds.quarantineMu.Unlock()
+	if ds.Quarantined == nil {
+		ds.Quarantined = map[string]time.Time{}
+	}
+	ds.Quarantined[host] = until
+}
+
 // KeepAlive implements walker.Datastore interface
 func (ds *MockDatastore) KeepAlive() error {
 	ds.Mock.Called()
@@ -114,6 +237,9 @@ type MockResponse struct {
 
 	// How long is the content
 	ContentLength int
+
+	// How long the server waits before responding
+	Delay time.Duration
 }
 
 // MockHTTPHandler implements http.Handler to serve mock requests.
@@ -219,7 +345,13 @@ func (s *MockHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if res.ContentType == "" {
 		res.ContentType = "text/html"
 	}
+	if res.Delay > 0 {
+		time.Sleep(res.Delay)
+	}
 
+	for key, values := range res.Headers {
+		w.Header()[key] = values
+	}
 	w.Header().Set("Content-Type", res.ContentType)
 	if res.ContentLength != 0 {
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", res.ContentLength))
@@ -0,0 +1,81 @@
+package walker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"code.google.com/p/log4go"
+)
+
+// nodeIDs caches the IDs read from (or written to) each fetcher.node_id_file,
+// so a process keeps the one ID even if the file changes under it
+var nodeIDs = struct {
+	sync.Mutex
+	byFile map[string]string
+}{byFile: map[string]string{}}
+
+// NodeID returns the ID this node records with the hosts it claims and the
+// links it fetches: cassandra.claim_node_id if set, else the ID kept in
+// fetcher.node_id_file (created there on first use, so it survives restarts
+// and tells apart the walker processes of a host), else the host name. It
+// returns "" if none of them is available.
+func NodeID() string {
+	if Config.Cassandra.ClaimNodeID != "" {
+		return Config.Cassandra.ClaimNodeID
+	}
+	host, _ := os.Hostname()
+	path := Config.Fetcher.NodeIDFile
+	if path == "" {
+		return host
+	}
+
+	nodeIDs.Lock()
+	defer nodeIDs.Unlock()
+	if id, ok := nodeIDs.byFile[path]; ok {
+		return id
+	}
+	id, err := loadNodeID(path, host)
+	if err != nil {
+		log4go.Error("Failed to load the node ID, using the host name %q: %v", host, err)
+		return host
+	}
+	nodeIDs.byFile[path] = id
+	return id
+}
+
+// loadNodeID reads the node ID from path, or generates one (the host name
+// with a random suffix) and writes it there if the file doesn't exist
+func loadNodeID(path, host string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if id := strings.TrimSpace(string(b)); id != "" {
+			return id, nil
+		}
+		return "", fmt.Errorf("%v is empty", path)
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("Failed to generate a node ID: %v", err)
+	}
+	id := hex.EncodeToString(suffix)
+	if host != "" {
+		id = host + "-" + id
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0644); err != nil {
+		return "", err
+	}
+	log4go.Info("Generated node ID %v, kept in %v", id, path)
+	return id, nil
+}
@@ -0,0 +1,55 @@
+package walker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNodeID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "walker-node")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	origFetcher, origCassandra := Config.Fetcher, Config.Cassandra
+	defer func() {
+		Config.Fetcher, Config.Cassandra = origFetcher, origCassandra
+	}()
+
+	host, _ := os.Hostname()
+	if id := NodeID(); id != host {
+		t.Errorf("Expected the host name %q as node ID by default, got %q", host, id)
+	}
+
+	// A generated ID is kept in the file, and read back from it
+	path := filepath.Join(dir, "state", "node-id")
+	Config.Fetcher.NodeIDFile = path
+	id := NodeID()
+	if !strings.HasPrefix(id, host+"-") {
+		t.Errorf("Expected a node ID generated from the host name, got %q", id)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(b)) != id {
+		t.Errorf("Expected %q kept in %v, got %q (%v)", id, path, b, err)
+	}
+	if again, err := loadNodeID(path, host); err != nil || again != id {
+		t.Errorf("Expected %q read back from %v, got %q (%v)", id, path, again, err)
+	}
+
+	other := filepath.Join(dir, "other-id")
+	if err := ioutil.WriteFile(other, []byte("fetcher-7\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	Config.Fetcher.NodeIDFile = other
+	if id := NodeID(); id != "fetcher-7" {
+		t.Errorf("Expected the node ID from %v, got %q", other, id)
+	}
+
+	Config.Cassandra.ClaimNodeID = "override"
+	if id := NodeID(); id != "override" {
+		t.Errorf("Expected cassandra.claim_node_id to override the node ID, got %q", id)
+	}
+}
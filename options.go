@@ -0,0 +1,143 @@
+package walker
+
+import (
+	"fmt"
+	"net/http"
+
+	"code.google.com/p/log4go"
+)
+
+// Programs embedding walker create their FetchManager with NewFetchManager,
+// configuring it with Options:
+//
+//	fm, err := walker.NewFetchManager(
+//		walker.WithConfigFile("walker.yaml"),
+//		walker.WithDatastore(ds),
+//		walker.WithHandler(indexer),
+//		walker.WithHandler(archiver),
+//	)
+//	if err != nil {
+//		...
+//	}
+//	go fm.Start()
+//
+// Setting FetchManager fields directly still works, but new settings are
+// only added as Options.
+
+// Option configures a FetchManager created by NewFetchManager
+type Option func(fm *FetchManager) error
+
+// NewFetchManager returns a FetchManager configured by opts, which are
+// applied in order. It must be given a Datastore and at least one Handler.
+func NewFetchManager(opts ...Option) (*FetchManager, error) {
+	fm := &FetchManager{}
+	for _, opt := range opts {
+		if err := opt(fm); err != nil {
+			return nil, err
+		}
+	}
+	if fm.Datastore == nil {
+		return nil, fmt.Errorf("Cannot create a FetchManager without a datastore")
+	}
+	if fm.Handler == nil {
+		return nil, fmt.Errorf("Cannot create a FetchManager without a handler")
+	}
+	return fm, nil
+}
+
+// WithDatastore sets the Datastore that drives the fetching
+func WithDatastore(ds Datastore) Option {
+	return func(fm *FetchManager) error {
+		if ds == nil {
+			return fmt.Errorf("WithDatastore given a nil datastore")
+		}
+		fm.Datastore = ds
+		return nil
+	}
+}
+
+// WithHandler adds h to the handlers fetch results are given to. Given more
+// than once, the handlers are chained, and called in the order given (see
+// ChainHandlers).
+func WithHandler(h Handler) Option {
+	return func(fm *FetchManager) error {
+		if h == nil {
+			return fmt.Errorf("WithHandler given a nil handler")
+		}
+		switch current := fm.Handler.(type) {
+		case nil:
+			fm.Handler = h
+		case handlerChain:
+			fm.Handler = append(current[:len(current):len(current)], h)
+		default:
+			fm.Handler = ChainHandlers(current, h)
+		}
+		return nil
+	}
+}
+
+// WithFilteredHandler is WithHandler, but h is only given fetch results whose
+// Content-Type matches one of mediaTypes (see FilterHandler)
+func WithFilteredHandler(h Handler, mediaTypes ...string) Option {
+	return func(fm *FetchManager) error {
+		if h == nil {
+			return fmt.Errorf("WithFilteredHandler given a nil handler")
+		}
+		filtered, err := FilterHandler(h, mediaTypes...)
+		if err != nil {
+			return err
+		}
+		return WithHandler(filtered)(fm)
+	}
+}
+
+// WithTransport sets the http.RoundTripper fetches are made with, instead of
+// the transport the FetchManager creates from the fetcher config
+func WithTransport(t http.RoundTripper) Option {
+	return func(fm *FetchManager) error {
+		fm.Transport = t
+		return nil
+	}
+}
+
+// WithLogger makes l the logger walker logs to. Walker logs through log4go's
+// global logger, so this replaces it for the whole process.
+func WithLogger(l log4go.Logger) Option {
+	return func(fm *FetchManager) error {
+		if l == nil {
+			return fmt.Errorf("WithLogger given a nil logger")
+		}
+		log4go.Global = l
+		return nil
+	}
+}
+
+// WithMetrics sets a Metrics the FetchManager counts its fetches in
+func WithMetrics(m Metrics) Option {
+	return func(fm *FetchManager) error {
+		fm.metrics = m
+		return nil
+	}
+}
+
+// WithConfigFile reads the walker config from path (see ReadConfigFile)
+func WithConfigFile(path string) Option {
+	return func(fm *FetchManager) error {
+		return ReadConfigFile(path)
+	}
+}
+
+// WithConfig sets the walker config to cfg, if it is valid. Like the config
+// read from a file, it applies to the whole process.
+func WithConfig(cfg *ConfigStruct) Option {
+	return func(fm *FetchManager) error {
+		prev := Config
+		Config = *cfg
+		if err := assertConfigInvariants(); err != nil {
+			Config = prev
+			return err
+		}
+		PostConfigHooks()
+		return nil
+	}
+}
@@ -0,0 +1,187 @@
+package walker
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type bodyHandler struct {
+	bodies []string
+	err    error
+}
+
+func (h *bodyHandler) HandleResponse(fr *FetchResults) {
+	h.HandleFetch(fr)
+}
+
+func (h *bodyHandler) HandleFetch(fr *FetchResults) error {
+	b, _ := ioutil.ReadAll(fr.Response.Body)
+	h.bodies = append(h.bodies, string(b))
+	return h.err
+}
+
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (m *countingMetrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	m.counts[name] += delta
+	m.mu.Unlock()
+}
+
+func TestNewFetchManager(t *testing.T) {
+	ds := &MockDatastore{}
+	h := &bodyHandler{}
+	if _, err := NewFetchManager(WithHandler(h)); err == nil {
+		t.Error("Expected an error creating a FetchManager without a datastore")
+	}
+	if _, err := NewFetchManager(WithDatastore(ds)); err == nil {
+		t.Error("Expected an error creating a FetchManager without a handler")
+	}
+	if _, err := NewFetchManager(WithDatastore(nil)); err == nil {
+		t.Error("Expected an error from WithDatastore(nil)")
+	}
+
+	transport := &http.Transport{}
+	fm, err := NewFetchManager(WithDatastore(ds), WithHandler(h), WithTransport(transport))
+	if err != nil {
+		t.Fatalf("Failed to create FetchManager: %v", err)
+	}
+	if fm.Datastore != ds || fm.Handler != h || fm.Transport != transport {
+		t.Errorf("FetchManager not configured as given: %+v", fm)
+	}
+}
+
+func TestChainHandlers(t *testing.T) {
+	first := &bodyHandler{err: errors.New("first failed")}
+	second := &bodyHandler{err: errors.New("second failed")}
+	third := &bodyHandler{}
+	fm, err := NewFetchManager(WithDatastore(&MockDatastore{}),
+		WithHandler(first), WithHandler(second), WithHandler(third))
+	if err != nil {
+		t.Fatalf("Failed to create FetchManager: %v", err)
+	}
+
+	fr := &FetchResults{
+		URL:      MustParse("http://test.com/page.html"),
+		Response: &http.Response{StatusCode: 200, Body: ioutil.NopCloser(strings.NewReader("page"))},
+	}
+	err = fm.Handler.(HandlerV2).HandleFetch(fr)
+	if err == nil || err.Error() != "first failed" {
+		t.Errorf("Expected the first handler's error, got %v", err)
+	}
+	for i, h := range []*bodyHandler{first, second, third} {
+		if len(h.bodies) != 1 || h.bodies[0] != "page" {
+			t.Errorf("Expected handler %d to read the whole body once, got %q", i, h.bodies)
+		}
+	}
+}
+
+func TestWithConfig(t *testing.T) {
+	defer func() {
+		// Reset config for the remaining tests
+		LoadTestConfig("test-walker.yaml")
+	}()
+
+	cfg := Config
+	cfg.Dispatcher.MaxLinksPerSegment = 0
+	if _, err := NewFetchManager(WithConfig(&cfg)); err == nil {
+		t.Error("Expected an error from WithConfig given a bad config")
+	}
+	if Config.Dispatcher.MaxLinksPerSegment == 0 {
+		t.Error("Expected a bad config to be left unapplied")
+	}
+
+	cfg.Dispatcher.MaxLinksPerSegment = 500
+	cfg.Fetcher.NumSimultaneousFetchers = 3
+	if _, err := NewFetchManager(WithConfig(&cfg)); err == nil {
+		t.Error("Expected an error creating a FetchManager without a datastore")
+	}
+	if Config.Fetcher.NumSimultaneousFetchers != 3 {
+		t.Errorf("Expected WithConfig to apply the config, got %d fetchers",
+			Config.Fetcher.NumSimultaneousFetchers)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := &countingMetrics{counts: map[string]int64{}}
+	r := newCrawlReporter(m)
+	r.claimed("test.com")
+	r.claimed("test.com")
+	r.add("test.com", &FetchResults{
+		URL:         MustParse("http://test.com/page.html"),
+		Response:    &http.Response{StatusCode: 200, Header: http.Header{}},
+		ContentSize: 100,
+	})
+	r.add("test.com", &FetchResults{URL: MustParse("http://test.com/gone.html"), FetchError: errors.New("refused")})
+	r.dohLookup(20*time.Millisecond, nil, true)
+	r.dohLookup(40*time.Millisecond, &net.DNSError{Err: "no such host", Name: "gone.com"}, true)
+	r.dohLookup(60*time.Millisecond, errors.New("resolver down"), true)
+
+	expected := map[string]int64{
+		MetricDomains:        1,
+		MetricLinksRequested: 2,
+		MetricLinksFetched:   1,
+		MetricBytes:          100,
+		MetricFetchErrors:    1,
+		MetricDoHLookups:     3,
+		MetricDoHFailures:    1,
+		MetricDoHFallbacks:   1,
+		MetricDoHMillis:      120,
+	}
+	for name, n := range expected {
+		if m.counts[name] != n {
+			t.Errorf("Expected %v to be %d, got %d", name, n, m.counts[name])
+		}
+	}
+	dns := r.report().DNS
+	if dns.DoHLookups != 3 || dns.DoHFailures != 1 || dns.DoHMeanMillis != 40 || dns.DoHMaxMillis != 60 {
+		t.Errorf("Unexpected DNS report %+v", dns)
+	}
+}
+
+func TestFilterHandler(t *testing.T) {
+	pages := &bodyHandler{}
+	images := &bodyHandler{err: errors.New("images failed")}
+	fm, err := NewFetchManager(WithDatastore(&MockDatastore{}),
+		WithFilteredHandler(pages, "text/html"), WithFilteredHandler(images, "image/*"))
+	if err != nil {
+		t.Fatalf("Failed to create FetchManager: %v", err)
+	}
+	if _, err := FilterHandler(pages, "text html"); err == nil {
+		t.Error("Expected an error from FilterHandler given a bad media type")
+	}
+
+	response := func(status int, ctype string) *FetchResults {
+		res := &http.Response{StatusCode: status, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(ctype))}
+		if ctype != "" {
+			res.Header.Set("Content-Type", ctype)
+		}
+		return &FetchResults{URL: MustParse("http://test.com/"), Response: res}
+	}
+	handler := fm.Handler.(HandlerV2)
+	if err := handler.HandleFetch(response(200, "text/html; charset=utf-8")); err != nil {
+		t.Errorf("Expected only the page handler to be given a page, got error %v", err)
+	}
+	if err := handler.HandleFetch(response(200, "image/png")); err == nil {
+		t.Error("Expected the image handler to be given an image")
+	}
+	handler.HandleFetch(response(200, "application/octet-stream"))
+	handler.HandleFetch(response(304, ""))
+
+	if expected := []string{"text/html; charset=utf-8", ""}; !reflect.DeepEqual(pages.bodies, expected) {
+		t.Errorf("Expected the page handler to get %q, got %q", expected, pages.bodies)
+	}
+	if expected := []string{"image/png", ""}; !reflect.DeepEqual(images.bodies, expected) {
+		t.Errorf("Expected the image handler to get %q, got %q", expected, images.bodies)
+	}
+}
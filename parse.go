@@ -3,11 +3,15 @@ package walker
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"code.google.com/p/go.net/html"
 	"code.google.com/p/go.net/html/charset"
@@ -17,11 +21,25 @@ import (
 // parseLinks tries to parse the http response in the given FetchResults for
 // links and stores them in the datastore.
 func (f *fetcher) parseLinks(body []byte, fr *FetchResults) {
-	outlinks, noindex, nofollow, err := parseHTML(body)
+	if max := Config.Fetcher.MaxParseBytes; max > 0 && int64(len(body)) > max {
+		log4go.Debug("Only parsing the first %v of %v bytes of %v (max_parse_bytes)", max, len(body), fr.URL)
+		body = body[:max]
+	}
+
+	var deadline time.Time
+	if f.parseTimeout > 0 {
+		deadline = time.Now().Add(f.parseTimeout)
+	}
+	outlinks, noindex, nofollow, rels, directives, scriptLinks, err := parseHTML(body, deadline)
 	if err != nil {
 		log4go.Debug("error parsing HTML for page %v: %v", fr.URL, err)
-		return
+		fr.ParseError = err
+		if _, ok := err.(*tokenizerError); !ok {
+			// A page that timed out or crashed the parser is not trusted at all
+			return
+		}
 	}
+	directives.applyTo(fr)
 
 	if noindex {
 		fr.MetaNoIndex = true
@@ -32,13 +50,189 @@ func (f *fetcher) parseLinks(body []byte, fr *FetchResults) {
 		log4go.Fine("Page has nofollow meta tag: %v", fr.URL)
 	}
 
+	for _, u := range []*URL{rels.amp, rels.mobile, rels.canonical} {
+		if u != nil {
+			u.MakeAbsolute(fr.URL)
+		}
+	}
+	fr.AMPURL = rels.amp
+	fr.MobileURL = rels.mobile
+	fr.CanonicalURL = rels.canonical
+	if rels.revisit > 0 && Config.Fetcher.RefreshHints {
+		fr.RefreshHint = rels.revisit
+	}
+
+	// Follow the pagination chain as long as it's within the depth budget.
+	// Anchors that duplicate the next link are dropped so only the copy
+	// carrying ChainPos gets stored.
+	var next *URL
+	var nextLink string
+	if rels.next != nil && !nofollow {
+		rels.next.MakeAbsolute(fr.URL)
+		if fr.URL.ChainPos == 0 {
+			fr.URL.ChainPos = 1
+		}
+		rels.next.ChainPos = fr.URL.ChainPos + 1
+		nextLink = rels.next.String()
+		if Config.Fetcher.MaxPaginationDepth <= 0 || rels.next.ChainPos <= Config.Fetcher.MaxPaginationDepth {
+			next = rels.next
+			outlinks = append(outlinks, next)
+		} else {
+			log4go.Fine("Pagination chain at %v exceeds max_pagination_depth, not storing %v", fr.URL, nextLink)
+		}
+	}
+
+	if !nofollow {
+		outlinks = append(outlinks, sameDomainLinks(scriptLinks, fr.URL)...)
+	}
+
+	switch strings.ToLower(Config.Fetcher.AlternatePolicy) {
+	case "both":
+		if !nofollow {
+			for _, u := range []*URL{rels.amp, rels.mobile} {
+				if u != nil {
+					outlinks = append(outlinks, u)
+				}
+			}
+		}
+	case "canonical":
+		if rels.isAMP && rels.canonical != nil && rels.canonical.String() != fr.URL.String() {
+			// The canonical page carries the same links, so only queue it
+			log4go.Fine("AMP page %v has canonical %v, not storing its other links", fr.URL, rels.canonical)
+			outlinks = []*URL{rels.canonical}
+		}
+	}
+
+	var links []*URL
 	for _, outlink := range outlinks {
 		outlink.MakeAbsolute(fr.URL)
+		if nextLink != "" && outlink != next && outlink.String() == nextLink {
+			continue
+		}
+		links = append(links, outlink)
+	}
+	f.storeParsedLinks(links, fr)
+}
+
+// storeParsedLinks expands links to redirector hosts and passes the ones
+// allowed by shouldStoreParsedLink to the datastore. The links must already be
+// absolute.
+func (f *fetcher) storeParsedLinks(outlinks []*URL, fr *FetchResults) {
+	for _, outlink := range outlinks {
+		if f.isRedirector(outlink.URL) {
+			if exp := f.expandRedirector(outlink); exp != nil {
+				log4go.Fine("Expanded redirector link %v -> %v", outlink, exp)
+				fr.ExpandedLinks = append(fr.ExpandedLinks, LinkExpansion{From: outlink, To: exp})
+				outlink = exp
+			}
+		}
+		outlink.Depth = fr.URL.Depth + 1
+		countOutlinkDomain(fr, outlink)
 		if f.shouldStoreParsedLink(outlink) {
 			log4go.Fine("Storing parsed link: %v", outlink)
 			f.fm.Datastore.StoreParsedURL(outlink, fr)
+			f.recordOutlink(outlink)
+		}
+	}
+}
+
+// maxOutlinkDomains caps the domains counted in FetchResults.OutlinkDomains,
+// so a link farm page doesn't bloat its fetch results
+const maxOutlinkDomains = 1000
+
+// countOutlinkDomain counts outlink in fr.OutlinkDomains if it is an http(s)
+// link to a domain other than the page's
+func countOutlinkDomain(fr *FetchResults, outlink *URL) {
+	if outlink.Scheme != "http" && outlink.Scheme != "https" {
+		return
+	}
+	dom, err := outlink.ToplevelDomainPlusOne()
+	if err != nil {
+		return
+	}
+	if own, err := fr.URL.ToplevelDomainPlusOne(); err != nil || dom == own {
+		return
+	}
+	if _, ok := fr.OutlinkDomains[dom]; !ok {
+		if len(fr.OutlinkDomains) >= maxOutlinkDomains {
+			return
+		}
+		if fr.OutlinkDomains == nil {
+			fr.OutlinkDomains = map[string]int{}
+		}
+	}
+	fr.OutlinkDomains[dom]++
+}
+
+// redirectorCacheSize is how many expanded redirector links each fetcher
+// remembers, so a short link on every page of a site is only expanded once
+const redirectorCacheSize = 10000
+
+// isRedirector returns true if u is on one of fetcher.redirector_hosts
+func (f *fetcher) isRedirector(u *url.URL) bool {
+	return f.redirectorHosts[strings.ToLower(u.Host)]
+}
+
+// expandRedirector resolves a link to one of fetcher.redirector_hosts by
+// following its redirects with HEAD requests while they stay on redirector
+// hosts, at most fetcher.max_redirector_hops of them. It returns the last URL
+// redirected to, or nil if the link could not be resolved. Expansions
+// (failed ones included) are cached.
+func (f *fetcher) expandRedirector(u *URL) *URL {
+	key := u.String()
+	if f.redirectorCache != nil {
+		if exp, ok := f.redirectorCache.Get(key); ok {
+			return exp.(*URL)
 		}
 	}
+	exp := f.resolveRedirector(u)
+	if f.redirectorCache != nil {
+		f.redirectorCache.Add(key, exp)
+	}
+	return exp
+}
+
+// resolveRedirector does the requests of expandRedirector. Each hop is
+// recorded, but only hops to redirector hosts are followed: any other host is
+// never requested, as its robots.txt, crawl delay and IP haven't been checked
+// (it is crawled like any other link once stored).
+func (f *fetcher) resolveRedirector(u *URL) *URL {
+	req, err := http.NewRequest("HEAD", u.String(), nil)
+	if err != nil {
+		log4go.Debug("Failed to create HEAD request for %v: %v", u, err)
+		return nil
+	}
+	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
+
+	var last *url.URL
+	client := *f.redirectorClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		last = req.URL
+		if len(via) >= Config.Fetcher.MaxRedirectorHops || !f.isRedirector(req.URL) {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+
+	res, err := client.Do(req)
+	if res != nil {
+		res.Body.Close()
+	}
+	if err != nil {
+		// We may still know where the link leads if an intermediate or
+		// final hop failed
+		log4go.Debug("Error expanding redirector link %v: %v", u, err)
+	}
+	if last == nil {
+		return nil
+	}
+
+	exp, err := ParseAndNormalizeURL(last.String())
+	if err != nil {
+		log4go.Debug("Failed to parse expanded link %v (from %v): %v", last, u, err)
+		return nil
+	}
+	return exp
 }
 
 // getIncludedTags gets a map of tags we should check for outlinks. It uses
@@ -62,38 +256,123 @@ func getIncludedTags() map[string]bool {
 	}
 
 	tags["meta"] = true
+
+	// html and link tags are only read for AMP, mobile and canonical
+	// relationships (see pageRels), never for outlinks
+	tags["html"] = true
+	tags["link"] = true
 	return tags
 }
 
-// parseHTML processes the html stored in content.
+// pageRels holds the alternate versions of a page declared by its <link> tags,
+// whether the page itself is an AMP page, and how often it says to revisit it.
+type pageRels struct {
+	// <link rel="amphtml" href="...">
+	amp *URL
+
+	// <link rel="alternate" media="only screen and (max-width: 640px)" href="...">
+	mobile *URL
+
+	// <link rel="canonical" href="...">
+	canonical *URL
+
+	// true if the page was marked <html amp> or <html ⚡>
+	isAMP bool
+
+	// <link rel="next" href="..."> or <a rel="next" href="...">
+	next *URL
+
+	// <meta name="revisit-after" content="7 days">, 0 if not given
+	revisit time.Duration
+}
+
+// errParseTimeout is returned by parseHTML when it runs past its deadline
+var errParseTimeout = fmt.Errorf("Exceeded parse_timeout")
+
+// tokenizerError is returned by parseHTML when the tokenizer fails before the
+// end of the page. What was parsed up to that point is returned with it.
+type tokenizerError struct {
+	err error
+}
+
+func (e *tokenizerError) Error() string {
+	return fmt.Sprintf("HTML tokenizer failed: %v", e.err)
+}
+
+// htmlReader returns the UTF-8 reader parseHTML tokenizes body from,
+// charset.NewReader unless testing
+var htmlReader = func(body []byte) (io.Reader, error) {
+	return charset.NewReader(bytes.NewReader(body), "text/html")
+}
+
+// parseDeadlineCheckTokens is how many tokens parseHTML reads between checks
+// of its deadline
+const parseDeadlineCheckTokens = 256
+
+// parseHTML processes the html stored in content, giving up with
+// errParseTimeout if it is still going at deadline (unless deadline is zero).
+// A panic in the tokenizer is recovered and returned as an error, as is any
+// tokenizer error other than reaching the end of body (a *tokenizerError,
+// returned along with everything found before it).
 // It returns:
 //     (a) a list of `links` on the page
 //     (b) a boolean metaNoindex to note if <meta name="ROBOTS" content="noindex"> was found
 //     (c) a boolean metaNofollow indicating if <meta name="ROBOTS" content="nofollow"> was found
-func parseHTML(body []byte) (links []*URL, metaNoindex bool, metaNofollow bool, err error) {
-	utf8Reader, err := charset.NewReader(bytes.NewReader(body), "text/html")
+//     (d) the AMP, mobile, canonical and pagination relationships declared by the page, and its revisit-after
+//     (e) the noai, noimageai, nosnippet and max-snippet robots <meta> directives
+//     (f) absolute URLs found in inline scripts, if fetcher.parse_script_links is set
+func parseHTML(body []byte, deadline time.Time) (links []*URL, metaNoindex bool, metaNofollow bool, rels pageRels,
+	directives robotsDirectives, scriptLinks []*URL, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("HTML parser panicked: %v", r)
+		}
+	}()
+
+	utf8Reader, err := htmlReader(body)
 	if err != nil {
 		return
 	}
 	tokenizer := html.NewTokenizer(utf8Reader)
 
 	tags := getIncludedTags()
+	parseScripts := Config.Fetcher.ParseScriptLinks
+	inScript := false
+
+	for tokens := 1; ; tokens++ {
+		if tokens%parseDeadlineCheckTokens == 0 && !deadline.IsZero() && time.Now().After(deadline) {
+			err = errParseTimeout
+			return
+		}
 
-	for {
 		tokenType := tokenizer.Next()
 		switch tokenType {
 		case html.ErrorToken:
-			//TODO: should use tokenizer.Err() to see if this is io.EOF
-			//      (meaning success) or an actual error
+			// io.EOF just means we reached the end of the document; anything
+			// else is a real failure to parse it
+			if tErr := tokenizer.Err(); tErr != io.EOF {
+				err = &tokenizerError{tErr}
+			}
 			return
+		case html.TextToken:
+			if inScript {
+				scriptLinks = parseScriptLinks(tokenizer.Text(), scriptLinks)
+			}
+		case html.EndTagToken:
+			inScript = false
 		case html.StartTagToken, html.SelfClosingTagToken:
 			tagNameB, hasAttrs := tokenizer.TagName()
 			tagName := string(tagNameB)
+			inScript = parseScripts && tagName == "script" && tokenType == html.StartTagToken
 			if hasAttrs && tags[tagName] {
 				switch tagName {
 				case "a":
 					if !metaNofollow {
-						links = parseAnchorAttrs(tokenizer, links)
+						var next *URL
+						links, next = parseAnchorAttrs(tokenizer, links)
+						if rels.next == nil {
+							rels.next = next
+						}
 					}
 
 				case "embed":
@@ -101,15 +380,30 @@ func parseHTML(body []byte) (links []*URL, metaNoindex bool, metaNofollow bool,
 						links = parseObjectOrEmbed(tokenizer, links, true)
 					}
 
+				case "html":
+					rels.isAMP = parseHTMLAttrs(tokenizer)
+
 				case "iframe":
-					links = parseIframe(tokenizer, links, metaNofollow)
+					links, err = parseIframe(tokenizer, links, metaNofollow, deadline)
+					if err != nil {
+						return
+					}
+
+				case "link":
+					rels = parseLinkAttrs(tokenizer, rels)
 
 				case "meta":
 					var isRobots, index, follow bool
-					links, isRobots, index, follow = parseMetaAttrs(tokenizer, links)
+					var d robotsDirectives
+					var revisit time.Duration
+					links, isRobots, index, follow, d, revisit = parseMetaAttrs(tokenizer, links)
+					if revisit > 0 && rels.revisit == 0 {
+						rels.revisit = revisit
+					}
 					if isRobots {
 						metaNoindex = metaNoindex || index
 						metaNofollow = metaNofollow || follow
+						directives = directives.merge(d)
 					}
 
 				case "object":
@@ -123,6 +417,49 @@ func parseHTML(body []byte) (links []*URL, metaNoindex bool, metaNofollow bool,
 	}
 }
 
+// scriptURLRegex matches quoted absolute http(s) URLs, allowing the escaped
+// slashes of JSON ("http:\/\/..."). Literals with template placeholders or
+// that are only a prefix of a concatenation don't match.
+var scriptURLRegex = regexp.MustCompile(`["'\x60](https?:(?:\\?/){2}(?:[^"'\x60\s<>{}\\]|\\/)+)["'\x60]`)
+
+// parseScriptLinks appends the absolute URLs found in string literals of
+// script to links.
+func parseScriptLinks(script []byte, links []*URL) []*URL {
+	for _, m := range scriptURLRegex.FindAllSubmatch(script, -1) {
+		link := strings.Replace(string(m[1]), `\/`, "/", -1)
+		u, err := ParseAndNormalizeURL(link)
+		if err != nil {
+			log4go.Fine("Failed to parse script link %q: %v", link, err)
+			continue
+		}
+		links = append(links, u)
+	}
+	return links
+}
+
+// sameDomainLinks returns the links with the same TLD+1 as page, without
+// duplicates
+func sameDomainLinks(links []*URL, page *URL) []*URL {
+	if len(links) == 0 {
+		return nil
+	}
+	dom, err := page.ToplevelDomainPlusOne()
+	if err != nil {
+		return nil
+	}
+	var same []*URL
+	seen := map[string]bool{}
+	for _, u := range links {
+		ldom, err := u.ToplevelDomainPlusOne()
+		if err != nil || ldom != dom || seen[u.String()] {
+			continue
+		}
+		seen[u.String()] = true
+		same = append(same, u)
+	}
+	return same
+}
+
 func parseObjectOrEmbed(tokenizer *html.Tokenizer, links []*URL, isEmbed bool) []*URL {
 	var ln *URL
 	var err error
@@ -145,12 +482,16 @@ func parseObjectOrEmbed(tokenizer *html.Tokenizer, links []*URL, isEmbed bool) [
 	return links
 }
 
-// parseIframe takes 3 arguments
+// parseIframe takes 4 arguments
 // (a) tokenizer
 // (b) list of links already collected
 // (c) a flag indicating if the parser is currently in a nofollow state
-// and returns a possibly extended list of links.
-func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool) (links []*URL) {
+// (d) the deadline of the enclosing parseHTML
+// and returns a possibly extended list of links. The only error returned is
+// errParseTimeout from parsing a srcdoc, which should stop the enclosing parse
+// too.
+func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool,
+	deadline time.Time) (links []*URL, fatal error) {
 	links = inLinks
 	docsrc, body, err := parseIframeAttrs(tokenizer)
 	if err != nil {
@@ -158,8 +499,11 @@ func parseIframe(tokenizer *html.Tokenizer, inLinks []*URL, metaNofollow bool) (
 	} else if docsrc {
 		var nlinks []*URL
 		var nNofollow bool
-		nlinks, _, nNofollow, err = parseHTML([]byte(body))
-		if err != nil {
+		nlinks, _, nNofollow, _, _, _, err = parseHTML([]byte(body), deadline)
+		if err == errParseTimeout {
+			fatal = err
+			return
+		} else if err != nil {
 			log4go.Error("parseEmbed failed to parse docsrc: %v", err)
 			return
 		}
@@ -193,15 +537,241 @@ var srcdocWordBytes = []byte("srcdoc")
 var httpEquivWordBytes = []byte("http-equiv")
 var refreshWordBytes = []byte("refresh")
 var metaRefreshPattern = regexp.MustCompile(`^\s*\d+;\s*url=(.*)`)
+var ampWordBytes = []byte("amp")
+var ampBoltWordBytes = []byte("\u26a1")
+var relWordBytes = []byte("rel")
+var hrefWordBytes = []byte("href")
+var mediaWordBytes = []byte("media")
+var mobileMediaPattern = regexp.MustCompile(`max-(device-)?width|handheld`)
+var revisitAfterWordBytes = []byte("revisit-after")
+var revisitAfterPattern = regexp.MustCompile(`^\s*(\d+)\s*(hour|day|week|month|year)?`)
+
+// revisitUnits are the lengths of the units a revisit-after can be given in
+var revisitUnits = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"year":  365 * 24 * time.Hour,
+}
+
+// parseRevisitAfter parses the (lowercased) content of a revisit-after
+// <meta>, ex. "7 days" or "2 weeks"; a bare number is in days. It returns 0 if
+// content doesn't parse.
+func parseRevisitAfter(content string) time.Duration {
+	m := revisitAfterPattern.FindStringSubmatch(content)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil || n <= 0 || n > 3650 {
+		return 0
+	}
+	unit := revisitUnits[m[2]]
+	if unit == 0 {
+		unit = revisitUnits["day"]
+	}
+	return time.Duration(n) * unit
+}
+
+// robotsDirectives holds the usage directives (as opposed to the indexing
+// ones, noindex and nofollow) from a robots <meta> tag or X-Robots-Tag header.
+type robotsDirectives struct {
+	noai, noimageai, nosnippet bool
+
+	// 0 means no limit
+	maxSnippet int
+}
+
+// parseRobotsDirectives parses a comma separated list of robots directives,
+// ex. "noai, max-snippet:50". Unknown directives are ignored.
+func parseRobotsDirectives(content string) (d robotsDirectives) {
+	for _, dir := range strings.Split(strings.ToLower(content), ",") {
+		dir = strings.TrimSpace(dir)
+		switch {
+		case dir == "noai":
+			d.noai = true
+		case dir == "noimageai":
+			d.noimageai = true
+		case dir == "nosnippet":
+			d.nosnippet = true
+		case strings.HasPrefix(dir, "max-snippet:"):
+			n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(dir, "max-snippet:")))
+			if err != nil {
+				log4go.Debug("Failed to parse robots directive %q: %v", dir, err)
+			} else if n == 0 {
+				d.nosnippet = true
+			} else if n > 0 {
+				d.maxSnippet = n
+			}
+		}
+	}
+	return
+}
+
+// merge combines two sets of directives, keeping the most restrictive of each
+func (d robotsDirectives) merge(o robotsDirectives) robotsDirectives {
+	d.noai = d.noai || o.noai
+	d.noimageai = d.noimageai || o.noimageai
+	d.nosnippet = d.nosnippet || o.nosnippet
+	if d.maxSnippet == 0 || (o.maxSnippet > 0 && o.maxSnippet < d.maxSnippet) {
+		d.maxSnippet = o.maxSnippet
+	}
+	return d
+}
+
+// applyTo merges the directives into those already set on fr
+func (d robotsDirectives) applyTo(fr *FetchResults) {
+	d = d.merge(robotsDirectives{
+		noai:       fr.MetaNoAI,
+		noimageai:  fr.MetaNoImageAI,
+		nosnippet:  fr.MetaNoSnippet,
+		maxSnippet: fr.MetaMaxSnippet,
+	})
+	fr.MetaNoAI = d.noai
+	fr.MetaNoImageAI = d.noimageai
+	fr.MetaNoSnippet = d.nosnippet
+	fr.MetaMaxSnippet = d.maxSnippet
+}
+
+// parseCacheHeaders returns the cache lifetime declared by a response's
+// Cache-Control and Expires headers: the max-age in seconds, or else the
+// Expires time. max-age takes precedence over Expires, and no-cache or
+// no-store cancels both.
+func parseCacheHeaders(h http.Header) (maxAge int, expires time.Time) {
+	hasMaxAge := false
+	for _, v := range h[http.CanonicalHeaderKey("Cache-Control")] {
+		for _, dir := range strings.Split(strings.ToLower(v), ",") {
+			dir = strings.TrimSpace(dir)
+			switch {
+			case dir == "no-cache" || dir == "no-store":
+				return 0, time.Time{}
+			case strings.HasPrefix(dir, "max-age="):
+				n, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(dir, "max-age="), `"`))
+				if err != nil || n < 0 {
+					log4go.Debug("Failed to parse Cache-Control directive %q", dir)
+				} else if !hasMaxAge || n < maxAge {
+					maxAge = n
+					hasMaxAge = true
+				}
+			}
+		}
+	}
+	if hasMaxAge {
+		return
+	}
+
+	// Invalid dates (ex. "0" or "-1") mean already expired, so are ignored
+	if t, err := http.ParseTime(h.Get("Expires")); err == nil {
+		expires = t
+	}
+	return
+}
+
+// parseRetryAfter returns when a response fetched at fetchTime asked to be
+// retried, from its Retry-After header (either a number of seconds or an HTTP
+// date), or zero if it didn't say. A delay longer than max (if > 0) is cut to
+// max.
+func parseRetryAfter(h http.Header, fetchTime time.Time, max time.Duration) time.Time {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return time.Time{}
+	}
+	var at time.Time
+	if n, err := strconv.Atoi(v); err == nil {
+		if n <= 0 {
+			return time.Time{}
+		}
+		at = fetchTime.Add(time.Duration(n) * time.Second)
+	} else if t, err := http.ParseTime(v); err == nil {
+		if !t.After(fetchTime) {
+			return time.Time{}
+		}
+		at = t
+	} else {
+		log4go.Debug("Failed to parse Retry-After %q", v)
+		return time.Time{}
+	}
+	if max > 0 && at.Sub(fetchTime) > max {
+		at = fetchTime.Add(max)
+	}
+	return at
+}
+
+// parseHTMLAttrs returns true if the <html> tag marks the page as AMP
+func parseHTMLAttrs(tokenizer *html.Tokenizer) bool {
+	for {
+		key, _, moreAttr := tokenizer.TagAttr()
+		if bytes.Compare(key, ampWordBytes) == 0 || bytes.Compare(key, ampBoltWordBytes) == 0 {
+			return true
+		}
+		if !moreAttr {
+			return false
+		}
+	}
+}
+
+// parseLinkAttrs fills in rels from a <link> tag declaring an AMP, mobile or
+// canonical version of the page, or the next page of a pagination chain. Only
+// the first of each kind is kept.
+func parseLinkAttrs(tokenizer *html.Tokenizer, rels pageRels) pageRels {
+	var rel, href, media []byte
+	for {
+		key, val, moreAttr := tokenizer.TagAttr()
+		if bytes.Compare(key, relWordBytes) == 0 {
+			rel = bytes.ToLower(val)
+		} else if bytes.Compare(key, hrefWordBytes) == 0 {
+			href = val
+		} else if bytes.Compare(key, mediaWordBytes) == 0 {
+			media = bytes.ToLower(val)
+		}
+		if !moreAttr {
+			break
+		}
+	}
+	if href == nil {
+		return rels
+	}
+
+	for _, r := range strings.Fields(string(rel)) {
+		var dest **URL
+		switch r {
+		case "amphtml":
+			dest = &rels.amp
+		case "next":
+			dest = &rels.next
+		case "canonical":
+			dest = &rels.canonical
+		case "alternate":
+			if mobileMediaPattern.Match(media) {
+				dest = &rels.mobile
+			}
+		}
+		if dest == nil || *dest != nil {
+			continue
+		}
 
-func parseMetaAttrs(tokenizer *html.Tokenizer, in_links []*URL) (links []*URL, isRobots bool, noIndex bool, noFollow bool) {
+		u, err := ParseAndNormalizeURL(strings.TrimSpace(string(href)))
+		if err != nil {
+			log4go.Debug("parseLinkAttrs failed to parse url for %q: %v", href, err)
+			return rels
+		}
+		*dest = u
+	}
+	return rels
+}
+
+func parseMetaAttrs(tokenizer *html.Tokenizer, in_links []*URL) (links []*URL, isRobots bool, noIndex bool,
+	noFollow bool, directives robotsDirectives, revisit time.Duration) {
 	links = in_links
 	var content, httpEquiv []byte
+	var isRevisit bool
 	for {
 		key, val, moreAttr := tokenizer.TagAttr()
 		if bytes.Compare(key, nameWordBytes) == 0 {
 			name := bytes.ToLower(val)
 			isRobots = bytes.Compare(name, robotsWordBytes) == 0
+			isRevisit = bytes.Compare(name, revisitAfterWordBytes) == 0
 		} else if bytes.Compare(key, contentWordBytes) == 0 {
 			content = bytes.ToLower(val)
 			// This will match ill-formatted contents like "noindexnofollow",
@@ -216,6 +786,14 @@ func parseMetaAttrs(tokenizer *html.Tokenizer, in_links []*URL) (links []*URL, i
 		}
 	}
 
+	if isRobots && content != nil {
+		directives = parseRobotsDirectives(string(content))
+	}
+
+	if isRevisit && content != nil {
+		revisit = parseRevisitAfter(string(content))
+	}
+
 	if bytes.Compare(httpEquiv, refreshWordBytes) == 0 && content != nil {
 		results := metaRefreshPattern.FindSubmatch(content)
 		if results != nil {
@@ -293,22 +871,34 @@ func parseIframeAttrs(tokenizer *html.Tokenizer) (srcdoc bool, body string, err
 
 // parseAnchorAttrs iterates over all of the attributes in the current anchor token.
 // If a href is found, it adds the link value to the links slice.
-// Returns the new link slice.
-func parseAnchorAttrs(tokenizer *html.Tokenizer, links []*URL) []*URL {
+// Returns the new link slice, and the link again as next if the anchor is
+// marked rel="next".
+func parseAnchorAttrs(tokenizer *html.Tokenizer, links []*URL) ([]*URL, *URL) {
 	//TODO: rework this to be cleaner, passing in `links` to be appended to
 	//isn't great
+	var u *URL
+	var isNext bool
 	for {
 		key, val, moreAttr := tokenizer.TagAttr()
 		if bytes.Compare(key, []byte("href")) == 0 {
-			u, err := ParseAndNormalizeURL(strings.TrimSpace(string(val)))
+			var err error
+			u, err = ParseAndNormalizeURL(strings.TrimSpace(string(val)))
 			if err == nil {
 				links = append(links, u)
 			}
+		} else if bytes.Compare(key, relWordBytes) == 0 {
+			for _, r := range strings.Fields(string(bytes.ToLower(val))) {
+				isNext = isNext || r == "next"
+			}
 		}
 		if !moreAttr {
-			return links
+			break
 		}
 	}
+	if isNext && u != nil {
+		return links, u.Clone()
+	}
+	return links, nil
 }
 
 // getMimeType attempts to get the mime type (i.e. "Content-Type") from the
@@ -338,6 +928,13 @@ func isHTML(r *http.Response) bool {
 	return false
 }
 
+// parsesPDF returns true if responses of mimeType are parsed as PDFs: it is
+// application/pdf, fetcher.parse_pdf is set and walker was built with the pdf
+// build tag
+func parsesPDF(mimeType string) bool {
+	return pdfSupported && Config.Fetcher.ParsePDF && mimeType == "application/pdf"
+}
+
 var privateNetworks = []*net.IPNet{
 	parseCIDR("10.0.0.0/8"),
 	parseCIDR("192.168.0.0/16"),
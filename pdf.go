@@ -0,0 +1,267 @@
+//go:build pdf
+// +build pdf
+
+package walker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"code.google.com/p/log4go"
+)
+
+// PDF parsing (fetcher.parse_pdf) is only built into walker with the pdf
+// build tag (go build -tags pdf), so binaries that don't crawl PDFs don't
+// carry the parser. Without it, pdf_stub.go stands in and walker refuses to
+// start with parse_pdf set.
+
+// pdfSupported is true if walker was built with the pdf build tag
+const pdfSupported = true
+
+// maxPDFStreamSize caps how much a single compressed PDF stream may inflate
+// to, so a small malicious PDF can't exhaust memory
+const maxPDFStreamSize = 16 * 1024 * 1024
+
+// parsePDFLinks extracts links and text from a PDF, storing the links like
+// parseLinks does for HTML and setting fr.Text.
+func (f *fetcher) parsePDFLinks(body []byte, fr *FetchResults) {
+	links, text := parsePDF(body)
+	fr.Text = text
+
+	var outlinks []*URL
+	for _, link := range links {
+		u, err := ParseAndNormalizeURL(link)
+		if err != nil {
+			log4go.Fine("Failed to parse link %q in PDF %v: %v", link, fr.URL, err)
+			continue
+		}
+		u.MakeAbsolute(fr.URL)
+		outlinks = append(outlinks, u)
+	}
+	f.storeParsedLinks(outlinks, fr)
+}
+
+var pdfStreamRegex = regexp.MustCompile(`stream\r?\n`)
+var pdfURIRegex = regexp.MustCompile(`/URI\s*([(<])`)
+
+// parsePDF returns the link targets (/URI actions) and the text found in a PDF.
+// Only what can be read with the standard library is supported: uncompressed
+// and FlateDecode streams, literal and hex strings, and Tj/TJ text. Text in
+// fonts with custom encodings may come out garbled, and encrypted PDFs yield
+// nothing.
+func parsePDF(body []byte) (links []string, text string) {
+	// Link annotations may be in the objects of the file itself or inside
+	// (compressed) object streams, and text is in content streams. So split
+	// the file into the bytes outside streams and the (inflated) contents of
+	// each stream.
+	var objects []byte
+	var streams [][]byte
+	pos := 0
+	for pos < len(body) {
+		loc := pdfStreamRegex.FindIndex(body[pos:])
+		if loc == nil {
+			break
+		}
+		start := pos + loc[1]
+		end := bytes.Index(body[start:], []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		objects = append(objects, body[pos:pos+loc[0]]...)
+		data := body[start : start+end]
+		if inflated := inflatePDFStream(data); inflated != nil {
+			data = inflated
+		}
+		streams = append(streams, data)
+		pos = start + end + len("endstream")
+	}
+	objects = append(objects, body[pos:]...)
+
+	seen := map[string]bool{}
+	var texts []string
+	for i, chunk := range append([][]byte{objects}, streams...) {
+		for _, loc := range pdfURIRegex.FindAllSubmatchIndex(chunk, -1) {
+			link, _ := readPDFString(chunk, loc[2])
+			link = strings.TrimSpace(link)
+			if link != "" && !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+		if i == 0 {
+			continue
+		}
+		if t := pdfText(chunk); t != "" {
+			texts = append(texts, t)
+		}
+	}
+	return links, strings.Join(texts, "\n")
+}
+
+// inflatePDFStream returns the decompressed contents of a FlateDecode stream,
+// or nil if data isn't one.
+func inflatePDFStream(data []byte) []byte {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(io.LimitReader(r, maxPDFStreamSize))
+	if err != nil && len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// pdfText returns the text shown by the BT ... ET blocks of a content stream,
+// one line per block
+func pdfText(b []byte) string {
+	var lines []string
+	inText := false
+	var line bytes.Buffer
+	for i := 0; i < len(b); {
+		switch c := b[i]; {
+		case (c == '<' || c == '>') && i+1 < len(b) && b[i+1] == c:
+			// Dictionary delimiters
+			i += 2
+		case c == '(' || c == '<':
+			s, next := readPDFString(b, i)
+			if inText {
+				line.WriteString(s)
+			}
+			i = next
+		case isPDFDelimiter(c):
+			i++
+		default:
+			j := i
+			for j < len(b) && !isPDFDelimiter(b[j]) {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			switch string(b[i:j]) {
+			case "BT":
+				inText = true
+				line.Reset()
+			case "ET":
+				if inText && strings.TrimSpace(line.String()) != "" {
+					lines = append(lines, strings.TrimSpace(line.String()))
+				}
+				inText = false
+			case "T*", "Td", "TD", "'", "\"":
+				// Moving to a new line
+				if inText && line.Len() > 0 {
+					line.WriteByte(' ')
+				}
+			}
+			i = j
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isPDFDelimiter returns true for PDF whitespace and delimiter characters
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte(" \t\r\n\f\x00()<>[]{}/%", c) >= 0
+}
+
+// readPDFString decodes the literal ("(...)") or hex ("<...>") string starting
+// at b[i], returning it and the index just after it.
+func readPDFString(b []byte, i int) (string, int) {
+	var raw []byte
+	if b[i] == '<' {
+		end := bytes.IndexByte(b[i:], '>')
+		if end < 0 {
+			return "", len(b)
+		}
+		h := strings.Map(func(r rune) rune {
+			if strings.ContainsRune(" \t\r\n\f", r) {
+				return -1
+			}
+			return r
+		}, string(b[i+1:i+end]))
+		if len(h)%2 == 1 {
+			h += "0"
+		}
+		raw, _ = hex.DecodeString(h)
+		return decodePDFText(raw), i + end + 1
+	}
+
+	depth := 0
+	j := i
+	for ; j < len(b); j++ {
+		c := b[j]
+		switch {
+		case c == '\\' && j+1 < len(b):
+			j++
+			switch e := b[j]; e {
+			case 'n':
+				raw = append(raw, '\n')
+			case 'r':
+				raw = append(raw, '\r')
+			case 't':
+				raw = append(raw, '\t')
+			case 'b':
+				raw = append(raw, '\b')
+			case 'f':
+				raw = append(raw, '\f')
+			case '\r', '\n':
+				// Line continuation
+				if e == '\r' && j+1 < len(b) && b[j+1] == '\n' {
+					j++
+				}
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					k := 0
+					for ; k < 3 && j+k < len(b) && b[j+k] >= '0' && b[j+k] <= '7'; k++ {
+						v = v*8 + int(b[j+k]-'0')
+					}
+					j += k - 1
+					raw = append(raw, byte(v))
+				} else {
+					raw = append(raw, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				raw = append(raw, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return decodePDFText(raw), j + 1
+			}
+			raw = append(raw, c)
+		default:
+			raw = append(raw, c)
+		}
+	}
+	return decodePDFText(raw), j
+}
+
+// decodePDFText converts a PDF text string to UTF-8. Strings starting with a
+// UTF-16BE byte order mark are decoded as such; anything else is treated as
+// Latin-1 (close enough to PDFDocEncoding for our purposes).
+func decodePDFText(raw []byte) string {
+	if len(raw) >= 2 && raw[0] == 0xFE && raw[1] == 0xFF {
+		u := make([]uint16, (len(raw)-2)/2)
+		for k := range u {
+			u[k] = uint16(raw[2+2*k])<<8 | uint16(raw[3+2*k])
+		}
+		return string(utf16.Decode(u))
+	}
+	r := make([]rune, len(raw))
+	for k, c := range raw {
+		r[k] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,12 @@
+//go:build !pdf
+// +build !pdf
+
+package walker
+
+// pdfSupported is true if walker was built with the pdf build tag (see
+// pdf.go)
+const pdfSupported = false
+
+// parsePDFLinks is never called without the pdf build tag, as
+// fetcher.parse_pdf is rejected when the config is loaded
+func (f *fetcher) parsePDFLinks(body []byte, fr *FetchResults) {}
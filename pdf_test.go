@@ -0,0 +1,80 @@
+//go:build sudo && pdf
+// +build sudo,pdf
+
+package walker
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPDFLinks(t *testing.T) {
+	orig := Config.Fetcher.ParsePDF
+	defer func() {
+		Config.Fetcher.ParsePDF = orig
+	}()
+	Config.Fetcher.ParsePDF = true
+
+	deflate := func(s string) string {
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write([]byte(s))
+		w.Close()
+		return b.String()
+	}
+	content := deflate("BT /F1 12 Tf 72 712 Td (Quarterly \\(draft\\) report) Tj T* [(Sec) -20 (tion 1)] TJ ET\n" +
+		"BT <FEFF00480069> Tj ET")
+	objStream := deflate("<< /Type /Action /S /URI /URI (http://t2.com/compressed.html) >>")
+	pdf := "%PDF-1.5\n" +
+		"1 0 obj << /Type /Annot /Subtype /Link /A << /S /URI /URI (http://t2.com/report.html) >> >> endobj\n" +
+		"2 0 obj << /Type /Annot /Subtype /Link /A << /S /URI /URI <687474703a2f2f74322e636f6d2f6865782e68746d6c> >> >> endobj\n" +
+		"3 0 obj << /Type /Annot /Subtype /Link /A << /S /URI /URI (mailto:someone@t2.com) >> >> endobj\n" +
+		"4 0 obj << /Length " + fmt.Sprint(len(content)) + " /Filter /FlateDecode >>\nstream\n" + content + "\nendstream\nendobj\n" +
+		"5 0 obj << /Type /ObjStm /Filter /FlateDecode >>\nstream\n" + objStream + "\nendstream\nendobj\n" +
+		"%%EOF\n"
+
+	page := response200()
+	page.Header.Set("Content-Type", "application/pdf")
+	page.Body = ioutil.NopCloser(strings.NewReader(pdf))
+	roundTriper := mapRoundTrip{
+		Responses: map[string]*http.Response{
+			"http://t1.com/report.pdf": page,
+		},
+	}
+
+	results := runFetcher(TestSpec{
+		hasParsedLinks: true,
+		transport:      &roundTriper,
+		hosts:          singleLinkDomainSpecArr("http://t1.com/report.pdf", nil),
+	}, t)
+
+	expected := map[string]bool{
+		"http://t2.com/report.html":     true,
+		"http://t2.com/hex.html":        true,
+		"http://t2.com/compressed.html": true,
+	}
+	urls, _ := results.dsStoreParsedURLCalls()
+	for _, u := range urls {
+		if !expected[u.String()] {
+			t.Errorf("Unexpected parsed link %v", u)
+		}
+		delete(expected, u.String())
+	}
+	for link := range expected {
+		t.Errorf("Expected parsed link %v", link)
+	}
+
+	frs := results.dsStoreURLFetchResultsCalls()
+	if len(frs) != 1 {
+		t.Fatalf("Expected 1 call to StoreURLFetchResults, got %d", len(frs))
+	}
+	expText := "Quarterly (draft) report Section 1\nHi"
+	if frs[0].Text != expText {
+		t.Errorf("PDF text mismatch, got %q, expected %q", frs[0].Text, expText)
+	}
+}
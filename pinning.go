@@ -0,0 +1,113 @@
+package walker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"code.google.com/p/log4go"
+)
+
+// Hosts can be pinned to an address (see fetcher.pinned_hosts), to crawl a
+// site on servers its DNS doesn't point at yet, ex. a staging environment or
+// new infrastructure before a cutover. Connections to a pinned host go to the
+// pinned address, but requests are otherwise unchanged: the Host header and
+// TLS server name (SNI) are still the host's, so the servers answer, and
+// present certificates, as they would for the live site. Pinned hosts are
+// also grouped by their pinned address for politeness (see
+// fetcher.politeness_grouping), and aren't blacklisted for it being private
+// (see fetcher.blacklist_private_ips).
+
+// HostPin pins a host, and its subdomains, to an IP address
+type HostPin struct {
+	// The host, ex. "example.com". Its subdomains (ex. "www.example.com") are
+	// pinned too, unless they have a pin of their own.
+	Host string `yaml:"host"`
+
+	// The IP address to connect to instead of the ones the host resolves to.
+	// Connections keep the port of the URL fetched.
+	Address string `yaml:"address"`
+}
+
+// checkHostPins returns an error if a pin has no host, a bad address, or the
+// same host as another
+func checkHostPins(pins []HostPin) error {
+	hosts := map[string]bool{}
+	for i, p := range pins {
+		host := normalizePinHost(p.Host)
+		if host == "" {
+			return fmt.Errorf("pin %d has no host", i)
+		}
+		if hosts[host] {
+			return fmt.Errorf("host %q is pinned more than once", p.Host)
+		}
+		hosts[host] = true
+		if net.ParseIP(p.Address) == nil {
+			return fmt.Errorf("host %q is pinned to %q, which is not an IP address", p.Host, p.Address)
+		}
+	}
+	return nil
+}
+
+func normalizePinHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// hostPins maps pinned hosts to the addresses they are pinned to
+type hostPins map[string]string
+
+// newHostPins indexes pins, skipping any that don't check out (they are
+// rejected when the config is loaded)
+func newHostPins(pins []HostPin) hostPins {
+	p := hostPins{}
+	for _, pin := range pins {
+		if host := normalizePinHost(pin.Host); host != "" && net.ParseIP(pin.Address) != nil {
+			p[host] = pin.Address
+		}
+	}
+	return p
+}
+
+// lookup returns the address host is pinned to, by its own pin or the pin of
+// the nearest domain above it, or "" if it isn't pinned
+func (p hostPins) lookup(host string) string {
+	if len(p) == 0 {
+		return ""
+	}
+	host = normalizePinHost(host)
+	for {
+		if addr, ok := p[host]; ok {
+			return addr
+		}
+		i := strings.Index(host, ".")
+		if i < 0 {
+			return ""
+		}
+		host = host[i+1:]
+	}
+}
+
+// pinnedAddr returns the address host is pinned to, or "" if it isn't (or
+// there is no FetchManager to pin it)
+func (fm *FetchManager) pinnedAddr(host string) string {
+	if fm == nil {
+		return ""
+	}
+	return fm.hostPins.lookup(host)
+}
+
+// pinnedDial wraps dial to connect to the pinned address of pinned hosts
+func (fm *FetchManager) pinnedDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+	if len(fm.hostPins) == 0 {
+		return dial
+	}
+	return func(network, addr string) (net.Conn, error) {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			if pinned := fm.pinnedAddr(host); pinned != "" {
+				log4go.Fine("Dialing %v at its pinned address %v", addr, pinned)
+				addr = net.JoinHostPort(pinned, port)
+			}
+		}
+		return dial(network, addr)
+	}
+}
@@ -0,0 +1,91 @@
+package walker
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestHostPinsLookup(t *testing.T) {
+	pins := newHostPins([]HostPin{
+		{Host: "Example.com", Address: "10.0.0.1"},
+		{Host: "api.example.com.", Address: "10.0.0.2"},
+		{Host: "bogus.com", Address: "not an address"},
+	})
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"example.com", "10.0.0.1"},
+		{"www.example.com", "10.0.0.1"},
+		{"WWW.EXAMPLE.COM", "10.0.0.1"},
+		{"api.example.com", "10.0.0.2"},
+		{"v2.api.example.com", "10.0.0.2"},
+		{"notexample.com", ""},
+		{"bogus.com", ""},
+		{"com", ""},
+	}
+	for _, test := range tests {
+		if addr := pins.lookup(test.host); addr != test.expected {
+			t.Errorf("Expected %v to be pinned to %q, got %q", test.host, test.expected, addr)
+		}
+	}
+
+	bad := [][]HostPin{
+		{{Host: "", Address: "10.0.0.1"}},
+		{{Host: "example.com", Address: "example.org"}},
+		{{Host: "example.com", Address: "10.0.0.1"}, {Host: "EXAMPLE.com", Address: "10.0.0.2"}},
+	}
+	for _, pins := range bad {
+		if err := checkHostPins(pins); err == nil {
+			t.Errorf("Expected pins %+v to be rejected", pins)
+		}
+	}
+}
+
+func TestPinnedDial(t *testing.T) {
+	var host, serverName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host = req.Host
+	}))
+	server.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, nil
+		},
+	}
+	server.StartTLS()
+	defer server.Close()
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to get test server port: %v", err)
+	}
+
+	// staging.invalid doesn't resolve, so is only reached through its pin
+	fm := &FetchManager{hostPins: newHostPins([]HostPin{{Host: "staging.invalid", Address: "127.0.0.1"}})}
+	transport := &http.Transport{
+		Dial:            fm.pinnedDial(net.Dial),
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	u := &url.URL{Scheme: "https", Host: net.JoinHostPort("www.staging.invalid", port), Path: "/"}
+	res, err := (&http.Client{Transport: transport}).Get(u.String())
+	if err != nil {
+		t.Fatalf("Failed to fetch %v from its pinned address: %v", u, err)
+	}
+	res.Body.Close()
+	if host != u.Host {
+		t.Errorf("Expected Host header %q, got %q", u.Host, host)
+	}
+	if serverName != "www.staging.invalid" {
+		t.Errorf("Expected SNI server name www.staging.invalid, got %q", serverName)
+	}
+
+	// Without pins the dial is left alone
+	fm = &FetchManager{}
+	if _, err := fm.pinnedDial(net.Dial)("tcp", net.JoinHostPort("www.staging.invalid", port)); err == nil {
+		t.Error("Expected dialing an unpinned host that doesn't resolve to fail")
+	}
+}
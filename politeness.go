@@ -0,0 +1,168 @@
+package walker
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// Politeness grouping (fetcher.politeness_grouping) keeps walker polite to
+// servers hosting many domains. Normally each fetcher observes the crawl delay
+// of the domain it has claimed, so a server hosting fifty claimed domains can
+// get fifty times the rate any one of them asked for. With grouping on,
+// fetchers look up the address each host resolves to and share one schedule
+// per server (per address, or per /24 subnet for servers behind a few
+// neighbouring addresses): a request is only made once the crawl delay has
+// passed since the last request any fetcher in this process made to that
+// server.
+
+// The fetcher.politeness_grouping values
+const (
+	PolitenessGroupNone   = "none"
+	PolitenessGroupIP     = "ip"
+	PolitenessGroupSubnet = "subnet"
+)
+
+// politenessLookup resolves a host name with the system's DNS, net.LookupIP
+// unless testing
+var politenessLookup = net.LookupIP
+
+// serverGateMaxGroups is the number of servers a serverGate tracks before it
+// drops those it has no future requests scheduled for
+const serverGateMaxGroups = 10000
+
+// serverGate schedules requests to servers so that requests to the same
+// server are at least a crawl delay apart, whichever fetcher makes them
+type serverGate struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+func newServerGate() *serverGate {
+	return &serverGate{next: map[string]time.Time{}}
+}
+
+// reserve books the next request to server, which must then wait until the
+// returned time; the request after it may be made delay later
+func (g *serverGate) reserve(server string, delay time.Duration) time.Time {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	at := g.next[server]
+	if at.Before(now) {
+		at = now
+	}
+	if len(g.next) >= serverGateMaxGroups {
+		for s, t := range g.next {
+			if t.Before(now) {
+				delete(g.next, s)
+			}
+		}
+	}
+	g.next[server] = at.Add(delay)
+	return at
+}
+
+// serverGroup returns the politeness group of ip under grouping: the address
+// itself, or its /24 subnet (/64 for IPv6)
+func serverGroup(ip net.IP, grouping string) string {
+	if grouping != PolitenessGroupSubnet {
+		return ip.String()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}).String()
+}
+
+// politenessGroup returns the politeness group of host, or "" if grouping is
+// off or host doesn't resolve. Groups are remembered for the current claim.
+func (f *fetcher) politenessGroup(host string) string {
+	grouping := Config.Fetcher.PolitenessGrouping
+	if grouping == PolitenessGroupNone {
+		return ""
+	}
+	if group, ok := f.serverGroups[host]; ok {
+		return group
+	}
+	group := ""
+	ips, err := f.fm.lookupServer(host)
+	if err != nil || len(ips) == 0 {
+		log4go.Debug("Failed to resolve %v for politeness grouping: %v", host, err)
+	} else {
+		group = serverGroup(ips[0], grouping)
+	}
+	if f.serverGroups == nil {
+		f.serverGroups = map[string]string{}
+	}
+	f.serverGroups[host] = group
+	return group
+}
+
+// lookupServer returns the addresses of host the way fetches dial it: its
+// pinned address, the one fm.dnsCache holds for it, or else those fm.doh (or
+// the system's DNS) resolves it to. Addresses it looks up are cached, so the
+// fetches that follow dial the server they were grouped by.
+func (fm *FetchManager) lookupServer(host string) ([]net.IP, error) {
+	if fm == nil {
+		return politenessLookup(host)
+	}
+	if pinned := net.ParseIP(fm.pinnedAddr(host)); pinned != nil {
+		return []net.IP{pinned}, nil
+	}
+	if fm.dnsCache != nil {
+		for _, port := range []string{"80", "443"} {
+			ipaddr, ok := fm.dnsCache.Addr("tcp", net.JoinHostPort(host, port))
+			if !ok {
+				continue
+			}
+			if ip, _, err := net.SplitHostPort(ipaddr); err == nil && net.ParseIP(ip) != nil {
+				return []net.IP{net.ParseIP(ip)}, nil
+			}
+		}
+	}
+
+	var ips []net.IP
+	var err error
+	if fm.doh != nil {
+		var addrs []string
+		addrs, err = fm.doh.Lookup(host)
+		for _, a := range addrs {
+			if ip := net.ParseIP(a); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+	} else {
+		ips, err = politenessLookup(host)
+	}
+	if err == nil && len(ips) > 0 && fm.dnsCache != nil {
+		for _, port := range []string{"80", "443"} {
+			fm.dnsCache.Seed("tcp", net.JoinHostPort(host, port), net.JoinHostPort(ips[0].String(), port))
+		}
+	}
+	return ips, err
+}
+
+// waitForServer waits until a request may be made to the server of host,
+// given crawl delay delay (see fetcher.politeness_grouping). It returns false
+// if the fetcher was told to quit while waiting.
+func (f *fetcher) waitForServer(host string, delay time.Duration) bool {
+	group := f.politenessGroup(host)
+	if group == "" {
+		return true
+	}
+	wait := f.fm.serverGate.reserve(group, delay).Sub(time.Now())
+	if wait <= 0 {
+		return true
+	}
+	log4go.Fine("Waiting %v for server %v before fetching from %v", wait, group, host)
+	select {
+	case <-time.After(wait):
+		return true
+	case <-f.quit:
+		return false
+	}
+}
@@ -0,0 +1,117 @@
+package walker
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/iParadigms/walker/dnscache"
+)
+
+func TestServerGroup(t *testing.T) {
+	tests := []struct {
+		ip       string
+		grouping string
+		expected string
+	}{
+		{"93.184.216.34", PolitenessGroupIP, "93.184.216.34"},
+		{"93.184.216.34", PolitenessGroupSubnet, "93.184.216.0/24"},
+		{"2606:2800:220:1:248:1893:25c8:1946", PolitenessGroupIP, "2606:2800:220:1:248:1893:25c8:1946"},
+		{"2606:2800:220:1:248:1893:25c8:1946", PolitenessGroupSubnet, "2606:2800:220:1::/64"},
+	}
+	for _, test := range tests {
+		if g := serverGroup(net.ParseIP(test.ip), test.grouping); g != test.expected {
+			t.Errorf("serverGroup(%v, %v): expected %v, got %v", test.ip, test.grouping, test.expected, g)
+		}
+	}
+}
+
+func TestServerGate(t *testing.T) {
+	g := newServerGate()
+	delay := time.Minute
+	start := time.Now()
+
+	// Requests to one server are spaced by the delay, others aren't held up
+	first := g.reserve("10.0.0.1", delay)
+	second := g.reserve("10.0.0.1", delay)
+	other := g.reserve("10.0.0.2", delay)
+	if first.Sub(start) > time.Second {
+		t.Errorf("Expected the first request to be made at once, got %v", first.Sub(start))
+	}
+	if d := second.Sub(first); d != delay {
+		t.Errorf("Expected the second request %v after the first, got %v", delay, d)
+	}
+	if other.Sub(start) > time.Second {
+		t.Errorf("Expected a request to another server to be made at once, got %v", other.Sub(start))
+	}
+}
+
+func TestPolitenessGroup(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { politenessLookup = lookup }(politenessLookup)
+	lookups := 0
+	politenessLookup = func(host string) ([]net.IP, error) {
+		lookups++
+		switch host {
+		case "a.com", "b.com":
+			return []net.IP{net.ParseIP("93.184.216.34")}, nil
+		case "c.com":
+			return []net.IP{net.ParseIP("93.184.216.35")}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	defer func(grouping string) { Config.Fetcher.PolitenessGrouping = grouping }(Config.Fetcher.PolitenessGrouping)
+
+	f := &fetcher{}
+	Config.Fetcher.PolitenessGrouping = PolitenessGroupNone
+	if g := f.politenessGroup("a.com"); g != "" || lookups != 0 {
+		t.Errorf("Expected no grouping, got %q after %d lookups", g, lookups)
+	}
+
+	Config.Fetcher.PolitenessGrouping = PolitenessGroupSubnet
+	expected := map[string]string{
+		"a.com":       "93.184.216.0/24",
+		"b.com":       "93.184.216.0/24",
+		"c.com":       "93.184.216.0/24",
+		"nowhere.com": "",
+	}
+	for host, group := range expected {
+		if g := f.politenessGroup(host); g != group {
+			t.Errorf("Expected %v to be in group %q, got %q", host, group, g)
+		}
+		f.politenessGroup(host)
+	}
+	if lookups != len(expected) {
+		t.Errorf("Expected each host to be looked up once, got %d lookups", lookups)
+	}
+}
+
+func TestPolitenessGroupDialedAddress(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { politenessLookup = lookup }(politenessLookup)
+	politenessLookup = func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("93.184.216.99")}, nil
+	}
+	defer func(grouping string) { Config.Fetcher.PolitenessGrouping = grouping }(Config.Fetcher.PolitenessGrouping)
+	Config.Fetcher.PolitenessGrouping = PolitenessGroupIP
+
+	cache, err := dnscache.New(10)
+	if err != nil {
+		t.Fatalf("Failed to create DNS cache: %v", err)
+	}
+	f := &fetcher{fm: &FetchManager{dnsCache: cache}}
+
+	// A host already dialed is grouped by the address it was dialed at
+	cache.Seed("tcp", "a.com:443", "10.0.0.1:443")
+	if g := f.politenessGroup("a.com"); g != "10.0.0.1" {
+		t.Errorf("Expected a.com to be grouped by its cached address, got %q", g)
+	}
+
+	// and one looked up is then dialed at the address it was grouped by
+	if g := f.politenessGroup("b.com"); g != "93.184.216.34" {
+		t.Errorf("Expected b.com to be grouped by its first address, got %q", g)
+	}
+	for _, addr := range []string{"b.com:80", "b.com:443"} {
+		if ipaddr, _ := cache.Addr("tcp", addr); ipaddr != "93.184.216.34"+addr[len("b.com"):] {
+			t.Errorf("Expected %v to be dialed at its grouped address, got %q", addr, ipaddr)
+		}
+	}
+}
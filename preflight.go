@@ -0,0 +1,165 @@
+package walker
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/temoto/robotstxt.go"
+)
+
+// Pre-flight checks catch seeds that would only waste a place in the
+// frontier, before they are added: a domain that doesn't resolve, whose
+// robots.txt can't be fetched or forbids crawling it, whose homepage doesn't
+// answer 200, or that is on a configured blocklist. The console runs them on
+// request when links are added (see console's /add and /rest/add).
+
+// The pre-flight checks, in the order Preflight runs them
+const (
+	PreflightBlocklist = "blocklist"
+	PreflightDNS       = "dns"
+	PreflightRobots    = "robots"
+	PreflightHomepage  = "homepage"
+)
+
+// preflightLookup resolves a host name, net.LookupHost unless testing
+var preflightLookup = net.LookupHost
+
+// PreflightCheck is the outcome of one pre-flight check
+type PreflightCheck struct {
+	// One of the Preflight* constants above (or the Verify* ones, for
+	// VerifyDomain)
+	Name string `json:"name"`
+
+	Passed bool `json:"passed"`
+
+	// What was found, ex. the addresses the host resolved to, or why it
+	// failed
+	Detail string `json:"detail"`
+}
+
+// PreflightReport is the outcome of the pre-flight checks of one link
+type PreflightReport struct {
+	Link   string           `json:"link"`
+	Domain string           `json:"domain"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+// Passed returns true if every check passed
+func (r *PreflightReport) Passed() bool {
+	for _, c := range r.Checks {
+		if !c.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *PreflightReport) add(name string, passed bool, format string, args ...interface{}) {
+	r.Checks = append(r.Checks, PreflightCheck{Name: name, Passed: passed, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Preflight runs the pre-flight checks for the host of link, making its
+// requests through transport (http.DefaultTransport if nil) with the
+// configured user agent and fetcher.http_timeout. An error is returned only if
+// link can't be parsed.
+func Preflight(link string, transport http.RoundTripper) (*PreflightReport, error) {
+	u, err := ParseAndNormalizeURL(link)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse %q: %v", link, err)
+	}
+	dom, err := u.ToplevelDomainPlusOne()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get domain of %q: %v", link, err)
+	}
+	r := &PreflightReport{Link: u.String(), Domain: dom}
+
+	if list := DomainBlocklisted(dom); list != "" {
+		r.add(PreflightBlocklist, false, "%v is on blocklist %v", dom, list)
+	} else {
+		r.add(PreflightBlocklist, true, "Not on any blocklist")
+	}
+
+	host := u.Hostname()
+	addrs, err := preflightLookup(host)
+	if err != nil {
+		r.add(PreflightDNS, false, "%v", err)
+		r.add(PreflightRobots, false, "Skipped: %v does not resolve", host)
+		r.add(PreflightHomepage, false, "Skipped: %v does not resolve", host)
+		return r, nil
+	}
+	private := ""
+	for _, a := range addrs {
+		if isPrivateAddr(a) {
+			private = a
+		}
+	}
+	if Config.Fetcher.BlacklistPrivateIPs && private != "" {
+		r.add(PreflightDNS, false, "%v resolves to private address %v", host, private)
+	} else {
+		r.add(PreflightDNS, true, "Resolves to %v", addrs)
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	timeout, err := time.ParseDuration(Config.Fetcher.HTTPTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Bad fetcher.http_timeout: %v", err)
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	base := u.Scheme + "://" + u.Host
+
+	status, body, _, err := preflightGet(client, base+"/robots.txt")
+	if err != nil {
+		r.add(PreflightRobots, false, "%v", err)
+	} else if status >= 500 {
+		r.add(PreflightRobots, false, "robots.txt answered %v", status)
+	} else if robots, err := robotstxt.FromStatusAndBytes(status, body); err != nil {
+		// The fetcher treats an unparseable robots.txt as allowing everything
+		r.add(PreflightRobots, true, "robots.txt can't be parsed, so allows crawling: %v", err)
+	} else if !robots.FindGroup(Config.Fetcher.UserAgent).Test(u.RequestURI()) {
+		r.add(PreflightRobots, false, "robots.txt disallows %v", u.RequestURI())
+	} else {
+		r.add(PreflightRobots, true, "robots.txt (status %v) allows crawling", status)
+	}
+
+	status, _, _, err = preflightGet(client, base+"/")
+	if err != nil {
+		r.add(PreflightHomepage, false, "%v", err)
+	} else if status != http.StatusOK {
+		r.add(PreflightHomepage, false, "Homepage answered %v", status)
+	} else {
+		r.add(PreflightHomepage, true, "Homepage answered 200")
+	}
+	return r, nil
+}
+
+// preflightGet GETs link with client (following redirects), returning the
+// final status, up to fetcher.max_http_content_size_bytes of body and the URL
+// it was read from
+func preflightGet(client *http.Client, link string) (int, []byte, *url.URL, error) {
+	req, err := http.NewRequest("GET", link, nil)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, Config.Fetcher.MaxHTTPContentSizeBytes))
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("Failed to read %v: %v", link, err)
+	}
+	final := req.URL
+	if res.Request != nil {
+		final = res.Request.URL
+	}
+	return res.StatusCode, body, final, nil
+}
@@ -0,0 +1,71 @@
+package walker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	defer func(lookup func(string) ([]string, error)) { preflightLookup = lookup }(preflightLookup)
+	preflightLookup = func(host string) ([]string, error) {
+		if host == "nowhere.com" {
+			return nil, fmt.Errorf("no such host")
+		}
+		return []string{"93.184.216.34"}, nil
+	}
+
+	robots := func(body string) *http.Response {
+		res := response200()
+		res.Header.Set("Content-Type", "text/plain")
+		res.Body = ioutil.NopCloser(strings.NewReader(body))
+		return res
+	}
+	// Responses can only be read once, so each Preflight gets its own
+	transport := func() http.RoundTripper {
+		return &mapRoundTrip{Responses: map[string]*http.Response{
+			"http://good.com/robots.txt":    robots("User-agent: *\nDisallow: /private\n"),
+			"http://good.com/":              response200(),
+			"http://blocked.com/robots.txt": robots("User-agent: *\nDisallow: /\n"),
+			"http://blocked.com/":           response200(),
+			// gone.com has no robots.txt (which allows everything) and a 404
+			// homepage
+		}}
+	}
+
+	tests := []struct {
+		link   string
+		failed []string
+	}{
+		{"http://good.com/page.html", nil},
+		{"http://good.com/private/page.html", []string{PreflightRobots}},
+		{"http://blocked.com/", []string{PreflightRobots}},
+		{"http://gone.com/", []string{PreflightHomepage}},
+		{"http://nowhere.com/", []string{PreflightDNS, PreflightRobots, PreflightHomepage}},
+	}
+	for _, test := range tests {
+		r, err := Preflight(test.link, transport())
+		if err != nil {
+			t.Errorf("Preflight(%v) failed: %v", test.link, err)
+			continue
+		}
+		var failed []string
+		for _, c := range r.Checks {
+			if !c.Passed {
+				failed = append(failed, c.Name)
+			}
+		}
+		if fmt.Sprint(failed) != fmt.Sprint(test.failed) {
+			t.Errorf("Preflight(%v): expected failed checks %v, got %+v", test.link, test.failed, r.Checks)
+		}
+		if r.Passed() != (len(test.failed) == 0) {
+			t.Errorf("Preflight(%v): Passed() returned %v", test.link, r.Passed())
+		}
+	}
+
+	if _, err := Preflight("http://", transport()); err == nil {
+		t.Error("Expected an error from Preflight of a bad link")
+	}
+}
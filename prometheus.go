@@ -0,0 +1,169 @@
+package walker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Observer is a Metrics that also takes observations for histograms, like
+// how long each fetch took. Walker's components check whether the Metrics
+// they are given is an Observer, and only observe if it is.
+type Observer interface {
+	Metrics
+
+	// Observe records value in the named histogram (one of the Metric*
+	// names documented as a histogram)
+	Observe(name string, value float64)
+}
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the buckets of
+// histograms not given their own in NewPrometheusMetrics
+var DefaultLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// PrometheusMetrics is an Observer that keeps its counters and histograms in
+// memory and serves them in the Prometheus text exposition format, so a
+// Prometheus server can scrape a walker process (see metrics.listen). It is
+// safe for concurrent use.
+type PrometheusMetrics struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	histograms map[string]*histogram
+	buckets    map[string][]float64
+}
+
+// histogram is a Prometheus histogram: the count of observations at most each
+// bucket's upper bound, and their sum and count
+type histogram struct {
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+// NewPrometheusMetrics returns an empty PrometheusMetrics. buckets gives the
+// bucket upper bounds of some histograms, by name; the others use
+// DefaultLatencyBuckets.
+func NewPrometheusMetrics(buckets map[string][]float64) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		counters:   map[string]int64{},
+		histograms: map[string]*histogram{},
+		buckets:    map[string][]float64{},
+	}
+	for name, b := range buckets {
+		b = append([]float64(nil), b...)
+		sort.Float64s(b)
+		m.buckets[name] = b
+	}
+	return m
+}
+
+// Add is documented on the Metrics interface
+func (m *PrometheusMetrics) Add(name string, delta int64) {
+	m.mu.Lock()
+	m.counters[name] += delta
+	m.mu.Unlock()
+}
+
+// Observe is documented on the Observer interface
+func (m *PrometheusMetrics) Observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h := m.histograms[name]
+	if h == nil {
+		bounds := m.buckets[name]
+		if bounds == nil {
+			bounds = DefaultLatencyBuckets
+		}
+		h = &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+		m.histograms[name] = h
+	}
+	for i, b := range h.bounds {
+		if value <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Counter returns the value of the named counter
+func (m *PrometheusMetrics) Counter(name string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format,
+// sorted by name
+func (m *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var written int64
+	printf := func(format string, args ...interface{}) error {
+		n, err := fmt.Fprintf(w, format, args...)
+		written += int64(n)
+		return err
+	}
+
+	names := make([]string, 0, len(m.counters))
+	for name := range m.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := printf("# TYPE %s counter\n%s %d\n", name, name, m.counters[name]); err != nil {
+			return written, err
+		}
+	}
+
+	names = names[:0]
+	for name := range m.histograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := m.histograms[name]
+		if err := printf("# TYPE %s histogram\n", name); err != nil {
+			return written, err
+		}
+		for i, b := range h.bounds {
+			le := strconv.FormatFloat(b, 'g', -1, 64)
+			if err := printf("%s_bucket{le=\"%s\"} %d\n", name, le, h.counts[i]); err != nil {
+				return written, err
+			}
+		}
+		err := printf("%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, h.count,
+			name, strconv.FormatFloat(h.sum, 'g', -1, 64), name, h.count)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ServeHTTP serves the metrics to a Prometheus scrape
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// NewMetricsService returns a Service serving m at /metrics on addr (ex.
+// ":9100")
+func NewMetricsService(addr string, m *PrometheusMetrics) Service {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	return NewHTTPService(addr, mux)
+}
+
+// Observe records value in the named histogram of m, if m is an Observer (and
+// not nil)
+func Observe(m Metrics, name string, value float64) {
+	if o, ok := m.(Observer); ok {
+		o.Observe(name, value)
+	}
+}
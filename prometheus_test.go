@@ -0,0 +1,66 @@
+package walker
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	m := NewPrometheusMetrics(map[string][]float64{MetricFetchSeconds: {1, 0.5}})
+	r := newCrawlReporter(m)
+	r.add("test.com", &FetchResults{
+		URL:          MustParse("http://test.com/page.html"),
+		Response:     &http.Response{StatusCode: 200, Header: http.Header{}},
+		ContentSize:  100,
+		ResponseTime: 300 * time.Millisecond,
+	})
+	r.add("test.com", &FetchResults{
+		URL:          MustParse("http://test.com/slow.html"),
+		Response:     &http.Response{StatusCode: 200, Header: http.Header{}},
+		ContentSize:  50,
+		ResponseTime: 2 * time.Second,
+		ParseError:   errors.New("bad html"),
+	})
+	r.add("test.com", &FetchResults{URL: MustParse("http://test.com/robots.html"), ExcludedByRobots: true})
+
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	expected := `# TYPE walker_bytes counter
+walker_bytes 150
+# TYPE walker_links_fetched counter
+walker_links_fetched 2
+# TYPE walker_links_requested counter
+walker_links_requested 2
+# TYPE walker_parse_errors counter
+walker_parse_errors 1
+# TYPE walker_robots_excluded counter
+walker_robots_excluded 1
+# TYPE walker_fetch_seconds histogram
+walker_fetch_seconds_bucket{le="0.5"} 1
+walker_fetch_seconds_bucket{le="1"} 1
+walker_fetch_seconds_bucket{le="+Inf"} 2
+walker_fetch_seconds_sum 2.3
+walker_fetch_seconds_count 2
+`
+	if string(body) != expected {
+		t.Errorf("Expected metrics:\n%v\ngot:\n%v", expected, string(body))
+	}
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected a text/plain scrape, got %v", res.Header.Get("Content-Type"))
+	}
+	if n := m.Counter(MetricLinksFetched); n != 2 {
+		t.Errorf("Expected Counter to read 2 links fetched, got %v", n)
+	}
+}
@@ -0,0 +1,171 @@
+package walker
+
+import (
+	"fmt"
+	"math"
+)
+
+// A minimal implementation of the protocol buffers wire format, enough to
+// encode and decode FetchRecords without generated code (see
+// fetchrecord.proto).
+
+// Protocol buffer wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoWriter appends fields to a protocol buffer message. Like proto3, it
+// leaves out singular fields with their zero value.
+type protoWriter struct {
+	b []byte
+}
+
+func (w *protoWriter) varint(v uint64) {
+	for v >= 0x80 {
+		w.b = append(w.b, byte(v)|0x80)
+		v >>= 7
+	}
+	w.b = append(w.b, byte(v))
+}
+
+func (w *protoWriter) tag(field, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *protoWriter) uint(field int, v uint64) {
+	if v != 0 {
+		w.tag(field, protoVarint)
+		w.varint(v)
+	}
+}
+
+func (w *protoWriter) int(field int, v int64) {
+	w.uint(field, uint64(v))
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	if v {
+		w.uint(field, 1)
+	}
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, protoFixed64)
+	bits := math.Float64bits(v)
+	for i := uint(0); i < 64; i += 8 {
+		w.b = append(w.b, byte(bits>>i))
+	}
+}
+
+func (w *protoWriter) string(field int, v string) {
+	if v != "" {
+		w.message(field, []byte(v))
+	}
+}
+
+// message writes a length-delimited field (a nested message, bytes or a
+// repeated string), even if it is empty
+func (w *protoWriter) message(field int, v []byte) {
+	w.tag(field, protoBytes)
+	w.varint(uint64(len(v)))
+	w.b = append(w.b, v...)
+}
+
+// protoReader reads the fields of a protocol buffer message
+type protoReader struct {
+	b []byte
+}
+
+// protoField is a field read by protoReader.next. Varint and fixed-size
+// values are in u, length-delimited ones in data.
+type protoField struct {
+	num      int
+	wireType int
+	u        uint64
+	data     []byte
+}
+
+func (f *protoField) int() int64 {
+	return int64(f.u)
+}
+
+func (f *protoField) bool() bool {
+	return f.u != 0
+}
+
+func (f *protoField) double() float64 {
+	return math.Float64frombits(f.u)
+}
+
+func (f *protoField) string() string {
+	return string(f.data)
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if len(r.b) == 0 {
+			return 0, fmt.Errorf("Truncated varint")
+		}
+		c := r.b[0]
+		r.b = r.b[1:]
+		v |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("Varint overflows 64 bits")
+}
+
+func (r *protoReader) fixed(n int) (uint64, error) {
+	if len(r.b) < n {
+		return 0, fmt.Errorf("Truncated fixed-size value")
+	}
+	var v uint64
+	for i := 0; i < n; i++ {
+		v |= uint64(r.b[i]) << (8 * uint(i))
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// next reads the next field, returning false at the end of the message
+func (r *protoReader) next() (*protoField, bool, error) {
+	if len(r.b) == 0 {
+		return nil, false, nil
+	}
+	key, err := r.varint()
+	if err != nil {
+		return nil, false, err
+	}
+	f := &protoField{num: int(key >> 3), wireType: int(key & 7)}
+	switch f.wireType {
+	case protoVarint:
+		f.u, err = r.varint()
+	case protoFixed64:
+		f.u, err = r.fixed(8)
+	case protoFixed32:
+		f.u, err = r.fixed(4)
+	case protoBytes:
+		var n uint64
+		n, err = r.varint()
+		if err == nil && n > uint64(len(r.b)) {
+			err = fmt.Errorf("Truncated field %d", f.num)
+		}
+		if err == nil {
+			f.data, r.b = r.b[:n], r.b[n:]
+		}
+	default:
+		err = fmt.Errorf("Unsupported wire type %d for field %d", f.wireType, f.num)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
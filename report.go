@@ -0,0 +1,484 @@
+package walker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/iParadigms/walker/dnscache"
+)
+
+// A FetchManager keeps a tally of everything its fetchers store, and can
+// summarize it as a CrawlReport: a JSON document meant to be kept as a record
+// of what a crawl run did. It is written to fetcher.report_file when the
+// FetchManager stops, and whenever WriteReport is called (the walker command
+// does so on SIGUSR1).
+
+const crawlReportFormat = "walker-crawl-report"
+const crawlReportVersion = 1
+
+// CrawlReport summarizes the fetches made by one FetchManager run
+type CrawlReport struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+
+	// The host name of the machine the crawl ran on
+	Node string `json:"node"`
+
+	// When the FetchManager started, and when this report was made
+	Started   time.Time `json:"started"`
+	Generated time.Time `json:"generated"`
+
+	Coverage ReportCoverage `json:"coverage"`
+	Errors   ReportErrors   `json:"errors"`
+	Policy   ReportPolicy   `json:"policy"`
+	DNS      ReportDNS      `json:"dns"`
+
+	// The most common Content-Types fetched (see
+	// fetcher.report_top_content_types), most common first
+	TopContentTypes []ReportCount `json:"top_content_types"`
+
+	// Bytes of content read from each domain
+	BytesByDomain map[string]int64 `json:"bytes_by_domain"`
+}
+
+// ReportCoverage counts what was crawled
+type ReportCoverage struct {
+	// Domains claimed, and how many of them were crawled to the end of their
+	// segment
+	Domains          int `json:"domains"`
+	DomainsCompleted int `json:"domains_completed"`
+
+	// Links requested, and how many of those got a complete response
+	LinksRequested int `json:"links_requested"`
+	LinksFetched   int `json:"links_fetched"`
+
+	// Bytes of content read in all
+	Bytes int64 `json:"bytes"`
+
+	// Pages not handled because they hadn't changed since they were last
+	// crawled (see fetcher.differential)
+	LinksUnchanged int `json:"links_unchanged"`
+
+	// Links read from hosts' sitemaps and passed to the datastore (see
+	// fetcher.sitemap_discovery)
+	SitemapLinks int `json:"sitemap_links"`
+}
+
+// ReportErrors counts failed fetches
+type ReportErrors struct {
+	// Requests that failed without a response, or whose body couldn't be read
+	FetchErrors int `json:"fetch_errors"`
+
+	// Requests abandoned because the response headers were too large or too
+	// many (see fetcher.max_response_header_bytes); these are also counted
+	// in FetchErrors
+	HeaderLimitErrors int `json:"header_limit_errors"`
+
+	// Responses with 4xx and 5xx statuses
+	ClientErrors int `json:"client_errors"`
+	ServerErrors int `json:"server_errors"`
+
+	// Pages that couldn't be parsed for links
+	ParseErrors int `json:"parse_errors"`
+
+	// Responses the handler failed to handle (see HandlerV2), and how many
+	// of those it asked to have fetched again
+	HandlerErrors  int `json:"handler_errors"`
+	HandlerRetries int `json:"handler_retries"`
+
+	// Number of responses with each status code
+	Statuses map[string]int `json:"statuses"`
+}
+
+// ReportPolicy counts links that crawl policy kept walker from fetching in
+// full
+type ReportPolicy struct {
+	// Links excluded by robots.txt
+	RobotsExcluded int `json:"robots_excluded"`
+
+	// Responses rejected for exceeding fetcher.max_http_content_size_bytes
+	SizeRejected int `json:"size_rejected"`
+
+	// Documents too large to fetch whole, of which only the start was fetched
+	// (see fetcher.range_fetch_bytes)
+	PartialFetches int `json:"partial_fetches"`
+
+	// Links skipped because their sitemap lastmod showed no change
+	SitemapFresh int `json:"sitemap_fresh"`
+
+	// Links not fetched because their extension is on
+	// fetcher.deny_extensions
+	ExtensionDenied int `json:"extension_denied"`
+
+	// Pages marked noindex, and so not handled if
+	// fetcher.honor_meta_noindex is set
+	MetaNoIndex int `json:"meta_noindex"`
+
+	// Responses stored but not handled because their Content-Type didn't
+	// match fetcher.handler_formats (or accept_formats)
+	TypeSkipped int `json:"type_skipped"`
+
+	// Number of times each decision (one of the RobotsDecision* values) was
+	// taken about the robots.txt of a host crawled
+	RobotsDecisions map[string]int `json:"robots_decisions"`
+}
+
+// ReportDNS counts the host name lookups made with DNS-over-HTTPS (see
+// fetcher.dns_over_https_url). Lookups answered from the DNS cache aren't
+// counted.
+type ReportDNS struct {
+	// Lookups made, and how many of those the resolver failed to answer (not
+	// counting hosts it answered don't exist)
+	DoHLookups  int `json:"doh_lookups"`
+	DoHFailures int `json:"doh_failures"`
+
+	// Failed lookups retried with the system's DNS (see
+	// fetcher.dns_over_https_fallback)
+	DoHFallbacks int `json:"doh_fallbacks"`
+
+	// The mean and longest time a lookup took, in milliseconds
+	DoHMeanMillis int64 `json:"doh_mean_millis"`
+	DoHMaxMillis  int64 `json:"doh_max_millis"`
+}
+
+// Metrics receives running counts of what a FetchManager's fetchers do, for
+// export to a monitoring system (see WithMetrics). Add is called by all the
+// fetchers, so must be safe for concurrent use.
+type Metrics interface {
+	// Add adds delta to the named counter (one of the Metric* names)
+	Add(name string, delta int64)
+}
+
+// The counters a FetchManager adds to its Metrics, counting the same things
+// as the CrawlReport fields of the same names
+const (
+	MetricDomains        = "walker_domains"
+	MetricLinksRequested = "walker_links_requested"
+	MetricLinksFetched   = "walker_links_fetched"
+	MetricBytes          = "walker_bytes"
+	MetricFetchErrors    = "walker_fetch_errors"
+	MetricRobotsExcluded = "walker_robots_excluded"
+	MetricHandlerErrors  = "walker_handler_errors"
+	MetricParseErrors    = "walker_parse_errors"
+
+	// A histogram (see Observer) of how long fetches took, in seconds, from
+	// sending the request to reading the last byte of the response
+	MetricFetchSeconds = "walker_fetch_seconds"
+
+	// The requests abandoned for the size or number of their response
+	// headers, counted in ReportErrors
+	MetricHeaderLimitErrors = "walker_header_limit_errors"
+
+	// The DoH lookups, failures and fallbacks counted in ReportDNS, and the
+	// milliseconds all the lookups took (divided by the lookups, the mean
+	// resolver latency)
+	MetricDoHLookups   = "walker_doh_lookups"
+	MetricDoHFailures  = "walker_doh_failures"
+	MetricDoHFallbacks = "walker_doh_fallbacks"
+	MetricDoHMillis    = "walker_doh_millis"
+)
+
+// ReportCount is a value and the number of times it was seen
+type ReportCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// crawlReporter tallies fetch results for a CrawlReport. It is safe for
+// concurrent use by all of a FetchManager's fetchers.
+type crawlReporter struct {
+	mu           sync.Mutex
+	started      time.Time
+	domains      map[string]bool
+	completed    int
+	coverage     ReportCoverage
+	errors       ReportErrors
+	policy       ReportPolicy
+	dns          ReportDNS
+	dohMillis    int64
+	contentTypes map[string]int
+	bytes        map[string]int64
+
+	// Where counts are also sent as they are made, or nil
+	metrics Metrics
+}
+
+func newCrawlReporter(metrics Metrics) *crawlReporter {
+	return &crawlReporter{
+		metrics:      metrics,
+		started:      time.Now(),
+		domains:      map[string]bool{},
+		errors:       ReportErrors{Statuses: map[string]int{}},
+		policy:       ReportPolicy{RobotsDecisions: map[string]int{}},
+		contentTypes: map[string]int{},
+		bytes:        map[string]int64{},
+	}
+}
+
+// claimed records that a fetcher claimed dom
+func (r *crawlReporter) claimed(dom string) {
+	r.mu.Lock()
+	r.addDomain(dom)
+	r.mu.Unlock()
+}
+
+// domainCompleted records that a fetcher got through all of dom's segment
+func (r *crawlReporter) domainCompleted(dom string) {
+	r.mu.Lock()
+	r.addDomain(dom)
+	r.completed++
+	r.mu.Unlock()
+}
+
+// addDomain records dom as crawled. r.mu must be held.
+func (r *crawlReporter) addDomain(dom string) {
+	if !r.domains[dom] {
+		r.domains[dom] = true
+		r.count(MetricDomains, 1)
+	}
+}
+
+// typeSkipped records that a response wasn't handled because of its type
+func (r *crawlReporter) typeSkipped() {
+	r.mu.Lock()
+	r.policy.TypeSkipped++
+	r.mu.Unlock()
+}
+
+// robotsDecision records the decision taken about a host's robots.txt
+func (r *crawlReporter) robotsDecision(decision string) {
+	r.mu.Lock()
+	r.policy.RobotsDecisions[decision]++
+	r.mu.Unlock()
+}
+
+// dohLookup records a DoH lookup that took took, with its error. fallback is
+// true if a failure is retried with the system's DNS.
+func (r *crawlReporter) dohLookup(took time.Duration, err error, fallback bool) {
+	ms := int64(took / time.Millisecond)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dns.DoHLookups++
+	r.count(MetricDoHLookups, 1)
+	r.dohMillis += ms
+	r.count(MetricDoHMillis, ms)
+	if ms > r.dns.DoHMaxMillis {
+		r.dns.DoHMaxMillis = ms
+	}
+	if err != nil && !dnscache.IsDNSError(err) {
+		r.dns.DoHFailures++
+		r.count(MetricDoHFailures, 1)
+		if fallback {
+			r.dns.DoHFallbacks++
+			r.count(MetricDoHFallbacks, 1)
+		}
+	}
+}
+
+// sitemapLinks records that n links were stored from a host's sitemaps
+func (r *crawlReporter) sitemapLinks(n int) {
+	r.mu.Lock()
+	r.coverage.SitemapLinks += n
+	r.mu.Unlock()
+}
+
+// count adds delta to the named counter of r.metrics, if set
+func (r *crawlReporter) count(name string, delta int64) {
+	if r.metrics != nil {
+		r.metrics.Add(name, delta)
+	}
+}
+
+// add records a stored fetch result for a link on dom
+func (r *crawlReporter) add(dom string, fr *FetchResults) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch {
+	case fr.ExcludedByRobots:
+		r.policy.RobotsExcluded++
+		r.count(MetricRobotsExcluded, 1)
+		return
+	case fr.SitemapFresh:
+		r.policy.SitemapFresh++
+		return
+	case fr.ExtensionDenied:
+		r.policy.ExtensionDenied++
+		return
+	}
+
+	r.coverage.LinksRequested++
+	r.count(MetricLinksRequested, 1)
+	if fr.FetchError != nil {
+		r.errors.FetchErrors++
+		r.count(MetricFetchErrors, 1)
+		if fr.FetchError == errContentTooLarge {
+			r.policy.SizeRejected++
+		}
+		if IsHeaderLimitError(fr.FetchError) {
+			r.errors.HeaderLimitErrors++
+			r.count(MetricHeaderLimitErrors, 1)
+		}
+		return
+	}
+	if fr.Response == nil {
+		return
+	}
+
+	r.coverage.LinksFetched++
+	r.count(MetricLinksFetched, 1)
+	r.count(MetricBytes, fr.ContentSize)
+	if fr.ResponseTime > 0 {
+		Observe(r.metrics, MetricFetchSeconds, fr.ResponseTime.Seconds())
+	}
+	r.coverage.Bytes += fr.ContentSize
+	r.bytes[dom] += fr.ContentSize
+	r.errors.Statuses[strconv.Itoa(fr.Response.StatusCode)]++
+	switch {
+	case fr.Response.StatusCode >= 500:
+		r.errors.ServerErrors++
+	case fr.Response.StatusCode >= 400:
+		r.errors.ClientErrors++
+	}
+	if fr.ParseError != nil {
+		r.errors.ParseErrors++
+		r.count(MetricParseErrors, 1)
+	}
+	if fr.HandlerError != nil {
+		r.errors.HandlerErrors++
+		r.count(MetricHandlerErrors, 1)
+		if fr.HandlerRetry {
+			r.errors.HandlerRetries++
+		}
+	}
+	if fr.MetaNoIndex {
+		r.policy.MetaNoIndex++
+	}
+	if fr.Partial {
+		r.policy.PartialFetches++
+	}
+	if fr.Unchanged && Config.Fetcher.Differential {
+		r.coverage.LinksUnchanged++
+	}
+	if fr.MimeType != "" {
+		r.contentTypes[fr.MimeType]++
+	}
+}
+
+// report returns a CrawlReport of everything recorded so far
+func (r *crawlReporter) report() *CrawlReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node, _ := os.Hostname()
+	rep := &CrawlReport{
+		Format:        crawlReportFormat,
+		Version:       crawlReportVersion,
+		Node:          node,
+		Started:       r.started,
+		Generated:     time.Now(),
+		Coverage:      r.coverage,
+		Errors:        r.errors,
+		Policy:        r.policy,
+		DNS:           r.dns,
+		BytesByDomain: map[string]int64{},
+	}
+	rep.Coverage.Domains = len(r.domains)
+	rep.Coverage.DomainsCompleted = r.completed
+	if r.dns.DoHLookups > 0 {
+		rep.DNS.DoHMeanMillis = r.dohMillis / int64(r.dns.DoHLookups)
+	}
+
+	rep.Errors.Statuses = map[string]int{}
+	for status, n := range r.errors.Statuses {
+		rep.Errors.Statuses[status] = n
+	}
+	rep.Policy.RobotsDecisions = map[string]int{}
+	for decision, n := range r.policy.RobotsDecisions {
+		rep.Policy.RobotsDecisions[decision] = n
+	}
+	for dom, n := range r.bytes {
+		rep.BytesByDomain[dom] = n
+	}
+
+	rep.TopContentTypes = []ReportCount{}
+	for name, n := range r.contentTypes {
+		rep.TopContentTypes = append(rep.TopContentTypes, ReportCount{Name: name, Count: n})
+	}
+	sort.Sort(reportCountsByCount(rep.TopContentTypes))
+	if len(rep.TopContentTypes) > Config.Fetcher.ReportTopContentTypes {
+		rep.TopContentTypes = rep.TopContentTypes[:Config.Fetcher.ReportTopContentTypes]
+	}
+	return rep
+}
+
+// reportCountsByCount sorts by descending count, then by name
+type reportCountsByCount []ReportCount
+
+func (s reportCountsByCount) Len() int      { return len(s) }
+func (s reportCountsByCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s reportCountsByCount) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Name < s[j].Name
+}
+
+// WriteFile writes r as indented JSON to path. The file is replaced
+// atomically, so a reader never sees a partial report.
+func (r *CrawlReport) WriteFile(path string) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode crawl report: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Failed to write crawl report: %v", err)
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Failed to write crawl report: %v", err)
+	}
+	return nil
+}
+
+// Report returns a CrawlReport of the fetches made since the FetchManager
+// started. It returns nil if it hasn't been started.
+func (fm *FetchManager) Report() *CrawlReport {
+	if fm.reporter == nil {
+		return nil
+	}
+	return fm.reporter.report()
+}
+
+// WriteReport writes the current Report to fetcher.report_file. It does
+// nothing if no report file is configured.
+func (fm *FetchManager) WriteReport() error {
+	if Config.Fetcher.ReportFile == "" {
+		return nil
+	}
+	r := fm.Report()
+	if r == nil {
+		return fmt.Errorf("Cannot report on a FetchManager that has not been started")
+	}
+	if err := r.WriteFile(Config.Fetcher.ReportFile); err != nil {
+		return err
+	}
+	log4go.Info("Wrote crawl report to %v", Config.Fetcher.ReportFile)
+	return nil
+}
@@ -0,0 +1,111 @@
+package walker
+
+import (
+	"fmt"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/temoto/robotstxt.go"
+)
+
+// The robots.txt error policy (fetcher.robots_error_policy) decides what a
+// fetcher does when it can't get a host's robots.txt. Walker has always
+// assumed a host without a readable robots.txt allows everything, whatever
+// the reason. RFC 9309 asks crawlers to tell the failures apart: a robots.txt
+// that is missing (4xx) allows everything, but one the server failed to serve
+// (5xx) must be taken to disallow everything, and one that couldn't be reached
+// at all should be retried before giving up. Under the rfc policy a fetcher
+// retries unreachable robots.txt files with backoff, and holds back a host
+// whose robots.txt answered 5xx or stayed unreachable: the claimed domain is
+// quarantined for fetcher.robots_unavailable_backoff, and links to any other
+// host are left in the segment for a later crawl.
+
+// The fetcher.robots_error_policy values
+const (
+	RobotsErrorPolicyAllow = "allow"
+	RobotsErrorPolicyRFC   = "rfc"
+)
+
+// The decisions a fetcher takes about the robots.txt of each host it crawls,
+// counted in CrawlReport.Policy.RobotsDecisions
+const (
+	// The robots.txt was fetched and its rules are followed
+	RobotsDecisionFetched = "fetched"
+
+	// The robots.txt handed over in the domain's HostContext is used
+	RobotsDecisionHandedOver = "handed_over"
+
+	// The host has no robots.txt (it answered 4xx), so everything is allowed
+	RobotsDecisionMissing = "missing"
+
+	// The robots.txt couldn't be fetched, but the allow policy assumes
+	// everything is allowed
+	RobotsDecisionAssumedAllowed = "assumed_allowed"
+
+	// The robots.txt answered 5xx, or couldn't be reached after
+	// fetcher.robots_fetch_retries retries, so the rfc policy holds the host
+	// back
+	RobotsDecisionUnavailable = "unavailable"
+	RobotsDecisionUnreachable = "unreachable"
+)
+
+// decideRobots returns the robotstxt.Group to crawl host by, or nil if the
+// host is to be held back, recording the decision taken
+func (f *fetcher) decideRobots(host string) *robotstxt.Group {
+	grp, decision := f.getRobots(host)
+	log4go.Info("robots.txt decision for %v (claimed %v): %v", host, f.host, decision)
+	f.fm.reporter.robotsDecision(decision)
+	return grp
+}
+
+// getRobotsTxt GETs the robots.txt at u, returning its status and, for a 2xx
+// status, its body. Under the rfc policy a request that fails without a
+// response is retried fetcher.robots_fetch_retries times, waiting
+// fetcher.robots_retry_backoff before the first retry and twice as long
+// before each one after that.
+func (f *fetcher) getRobotsTxt(u *URL) (int, []byte, error) {
+	retries, backoff := 0, f.fm.robotsRetryBackoff
+	if Config.Fetcher.RobotsErrorPolicy == RobotsErrorPolicyRFC {
+		retries = Config.Fetcher.RobotsFetchRetries
+	}
+	for try := 0; ; try++ {
+		status, body, err := f.tryRobotsTxt(u)
+		if err == nil || try >= retries {
+			return status, body, err
+		}
+		log4go.Debug("Could not fetch %v, retrying in %v (error: %v)", u, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-f.quit:
+			return 0, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+func (f *fetcher) tryRobotsTxt(u *URL) (int, []byte, error) {
+	res, _, err := f.fetch(u)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, nil, nil
+	}
+	body, err := readCapped(res.Body, Config.Fetcher.MaxRobotsBytes)
+	if err == errOverLimit {
+		f.overLimit(u.Host, u.String(), Config.Fetcher.MaxRobotsBytes)
+		body = truncateRobots(body)
+	} else if err != nil {
+		return 0, nil, fmt.Errorf("Error reading robots.txt: %v", err)
+	}
+	return res.StatusCode, body, nil
+}
+
+// holdBackHost quarantines the claimed domain for
+// fetcher.robots_unavailable_backoff, since its robots.txt couldn't be had
+func (f *fetcher) holdBackHost() {
+	until := time.Now().Add(f.fm.robotsUnavailableBackoff)
+	log4go.Warn("robots.txt of %v is unavailable, holding it back until %v", f.host, until)
+	f.fm.Datastore.QuarantineHost(f.host, until)
+}
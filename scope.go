@@ -0,0 +1,131 @@
+package walker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The CrawlScope modes
+const (
+	// Keep every link (subject to cassandra.add_new_domains and the link
+	// filters); the scope of domains that haven't been given one
+	ScopeAll = "all"
+
+	// Keep links on the same host as the page they were found on
+	ScopeHost = "host"
+
+	// Keep links on the same domain (TLD+1) as the page, on any subdomain
+	ScopeDomain = "domain"
+
+	// Keep links on the domain itself and on the subdomains listed
+	ScopeSubdomains = "subdomains"
+
+	// Keep links matching a regular expression
+	ScopeCustom = "custom"
+)
+
+// CrawlScope decides which of the links found on the pages of a domain stay
+// in the crawl. Each domain can be given its own (see
+// cassandra.DomainInfo.Scope), so a seed can be crawled without following
+// links off it, without global exclude_link_patterns.
+type CrawlScope struct {
+	// One of the Scope* modes; empty is taken as ScopeAll
+	Mode string
+
+	// With ScopeSubdomains, the subdomains whose links are kept besides the
+	// domain's own, ex. "www" or "docs.api"
+	Subdomains []string
+
+	// With ScopeCustom, the regular expression the links kept must match
+	// (anywhere in the link, unless anchored)
+	Pattern string
+
+	re *regexp.Regexp
+}
+
+// Compile checks s, and readies its Pattern for Allows. It normalizes
+// Subdomains to lower case, without surrounding dots.
+func (s *CrawlScope) Compile() error {
+	s.re = nil
+	switch s.Mode {
+	case "", ScopeAll, ScopeHost, ScopeDomain:
+	case ScopeSubdomains:
+		var subs []string
+		for _, sub := range s.Subdomains {
+			sub = strings.Trim(strings.ToLower(strings.TrimSpace(sub)), ".")
+			if sub != "" {
+				subs = append(subs, sub)
+			}
+		}
+		if len(subs) == 0 {
+			return fmt.Errorf("Scope %v needs at least one subdomain", s.Mode)
+		}
+		sort.Strings(subs)
+		s.Subdomains = subs
+	case ScopeCustom:
+		if s.Pattern == "" {
+			return fmt.Errorf("Scope %v needs a pattern", s.Mode)
+		}
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("Bad scope pattern %q: %v", s.Pattern, err)
+		}
+		s.re = re
+	default:
+		return fmt.Errorf("Unknown scope %q, expected one of (%v, %v, %v, %v, %v)", s.Mode,
+			ScopeAll, ScopeHost, ScopeDomain, ScopeSubdomains, ScopeCustom)
+	}
+	return nil
+}
+
+// Allows returns true if link, found on page, is in scope
+func (s *CrawlScope) Allows(link, page *URL) bool {
+	switch s.Mode {
+	case ScopeHost:
+		return strings.EqualFold(link.Host, page.Host)
+	case ScopeDomain, ScopeSubdomains:
+		dom, sub, err := link.TLDPlusOneAndSubdomain()
+		if err != nil {
+			return false
+		}
+		pageDom, err := page.ToplevelDomainPlusOne()
+		if err != nil || !strings.EqualFold(dom, pageDom) {
+			return false
+		}
+		if s.Mode == ScopeDomain || sub == "" {
+			return true
+		}
+		sub = strings.ToLower(sub)
+		for _, allowed := range s.Subdomains {
+			if sub == allowed {
+				return true
+			}
+		}
+		return false
+	case ScopeCustom:
+		if s.re == nil {
+			if err := s.Compile(); err != nil {
+				return false
+			}
+		}
+		return s.re.MatchString(link.String())
+	default:
+		return true
+	}
+}
+
+// String describes s, ex. "subdomains (www, blog)"
+func (s CrawlScope) String() string {
+	switch s.Mode {
+	case "":
+		return ScopeAll
+	case ScopeSubdomains:
+		return fmt.Sprintf("%v (%v)", s.Mode, strings.Join(s.Subdomains, ", "))
+	case ScopeCustom:
+		return fmt.Sprintf("%v (%v)", s.Mode, s.Pattern)
+	default:
+		return s.Mode
+	}
+}
@@ -0,0 +1,63 @@
+package walker
+
+import "testing"
+
+func TestCrawlScopeAllows(t *testing.T) {
+	page := MustParse("http://www.test.com/index.html")
+	tests := []struct {
+		scope CrawlScope
+		link  string
+		allow bool
+	}{
+		{CrawlScope{}, "http://other.com/", true},
+		{CrawlScope{Mode: ScopeAll}, "http://other.com/", true},
+
+		{CrawlScope{Mode: ScopeHost}, "http://www.test.com/a.html", true},
+		{CrawlScope{Mode: ScopeHost}, "http://WWW.test.com/a.html", true},
+		{CrawlScope{Mode: ScopeHost}, "http://test.com/a.html", false},
+		{CrawlScope{Mode: ScopeHost}, "http://docs.test.com/a.html", false},
+
+		{CrawlScope{Mode: ScopeDomain}, "http://test.com/a.html", true},
+		{CrawlScope{Mode: ScopeDomain}, "http://deep.docs.test.com/a.html", true},
+		{CrawlScope{Mode: ScopeDomain}, "http://test.co.uk/a.html", false},
+		{CrawlScope{Mode: ScopeDomain}, "http://other.com/a.html", false},
+
+		{CrawlScope{Mode: ScopeSubdomains, Subdomains: []string{"docs"}}, "http://test.com/a.html", true},
+		{CrawlScope{Mode: ScopeSubdomains, Subdomains: []string{"docs"}}, "http://docs.test.com/a.html", true},
+		{CrawlScope{Mode: ScopeSubdomains, Subdomains: []string{"docs"}}, "http://blog.test.com/a.html", false},
+		{CrawlScope{Mode: ScopeSubdomains, Subdomains: []string{"docs"}}, "http://docs.other.com/a.html", false},
+
+		{CrawlScope{Mode: ScopeCustom, Pattern: `^https?://[^/]*test\.com/docs/`}, "http://test.com/docs/a.html", true},
+		{CrawlScope{Mode: ScopeCustom, Pattern: `^https?://[^/]*test\.com/docs/`}, "http://test.com/blog/a.html", false},
+	}
+	for _, test := range tests {
+		if err := test.scope.Compile(); err != nil {
+			t.Errorf("Failed to compile scope %v: %v", test.scope.String(), err)
+			continue
+		}
+		if allow := test.scope.Allows(MustParse(test.link), page); allow != test.allow {
+			t.Errorf("Scope %v allowing %v: expected %v, got %v", test.scope.String(), test.link, test.allow, allow)
+		}
+	}
+}
+
+func TestCrawlScopeCompile(t *testing.T) {
+	s := CrawlScope{Mode: ScopeSubdomains, Subdomains: []string{" WWW ", "", ".docs."}}
+	if err := s.Compile(); err != nil {
+		t.Fatalf("Failed to compile %v: %v", s.String(), err)
+	}
+	if s.String() != "subdomains (docs, www)" {
+		t.Errorf("Expected subdomains normalized to (docs, www), got %v", s.String())
+	}
+
+	for _, bad := range []CrawlScope{
+		{Mode: "tld"},
+		{Mode: ScopeSubdomains},
+		{Mode: ScopeCustom},
+		{Mode: ScopeCustom, Pattern: "("},
+	} {
+		if err := bad.Compile(); err == nil {
+			t.Errorf("Expected scope %#v to be rejected", bad)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package walker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// Screenshot capture is for visual QA of crawled pages. For pages whose URL
+// matches one of screenshots.patterns, once walker has fetched the page it
+// asks a headless browser rendering service (screenshots.renderer_url) for a
+// screenshot of it, and makes a thumbnail. Both are handed to the datastore
+// in FetchResults.Screenshot.
+//
+// Only pages walker fetched itself are captured, so robots.txt is honored,
+// and pages marked noindex are skipped. The renderer loads the page again
+// (along with its resources) right after walker's own fetch.
+//
+// The renderer is sent a POST with a JSON body:
+//
+//	{"url": "http://...", "width": 1280, "height": 800, "user_agent": "..."}
+//
+// and must answer 200 with the image (ex. image/png) as the body.
+
+// Screenshot is a rendering of a fetched page
+type Screenshot struct {
+	// When the screenshot was taken
+	Time time.Time
+
+	// The Content-Type of Image, as given by the renderer
+	MimeType string
+
+	// The screenshot, and a PNG thumbnail of it screenshots.thumbnail_width
+	// pixels wide
+	Image     []byte
+	Thumbnail []byte
+}
+
+// screenshotter requests screenshots from the configured renderer
+type screenshotter struct {
+	rendererURL string
+	client      *http.Client
+	patterns    []*regexp.Regexp
+}
+
+// newScreenshotter returns a screenshotter for Config.Screenshots, or nil if
+// no renderer is configured
+func newScreenshotter() (*screenshotter, error) {
+	cfg := &Config.Screenshots
+	if cfg.RendererURL == "" {
+		return nil, nil
+	}
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Bad screenshots.timeout: %v", err)
+	}
+	s := &screenshotter{
+		rendererURL: cfg.RendererURL,
+		client:      &http.Client{Timeout: timeout},
+	}
+	for _, p := range cfg.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("Bad screenshots.patterns entry %q: %v", p, err)
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s, nil
+}
+
+// wants returns true if the page fetched in fr should be captured
+func (s *screenshotter) wants(fr *FetchResults) bool {
+	if s == nil || fr.Response == nil || fr.Response.StatusCode != http.StatusOK || !isHTML(fr.Response) {
+		return false
+	}
+	if fr.MetaNoIndex {
+		return false
+	}
+	link := fr.URL.String()
+	for _, re := range s.patterns {
+		if re.MatchString(link) {
+			return true
+		}
+	}
+	return false
+}
+
+// capture requests a screenshot of u from the renderer
+func (s *screenshotter) capture(u *URL) (*Screenshot, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"url":        u.String(),
+		"width":      Config.Screenshots.Width,
+		"height":     Config.Screenshots.Height,
+		"user_agent": Config.Fetcher.UserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	shot := &Screenshot{Time: time.Now()}
+	res, err := s.client.Post(s.rendererURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Screenshot request failed: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Renderer answered %v", res.Status)
+	}
+
+	max := Config.Fetcher.MaxHTTPContentSizeBytes
+	shot.Image, err = ioutil.ReadAll(io.LimitReader(res.Body, max+1))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read screenshot: %v", err)
+	}
+	if int64(len(shot.Image)) > max {
+		return nil, fmt.Errorf("Screenshot larger than %v bytes", max)
+	}
+	shot.MimeType = res.Header.Get("Content-Type")
+	shot.Thumbnail, err = makeThumbnail(shot.Image, Config.Screenshots.ThumbnailWidth)
+	if err != nil {
+		return nil, err
+	}
+	return shot, nil
+}
+
+// captureScreenshot sets fr.Screenshot if the page should be captured. A
+// failed capture is logged and otherwise ignored.
+func (f *fetcher) captureScreenshot(fr *FetchResults) {
+	if !f.fm.screenshots.wants(fr) {
+		return
+	}
+	log4go.Fine("Capturing screenshot of %v", fr.URL)
+	shot, err := f.fm.screenshots.capture(fr.URL)
+	if err != nil {
+		log4go.Error("Failed to capture screenshot of %v: %v", fr.URL, err)
+		return
+	}
+	fr.Screenshot = shot
+}
+
+// makeThumbnail scales the image img down to width pixels wide (keeping its
+// aspect ratio), returning it as a PNG. Images no wider than width are only
+// re-encoded.
+func makeThumbnail(img []byte, width int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode screenshot: %v", err)
+	}
+	b := src.Bounds()
+	if b.Dx() > width {
+		src = scaleImage(src, width, (b.Dy()*width+b.Dx()/2)/b.Dx())
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		return nil, fmt.Errorf("Failed to encode thumbnail: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage shrinks src to width x height, averaging the source pixels that
+// fall in each destination pixel
+func scaleImage(src image.Image, width, height int) image.Image {
+	if height < 1 {
+		height = 1
+	}
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := b.Min.Y + y*b.Dy()/height
+		y1 := b.Min.Y + (y+1)*b.Dy()/height
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0 := b.Min.X + x*b.Dx()/width
+			x1 := b.Min.X + (x+1)*b.Dx()/width
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+pr, g+pg, bl+pb, a+pa, n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
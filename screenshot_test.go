@@ -0,0 +1,116 @@
+package walker
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+)
+
+// testPNG returns a width x height PNG, white on the left half and black on
+// the right
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode test PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	tests := []struct {
+		width, height int
+		thumbWidth    int
+		expectedW     int
+		expectedH     int
+	}{
+		{1280, 800, 320, 320, 200},
+		{640, 2000, 160, 160, 500},
+		{200, 100, 320, 200, 100},
+		{1000, 1, 100, 100, 1},
+	}
+	for _, test := range tests {
+		thumb, err := makeThumbnail(testPNG(t, test.width, test.height), test.thumbWidth)
+		if err != nil {
+			t.Errorf("makeThumbnail of %dx%d failed: %v", test.width, test.height, err)
+			continue
+		}
+		img, err := png.Decode(bytes.NewReader(thumb))
+		if err != nil {
+			t.Errorf("Thumbnail of %dx%d isn't a PNG: %v", test.width, test.height, err)
+			continue
+		}
+		b := img.Bounds()
+		if b.Dx() != test.expectedW || b.Dy() != test.expectedH {
+			t.Errorf("Thumbnail of %dx%d got %dx%d, expected %dx%d", test.width, test.height,
+				b.Dx(), b.Dy(), test.expectedW, test.expectedH)
+		}
+		left, _, _, _ := img.At(0, 0).RGBA()
+		right, _, _, _ := img.At(b.Dx()-1, 0).RGBA()
+		if left != 0xffff || right != 0 {
+			t.Errorf("Thumbnail of %dx%d lost its halves: left %x, right %x", test.width, test.height, left, right)
+		}
+	}
+
+	if _, err := makeThumbnail([]byte("not an image"), 320); err == nil {
+		t.Errorf("Expected makeThumbnail of a non-image to fail")
+	}
+}
+
+func TestScreenshotterWants(t *testing.T) {
+	origURL, origPatterns := Config.Screenshots.RendererURL, Config.Screenshots.Patterns
+	defer func() { Config.Screenshots.RendererURL, Config.Screenshots.Patterns = origURL, origPatterns }()
+
+	Config.Screenshots.RendererURL = ""
+	s, err := newScreenshotter()
+	if err != nil || s != nil {
+		t.Fatalf("Expected no screenshotter without a renderer, got %v, %v", s, err)
+	}
+
+	Config.Screenshots.RendererURL = "http://renderer.local/screenshot"
+	Config.Screenshots.Patterns = []string{`^https?://a\.com/products/`}
+	s, err = newScreenshotter()
+	if err != nil {
+		t.Fatalf("Failed to create screenshotter: %v", err)
+	}
+
+	page := func(link string, status int, mime string, noindex bool) *FetchResults {
+		return &FetchResults{
+			URL: MustParse(link),
+			Response: &http.Response{
+				StatusCode: status,
+				Header:     http.Header{"Content-Type": []string{mime}},
+			},
+			MetaNoIndex: noindex,
+		}
+	}
+	tests := []struct {
+		tag      string
+		fr       *FetchResults
+		expected bool
+	}{
+		{"match", page("http://a.com/products/1", 200, "text/html", false), true},
+		{"no match", page("http://a.com/about", 200, "text/html", false), false},
+		{"not ok", page("http://a.com/products/1", 404, "text/html", false), false},
+		{"not html", page("http://a.com/products/1.pdf", 200, "application/pdf", false), false},
+		{"noindex", page("http://a.com/products/1", 200, "text/html", true), false},
+		{"no response", &FetchResults{URL: MustParse("http://a.com/products/1")}, false},
+	}
+	for _, test := range tests {
+		if got := s.wants(test.fr); got != test.expected {
+			t.Errorf("wants for %v got %v, expected %v", test.tag, got, test.expected)
+		}
+	}
+}
@@ -6,4 +6,4 @@ cd "$( dirname "${BASH_SOURCE[0]}" )/.."
 # -p 1 ensures that multiple test binaries from different subpackages don't run
 # in parallel. We need this because multiple packages test with the local
 # cassandra instance and can conflict.
-sudo -E $(which go) test -p 1 -tags "sudo cassandra" -cover ./...
+sudo -E $(which go) test -p 1 -tags "sudo cassandra pdf" -cover ./...
@@ -0,0 +1,312 @@
+package walker
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"code.google.com/p/go.net/html"
+)
+
+// A small selector engine for watch rules, supporting the common subset of
+// CSS selectors and XPath: element names (or *), ids, classes and attribute
+// tests, joined by descendant and child steps. CSS selectors may be grouped
+// with commas.
+
+// selStep matches one element of a selector
+type selStep struct {
+	// True if the element must be a child of the one matched by the previous
+	// step (or, for the first step, of the document root); otherwise any
+	// descendant will do
+	child bool
+
+	// The element name, or "" for any
+	tag string
+
+	id      string
+	classes []string
+	attrs   []selAttr
+}
+
+// selAttr tests an attribute: that it is set, or that it has value
+type selAttr struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+// selector is a compiled selector, a list of alternatives
+type selector [][]selStep
+
+// parseCSSSelector compiles a CSS selector like "div#main > p.price" or
+// "span[itemprop=price], .price"
+func parseCSSSelector(s string) (selector, error) {
+	var sel selector
+	for _, group := range strings.Split(s, ",") {
+		steps, err := parseCSSGroup(strings.TrimSpace(group))
+		if err != nil {
+			return nil, fmt.Errorf("bad CSS selector %q: %v", s, err)
+		}
+		sel = append(sel, steps)
+	}
+	return sel, nil
+}
+
+func parseCSSGroup(s string) ([]selStep, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty selector")
+	}
+	var steps []selStep
+	child := false
+	for s != "" {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		if strings.HasPrefix(s, ">") {
+			if child || len(steps) == 0 {
+				return nil, fmt.Errorf("misplaced >")
+			}
+			child = true
+			s = s[1:]
+			continue
+		}
+		if s == "" {
+			break
+		}
+		st := selStep{child: child}
+		child = false
+		n, err := parseCSSCompound(s, &st)
+		if err != nil {
+			return nil, err
+		}
+		s = s[n:]
+		steps = append(steps, st)
+	}
+	if child {
+		return nil, fmt.Errorf("selector ends with >")
+	}
+	return steps, nil
+}
+
+// parseCSSCompound parses one compound selector (ex. "a.b[c]") off the front
+// of s into st, returning the number of bytes read
+func parseCSSCompound(s string, st *selStep) (int, error) {
+	i := 0
+	if i < len(s) && s[i] == '*' {
+		i++
+	} else {
+		n := cssIdentLen(s[i:])
+		st.tag = strings.ToLower(s[i : i+n])
+		i += n
+	}
+	for i < len(s) {
+		switch s[i] {
+		case '#', '.':
+			n := cssIdentLen(s[i+1:])
+			if n == 0 {
+				return 0, fmt.Errorf("expected a name after %c", s[i])
+			}
+			if s[i] == '#' {
+				st.id = s[i+1 : i+1+n]
+			} else {
+				st.classes = append(st.classes, s[i+1:i+1+n])
+			}
+			i += 1 + n
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return 0, fmt.Errorf("unclosed [")
+			}
+			a, err := parseAttrTest(s[i+1:i+end], "")
+			if err != nil {
+				return 0, err
+			}
+			st.attrs = append(st.attrs, a)
+			i += end + 1
+		default:
+			if i == 0 {
+				return 0, fmt.Errorf("unexpected %q", s[i])
+			}
+			if !unicode.IsSpace(rune(s[i])) && s[i] != '>' {
+				return 0, fmt.Errorf("unexpected %q", s[i])
+			}
+			return i, nil
+		}
+	}
+	if i == 0 {
+		return 0, fmt.Errorf("empty selector")
+	}
+	return i, nil
+}
+
+// cssIdentLen returns the length of the name at the start of s
+func cssIdentLen(s string) int {
+	for i, r := range s {
+		if !(unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// parseAttrTest parses an attribute test like `name`, `name=value` or
+// `name="value"`, with prefix (ex. "@" for XPath) before the name
+func parseAttrTest(s, prefix string) (selAttr, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return selAttr{}, fmt.Errorf("unsupported test [%v]", s)
+	}
+	s = s[len(prefix):]
+	parts := strings.SplitN(s, "=", 2)
+	a := selAttr{name: strings.ToLower(strings.TrimSpace(parts[0]))}
+	if a.name == "" || cssIdentLen(a.name) != len(a.name) {
+		return selAttr{}, fmt.Errorf("bad attribute name in [%v]", s)
+	}
+	if len(parts) == 2 {
+		a.hasValue = true
+		a.value = strings.TrimSpace(parts[1])
+		if len(a.value) >= 2 && (a.value[0] == '"' || a.value[0] == '\'') && a.value[len(a.value)-1] == a.value[0] {
+			a.value = a.value[1 : len(a.value)-1]
+		}
+	}
+	return a, nil
+}
+
+// parseXPath compiles an XPath location path like
+// "//div[@id='main']/span[@class='price']"
+func parseXPath(s string) (selector, error) {
+	if !strings.HasPrefix(s, "/") {
+		return nil, fmt.Errorf("bad XPath %q: must start with / or //", s)
+	}
+	var steps []selStep
+	rest := s
+	for rest != "" {
+		st := selStep{child: true}
+		if strings.HasPrefix(rest, "//") {
+			st.child = false
+			rest = rest[2:]
+		} else if strings.HasPrefix(rest, "/") {
+			rest = rest[1:]
+		} else {
+			return nil, fmt.Errorf("bad XPath %q: expected /", s)
+		}
+
+		end := strings.IndexAny(rest, "/[")
+		if end < 0 {
+			end = len(rest)
+		}
+		name := rest[:end]
+		rest = rest[end:]
+		if name != "*" {
+			if name == "" || cssIdentLen(name) != len(name) {
+				return nil, fmt.Errorf("bad XPath %q: unsupported step %q", s, name)
+			}
+			st.tag = strings.ToLower(name)
+		}
+		for strings.HasPrefix(rest, "[") {
+			stop := strings.IndexByte(rest, ']')
+			if stop < 0 {
+				return nil, fmt.Errorf("bad XPath %q: unclosed [", s)
+			}
+			a, err := parseAttrTest(rest[1:stop], "@")
+			if err != nil {
+				return nil, fmt.Errorf("bad XPath %q: %v", s, err)
+			}
+			st.attrs = append(st.attrs, a)
+			rest = rest[stop+1:]
+		}
+		steps = append(steps, st)
+	}
+	return selector{steps}, nil
+}
+
+// matches returns true if n matches st, ignoring how it is combined with the
+// other steps
+func (st *selStep) matches(n *html.Node) bool {
+	if n.Type != html.ElementNode || (st.tag != "" && n.Data != st.tag) {
+		return false
+	}
+	if st.id != "" && nodeAttr(n, "id") != st.id {
+		return false
+	}
+	for _, c := range st.classes {
+		if !containsString(strings.Fields(nodeAttr(n, "class")), c) {
+			return false
+		}
+	}
+	for _, a := range st.attrs {
+		v, ok := nodeAttrOK(n, a.name)
+		if !ok || (a.hasValue && v != a.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchAt returns true if n matches steps[i], with its ancestors matching the
+// steps before it
+func matchAt(steps []selStep, n *html.Node, i int) bool {
+	st := &steps[i]
+	if !st.matches(n) {
+		return false
+	}
+	if i == 0 {
+		return !st.child || (n.Parent != nil && n.Parent.Type == html.DocumentNode)
+	}
+	if st.child {
+		return n.Parent != nil && matchAt(steps, n.Parent, i-1)
+	}
+	for p := n.Parent; p != nil; p = p.Parent {
+		if matchAt(steps, p, i-1) {
+			return true
+		}
+	}
+	return false
+}
+
+// find returns the elements under root matched by sel, in document order
+func (sel selector) find(root *html.Node) []*html.Node {
+	var found []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		for _, steps := range sel {
+			if matchAt(steps, n, len(steps)-1) {
+				found = append(found, n)
+				break
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(root)
+	return found
+}
+
+// nodeText returns the text inside n with runs of whitespace collapsed
+func nodeText(n *html.Node) string {
+	var parts []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			parts = append(parts, n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(strings.Join(parts, " ")), " ")
+}
+
+func nodeAttr(n *html.Node, name string) string {
+	v, _ := nodeAttrOK(n, name)
+	return v
+}
+
+func nodeAttrOK(n *html.Node, name string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,80 @@
+package walker
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"code.google.com/p/go.net/html"
+)
+
+const selectorTestPage = `<html><body>
+<div id="main" class="product featured">
+	<h1>Widget</h1>
+	<p class="price"><span itemprop="price">  9.99 </span> USD</p>
+	<div class="stock"><span>In stock</span></div>
+</div>
+<div id="related">
+	<p class="price">19.99</p>
+	<a href="/other" rel="nofollow">Other</a>
+</div>
+</body></html>`
+
+func TestSelectorFind(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(selectorTestPage))
+	if err != nil {
+		t.Fatalf("Failed to parse test page: %v", err)
+	}
+
+	tests := []struct {
+		css      string
+		xpath    string
+		expected []string
+	}{
+		{css: "h1", xpath: "//h1", expected: []string{"Widget"}},
+		{css: "p.price", xpath: "//p[@class='price']", expected: []string{"9.99 USD", "19.99"}},
+		{css: "#main .price", xpath: "//div[@id='main']//p", expected: []string{"9.99 USD"}},
+		{css: "div#main > p > span", xpath: "//div[@id=\"main\"]/p/span", expected: []string{"9.99"}},
+		{css: "span[itemprop=price]", xpath: "//span[@itemprop='price']", expected: []string{"9.99"}},
+		{css: "div.product.featured > h1", xpath: "/html/body/div/h1", expected: []string{"Widget"}},
+		{css: "a[rel], #related > a", xpath: "//*[@rel]", expected: []string{"Other"}},
+		{css: "#related .price, #main > .price", xpath: "//body/div/*[@class='price']",
+			expected: []string{"9.99 USD", "19.99"}},
+		{css: "#main > span", xpath: "/body", expected: nil},
+	}
+	texts := func(sel selector) []string {
+		var found []string
+		for _, n := range sel.find(doc) {
+			found = append(found, nodeText(n))
+		}
+		return found
+	}
+	for _, test := range tests {
+		sel, err := parseCSSSelector(test.css)
+		if err != nil {
+			t.Errorf("Failed to parse CSS selector %q: %v", test.css, err)
+		} else if got := texts(sel); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("CSS selector %q found %q, expected %q", test.css, got, test.expected)
+		}
+
+		sel, err = parseXPath(test.xpath)
+		if err != nil {
+			t.Errorf("Failed to parse XPath %q: %v", test.xpath, err)
+		} else if got := texts(sel); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("XPath %q found %q, expected %q", test.xpath, got, test.expected)
+		}
+	}
+}
+
+func TestSelectorParseErrors(t *testing.T) {
+	for _, css := range []string{"", "p,", "> p", "p >", "p >> a", "p.", "#", "p[a", "p[=b]", "p:first-child"} {
+		if _, err := parseCSSSelector(css); err == nil {
+			t.Errorf("Expected CSS selector %q to fail to parse", css)
+		}
+	}
+	for _, xpath := range []string{"", "p", "//", "//p[", "//p[a]", "//p[position()=1]", "//text()"} {
+		if _, err := parseXPath(xpath); err == nil {
+			t.Errorf("Expected XPath %q to fail to parse", xpath)
+		}
+	}
+}
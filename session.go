@@ -0,0 +1,266 @@
+package walker
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// Session bootstraps (sessions.bootstraps) let walker crawl sites behind a
+// login, such as intranets. When a fetcher claims a domain with a bootstrap,
+// it first logs in, either by making a configured sequence of requests (ex.
+// GET the login page, then POST the login form) or by running an operator's
+// script that prints the session cookies. The cookies that result are sent
+// with every fetch of that claim (along with any the site sets while it is
+// crawled), and thrown away when the domain is unclaimed, so each claim logs
+// in afresh.
+//
+// Credentials needn't be written in the config file: form values and headers
+// may use ${ENV_VAR} and file:///path references (see resolveConfigRefs).
+
+// SessionBootstrap is one sessions.bootstraps entry
+type SessionBootstrap struct {
+	// The domain (top level domain plus one, ex. "example.com") to log in to
+	Domain string `yaml:"domain"`
+
+	// The requests to make, in order (set either Steps or Command)
+	Steps []SessionStep `yaml:"steps"`
+
+	// A command run with sh -c, with WALKER_DOMAIN set to the domain. It
+	// prints the session cookies on stdout, one per line, as name=value or in
+	// Set-Cookie form (ex. "sid=abc; Path=/"); cookies not given a Domain
+	// are sent to the domain and all its subdomains.
+	Command string `yaml:"command"`
+}
+
+// SessionStep is a request made to bootstrap a session
+type SessionStep struct {
+	// GET or POST; POST if empty and Form is set, GET otherwise
+	Method string `yaml:"method"`
+
+	URL string `yaml:"url"`
+
+	// Form values, sent url-encoded as the body of a POST or as the query of
+	// a GET
+	Form []SessionField `yaml:"form"`
+
+	// Extra request headers
+	Headers []SessionField `yaml:"headers"`
+
+	// The status the final response (after redirects) must have; any 2xx or
+	// 3xx if 0
+	ExpectStatus int `yaml:"expect_status"`
+}
+
+// SessionField is a name and value, for forms and headers
+type SessionField struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// method returns the HTTP method of s
+func (s *SessionStep) method() string {
+	if s.Method != "" {
+		return strings.ToUpper(s.Method)
+	}
+	if len(s.Form) > 0 {
+		return "POST"
+	}
+	return "GET"
+}
+
+// checkSessionBootstraps returns an error describing the first bad bootstrap
+// in bs
+func checkSessionBootstraps(bs []SessionBootstrap) error {
+	domains := map[string]bool{}
+	for i, b := range bs {
+		if b.Domain == "" {
+			return fmt.Errorf("bootstrap %d has no domain", i)
+		}
+		dom := strings.ToLower(b.Domain)
+		if domains[dom] {
+			return fmt.Errorf("domain %q has more than one bootstrap", b.Domain)
+		}
+		domains[dom] = true
+		if (len(b.Steps) == 0) == (b.Command == "") {
+			return fmt.Errorf("bootstrap for %q must set exactly one of steps and command", b.Domain)
+		}
+		for j, s := range b.Steps {
+			u, err := url.Parse(s.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("bootstrap for %q step %d: url must be an http(s) URL, got %q",
+					b.Domain, j, s.URL)
+			}
+			if m := s.method(); m != "GET" && m != "POST" {
+				return fmt.Errorf("bootstrap for %q step %d: method must be GET or POST, got %q",
+					b.Domain, j, s.Method)
+			}
+		}
+	}
+	return nil
+}
+
+// sessionBootstrapFor returns the configured bootstrap for dom, or nil
+func sessionBootstrapFor(dom string) *SessionBootstrap {
+	for i := range Config.Sessions.Bootstraps {
+		b := &Config.Sessions.Bootstraps[i]
+		if strings.EqualFold(b.Domain, dom) {
+			return b
+		}
+	}
+	return nil
+}
+
+// bootstrapSession logs in to host if it has a session bootstrap, setting the
+// cookie jar the fetcher uses for the claim. It returns false if logging in
+// failed, in which case the host shouldn't be crawled.
+func (f *fetcher) bootstrapSession(host string) bool {
+	f.httpclient.Jar = nil
+	b := sessionBootstrapFor(host)
+	if b == nil {
+		return true
+	}
+	jar, err := b.run(f.httpclient.Transport, f.fm.sessionTimeout)
+	if err != nil {
+		log4go.Error("Failed to bootstrap session for %v: %v", host, err)
+		return false
+	}
+	log4go.Info("Bootstrapped session for %v", host)
+	f.httpclient.Jar = jar
+	return true
+}
+
+// run performs b, returning a cookie jar holding the session. Steps are
+// requested through transport; each step, or the command, must finish within
+// timeout.
+func (b *SessionBootstrap) run(transport http.RoundTripper, timeout time.Duration) (http.CookieJar, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.Command != "" {
+		cookies, err := runSessionCommand(b.Command, b.Domain, timeout)
+		if err != nil {
+			return nil, err
+		}
+		setDomainCookies(jar, b.Domain, cookies)
+		return jar, nil
+	}
+
+	client := &http.Client{Transport: transport, Jar: jar, Timeout: timeout}
+	for i := range b.Steps {
+		if err := b.Steps[i].do(client); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+	return jar, nil
+}
+
+// do makes the request s describes with client
+func (s *SessionStep) do(client *http.Client) error {
+	form := url.Values{}
+	for _, fv := range s.Form {
+		form.Add(fv.Name, fv.Value)
+	}
+
+	var req *http.Request
+	var err error
+	if s.method() == "POST" {
+		req, err = http.NewRequest("POST", s.URL, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("GET", s.URL, nil)
+		if err == nil && len(form) > 0 {
+			q := req.URL.Query()
+			for k, vs := range form {
+				q[k] = append(q[k], vs...)
+			}
+			req.URL.RawQuery = q.Encode()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to create request for %v: %v", s.URL, err)
+	}
+	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
+	for _, h := range s.Headers {
+		req.Header.Set(h.Name, h.Value)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if s.ExpectStatus != 0 {
+		if res.StatusCode != s.ExpectStatus {
+			return fmt.Errorf("%v %v answered %v, expected %v", req.Method, s.URL, res.Status, s.ExpectStatus)
+		}
+	} else if res.StatusCode >= 400 {
+		return fmt.Errorf("%v %v answered %v", req.Method, s.URL, res.Status)
+	}
+	return nil
+}
+
+// runSessionCommand runs command for domain, returning the cookies it prints
+func runSessionCommand(command, domain string, timeout time.Duration) ([]*http.Cookie, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Env = append(os.Environ(), "WALKER_DOMAIN="+domain)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Run it in its own process group, so a timeout kills anything it started
+	// too (which would otherwise keep stdout open)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to run session command: %v", err)
+	}
+	timer := time.AfterFunc(timeout, func() { syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) })
+	err := cmd.Wait()
+	if !timer.Stop() {
+		return nil, fmt.Errorf("Session command timed out after %v", timeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Session command failed: %v: %v", err, strings.TrimSpace(stderr.String()))
+	}
+
+	header := http.Header{}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			header.Add("Set-Cookie", line)
+		}
+	}
+	cookies := (&http.Response{Header: header}).Cookies()
+	if len(cookies) == 0 {
+		return nil, fmt.Errorf("Session command printed no cookies")
+	}
+	return cookies, nil
+}
+
+// setDomainCookies puts cookies in jar for domain, making those without a
+// Domain apply to its subdomains too
+func setDomainCookies(jar http.CookieJar, domain string, cookies []*http.Cookie) {
+	for _, c := range cookies {
+		if c.Domain == "" {
+			c.Domain = domain
+		}
+		if c.Path == "" {
+			c.Path = "/"
+		}
+	}
+	for _, scheme := range []string{"http", "https"} {
+		jar.SetCookies(&url.URL{Scheme: scheme, Host: domain, Path: "/"}, cookies)
+	}
+}
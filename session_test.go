@@ -0,0 +1,158 @@
+package walker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckSessionBootstraps(t *testing.T) {
+	good := []SessionBootstrap{
+		{Domain: "example.com", Steps: []SessionStep{{URL: "https://login.example.com/"}}},
+		{Domain: "example.org", Command: "echo sid=1"},
+	}
+	if err := checkSessionBootstraps(good); err != nil {
+		t.Errorf("Expected good bootstraps to pass, got %v", err)
+	}
+
+	tests := []struct {
+		bs  []SessionBootstrap
+		err string
+	}{
+		{[]SessionBootstrap{{Command: "true"}}, "has no domain"},
+		{[]SessionBootstrap{{Domain: "a.com"}}, "exactly one of"},
+		{[]SessionBootstrap{{Domain: "a.com", Command: "true", Steps: good[0].Steps}}, "exactly one of"},
+		{[]SessionBootstrap{good[1], {Domain: "Example.org", Command: "true"}}, "more than one"},
+		{[]SessionBootstrap{{Domain: "a.com", Steps: []SessionStep{{URL: "ftp://a.com/"}}}}, "http(s) URL"},
+		{[]SessionBootstrap{{Domain: "a.com", Steps: []SessionStep{{URL: "http://a.com/", Method: "PUT"}}}}, "GET or POST"},
+	}
+	for _, test := range tests {
+		err := checkSessionBootstraps(test.bs)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected error containing %q for %+v, got %v", test.err, test.bs, err)
+		}
+	}
+}
+
+func TestSessionBootstrapsRedacted(t *testing.T) {
+	orig := Config.Sessions.Bootstraps
+	defer func() {
+		Config.Sessions.Bootstraps = orig
+	}()
+	Config.Sessions.Bootstraps = []SessionBootstrap{{
+		Domain: "example.com",
+		Steps: []SessionStep{{
+			URL:     "https://example.com/login",
+			Method:  "POST",
+			Form:    []SessionField{{Name: "password", Value: "hunter2"}},
+			Headers: []SessionField{{Name: "Authorization", Value: "Bearer abc123"}},
+		}},
+	}}
+
+	if v := EffectiveConfig().Values["sessions"]["bootstraps"].Value; v != "<redacted>" {
+		t.Errorf("Expected bootstraps to be redacted, got %v", v)
+	}
+}
+
+func TestSessionBootstrapSteps(t *testing.T) {
+	var posted url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "csrf", Value: "tok"})
+		case "/session":
+			if c, err := r.Cookie("csrf"); err != nil || c.Value != "tok" {
+				http.Error(w, "missing csrf cookie", http.StatusForbidden)
+				return
+			}
+			r.ParseForm()
+			posted = r.PostForm
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s3cret", Path: "/"})
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/home":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	b := &SessionBootstrap{
+		Domain: "127.0.0.1",
+		Steps: []SessionStep{
+			{URL: server.URL + "/login"},
+			{
+				URL:          server.URL + "/session",
+				Form:         []SessionField{{"username", "crawler"}, {"password", "hunter2"}},
+				ExpectStatus: 200,
+			},
+		},
+	}
+	jar, err := b.run(http.DefaultTransport, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to bootstrap session: %v", err)
+	}
+	if posted.Get("username") != "crawler" || posted.Get("password") != "hunter2" {
+		t.Errorf("Expected login form to be posted, got %v", posted)
+	}
+	u, _ := url.Parse(server.URL + "/some/page")
+	var sid string
+	for _, c := range jar.Cookies(u) {
+		if c.Name == "sid" {
+			sid = c.Value
+		}
+	}
+	if sid != "s3cret" {
+		t.Errorf("Expected session cookie in jar, got %v", jar.Cookies(u))
+	}
+
+	b.Steps[1].Form[1].Value = "wrong"
+	b.Steps[1].ExpectStatus = 0
+	b.Steps = append(b.Steps, SessionStep{URL: server.URL + "/missing"})
+	if _, err := b.run(http.DefaultTransport, 5*time.Second); err == nil || !strings.Contains(err.Error(), "step 2") {
+		t.Errorf("Expected the 404 of step 2 to fail the bootstrap, got %v", err)
+	}
+}
+
+func TestSessionBootstrapCommand(t *testing.T) {
+	b := &SessionBootstrap{
+		Domain:  "example.com",
+		Command: `echo "sid=$WALKER_DOMAIN"; echo; echo "pref=1; Path=/app"`,
+	}
+	jar, err := b.run(nil, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Failed to bootstrap session: %v", err)
+	}
+	tests := []struct {
+		link    string
+		cookies string
+	}{
+		{"http://example.com/", "sid=example.com"},
+		{"https://intranet.example.com/app/x", "pref=1 sid=example.com"},
+		{"http://other.com/", ""},
+	}
+	for _, test := range tests {
+		u, _ := url.Parse(test.link)
+		var got []string
+		for _, c := range jar.Cookies(u) {
+			got = append(got, c.Name+"="+c.Value)
+		}
+		if strings.Join(got, " ") != test.cookies {
+			t.Errorf("Expected cookies %q for %v, got %q", test.cookies, test.link, got)
+		}
+	}
+
+	for cmd, msg := range map[string]string{
+		"exit 3":  "exit status 3",
+		"true":    "no cookies",
+		"sleep 5": "timed out",
+	} {
+		b.Command = cmd
+		_, err := b.run(nil, 200*time.Millisecond)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Expected error containing %q from %q, got %v", msg, cmd, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ Package simplehandler provides a basic walker handler implementation
 package simplehandler
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -14,10 +15,18 @@ import (
 	"code.google.com/p/log4go"
 )
 
-// Handler implements an object that conforms to walker.Handler interface.
+// Handler implements an object that conforms to the walker.Handler and
+// walker.HandlerV2 interfaces.
 type Handler struct{}
 
-// HandleResponse just writes returned pages as files locally, naming the file
+// HandleResponse calls HandleFetch, logging any error it returns.
+func (h *Handler) HandleResponse(fr *walker.FetchResults) {
+	if err := h.HandleFetch(fr); err != nil {
+		log4go.Error(err.Error())
+	}
+}
+
+// HandleFetch just writes returned pages as files locally, naming the file
 // after the URL of the request made.
 //
 // For example, when handling the response for
@@ -25,15 +34,21 @@ type Handler struct{}
 // `$PWD/test.com/amazing` and write the page contents (no headers or HTTP
 // data) to `$PWD/test.com/amazing/stuff.html`
 //
-// It skips pages that do not have a 2XX HTTP code.
-func (h *Handler) HandleResponse(fr *walker.FetchResults) {
+// It skips pages that do not have a 2XX HTTP code, and pages marked noai if
+// fetcher.honor_meta_noai is set. It returns an error if the page couldn't
+// be written.
+func (h *Handler) HandleFetch(fr *walker.FetchResults) (err error) {
 	if fr.ExcludedByRobots {
 		log4go.Debug("Excluded by robots.txt, ignoring url: %v", fr.URL)
-		return
+		return nil
+	}
+	if walker.Config.Fetcher.HonorMetaNoai && fr.MetaNoAI {
+		log4go.Debug("Page is marked noai, ignoring url: %v", fr.URL)
+		return nil
 	}
 	if fr.Response.StatusCode < 200 || fr.Response.StatusCode >= 300 {
 		log4go.Debug("Returned %v ignoring url: %v", fr.Response.StatusCode, fr.URL)
-		return
+		return nil
 	}
 
 	path := filepath.Join(fr.URL.Host, fr.URL.RequestURI())
@@ -43,32 +58,28 @@ func (h *Handler) HandleResponse(fr *walker.FetchResults) {
 	}
 	log4go.Debug("Creating dir %v", dir)
 	if err := os.MkdirAll(dir, 0777); err != nil {
-		log4go.Error(err.Error())
-		return
+		return err
 	}
 
 	if strings.HasSuffix(path, "/") || path == dir {
 		// Don't store directory pages; no sensible name to use for them
-		return
+		return nil
 	}
 
 	out, err := os.Create(path)
 	log4go.Debug("Creating file %v", path)
 	if err != nil {
-		log4go.Error(err.Error())
-		return
+		return err
 	}
 	defer func() {
 		log4go.Debug("Closing file %v", path)
-		err := out.Close()
-		if err != nil {
-			log4go.Error(err.Error())
+		if cerr := out.Close(); err == nil && cerr != nil {
+			err = cerr
 		}
 	}()
 	log4go.Debug("Copying contents to %v", path)
-	_, err = io.Copy(out, fr.Response.Body)
-	if err != nil {
-		log4go.Error(err.Error())
-		return
+	if _, err = io.Copy(out, fr.Response.Body); err != nil {
+		return fmt.Errorf("Failed to write %v: %v", path, err)
 	}
+	return nil
 }
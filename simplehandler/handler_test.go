@@ -162,3 +162,46 @@ func TestSimpleWriterHandlerIgnoresBadHTTPCode(t *testing.T) {
 		t.Errorf("File should not have been created due http error code: %v", file)
 	}
 }
+
+func TestSimpleWriterHandlerIgnoresNoAI(t *testing.T) {
+	orig := walker.Config.Fetcher.HonorMetaNoai
+	defer func() {
+		walker.Config.Fetcher.HonorMetaNoai = orig
+	}()
+	walker.Config.Fetcher.HonorMetaNoai = true
+
+	h := &Handler{}
+
+	page4URL := walker.MustParse("http://test.com/page4.html")
+	page4Contents := []byte("<html>stuff</html>")
+	page4Fetch := &walker.FetchResults{
+		URL:      page4URL,
+		MetaNoAI: true,
+		Response: &http.Response{
+			Status:        "200 OK",
+			StatusCode:    200,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			ContentLength: 18,
+			Body:          ioutil.NopCloser(bytes.NewReader(page4Contents)),
+			Request: &http.Request{
+				Method:        "GET",
+				URL:           page4URL.URL,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				ContentLength: 18,
+				Host:          "test.com",
+			},
+		},
+	}
+
+	h.HandleResponse(page4Fetch)
+	defer os.RemoveAll("test.com")
+	file := "test.com/page4.html"
+	_, err := ioutil.ReadFile(file)
+	if err == nil {
+		t.Errorf("File should not have been created due to noai: %v", file)
+	}
+}
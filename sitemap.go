@@ -0,0 +1,304 @@
+package walker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"code.google.com/p/log4go"
+	"github.com/temoto/robotstxt.go"
+)
+
+// sitemapEntry is the <lastmod> and <changefreq> of a sitemap <url> entry
+type sitemapEntry struct {
+	lastMod time.Time
+
+	// True if lastmod gave only a date, no time of day
+	dateOnly bool
+
+	// How often the entry says its page changes (0 if it didn't say)
+	changeFreq time.Duration
+}
+
+// sitemapXML matches both a <urlset> sitemap and a <sitemapindex>
+type sitemapXML struct {
+	URLs []struct {
+		Loc        string `xml:"loc"`
+		LastMod    string `xml:"lastmod"`
+		ChangeFreq string `xml:"changefreq"`
+		Priority   string `xml:"priority"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// parseSitemap parses a sitemap or sitemap index (gzipped or not), adding the
+// entries on domain dom with a lastmod or a changefreq to entries until it
+// holds max of them. If links isn't nil, every link on dom is also appended to
+// it (until it holds max), with its lastmod and priority set as hints.
+// It returns the sitemaps listed if body is a sitemap index, and errOverLimit
+// if body decompresses to more than fetcher.max_sitemap_bytes.
+func parseSitemap(body []byte, dom string, entries map[string]sitemapEntry, links *[]*URL, max int) ([]string, error) {
+	if bytes.HasPrefix(body, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		body, err = readCapped(r, Config.Fetcher.MaxSitemapBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var sm sitemapXML
+	if err := xml.Unmarshal(body, &sm); err != nil {
+		return nil, err
+	}
+	for _, u := range sm.URLs {
+		if len(entries) >= max && (links == nil || len(*links) >= max) {
+			break
+		}
+		link, err := ParseURL(strings.TrimSpace(u.Loc))
+		if err != nil {
+			continue
+		}
+		if d, err := link.ToplevelDomainPlusOne(); err != nil || d != dom {
+			continue
+		}
+
+		var e sitemapEntry
+		badLastMod := false
+		if u.LastMod != "" {
+			e, err = parseLastMod(u.LastMod)
+			if err != nil {
+				log4go.Fine("Ignoring lastmod of sitemap entry for %v: %v", u.Loc, err)
+				badLastMod = true
+			}
+		}
+		e.changeFreq = changeFreqs[strings.ToLower(strings.TrimSpace(u.ChangeFreq))]
+		if links != nil && len(*links) < max {
+			if found, err := ParseAndNormalizeURL(link.String()); err == nil {
+				found.SitemapLastMod = e.lastMod
+				if p, err := strconv.ParseFloat(strings.TrimSpace(u.Priority), 64); err == nil && p >= 0 && p <= 1 {
+					found.SitemapPriority = p
+				}
+				*links = append(*links, found)
+			}
+		}
+		if badLastMod || (e.lastMod.IsZero() && e.changeFreq == 0) || len(entries) >= max {
+			continue
+		}
+		entries[link.String()] = e
+	}
+
+	var sitemaps []string
+	for _, s := range sm.Sitemaps {
+		sitemaps = append(sitemaps, strings.TrimSpace(s.Loc))
+	}
+	return sitemaps, nil
+}
+
+// lastModFormats are the W3C datetime formats sitemaps use, most precise first
+var lastModFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04Z07:00",
+}
+
+// parseLastMod parses a sitemap <lastmod>
+func parseLastMod(s string) (sitemapEntry, error) {
+	s = strings.TrimSpace(s)
+	for _, format := range lastModFormats {
+		if t, err := time.Parse(format, s); err == nil {
+			return sitemapEntry{lastMod: t}, nil
+		}
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return sitemapEntry{}, fmt.Errorf("Failed to parse lastmod %q", s)
+	}
+	return sitemapEntry{lastMod: t, dateOnly: true}, nil
+}
+
+// changeFreqs are the refresh intervals the sitemap <changefreq> values stand
+// for. "never" (archived pages) is taken as yearly, and "always" as changing
+// so often the page may be refreshed as soon as the dispatcher allows.
+var changeFreqs = map[string]time.Duration{
+	"always":  time.Second,
+	"hourly":  time.Hour,
+	"daily":   24 * time.Hour,
+	"weekly":  7 * 24 * time.Hour,
+	"monthly": 30 * 24 * time.Hour,
+	"yearly":  365 * 24 * time.Hour,
+	"never":   365 * 24 * time.Hour,
+}
+
+// fresh returns true if e says its link hasn't changed since lastCrawled, at
+// the given fetcher.sitemap_trust level
+func (e sitemapEntry) fresh(lastCrawled time.Time, trust string) bool {
+	if e.lastMod.IsZero() {
+		// Only a changefreq was given
+		return false
+	}
+	if e.lastMod.After(time.Now()) {
+		// A lastmod in the future says the sitemap can't be relied on
+		return false
+	}
+	switch trust {
+	case "conservative":
+		return !e.dateOnly && e.lastMod.Before(lastCrawled)
+	case "full":
+		if e.dateOnly {
+			return !e.lastMod.AddDate(0, 0, 1).After(lastCrawled)
+		}
+		return e.lastMod.Before(lastCrawled)
+	default:
+		return false
+	}
+}
+
+// sitemapFresh returns true if link was crawled before and the current host's
+// sitemap says it hasn't changed since, so it needn't be fetched again
+func (f *fetcher) sitemapFresh(link *URL) bool {
+	if Config.Fetcher.SitemapTrust == "none" || link.LastCrawled.Equal(NotYetCrawled) ||
+		link.LastCrawled.IsZero() {
+		return false
+	}
+	if f.sitemapMaxSkipAge > 0 && time.Since(link.LastCrawled) > f.sitemapMaxSkipAge {
+		return false
+	}
+	if !f.sitemapLoaded {
+		f.loadSitemaps(f.host)
+	}
+	e, ok := f.sitemap[link.String()]
+	return ok && e.fresh(link.LastCrawled, Config.Fetcher.SitemapTrust)
+}
+
+// sitemapChangeFreq returns how often the current host's sitemap says link
+// changes, or 0 if it doesn't say or fetcher.refresh_hints is off
+func (f *fetcher) sitemapChangeFreq(link *URL) time.Duration {
+	if !Config.Fetcher.RefreshHints {
+		return 0
+	}
+	if !f.sitemapLoaded {
+		f.loadSitemaps(f.host)
+	}
+	return f.sitemap[link.String()].changeFreq
+}
+
+// sitemapLink is a link listed in a sitemap, and the sitemap it was found in
+type sitemapLink struct {
+	link    *URL
+	sitemap *URL
+}
+
+// loadSitemaps reads the entries of host's sitemaps into f.sitemap, and, if
+// fetcher.sitemap_discovery is set, all the links they list into
+// f.sitemapLinks. The sitemaps are those listed in host's robots.txt, or
+// /sitemap.xml if it lists none; sitemap indexes are followed one level. Only
+// sitemaps and entries on host's domain are used.
+func (f *fetcher) loadSitemaps(host string) {
+	f.sitemapLoaded = true
+	f.sitemap = map[string]sitemapEntry{}
+	f.sitemapLinks = nil
+
+	var sitemaps []string
+	if body := f.robotsBodies[host]; body != nil {
+		if robots, err := robotstxt.FromBytes(body); err == nil {
+			sitemaps = robots.Sitemaps
+		}
+	}
+	if len(sitemaps) == 0 {
+		sitemaps = []string{"http://" + host + "/sitemap.xml"}
+	}
+
+	max := Config.Fetcher.MaxSitemapEntries
+	for depth := 0; depth < 2 && len(sitemaps) > 0; depth++ {
+		var next []string
+		for _, loc := range sitemaps {
+			if len(f.sitemap) >= max && (!Config.Fetcher.SitemapDiscovery || len(f.sitemapLinks) >= max) {
+				break
+			}
+			body, err := f.fetchSitemap(host, loc)
+			if err == errOverLimit {
+				f.overLimit(host, loc, Config.Fetcher.MaxSitemapBytes)
+				continue
+			} else if err != nil {
+				log4go.Debug("Not using sitemap %v: %v", loc, err)
+				continue
+			}
+			var links *[]*URL
+			if Config.Fetcher.SitemapDiscovery {
+				links = &[]*URL{}
+			}
+			index, err := parseSitemap(body, host, f.sitemap, links, max-len(f.sitemapLinks))
+			if err == errOverLimit {
+				f.overLimit(host, loc, Config.Fetcher.MaxSitemapBytes)
+				continue
+			} else if err != nil {
+				log4go.Debug("Failed to parse sitemap %v: %v", loc, err)
+				continue
+			}
+			if source, err := ParseURL(loc); err == nil && links != nil {
+				for _, link := range *links {
+					f.sitemapLinks = append(f.sitemapLinks, sitemapLink{link: link, sitemap: source})
+				}
+			}
+			next = append(next, index...)
+		}
+		sitemaps = next
+	}
+	log4go.Info("Read %v entries from the sitemaps of %v", len(f.sitemap), host)
+}
+
+// discoverSitemapLinks passes the links listed in host's sitemaps to the
+// datastore like links parsed from a page, if fetcher.sitemap_discovery is
+// set. Each carries the lastmod and priority its sitemap gave it, and is
+// recorded as found on the sitemap.
+func (f *fetcher) discoverSitemapLinks(host string) {
+	if !Config.Fetcher.SitemapDiscovery {
+		return
+	}
+	if !f.sitemapLoaded {
+		f.loadSitemaps(host)
+	}
+	stored := 0
+	now := time.Now()
+	for _, l := range f.sitemapLinks {
+		if !f.shouldStoreParsedLink(l.link) {
+			continue
+		}
+		f.fm.Datastore.StoreParsedURL(l.link, &FetchResults{URL: l.sitemap, FetchTime: now})
+		stored++
+	}
+	f.fm.reporter.sitemapLinks(stored)
+	log4go.Info("Stored %v links from the sitemaps of %v", stored, host)
+}
+
+// fetchSitemap GETs the sitemap at loc, which must be on host's domain. It
+// returns errOverLimit if it is larger than fetcher.max_sitemap_bytes.
+func (f *fetcher) fetchSitemap(host, loc string) ([]byte, error) {
+	parsed, err := url.Parse(loc)
+	if err != nil {
+		return nil, err
+	}
+	u := &URL{URL: parsed, LastCrawled: NotYetCrawled}
+	if dom, err := u.ToplevelDomainPlusOne(); err != nil || dom != host {
+		return nil, fmt.Errorf("not on %v", host)
+	}
+
+	res, _, err := f.fetch(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("got %v", res.Status)
+	}
+	return readCapped(res.Body, Config.Fetcher.MaxSitemapBytes)
+}
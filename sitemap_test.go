@@ -0,0 +1,170 @@
+package walker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testSitemap = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>http://test.com/timed.html</loc><lastmod>2014-03-01T10:30:00+00:00</lastmod></url>
+  <url><loc>http://test.com/minutes.html</loc><lastmod>2014-03-01T10:30Z</lastmod></url>
+  <url><loc>http://test.com/dated.html</loc><lastmod>2014-03-01</lastmod><changefreq>Daily</changefreq></url>
+  <url><loc>http://test.com/nolastmod.html</loc></url>
+  <url><loc>http://test.com/weekly.html</loc><changefreq>weekly</changefreq></url>
+  <url><loc>http://test.com/badfreq.html</loc><changefreq>sometimes</changefreq></url>
+  <url><loc>http://test.com/badlastmod.html</loc><lastmod>yesterday</lastmod></url>
+  <url><loc>http://other.com/page.html</loc><lastmod>2014-03-01</lastmod></url>
+</urlset>`
+
+func TestParseSitemap(t *testing.T) {
+	timed := time.Date(2014, 3, 1, 10, 30, 0, 0, time.UTC)
+	expected := map[string]sitemapEntry{
+		"http://test.com/timed.html":   sitemapEntry{lastMod: timed},
+		"http://test.com/minutes.html": sitemapEntry{lastMod: timed},
+		"http://test.com/dated.html": sitemapEntry{lastMod: time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC), dateOnly: true,
+			changeFreq: 24 * time.Hour},
+		"http://test.com/weekly.html": sitemapEntry{changeFreq: 7 * 24 * time.Hour},
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testSitemap))
+	w.Close()
+
+	for _, body := range [][]byte{[]byte(testSitemap), gz.Bytes()} {
+		entries := map[string]sitemapEntry{}
+		index, err := parseSitemap(body, "test.com", entries, nil, 100)
+		if err != nil {
+			t.Fatalf("parseSitemap failed: %v", err)
+		}
+		if len(index) != 0 {
+			t.Errorf("Expected no sitemaps listed, got %v", index)
+		}
+		if len(entries) != len(expected) {
+			t.Errorf("Expected %d entries, got %v", len(expected), entries)
+		}
+		for link, e := range expected {
+			if got := entries[link]; !got.lastMod.Equal(e.lastMod) || got.dateOnly != e.dateOnly ||
+				got.changeFreq != e.changeFreq {
+				t.Errorf("Entry for %v: got %+v, expected %+v", link, got, e)
+			}
+		}
+	}
+
+	entries := map[string]sitemapEntry{}
+	parseSitemap([]byte(testSitemap), "test.com", entries, nil, 2)
+	if len(entries) != 2 {
+		t.Errorf("Expected parsing to stop at 2 entries, got %v", entries)
+	}
+
+	index, err := parseSitemap([]byte(`<sitemapindex>
+		<sitemap><loc> http://test.com/sitemap1.xml </loc></sitemap>
+		<sitemap><loc>http://test.com/sitemap2.xml.gz</loc></sitemap>
+	</sitemapindex>`), "test.com", map[string]sitemapEntry{}, nil, 100)
+	if err != nil {
+		t.Fatalf("parseSitemap failed on index: %v", err)
+	}
+	if !reflect.DeepEqual(index, []string{"http://test.com/sitemap1.xml", "http://test.com/sitemap2.xml.gz"}) {
+		t.Errorf("Sitemap index mismatch, got %v", index)
+	}
+}
+
+func TestParseSitemapLinks(t *testing.T) {
+	var links []*URL
+	entries := map[string]sitemapEntry{}
+	_, err := parseSitemap([]byte(`<urlset>
+		<url><loc>http://test.com/a.html</loc><lastmod>2014-03-01</lastmod><priority>0.8</priority></url>
+		<url><loc>http://test.com/b.html</loc><priority>high</priority></url>
+		<url><loc>http://test.com/c.html</loc><lastmod>yesterday</lastmod></url>
+		<url><loc>http://other.com/d.html</loc><priority>1.0</priority></url>
+		<url><loc>http://test.com/e.html</loc></url>
+	</urlset>`), "test.com", entries, &links, 3)
+	if err != nil {
+		t.Fatalf("parseSitemap failed: %v", err)
+	}
+
+	// Every link on the domain is kept, up to the limit, whatever hints it has
+	expected := []struct {
+		link     string
+		lastMod  time.Time
+		priority float64
+	}{
+		{"http://test.com/a.html", time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC), 0.8},
+		{"http://test.com/b.html", time.Time{}, 0},
+		{"http://test.com/c.html", time.Time{}, 0},
+	}
+	if len(links) != len(expected) {
+		t.Fatalf("Expected %d links, got %v", len(expected), links)
+	}
+	for i, e := range expected {
+		if l := links[i]; l.String() != e.link || !l.SitemapLastMod.Equal(e.lastMod) || l.SitemapPriority != e.priority {
+			t.Errorf("Expected link %v (lastmod %v, priority %v), got %v (lastmod %v, priority %v)",
+				e.link, e.lastMod, e.priority, l, l.SitemapLastMod, l.SitemapPriority)
+		}
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only a.html's entry kept, got %v", entries)
+	}
+}
+
+func TestParseSitemapOverLimit(t *testing.T) {
+	orig := Config.Fetcher.MaxSitemapBytes
+	defer func() {
+		Config.Fetcher.MaxSitemapBytes = orig
+	}()
+	Config.Fetcher.MaxSitemapBytes = int64(len(testSitemap) - 1)
+
+	// A gzipped sitemap is limited by its decompressed size
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testSitemap))
+	w.Close()
+	if int64(gz.Len()) > Config.Fetcher.MaxSitemapBytes {
+		t.Fatalf("Expected the gzipped sitemap to be under the limit, it is %d bytes", gz.Len())
+	}
+
+	entries := map[string]sitemapEntry{}
+	if _, err := parseSitemap(gz.Bytes(), "test.com", entries, nil, 100); err != errOverLimit {
+		t.Errorf("Expected errOverLimit, got %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Expected no entries read from a sitemap over the limit, got %v", entries)
+	}
+}
+
+func TestSitemapEntryFresh(t *testing.T) {
+	crawled := time.Date(2014, 3, 1, 12, 0, 0, 0, time.UTC)
+	before := sitemapEntry{lastMod: crawled.Add(-time.Hour)}
+	after := sitemapEntry{lastMod: crawled.Add(time.Hour)}
+	sameDay := sitemapEntry{lastMod: time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC), dateOnly: true}
+	dayBefore := sitemapEntry{lastMod: time.Date(2014, 2, 28, 0, 0, 0, 0, time.UTC), dateOnly: true}
+	future := sitemapEntry{lastMod: time.Now().Add(time.Hour)}
+	freqOnly := sitemapEntry{changeFreq: time.Hour}
+
+	tests := []struct {
+		tag      string
+		entry    sitemapEntry
+		crawled  time.Time
+		trust    string
+		expected bool
+	}{
+		{"NoneTrust", before, crawled, "none", false},
+		{"ConservativeBefore", before, crawled, "conservative", true},
+		{"ConservativeAfter", after, crawled, "conservative", false},
+		{"ConservativeDateOnly", dayBefore, crawled, "conservative", false},
+		{"FullBefore", before, crawled, "full", true},
+		{"FullDayBefore", dayBefore, crawled, "full", true},
+		{"FullSameDay", sameDay, crawled, "full", false},
+		{"FullFuture", future, time.Now().Add(2 * time.Hour), "full", false},
+		{"FullChangeFreqOnly", freqOnly, crawled, "full", false},
+	}
+	for _, tst := range tests {
+		if got := tst.entry.fresh(tst.crawled, tst.trust); got != tst.expected {
+			t.Errorf("For tag %v expected fresh to be %v", tst.tag, tst.expected)
+		}
+	}
+}
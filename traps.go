@@ -0,0 +1,79 @@
+package walker
+
+import "strings"
+
+// Crawler traps like calendars, faceted search or session ids in links offer
+// an unbounded number of query strings on a single path, and can fill a
+// domain's uncrawled links with pages that are all the same. The dispatcher
+// looks out for them (see dispatcher.trap_escape): when most of a domain's
+// uncrawled links are on one path, it synthesizes a rule collapsing the query
+// parameters that take unbounded values there. Links the rule matches are
+// then crawled once, collapsed, instead of once per query string.
+
+// The dispatcher.trap_escape values
+const (
+	// Traps are neither detected nor escaped
+	TrapEscapeOff = "off"
+
+	// Rules are proposed, and only collapse links once an operator confirms
+	// them on the console
+	TrapEscapeConfirm = "confirm"
+
+	// Rules collapse links as soon as they are synthesized
+	TrapEscapeAggressive = "aggressive"
+)
+
+// QueryParamNames returns the names of the parameters of raw query string
+// query, in the order they appear (names repeated in query are repeated)
+func QueryParamNames(query string) []string {
+	var names []string
+	for _, pair := range strings.Split(query, "&") {
+		if pair == "" {
+			continue
+		}
+		if i := strings.Index(pair, "="); i >= 0 {
+			pair = pair[:i]
+		}
+		names = append(names, pair)
+	}
+	return names
+}
+
+// CollapseQuery drops the query parameters named in params from the request
+// URI uri (all of them if params is empty), keeping the others in order. It
+// returns uri unchanged, and false, if there was nothing to drop.
+func CollapseQuery(uri string, params []string) (string, bool) {
+	i := strings.Index(uri, "?")
+	if i < 0 {
+		return uri, false
+	}
+	path, query := uri[:i], uri[i+1:]
+	if len(params) == 0 {
+		return path, true
+	}
+
+	drop := map[string]bool{}
+	for _, p := range params {
+		drop[p] = true
+	}
+	var kept []string
+	dropped := false
+	for _, pair := range strings.Split(query, "&") {
+		name := pair
+		if j := strings.Index(pair, "="); j >= 0 {
+			name = pair[:j]
+		}
+		if drop[name] {
+			dropped = true
+		} else if pair != "" {
+			kept = append(kept, pair)
+		}
+	}
+	if !dropped {
+		return uri, false
+	}
+	if len(kept) == 0 {
+		return path, true
+	}
+	return path + "?" + strings.Join(kept, "&"), true
+}
@@ -0,0 +1,48 @@
+package walker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQueryParamNames(t *testing.T) {
+	tests := []struct {
+		query    string
+		expected string
+	}{
+		{"", ""},
+		{"a=1", "a"},
+		{"a=1&b&c=3&a=4", "a b c a"},
+		{"&&d=1&", "d"},
+	}
+	for _, test := range tests {
+		if names := strings.Join(QueryParamNames(test.query), " "); names != test.expected {
+			t.Errorf("Expected the params of %q to be %q, got %q", test.query, test.expected, names)
+		}
+	}
+}
+
+func TestCollapseQuery(t *testing.T) {
+	tests := []struct {
+		uri       string
+		params    []string
+		expected  string
+		collapsed bool
+	}{
+		{"/cal", nil, "/cal", false},
+		{"/cal?day=1&month=2", nil, "/cal", true},
+		{"/cal?", nil, "/cal", true},
+		{"/cal?day=1&month=2", []string{"day"}, "/cal?month=2", true},
+		{"/cal?month=2&day=1&day=3&lang=en", []string{"day"}, "/cal?month=2&lang=en", true},
+		{"/cal?day=1&sid", []string{"day", "sid"}, "/cal", true},
+		{"/cal?month=2", []string{"day"}, "/cal?month=2", false},
+		{"/cal?dayz=1", []string{"day"}, "/cal?dayz=1", false},
+	}
+	for _, test := range tests {
+		uri, collapsed := CollapseQuery(test.uri, test.params)
+		if uri != test.expected || collapsed != test.collapsed {
+			t.Errorf("Expected %q collapsing %v to be %q (%v), got %q (%v)",
+				test.uri, test.params, test.expected, test.collapsed, uri, collapsed)
+		}
+	}
+}
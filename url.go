@@ -8,7 +8,6 @@ import (
 	"strings"
 	"time"
 
-	"code.google.com/p/go.net/publicsuffix"
 	"github.com/PuerkitoBio/purell"
 )
 
@@ -21,6 +20,25 @@ type URL struct {
 	// LastCrawled is the last time we crawled this URL, for example to use a
 	// Last-Modified header.
 	LastCrawled time.Time
+
+	// ChainPos is this URL's position in a rel=next pagination chain (1 being
+	// the first page), or 0 if it is not known to be part of one.
+	ChainPos int
+
+	// Depth is how many links away from a seed this URL was found: 0 for
+	// seeds (and links whose depth isn't known), 1 for links found on a seed,
+	// and so on. See dispatcher.max_crawl_depth.
+	Depth int
+
+	// LastFingerprint is the FNV fingerprint of the URL's content when it was
+	// last crawled, or 0 if not known. See fetcher.skip_unchanged_pages.
+	LastFingerprint int64
+
+	// SitemapLastMod and SitemapPriority are the <lastmod> and <priority>
+	// the URL was given in a host's sitemap, if it was found in one (see
+	// fetcher.sitemap_discovery); zero if not given.
+	SitemapLastMod  time.Time
+	SitemapPriority float64
 }
 
 // CreateURL creates a walker URL from values usually pulled out of the
@@ -75,20 +93,48 @@ func setupNormalizeURL() error {
 	for _, p := range Config.Fetcher.PurgeSidList {
 		parseURLPurgeMap[strings.ToLower(p)] = true
 	}
+
+	var err error
+	hashRoutePatterns, err = aggregateRegex(Config.Fetcher.HashRoutePatterns, "hash_route_patterns")
+	if err != nil {
+		return fmt.Errorf("Failed setupParseURL: %v", err)
+	}
 	return nil
 }
 
 // ParseURL is the walker.URL equivalent of url.Parse. Note, all URL's should
-// be passed through this function so that we get consistency.
+// be passed through this function so that we get consistency. Absolute URLs
+// are canonicalized (see Canonicalize), so the datastore never stores the same
+// link twice under keys differing only in how its host was written.
 func ParseURL(ref string) (*URL, error) {
 	u, err := url.Parse(ref)
 	if err != nil {
 		return nil, err
 	}
 	wurl := &URL{URL: u, LastCrawled: NotYetCrawled}
+	wurl.Canonicalize()
 	return wurl, nil
 }
 
+// Canonicalize lower cases the scheme and host of an absolute URL, drops its
+// port if it is the scheme's default (80 for http, 443 for https), and makes
+// an empty path "/". URLs without a host are left alone.
+func (u *URL) Canonicalize() {
+	if u.Host == "" {
+		return
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(host, ":80")) ||
+		(u.Scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	u.Host = host
+	if u.Path == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+}
+
 // ParseAndNormalizeURL will walker.ParseURL the argument string,
 // and then Normalize the resulting URL.
 func ParseAndNormalizeURL(ref string) (*URL, error) {
@@ -104,6 +150,9 @@ func ParseAndNormalizeURL(ref string) (*URL, error) {
 func (u *URL) Normalize() {
 	rawURL := u.URL
 
+	// Keep hash routes the fragment removal below would drop
+	u.escapeHashRoute()
+
 	// Apply standard normalization filters to url. This call will
 	// modify the url in place.
 	purell.NormalizeURL(rawURL, purell.FlagsSafe|purell.FlagRemoveFragment)
@@ -137,8 +186,11 @@ func (u *URL) Clone() *URL {
 	}
 
 	return &URL{
-		URL:         &nurl,
-		LastCrawled: u.LastCrawled,
+		URL:             &nurl,
+		LastCrawled:     u.LastCrawled,
+		ChainPos:        u.ChainPos,
+		Depth:           u.Depth,
+		LastFingerprint: u.LastFingerprint,
 	}
 }
 
@@ -171,9 +223,9 @@ func (u *URL) NormalizedForm() *URL {
 //
 // For example the TLD of http://www.bbc.co.uk/ is 'co.uk', plus one is
 // 'bbc.co.uk'. Walker uses these TLD+1 domains as the primary unit of
-// grouping.
+// grouping. See TLDPlusOne.
 func (u *URL) ToplevelDomainPlusOne() (string, error) {
-	return publicsuffix.EffectiveTLDPlusOne(u.Host)
+	return TLDPlusOne(u.Host)
 }
 
 // Subdomain provides the remaining subdomain after removing the
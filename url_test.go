@@ -0,0 +1,31 @@
+package walker
+
+import "testing"
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		link, canonical string
+	}{
+		{"HTTP://Example.COM", "http://example.com/"},
+		{"http://example.com:80/a.html", "http://example.com/a.html"},
+		{"https://www.example.com:443?q=1", "https://www.example.com/?q=1"},
+		{"https://example.com:80/", "https://example.com:80/"},
+		{"http://example.com:8080", "http://example.com:8080/"},
+		{"/Relative/Path.html", "/Relative/Path.html"},
+	}
+	for _, test := range tests {
+		u, err := ParseURL(test.link)
+		if err != nil {
+			t.Errorf("Failed to parse %v: %v", test.link, err)
+			continue
+		}
+		if u.String() != test.canonical {
+			t.Errorf("Expected %v to be canonicalized to %v, got %v", test.link, test.canonical, u)
+		}
+	}
+
+	u, err := CreateURL("Example.com", "WWW", "", "http", NotYetCrawled)
+	if err != nil || u.String() != "http://www.example.com/" {
+		t.Errorf("Expected CreateURL to make http://www.example.com/, got %v (%v)", u, err)
+	}
+}
@@ -0,0 +1,190 @@
+package walker
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// With cassandra.add_new_domains set, an open-web crawl adds every domain it
+// finds a link to, including spam, parked and dead ones that only pollute the
+// frontier. cassandra.verify_new_domains lists checks a new domain must pass
+// before it is added (VerifyDomain runs them); links to domains that fail are
+// not stored.
+
+// The domain verification checks, in the order VerifyDomain runs them
+const (
+	// The domain (or www. under it) resolves
+	VerifyResolve = "resolve"
+
+	// It answers HTTP or HTTPS requests for its homepage, with any status
+	VerifyRespond = "respond"
+
+	// Its homepage isn't a parked page: it isn't served from, or doesn't
+	// redirect to, a known parking service, and doesn't read like one. The
+	// domain's name servers aren't a parking service's either.
+	VerifyNotParked = "not_parked"
+
+	// It publishes a DNS TXT record of cassandra.verify_txt_record, ex. to
+	// crawl only the domains that opted in
+	VerifyTXT = "txt"
+)
+
+// VerifyChecks are all the domain verification checks
+var VerifyChecks = []string{VerifyResolve, VerifyRespond, VerifyNotParked, VerifyTXT}
+
+// The DNS lookups of VerifyDomain, net's unless testing
+var (
+	verifyLookupNS  = net.LookupNS
+	verifyLookupTXT = net.LookupTXT
+)
+
+// parkingHosts are domains of parking services, matched against the host a
+// homepage is served from and the domain's name servers
+var parkingHosts = []string{
+	"above.com",
+	"bodis.com",
+	"dan.com",
+	"parkingcrew.net",
+	"parklogic.com",
+	"sedo.com",
+	"sedoparking.com",
+	"afternic.com",
+	"hugedomains.com",
+}
+
+// parkedPhrases read like a parked page, matched against the lowercased
+// homepage
+var parkedPhrases = [][]byte{
+	[]byte("this domain is for sale"),
+	[]byte("this domain may be for sale"),
+	[]byte("buy this domain"),
+	[]byte("domain is parked"),
+	[]byte("parked free"),
+	[]byte("domain parking"),
+	[]byte("parkingcrew"),
+	[]byte("sedoparking"),
+}
+
+// onParkingHost returns true if host is, or is under, one of parkingHosts
+func onParkingHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, p := range parkingHosts {
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyDomain runs the given verification checks (see VerifyChecks) on dom,
+// in the order of VerifyChecks, making its requests through transport
+// (http.DefaultTransport if nil) with the configured user agent and
+// fetcher.http_timeout. Checks that need the domain to resolve, or its
+// homepage, fail without trying if it doesn't.
+func VerifyDomain(dom string, checks []string, transport http.RoundTripper) *PreflightReport {
+	r := &PreflightReport{Link: "http://" + dom + "/", Domain: dom}
+	run := map[string]bool{}
+	for _, c := range checks {
+		run[c] = true
+	}
+
+	host := dom
+	addrs, err := preflightLookup(host)
+	if err != nil {
+		host = "www." + dom
+		addrs, err = preflightLookup(host)
+	}
+	if err != nil {
+		for _, c := range VerifyChecks {
+			if run[c] && c != VerifyTXT {
+				r.add(c, false, "%v does not resolve", dom)
+			}
+		}
+	} else {
+		if run[VerifyResolve] {
+			r.add(VerifyResolve, true, "%v resolves to %v", host, addrs)
+		}
+		if run[VerifyRespond] || run[VerifyNotParked] {
+			verifyHomepage(r, host, run, transport)
+		}
+	}
+
+	if run[VerifyTXT] {
+		records, err := verifyLookupTXT(dom)
+		found := false
+		for _, rec := range records {
+			found = found || strings.TrimSpace(rec) == Config.Cassandra.VerifyTXTRecord
+		}
+		if err != nil {
+			r.add(VerifyTXT, false, "%v", err)
+		} else if !found {
+			r.add(VerifyTXT, false, "No TXT record %q", Config.Cassandra.VerifyTXTRecord)
+		} else {
+			r.add(VerifyTXT, true, "Has TXT record %q", Config.Cassandra.VerifyTXTRecord)
+		}
+	}
+	return r
+}
+
+// verifyHomepage runs the respond and not_parked checks (those set in run) on
+// the homepage of host
+func verifyHomepage(r *PreflightReport, host string, run map[string]bool, transport http.RoundTripper) {
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	timeout, err := time.ParseDuration(Config.Fetcher.HTTPTimeout)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+
+	var status int
+	var body []byte
+	var final *url.URL
+	for _, scheme := range []string{"http", "https"} {
+		status, body, final, err = preflightGet(client, scheme+"://"+host+"/")
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		if run[VerifyRespond] {
+			r.add(VerifyRespond, false, "%v", err)
+		}
+		if run[VerifyNotParked] {
+			r.add(VerifyNotParked, false, "Skipped: the homepage didn't answer")
+		}
+		return
+	}
+	if run[VerifyRespond] {
+		r.add(VerifyRespond, true, "Homepage answered %v", status)
+	}
+	if !run[VerifyNotParked] {
+		return
+	}
+
+	if onParkingHost(final.Host) {
+		r.add(VerifyNotParked, false, "Homepage is served from parking service %v", final.Host)
+		return
+	}
+	lower := bytes.ToLower(body)
+	for _, phrase := range parkedPhrases {
+		if bytes.Contains(lower, phrase) {
+			r.add(VerifyNotParked, false, "Homepage reads like a parked page (%q)", phrase)
+			return
+		}
+	}
+	if servers, err := verifyLookupNS(r.Domain); err == nil {
+		for _, ns := range servers {
+			if onParkingHost(ns.Host) {
+				r.add(VerifyNotParked, false, "Name server %v is a parking service's", ns.Host)
+				return
+			}
+		}
+	}
+	r.add(VerifyNotParked, true, "Not parked")
+}
@@ -0,0 +1,100 @@
+package walker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// downRoundTrip fails every request to down.com, and serves the rest from a
+// mapRoundTrip
+type downRoundTrip struct {
+	mapRoundTrip
+}
+
+func (rt *downRoundTrip) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "down.com" {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return rt.mapRoundTrip.RoundTrip(req)
+}
+
+func TestVerifyDomain(t *testing.T) {
+	defer func(lookup func(string) ([]string, error)) { preflightLookup = lookup }(preflightLookup)
+	preflightLookup = func(host string) ([]string, error) {
+		if host == "nowhere.com" || host == "www.nowhere.com" || host == "wwwonly.com" {
+			return nil, fmt.Errorf("no such host")
+		}
+		return []string{"93.184.216.34"}, nil
+	}
+	defer func(lookup func(string) ([]*net.NS, error)) { verifyLookupNS = lookup }(verifyLookupNS)
+	verifyLookupNS = func(dom string) ([]*net.NS, error) {
+		if dom == "nsparked.com" {
+			return []*net.NS{{Host: "ns1.sedoparking.com."}}, nil
+		}
+		return []*net.NS{{Host: "ns1.example-dns.net."}}, nil
+	}
+	defer func(lookup func(string) ([]string, error)) { verifyLookupTXT = lookup }(verifyLookupTXT)
+	verifyLookupTXT = func(dom string) ([]string, error) {
+		if dom == "good.com" {
+			return []string{"v=spf1 -all", "walker-crawl=allow"}, nil
+		}
+		return nil, nil
+	}
+	origTXT := Config.Cassandra.VerifyTXTRecord
+	defer func() { Config.Cassandra.VerifyTXTRecord = origTXT }()
+	Config.Cassandra.VerifyTXTRecord = "walker-crawl=allow"
+
+	page := func(body string) *http.Response {
+		res := response200()
+		res.Body = ioutil.NopCloser(strings.NewReader(body))
+		return res
+	}
+	// Responses can only be read once, so each VerifyDomain gets its own
+	transport := func() http.RoundTripper {
+		return &downRoundTrip{mapRoundTrip{Responses: map[string]*http.Response{
+			"http://good.com/":        page("<html><body>Welcome</body></html>"),
+			"http://www.wwwonly.com/": page("<html><body>Welcome</body></html>"),
+			"http://forsale.com/":     page("<html><body>This Domain Is For Sale!</body></html>"),
+			"http://redirected.com/":  response307("http://sedo.com/park"),
+			"http://sedo.com/park":    page("<html></html>"),
+			"http://nsparked.com/":    page("<html><body>Welcome</body></html>"),
+		}}}
+	}
+
+	all := VerifyChecks
+	tests := []struct {
+		dom    string
+		checks []string
+		failed []string
+	}{
+		{"good.com", all, nil},
+		{"wwwonly.com", []string{VerifyResolve, VerifyRespond, VerifyNotParked}, nil},
+		{"nowhere.com", all, []string{VerifyResolve, VerifyRespond, VerifyNotParked, VerifyTXT}},
+		{"nowhere.com", []string{VerifyRespond}, []string{VerifyRespond}},
+		{"down.com", all, []string{VerifyRespond, VerifyNotParked, VerifyTXT}},
+		{"forsale.com", []string{VerifyResolve, VerifyRespond, VerifyNotParked}, []string{VerifyNotParked}},
+		{"forsale.com", []string{VerifyResolve, VerifyRespond}, nil},
+		{"redirected.com", []string{VerifyNotParked}, []string{VerifyNotParked}},
+		{"nsparked.com", []string{VerifyNotParked}, []string{VerifyNotParked}},
+	}
+	for _, test := range tests {
+		r := VerifyDomain(test.dom, test.checks, transport())
+		var failed []string
+		for _, c := range r.Checks {
+			if !c.Passed {
+				failed = append(failed, c.Name)
+			}
+		}
+		if fmt.Sprint(failed) != fmt.Sprint(test.failed) {
+			t.Errorf("VerifyDomain(%v, %v): expected failed checks %v, got %+v", test.dom, test.checks,
+				test.failed, r.Checks)
+		}
+		if r.Passed() != (len(test.failed) == 0) {
+			t.Errorf("VerifyDomain(%v, %v): Passed() returned %v", test.dom, test.checks, r.Passed())
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package walker
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"code.google.com/p/go.net/html"
+	"code.google.com/p/log4go"
+)
+
+// Watch rules (watch.rules) turn walker into a page change monitor. Each rule
+// selects part of the pages of a domain with a CSS selector or XPath; the
+// text it selects is kept in the page's PageState, and when it changes
+// between crawls (or, if the rule gives an expected value, when it stops
+// matching that) the change is recorded in FetchResults.WatchChanges, for the
+// datastore to keep, and a watch_changed webhook is fired.
+
+// WatchRule is one watch.rules entry
+type WatchRule struct {
+	// Names the rule in change events; must be unique
+	Name string `yaml:"name"`
+
+	// The domain (top level domain plus one, ex. "example.com") whose pages
+	// are watched
+	Domain string `yaml:"domain"`
+
+	// A regular expression the path (with query) of a page must match to be
+	// watched; all pages of Domain if empty
+	Path string `yaml:"path"`
+
+	// The content watched, as a CSS selector or an XPath location path (set
+	// exactly one). The watched value is the text of the selected elements,
+	// one per line.
+	Selector string `yaml:"selector"`
+	XPath    string `yaml:"xpath"`
+
+	// If set, a change is recorded when the watched value changes to
+	// something other than Expected, rather than on any change
+	Expected string `yaml:"expected"`
+}
+
+// WatchChange is a change in the content a watch rule selects
+type WatchChange struct {
+	// The WatchRule's name
+	Rule string
+
+	// The watched value before the change ("" if it wasn't recorded before),
+	// and after
+	Previous string
+	Current  string
+
+	// The value the rule expected, if any
+	Expected string
+
+	// When the change was seen
+	Time time.Time
+}
+
+// watchRule is a compiled WatchRule
+type watchRule struct {
+	WatchRule
+	path *regexp.Regexp
+	sel  selector
+}
+
+// compileWatchRules compiles rules, failing on the first bad one
+func compileWatchRules(rules []WatchRule) ([]*watchRule, error) {
+	var compiled []*watchRule
+	names := map[string]bool{}
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("rule %d has no name", i)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("rule name %q is used more than once", r.Name)
+		}
+		names[r.Name] = true
+		if r.Domain == "" {
+			return nil, fmt.Errorf("rule %q has no domain", r.Name)
+		}
+
+		wr := &watchRule{WatchRule: r}
+		wr.Domain = strings.ToLower(r.Domain)
+		var err error
+		if r.Path != "" {
+			wr.path, err = regexp.Compile(r.Path)
+			if err != nil {
+				return nil, fmt.Errorf("rule %q has a bad path: %v", r.Name, err)
+			}
+		}
+		switch {
+		case r.Selector != "" && r.XPath != "":
+			return nil, fmt.Errorf("rule %q sets both selector and xpath", r.Name)
+		case r.Selector != "":
+			wr.sel, err = parseCSSSelector(r.Selector)
+		case r.XPath != "":
+			wr.sel, err = parseXPath(r.XPath)
+		default:
+			err = fmt.Errorf("rule %q sets neither selector nor xpath", r.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, wr)
+	}
+	return compiled, nil
+}
+
+// watchRulesFor returns the rules of fm that apply to u
+func (fm *FetchManager) watchRulesFor(u *URL) []*watchRule {
+	if len(fm.watchRules) == 0 {
+		return nil
+	}
+	dom, err := u.ToplevelDomainPlusOne()
+	if err != nil {
+		return nil
+	}
+	var rules []*watchRule
+	for _, r := range fm.watchRules {
+		if r.Domain == dom && (r.path == nil || r.path.MatchString(u.RequestURI())) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// watchValues returns the value each of rules selects in the HTML body, by
+// rule name
+func watchValues(body []byte, rules []*watchRule) map[string]string {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		log4go.Debug("Failed to parse page for watch rules: %v", err)
+		return nil
+	}
+	values := map[string]string{}
+	for _, r := range rules {
+		var texts []string
+		for _, n := range r.sel.find(doc) {
+			texts = append(texts, nodeText(n))
+		}
+		values[r.Name] = strings.Join(texts, "\n")
+	}
+	return values
+}
+
+// watchChanges compares the current watched values with the previous ones,
+// returning the changes rules should report
+func watchChanges(rules []*watchRule, prev, cur map[string]string, now time.Time) []WatchChange {
+	var changes []WatchChange
+	for _, r := range rules {
+		before, seen := prev[r.Name]
+		after := cur[r.Name]
+		if r.Expected != "" {
+			if after == r.Expected || (seen && after == before) {
+				continue
+			}
+		} else if !seen || after == before {
+			continue
+		}
+		changes = append(changes, WatchChange{
+			Rule:     r.Name,
+			Previous: before,
+			Current:  after,
+			Expected: r.Expected,
+			Time:     now,
+		})
+	}
+	return changes
+}
+
+// fireWatchChanges fires a watch_changed webhook for each of fr's WatchChanges
+func fireWatchChanges(fr *FetchResults) {
+	dom, _ := fr.URL.ToplevelDomainPlusOne()
+	for _, c := range fr.WatchChanges {
+		log4go.Info("Watch rule %v saw a change on %v", c.Rule, fr.URL)
+		FireWebhook(NewWebhookEvent(WebhookWatchChanged, dom,
+			fmt.Sprintf("Watch rule %v saw %v change from %q to %q", c.Rule, fr.URL, c.Previous, c.Current),
+			map[string]interface{}{
+				"rule":     c.Rule,
+				"url":      fr.URL.String(),
+				"previous": c.Previous,
+				"current":  c.Current,
+				"expected": c.Expected,
+			}))
+	}
+}
@@ -0,0 +1,141 @@
+package walker
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompileWatchRules(t *testing.T) {
+	good := WatchRule{Name: "price", Domain: "Example.com", Path: "^/products/", Selector: "#price"}
+	rules, err := compileWatchRules([]WatchRule{good, {Name: "stock", Domain: "example.com", XPath: "//div"}})
+	if err != nil {
+		t.Fatalf("Failed to compile good rules: %v", err)
+	}
+	if len(rules) != 2 || rules[0].Domain != "example.com" || rules[0].path == nil || rules[1].path != nil {
+		t.Errorf("Compiled rules not as expected: %+v", rules)
+	}
+
+	tests := []struct {
+		tag   string
+		rules []WatchRule
+	}{
+		{"no name", []WatchRule{{Domain: "a.com", Selector: "p"}}},
+		{"repeated name", []WatchRule{good, good}},
+		{"no domain", []WatchRule{{Name: "a", Selector: "p"}}},
+		{"bad path", []WatchRule{{Name: "a", Domain: "a.com", Path: "(", Selector: "p"}}},
+		{"both selectors", []WatchRule{{Name: "a", Domain: "a.com", Selector: "p", XPath: "//p"}}},
+		{"no selector", []WatchRule{{Name: "a", Domain: "a.com"}}},
+		{"bad selector", []WatchRule{{Name: "a", Domain: "a.com", Selector: "p >"}}},
+		{"bad xpath", []WatchRule{{Name: "a", Domain: "a.com", XPath: "p"}}},
+	}
+	for _, test := range tests {
+		if _, err := compileWatchRules(test.rules); err == nil {
+			t.Errorf("Expected rules with %v to fail to compile", test.tag)
+		}
+	}
+}
+
+func TestWatchRulesFor(t *testing.T) {
+	fm := &FetchManager{}
+	var err error
+	fm.watchRules, err = compileWatchRules([]WatchRule{
+		{Name: "all", Domain: "a.com", Selector: "p"},
+		{Name: "products", Domain: "a.com", Path: `^/products/\d+$`, Selector: "p"},
+		{Name: "other", Domain: "b.com", Selector: "p"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+
+	tests := []struct {
+		link     string
+		expected []string
+	}{
+		{"http://www.a.com/", []string{"all"}},
+		{"http://a.com/products/12", []string{"all", "products"}},
+		{"http://a.com/products/12?color=red", []string{"all"}},
+		{"https://b.com/products/12", []string{"other"}},
+		{"http://c.com/", nil},
+	}
+	for _, test := range tests {
+		var names []string
+		for _, r := range fm.watchRulesFor(MustParse(test.link)) {
+			names = append(names, r.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("Rules for %v got %v, expected %v", test.link, names, test.expected)
+		}
+	}
+}
+
+func TestWatchValues(t *testing.T) {
+	rules, err := compileWatchRules([]WatchRule{
+		{Name: "price", Domain: "a.com", Selector: ".price"},
+		{Name: "stock", Domain: "a.com", XPath: "//div[@class='stock']/span"},
+		{Name: "missing", Domain: "a.com", Selector: "table"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+	expected := map[string]string{"price": "9.99 USD\n19.99", "stock": "In stock", "missing": ""}
+	got := watchValues([]byte(selectorTestPage), rules)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("watchValues got %q, expected %q", got, expected)
+	}
+}
+
+func TestWatchChanges(t *testing.T) {
+	rules, err := compileWatchRules([]WatchRule{
+		{Name: "price", Domain: "a.com", Selector: ".price"},
+		{Name: "stock", Domain: "a.com", Selector: ".stock", Expected: "In stock"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile rules: %v", err)
+	}
+	now := time.Now()
+
+	tests := []struct {
+		tag      string
+		prev     map[string]string
+		cur      map[string]string
+		expected []WatchChange
+	}{
+		{
+			tag: "first sighting",
+			cur: map[string]string{"price": "9.99", "stock": "In stock"},
+		},
+		{
+			tag: "first sighting not as expected",
+			cur: map[string]string{"price": "9.99", "stock": "Sold out"},
+			expected: []WatchChange{
+				{Rule: "stock", Current: "Sold out", Expected: "In stock", Time: now},
+			},
+		},
+		{
+			tag:  "no change",
+			prev: map[string]string{"price": "9.99", "stock": "Sold out"},
+			cur:  map[string]string{"price": "9.99", "stock": "Sold out"},
+		},
+		{
+			tag:  "changes",
+			prev: map[string]string{"price": "9.99", "stock": "Sold out"},
+			cur:  map[string]string{"price": "8.99", "stock": "Backordered"},
+			expected: []WatchChange{
+				{Rule: "price", Previous: "9.99", Current: "8.99", Time: now},
+				{Rule: "stock", Previous: "Sold out", Current: "Backordered", Expected: "In stock", Time: now},
+			},
+		},
+		{
+			tag:  "back to expected",
+			prev: map[string]string{"price": "9.99", "stock": "Sold out"},
+			cur:  map[string]string{"price": "9.99", "stock": "In stock"},
+		},
+	}
+	for _, test := range tests {
+		got := watchChanges(rules, test.prev, test.cur, now)
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("watchChanges for %v got %+v, expected %+v", test.tag, got, test.expected)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package walker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"code.google.com/p/log4go"
+)
+
+// The events webhooks can subscribe to (see webhooks.hooks)
+const (
+	// A fetcher got through every link of a domain's segment
+	WebhookDomainCompleted = "domain_completed"
+
+	// The share of fetches of a claimed domain that failed (fetch errors and
+	// 5xx responses) went over webhooks.error_rate_threshold. Fired at most
+	// once per claim.
+	WebhookDomainErrorRate = "domain_error_rate"
+
+	// A host's robots.txt now disallows walker from crawling "/", where the
+	// last copy (handed over in the domain's HostContext) didn't
+	WebhookRobotsBlocked = "robots_blocked"
+
+	// A dispatcher domain iteration has been running longer than
+	// webhooks.dispatcher_stall_time
+	WebhookDispatcherStalled = "dispatcher_stalled"
+
+	// No dispatcher domain iteration has finished for
+	// webhooks.round_overdue_time
+	WebhookDispatcherRoundOverdue = "dispatcher_round_overdue"
+
+	// The content a watch rule (see watch.rules) selects on a page changed
+	WebhookWatchChanged = "watch_changed"
+)
+
+// WebhookEventNames lists every event a webhook can subscribe to
+var WebhookEventNames = []string{
+	WebhookDomainCompleted,
+	WebhookDomainErrorRate,
+	WebhookRobotsBlocked,
+	WebhookDispatcherStalled,
+	WebhookDispatcherRoundOverdue,
+	WebhookWatchChanged,
+}
+
+// WebhookConfig is one webhooks.hooks entry
+type WebhookConfig struct {
+	// Where the payload is POSTed
+	URL string `yaml:"url"`
+
+	// The events (see WebhookEventNames) sent to this hook
+	Events []string `yaml:"events"`
+
+	// A text/template executed with the WebhookEvent to make the request
+	// body. If empty, the event is sent as JSON (see WebhookEvent.JSON).
+	Payload string `yaml:"payload"`
+
+	// The request's Content-Type, "application/json" if empty
+	ContentType string `yaml:"content_type"`
+}
+
+// WebhookEvent is something that happened during a crawl that operators may
+// want to hear about. It is the data payload templates are executed with.
+type WebhookEvent struct {
+	// One of WebhookEventNames
+	Event string
+
+	Time time.Time
+
+	// The host name of the machine the event happened on
+	Node string
+
+	// The domain the event is about, if any
+	Domain string
+
+	// A one line, human readable description of the event
+	Message string
+
+	// Event specific values, ex. "fetched" and "errors" for domain_completed
+	Data map[string]interface{}
+}
+
+// NewWebhookEvent creates a WebhookEvent happening now on this node
+func NewWebhookEvent(event, domain, message string, data map[string]interface{}) *WebhookEvent {
+	node, _ := os.Hostname()
+	return &WebhookEvent{
+		Event:   event,
+		Time:    time.Now(),
+		Node:    node,
+		Domain:  domain,
+		Message: message,
+		Data:    data,
+	}
+}
+
+// JSON returns the default payload for e: an object with its fields in
+// snake_case, plus a "text" field holding the message, so it can be sent
+// straight to a Slack incoming webhook.
+func (e *WebhookEvent) JSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"event":   e.Event,
+		"time":    e.Time,
+		"node":    e.Node,
+		"domain":  e.Domain,
+		"message": e.Message,
+		"data":    e.Data,
+		"text":    e.Message,
+	})
+}
+
+// webhookFuncs are available to payload templates. json encodes a value as
+// JSON, so templated strings are escaped correctly, ex.
+//
+//	{"text": {{json .Message}}}
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parseWebhookPayload parses a WebhookConfig.Payload template
+func parseWebhookPayload(payload string) (*template.Template, error) {
+	return template.New("payload").Funcs(webhookFuncs).Parse(payload)
+}
+
+type webhook struct {
+	WebhookConfig
+	payload *template.Template
+	events  map[string]bool
+}
+
+// maxWebhookDeliveries is the most webhook requests Webhooks has in flight at
+// once; events fired while it is at the limit are dropped (and logged)
+const maxWebhookDeliveries = 16
+
+// Webhooks sends WebhookEvents to the hooks subscribed to them. Delivery
+// happens in the background so firing an event never holds up a crawl, and
+// failed deliveries are logged rather than retried.
+type Webhooks struct {
+	hooks  []*webhook
+	client *http.Client
+
+	// Limits the deliveries in flight, and tracks them for Wait
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewWebhooks creates Webhooks for the given webhooks.hooks entries, each
+// request timing out after timeout.
+func NewWebhooks(configs []WebhookConfig, timeout time.Duration) (*Webhooks, error) {
+	w := &Webhooks{
+		client: &http.Client{Timeout: timeout},
+		slots:  make(chan struct{}, maxWebhookDeliveries),
+	}
+	for i, cfg := range configs {
+		if cfg.URL == "" {
+			return nil, fmt.Errorf("Webhook %d has no url", i)
+		}
+		h := &webhook{WebhookConfig: cfg, events: map[string]bool{}}
+		for _, ev := range cfg.Events {
+			if !isWebhookEvent(ev) {
+				return nil, fmt.Errorf("Webhook %d has unknown event %q", i, ev)
+			}
+			h.events[ev] = true
+		}
+		if cfg.Payload != "" {
+			var err error
+			h.payload, err = parseWebhookPayload(cfg.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("Webhook %d payload failed to parse: %v", i, err)
+			}
+		}
+		if h.ContentType == "" {
+			h.ContentType = "application/json"
+		}
+		w.hooks = append(w.hooks, h)
+	}
+	return w, nil
+}
+
+func isWebhookEvent(event string) bool {
+	for _, ev := range WebhookEventNames {
+		if ev == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Fire sends e to every hook subscribed to e.Event
+func (w *Webhooks) Fire(e *WebhookEvent) {
+	for _, h := range w.hooks {
+		if !h.events[e.Event] {
+			continue
+		}
+		body, err := h.render(e)
+		if err != nil {
+			log4go.Error("Failed to render %v webhook payload for %v: %v", e.Event, h.URL, err)
+			continue
+		}
+
+		select {
+		case w.slots <- struct{}{}:
+		default:
+			log4go.Warn("Dropping %v webhook to %v, too many deliveries in flight", e.Event, h.URL)
+			continue
+		}
+		w.wg.Add(1)
+		go func(h *webhook) {
+			defer func() {
+				<-w.slots
+				w.wg.Done()
+			}()
+			if err := w.deliver(h, body); err != nil {
+				log4go.Error("Failed to send %v webhook to %v: %v", e.Event, h.URL, err)
+			}
+		}(h)
+	}
+}
+
+// Wait waits for deliveries in flight to finish
+func (w *Webhooks) Wait() {
+	w.wg.Wait()
+}
+
+func (h *webhook) render(e *WebhookEvent) ([]byte, error) {
+	if h.payload == nil {
+		return e.JSON()
+	}
+	var buf bytes.Buffer
+	if err := h.payload.Execute(&buf, e); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *Webhooks) deliver(h *webhook, body []byte) error {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", h.ContentType)
+	req.Header.Set("User-Agent", Config.Fetcher.UserAgent)
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("got %v", res.Status)
+	}
+	return nil
+}
+
+// The Webhooks for Config.Webhooks, created on first use by FireWebhook, and
+// the config they were created from
+var configWebhooks *Webhooks
+var configWebhooksKey string
+var configWebhooksMu sync.Mutex
+
+// configuredWebhooks returns the Webhooks for Config.Webhooks, recreating
+// them if the config has changed since they were created. It returns nil if
+// no hooks are configured.
+func configuredWebhooks() *Webhooks {
+	configWebhooksMu.Lock()
+	defer configWebhooksMu.Unlock()
+
+	key := fmt.Sprintf("%v %v", Config.Webhooks.Hooks, Config.Webhooks.Timeout)
+	if key == configWebhooksKey {
+		return configWebhooks
+	}
+	configWebhooksKey = key
+	configWebhooks = nil
+	if len(Config.Webhooks.Hooks) == 0 {
+		return nil
+	}
+
+	timeout, err := time.ParseDuration(Config.Webhooks.Timeout)
+	if err != nil {
+		panic(err) // This won't happen b/c this duration is checked in Config
+	}
+	w, err := NewWebhooks(Config.Webhooks.Hooks, timeout)
+	if err != nil {
+		log4go.Error("Not sending webhooks: %v", err)
+		return nil
+	}
+	configWebhooks = w
+	return w
+}
+
+// FireWebhook sends e to the configured webhooks (see webhooks.hooks)
+// subscribed to its event. It returns right away; delivery happens in the
+// background.
+func FireWebhook(e *WebhookEvent) {
+	w := configuredWebhooks()
+	if w == nil {
+		return
+	}
+	log4go.Fine("Firing %v webhook: %v", e.Event, e.Message)
+	w.Fire(e)
+}
+
+// formatPercent formats a fraction as a percentage for event messages
+func formatPercent(f float64) string {
+	return strings.TrimSuffix(strings.TrimRight(fmt.Sprintf("%.1f", f*100), "0"), ".") + "%"
+}
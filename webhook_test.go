@@ -0,0 +1,106 @@
+package walker
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is an HTTP server recording the bodies POSTed to it, by path
+type webhookRecorder struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies map[string][]string
+}
+
+func newWebhookRecorder() *webhookRecorder {
+	r := &webhookRecorder{bodies: map[string][]string{}}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], string(body))
+		r.mu.Unlock()
+	}))
+	return r
+}
+
+func (r *webhookRecorder) received(path string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.bodies[path]
+}
+
+func TestWebhooksFire(t *testing.T) {
+	rec := newWebhookRecorder()
+	defer rec.Close()
+
+	w, err := NewWebhooks([]WebhookConfig{
+		{
+			URL:     rec.URL + "/templated",
+			Events:  []string{WebhookDomainCompleted},
+			Payload: `{"summary": {{json .Message}}, "fetched": {{.Data.fetched}}}`,
+		},
+		{
+			URL:    rec.URL + "/default",
+			Events: []string{WebhookDomainCompleted, WebhookRobotsBlocked},
+		},
+	}, time.Second)
+	if err != nil {
+		t.Fatalf("NewWebhooks failed: %v", err)
+	}
+
+	w.Fire(NewWebhookEvent(WebhookDomainCompleted, "test.com", `Finished "test.com"`,
+		map[string]interface{}{"fetched": 3}))
+	w.Fire(NewWebhookEvent(WebhookRobotsBlocked, "test.com", "Blocked", nil))
+	w.Fire(NewWebhookEvent(WebhookDispatcherStalled, "", "Stalled", nil))
+	w.Wait()
+
+	templated := rec.received("/templated")
+	if len(templated) != 1 {
+		t.Fatalf("Expected 1 templated webhook, got %v", templated)
+	}
+	if templated[0] != `{"summary": "Finished \"test.com\"", "fetched": 3}` {
+		t.Errorf("Templated payload mismatch, got %v", templated[0])
+	}
+
+	def := rec.received("/default")
+	if len(def) != 2 {
+		t.Fatalf("Expected 2 default webhooks, got %v", def)
+	}
+	events := map[string]bool{}
+	for _, body := range def {
+		var payload map[string]interface{}
+		if err := json.Unmarshal([]byte(body), &payload); err != nil {
+			t.Fatalf("Failed to decode default payload %v: %v", body, err)
+		}
+		if payload["domain"] != "test.com" || payload["text"] != payload["message"] {
+			t.Errorf("Default payload mismatch, got %v", body)
+		}
+		events[payload["event"].(string)] = true
+	}
+	if !events[WebhookDomainCompleted] || !events[WebhookRobotsBlocked] {
+		t.Errorf("Expected domain_completed and robots_blocked events, got %v", events)
+	}
+}
+
+func TestNewWebhooksErrors(t *testing.T) {
+	tests := []struct {
+		config   WebhookConfig
+		expected string
+	}{
+		{WebhookConfig{Events: []string{WebhookDomainCompleted}}, "has no url"},
+		{WebhookConfig{URL: "http://hooks.test.com", Events: []string{"domain_exploded"}}, "unknown event"},
+		{WebhookConfig{URL: "http://hooks.test.com", Payload: "{{.Message"}, "failed to parse"},
+	}
+	for _, tst := range tests {
+		_, err := NewWebhooks([]WebhookConfig{tst.config}, time.Second)
+		if err == nil || !strings.Contains(err.Error(), tst.expected) {
+			t.Errorf("Expected error containing %q for %+v, got %v", tst.expected, tst.config, err)
+		}
+	}
+}